@@ -0,0 +1,37 @@
+// Package avr compiles IR to a program for an ATmega microcontroller: an
+// Intel HEX file of AVR machine code, flashed with avrdude, that does its
+// I/O over the serial port.
+package avr
+
+import (
+	"fmt"
+
+	"github.com/lcox74/bfcc/bf/backend/elf"
+	"github.com/lcox74/bfcc/bf/ir"
+	"github.com/lcox74/bfcc/internal/codegen/avr"
+)
+
+// MCU describes a supported microcontroller: its flash, SRAM and clock.
+type MCU = avr.MCU
+
+// Costs is the code size of each op in a program, for
+// optimise.Options.Costs.
+var Costs = &avr.Costs
+
+// Lookup returns the microcontroller with the avrdude part name name,
+// atmega328p or atmega2560, or nil if it is not supported.
+func Lookup(name string) *MCU {
+	return avr.MCUs[name]
+}
+
+// Build returns an Intel HEX file running ops on the microcontroller
+// named mcu. Of the elf package's options it only supports the cell
+// model, WithMidTape, WithDebug and WithProgress. The tape is the MCU's
+// TapeSize cells, and it fails if the code does not fit its flash.
+func Build(ops []ir.Op, mcu string, opts ...elf.Option) ([]byte, error) {
+	m := Lookup(mcu)
+	if m == nil {
+		return nil, fmt.Errorf("unknown microcontroller: %s", mcu)
+	}
+	return avr.NewGenerator(ops, m, opts...).GenerateHex()
+}
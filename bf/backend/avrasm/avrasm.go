@@ -0,0 +1,55 @@
+// Package avrasm compiles IR to AVR assembly source for avr-gcc, as a main
+// function and a .bss tape for its startup code and linker scripts to
+// place. The I/O is USART0 or bf_getc and bf_putc functions of your own,
+// and the tape size is an option, for any ATmega wiring.
+package avrasm
+
+import (
+	"github.com/lcox74/bfcc/bf/backend/avr"
+	"github.com/lcox74/bfcc/bf/ir"
+	"github.com/lcox74/bfcc/internal/codegen/avrasm"
+)
+
+// Option configures the generated program.
+type Option = avrasm.Option
+
+// IO is how a program does its I/O: UART or Extern.
+type IO = avrasm.IO
+
+// I/O strategies.
+const (
+	UART   = avrasm.UART
+	Extern = avrasm.Extern
+)
+
+// Generate returns assembly source running ops.
+func Generate(ops []ir.Op, opts ...Option) string {
+	return avrasm.NewGenerator(ops, opts...).Generate()
+}
+
+// WithMCU sets the microcontroller the program is for (default the
+// atmega328p), from avr.Lookup.
+func WithMCU(mcu *avr.MCU) Option { return avrasm.WithMCU(mcu) }
+
+// WithTapeSize sets the number of cells on the tape (default the MCU's
+// TapeSize).
+func WithTapeSize(n int) Option { return avrasm.WithTapeSize(n) }
+
+// WithIO sets how the program does its I/O (default UART).
+func WithIO(io IO) Option { return avrasm.WithIO(io) }
+
+// WithBaud sets the speed of USART0 with UART I/O (default 9600).
+func WithBaud(baud int) Option { return avrasm.WithBaud(baud) }
+
+// WithCellOverflow sets the cell overflow policy (default ir.OverflowWrap).
+func WithCellOverflow(o ir.CellOverflow) Option { return avrasm.WithCellOverflow(o) }
+
+// WithSignedCells treats cells as signed bytes.
+func WithSignedCells() Option { return avrasm.WithSignedCells() }
+
+// WithMidTape starts the data pointer in the middle of the tape.
+func WithMidTape() Option { return avrasm.WithMidTape() }
+
+// WithProgress calls report with the number of ops emitted so far as
+// Generate works through them.
+func WithProgress(report func(done, total int)) Option { return avrasm.WithProgress(report) }
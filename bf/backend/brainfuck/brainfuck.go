@@ -0,0 +1,21 @@
+// Package brainfuck writes IR back out as plain Brainfuck, with no
+// comments, for sharing optimised programs with other interpreters.
+//
+// ADD and SHIFT are written one command at a time, ZERO as [-] and the
+// range ops as the clears and move loops they stand for. The optimiser only
+// makes a ZERO or a range op where such a loop does the same under the cell
+// model it was given, so the output of optimise.Optimise is equivalent to
+// its input under that model. SECTION and TRAP have no Brainfuck form and
+// are left out.
+package brainfuck
+
+import (
+	"github.com/lcox74/bfcc/bf/ir"
+	"github.com/lcox74/bfcc/internal/expand"
+)
+
+// Generate returns ops as Brainfuck, with lines wrapped at width bytes, or
+// on one line for a width of 0.
+func Generate(ops []ir.Op, width int) string {
+	return expand.Expand(ops, expand.Config{Width: width})
+}
@@ -0,0 +1,24 @@
+// Package c64 compiles IR to a Commodore 64 program: a PRG file of 6502
+// machine code, started from BASIC with RUN, that does its I/O through
+// the KERNAL in PETSCII.
+package c64
+
+import (
+	"github.com/lcox74/bfcc/bf/backend/elf"
+	"github.com/lcox74/bfcc/bf/ir"
+	"github.com/lcox74/bfcc/internal/codegen/c64"
+)
+
+// Costs is the code size of each op in a program, for
+// optimise.Options.Costs.
+var Costs = &c64.Costs
+
+// MaxCode is the most code a program can have, leaving room for the tape.
+const MaxCode = c64.MaxCode
+
+// Build returns a PRG file running ops. Of the elf package's options it
+// only supports the cell model, WithMidTape, WithDebug and WithProgress.
+// It fails if the code is larger than MaxCode.
+func Build(ops []ir.Op, opts ...elf.Option) ([]byte, error) {
+	return c64.NewGenerator(ops, opts...).GeneratePRG()
+}
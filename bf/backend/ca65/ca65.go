@@ -0,0 +1,43 @@
+// Package ca65 compiles IR to 6502 assembly source for ca65, the cc65
+// suite's assembler, as a Commodore 64 or Apple II program to link with
+// ld65. The machine's ROM routines are named at the top of the source, to
+// port the I/O to another 6502 machine.
+package ca65
+
+import (
+	"github.com/lcox74/bfcc/bf/ir"
+	"github.com/lcox74/bfcc/internal/codegen/ca65"
+)
+
+// Option configures the generated program.
+type Option = ca65.Option
+
+// Machine is the computer a program is for: C64 or Apple2.
+type Machine = ca65.Machine
+
+// Machines.
+const (
+	C64    = ca65.C64
+	Apple2 = ca65.Apple2
+)
+
+// Generate returns assembly source running ops.
+func Generate(ops []ir.Op, opts ...Option) string {
+	return ca65.NewGenerator(ops, opts...).Generate()
+}
+
+// WithMachine sets the machine the program is for (default C64).
+func WithMachine(m Machine) Option { return ca65.WithMachine(m) }
+
+// WithCellOverflow sets the cell overflow policy (default ir.OverflowWrap).
+func WithCellOverflow(o ir.CellOverflow) Option { return ca65.WithCellOverflow(o) }
+
+// WithSignedCells treats cells as signed bytes.
+func WithSignedCells() Option { return ca65.WithSignedCells() }
+
+// WithMidTape starts the data pointer in the middle of the tape.
+func WithMidTape() Option { return ca65.WithMidTape() }
+
+// WithProgress calls report with the number of ops emitted so far as
+// Generate works through them.
+func WithProgress(report func(done, total int)) Option { return ca65.WithProgress(report) }
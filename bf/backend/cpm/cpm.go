@@ -0,0 +1,24 @@
+// Package cpm compiles IR to a CP/M program: a .COM file of Z80 machine
+// code, run by name from the CCP, that does its I/O through the BDOS.
+package cpm
+
+import (
+	"github.com/lcox74/bfcc/bf/backend/elf"
+	"github.com/lcox74/bfcc/bf/ir"
+	"github.com/lcox74/bfcc/internal/codegen/cpm"
+)
+
+// Costs is the code size of each op in a program, for
+// optimise.Options.Costs.
+var Costs = &cpm.Costs
+
+// MaxCode is the most code a program can have in a full 64KB system,
+// leaving room for the tape.
+const MaxCode = cpm.MaxCode
+
+// Build returns a .COM file running ops. Of the elf package's options it
+// only supports the cell model, WithMidTape, WithDebug and WithProgress.
+// It fails if the code is larger than MaxCode.
+func Build(ops []ir.Op, opts ...elf.Option) ([]byte, error) {
+	return cpm.NewGenerator(ops, opts...).GenerateCOM()
+}
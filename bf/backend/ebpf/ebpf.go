@@ -0,0 +1,41 @@
+// Package ebpf compiles IR to an eBPF program and runs it in the Linux
+// kernel, as a bpf_loop callback that resumes at each loop iteration.
+// Running needs x86_64 Linux 5.17 or later and CAP_BPF.
+package ebpf
+
+import (
+	"io"
+
+	"github.com/lcox74/bfcc/bf/backend/elf"
+	"github.com/lcox74/bfcc/bf/ir"
+	"github.com/lcox74/bfcc/internal/codegen/ebpf"
+)
+
+// Program is a generated program: its instructions, BTF and func_info.
+type Program = ebpf.Program
+
+// Errors a program fails with.
+var (
+	ErrLoopLimit = ebpf.ErrLoopLimit
+	ErrTape      = ebpf.ErrTape
+	ErrOverflow  = ebpf.ErrOverflow
+	ErrTrap      = ebpf.ErrTrap
+	ErrIO        = ebpf.ErrIO
+)
+
+// Costs is the code size of each op in a program, for
+// optimise.Options.Costs.
+var Costs = &ebpf.Costs
+
+// Build returns an eBPF program running ops. Of the elf package's options
+// it only supports the cell model, WithMidTape, WithDebug and
+// WithProgress. It fails if the program is too large for eBPF's jumps.
+func Build(ops []ir.Op, opts ...elf.Option) (*Program, error) {
+	return ebpf.NewGenerator(ops, opts...).Generate()
+}
+
+// Run loads prog into the kernel and runs it with input, writing its
+// output to w. maxLoops bounds its loop iterations, 0 for no limit.
+func Run(prog *Program, input []byte, w io.Writer, maxLoops uint64) error {
+	return ebpf.Run(prog, input, w, maxLoops)
+}
@@ -0,0 +1,190 @@
+// Package elf compiles IR to a static x86_64, riscv64, i386 or ARMv7 Linux
+// executable, an x86_64 FreeBSD one, or a bare-metal x86 Multiboot image,
+// with no assembler or linker involved.
+package elf
+
+import (
+	"github.com/lcox74/bfcc/bf/ir"
+	"github.com/lcox74/bfcc/internal/codegen/freebsd"
+	"github.com/lcox74/bfcc/internal/codegen/linux"
+)
+
+// Option configures the generated executable.
+type Option = linux.Option
+
+// Build returns an ELF64 executable running ops.
+func Build(ops []ir.Op, opts ...Option) []byte {
+	return linux.NewX86_64Generator(ops, opts...).GenerateELF()
+}
+
+// BuildRaw returns position-independent x86_64 Linux machine code running
+// ops, with no ELF wrapper: the tape is mmapped at startup and the code
+// runs from its first byte wherever it is loaded. WithIdent, WithSourceMap
+// and WithSymbols do not apply.
+func BuildRaw(ops []ir.Op, opts ...Option) []byte {
+	return linux.NewX86_64Generator(ops, opts...).GenerateRaw()
+}
+
+// BuildRawFunction returns position-independent x86_64 Linux machine code
+// like BuildRaw, but to call as a function taking an ir.TapeSize cell tape
+// in RDI, int run(unsigned char *tape), which returns 0 when the program
+// finishes, or 1 on a trapped cell overflow, rather than exiting. Options
+// reading the process's arguments or environment do not apply either.
+func BuildRawFunction(ops []ir.Op, opts ...Option) []byte {
+	return linux.NewX86_64Generator(ops, opts...).GenerateRawFunction()
+}
+
+// BuildObject returns a relocatable x86_64 object file defining main, for
+// a C compiler to link against the C library. , and . call getchar and
+// putchar rather than making system calls, so output is buffered by stdio,
+// and main returns 0, or 1 on a trapped cell overflow. Options that read
+// the process's arguments or environment, WithDumpTape, WithIdent,
+// WithSourceMap and WithSymbols do not apply.
+func BuildObject(ops []ir.Op, opts ...Option) []byte {
+	return linux.NewX86_64Generator(ops, opts...).GenerateObject()
+}
+
+// BuildFunctionObject returns a relocatable x86_64 object file defining
+// name as a System V function for C or cgo to call given a tape and its
+// size, void name(uint8_t *tape, size_t len). The code is
+// BuildRawFunction's, making system calls for I/O, with the middle cell
+// and WithTapeInit's limit taken from len. Options reading the process's
+// arguments or environment, WithDumpTape, WithIdent, WithSourceMap and
+// WithSymbols do not apply.
+func BuildFunctionObject(ops []ir.Op, name string, opts ...Option) []byte {
+	return linux.NewX86_64Generator(ops, opts...).GenerateFunctionObject(name)
+}
+
+// BuildLibrary returns a static library, an ar archive of one x86_64
+// object file, for C programs to call ops from, and the C header declaring
+// it. The entry function is prefix_run, which takes the tape and a struct
+// of I/O hooks, so the code makes no system calls; prefix must be a C
+// identifier. Options that read the process's arguments or environment,
+// WithTapeInit, WithIdent, WithSourceMap and WithSymbols do not apply.
+func BuildLibrary(ops []ir.Op, prefix string, opts ...Option) (archive []byte, header string) {
+	return linux.NewX86_64Generator(ops, opts...).GenerateLibrary(prefix)
+}
+
+// BuildRISCV64 returns an ELF64 RISC-V executable running ops. Only the cell
+// model, WithMidTape, WithDebug, WithIdent and WithProgress options apply.
+func BuildRISCV64(ops []ir.Op, opts ...Option) []byte {
+	return linux.NewRISCV64Generator(ops, opts...).GenerateELF()
+}
+
+// BuildI386 returns an ELF32 i386 executable running ops. Only the cell
+// model, WithMidTape, WithDebug and WithProgress options apply.
+func BuildI386(ops []ir.Op, opts ...Option) []byte {
+	return linux.NewI386Generator(ops, opts...).GenerateELF()
+}
+
+// BuildMultiboot returns an ELF32 Multiboot image running ops on a bare
+// x86 machine, for GRUB or `qemu-system-i386 -kernel`: OUT writes to the
+// VGA text screen and the first serial port, and IN reads the keyboard or
+// serial port. The same options as for BuildI386 apply.
+func BuildMultiboot(ops []ir.Op, opts ...Option) []byte {
+	return linux.NewI386Generator(ops, opts...).GenerateMultiboot()
+}
+
+// BuildARM returns an ELF32 ARM EABI executable running ops, for ARMv7
+// Linux. Only the cell model, WithMidTape, WithDebug and WithProgress
+// options apply.
+func BuildARM(ops []ir.Op, opts ...Option) []byte {
+	return linux.NewARMGenerator(ops, opts...).GenerateELF()
+}
+
+// Costs, RISCV64Costs, I386Costs and ARMCosts are the code sizes of each op
+// on the four targets, for optimise.Options.Costs.
+var (
+	Costs        = &linux.X86_64Costs
+	RISCV64Costs = &linux.RISCV64Costs
+	I386Costs    = &linux.I386Costs
+	ARMCosts     = &linux.ARMCosts
+)
+
+// BuildFreeBSD returns an ELF64 x86_64 FreeBSD executable running ops. All
+// options apply.
+func BuildFreeBSD(ops []ir.Op, opts ...Option) []byte {
+	return freebsd.NewX86_64Generator(ops, opts...).GenerateELF()
+}
+
+// BuildFreeBSDRaw is BuildRaw for FreeBSD.
+func BuildFreeBSDRaw(ops []ir.Op, opts ...Option) []byte {
+	return freebsd.NewX86_64Generator(ops, opts...).GenerateRaw()
+}
+
+// BuildFreeBSDRawFunction is BuildRawFunction for FreeBSD.
+func BuildFreeBSDRawFunction(ops []ir.Op, opts ...Option) []byte {
+	return freebsd.NewX86_64Generator(ops, opts...).GenerateRawFunction()
+}
+
+// BuildFreeBSDFunctionObject is BuildFunctionObject for FreeBSD.
+func BuildFreeBSDFunctionObject(ops []ir.Op, name string, opts ...Option) []byte {
+	return freebsd.NewX86_64Generator(ops, opts...).GenerateFunctionObject(name)
+}
+
+// InfoFlag is the argument that makes a WithInfo executable print its info.
+const InfoFlag = linux.InfoFlag
+
+// TapeEnvVar is the environment variable read by a WithTapeEnv executable.
+const TapeEnvVar = linux.TapeEnvVar
+
+// DumpEnvVar names the file a WithDumpTape executable writes its tape to.
+const DumpEnvVar = linux.DumpEnvVar
+
+// WithCellOverflow sets the cell overflow policy (default ir.OverflowWrap).
+func WithCellOverflow(o ir.CellOverflow) Option { return linux.WithCellOverflow(o) }
+
+// WithSignedCells treats cells as signed bytes, and IN stores -1 at end of
+// input.
+func WithSignedCells() Option { return linux.WithSignedCells() }
+
+// WithSize makes the x86_64 code smaller rather than faster: inc/dec and
+// 8-bit immediates, and no SSE2 scans or helper alignment.
+func WithSize() Option { return linux.WithSize() }
+
+// WithAVX2 makes the x86_64 code for x86-64-v3 CPUs, scanning and copying
+// cells 32 at a time, with a check at startup that the CPU has AVX2.
+func WithAVX2() Option { return linux.WithAVX2() }
+
+// WithProfile aligns the hot loops and inlines the hot OUTs of the x86_64
+// code, counts[i] being how many times ops[i] ran, as vm.WithOpCounts
+// counts them.
+func WithProfile(counts []uint64) Option { return linux.WithProfile(counts) }
+
+// WithMidTape starts the data pointer in the middle of the tape.
+func WithMidTape() Option { return linux.WithMidTape() }
+
+// WithArgvInput makes IN read the first command-line argument, not stdin.
+func WithArgvInput() Option { return linux.WithArgvInput() }
+
+// WithTapeEnv sizes the tape from TapeEnvVar at startup.
+func WithTapeEnv() Option { return linux.WithTapeEnv() }
+
+// WithTapeGuard maps the tape between guard pages, so an executable
+// reports a cell accessed off either end, and the code address, rather
+// than segfaulting.
+func WithTapeGuard() Option { return linux.WithTapeGuard() }
+
+// WithDumpTape writes the tape to the file named by DumpEnvVar at exit.
+func WithDumpTape() Option { return linux.WithDumpTape() }
+
+// WithInfo makes the executable print info and exit when run with InfoFlag.
+func WithInfo(info string) Option { return linux.WithInfo(info) }
+
+// WithIdent records ident in the .comment section and flags in a note, for
+// `readelf -p .comment` and `readelf -n`.
+func WithIdent(ident, flags string) Option { return linux.WithIdent(ident, flags) }
+
+// WithDebug traps if control runs past the end of the program.
+func WithDebug() Option { return linux.WithDebug() }
+
+// WithSourceMap embeds a map from code addresses to ops, for
+// `bfcc addr2src`.
+func WithSourceMap() Option { return linux.WithSourceMap() }
+
+// WithSymbols emits a symbol table naming the runtime helpers and loops.
+func WithSymbols() Option { return linux.WithSymbols() }
+
+// WithProgress calls report with the number of ops emitted so far as Build
+// works through them.
+func WithProgress(report func(done, total int)) Option { return linux.WithProgress(report) }
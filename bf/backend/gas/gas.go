@@ -0,0 +1,44 @@
+// Package gas compiles IR to GNU assembler (AT&T syntax) source for x86_64
+// Linux, to assemble and link with as and ld.
+package gas
+
+import (
+	"github.com/lcox74/bfcc/bf/ir"
+	"github.com/lcox74/bfcc/internal/codegen/gas"
+)
+
+// Option configures the generated program.
+type Option = gas.Option
+
+// Generate returns assembly source running ops.
+func Generate(ops []ir.Op, opts ...Option) string {
+	return gas.NewGenerator(ops, opts...).Generate()
+}
+
+// WithCellOverflow sets the cell overflow policy (default ir.OverflowWrap).
+func WithCellOverflow(o ir.CellOverflow) Option { return gas.WithCellOverflow(o) }
+
+// WithSignedCells treats cells as signed bytes, and IN stores -1 at end of
+// input.
+func WithSignedCells() Option { return gas.WithSignedCells() }
+
+// WithMidTape starts the data pointer in the middle of the tape.
+func WithMidTape() Option { return gas.WithMidTape() }
+
+// WithArgvInput makes IN read the first command-line argument, not stdin.
+func WithArgvInput() Option { return gas.WithArgvInput() }
+
+// WithTapeEnv sizes the tape from the BF_TAPE environment variable at
+// startup.
+func WithTapeEnv() Option { return gas.WithTapeEnv() }
+
+// WithInfo makes the program print info and exit when run with
+// --bfcc-info.
+func WithInfo(info string) Option { return gas.WithInfo(info) }
+
+// WithDebug traps if control runs past the end of the program.
+func WithDebug() Option { return gas.WithDebug() }
+
+// WithProgress calls report with the number of ops emitted so far as
+// Generate works through them.
+func WithProgress(report func(done, total int)) Option { return gas.WithProgress(report) }
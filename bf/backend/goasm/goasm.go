@@ -0,0 +1,46 @@
+// Package goasm compiles IR to Go assembly for x86_64 Linux, with a stub Go
+// file declaring the function it defines, to build into Go programs
+// without cgo.
+package goasm
+
+import (
+	"github.com/lcox74/bfcc/bf/ir"
+	"github.com/lcox74/bfcc/internal/codegen/goasm"
+)
+
+// Option configures the generated function.
+type Option = goasm.Option
+
+// Func is the name of the function the assembly defines, and TapeSizeConst
+// the constant the stub gives the tape size in.
+const (
+	Func          = goasm.Func
+	TapeSizeConst = goasm.TapeSizeConst
+)
+
+// Generate returns assembly source running ops, for a file ending _amd64.s,
+// and the stub Go file declaring it.
+func Generate(ops []ir.Op, opts ...Option) (asm, stub string) {
+	g := goasm.NewGenerator(ops, opts...)
+	return g.Generate(), g.Stub()
+}
+
+// WithPackage sets the package the stub is in (default main).
+func WithPackage(name string) Option { return goasm.WithPackage(name) }
+
+// WithCellOverflow sets the cell overflow policy (default ir.OverflowWrap).
+func WithCellOverflow(o ir.CellOverflow) Option { return goasm.WithCellOverflow(o) }
+
+// WithSignedCells treats cells as signed bytes, and IN stores -1 at end of
+// input.
+func WithSignedCells() Option { return goasm.WithSignedCells() }
+
+// WithMidTape starts the data pointer in the middle of the tape.
+func WithMidTape() Option { return goasm.WithMidTape() }
+
+// WithDebug traps if control runs past the end of the function.
+func WithDebug() Option { return goasm.WithDebug() }
+
+// WithProgress calls report with the number of ops emitted so far as
+// Generate works through them.
+func WithProgress(report func(done, total int)) Option { return goasm.WithProgress(report) }
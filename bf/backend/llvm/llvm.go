@@ -0,0 +1,16 @@
+// Package llvm compiles IR to LLVM IR assembly, a .ll file defining main,
+// for clang to compile for any target LLVM supports. The I/O goes through
+// the C library's getchar and putchar.
+package llvm
+
+import (
+	"github.com/lcox74/bfcc/bf/backend/elf"
+	"github.com/lcox74/bfcc/bf/ir"
+	"github.com/lcox74/bfcc/internal/codegen/llvm"
+)
+
+// Generate returns LLVM IR running ops. Of the elf package's options it
+// only supports the cell model, WithMidTape and WithProgress.
+func Generate(ops []ir.Op, opts ...elf.Option) string {
+	return llvm.NewGenerator(ops, opts...).Generate()
+}
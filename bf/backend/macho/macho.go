@@ -0,0 +1,27 @@
+// Package macho compiles IR to an x86_64 or arm64 macOS executable, with
+// no assembler or linker involved.
+package macho
+
+import (
+	"github.com/lcox74/bfcc/bf/backend/elf"
+	"github.com/lcox74/bfcc/bf/ir"
+	"github.com/lcox74/bfcc/internal/codegen/darwin"
+)
+
+// Build returns a Mach-O 64 executable running ops. It takes the elf
+// package's options, except WithSourceMap and WithSymbols, which have no
+// effect.
+func Build(ops []ir.Op, opts ...elf.Option) []byte {
+	return darwin.NewX86_64Generator(ops, opts...).GenerateMachO()
+}
+
+// BuildARM64 returns an ad-hoc signed arm64 Mach-O 64 executable running
+// ops, for Apple silicon. Of the elf package's options it only supports
+// the cell model, WithMidTape, WithDebug and WithProgress.
+func BuildARM64(ops []ir.Op, opts ...elf.Option) []byte {
+	return darwin.NewARM64Generator(ops, opts...).GenerateMachO()
+}
+
+// ARM64Costs is the code size of each op on arm64, for
+// optimise.Options.Costs. x86_64 code is as big as elf.Costs says.
+var ARM64Costs = &darwin.ARM64Costs
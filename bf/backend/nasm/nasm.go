@@ -0,0 +1,44 @@
+// Package nasm compiles IR to NASM (Intel syntax) source for x86_64 Linux,
+// to assemble with nasm or yasm and link with ld.
+package nasm
+
+import (
+	"github.com/lcox74/bfcc/bf/ir"
+	"github.com/lcox74/bfcc/internal/codegen/nasm"
+)
+
+// Option configures the generated program.
+type Option = nasm.Option
+
+// Generate returns assembly source running ops.
+func Generate(ops []ir.Op, opts ...Option) string {
+	return nasm.NewGenerator(ops, opts...).Generate()
+}
+
+// WithCellOverflow sets the cell overflow policy (default ir.OverflowWrap).
+func WithCellOverflow(o ir.CellOverflow) Option { return nasm.WithCellOverflow(o) }
+
+// WithSignedCells treats cells as signed bytes, and IN stores -1 at end of
+// input.
+func WithSignedCells() Option { return nasm.WithSignedCells() }
+
+// WithMidTape starts the data pointer in the middle of the tape.
+func WithMidTape() Option { return nasm.WithMidTape() }
+
+// WithArgvInput makes IN read the first command-line argument, not stdin.
+func WithArgvInput() Option { return nasm.WithArgvInput() }
+
+// WithTapeEnv sizes the tape from the BF_TAPE environment variable at
+// startup.
+func WithTapeEnv() Option { return nasm.WithTapeEnv() }
+
+// WithInfo makes the program print info and exit when run with
+// --bfcc-info.
+func WithInfo(info string) Option { return nasm.WithInfo(info) }
+
+// WithDebug traps if control runs past the end of the program.
+func WithDebug() Option { return nasm.WithDebug() }
+
+// WithProgress calls report with the number of ops emitted so far as
+// Generate works through them.
+func WithProgress(report func(done, total int)) Option { return nasm.WithProgress(report) }
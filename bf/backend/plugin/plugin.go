@@ -0,0 +1,79 @@
+// Package plugin is for writing a backend plugin in Go: an executable named
+// bfcc-backend-<arch> that bfcc build runs for -arch <arch>, sending it the
+// optimised IR as JSON on stdin and writing what it prints on stdout to the
+// output file. See docs/plugins.md for the protocol, which a plugin in any
+// language can speak.
+//
+// It is also for writing an external optimiser pass, run on the IR after
+// the built-in passes: see PassMain.
+//
+// A plugin's main function is a call to Main:
+//
+//	func main() {
+//		plugin.Main(plugin.Info{Description: "Game Boy ROM", Suffix: ".gb"}, build)
+//	}
+//
+//	func build(req *plugin.Request) ([]byte, error) {
+//		ops, err := req.IR()
+//		...
+//	}
+package plugin
+
+import (
+	"io"
+
+	"github.com/lcox74/bfcc/bf/ir"
+	"github.com/lcox74/bfcc/internal/plugin"
+)
+
+// Protocol is the version of the request format this package reads.
+const Protocol = plugin.Protocol
+
+// Info is what a plugin says about itself: a one-line description for
+// bfcc backends, the suffix of its output files, and whether they are run
+// directly. Main fills in its Protocol.
+type Info = plugin.Info
+
+// Request is what bfcc asks a plugin to build: the IR and the tape and
+// cell model it runs with. Its IR method returns the ops as ir.Ops, and
+// CellModel the cells as an ir.CellModel.
+type Request = plugin.Request
+
+// Op is one IR op of a Request, with its kind by name.
+type Op = plugin.Op
+
+// Main is the main function of a plugin: it describes the plugin as info
+// when run with -describe, and otherwise builds the request on stdin with
+// build and writes the result to stdout. It exits 1, with the error on
+// stderr, if anything fails.
+func Main(info Info, build func(*Request) ([]byte, error)) {
+	plugin.Main(info, build)
+}
+
+// ReadRequest reads a Request from r, for a plugin with a main function of
+// its own.
+func ReadRequest(r io.Reader) (*Request, error) {
+	return plugin.ReadRequest(r)
+}
+
+// PassRequest is what bfcc sends an external optimiser pass, one of those
+// listed in BFCC_PASSES: the optimised IR, the -O level and the cell
+// model. Its IR and CellModel methods are as for a Request.
+type PassRequest = plugin.PassRequest
+
+// PassResult is what a pass writes back: the transformed IR.
+type PassResult = plugin.PassResult
+
+// PassMain is the main function of an external optimiser pass: it reads
+// the request on stdin, transforms its IR with pass and writes the result
+// to stdout, where bfcc checks it before using it. It exits 1, with the
+// error on stderr, if anything fails.
+func PassMain(pass func(*PassRequest) ([]ir.Op, error)) {
+	plugin.PassMain(pass)
+}
+
+// ReadPassRequest reads a PassRequest from r, for a pass with a main
+// function of its own.
+func ReadPassRequest(r io.Reader) (*PassRequest, error) {
+	return plugin.ReadPassRequest(r)
+}
@@ -0,0 +1,175 @@
+// Package vm runs IR in a virtual machine, with optional step limits, tape
+// and cell policies, and checkpoints.
+package vm
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/lcox74/bfcc/bf/ir"
+	"github.com/lcox74/bfcc/internal/vm"
+)
+
+// VM runs IR. Create one with New.
+type VM = vm.VM
+
+// Option configures a VM.
+type Option = vm.VMOption
+
+// New returns a VM with an ir.TapeSize tape of wrapping unsigned cells, reading
+// stdin and writing stdout unless configured otherwise.
+func New(opts ...Option) *VM {
+	return vm.NewVM(opts...)
+}
+
+// RuntimeError is returned by Run when a program fails, eg. by running off
+// the tape, with the position of the op that failed.
+type RuntimeError = vm.RuntimeError
+
+// Errors wrapped by a RuntimeError.
+var (
+	ErrStepLimit  = vm.ErrStepLimit
+	ErrTrap       = vm.ErrTrap
+	ErrNotDecimal = vm.ErrNotDecimal
+)
+
+// Stepper runs a program one event at a time, without callbacks: create one
+// with VM.Stepper and call Next until it returns EventHalt or an error.
+// Input is given with Input or InputEOF after an EventInputRequest.
+type Stepper = vm.Stepper
+
+// Event is something a program did that can be seen from outside it,
+// returned by Stepper.Next.
+type Event = vm.Event
+
+// EventKind is the kind of an Event.
+type EventKind = vm.EventKind
+
+// Event kinds.
+const (
+	EventOutput       = vm.EventOutput
+	EventInputRequest = vm.EventInputRequest
+	EventLoopEnter    = vm.EventLoopEnter
+	EventHalt         = vm.EventHalt
+)
+
+// ErrInputPending is returned by Stepper.Next after an EventInputRequest
+// that was not given input.
+var ErrInputPending = vm.ErrInputPending
+
+// CellIO is how IN and OUT move cells to and from the input and output
+// streams.
+type CellIO = vm.CellIO
+
+// ByteIO reads and writes each cell as one raw byte, the default.
+type ByteIO = vm.ByteIO
+
+// DecimalIO reads and writes cells as decimal numbers, one per line on
+// output.
+type DecimalIO = vm.DecimalIO
+
+// EscapedIO reads raw bytes, and writes output bytes that are not
+// printable ASCII (or every byte, with All set) as \xNN escapes.
+type EscapedIO = vm.EscapedIO
+
+// WithIO sets how cells are read and written (default ByteIO).
+func WithIO(cio CellIO) Option { return vm.WithIO(cio) }
+
+// Newline is the line ending a program reads and writes, for
+// NewlineReader and NewlineWriter.
+type Newline = vm.Newline
+
+// Line endings.
+const (
+	NewlineLF   = vm.NewlineLF
+	NewlineCR   = vm.NewlineCR
+	NewlineCRLF = vm.NewlineCRLF
+)
+
+// NewlineReader returns r with its lines, ending in \n or \r\n, ending
+// in nl instead, for WithInput.
+func NewlineReader(r io.Reader, nl Newline) io.Reader { return vm.NewlineReader(r, nl) }
+
+// NewlineWriter writes a program's lines ending in nl to another writer
+// ending in \n, for WithOutput. Flush it when the program is done.
+type NewlineWriter = vm.NewlineWriter
+
+// NewNewlineWriter returns a NewlineWriter writing to w.
+func NewNewlineWriter(w io.Writer, nl Newline) *NewlineWriter { return vm.NewNewlineWriter(w, nl) }
+
+// Snapshot is a VM's state, saved by WithCheckpoint and restored by
+// WithResume.
+type Snapshot = vm.Snapshot
+
+// ReadSnapshot decodes a snapshot saved by WithCheckpoint.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	return vm.ReadSnapshot(r)
+}
+
+// WithInput sets the input reader (default os.Stdin).
+func WithInput(r io.Reader) Option { return vm.WithInput(r) }
+
+// WithOutput sets the output writer (default os.Stdout).
+func WithOutput(w io.Writer) Option { return vm.WithOutput(w) }
+
+// WithOutputChan sends the output to ch instead of a writer, a slice per
+// batch of output, waiting while ch is full and, with WithContext, giving
+// up once the context is done. Run never closes ch.
+func WithOutputChan(ch chan<- []byte) Option { return vm.WithOutputChan(ch) }
+
+// WithMaxSteps stops a run with ErrStepLimit after n ops (0 means no limit).
+func WithMaxSteps(n uint64) Option { return vm.WithMaxSteps(n) }
+
+// WithMemorySize sets the number of cells on the tape (default ir.TapeSize).
+func WithMemorySize(size int) Option { return vm.WithMemorySize(size) }
+
+// WithMidTape starts the data pointer in the middle of the tape.
+func WithMidTape() Option { return vm.WithMidTape() }
+
+// WithCells sets the cell model.
+func WithCells(cells ir.CellModel) Option { return vm.WithCells(cells) }
+
+// WithCellOverflow sets the cell overflow policy (default ir.OverflowWrap).
+func WithCellOverflow(o ir.CellOverflow) Option { return vm.WithCellOverflow(o) }
+
+// WithSignedCells treats cells as signed bytes, and IN stores -1 at end of
+// input.
+func WithSignedCells() Option { return vm.WithSignedCells() }
+
+// WithTapeOverflow sets the policy for moving past the last cell (default
+// ir.BoundError).
+func WithTapeOverflow(b ir.TapeBound) Option { return vm.WithTapeOverflow(b) }
+
+// WithTapeUnderflow sets the policy for moving below cell 0 (default
+// ir.BoundError).
+func WithTapeUnderflow(b ir.TapeBound) Option { return vm.WithTapeUnderflow(b) }
+
+// WithOpCounts increments counts[i] every time ops[i] runs.
+func WithOpCounts(counts []uint64) Option { return vm.WithOpCounts(counts) }
+
+// WithCommandCount counts the source commands each Run executes, for
+// VM.Commands. The ops must be unoptimised, as ir.Op.Commands counts them.
+func WithCommandCount() Option { return vm.WithCommandCount() }
+
+// WithCheckpoint calls save with a snapshot roughly every interval.
+func WithCheckpoint(every time.Duration, save func(*Snapshot) error) Option {
+	return vm.WithCheckpoint(every, save)
+}
+
+// WithProgress calls report with the steps executed so far roughly every
+// interval, checked on loop back-edges.
+func WithProgress(every time.Duration, report func(steps uint64)) Option {
+	return vm.WithProgress(every, report)
+}
+
+// WithContext stops a run with a RuntimeError once ctx is done, checked on
+// loop back-edges and while waiting for input.
+func WithContext(ctx context.Context) Option { return vm.WithContext(ctx) }
+
+// WithTranscript logs every cell read and written to w, one line each
+// with the step it happened at.
+func WithTranscript(w io.Writer) Option { return vm.WithTranscript(w) }
+
+// WithResume starts the next Run from a snapshot instead of a fresh tape.
+func WithResume(s *Snapshot) Option { return vm.WithResume(s) }
@@ -0,0 +1,46 @@
+// Package wasm compiles IR to a WebAssembly module, for running programs
+// in a browser or any other WebAssembly host.
+//
+// The module imports ReadFunc and WriteFunc from ImportModule, and exports
+// its tape as MemoryExport and the program as RunFunc:
+//
+//	bf.read  () -> i32   the next input byte, or -1 at end of input
+//	bf.write (i32)       output the low byte of its argument
+//
+// BuildWASI instead produces a module for WASI runtimes, which does its
+// I/O on stdin and stdout and exports the program as StartFunc.
+package wasm
+
+import (
+	"github.com/lcox74/bfcc/bf/backend/elf"
+	"github.com/lcox74/bfcc/bf/ir"
+	"github.com/lcox74/bfcc/internal/codegen/wasm"
+)
+
+// Names the module imports and exports.
+const (
+	ImportModule = wasm.ImportModule
+	ReadFunc     = wasm.ReadFunc
+	WriteFunc    = wasm.WriteFunc
+	RunFunc      = wasm.RunFunc
+	MemoryExport = wasm.MemoryExport
+	WASIModule   = wasm.WASIModule
+	StartFunc    = wasm.StartFunc
+)
+
+// Costs is the code size of each op in a module, for
+// optimise.Options.Costs.
+var Costs = &wasm.Costs
+
+// Build returns a binary WebAssembly module running ops. Of the elf
+// package's options it only supports the cell model, WithMidTape and
+// WithProgress.
+func Build(ops []ir.Op, opts ...elf.Option) []byte {
+	return wasm.NewGenerator(ops, opts...).GenerateModule()
+}
+
+// BuildWASI returns a binary WebAssembly module running ops under a WASI
+// preview 1 runtime, with the same options as Build.
+func BuildWASI(ops []ir.Op, opts ...elf.Option) []byte {
+	return wasm.NewGenerator(ops, opts...).GenerateWASI()
+}
@@ -0,0 +1,149 @@
+package bf
+
+import (
+	"context"
+
+	"github.com/lcox74/bfcc/bf/backend/elf"
+	"github.com/lcox74/bfcc/bf/backend/gas"
+	"github.com/lcox74/bfcc/bf/ir"
+	"github.com/lcox74/bfcc/bf/optimise"
+	"github.com/lcox74/bfcc/bf/token"
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// Artifact selects something for Build to return. Artifacts combine with |.
+type Artifact uint
+
+// Artifacts Build can return.
+const (
+	Tokens    Artifact = 1 << iota // the source's tokens
+	IR                             // the IR before optimising
+	Optimised                      // the optimised IR, and the optimiser's report
+	Asm                            // GNU assembler source for x86_64 Linux
+	ELF                            // an x86_64 Linux executable
+)
+
+// Options configures Build. Every stage is given the same settings, so the
+// IR, the assembly and the executable always agree. The zero value returns
+// nothing, having checked the source is valid, at O0 for wrapping unsigned
+// cells.
+type Options struct {
+	Artifacts Artifact
+	Level     optimise.Level
+	Cells     ir.CellModel
+	Costs     *optimise.CostModel // nil for elf.Costs, the target of Asm and ELF
+	MidTape   bool                // start the data pointer in the middle of the tape
+	Debug     bool                // trap at unreachable code and check jump targets
+}
+
+// Artifacts holds what Build was asked for. The others are left empty.
+type Artifacts struct {
+	Tokens    []token.Token
+	IR        []ir.Op
+	Optimised []ir.Op
+	Report    *optimise.Report
+	Asm       string
+	ELF       []byte
+}
+
+// Build compiles source, returning the artifacts opts.Artifacts selects.
+// At optimise.Og the source is lowered with one op per command, as by
+// ir.LowerUnfolded. Build checks ctx between stages, returning
+// context.Cause(ctx) once it is done; an error from lowering is an
+// *ir.Error.
+func Build(ctx context.Context, source []byte, opts Options) (Artifacts, error) {
+	var a Artifacts
+
+	toks := token.Tokenize(source)
+	if opts.Artifacts&Tokens != 0 {
+		a.Tokens = toks
+	}
+	if err := stageDone(ctx); err != nil {
+		return Artifacts{}, err
+	}
+
+	ops, err := core.LowerAt(toks, opts.Level)
+	if err != nil {
+		return Artifacts{}, err
+	}
+	if opts.Artifacts&IR != 0 {
+		a.IR = ops
+	}
+	if opts.Artifacts&(Optimised|Asm|ELF) == 0 {
+		return a, nil
+	}
+	if err := stageDone(ctx); err != nil {
+		return Artifacts{}, err
+	}
+
+	costs := opts.Costs
+	if costs == nil {
+		costs = elf.Costs
+	}
+	ops, report, err := optimise.Optimise(ops, optimise.Options{Level: opts.Level, Cells: opts.Cells, Costs: costs})
+	if err != nil {
+		return Artifacts{}, err
+	}
+	if opts.Debug {
+		ops = core.InsertTraps(ops, opts.Cells, nil)
+		if err := core.CheckJumps(ops); err != nil {
+			return Artifacts{}, err
+		}
+	}
+	if opts.Artifacts&Optimised != 0 {
+		a.Optimised, a.Report = ops, report
+	}
+
+	if opts.Artifacts&Asm != 0 {
+		if err := stageDone(ctx); err != nil {
+			return Artifacts{}, err
+		}
+		a.Asm = gas.Generate(ops, gasOptions(opts)...)
+	}
+	if opts.Artifacts&ELF != 0 {
+		if err := stageDone(ctx); err != nil {
+			return Artifacts{}, err
+		}
+		a.ELF = elf.Build(ops, elfOptions(opts)...)
+	}
+	return a, nil
+}
+
+// stageDone returns the cause of ctx being done, or nil to go on to the
+// next stage.
+func stageDone(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return nil
+}
+
+// gasOptions returns the gas package's options for opts.
+func gasOptions(opts Options) []gas.Option {
+	out := []gas.Option{gas.WithCellOverflow(opts.Cells.Overflow)}
+	if opts.Cells.Signed {
+		out = append(out, gas.WithSignedCells())
+	}
+	if opts.MidTape {
+		out = append(out, gas.WithMidTape())
+	}
+	if opts.Debug {
+		out = append(out, gas.WithDebug())
+	}
+	return out
+}
+
+// elfOptions returns the elf package's options for opts.
+func elfOptions(opts Options) []elf.Option {
+	out := []elf.Option{elf.WithCellOverflow(opts.Cells.Overflow)}
+	if opts.Cells.Signed {
+		out = append(out, elf.WithSignedCells())
+	}
+	if opts.MidTape {
+		out = append(out, elf.WithMidTape())
+	}
+	if opts.Debug {
+		out = append(out, elf.WithDebug())
+	}
+	return out
+}
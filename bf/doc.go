@@ -0,0 +1,40 @@
+// Package bf is the importable API of the compiler, for tools built on it
+// such as editors, playgrounds and judges. It is split by stage:
+//
+//	bf/token              Tokenize: source to tokens with positions
+//	bf/ir                 Lower: tokens to IR, and the IR itself
+//	bf/optimise           Optimise: IR to IR, with a report of what changed
+//	bf/backend/vm         run IR in the virtual machine
+//	bf/backend/elf        IR to an x86_64, riscv64, i386 or ARMv7 Linux, or x86_64 FreeBSD, executable, or a bare-metal Multiboot image
+//	bf/backend/macho      IR to an x86_64 or arm64 macOS executable
+//	bf/backend/wasm       IR to a WebAssembly module
+//	bf/backend/c64        IR to a Commodore 64 program
+//	bf/backend/cpm        IR to a CP/M program for a Z80 machine
+//	bf/backend/avr        IR to an Intel HEX file for an ATmega microcontroller
+//	bf/backend/ebpf       IR to an eBPF program, run in the Linux kernel
+//	bf/backend/gas        IR to GNU assembler source
+//	bf/backend/nasm       IR to NASM source, for nasm or yasm
+//	bf/backend/llvm       IR to LLVM IR assembly, for clang
+//	bf/backend/ca65       IR to 6502 assembly for ca65, as a C64 or Apple II program
+//	bf/backend/avrasm     IR to AVR assembly for avr-gcc, with the tape size and I/O as options
+//	bf/backend/goasm      IR to Go assembly and a stub Go file declaring it, to link into Go programs without cgo
+//	bf/backend/brainfuck  IR back to plain Brainfuck, for other interpreters
+//	bf/backend/plugin     a backend plugin, run by bfcc build for a target it lacks, or an optimiser pass
+//	bf/enumerate          every program up to a length, run under step limits as in a busy beaver search
+//
+// A compile is those stages in turn:
+//
+//	ops, err := ir.Lower(token.Tokenize(src))
+//	if err != nil { ... }
+//	ops, report, err := optimise.Optimise(ops, optimise.Options{Level: optimise.O2})
+//	if err != nil { ... }
+//	err = vm.New(vm.WithOutput(os.Stdout)).Run(ops)
+//
+// Build does all of that in one call, with one set of options, returning
+// whichever of the tokens, IR, optimised IR, assembly and executable are
+// asked for.
+//
+// These packages follow semantic versioning (see docs/api.md): anything
+// exported from them keeps working across minor releases. The packages
+// under internal/ are the implementation and may change at any time.
+package bf
@@ -0,0 +1,58 @@
+// Package enumerate searches every Brainfuck program up to a length, as in
+// a busy beaver search: each is run in ir.Eval under a step limit, and only
+// the first program of each canonical form, the IR the optimiser makes of
+// it, is run. Search does it in parallel.
+package enumerate
+
+import (
+	"iter"
+
+	"github.com/lcox74/bfcc/bf/ir"
+	"github.com/lcox74/bfcc/internal/enumerate"
+)
+
+// DefaultAlphabet is the commands programs are made of when Config.Alphabet
+// is empty: all but I/O.
+const DefaultAlphabet = enumerate.DefaultAlphabet
+
+// DefaultMaxSteps bounds each run when Config.Limits.MaxSteps is zero.
+const DefaultMaxSteps = enumerate.DefaultMaxSteps
+
+// Config controls a search: the longest program, its commands, the input
+// and limits of each run, the workers, and whether to run every program
+// rather than the first of each form.
+type Config = enumerate.Config
+
+// Result is one program's run: its output, the commands it ran, and the
+// *ir.EvalError it failed with, if it did.
+type Result = enumerate.Result
+
+// Stats counts the programs a search listed, ran, and saw halt.
+type Stats = enumerate.Stats
+
+// ErrAlphabet is wrapped by the error Search returns for an alphabet that
+// is not distinct commands.
+var ErrAlphabet = enumerate.ErrAlphabet
+
+// Programs lists every program of up to maxLen commands from alphabet whose
+// brackets match, shortest first and then in the order of alphabet.
+func Programs(maxLen int, alphabet string) iter.Seq[string] {
+	return enumerate.Programs(maxLen, alphabet)
+}
+
+// Canonical returns the fingerprint of src's canonical form, which
+// programs that do the same thing, bar the tape's bounds, share.
+func Canonical(src string, cells ir.CellModel) (ir.Fingerprint, error) {
+	return enumerate.Canonical(src, cells)
+}
+
+// Search runs the programs cfg lists and calls yield with each result, in
+// listing order, until it returns false.
+func Search(cfg Config, yield func(Result) bool) (Stats, error) {
+	return enumerate.Search(cfg, yield)
+}
+
+// Run runs one program, counting the commands it runs.
+func Run(program string, input []byte, limits ir.Limits) Result {
+	return enumerate.Run(program, input, limits)
+}
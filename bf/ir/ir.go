@@ -0,0 +1,239 @@
+// Package ir is the compiler's intermediate representation: a flat list of
+// ops over a tape of cells, with loops as JZ/JNZ pairs sharing a label.
+// docs/ir.md describes each op.
+package ir
+
+import (
+	"github.com/lcox74/bfcc/bf/token"
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// Op is one IR instruction.
+type Op = core.Op
+
+// OpKind is the kind of an Op.
+type OpKind = core.OpKind
+
+// Op kinds.
+const (
+	OpShift     = core.OpShift
+	OpAdd       = core.OpAdd
+	OpZero      = core.OpZero
+	OpIn        = core.OpIn
+	OpOut       = core.OpOut
+	OpJz        = core.OpJz
+	OpJnz       = core.OpJnz
+	OpSection   = core.OpSection
+	OpTrap      = core.OpTrap
+	OpZeroRange = core.OpZeroRange
+	OpCopyRange = core.OpCopyRange
+	OpNop       = core.OpNop
+)
+
+// Op constructors.
+func Shift(k int) Op        { return core.Shift(k) }
+func Add(k int) Op          { return core.Add(k) }
+func Zero() Op              { return core.Zero() }
+func In() Op                { return core.In() }
+func Out() Op               { return core.Out() }
+func Jz(label int) Op       { return core.Jz(label) }
+func Jnz(label int) Op      { return core.Jnz(label) }
+func Section(h Handoff) Op  { return core.Section(h) }
+func Trap() Op              { return core.Trap() }
+func Nop() Op               { return core.Nop() }
+func ZeroRange(n int) Op    { return core.ZeroRange(n) }
+func CopyRange(n, d int) Op { return core.CopyRange(n, d) }
+
+// Error is returned by Lower for source that does not compile, eg. an
+// unmatched bracket, with its position.
+type Error = core.Error
+
+// MessageID names a diagnostic: an Error, an EvalError, a vm.RuntimeError,
+// an error reading input or a checkpoint, or an optimiser warning. Its
+// Format method returns the English format.
+type MessageID = core.MessageID
+
+// Diagnostics, with their English formats, which give the arguments a
+// translation takes.
+const (
+	MsgUnmatchedOpen    = core.MsgUnmatchedOpen    // unmatched '['
+	MsgUnmatchedClose   = core.MsgUnmatchedClose   // unmatched ']'
+	MsgUnexpectedToken  = core.MsgUnexpectedToken  // unexpected token
+	MsgSourceError      = core.MsgSourceError      // %s at line %d col %d (offset %d)
+	MsgLabelReused      = core.MsgLabelReused      // op %d: label L%d is used by more than one loop
+	MsgUnmatchedJnz     = core.MsgUnmatchedJnz     // op %d: JNZ L%d without a matching JZ
+	MsgMismatchedJnz    = core.MsgMismatchedJnz    // op %d: JNZ L%d closes JZ L%d at op %d
+	MsgUnmatchedJz      = core.MsgUnmatchedJz      // op %d: JZ L%d without a matching JNZ
+	MsgRuntimeError     = core.MsgRuntimeError     // runtime error at PC %d: %s
+	MsgRuntimeErrorAt   = core.MsgRuntimeErrorAt   // runtime error at PC %d (line %d, col %d): %s
+	MsgEvalError        = core.MsgEvalError        // %s (op %d)
+	MsgEvalErrorAt      = core.MsgEvalErrorAt      // %s at line %d col %d (op %d)
+	MsgStepLimit        = core.MsgStepLimit        // step limit exceeded (%d steps)
+	MsgStepLimitEval    = core.MsgStepLimitEval    // step limit exceeded: %d steps
+	MsgOutputLimit      = core.MsgOutputLimit      // output limit exceeded: %d bytes
+	MsgInputExhausted   = core.MsgInputExhausted   // read past the end of input
+	MsgInputError       = core.MsgInputError       // input error: %v
+	MsgOutputError      = core.MsgOutputError      // output error: %v
+	MsgOutOfBounds      = core.MsgOutOfBounds      // data pointer out of bounds: %d (valid range %d to %d)
+	MsgCellOverflow     = core.MsgCellOverflow     // cell overflow: %d %+d is outside %d to %d
+	MsgTrap             = core.MsgTrap             // trap: reached unreachable code
+	MsgWarningAt        = core.MsgWarningAt        // line %d col %d: %s
+	MsgClearLoopsKept   = core.MsgClearLoopsKept   // clear loops are kept: signed cells ...
+	MsgEmptyLoopRemoved = core.MsgEmptyLoopRemoved // removed empty loop, which never exits if entered
+	MsgInFile           = core.MsgInFile           // %s: %s
+
+	MsgInvalidIR          = core.MsgInvalidIR          // invalid IR: %w
+	MsgOptimiserInvalidIR = core.MsgOptimiserInvalidIR // optimiser produced invalid IR: %w
+	MsgInputPending       = core.MsgInputPending       // input requested but not given
+	MsgNotDecimal         = core.MsgNotDecimal         // expected a decimal number
+	MsgNotDecimalGot      = core.MsgNotDecimalGot      // %w, got %q
+	MsgInputOverflow      = core.MsgInputOverflow      // cell overflow: input %d is outside %d to %d
+	MsgCheckpointProgram  = core.MsgCheckpointProgram  // checkpoint was taken from a different program ...
+	MsgCheckpointDP       = core.MsgCheckpointDP       // checkpoint data pointer %d is outside its tape
+	MsgCheckpointRead     = core.MsgCheckpointRead     // reading checkpoint: %w
+	MsgNotCheckpoint      = core.MsgNotCheckpoint      // not a bfcc checkpoint file
+	MsgCheckpointVersion  = core.MsgCheckpointVersion  // unsupported checkpoint version %d
+	MsgCheckpointTooLarge = core.MsgCheckpointTooLarge // checkpoint tape too large: %d bytes
+	MsgCheckpointReadTape = core.MsgCheckpointReadTape // reading checkpoint tape: %w
+	MsgCheckpointPC       = core.MsgCheckpointPC       // checkpoint PC %d is outside its program of %d ops
+	MsgCheckpointOrigin   = core.MsgCheckpointOrigin   // checkpoint origin %d is outside its tape
+)
+
+// Localiser returns the format to use for a diagnostic in place of its
+// English one, taking the same arguments.
+type Localiser = core.Localiser
+
+// SetLocaliser makes l translate every diagnostic from then on, in every
+// package, or with nil restores English.
+func SetLocaliser(l Localiser) { core.SetLocaliser(l) }
+
+// Lower turns tokens into unoptimised IR, one op per command or run of
+// + - < > commands.
+func Lower(toks []token.Token) ([]Op, error) {
+	return core.Lower(toks)
+}
+
+// LowerUnfolded is Lower without folding runs, so every command is an op of
+// its own at its own position. It is the lowering for optimise.Og.
+func LowerUnfolded(toks []token.Token) ([]Op, error) {
+	return core.LowerAt(toks, core.Og)
+}
+
+// Handoff selects what each program in a chain starts with.
+type Handoff = core.Handoff
+
+// Handoffs.
+const (
+	HandoffContinue = core.HandoffContinue // same tape, pointer left where it was
+	HandoffShare    = core.HandoffShare    // same tape, pointer back at the start cell
+	HandoffReset    = core.HandoffReset    // zeroed tape, pointer back at the start cell
+)
+
+// ChainSeparator is the line that separates the programs of a chain.
+const ChainSeparator = core.ChainSeparator
+
+// LowerChain lowers src as a chain of programs separated by ChainSeparator
+// lines, joined by SECTION ops.
+func LowerChain(src []byte, h Handoff) ([]Op, error) {
+	return core.LowerChain(src, h)
+}
+
+// ResolveJumps returns the target of each JZ and JNZ in ops (just past the
+// matching JNZ, and back at the matching JZ), or an error if the loops are
+// not properly nested.
+func ResolveJumps(ops []Op) ([]int, error) {
+	return core.ResolveJumps(ops)
+}
+
+// Dump formats ops one per line, as printed by `bfcc ir`, with the source
+// position and matching op of each JZ and JNZ.
+func Dump(ops []Op) string {
+	return core.Dump(ops)
+}
+
+// DumpLoops is Dump with only the JZ and JNZ ops, as printed by
+// `bfcc ir -only-loops`.
+func DumpLoops(ops []Op) string {
+	return core.DumpLoops(ops, nil)
+}
+
+// TapeSize is the number of cells on the default tape.
+const TapeSize = core.TapeSize
+
+// CellModel is what a cell holds and what happens when an ADD takes it out
+// of range. The zero value is unsigned bytes that wrap.
+type CellModel = core.CellModel
+
+// CellOverflow selects what happens when an ADD overflows a cell.
+type CellOverflow = core.CellOverflow
+
+// Cell overflow policies.
+const (
+	OverflowWrap     = core.OverflowWrap
+	OverflowSaturate = core.OverflowSaturate
+	OverflowTrap     = core.OverflowTrap
+)
+
+// TapeBound selects what happens when the pointer moves off one end of the
+// tape.
+type TapeBound = core.TapeBound
+
+// Tape bound policies.
+const (
+	BoundError = core.BoundError
+	BoundWrap  = core.BoundWrap
+	BoundGrow  = core.BoundGrow
+)
+
+// Limits bounds an Eval run and describes the machine it runs on.
+type Limits = core.Limits
+
+// EvalError is a run of Eval that failed at an op.
+type EvalError = core.EvalError
+
+// Errors wrapped by an EvalError.
+var (
+	ErrStepLimit      = core.ErrStepLimit
+	ErrOutputLimit    = core.ErrOutputLimit
+	ErrInputExhausted = core.ErrInputExhausted
+	ErrOutOfBounds    = core.ErrOutOfBounds
+	ErrCellOverflow   = core.ErrCellOverflow
+	ErrTrapped        = core.ErrTrapped
+)
+
+// Eval runs ops on input and returns everything they write, without
+// readers, writers or a VM. It suits tests and quick checks; use the vm
+// backend for long runs.
+func Eval(ops []Op, input []byte, limits Limits) ([]byte, error) {
+	return core.Eval(ops, input, limits)
+}
+
+// EvalSteps is Eval, also returning the number of ops run, which
+// Limits.MaxSteps bounds.
+func EvalSteps(ops []Op, input []byte, limits Limits) ([]byte, uint64, error) {
+	return core.EvalSteps(ops, input, limits)
+}
+
+// Canonicalise returns ops in a normal form for wrapping unsigned cells,
+// which programs that differ only in how they spell the same thing share:
+// positions and NOPs dropped, loops labelled in order, and each run of
+// SHIFT, ADD and ZERO reduced to one update sequence per cell, lowest
+// offset first.
+func Canonicalise(ops []Op) ([]Op, error) {
+	return core.Canonicalise(ops)
+}
+
+// CanonicaliseForCells is Canonicalise for the given cell model, merging
+// only the updates that are sound under it.
+func CanonicaliseForCells(ops []Op, cells CellModel) ([]Op, error) {
+	return core.CanonicaliseForCells(ops, cells)
+}
+
+// Fingerprint is a stable hash of a normal form.
+type Fingerprint = core.Fingerprint
+
+// FingerprintOf returns the fingerprint of the normal form of ops under
+// cells.
+func FingerprintOf(ops []Op, cells CellModel) (Fingerprint, error) {
+	return core.FingerprintOf(ops, cells)
+}
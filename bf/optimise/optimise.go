@@ -0,0 +1,48 @@
+// Package optimise rewrites IR into equivalent, faster IR.
+package optimise
+
+import (
+	"github.com/lcox74/bfcc/bf/ir"
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// Level selects which passes run.
+type Level = core.OptLevel
+
+// Optimisation levels.
+const (
+	O0 = core.O0 // none
+	O1 = core.O1 // merge adjacent ops and drop no-ops
+	O2 = core.O2 // all passes
+	Og = core.Og // none, on IR from ir.LowerUnfolded, for debugging
+)
+
+// Options selects what Optimise does. The zero value is O0 for wrapping
+// unsigned cells.
+type Options = core.Options
+
+// Report describes what Optimise did: rewrites per pass, op counts before
+// and after, and warnings about rewrites that change what a program does in
+// corner cases.
+type Report = core.Report
+
+// CostModel is what a backend's code for each op costs. Options.Costs
+// selects the model the schedule pass orders cell updates for; the backend
+// packages export a model for each target.
+type CostModel = core.CostModel
+
+// StepCosts is the VM's cost model, where every op is one step. It is the
+// default when Options.Costs is nil.
+var StepCosts = &core.StepCosts
+
+// PassCount is the number of rewrites one pass made.
+type PassCount = core.PassCount
+
+// Warning is a note about one rewrite, at a source position when known.
+type Warning = core.Warning
+
+// Optimise applies the passes for opts.Level that are sound under
+// opts.Cells. It returns an error if ops is not valid IR.
+func Optimise(ops []ir.Op, opts Options) ([]ir.Op, *Report, error) {
+	return core.Optimise(ops, opts)
+}
@@ -0,0 +1,51 @@
+// Package token splits Brainfuck source into tokens. Every byte other than
+// the eight commands is a comment and produces no token.
+package token
+
+import "github.com/lcox74/bfcc/internal/core"
+
+// Kind is the kind of a token, one per command.
+type Kind = core.TokenKind
+
+// Token kinds.
+const (
+	Invalid    = core.TokInvalid
+	ShiftRight = core.TokShiftRight // >
+	ShiftLeft  = core.TokShiftLeft  // <
+	Add        = core.TokAdd        // +
+	Sub        = core.TokSub        // -
+	Out        = core.TokOut        // .
+	In         = core.TokIn         // ,
+	LBracket   = core.TokLBracket   // [
+	RBracket   = core.TokRBracket   // ]
+	EOF        = core.TokEOF        // end of the source, always the last token
+)
+
+// Token is one command and where it is in the source.
+type Token = core.Token
+
+// Position is a location in the source: a byte offset and a 1-based line
+// and column.
+type Position = core.Position
+
+// Source is one named file of a program.
+type Source = core.Source
+
+// Sources is a program of several files joined into one, which makes
+// positions in it relative to their files.
+type Sources = core.Sources
+
+// JoinSources joins files into one program. Each starts on a line of its
+// own.
+func JoinSources(files ...Source) *Sources {
+	return core.JoinSources(files...)
+}
+
+// NoOptDirective, in the comment before a [, sets the token's NoOpt: the
+// optimiser leaves that loop as it is.
+const NoOptDirective = core.NoOptDirective
+
+// Tokenize returns the tokens of src, ending with an EOF token.
+func Tokenize(src []byte) []Token {
+	return core.Tokenize(src)
+}
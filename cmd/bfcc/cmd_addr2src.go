@@ -0,0 +1,94 @@
+package main
+
+import (
+	"debug/elf"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lcox74/bfcc/internal/srcmap"
+)
+
+func cmdAddr2Src(args []string) {
+	fs := flag.NewFlagSet("addr2src", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bfcc addr2src <binary> <address>...")
+		fmt.Fprintln(os.Stderr, "\nReports the IR op and source position of code addresses in a binary")
+		fmt.Fprintln(os.Stderr, "built with `bfcc build -srcmap`, eg. the ip of a segfault in dmesg.")
+		fmt.Fprintln(os.Stderr, "Addresses are hex, with or without 0x.")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() < 2 {
+		fs.Usage()
+	}
+
+	file := filepath.Clean(fs.Arg(0))
+	m, err := readSourceMap(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, arg := range fs.Args()[1:] {
+		addr, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(arg), "0x"), 16, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid address %q\n", arg)
+			os.Exit(1)
+		}
+
+		e, ok := m.Lookup(addr)
+		if !ok {
+			failed = true
+			fmt.Printf("%#x: not in the program's code\n", addr)
+			continue
+		}
+		fmt.Printf("%#x: %s\n", addr, describeEntry(e, addr))
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// readSourceMap loads the source map embedded in a native executable.
+func readSourceMap(file string) (*srcmap.Map, error) {
+	f, err := elf.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sec := f.Section(srcmap.SectionName)
+	if sec == nil {
+		return nil, fmt.Errorf("no source map (build with -srcmap)")
+	}
+	data, err := sec.Data()
+	if err != nil {
+		return nil, err
+	}
+	return srcmap.Decode(data)
+}
+
+// describeEntry says what addr, inside e, belongs to.
+func describeEntry(e srcmap.Entry, addr uint64) string {
+	name := strings.Join(strings.Fields(e.Name), " ")
+	if e.Op < 0 {
+		return fmt.Sprintf("%s +%#x (runtime)", name, addr-e.Addr)
+	}
+
+	desc := fmt.Sprintf("op %d (%s) +%#x", e.Op, name, addr-e.Addr)
+	if e.Pos != nil {
+		desc += fmt.Sprintf(", line %d col %d", e.Pos.Line, e.Pos.Column)
+		if e.Pos.File != "" {
+			desc += " of " + e.Pos.File
+		}
+	}
+	return desc
+}
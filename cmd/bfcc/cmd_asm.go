@@ -7,26 +7,62 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/lcox74/bfcc/internal/codegen/avr"
+	"github.com/lcox74/bfcc/internal/codegen/avrasm"
+	"github.com/lcox74/bfcc/internal/codegen/c64"
+	"github.com/lcox74/bfcc/internal/codegen/ca65"
 	"github.com/lcox74/bfcc/internal/codegen/gas"
+	"github.com/lcox74/bfcc/internal/codegen/goasm"
+	"github.com/lcox74/bfcc/internal/codegen/linux"
+	"github.com/lcox74/bfcc/internal/codegen/nasm"
 	"github.com/lcox74/bfcc/internal/core"
 )
 
 func cmdAsm(args []string) {
 	fs := flag.NewFlagSet("asm", flag.ExitOnError)
-	optLevel := fs.Int("O", 2, "optimization level (0, 1, or 2)")
-	output := fs.String("o", "", "output file (default: input file with .s extension)")
+	optLevel := optLevelFlag(fs, core.O2, "optimization `level` (0, 1, 2, or g)")
+	cellModel := cellFlags(fs)
+	midTape := midTapeFlag(fs)
+	argvInput := fs.Bool("argv-input", false, "read input from the first command-line argument instead of stdin")
+	tapeEnv := fs.Bool("tape-env", false, "size the tape from the BF_TAPE environment variable at startup")
+	info := fs.Bool("info", false, "embed a --bfcc-info handler reporting the compiler version and source hash")
+	chain := chainFlag(fs)
+	dialect := dialectFlag(fs)
+	debug := debugFlag(fs)
+	syntax := fs.String("syntax", "gas", "assembler syntax (gas for GNU as AT&T syntax, nasm for nasm and yasm Intel syntax, ca65 for 6502 assembly for cc65's ca65, avr for AVR assembly for avr-gcc, or go for Go assembly and a stub Go file to build into Go programs)")
+	machine := fs.String("machine", "c64", "with -syntax ca65, the 6502 machine whose ROM routines the I/O calls (c64 or apple2)")
+	mcu := fs.String("mcu", "atmega328p", "with -syntax avr, the microcontroller (atmega328p or atmega2560)")
+	tapeSize := fs.Int("tape-size", 0, "with -syntax avr, the `cells` on the tape (default all the SRAM but a little stack)")
+	io := fs.String("io", "uart", "with -syntax avr, how , and . do their I/O (uart for USART0, or extern to call bf_getc and bf_putc)")
+	baud := fs.Int("baud", avr.Baud, "with -syntax avr and -io uart, the serial port's speed")
+	pkg := fs.String("package", "main", "with -syntax go, the Go package the files are in")
+	output := fs.String("o", "", "output file (default: input file with .s extension, .asm for nasm, or _amd64.s for go)")
+	showProgress := fs.Bool("progress", false, "show the ops processed and the time remaining on stderr")
 	fs.Usage = func() {
-		fmt.Fprintln(os.Stderr, "usage: bfcc asm [-O level] [-o output] <file>")
+		fmt.Fprintln(os.Stderr, "usage: bfcc asm [options] <file>")
 		fs.PrintDefaults()
 		os.Exit(1)
 	}
-	fs.Parse(args)
+	parseFlags(fs, args)
 
 	if fs.NArg() != 1 {
 		fs.Usage()
 	}
 
-	level := parseOptLevel(*optLevel)
+	if *syntax != "gas" && *syntax != "nasm" && *syntax != "ca65" && *syntax != "avr" && *syntax != "go" {
+		fmt.Fprintf(os.Stderr, "unknown syntax: %s (must be gas, nasm, ca65, avr or go)\n", *syntax)
+		os.Exit(1)
+	}
+	checkSyntax(fs, *syntax)
+	m, err := ca65.ParseMachine(*machine)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	avrOpts := checkAVR(fs, *mcu, *tapeSize, *io, *baud)
+
+	level := *optLevel
+	cells := *cellModel
 	file := filepath.Clean(fs.Arg(0))
 	src := readSource(file)
 
@@ -34,21 +70,67 @@ func cmdAsm(args []string) {
 	outFile := *output
 	if outFile == "" {
 		outFile = strings.TrimSuffix(file, ".bf") + ".s"
+		switch *syntax {
+		case "nasm":
+			outFile = strings.TrimSuffix(file, ".bf") + ".asm"
+		case "go":
+			outFile = strings.TrimSuffix(file, ".bf") + "_amd64.s"
+		}
+	}
+
+	var prog *progress
+	if *showProgress {
+		prog = newProgress()
 	}
 
 	// Compile to IR
-	tokens := core.Tokenize(src)
-	ops, err := core.Lower(tokens)
+	ops, err := lower(src, core.TokenizeDialect(src, parseDialect(*dialect, *chain)), *chain, level)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
-	ops = core.OptimiseWithLevel(ops, level)
+	costs := &linux.X86_64Costs
+	switch *syntax {
+	case "ca65":
+		costs = &c64.Costs
+	case "avr":
+		costs = &avr.Costs
+	}
+	ops, err = optimiseWithProgress(ops, level, cells, costs, false, prog)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *debug {
+		ops = debugOps(ops, cells, nil)
+	}
 
 	// Generate assembly
-	gen := gas.NewGenerator(ops)
-	asm := gen.Generate()
+	gen := asmOptions{cells: cells, midTape: *midTape, argvInput: *argvInput, tapeEnv: *tapeEnv, debug: *debug}
+	if *info {
+		gen.info = infoMessage([]string{file}, src, *tapeEnv)
+	}
+	if prog != nil {
+		prog.begin()
+		gen.progress = prog.codegen
+	}
+
+	var asm, stub string
+	switch *syntax {
+	case "nasm":
+		asm = nasm.NewGenerator(ops, gen.nasm()...).Generate()
+	case "ca65":
+		asm = ca65.NewGenerator(ops, gen.ca65(m)...).Generate()
+	case "avr":
+		asm = avrasm.NewGenerator(ops, append(avrOpts, gen.avr()...)...).Generate()
+	case "go":
+		g := goasm.NewGenerator(ops, append(gen.goasm(), goasm.WithPackage(*pkg))...)
+		asm, stub = g.Generate(), g.Stub()
+	default:
+		asm = gas.NewGenerator(ops, gen.gas()...).Generate()
+	}
+	prog.done()
 
 	// Write assembly file
 	if err := os.WriteFile(outFile, []byte(asm), 0644); err != nil {
@@ -57,4 +139,179 @@ func cmdAsm(args []string) {
 	}
 
 	fmt.Printf("generated %s -> %s\n", file, outFile)
+
+	// Write the Go stub declaring the function beside it
+	if *syntax == "go" {
+		stubFile := strings.TrimSuffix(outFile, filepath.Ext(outFile)) + ".go"
+		if err := os.WriteFile(stubFile, []byte(stub), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("generated %s -> %s\n", file, stubFile)
+	}
+}
+
+// asmOptions are the generator options asm was given, for either syntax.
+type asmOptions struct {
+	cells                       core.CellModel
+	midTape, argvInput, tapeEnv bool
+	info                        string
+	debug                       bool
+	progress                    func(done, total int)
+}
+
+// gas returns the gas package's options.
+func (o asmOptions) gas() []gas.Option {
+	opts := []gas.Option{gas.WithCellOverflow(o.cells.Overflow)}
+	if o.cells.Signed {
+		opts = append(opts, gas.WithSignedCells())
+	}
+	if o.midTape {
+		opts = append(opts, gas.WithMidTape())
+	}
+	if o.argvInput {
+		opts = append(opts, gas.WithArgvInput())
+	}
+	if o.tapeEnv {
+		opts = append(opts, gas.WithTapeEnv())
+	}
+	if o.info != "" {
+		opts = append(opts, gas.WithInfo(o.info))
+	}
+	if o.debug {
+		opts = append(opts, gas.WithDebug())
+	}
+	if o.progress != nil {
+		opts = append(opts, gas.WithProgress(o.progress))
+	}
+	return opts
+}
+
+// nasm returns the nasm package's options.
+func (o asmOptions) nasm() []nasm.Option {
+	opts := []nasm.Option{nasm.WithCellOverflow(o.cells.Overflow)}
+	if o.cells.Signed {
+		opts = append(opts, nasm.WithSignedCells())
+	}
+	if o.midTape {
+		opts = append(opts, nasm.WithMidTape())
+	}
+	if o.argvInput {
+		opts = append(opts, nasm.WithArgvInput())
+	}
+	if o.tapeEnv {
+		opts = append(opts, nasm.WithTapeEnv())
+	}
+	if o.info != "" {
+		opts = append(opts, nasm.WithInfo(o.info))
+	}
+	if o.debug {
+		opts = append(opts, nasm.WithDebug())
+	}
+	if o.progress != nil {
+		opts = append(opts, nasm.WithProgress(o.progress))
+	}
+	return opts
+}
+
+// ca65 returns the ca65 package's options, for machine m.
+func (o asmOptions) ca65(m ca65.Machine) []ca65.Option {
+	opts := []ca65.Option{ca65.WithMachine(m), ca65.WithCellOverflow(o.cells.Overflow)}
+	if o.cells.Signed {
+		opts = append(opts, ca65.WithSignedCells())
+	}
+	if o.midTape {
+		opts = append(opts, ca65.WithMidTape())
+	}
+	if o.progress != nil {
+		opts = append(opts, ca65.WithProgress(o.progress))
+	}
+	return opts
+}
+
+// avr returns the avrasm package's options, but for those checkAVR
+// returns.
+func (o asmOptions) avr() []avrasm.Option {
+	opts := []avrasm.Option{avrasm.WithCellOverflow(o.cells.Overflow)}
+	if o.cells.Signed {
+		opts = append(opts, avrasm.WithSignedCells())
+	}
+	if o.midTape {
+		opts = append(opts, avrasm.WithMidTape())
+	}
+	if o.progress != nil {
+		opts = append(opts, avrasm.WithProgress(o.progress))
+	}
+	return opts
+}
+
+// goasm returns the goasm package's options, but for the package name.
+func (o asmOptions) goasm() []goasm.Option {
+	opts := []goasm.Option{goasm.WithCellOverflow(o.cells.Overflow)}
+	if o.cells.Signed {
+		opts = append(opts, goasm.WithSignedCells())
+	}
+	if o.midTape {
+		opts = append(opts, goasm.WithMidTape())
+	}
+	if o.debug {
+		opts = append(opts, goasm.WithDebug())
+	}
+	if o.progress != nil {
+		opts = append(opts, goasm.WithProgress(o.progress))
+	}
+	return opts
+}
+
+// checkSyntax exits if a flag asm was given does not apply to syntax: the
+// 6502 programs of ca65 and the AVR ones have no arguments, environment or
+// stdout, nor do Go's functions, and -machine, -mcu, -tape-size, -io,
+// -baud and -package are only for them.
+func checkSyntax(fs *flag.FlagSet, syntax string) {
+	fs.Visit(func(f *flag.Flag) {
+		switch {
+		case f.Name == "machine" && syntax != "ca65":
+			fmt.Fprintln(os.Stderr, "-machine is only used with -syntax ca65")
+			os.Exit(1)
+		case (f.Name == "mcu" || f.Name == "tape-size" || f.Name == "io" || f.Name == "baud") && syntax != "avr":
+			fmt.Fprintf(os.Stderr, "-%s is only used with -syntax avr\n", f.Name)
+			os.Exit(1)
+		case f.Name == "package" && syntax != "go":
+			fmt.Fprintln(os.Stderr, "-package is only used with -syntax go")
+			os.Exit(1)
+		case (f.Name == "argv-input" || f.Name == "tape-env" || f.Name == "info") && (syntax == "ca65" || syntax == "avr" || syntax == "go") && f.Value.String() == "true":
+			fmt.Fprintf(os.Stderr, "-syntax %s cannot be used with -%s\n", syntax, f.Name)
+			os.Exit(1)
+		}
+	})
+}
+
+// checkAVR exits if the -syntax avr flags are out of range, or -baud is
+// given without -io uart, and returns them as avrasm options.
+func checkAVR(fs *flag.FlagSet, mcu string, tapeSize int, io string, baud int) []avrasm.Option {
+	m, ok := avr.MCUs[mcu]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown microcontroller: %s (must be atmega328p or atmega2560)\n", mcu)
+		os.Exit(1)
+	}
+	if tapeSize < 0 || tapeSize > m.TapeSize() {
+		fmt.Fprintf(os.Stderr, "invalid tape size: %d (must be at most %d cells on the %s)\n", tapeSize, m.TapeSize(), mcu)
+		os.Exit(1)
+	}
+	i, err := avrasm.ParseIO(io)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "baud" && i != avrasm.UART {
+			fmt.Fprintln(os.Stderr, "-baud is only used with -io uart")
+			os.Exit(1)
+		}
+	})
+	if _, ok := avrasm.UBRR(m, baud); !ok {
+		fmt.Fprintf(os.Stderr, "invalid baud rate: %d (out of range for a %d MHz clock)\n", baud, m.Clock/1_000_000)
+		os.Exit(1)
+	}
+	return []avrasm.Option{avrasm.WithMCU(m), avrasm.WithTapeSize(tapeSize), avrasm.WithIO(i), avrasm.WithBaud(baud)}
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/lcox74/bfcc/internal/plugin"
+)
+
+// archDescriptions say what each built-in -arch builds, for bfcc backends.
+var archDescriptions = map[string]string{
+	"amd64":   "x86_64 Linux, FreeBSD or macOS executable, or raw machine code",
+	"riscv64": "RISC-V 64 Linux executable",
+	"386":     "i386 Linux executable, or bare-metal Multiboot image",
+	"arm":     "ARMv7 Linux executable",
+	"arm64":   "arm64 macOS executable",
+	"wasm":    "WebAssembly module, or WASI program",
+	"6502":    "Commodore 64 program",
+	"z80":     "CP/M program",
+	"avr":     "Intel HEX file for an ATmega microcontroller",
+}
+
+func cmdBackends(args []string) {
+	fs := flag.NewFlagSet("backends", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bfcc backends")
+		fmt.Fprintln(os.Stderr, "\nLists the -arch values of build: the built-in backends, then the plugins")
+		fmt.Fprintf(os.Stderr, "found on the PATH, executables named %s<arch>.\n", plugin.Prefix)
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+	}
+
+	for _, arch := range archs {
+		fmt.Printf("%-10s %s (built in)\n", arch, archDescriptions[arch])
+	}
+	failed := false
+	for _, p := range plugin.Discover() {
+		if _, ok := archDescriptions[p.Arch]; ok {
+			fmt.Printf("%-10s %s is hidden by the built-in backend\n", p.Arch, p.Path)
+			continue
+		}
+		info, err := p.Describe()
+		if err != nil {
+			failed = true
+			fmt.Printf("%-10s %v\n", p.Arch, err)
+			continue
+		}
+		fmt.Printf("%-10s %s (%s)\n", p.Arch, info.Description, p.Path)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/internal/expand"
+)
+
+func cmdBF(args []string) {
+	fs := flag.NewFlagSet("bf", flag.ExitOnError)
+	optLevel := optLevelFlag(fs, core.O2, "optimization `level` (0, 1, 2, or g)")
+	cellModel := cellFlags(fs)
+	dialect := dialectFlag(fs)
+	width := fs.Int("width", 80, "wrap lines at this many bytes (0 for no wrapping)")
+	output := fs.String("o", "", "output file (default: stdout)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bfcc bf [options] <file>...")
+		fmt.Fprintln(os.Stderr, "\nProduces the optimised program as plain Brainfuck, with no comments,")
+		fmt.Fprintln(os.Stderr, "for any interpreter with the same cell model. More than one file is")
+		fmt.Fprintln(os.Stderr, "written as the files joined in order.")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+	}
+
+	level := *optLevel
+	cells := *cellModel
+	srcs := readSources(fs.Args())
+	src := srcs.Src
+
+	ops, err := lower(src, core.TokenizeDialect(src, parseDialect(*dialect, "")), "", level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, srcs.LocateError(err))
+		os.Exit(1)
+	}
+	ops, err = optimiseWithProgress(ops, level, cells, nil, false, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// The optimiser only makes a ZERO, or a range op, where a [-] loop
+	// does the same under cells, so the long-hand form is equivalent
+	out := expand.Expand(ops, expand.Config{Width: *width})
+
+	if *output == "" {
+		fmt.Print(out)
+		return
+	}
+	if err := os.WriteFile(*output, []byte(out), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -5,57 +5,663 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 
+	"github.com/lcox74/bfcc/internal/codegen/avr"
+	"github.com/lcox74/bfcc/internal/codegen/c64"
+	"github.com/lcox74/bfcc/internal/codegen/cpm"
+	"github.com/lcox74/bfcc/internal/codegen/darwin"
+	"github.com/lcox74/bfcc/internal/codegen/freebsd"
 	"github.com/lcox74/bfcc/internal/codegen/linux"
+	"github.com/lcox74/bfcc/internal/codegen/wasm"
 	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/internal/coverage"
+	"github.com/lcox74/bfcc/internal/plugin"
 )
 
 func cmdBuild(args []string) {
 	fs := flag.NewFlagSet("build", flag.ExitOnError)
-	optLevel := fs.Int("O", 2, "optimization level (0, 1, or 2)")
-	output := fs.String("o", "", "output file (default: input file without extension)")
+	optLevel := optLevelFlag(fs, core.O2, "optimization `level` (0, 1, 2, or g)")
+	superopt := fs.Bool("superopt", false, "experimental: at -O 2, replace small loops with shorter code found by exhaustive search")
+	sizeOpt := fs.Bool("Os", false, "make the amd64 code smaller rather than faster, with inc/dec and 8-bit immediates, and report its size")
+	march := fs.String("march", "x86-64", "the amd64 CPUs to build for (x86-64 for all of them, or x86-64-v3 for Haswell and later, scanning and copying cells with AVX2 and checking for it at startup)")
+	pgo := fs.String("pgo", "", "guide the amd64 code by a `profile` from bfcc run -coverage, aligning its hot loops and inlining its hot writes")
+	cellModel := cellFlags(fs)
+	midTape := midTapeFlag(fs)
+	argvInput := fs.Bool("argv-input", false, "read input from the first command-line argument instead of stdin")
+	tapeEnv := fs.Bool("tape-env", false, "size the tape from the BF_TAPE environment variable at startup")
+	tapeInit := fs.String("tape-init", "", "load the tape with this file's bytes, from the start cell, in the prologue")
+	tapeGuard := fs.Bool("tape-guard", false, "map the tape between guard pages, and report a cell accessed off either end with the code address rather than segfaulting (amd64 Linux)")
+	dumpTape := fs.Bool("dump-tape", false, "write the tape, up to its last non-zero cell, to the file named by BF_DUMP at exit")
+	info := fs.Bool("info", false, "embed a --bfcc-info handler reporting the compiler version and source hash")
+	ident := fs.Bool("ident", false, "record the compiler version in .comment and the build flags in a .note.bfcc section")
+	chain := chainFlag(fs)
+	dialect := dialectFlag(fs)
+	debug := debugFlag(fs)
+	srcMap := fs.Bool("srcmap", false, "embed a source map for bfcc addr2src")
+	strip := fs.Bool("strip", true, "leave out the symbol table")
+	noStrip := fs.Bool("no-strip", false, "emit a symbol table naming the runtime helpers and loops (same as -strip=false)")
+	format := fs.String("format", "exe", "output format (exe for the target's executable or program, or raw for flat position-independent machine code with no ELF wrapper, mmapping the tape at startup, or obj for an object file defining main that calls getchar and putchar, to link with cc, on amd64 Linux and FreeBSD)")
+	raw := fs.Bool("raw", false, "same as -format raw")
+	tapeArg := fs.Bool("tape-arg", false, "with -format raw, take the tape from the caller in RDI and return to it, rather than mmapping the tape and exiting, or with -format obj, define bf_main(tape, len), making system calls, rather than main")
+	lib := fs.Bool("lib", false, "output a static library, lib<name>.a, and a C header declaring it, <name>.h, to call the program from C (amd64)")
+	mode := fs.String("mode", "", "permissions of the output file, in octal (default 0755, or 0644 for a raw blob, object file, static library, Multiboot image, WebAssembly module, C64 or CP/M program, or Intel HEX file)")
+	showProgress := fs.Bool("progress", false, "show the ops processed and the time remaining on stderr")
+	output := fs.String("o", "", "output file (default: the first input file without extension)")
+	arch := fs.String("arch", "amd64", "target architecture (amd64, riscv64, 386, arm, arm64 with -os darwin, wasm for a WebAssembly module, 6502 for a C64 program, z80 for a CP/M program, avr for an Intel HEX file, or a plugin's, see bfcc backends)")
+	mcu := fs.String("mcu", "atmega328p", "with -arch avr, the microcontroller (atmega328p or atmega2560)")
+	targetOS := fs.String("os", "linux", "target operating system (linux, freebsd, darwin for a macOS Mach-O executable, wasi with -arch wasm, c64 with -arch 6502, cpm with -arch z80, or baremetal with -arch 386 for a Multiboot image)")
+	target := fs.String("target", "", "target as os/arch, eg. freebsd/amd64, or wasi for wasi/wasm, c64 for c64/6502, cpm for cpm/z80 and baremetal for baremetal/386, instead of -os and -arch")
 	fs.Usage = func() {
-		fmt.Fprintln(os.Stderr, "usage: bfcc build [-O level] [-o output] <file>")
-		fmt.Fprintln(os.Stderr, "\nProduces a native ELF64 Linux executable directly.")
+		fmt.Fprintln(os.Stderr, "usage: bfcc build [options] <file>...")
+		fmt.Fprintln(os.Stderr, "\nProduces a native ELF Linux or FreeBSD (or Mach-O macOS) executable directly.")
+		fmt.Fprintln(os.Stderr, "More than one file is built as the files joined in order.")
 		fs.PrintDefaults()
 		os.Exit(1)
 	}
-	fs.Parse(args)
+	parseFlags(fs, args)
 
-	if fs.NArg() != 1 {
+	if fs.NArg() < 1 {
 		fs.Usage()
 	}
+	if *target != "" {
+		*targetOS, *arch = parseTarget(*target)
+	}
+	checkArch(fs, *arch)
+	checkOS(fs, *targetOS, *arch)
+	checkMCU(fs, *mcu, *arch)
+	*format = parseFormat(fs, *format, *raw)
+	*raw = *format == "raw"
+	obj := *format == "obj"
+	if obj {
+		checkObject(fs, *targetOS, *arch)
+	}
+	if *raw {
+		checkRaw(fs, *targetOS, *arch, *tapeArg)
+	} else if *tapeArg && !obj {
+		fmt.Fprintln(os.Stderr, "-tape-arg is only used with -format raw or obj")
+		os.Exit(1)
+	}
+	if *lib {
+		checkLib(fs, *targetOS, *arch)
+	}
+	if *pgo != "" && fs.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "-pgo needs a single source file")
+		os.Exit(1)
+	}
+	if *tapeGuard && *tapeEnv {
+		fmt.Fprintln(os.Stderr, "-tape-guard cannot be used with -tape-env")
+		os.Exit(1)
+	}
+	avx2 := parseMarch(*march)
+	backend, backendInfo := findBackend(*arch)
 
-	level := parseOptLevel(*optLevel)
-	file := filepath.Clean(fs.Arg(0))
-	src := readSource(file)
+	level := *optLevel
+	if *mode == "" {
+		*mode = "0755"
+		if *raw || obj || *lib || *targetOS == "baremetal" || *arch == "wasm" || *arch == "6502" || *arch == "z80" || *arch == "avr" {
+			*mode = "0644" // loaded by a host, emulator or programmer, not run
+		}
+		if backend != nil && !backendInfo.Executable {
+			*mode = "0644"
+		}
+	}
+	perm := parseFileMode(*mode)
+	cells := *cellModel
+	srcs := readSources(fs.Args())
+	file, src := srcs.Names()[0], srcs.Src
 
 	// Determine output filename
 	outFile := *output
+	if outFile == "" && *lib {
+		outFile = filepath.Join(filepath.Dir(file), "lib"+strings.TrimSuffix(filepath.Base(file), ".bf")+".a")
+	}
 	if outFile == "" {
 		outFile = strings.TrimSuffix(file, ".bf")
+		switch {
+		case backend != nil:
+			outFile += backendInfo.Suffix
+		case *raw:
+			outFile += ".bin"
+		case obj:
+			outFile += ".o"
+		case *targetOS == "baremetal":
+			outFile += ".elf"
+		case *arch == "wasm":
+			outFile += ".wasm"
+		case *arch == "6502":
+			outFile += ".prg"
+		case *arch == "z80":
+			outFile += ".com"
+		case *arch == "avr":
+			outFile += ".hex"
+		}
+	}
+
+	var prog *progress
+	if *showProgress {
+		prog = newProgress()
 	}
 
 	// Compile to IR
-	tokens := core.Tokenize(src)
-	ops, err := core.Lower(tokens)
+	ops, err := lower(src, core.TokenizeDialect(src, parseDialect(*dialect, *chain)), *chain, level)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, srcs.LocateError(err))
 		os.Exit(1)
 	}
+	srcs.LocateOps(ops)
 
-	ops = core.OptimiseWithLevel(ops, level)
+	ops, err = optimiseWithProgress(ops, level, cells, costModels[*arch], *superopt, prog)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	var tape []byte
+	if *tapeInit != "" {
+		tape = readTapeInit(*tapeInit, *midTape)
+	}
+	if *debug {
+		ops = debugOps(ops, cells, tape)
+	}
 
 	// Generate ELF binary
-	gen := linux.NewX86_64Generator(ops)
-	binary := gen.GenerateELF()
+	genOpts := []linux.Option{linux.WithCellOverflow(cells.Overflow)}
+	if cells.Signed {
+		genOpts = append(genOpts, linux.WithSignedCells())
+	}
+	if *midTape {
+		genOpts = append(genOpts, linux.WithMidTape())
+	}
+	if *argvInput {
+		genOpts = append(genOpts, linux.WithArgvInput())
+	}
+	if *tapeEnv {
+		genOpts = append(genOpts, linux.WithTapeEnv())
+	}
+	if *tapeGuard {
+		genOpts = append(genOpts, linux.WithTapeGuard())
+	}
+	if *tapeInit != "" {
+		genOpts = append(genOpts, linux.WithTapeInit(tape))
+	}
+	if *dumpTape {
+		genOpts = append(genOpts, linux.WithDumpTape())
+	}
+	if *info {
+		genOpts = append(genOpts, linux.WithInfo(infoMessage(srcs.Names(), src, *tapeEnv)))
+	}
+	if *ident {
+		genOpts = append(genOpts, linux.WithIdent("bfcc "+version, buildFlags(fs)))
+	}
+	if *debug {
+		genOpts = append(genOpts, linux.WithDebug())
+	}
+	if *srcMap {
+		genOpts = append(genOpts, linux.WithSourceMap())
+	}
+	if !*strip || *noStrip {
+		genOpts = append(genOpts, linux.WithSymbols())
+	}
+	if *pgo != "" {
+		genOpts = append(genOpts, linux.WithProfile(readProfile(*pgo, src, ops)))
+	}
+	if avx2 {
+		genOpts = append(genOpts, linux.WithAVX2())
+	}
+	speedOpts := slices.Clone(genOpts) // for the -Os report
+	if *sizeOpt {
+		genOpts = append(genOpts, linux.WithSize())
+	}
+	sizeOpts := slices.Clone(genOpts)
+
+	if prog != nil {
+		prog.begin()
+		genOpts = append(genOpts, linux.WithProgress(prog.codegen))
+	}
+
+	var binary []byte
+	var header, headerFile string
+	switch {
+	case *lib:
+		var prefix string
+		headerFile, prefix = libraryNames(outFile)
+		binary, header = linux.NewX86_64Generator(ops, genOpts...).GenerateLibrary(prefix)
+	case backend != nil:
+		binary, err = backend.Build(plugin.NewRequest(*arch, ops, cells, *midTape))
+	case *arch == "6502":
+		binary, err = c64.NewGenerator(ops, genOpts...).GeneratePRG()
+	case *arch == "z80":
+		binary, err = cpm.NewGenerator(ops, genOpts...).GenerateCOM()
+	case *arch == "avr":
+		binary, err = avr.NewGenerator(ops, avr.MCUs[*mcu], genOpts...).GenerateHex()
+	case *targetOS == "wasi":
+		binary = wasm.NewGenerator(ops, genOpts...).GenerateWASI()
+	case *arch == "wasm":
+		binary = wasm.NewGenerator(ops, genOpts...).GenerateModule()
+	case *targetOS == "darwin" && *arch == "arm64":
+		binary = darwin.NewARM64Generator(ops, genOpts...).GenerateMachO()
+	case *targetOS == "darwin":
+		gen := darwin.NewX86_64Generator(ops, genOpts...)
+		binary, err = gen.GenerateMachO(), gen.Err()
+	case obj && *tapeArg && *targetOS == "freebsd":
+		gen := freebsd.NewX86_64Generator(ops, genOpts...)
+		binary, err = gen.GenerateFunctionObject("bf_main"), gen.Err()
+	case obj && *tapeArg:
+		binary = linux.NewX86_64Generator(ops, genOpts...).GenerateFunctionObject("bf_main")
+	case obj:
+		binary = linux.NewX86_64Generator(ops, genOpts...).GenerateObject()
+	case *raw && *tapeArg && *targetOS == "freebsd":
+		gen := freebsd.NewX86_64Generator(ops, genOpts...)
+		binary, err = gen.GenerateRawFunction(), gen.Err()
+	case *raw && *tapeArg:
+		binary = linux.NewX86_64Generator(ops, genOpts...).GenerateRawFunction()
+	case *raw && *targetOS == "freebsd":
+		gen := freebsd.NewX86_64Generator(ops, genOpts...)
+		binary, err = gen.GenerateRaw(), gen.Err()
+	case *raw:
+		binary = linux.NewX86_64Generator(ops, genOpts...).GenerateRaw()
+	case *targetOS == "freebsd":
+		gen := freebsd.NewX86_64Generator(ops, genOpts...)
+		binary, err = gen.GenerateELF(), gen.Err()
+	case *arch == "riscv64":
+		binary = linux.NewRISCV64Generator(ops, genOpts...).GenerateELF()
+	case *targetOS == "baremetal":
+		binary = linux.NewI386Generator(ops, genOpts...).GenerateMultiboot()
+	case *arch == "386":
+		binary = linux.NewI386Generator(ops, genOpts...).GenerateELF()
+	case *arch == "arm":
+		binary = linux.NewARMGenerator(ops, genOpts...).GenerateELF()
+	default:
+		binary = linux.NewX86_64Generator(ops, genOpts...).GenerateELF()
+	}
+	prog.done()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
-	// Write executable file with executable permissions
-	if err := os.WriteFile(outFile, binary, 0755); err != nil {
+	// Write the executable, then set its mode exactly: WriteFile applies
+	// the umask, and leaves the mode of an existing file alone
+	if err := os.WriteFile(outFile, binary, perm); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	if err := os.Chmod(outFile, perm); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *lib {
+		if err := os.WriteFile(headerFile, []byte(header), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		outFile += ", " + headerFile
+	}
 
 	fmt.Printf("built %s -> %s\n", file, outFile)
+	if *sizeOpt {
+		size := len(linux.NewX86_64Generator(ops, sizeOpts...).Generate())
+		speed := len(linux.NewX86_64Generator(ops, speedOpts...).Generate())
+		fmt.Printf("code: %d bytes, %d without -Os (%+.1f%%), in %d bytes of output\n",
+			size, speed, 100*float64(size-speed)/float64(speed), len(binary))
+	}
+}
+
+// buildFlags returns the flags set on fs as they would be given on the
+// command line, for -ident, leaving out those that do not change the
+// executable's contents.
+func buildFlags(fs *flag.FlagSet) string {
+	var flags []string
+	fs.Visit(func(f *flag.Flag) {
+		switch {
+		case f.Name == "o" || f.Name == "output" || f.Name == "mode" || f.Name == "progress":
+		case isBoolFlag(f) && f.Value.String() == "true":
+			flags = append(flags, "-"+f.Name)
+		default:
+			flags = append(flags, fmt.Sprintf("-%s=%s", f.Name, f.Value))
+		}
+	})
+	return strings.Join(flags, " ")
+}
+
+// archs are the -arch values of the built-in backends. Any other names a
+// plugin.
+var archs = []string{"amd64", "riscv64", "386", "arm", "arm64", "wasm", "6502", "z80", "avr"}
+
+// checkArch rejects an unknown -arch, and the build flags the riscv64, 386,
+// arm, arm64, wasm, 6502, z80, avr and plugin backends do not support.
+// riscv64 executables are ELF64, so take -ident.
+func checkArch(fs *flag.FlagSet, arch string) {
+	if arch == "amd64" {
+		return
+	}
+	if _, ok := plugin.Find(arch); !ok && !slices.Contains(archs, arch) {
+		fmt.Fprintf(os.Stderr, "unknown architecture: %s (must be amd64, riscv64, 386, arm, arm64, wasm, 6502, z80, avr, or a plugin's, see bfcc backends)\n", arch)
+		os.Exit(1)
+	}
+	fs.Visit(func(f *flag.Flag) {
+		var unsupported bool
+		switch f.Name {
+		case "argv-input", "tape-env", "tape-guard", "dump-tape", "info", "srcmap", "no-strip", "Os":
+			unsupported = f.Value.String() == "true"
+		case "tape-init", "pgo", "march":
+			unsupported = true
+		case "ident":
+			unsupported = f.Value.String() == "true" && arch != "riscv64"
+		case "strip":
+			unsupported = f.Value.String() == "false"
+		}
+		if unsupported {
+			fmt.Fprintf(os.Stderr, "-arch %s cannot be used with -%s\n", arch, f.Name)
+			os.Exit(1)
+		}
+	})
+}
+
+// parseMarch reports whether -march asks for x86-64-v3 code rather than
+// code for every x86_64 CPU.
+func parseMarch(march string) bool {
+	switch march {
+	case "x86-64":
+		return false
+	case "x86-64-v3":
+		return true
+	}
+	fmt.Fprintf(os.Stderr, "unknown CPU level: %s (must be x86-64 or x86-64-v3)\n", march)
+	os.Exit(1)
+	return false
+}
+
+// parseTarget splits a -target of the form os/arch. WASI, the C64, CP/M and
+// bare metal have only the one architecture, so wasi alone is short for
+// wasi/wasm, c64 for c64/6502, cpm for cpm/z80 and baremetal for
+// baremetal/386.
+func parseTarget(target string) (targetOS, arch string) {
+	switch target {
+	case "wasi":
+		return "wasi", "wasm"
+	case "c64":
+		return "c64", "6502"
+	case "cpm":
+		return "cpm", "z80"
+	case "baremetal":
+		return "baremetal", "386"
+	}
+	targetOS, arch, ok := strings.Cut(target, "/")
+	if !ok {
+		fmt.Fprintf(os.Stderr, "invalid target: %s (must be os/arch, eg. freebsd/amd64)\n", target)
+		os.Exit(1)
+	}
+	return targetOS, arch
+}
+
+// checkOS rejects an unknown -os, an -arch the OS has no backend for, for
+// darwin the flags that add ELF sections, and for darwin and freebsd
+// -tape-guard, whose handler is installed with Linux's rt_sigaction. A
+// WebAssembly module runs on
+// no particular OS, so -arch wasm takes no -os but wasi, which makes it a
+// WASI program. -arch 6502 only targets the C64 and -arch z80 CP/M, so
+// they need no -os, and -arch avr runs on the bare chip, so takes no -os at
+// all. Nor does a plugin, which targets whatever it was written for.
+func checkOS(fs *flag.FlagSet, targetOS, arch string) {
+	if arch == "wasm" || arch == "6502" || arch == "z80" || arch == "avr" || !slices.Contains(archs, arch) {
+		only := map[string]string{"wasm": "wasi", "6502": "c64", "z80": "cpm"}[arch]
+		fs.Visit(func(f *flag.Flag) {
+			if (f.Name == "os" || f.Name == "target") && targetOS != only {
+				fmt.Fprintf(os.Stderr, "-arch %s cannot be used with -%s %s\n", arch, f.Name, f.Value)
+				os.Exit(1)
+			}
+		})
+		return
+	}
+	switch targetOS {
+	case "wasi":
+		fmt.Fprintln(os.Stderr, "-os wasi only supports -arch wasm")
+		os.Exit(1)
+	case "c64":
+		fmt.Fprintln(os.Stderr, "-os c64 only supports -arch 6502")
+		os.Exit(1)
+	case "cpm":
+		fmt.Fprintln(os.Stderr, "-os cpm only supports -arch z80")
+		os.Exit(1)
+	case "baremetal":
+		if arch != "386" {
+			fmt.Fprintln(os.Stderr, "-os baremetal only supports -arch 386")
+			os.Exit(1)
+		}
+		return
+	case "linux":
+		if arch == "arm64" {
+			fmt.Fprintln(os.Stderr, "-arch arm64 is only supported with -os darwin")
+			os.Exit(1)
+		}
+		return
+	case "freebsd":
+		if arch != "amd64" {
+			fmt.Fprintln(os.Stderr, "-os freebsd only supports -arch amd64")
+			os.Exit(1)
+		}
+		fs.Visit(func(f *flag.Flag) {
+			// FreeBSD's sigaction takes a different struct
+			if f.Name == "tape-guard" && f.Value.String() == "true" {
+				fmt.Fprintln(os.Stderr, "-os freebsd cannot be used with -tape-guard")
+				os.Exit(1)
+			}
+		})
+		return
+	case "darwin":
+	default:
+		fmt.Fprintf(os.Stderr, "unknown operating system: %s (must be linux, freebsd, darwin, wasi, c64, cpm, or baremetal)\n", targetOS)
+		os.Exit(1)
+	}
+	if arch != "amd64" && arch != "arm64" {
+		fmt.Fprintln(os.Stderr, "-os darwin only supports -arch amd64 and arm64")
+		os.Exit(1)
+	}
+	fs.Visit(func(f *flag.Flag) {
+		var unsupported bool
+		switch f.Name {
+		case "srcmap", "no-strip", "ident", "tape-guard":
+			unsupported = f.Value.String() == "true"
+		case "strip":
+			unsupported = f.Value.String() == "false"
+		}
+		if unsupported {
+			fmt.Fprintf(os.Stderr, "-os darwin cannot be used with -%s\n", f.Name)
+			os.Exit(1)
+		}
+	})
+}
+
+// parseFormat returns the output format -format and -raw ask for, exiting
+// on an unknown format, or -raw with another -format.
+func parseFormat(fs *flag.FlagSet, format string, raw bool) string {
+	switch format {
+	case "exe", "obj":
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name == "format" && raw {
+				fmt.Fprintf(os.Stderr, "-raw cannot be used with -format %s\n", format)
+				os.Exit(1)
+			}
+		})
+		if raw {
+			return "raw"
+		}
+		return format
+	case "raw":
+		return format
+	}
+	fmt.Fprintf(os.Stderr, "unknown format: %s (must be exe, raw, or obj)\n", format)
+	os.Exit(1)
+	return ""
+}
+
+// checkRaw rejects -format raw off amd64 Linux and FreeBSD, which have the
+// only position-independent backend, and with the flags that add ELF
+// sections, or with -tape-arg, the ones that read the process's arguments
+// and environment from the stack.
+func checkRaw(fs *flag.FlagSet, targetOS, arch string, tapeArg bool) {
+	if arch != "amd64" || (targetOS != "linux" && targetOS != "freebsd") {
+		fmt.Fprintf(os.Stderr, "-format raw is only supported on amd64 Linux and FreeBSD, not %s/%s\n", targetOS, arch)
+		os.Exit(1)
+	}
+	fs.Visit(func(f *flag.Flag) {
+		var unsupported bool
+		switch f.Name {
+		case "srcmap", "no-strip", "ident":
+			unsupported = f.Value.String() == "true"
+		case "strip":
+			unsupported = f.Value.String() == "false"
+		case "argv-input", "tape-env", "tape-guard", "dump-tape", "info":
+			if tapeArg && f.Value.String() == "true" {
+				fmt.Fprintf(os.Stderr, "-tape-arg cannot be used with -%s\n", f.Name)
+				os.Exit(1)
+			}
+		}
+		if unsupported {
+			fmt.Fprintf(os.Stderr, "-format raw cannot be used with -%s\n", f.Name)
+			os.Exit(1)
+		}
+	})
+}
+
+// checkObject rejects -format obj off amd64 Linux and FreeBSD, whose
+// System V calling convention main follows, and with the flags that read
+// the process's arguments or environment, write files, or add ELF
+// sections, which the C library and cc take care of instead.
+func checkObject(fs *flag.FlagSet, targetOS, arch string) {
+	if arch != "amd64" || (targetOS != "linux" && targetOS != "freebsd") {
+		fmt.Fprintf(os.Stderr, "-format obj is only supported on amd64 Linux and FreeBSD, not %s/%s\n", targetOS, arch)
+		os.Exit(1)
+	}
+	fs.Visit(func(f *flag.Flag) {
+		var unsupported bool
+		switch f.Name {
+		case "argv-input", "tape-env", "tape-guard", "dump-tape", "info", "srcmap", "no-strip", "ident":
+			unsupported = f.Value.String() == "true"
+		case "strip":
+			unsupported = f.Value.String() == "false"
+		}
+		if unsupported {
+			fmt.Fprintf(os.Stderr, "-format obj cannot be used with -%s\n", f.Name)
+			os.Exit(1)
+		}
+	})
+}
+
+// findBackend returns the plugin for a -arch that is not built in, and what
+// it says about itself, exiting if it cannot describe itself. It returns
+// nil for a built-in -arch.
+func findBackend(arch string) (*plugin.Plugin, plugin.Info) {
+	if slices.Contains(archs, arch) {
+		return nil, plugin.Info{}
+	}
+	p, _ := plugin.Find(arch)
+	info, err := p.Describe()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return &p, info
+}
+
+// checkLib rejects -lib off amd64 Linux and FreeBSD, whose System V calling
+// convention the library's entry function follows, and with the flags for
+// an executable's arguments, environment and ELF sections.
+func checkLib(fs *flag.FlagSet, targetOS, arch string) {
+	if arch != "amd64" || (targetOS != "linux" && targetOS != "freebsd") {
+		fmt.Fprintf(os.Stderr, "-lib is only supported on amd64 Linux and FreeBSD, not %s/%s\n", targetOS, arch)
+		os.Exit(1)
+	}
+	fs.Visit(func(f *flag.Flag) {
+		var unsupported bool
+		switch f.Name {
+		case "argv-input", "tape-env", "tape-guard", "dump-tape", "info", "srcmap", "no-strip", "ident", "raw":
+			unsupported = f.Value.String() == "true"
+		case "format":
+			if f.Value.String() != "exe" {
+				fmt.Fprintf(os.Stderr, "-lib cannot be used with -format %s\n", f.Value)
+				os.Exit(1)
+			}
+		case "tape-init":
+			unsupported = true
+		case "strip":
+			unsupported = f.Value.String() == "false"
+		}
+		if unsupported {
+			fmt.Fprintf(os.Stderr, "-lib cannot be used with -%s\n", f.Name)
+			os.Exit(1)
+		}
+	})
+}
+
+// libraryNames returns the header to write beside the -lib archive out,
+// and the prefix of the names it declares: out's name less any lib and .a,
+// libhello.a giving hello.h and hello_run. The prefix is made a C
+// identifier, with an underscore for any other character and before a
+// leading digit.
+func libraryNames(out string) (header, prefix string) {
+	name := strings.TrimSuffix(filepath.Base(out), ".a")
+	if trimmed := strings.TrimPrefix(name, "lib"); trimmed != "" {
+		name = trimmed
+	}
+	ident := []byte(name)
+	for i, c := range ident {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			ident[i] = '_'
+		}
+	}
+	if ident[0] >= '0' && ident[0] <= '9' {
+		ident = append([]byte{'_'}, ident...)
+	}
+	return filepath.Join(filepath.Dir(out), name+".h"), string(ident)
+}
+
+// checkMCU rejects an unknown -mcu, and -mcu without -arch avr.
+func checkMCU(fs *flag.FlagSet, mcu, arch string) {
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "mcu" && arch != "avr" {
+			fmt.Fprintln(os.Stderr, "-mcu is only used with -arch avr")
+			os.Exit(1)
+		}
+	})
+	if _, ok := avr.MCUs[mcu]; !ok {
+		fmt.Fprintf(os.Stderr, "unknown microcontroller: %s (must be atmega328p or atmega2560)\n", mcu)
+		os.Exit(1)
+	}
+}
+
+// parseFileMode parses an octal permission mode such as 0755 or 755.
+func parseFileMode(mode string) os.FileMode {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm&^uint64(os.ModePerm) != 0 {
+		fmt.Fprintf(os.Stderr, "invalid file mode: %s (must be octal permissions, eg. 0755)\n", mode)
+		os.Exit(1)
+	}
+	return os.FileMode(perm)
+}
+
+// readProfile reads a coverage profile for -pgo and returns how many times
+// each of ops ran in it.
+func readProfile(file string, src []byte, ops []core.Op) []uint64 {
+	f, err := os.Open(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	profile, err := coverage.ReadJSON(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reading profile %s: %v\n", file, err)
+		os.Exit(1)
+	}
+	counts, err := profile.OpCounts(src, ops)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return counts
 }
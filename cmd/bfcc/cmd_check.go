@@ -0,0 +1,76 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/internal/lint"
+)
+
+func cmdCheck(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	cellModel := cellFlags(fs)
+	comments := fs.Bool("comments", false, "warn about commands in lines that read as prose comments")
+	commentChars := fs.String("comment-chars", lint.DefaultCommentChars, "the commands -comments looks for")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bfcc check [options] <file>")
+		fmt.Fprintln(os.Stderr, "\nChecks the program compiles and prints warnings about likely mistakes.")
+		fmt.Fprintln(os.Stderr, "Exits with status 1 if there are any.")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+	}
+	if i := strings.IndexFunc(*commentChars, func(r rune) bool { return !strings.ContainsRune(lint.CommandChars, r) }); i >= 0 {
+		fmt.Fprintf(os.Stderr, "invalid -comment-chars: %q is not a command (must be some of %s)\n", (*commentChars)[i], lint.CommandChars)
+		os.Exit(1)
+	}
+
+	cells := *cellModel
+	file := filepath.Clean(fs.Arg(0))
+	src := readSource(file)
+
+	ops, err := core.Lower(core.Tokenize(src))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// The optimiser warns about rewrites that change corner cases
+	_, r, err := core.Optimise(ops, core.Options{Level: core.O2, Cells: cells})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	warnings := r.Warnings
+	if *comments {
+		warnings = append(warnings, lint.Comments(src, *commentChars)...)
+	}
+
+	slices.SortStableFunc(warnings, func(a, b core.Warning) int {
+		return cmp.Compare(warningOffset(a), warningOffset(b))
+	})
+	for _, w := range warnings {
+		fmt.Printf("%s: warning: %s\n", file, w)
+	}
+	if len(warnings) > 0 {
+		os.Exit(1)
+	}
+}
+
+// warningOffset orders warnings by source position, those with none first.
+func warningOffset(w core.Warning) int {
+	if w.Pos == nil {
+		return -1
+	}
+	return w.Pos.Offset
+}
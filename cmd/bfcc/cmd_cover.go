@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lcox74/bfcc/internal/coverage"
+)
+
+func cmdCover(args []string) {
+	fs := flag.NewFlagSet("cover", flag.ExitOnError)
+	output := fs.String("o", "", "output file (default: profile with .html extension)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bfcc cover [-o output] <profile.json>")
+		fmt.Fprintln(os.Stderr, "\nRenders a profile from `bfcc run -coverage` as an HTML report.")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+	}
+
+	file := filepath.Clean(fs.Arg(0))
+	f, err := os.Open(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	profile, err := coverage.ReadJSON(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+		os.Exit(1)
+	}
+
+	// Determine output filename
+	outFile := *output
+	if outFile == "" {
+		outFile = strings.TrimSuffix(file, ".json") + ".html"
+	}
+
+	src := readSource(profile.File)
+
+	out, err := os.Create(outFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer out.Close()
+
+	if err := profile.WriteHTML(out, src); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("rendered %s -> %s\n", file, outFile)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/internal/irdiff"
+)
+
+func cmdDiff(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	optLevel := optLevelFlag(fs, core.O1, "optimization `level` to compare at (0, 1, 2, or g)")
+	context := fs.Int("U", 3, "lines of context")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bfcc diff [options] <a.bf> <b.bf>")
+		fmt.Fprintln(os.Stderr, "\nDiffs two programs by IR, ignoring comments and layout.")
+		fmt.Fprintln(os.Stderr, "Exits with status 1 if they differ.")
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+	}
+
+	level := *optLevel
+	fileA, fileB := filepath.Clean(fs.Arg(0)), filepath.Clean(fs.Arg(1))
+	a := diffOps(fileA, level)
+	b := diffOps(fileB, level)
+
+	edits := irdiff.Diff(a, b)
+	if !irdiff.Changed(edits) {
+		return
+	}
+	irdiff.WriteUnified(os.Stdout, fileA, fileB, a, b, edits, *context)
+	os.Exit(1)
+}
+
+// diffOps reads and lowers a program for diffing.
+func diffOps(file string, level core.OptLevel) []core.Op {
+	ops, err := core.LowerAt(core.Tokenize(readSource(file)), level)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+		os.Exit(2)
+	}
+	ops, err = core.OptimiseWithLevel(ops, level)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+		os.Exit(2)
+	}
+	return ops
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/lcox74/bfcc/internal/codegen/ebpf"
+	"github.com/lcox74/bfcc/internal/codegen/linux"
+	"github.com/lcox74/bfcc/internal/core"
+	bpf "github.com/lcox74/bfcc/pkg/ebpf"
+)
+
+func cmdEBPF(args []string) {
+	fs := flag.NewFlagSet("ebpf", flag.ExitOnError)
+	optLevel := optLevelFlag(fs, core.O2, "optimization `level` (0, 1, 2, or g)")
+	cellModel := cellFlags(fs)
+	midTape := midTapeFlag(fs)
+	chain := chainFlag(fs)
+	dialect := dialectFlag(fs)
+	debug := debugFlag(fs)
+	listing := fs.Bool("S", false, "print the eBPF instructions instead of running them")
+	output := fs.String("o", "", "with -S, the file to print to (default stdout)")
+	maxLoops := fs.Uint64("max-loops", 0, "stop after this many loop iterations (0 for no limit)")
+	showProgress := fs.Bool("progress", false, "show the ops processed and the time remaining on stderr")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bfcc ebpf [options] <file>")
+		fmt.Fprintln(os.Stderr, "\nRuns the program in the Linux kernel as eBPF, with stdin read in first. Needs")
+		fmt.Fprintln(os.Stderr, "Linux 5.17 or later and CAP_BPF.")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+	}
+
+	level := *optLevel
+	cells := *cellModel
+	file := filepath.Clean(fs.Arg(0))
+	src := readSource(file)
+
+	var prog *progress
+	if *showProgress {
+		prog = newProgress()
+	}
+
+	// Compile to IR
+	ops, err := lower(src, core.TokenizeDialect(src, parseDialect(*dialect, *chain)), *chain, level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	ops, err = optimiseWithProgress(ops, level, cells, &ebpf.Costs, false, prog)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *debug {
+		ops = debugOps(ops, cells, nil)
+	}
+
+	// Generate eBPF
+	genOpts := []linux.Option{linux.WithCellOverflow(cells.Overflow)}
+	if cells.Signed {
+		genOpts = append(genOpts, linux.WithSignedCells())
+	}
+	if *midTape {
+		genOpts = append(genOpts, linux.WithMidTape())
+	}
+	if *debug {
+		genOpts = append(genOpts, linux.WithDebug())
+	}
+
+	if prog != nil {
+		prog.begin()
+		genOpts = append(genOpts, linux.WithProgress(prog.codegen))
+	}
+
+	program, err := ebpf.NewGenerator(ops, genOpts...).Generate()
+	prog.done()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *listing {
+		text := bpf.Disassemble(program.Code)
+		if *output == "" {
+			fmt.Print(text)
+			return
+		}
+		if err := os.WriteFile(*output, []byte(text), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("generated %s -> %s\n", file, *output)
+		return
+	}
+	if *output != "" {
+		fmt.Fprintln(os.Stderr, "-o is only used with -S")
+		os.Exit(1)
+	}
+
+	input, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	out := bufio.NewWriter(os.Stdout)
+	err = ebpf.Run(program, input, out, *maxLoops)
+	if ferr := out.Flush(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/internal/enumerate"
+)
+
+func cmdEnumerate(args []string) {
+	fs := flag.NewFlagSet("enumerate", flag.ExitOnError)
+	maxLen := fs.Int("max-len", 6, "longest program, in commands")
+	alphabet := fs.String("alphabet", enumerate.DefaultAlphabet, "the commands programs are made of")
+	input := fs.String("input", "", "what every program reads")
+	maxSteps := fs.Uint64("max-steps", enumerate.DefaultMaxSteps, "stop each program after this many commands")
+	maxOutput := fs.Int("max-output", 0, "stop each program after writing this many bytes (0 for no limit)")
+	tapeSize := fs.Int("tape-size", core.TapeSize, "`cells` on the tape")
+	cellModel := cellFlags(fs)
+	workers := fs.Int("workers", 0, "programs run at once (0 for GOMAXPROCS)")
+	all := fs.Bool("all", false, "run every program, not just the first of each canonical form")
+	halts := fs.Bool("halts", false, "only list programs that halt")
+	minSteps := fs.Uint64("min-steps", 0, "only list programs that run at least this many commands")
+	minOutput := fs.Int("min-output", 0, "only list programs that write at least this many bytes")
+	match := fs.String("match", "", "only list programs whose output matches this `regexp`")
+	jsonOut := fs.Bool("json", false, "write a JSON object per program instead of a line")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bfcc enumerate [options]")
+		fmt.Fprintln(os.Stderr, "\nRuns every program up to -max-len commands, shortest first, skipping")
+		fmt.Fprintln(os.Stderr, "those the optimiser makes the same IR of as an earlier one, and lists")
+		fmt.Fprintln(os.Stderr, "each with the commands it ran, how it stopped, and its output.")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+	}
+	var re *regexp.Regexp
+	if *match != "" {
+		var err error
+		if re, err = regexp.Compile(*match); err != nil {
+			fmt.Fprintln(os.Stderr, "invalid -match:", err)
+			os.Exit(1)
+		}
+	}
+
+	cfg := enumerate.Config{
+		MaxLen:   *maxLen,
+		Alphabet: *alphabet,
+		Input:    []byte(*input),
+		Limits: core.Limits{
+			MaxSteps:  *maxSteps,
+			MaxOutput: *maxOutput,
+			Tape:      *tapeSize,
+			Cells:     *cellModel,
+		},
+		Workers: *workers,
+		All:     *all,
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	listed := 0
+	stats, err := enumerate.Search(cfg, func(r enumerate.Result) bool {
+		switch {
+		case *halts && !r.Halted(),
+			r.Steps < *minSteps,
+			len(r.Output) < *minOutput,
+			re != nil && !re.Match(r.Output):
+			return true
+		}
+		listed++
+
+		if *jsonOut {
+			err := enc.Encode(enumerateJSON{
+				Program: r.Program,
+				Steps:   r.Steps,
+				Stop:    stopReason(r.Err),
+				Output:  string(r.Output),
+			})
+			return err == nil
+		}
+		fmt.Printf("%-*s %8d  %-13s %q\n", *maxLen, r.Program, r.Steps, stopReason(r.Err), r.Output)
+		return true
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stderr, "%d programs, %d run, %d halted, %d listed\n",
+		stats.Programs, stats.Distinct, stats.Halted, listed)
+}
+
+// enumerateJSON is a program's line of enumerate -json.
+type enumerateJSON struct {
+	Program string `json:"program"`
+	Steps   uint64 `json:"steps"`
+	Stop    string `json:"stop"`
+	Output  string `json:"output"`
+}
+
+// stopReason names how a run ended: halted, or the limit or error it failed
+// with.
+func stopReason(err error) string {
+	switch {
+	case err == nil:
+		return "halted"
+	case errors.Is(err, core.ErrStepLimit):
+		return "step-limit"
+	case errors.Is(err, core.ErrOutputLimit):
+		return "output-limit"
+	case errors.Is(err, core.ErrOutOfBounds):
+		return "out-of-bounds"
+	case errors.Is(err, core.ErrCellOverflow):
+		return "cell-overflow"
+	default:
+		return err.Error()
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lcox74/bfcc/internal/codegen/linux"
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/internal/eval"
+	"github.com/lcox74/bfcc/internal/golf"
+)
+
+func cmdEval(args []string) {
+	fs := flag.NewFlagSet("eval", flag.ExitOnError)
+	emit := fs.String("emit", "raw", "what to emit: raw output, bf program, or elf executable")
+	output := fs.String("o", "", "output file (default: stdout, or the input file without extension for elf)")
+	maxSteps := fs.Uint64("max-steps", eval.DefaultMaxSteps, "fail if the program runs for more ops than this")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bfcc eval [options] <file>")
+		fmt.Fprintln(os.Stderr, "\nRuns an input-free program at compile time and emits its output,")
+		fmt.Fprintln(os.Stderr, "or a program that just prints it.")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+	}
+
+	file := filepath.Clean(fs.Arg(0))
+	src := readSource(file)
+
+	ops, err := core.Lower(core.Tokenize(src))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	ops, err = core.OptimiseWithLevel(ops, core.O2)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	out, err := eval.Evaluate(ops, *maxSteps)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var data []byte
+	mode := os.FileMode(0644)
+	switch *emit {
+	case "raw":
+		data = out
+	case "bf":
+		data = []byte(golf.Shorten(eval.Program(out)) + "\n")
+	case "elf":
+		data = linux.NewX86_64Generator(eval.Program(out)).GenerateELF()
+		mode = 0755
+		if *output == "" {
+			*output = strings.TrimSuffix(file, ".bf")
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "invalid emit mode: %s (must be raw, bf, or elf)\n", *emit)
+		os.Exit(1)
+	}
+
+	if *output == "" {
+		os.Stdout.Write(data)
+		return
+	}
+	if err := os.WriteFile(*output, data, mode); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/internal/expand"
+)
+
+func cmdExpand(args []string) {
+	fs := flag.NewFlagSet("expand", flag.ExitOnError)
+	optLevel := optLevelFlag(fs, core.O2, "optimization `level` of the IR to expand (0, 1, 2, or g)")
+	seed := fs.Uint64("seed", 1, "seed for the padding")
+	noOps := fs.Float64("noops", 0, "chance (0 to 1) of a no-op pair after each command")
+	comments := fs.Float64("comments", 0, "chance (0 to 1) of comment noise after each command")
+	width := fs.Int("width", 80, "wrap lines at this many bytes (0 for no wrapping)")
+	output := fs.String("o", "", "output file (default: stdout)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bfcc expand [options] <file>")
+		fmt.Fprintln(os.Stderr, "\nRewrites the program long-hand, optionally padded with no-ops and comments.")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+	}
+
+	level := *optLevel
+	file := filepath.Clean(fs.Arg(0))
+	src := readSource(file)
+
+	ops, err := core.LowerAt(core.Tokenize(src), level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	ops, err = core.OptimiseWithLevel(ops, level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	out := expand.Expand(ops, expand.Config{Seed: *seed, NoOps: *noOps, Comments: *comments, Width: *width})
+
+	if *output == "" {
+		fmt.Print(out)
+		return
+	}
+	if err := os.WriteFile(*output, []byte(out), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -5,35 +5,85 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 
 	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/internal/plugin"
 )
 
 func cmdIR(args []string) {
 	fs := flag.NewFlagSet("ir", flag.ExitOnError)
-	optLevel := fs.Int("O", 0, "optimization level (0, 1, or 2)")
+	optLevel := optLevelFlag(fs, core.O0, "optimization `level` (0, 1, 2, or g)")
+	superopt := fs.Bool("superopt", false, "experimental: at -O 2, replace small loops with shorter code found by exhaustive search")
+	cellModel := cellFlags(fs)
+	chain := chainFlag(fs)
+	dialect := dialectFlag(fs)
+	debug := debugFlag(fs)
+	report := fs.Bool("report", false, "print what each optimiser pass did to stderr")
+	costModel := fs.String("costs", "vm", "the backend whose costs the optimiser schedules ops for (vm, amd64, riscv64, 386, arm, arm64, wasm, 6502, z80, avr, or ebpf)")
+	annotateConst := fs.Bool("annotate-const", false, "annotate ops with the current cell value where it is statically known")
+	onlyLoops := fs.Bool("only-loops", false, "only dump the JZ and JNZ ops")
 	fs.Usage = func() {
-		fmt.Fprintln(os.Stderr, "usage: bfcc ir [-O level] <file>")
+		fmt.Fprintln(os.Stderr, "usage: bfcc ir [options] <file>")
 		fs.PrintDefaults()
 		os.Exit(1)
 	}
-	fs.Parse(args)
+	parseFlags(fs, args)
 
 	if fs.NArg() != 1 {
 		fs.Usage()
 	}
 
-	level := parseOptLevel(*optLevel)
+	level := *optLevel
+	cells := *cellModel
+	costs := parseCostModel(*costModel)
 	file := filepath.Clean(fs.Arg(0))
 	src := readSource(file)
 
-	tokens := core.Tokenize(src)
-	ops, err := core.Lower(tokens)
+	ops, err := lower(src, core.TokenizeDialect(src, parseDialect(*dialect, *chain)), *chain, level)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
-	ops = core.OptimiseWithLevel(ops, level)
-	fmt.Print(core.Dump(ops))
+	ops, r, err := core.Optimise(ops, core.Options{Level: level, Cells: cells, Costs: costs, Superopt: *superopt})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *report {
+		r.WriteText(os.Stderr)
+	}
+	if ops, err = plugin.RunPasses(ops, level, cells); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *debug {
+		ops = debugOps(ops, cells, nil)
+	}
+	var notes []string
+	if *annotateConst {
+		notes = constNotes(ops, cells)
+	}
+	if *onlyLoops {
+		fmt.Print(core.DumpLoops(ops, notes))
+		return
+	}
+	fmt.Print(core.DumpNotes(ops, notes))
+}
+
+// constNotes describes the known value of the current cell after each op,
+// eg. "cell=72 'H'", leaving ops where it is unknown without a note.
+func constNotes(ops []core.Op, cells core.CellModel) []string {
+	notes := make([]string, len(ops))
+	for i, c := range core.KnownCells(ops, cells, nil) {
+		if !c.Known {
+			continue
+		}
+		notes[i] = fmt.Sprintf("cell=%d", c.Value)
+		if r := rune(byte(c.Value)); r == '\n' || r == '\t' || (r >= ' ' && r <= '~') {
+			notes[i] += " " + strconv.QuoteRune(r)
+		}
+	}
+	return notes
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lcox74/bfcc/internal/codegen/linux"
+	"github.com/lcox74/bfcc/internal/codegen/llvm"
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+func cmdLLVM(args []string) {
+	fs := flag.NewFlagSet("llvm", flag.ExitOnError)
+	optLevel := optLevelFlag(fs, core.O2, "optimization `level` (0, 1, 2, or g)")
+	cellModel := cellFlags(fs)
+	midTape := midTapeFlag(fs)
+	chain := chainFlag(fs)
+	dialect := dialectFlag(fs)
+	debug := debugFlag(fs)
+	output := fs.String("o", "", "output file (default: input file with .ll extension)")
+	showProgress := fs.Bool("progress", false, "show the ops processed and the time remaining on stderr")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bfcc llvm [options] <file>")
+		fmt.Fprintln(os.Stderr, "\nProduces LLVM IR defining main, to compile with clang for any target.")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+	}
+
+	level := *optLevel
+	cells := *cellModel
+	file := filepath.Clean(fs.Arg(0))
+	src := readSource(file)
+
+	// Determine output filename
+	outFile := *output
+	if outFile == "" {
+		outFile = strings.TrimSuffix(file, ".bf") + ".ll"
+	}
+
+	var prog *progress
+	if *showProgress {
+		prog = newProgress()
+	}
+
+	// Compile to IR
+	ops, err := lower(src, core.TokenizeDialect(src, parseDialect(*dialect, *chain)), *chain, level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// LLVM schedules the code itself, so the VM's cost model will do
+	ops, err = optimiseWithProgress(ops, level, cells, nil, false, prog)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *debug {
+		ops = debugOps(ops, cells, nil)
+	}
+
+	// Generate LLVM IR
+	genOpts := []linux.Option{linux.WithCellOverflow(cells.Overflow)}
+	if cells.Signed {
+		genOpts = append(genOpts, linux.WithSignedCells())
+	}
+	if *midTape {
+		genOpts = append(genOpts, linux.WithMidTape())
+	}
+	if *debug {
+		genOpts = append(genOpts, linux.WithDebug())
+	}
+
+	if prog != nil {
+		prog.begin()
+		genOpts = append(genOpts, linux.WithProgress(prog.codegen))
+	}
+
+	ll := llvm.NewGenerator(ops, genOpts...).Generate()
+	prog.done()
+
+	if err := os.WriteFile(outFile, []byte(ll), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("generated %s -> %s\n", file, outFile)
+}
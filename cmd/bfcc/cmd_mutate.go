@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/lcox74/bfcc/internal/bftest"
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/internal/mutate"
+)
+
+func cmdMutate(args []string) {
+	fs := flag.NewFlagSet("mutate", flag.ExitOnError)
+	optLevel := optLevelFlag(fs, core.O2, "optimization `level` (0, 1, 2, or g)")
+	testsFile := fs.String("tests", "", "test case file (default: <file>.tests.json)")
+	maxSteps := fs.Uint64("max-steps", bftest.DefaultMaxSteps, "step limit per test case")
+	verbose := fs.Bool("v", false, "list every mutant, not just survivors")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bfcc mutate [options] <file>")
+		fmt.Fprintln(os.Stderr, "\nApplies single-command mutations and reports mutants the tests miss.")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+	}
+
+	level := *optLevel
+	file := filepath.Clean(fs.Arg(0))
+	src := readSource(file)
+	cases := readCases(file, *testsFile)
+
+	report, err := mutate.Run(file, src, cases, mutate.Config{Level: level, MaxSteps: *maxSteps})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	for _, o := range report.Outcomes {
+		if !*verbose && o.Status != mutate.Survived {
+			continue
+		}
+		if o.Reason != "" {
+			fmt.Printf("%-9s %s (%s)\n", o.Status, o.Mutant, o.Reason)
+		} else {
+			fmt.Printf("%-9s %s\n", o.Status, o.Mutant)
+		}
+	}
+
+	fmt.Printf("%d mutants: %d killed, %d survived, %d uncovered, %d invalid (score %.1f%%)\n",
+		len(report.Outcomes),
+		report.Count(mutate.Killed),
+		report.Count(mutate.Survived),
+		report.Count(mutate.Uncovered),
+		report.Count(mutate.Invalid),
+		report.Score(),
+	)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/lcox74/bfcc/internal/outline"
+)
+
+func cmdOutline(args []string) {
+	fs := flag.NewFlagSet("outline", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "write JSON instead of an indented tree")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bfcc outline [-json] <file>")
+		fmt.Fprintln(os.Stderr, "\nPrints the loop structure with source ranges and body summaries.")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+	}
+
+	file := filepath.Clean(fs.Arg(0))
+	o, err := outline.Build(file, readSource(file))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if !*jsonOut {
+		o.WriteText(os.Stdout)
+		return
+	}
+	if err := o.WriteJSON(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -1,45 +1,366 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
-	"path/filepath"
+	"time"
 
 	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/internal/coverage"
 	"github.com/lcox74/bfcc/internal/vm"
 )
 
 func cmdRun(args []string) {
 	fs := flag.NewFlagSet("run", flag.ExitOnError)
-	optLevel := fs.Int("O", 2, "optimization level (0, 1, or 2)")
+	optLevel := optLevelFlag(fs, core.O2, "optimization `level` (0, 1, 2, or g)")
+	superopt := fs.Bool("superopt", false, "experimental: at -O 2, replace small loops with shorter code found by exhaustive search")
+	cellModel := cellFlags(fs)
+	tapeUnderflow := fs.String("tape-underflow", "error", "policy when moving below cell 0 (error, wrap, or grow)")
+	tapeOverflow := fs.String("tape-overflow", "error", "policy when moving past the last cell (error, wrap, or grow)")
+	midTape := midTapeFlag(fs)
+	tapeInit := fs.String("tape-init", "", "load the tape with this file's bytes, from the start cell, before running")
+	dumpTape := fs.String("dump-tape", "", "write the tape, up to its last non-zero cell, to this file when the program finishes")
+	checkpointEvery := fs.Duration("checkpoint-every", 0, "snapshot VM state this often (eg. 10s)")
+	checkpointFile := fs.String("checkpoint-file", "", "file to write snapshots to")
+	resume := fs.String("resume", "", "resume from a checkpoint file")
+	coverageFile := fs.String("coverage", "", "write source command coverage as JSON (runs at -O 0)")
+	countCommands := fs.Bool("count-commands", false, "report the source commands executed on stderr (runs at -O 0)")
+	chain := chainFlag(fs)
+	dialect := dialectFlag(fs)
+	debug := debugFlag(fs)
+	noIR := fs.Bool("no-ir", false, "interpret the source tokens directly, without lowering to IR (requires -O 0)")
+	maxSteps := fs.Uint64("max-steps", 0, "stop after this many steps (0 for no limit)")
+	showProgress := fs.Bool("progress", false, "show the steps executed on stderr")
+	ioMode := fs.String("io", "bytes", "how , and . read and write cells (bytes, decimal, hex, or escaped)")
+	transcript := fs.String("transcript", "", "log each byte read and written, with its step, to this file")
+	newline := fs.String("newline", "lf", "the line ending the program reads and writes, translated from and to \\n (lf, cr, or crlf)")
+	timeout := fs.Duration("timeout", 0, "stop the run after this long (eg. 30s, 0 for no limit)")
 	fs.Usage = func() {
-		fmt.Fprintln(os.Stderr, "usage: bfcc run [-O level] <file>")
+		fmt.Fprintln(os.Stderr, "usage: bfcc run [options] <file>...")
+		fmt.Fprintln(os.Stderr, "\nMore than one file is run as the files joined in order.")
 		fs.PrintDefaults()
 		os.Exit(1)
 	}
-	fs.Parse(args)
+	parseFlags(fs, args)
 
-	if fs.NArg() != 1 {
+	if fs.NArg() < 1 {
 		fs.Usage()
 	}
+	if fs.NArg() > 1 && *coverageFile != "" {
+		fmt.Fprintln(os.Stderr, "-coverage needs a single source file")
+		os.Exit(1)
+	}
+
+	level := *optLevel
+	cells := *cellModel
+	srcs := readSources(fs.Args())
+	src := srcs.Src
+
+	limits := &runLimits{maxSteps: *maxSteps, timeout: *timeout, transcript: *transcript, newline: parseNewline(*newline)}
+	if *showProgress {
+		limits.prog = newProgress()
+	}
+
+	d := parseDialect(*dialect, *chain)
+	tokens := core.TokenizeDialect(src, d)
+	var tape []byte
+	if *tapeInit != "" {
+		tape = readTapeInit(*tapeInit, *midTape)
+	}
+	if *noIR {
+		vmOpts := vmOptions(cells, *tapeUnderflow, *tapeOverflow, *ioMode, *midTape, tape)
+		vmOpts = append(vmOpts, vm.WithDialect(d))
+		if *countCommands {
+			vmOpts = append(vmOpts, vm.WithCommandCount())
+		}
+		srcs.LocateTokens(tokens)
+		runTokens(tokens, fs, level, vmOpts, limits, *dumpTape, *countCommands)
+		return
+	}
+
+	// Coverage and command counts map ops back to source commands, which
+	// needs unoptimised IR
+	if (*coverageFile != "" || *countCommands) && level != core.Og {
+		level = core.O0
+	}
+	ops, err := lower(src, tokens, *chain, level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, srcs.LocateError(err))
+		os.Exit(1)
+	}
+	srcs.LocateOps(ops)
+	ops, err = optimiseWithProgress(ops, level, cells, nil, *superopt, limits.prog)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *debug {
+		ops = debugOps(ops, cells, tape)
+	}
+
+	vmOpts := vmOptions(cells, *tapeUnderflow, *tapeOverflow, *ioMode, *midTape, tape)
+
+	if *checkpointEvery > 0 {
+		if *checkpointFile == "" {
+			fmt.Fprintln(os.Stderr, "-checkpoint-every requires -checkpoint-file")
+			os.Exit(1)
+		}
+		vmOpts = append(vmOpts, vm.WithCheckpoint(*checkpointEvery, func(s *vm.Snapshot) error {
+			return writeCheckpoint(*checkpointFile, s)
+		}))
+	} else if *checkpointFile != "" {
+		fmt.Fprintln(os.Stderr, "-checkpoint-file requires -checkpoint-every")
+		os.Exit(1)
+	}
+	if *resume != "" {
+		vmOpts = append(vmOpts, vm.WithResume(readCheckpoint(*resume)))
+	}
+
+	if *countCommands {
+		vmOpts = append(vmOpts, vm.WithDialect(d), vm.WithCommandCount())
+	}
+
+	var counts []uint64
+	if *coverageFile != "" {
+		counts = make([]uint64, len(ops))
+		vmOpts = append(vmOpts, vm.WithOpCounts(counts))
+	}
+
+	interpreter := vm.NewVM(append(vmOpts, limits.start()...)...)
+	runErr := interpreter.Run(ops)
+	limits.stop()
+
+	// Coverage and command counts are still written for runs that fail
+	// part way through
+	if *coverageFile != "" {
+		writeCoverage(*coverageFile, srcs.Names()[0], src, tokens, ops, counts)
+	}
+	if *countCommands {
+		fmt.Fprintf(os.Stderr, "commands: %d\n", interpreter.Commands())
+	}
+
+	if runErr != nil {
+		limits.fail(runErr, interpreter.Steps())
+	}
+	writeTapeDump(*dumpTape, interpreter)
+}
+
+// writeTapeDump saves the tape of a finished run for -dump-tape, if file is
+// not empty.
+func writeTapeDump(file string, interpreter *vm.VM) {
+	if file == "" {
+		return
+	}
+	if err := os.WriteFile(file, interpreter.Tape(), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// vmOptions returns the VM options for the cell, tape and I/O flags of run.
+func vmOptions(cells core.CellModel, underflow, overflow, ioMode string, midTape bool, tape []byte) []vm.VMOption {
+	vmOpts := []vm.VMOption{
+		vm.WithCells(cells),
+		vm.WithTapeUnderflow(parseTapeBound(underflow)),
+		vm.WithTapeOverflow(parseTapeBound(overflow)),
+		vm.WithIO(parseCellIO(ioMode)),
+	}
+	if midTape {
+		vmOpts = append(vmOpts, vm.WithMidTape())
+	}
+	if tape != nil {
+		vmOpts = append(vmOpts, vm.WithTapeInit(tape))
+	}
+	return vmOpts
+}
+
+// runLimits holds the flags of run that bound and watch a run: -max-steps,
+// -timeout, -progress and -transcript, and -newline, which filters its I/O.
+type runLimits struct {
+	maxSteps   uint64
+	timeout    time.Duration
+	prog       *progress // nil without -progress
+	transcript string    // file to log I/O to, empty for none
+	newline    vm.Newline
+	output     countingWriter
+	stdout     *vm.NewlineWriter
+	cancel     context.CancelFunc
+	log        *bufio.Writer
+	logFile    *os.File
+}
+
+// start returns the VM options for the limits, and starts the clock for
+// -timeout. Output goes through the limits so it can be counted, and
+// both input and output through the -newline filters.
+func (l *runLimits) start() []vm.VMOption {
+	l.stdout = vm.NewNewlineWriter(os.Stdout, l.newline)
+	l.output.w = l.stdout
+	vmOpts := []vm.VMOption{
+		vm.WithMaxSteps(l.maxSteps),
+		vm.WithInput(vm.NewlineReader(os.Stdin, l.newline)),
+		vm.WithOutput(&l.output),
+	}
+	if l.prog != nil {
+		l.prog.begin()
+		vmOpts = append(vmOpts, vm.WithProgress(progressInterval, func(steps uint64) {
+			l.prog.run(steps, l.maxSteps)
+		}))
+	}
+	if l.timeout > 0 {
+		cause := fmt.Errorf("%w (%v)", context.DeadlineExceeded, l.timeout)
+		var ctx context.Context
+		ctx, l.cancel = context.WithTimeoutCause(context.Background(), l.timeout, cause)
+		vmOpts = append(vmOpts, vm.WithContext(ctx))
+	}
+	if l.transcript != "" {
+		f, err := os.Create(l.transcript)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		l.logFile, l.log = f, bufio.NewWriter(f)
+		vmOpts = append(vmOpts, vm.WithTranscript(l.log))
+	}
+	return vmOpts
+}
+
+// stop ends the run's progress reports and timeout, writes any output
+// the -newline filter held back, and saves the transcript, which is kept
+// for runs that fail too.
+func (l *runLimits) stop() {
+	l.prog.done()
+	if l.cancel != nil {
+		l.cancel()
+	}
+	if err := l.stdout.Flush(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if l.log != nil {
+		err := l.log.Flush()
+		if cerr := l.logFile.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", l.transcript, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// fail prints the error that stopped a run and exits. A run that timed out
+// also reports how far it got, which is what a grader or CI log needs.
+func (l *runLimits) fail(err error, steps uint64) {
+	fmt.Fprintln(os.Stderr, err)
+	if errors.Is(err, context.DeadlineExceeded) {
+		fmt.Fprintf(os.Stderr, "timed out after %d steps and %d bytes of output\n", steps, l.output.n)
+	}
+	os.Exit(1)
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// runTokens runs a program with -no-ir, saving its tape to
+// dumpTape if set and reporting the commands run if countCommands is.
+// Only the cell, tape, I/O and run limit flags apply to the token
+// interpreter, so the flags for the IR pipeline are rejected.
+func runTokens(tokens []core.Token, fs *flag.FlagSet, level core.OptLevel, vmOpts []vm.VMOption, limits *runLimits, dumpTape string, countCommands bool) {
+	if level != core.O0 {
+		fmt.Fprintln(os.Stderr, "-no-ir runs the source without optimising it, use -O 0")
+		os.Exit(1)
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "checkpoint-every", "checkpoint-file", "resume", "coverage", "chain", "g":
+			fmt.Fprintf(os.Stderr, "-no-ir cannot be used with -%s\n", f.Name)
+			os.Exit(1)
+		}
+	})
+
+	interpreter := vm.NewVM(append(vmOpts, limits.start()...)...)
+	err := interpreter.RunTokens(tokens)
+	limits.stop()
+	if countCommands {
+		fmt.Fprintf(os.Stderr, "commands: %d\n", interpreter.Commands())
+	}
+	if err != nil {
+		limits.fail(err, interpreter.Steps())
+	}
+	writeTapeDump(dumpTape, interpreter)
+}
 
-	level := parseOptLevel(*optLevel)
-	file := filepath.Clean(fs.Arg(0))
-	src := readSource(file)
+// writeCoverage saves a coverage profile and prints a one line summary.
+func writeCoverage(out, file string, src []byte, tokens []core.Token, ops []core.Op, counts []uint64) {
+	profile, err := coverage.FromCounts(file, src, tokens, ops, counts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
-	tokens := core.Tokenize(src)
-	ops, err := core.Lower(tokens)
+	f, err := os.Create(out)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	defer f.Close()
+
+	if err := profile.WriteJSON(f); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stderr, "coverage: %.1f%% of %d commands\n", profile.Percent(), len(profile.Commands))
+}
 
-	ops = core.OptimiseWithLevel(ops, level)
+// writeCheckpoint replaces file with the snapshot, via a rename so an
+// interrupted write never leaves a truncated checkpoint behind.
+func writeCheckpoint(file string, s *vm.Snapshot) error {
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := s.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
 
-	interpreter := vm.NewVM()
-	if err := interpreter.Run(ops); err != nil {
+func readCheckpoint(file string) *vm.Snapshot {
+	f, err := os.Open(file)
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	defer f.Close()
+
+	s, err := vm.ReadSnapshot(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+		os.Exit(1)
+	}
+	return s
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/internal/golf"
+)
+
+func cmdShorten(args []string) {
+	fs := flag.NewFlagSet("shorten", flag.ExitOnError)
+	output := fs.String("o", "", "output file (default: stdout)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bfcc shorten [-o output] <file>")
+		fmt.Fprintln(os.Stderr, "\nExperimental: rewrites the program as shorter, equivalent Brainfuck.")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+	}
+
+	file := filepath.Clean(fs.Arg(0))
+	src := readSource(file)
+
+	ops, err := core.Lower(core.Tokenize(src))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	ops, err = core.OptimiseWithLevel(ops, core.O2)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	short := golf.Shorten(ops) + "\n"
+
+	if *output == "" {
+		fmt.Print(short)
+	} else if err := os.WriteFile(*output, []byte(short), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stderr, "%d -> %d bytes\n", len(src), len(short)-1)
+}
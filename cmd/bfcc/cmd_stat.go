@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/lcox74/bfcc/internal/bftest"
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/internal/stats"
+)
+
+// statKinds lists the command token kinds in display order.
+var statKinds = []core.TokenKind{
+	core.TokAdd, core.TokSub, core.TokShiftRight, core.TokShiftLeft,
+	core.TokOut, core.TokIn, core.TokLBracket, core.TokRBracket,
+}
+
+// statChars maps token kinds to their source character.
+var statChars = map[core.TokenKind]byte{
+	core.TokAdd: '+', core.TokSub: '-', core.TokShiftRight: '>', core.TokShiftLeft: '<',
+	core.TokOut: '.', core.TokIn: ',', core.TokLBracket: '[', core.TokRBracket: ']',
+}
+
+func cmdStat(args []string) {
+	fs := flag.NewFlagSet("stat", flag.ExitOnError)
+	run := fs.Bool("run", false, "also run the program with stdin as its input, and report the highest cell it reached")
+	maxSteps := fs.Uint64("max-steps", bftest.DefaultMaxSteps, "step limit for -run")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bfcc stat [options] <file>")
+		fmt.Fprintln(os.Stderr, "\nPrints static metrics about the program.")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+	}
+
+	file := filepath.Clean(fs.Arg(0))
+	src := readSource(file)
+
+	s, err := stats.Analyse(src)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	var runErr error
+	if *run {
+		input, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		runErr = s.Measure(src, string(input), *maxSteps)
+	}
+
+	fmt.Printf("size:      %d bytes, %d lines\n", s.Bytes, s.Lines)
+	fmt.Printf("commands:  %d (%.1f%% comments)\n", s.Commands, 100*s.CommentRatio())
+	for _, kind := range statKinds {
+		fmt.Printf("  %c  %d\n", statChars[kind], s.Counts[kind])
+	}
+
+	fmt.Printf("loops:     %d, max depth %d\n", s.Loops, s.MaxDepth)
+	for d, n := range s.Depths {
+		fmt.Printf("  depth %-3d %d\n", d+1, n)
+	}
+
+	if s.LongestRun.Length > 0 {
+		fmt.Printf("longest run: %d x '%c' at %d:%d\n",
+			s.LongestRun.Length, statChars[s.LongestRun.Kind], s.LongestRun.Pos.Line, s.LongestRun.Pos.Column)
+	}
+
+	if s.Balanced {
+		fmt.Printf("tape:      %d cells (offsets %d to %d)\n", s.TapeCells(), s.MinOffset, s.MaxOffset)
+	} else {
+		fmt.Printf("tape:      unknown, loop ending at %d:%d moves the pointer\n",
+			s.Unbalanced.Line, s.Unbalanced.Column)
+	}
+
+	fmt.Printf("ir ops:    %d (-O 0), %d (-O 1), %d (-O 2)\n", s.IRSize[core.O0], s.IRSize[core.O1], s.IRSize[core.O2])
+
+	if s.Measured {
+		fmt.Printf("high water: cell %d, a tape of %d cells\n", s.HighWater, s.HighWater+1)
+		if runErr != nil {
+			fmt.Printf("  before the run stopped: %v\n", runErr)
+		}
+	}
+}
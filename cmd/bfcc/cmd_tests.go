@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/lcox74/bfcc/internal/bftest"
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+func cmdTest(args []string) {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	optLevel := optLevelFlag(fs, core.O2, "optimization `level` (0, 1, 2, or g)")
+	testsFile := fs.String("tests", "", "test case file (default: <file>.tests.json)")
+	maxSteps := fs.Uint64("max-steps", bftest.DefaultMaxSteps, "step limit per test case")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bfcc test [options] <file>")
+		fmt.Fprintln(os.Stderr, "\nRuns the program against input/output test cases.")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+	}
+
+	level := *optLevel
+	file := filepath.Clean(fs.Arg(0))
+	src := readSource(file)
+	cases := readCases(file, *testsFile)
+
+	tokens := core.Tokenize(src)
+	ops, err := core.LowerAt(tokens, level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	ops, err = core.OptimiseWithLevel(ops, level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	failed := 0
+	for _, r := range bftest.Run(ops, cases, *maxSteps, nil) {
+		switch {
+		case r.Err != nil:
+			failed++
+			fmt.Printf("FAIL %s: %v\n", r.Case.Name, r.Err)
+		case !r.Passed():
+			failed++
+			fmt.Printf("FAIL %s: got %q, want %q\n", r.Case.Name, r.Output, r.Case.Output)
+		default:
+			fmt.Printf("ok   %s (high water: cell %d)\n", r.Case.Name, r.HighWater)
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of %d cases failed\n", failed, len(cases))
+		os.Exit(1)
+	}
+}
+
+// readCases loads the test cases for a program, from testsFile if set or
+// the conventional <file>.tests.json otherwise.
+func readCases(file, testsFile string) []bftest.Case {
+	if testsFile == "" {
+		testsFile = bftest.TestsFile(file)
+	}
+
+	f, err := os.Open(testsFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	cases, err := bftest.ReadCases(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", testsFile, err)
+		os.Exit(1)
+	}
+	return cases
+}
@@ -7,15 +7,18 @@ import (
 	"path/filepath"
 
 	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/internal/stats"
 )
 
 func cmdTokens(args []string) {
 	fs := flag.NewFlagSet("tokens", flag.ExitOnError)
+	count := fs.Bool("count", false, "print the number of tokens of each kind, commands, comment bytes and lines instead")
 	fs.Usage = func() {
-		fmt.Fprintln(os.Stderr, "usage: bfcc tokens <file>")
+		fmt.Fprintln(os.Stderr, "usage: bfcc tokens [-count] <file>")
+		fs.PrintDefaults()
 		os.Exit(1)
 	}
-	fs.Parse(args)
+	parseFlags(fs, args)
 
 	if fs.NArg() != 1 {
 		fs.Usage()
@@ -24,6 +27,17 @@ func cmdTokens(args []string) {
 	file := filepath.Clean(fs.Arg(0))
 	src := readSource(file)
 
+	if *count {
+		s := stats.Count(src)
+		for kind := core.TokShiftRight; kind < core.TokEOF; kind++ {
+			fmt.Printf("%-14s %d\n", kind, s.Counts[kind])
+		}
+		fmt.Printf("%-14s %d\n", "commands", s.Commands)
+		fmt.Printf("%-14s %d\n", "comment bytes", s.CommentBytes)
+		fmt.Printf("%-14s %d\n", "lines", s.Lines)
+		return
+	}
+
 	tokens := core.Tokenize(src)
 	for _, tok := range tokens {
 		fmt.Printf("%d:%d\t%v\n", tok.Pos.Line, tok.Pos.Column, tok.Kind)
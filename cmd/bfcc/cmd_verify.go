@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lcox74/bfcc/internal/bftest"
+	"github.com/lcox74/bfcc/internal/codegen/linux"
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/internal/trace"
+)
+
+func cmdVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	optLevel := optLevelFlag(fs, core.O2, "optimization `level` of the native build (0, 1, 2, or g)")
+	maxSteps := fs.Uint64("max-steps", bftest.DefaultMaxSteps, "step limit per VM run")
+	timeout := fs.Duration("timeout", 10*time.Second, "time limit per native run")
+	traced := fs.Bool("trace", false, "compare event traces with the VM running the same IR, to find the first divergence")
+	traceEvents := fs.Int("trace-events", 1_000_000, "number of events compared per run with -trace")
+	emulate := fs.Bool("emulate", false, "run the executables in the built-in x86_64 emulator, on any host")
+	march := fs.String("march", "x86-64", "the amd64 CPUs to build for, as for build (x86-64 or x86-64-v3)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bfcc verify [options] <file>...")
+		fmt.Fprintln(os.Stderr, "\nBuilds each program as a native executable, runs it with the inputs")
+		fmt.Fprintln(os.Stderr, "from <file>.tests.json (or no input without one) and checks its output")
+		fmt.Fprintln(os.Stderr, "against the unoptimised program in the VM. Native runs need x86_64")
+		fmt.Fprintln(os.Stderr, "Linux; with -emulate they run in an emulator on any host instead.")
+		fmt.Fprintln(os.Stderr, "\nWith -trace the executable also reports each loop entry and I/O byte,")
+		fmt.Fprintln(os.Stderr, "and the first event that differs from the VM running the same IR is")
+		fmt.Fprintln(os.Stderr, "shown with its source position.")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+	}
+
+	opts := verifyOptions{
+		level:    *optLevel,
+		maxSteps: *maxSteps,
+		timeout:  *timeout,
+		emulate:  *emulate,
+		avx2:     parseMarch(*march),
+	}
+	if *traced {
+		opts.traceLimit = max(*traceEvents, 1)
+	}
+
+	failed, total := 0, 0
+	for _, file := range fs.Args() {
+		file = filepath.Clean(file)
+		results, err := verifyFile(file, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			os.Exit(1)
+		}
+
+		for _, r := range results {
+			total++
+			if r.err != nil {
+				failed++
+				fmt.Printf("FAIL %s %s: %v\n", file, r.name, r.err)
+			} else {
+				fmt.Printf("ok   %s %s (high water: cell %d)\n", file, r.name, r.highWater)
+			}
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of %d runs failed\n", failed, total)
+		os.Exit(1)
+	}
+}
+
+// verifyResult is the outcome of running one case natively and in the VM.
+type verifyResult struct {
+	name      string
+	err       error // nil when both ran cleanly and agreed
+	highWater int   // the VM run's, see vm.VM.HighWater
+}
+
+// verifyOptions are the flags of verify.
+type verifyOptions struct {
+	level      core.OptLevel
+	maxSteps   uint64
+	timeout    time.Duration
+	traceLimit int  // events compared per run, 0 to compare output only
+	emulate    bool // run the executable in the emulator rather than natively
+	avx2       bool // build for x86-64-v3, see linux.WithAVX2
+}
+
+// verifyFile builds file and runs the executable against the VM for each
+// of its cases. Without tracing the VM runs the unoptimised program, which
+// checks the optimiser too; with tracing it runs the same IR as the
+// executable, so that loop labels line up.
+func verifyFile(file string, opts verifyOptions) ([]verifyResult, error) {
+	src := readSource(file)
+	ops, err := core.LowerAt(core.Tokenize(src), opts.level)
+	if err != nil {
+		return nil, err
+	}
+	optimised, err := core.OptimiseWithLevel(ops, opts.level)
+	if err != nil {
+		return nil, err
+	}
+
+	cases := []bftest.Case{{Name: "no input"}}
+	if _, err := os.Stat(bftest.TestsFile(file)); err == nil {
+		cases = readCases(file, "")
+	}
+
+	var genOpts []linux.Option
+	if opts.avx2 {
+		genOpts = append(genOpts, linux.WithAVX2())
+	}
+	var want []bftest.Result
+	if opts.traceLimit > 0 {
+		if core.NextLabel(optimised) > trace.MaxLabel+1 {
+			return nil, fmt.Errorf("too many loops to trace")
+		}
+		genOpts = append(genOpts, linux.WithTrace())
+		want = bftest.RunTrace(optimised, cases, opts.maxSteps, opts.traceLimit)
+	} else {
+		want = bftest.Run(ops, cases, opts.maxSteps, nil)
+	}
+
+	binary := linux.NewX86_64Generator(optimised, genOpts...).GenerateELF()
+	run := bftest.RunNative
+	if opts.emulate {
+		run = bftest.RunEmulated
+	}
+	native, err := run(binary, cases, opts.timeout, opts.traceLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]verifyResult, len(cases))
+	for i, c := range cases {
+		results[i].name = c.Name
+		results[i].highWater = want[i].HighWater
+		at := trace.FirstDiff(native[i].Trace, want[i].Trace)
+		switch got, want := native[i], want[i]; {
+		case want.Err != nil:
+			results[i].err = fmt.Errorf("vm: %w", want.Err)
+		case at >= 0:
+			results[i].err = errors.New(traceDivergence(optimised, got.Trace, want.Trace, at))
+		case got.Err != nil:
+			results[i].err = fmt.Errorf("native: %w", got.Err)
+		case got.Output != want.Output:
+			results[i].err = errors.New(outputMismatch(got.Output, want.Output))
+		}
+	}
+	return results, nil
+}
+
+// outputMismatch describes where the native output first differs from the
+// VM's, quoting a little of each from there.
+func outputMismatch(got, want string) string {
+	at := 0
+	for at < len(got) && at < len(want) && got[at] == want[at] {
+		at++
+	}
+	clip := func(s string) string {
+		return s[at:min(len(s), at+32)]
+	}
+	return fmt.Sprintf("output differs at byte %d: native wrote %q, vm wrote %q", at, clip(got), clip(want))
+}
+
+// traceDivergence describes the first event where the native trace differs
+// from the VM's, after the few events leading up to it. Loop events are
+// located in the source by their JZ.
+func traceDivergence(ops []core.Op, got, want []trace.Event, at int) string {
+	loops := make(map[int]*core.Position)
+	for _, op := range ops {
+		if op.Kind == core.OpJz {
+			loops[op.Arg] = op.Pos
+		}
+	}
+	describe := func(events []trace.Event) string {
+		if at >= len(events) {
+			return "end of trace"
+		}
+		e := events[at]
+		if pos := loops[e.Value]; e.Kind == trace.Loop && pos != nil {
+			return fmt.Sprintf("%v at line %d col %d", e, pos.Line, pos.Column)
+		}
+		return e.String()
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "traces differ at event %d: native %s, vm %s", at, describe(got), describe(want))
+	if at > 0 {
+		b.WriteString("\n    after:")
+		for _, e := range want[max(0, at-3):at] {
+			fmt.Fprintf(&b, " %v;", e)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// longAliases are the long names given to a command's short flags, as
+// --optimize=2 or --output out.
+var longAliases = map[string]string{
+	"optimize": "O",
+	"output":   "o",
+}
+
+// parseFlags parses a command's args GNU style, where the flag package
+// would stop at the first file: flags may come before or after the files,
+// and everything after -- is a file, even if it starts with a dash. A
+// single-letter flag may take its value attached, as in -O2 or -oout, and
+// -O and -o have the long aliases --optimize and --output. Flags are then
+// parsed by fs in their order on the command line, so errors and -h work
+// as before, and fs.Args holds the files.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	for alias, name := range longAliases {
+		if f := fs.Lookup(name); f != nil && fs.Lookup(alias) == nil {
+			arg, _ := flag.UnquoteUsage(f)
+			fs.Var(f.Value, alias, fmt.Sprintf("same as -%s `%s`", name, arg))
+		}
+	}
+
+	var flags, files []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			files = append(files, args[i+1:]...)
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			files = append(files, arg)
+			continue
+		}
+
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		f := fs.Lookup(name)
+		if f == nil && !strings.HasPrefix(arg, "--") && len(name) > 1 {
+			// -O2 for -O 2, if there is no flag named O2
+			if short := fs.Lookup(name[:1]); short != nil && !isBoolFlag(short) {
+				flags = append(flags, "-"+name[:1], strings.TrimPrefix(arg, "-"+name[:1]))
+				continue
+			}
+		}
+		flags = append(flags, arg)
+		if f != nil && !hasValue && !isBoolFlag(f) && i+1 < len(args) {
+			i++
+			flags = append(flags, args[i])
+		}
+	}
+
+	// The files go through a second Parse, after --, so a flag missing its
+	// value at the end cannot take the -- as one
+	fs.Parse(flags)
+	fs.Parse(append([]string{"--"}, files...))
+}
+
+// isBoolFlag reports whether f takes no value, as a bool flag.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
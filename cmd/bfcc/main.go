@@ -1,38 +1,261 @@
 package main
 
 import (
+	"crypto/sha256"
+	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/lcox74/bfcc/internal/codegen/avr"
+	"github.com/lcox74/bfcc/internal/codegen/c64"
+	"github.com/lcox74/bfcc/internal/codegen/cpm"
+	"github.com/lcox74/bfcc/internal/codegen/darwin"
+	"github.com/lcox74/bfcc/internal/codegen/ebpf"
+	"github.com/lcox74/bfcc/internal/codegen/linux"
+	"github.com/lcox74/bfcc/internal/codegen/wasm"
 	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/internal/vm"
 )
 
+// version is the compiler version, set at build time with
+// -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
 func usage() {
 	fmt.Fprintln(os.Stderr, `usage: bfcc <command> [options] <file>
 
 commands:
-  build [-O level] [-o out] <file> Output ELF64 executable (x86_64 Linux)
-  run [-O level] <file>            Run the program (default -O 2)
-  asm [-O level] [-o out] <file>   Output GAS assembly (x86_64 Linux)
-  tokens <file>                    Dump tokenizer output
-  ir [-O level] <file>             Dump IR (default -O 0)`)
+  build [-O level] [-o out] <file> Output executable (x86_64, riscv64, i386 or ARMv7 Linux; x86_64 FreeBSD; x86_64 or arm64 macOS; wasm or WASI; C64; CP/M; AVR; bare-metal x86)
+  run [-O level] <file>...         Run the program (default -O 2)
+  asm [-O level] [-o out] <file>   Output GAS, NASM or Go assembly (x86_64 Linux), ca65 (C64, Apple II) or AVR
+  llvm [-O level] [-o out] <file>  Output LLVM IR (any LLVM target)
+  bf [-O level] [-o out] <file>... Output optimised, plain Brainfuck (any interpreter)
+  ebpf [-O level] [-S] <file>      Run the program in the Linux kernel as eBPF, or list it
+  tokens [-count] <file>           Dump tokenizer output, or count it
+  ir [-O level] <file>             Dump IR (default -O 0)
+  stat [-run] <file>               Print static program metrics
+  check [-comments] <file>         Warn about likely mistakes
+  shorten [-o out] <file>          Rewrite as shorter equivalent Brainfuck
+  expand [options] <file>          Rewrite long-hand with optional padding
+  diff [-O level] <a> <b>          Diff two programs by IR, ignoring comments
+  outline [-json] <file>           Print the loop structure
+  eval [-emit mode] <file>         Evaluate an input-free program at compile time
+  cover [-o out] <profile.json>    Render a coverage profile as HTML
+  test [-tests file] <file>        Run the program's input/output tests
+  mutate [-tests file] <file>      Report mutants the program's tests miss
+  enumerate [-max-len n]           Run every program up to a length, as in a busy beaver search
+  verify [-O level] <file>...      Check native executables against the VM
+  addr2src <binary> <address>...   Map code addresses back to IR and source
+  backends                         List the build architectures, including plugins`)
 	os.Exit(1)
 }
 
-func parseOptLevel(level int) core.OptLevel {
-	switch level {
-	case 0:
-		return core.O0
-	case 1:
-		return core.O1
-	case 2:
-		return core.O2
-	default:
-		fmt.Fprintf(os.Stderr, "invalid optimization level: %d (must be 0, 1, or 2)\n", level)
+// optLevelValue is the value of -O: 0, 1, 2, or g.
+type optLevelValue struct{ level *core.OptLevel }
+
+func (v optLevelValue) String() string {
+	if v.level == nil {
+		return ""
+	}
+	return v.level.String()
+}
+
+func (v optLevelValue) Set(s string) error {
+	level, err := core.ParseOptLevel(s)
+	if err != nil {
+		return err
+	}
+	*v.level = level
+	return nil
+}
+
+// optLevelFlag defines -O on fs with the given default, and -Og as
+// shorthand for -O g.
+func optLevelFlag(fs *flag.FlagSet, def core.OptLevel, usage string) *core.OptLevel {
+	level := def
+	fs.Var(optLevelValue{&level}, "O", usage)
+	fs.BoolFunc("Og", "shorthand for -O g: no optimisation and one op per source command, for debugging", func(string) error {
+		level = core.Og
+		return nil
+	})
+	return &level
+}
+
+// cellOverflowValue is a flag.Value for -cell-overflow.
+type cellOverflowValue struct {
+	overflow *core.CellOverflow
+}
+
+func (v cellOverflowValue) String() string {
+	if v.overflow == nil {
+		return ""
+	}
+	return v.overflow.String()
+}
+
+func (v cellOverflowValue) Set(s string) error {
+	overflow, err := core.ParseCellOverflow(s)
+	if err != nil {
+		return err
+	}
+	*v.overflow = overflow
+	return nil
+}
+
+// cellFlags defines -cell-overflow and -signed-cells on fs, which set the
+// returned cell model.
+func cellFlags(fs *flag.FlagSet) *core.CellModel {
+	cells := new(core.CellModel)
+	fs.Var(cellOverflowValue{&cells.Overflow}, "cell-overflow", "cell overflow `policy` (wrap, saturate, or trap)")
+	fs.BoolVar(&cells.Signed, "signed-cells", false, "treat cells as signed bytes (-128 to 127, EOF stores -1)")
+	return cells
+}
+
+// midTapeFlag defines -mid-tape on fs.
+func midTapeFlag(fs *flag.FlagSet) *bool {
+	return fs.Bool("mid-tape", false, "start the data pointer in the middle of the tape")
+}
+
+// chainFlag defines -chain on fs, which parseDialect and lower read.
+func chainFlag(fs *flag.FlagSet) *string {
+	return fs.String("chain", "", "run %% separated programs in turn, with this handoff (continue, share, or reset)")
+}
+
+// debugFlag defines -g on fs, for debugOps.
+func debugFlag(fs *flag.FlagSet) *bool {
+	return fs.Bool("g", false, "debug build: trap at unreachable code and check jump targets")
+}
+
+// costModels are the backend cost models, by -arch name, and the VM's.
+var costModels = map[string]*core.CostModel{
+	"vm":      &core.StepCosts,
+	"amd64":   &linux.X86_64Costs,
+	"riscv64": &linux.RISCV64Costs,
+	"386":     &linux.I386Costs,
+	"arm":     &linux.ARMCosts,
+	"arm64":   &darwin.ARM64Costs,
+	"wasm":    &wasm.Costs,
+	"6502":    &c64.Costs,
+	"z80":     &cpm.Costs,
+	"avr":     &avr.Costs,
+	"ebpf":    &ebpf.Costs,
+}
+
+func parseCostModel(name string) *core.CostModel {
+	costs, ok := costModels[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown cost model: %s (must be vm, amd64, riscv64, 386, arm, arm64, wasm, 6502, z80, avr, or ebpf)\n", name)
+		os.Exit(1)
+	}
+	return costs
+}
+
+func parseTapeBound(name string) core.TapeBound {
+	bound, err := core.ParseTapeBound(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return bound
+}
+
+func parseCellIO(name string) vm.CellIO {
+	cio, err := vm.ParseIO(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return cio
+}
+
+func parseNewline(name string) vm.Newline {
+	nl, err := vm.ParseNewline(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return nl
+}
+
+// dialectFlag defines -dialect on fs.
+func dialectFlag(fs *flag.FlagSet) *string {
+	return fs.String("dialect", "standard", "how to read the source (standard, jump-back for ] always jumping back to [, or strict for no bfcc extensions)")
+}
+
+// parseDialect parses -dialect. A strict program has no chain separators,
+// so it cannot be given -chain.
+func parseDialect(name, chain string) core.Dialect {
+	d, err := core.ParseDialect(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if d == core.DialectStrict && chain != "" {
+		fmt.Fprintln(os.Stderr, "-dialect strict cannot be used with -chain")
+		os.Exit(1)
+	}
+	return d
+}
+
+// lower lowers the tokens of src for optimising at level, or with a
+// handoff name in chain, the chain of %% separated programs in it.
+func lower(src []byte, tokens []core.Token, chain string, level core.OptLevel) ([]core.Op, error) {
+	if chain == "" {
+		return core.LowerAt(tokens, level)
+	}
+	h, err := core.ParseHandoff(chain)
+	if err != nil {
+		return nil, err
+	}
+	return core.LowerChainAt(src, h, level)
+}
+
+// readTapeInit reads a -tape-init file, which has to fit on the tape from
+// the start cell.
+func readTapeInit(file string, midTape bool) []byte {
+	data, err := os.ReadFile(filepath.Clean(file))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	room := core.TapeSize
+	if midTape {
+		room -= core.TapeSize / 2
+	}
+	if len(data) > room {
+		fmt.Fprintf(os.Stderr, "-tape-init file %s is %d bytes, but the tape has room for %d from the start cell\n", file, len(data), room)
+		os.Exit(1)
+	}
+	return data
+}
+
+// infoMessage returns the text printed by an executable built with -info
+// from files.
+func infoMessage(files []string, src []byte, tapeEnv bool) string {
+	tape := fmt.Sprintf("%d bytes", core.TapeSize)
+	if tapeEnv {
+		tape += " (BF_TAPE overrides)"
+	}
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = filepath.Base(file)
+	}
+	return fmt.Sprintf("built by bfcc %s\nsource: %s (sha256 %x)\ntape: %s\n",
+		version, strings.Join(names, " + "), sha256.Sum256(src), tape)
+}
+
+// debugOps inserts TRAP ops for a -g build and checks the jump targets of
+// the final IR. cells is the cell model the program runs under and tape
+// its -tape-init bytes, if any.
+func debugOps(ops []core.Op, cells core.CellModel, tape []byte) []core.Op {
+	ops = core.InsertTraps(ops, cells, tape)
+	if err := core.CheckJumps(ops); err != nil {
+		fmt.Fprintf(os.Stderr, "internal error: %v\n", err)
 		os.Exit(1)
 	}
-	return core.O0
+	return ops
 }
 
 func readSource(file string) []byte {
@@ -64,6 +287,40 @@ func main() {
 		cmdRun(args)
 	case "asm":
 		cmdAsm(args)
+	case "llvm":
+		cmdLLVM(args)
+	case "ebpf":
+		cmdEBPF(args)
+	case "stat":
+		cmdStat(args)
+	case "check":
+		cmdCheck(args)
+	case "shorten":
+		cmdShorten(args)
+	case "expand":
+		cmdExpand(args)
+	case "bf":
+		cmdBF(args)
+	case "diff":
+		cmdDiff(args)
+	case "outline":
+		cmdOutline(args)
+	case "eval":
+		cmdEval(args)
+	case "cover":
+		cmdCover(args)
+	case "test":
+		cmdTest(args)
+	case "mutate":
+		cmdMutate(args)
+	case "enumerate":
+		cmdEnumerate(args)
+	case "verify":
+		cmdVerify(args)
+	case "addr2src":
+		cmdAddr2Src(args)
+	case "backends":
+		cmdBackends(args)
 	default:
 		usage()
 	}
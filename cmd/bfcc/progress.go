@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/internal/plugin"
+)
+
+// progressInterval is how often -progress updates the status on stderr.
+const progressInterval = 500 * time.Millisecond
+
+// progress prints a status line on stderr for -progress. On a terminal the
+// line is redrawn in place; otherwise each update is a line of its own, so
+// logs stay readable.
+type progress struct {
+	tty   bool
+	start time.Time
+	last  time.Time
+	shown bool // a status line is on screen and needs clearing
+	any   bool // a status has been shown
+}
+
+func newProgress() *progress {
+	now := time.Now()
+	p := &progress{start: now, last: now}
+	if fi, err := os.Stderr.Stat(); err == nil {
+		p.tty = fi.Mode()&os.ModeCharDevice != 0
+	}
+	return p
+}
+
+// begin restarts the clock for the next phase, whose time remaining is
+// estimated on its own. Like done, it does nothing on a nil progress.
+func (p *progress) begin() {
+	if p == nil {
+		return
+	}
+	p.start = time.Now()
+}
+
+// update shows the status, unless the last one was shown less than
+// progressInterval ago and force is false.
+func (p *progress) update(force bool, format string, args ...any) {
+	now := time.Now()
+	if !force && now.Sub(p.last) < progressInterval {
+		return
+	}
+	p.last = now
+	p.any = true
+
+	msg := fmt.Sprintf(format, args...)
+	if p.tty {
+		fmt.Fprintf(os.Stderr, "\r%s\033[K", msg)
+		p.shown = true
+	} else {
+		fmt.Fprintln(os.Stderr, msg)
+	}
+}
+
+// done clears the status line, so later output starts on a clean line.
+func (p *progress) done() {
+	if p != nil && p.shown {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+		p.shown = false
+	}
+}
+
+// remaining estimates the time left from the rate so far, given how much
+// of total is done.
+func (p *progress) remaining(done, total uint64) string {
+	if done == 0 || done >= total {
+		return "0s"
+	}
+	elapsed := time.Since(p.start)
+	left := time.Duration(float64(elapsed) * float64(total-done) / float64(done))
+	return left.Round(100 * time.Millisecond).String()
+}
+
+// optimise reports the optimiser passes, see core.Options.Progress.
+func (p *progress) optimise(round int, pass string, ops int) {
+	p.update(false, "optimise: round %d, %s, %d ops", round, pass, ops)
+}
+
+// codegen reports the ops emitted by a generator.
+func (p *progress) codegen(done, total int) {
+	if done == total {
+		// Work that finished quickly is not worth a line
+		p.update(p.any, "codegen: %d ops in %v", total, time.Since(p.start).Round(time.Millisecond))
+		return
+	}
+	p.update(false, "codegen: %d/%d ops (%.0f%%), %s remaining",
+		done, total, 100*float64(done)/float64(total), p.remaining(uint64(done), uint64(total)))
+}
+
+// run reports the steps executed by the VM, as a share of maxSteps when
+// there is a limit.
+func (p *progress) run(steps, maxSteps uint64) {
+	if maxSteps == 0 {
+		rate := float64(steps) / time.Since(p.start).Seconds()
+		p.update(true, "run: %d steps (%.0f steps/s)", steps, rate)
+		return
+	}
+	p.update(true, "run: %d/%d steps (%.0f%%), %s remaining until the step limit",
+		steps, maxSteps, 100*float64(steps)/float64(maxSteps), p.remaining(steps, maxSteps))
+}
+
+// optimiseWithProgress is core.OptimiseForCells for the costs of a backend
+// (nil for the VM), with the superopt pass if asked for, then the external passes in BFCC_PASSES, reporting the
+// built-in passes to p when it is not nil and clearing the status line
+// once they are done.
+func optimiseWithProgress(ops []core.Op, level core.OptLevel, cells core.CellModel, costs *core.CostModel, superopt bool, p *progress) ([]core.Op, error) {
+	opts := core.Options{Level: level, Cells: cells, Costs: costs, Superopt: superopt}
+	if p != nil {
+		opts.Progress = p.optimise
+	}
+	result, _, err := core.Optimise(ops, opts)
+	p.done()
+	if err != nil {
+		return nil, err
+	}
+	return plugin.RunPasses(result, level, cells)
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// readSources reads the files of run and build and joins them in order, as
+// if they were one, exiting if one cannot be read.
+func readSources(files []string) *core.Sources {
+	var srcs []core.Source
+	for _, file := range files {
+		file = filepath.Clean(file)
+		srcs = append(srcs, core.Source{Name: file, Data: readSource(file)})
+	}
+	return core.JoinSources(srcs...)
+}
@@ -0,0 +1,115 @@
+// Package bftest runs Brainfuck programs against input/output test cases.
+//
+// Test cases live in a JSON file, by convention next to the program with a
+// .tests.json extension:
+//
+//	[
+//	  {"name": "greets", "input": "", "output": "Hello World!\n"},
+//	  {"name": "echoes", "input": "abc", "output": "abc"}
+//	]
+package bftest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/internal/trace"
+	"github.com/lcox74/bfcc/internal/vm"
+)
+
+// DefaultMaxSteps bounds each test run so a looping program fails rather
+// than hangs.
+const DefaultMaxSteps = 100_000_000
+
+// Case is a single test: the program fed Input must write exactly Output.
+type Case struct {
+	Name   string `json:"name"`
+	Input  string `json:"input"`
+	Output string `json:"output"`
+}
+
+// Result is the outcome of running one Case.
+type Result struct {
+	Case   Case
+	Output string        // what the program actually wrote
+	Err    error         // runtime error, eg. vm.ErrStepLimit
+	Trace  []trace.Event // events of a traced run, see RunTrace
+
+	// HighWater is the highest cell the data pointer reached, see
+	// vm.VM.HighWater. Only VM runs record it.
+	HighWater int
+}
+
+// Passed reports whether the program ran cleanly and wrote the expected output.
+func (r Result) Passed() bool {
+	return r.Err == nil && r.Output == r.Case.Output
+}
+
+// ReadCases decodes a JSON list of test cases.
+func ReadCases(r io.Reader) ([]Case, error) {
+	var cases []Case
+	if err := json.NewDecoder(r).Decode(&cases); err != nil {
+		return nil, err
+	}
+	for i := range cases {
+		if cases[i].Name == "" {
+			cases[i].Name = fmt.Sprintf("case %d", i+1)
+		}
+	}
+	return cases, nil
+}
+
+// TestsFile returns the conventional test case file for a program.
+func TestsFile(program string) string {
+	return strings.TrimSuffix(program, ".bf") + ".tests.json"
+}
+
+// Run executes ops once per case. opts are applied to every VM after the
+// case's input/output and the step limit, and counts (if non-nil) gathers
+// per-op execution counts across all cases.
+func Run(ops []core.Op, cases []Case, maxSteps uint64, counts []uint64, opts ...vm.VMOption) []Result {
+	results := make([]Result, 0, len(cases))
+
+	for _, c := range cases {
+		var out bytes.Buffer
+		vmOpts := []vm.VMOption{
+			vm.WithInput(strings.NewReader(c.Input)),
+			vm.WithOutput(&out),
+			vm.WithMaxSteps(maxSteps),
+		}
+		if counts != nil {
+			vmOpts = append(vmOpts, vm.WithOpCounts(counts))
+		}
+		vmOpts = append(vmOpts, opts...)
+
+		interpreter := vm.NewVM(vmOpts...)
+		err := interpreter.Run(ops)
+		results = append(results, Result{Case: c, Output: out.String(), Err: err, HighWater: interpreter.HighWater()})
+	}
+
+	return results
+}
+
+// RunTrace is Run recording the first limit trace events of each case.
+func RunTrace(ops []core.Op, cases []Case, maxSteps uint64, limit int) []Result {
+	results := make([]Result, 0, len(cases))
+
+	for _, c := range cases {
+		var events []trace.Event
+		record := vm.WithTrace(func(e trace.Event) {
+			if len(events) < limit {
+				events = append(events, e)
+			}
+		})
+
+		r := Run(ops, []Case{c}, maxSteps, nil, record)[0]
+		r.Trace = events
+		results = append(results, r)
+	}
+
+	return results
+}
@@ -0,0 +1,111 @@
+package bftest_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lcox74/bfcc/internal/bftest"
+	"github.com/lcox74/bfcc/internal/codegen/linux"
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/internal/vm"
+)
+
+// TestCellModes is the conformance suite for the cell models: each
+// overflow policy, with signed and unsigned cells, adds k to a cell at and
+// between its bounds, in the VM and in x86_64 executables at -O0 and -O2
+// run in the emulator. Adds of more than 255 either way are the ones
+// CellModel.AlwaysOverflows lets a backend skip.
+func TestCellModes(t *testing.T) {
+	ks := []int{1, -1, 127, -127, 128, -128, 129, -129, 255, -255, 256, -256, 300, -300}
+	cases := []bftest.Case{{Name: "no input"}}
+
+	for _, overflow := range []core.CellOverflow{core.OverflowWrap, core.OverflowSaturate, core.OverflowTrap} {
+		for _, signed := range []bool{false, true} {
+			cells := core.CellModel{Overflow: overflow, Signed: signed}
+			name := overflow.String() + "/unsigned"
+			if signed {
+				name = overflow.String() + "/signed"
+			}
+			t.Run(name, func(t *testing.T) {
+				starts := []int{cells.Min(), cells.Max()}
+				if signed {
+					starts = append(starts, 0)
+				}
+				for _, start := range starts {
+					for _, k := range ks {
+						testCellAdd(t, cells, start, k, cases)
+					}
+				}
+			})
+		}
+	}
+}
+
+// testCellAdd runs a program writing a cell set to start, then the cell
+// less k, and checks each run writes what the cell model says, stopping
+// after the first byte if the add overflows under trap.
+func testCellAdd(t *testing.T, cells core.CellModel, start, k int, cases []bftest.Case) {
+	t.Helper()
+	src := adds(start) + "." + adds(k) + "."
+	want, traps := cellAdd(cells, start, k)
+
+	ops, err := core.Lower(core.Tokenize([]byte(src)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := bftest.Run(ops, cases, bftest.DefaultMaxSteps, nil, vm.WithCells(cells))
+	check(t, fmt.Sprintf("%d %+d vm", start, k), got[0], want, traps)
+
+	for _, level := range []core.OptLevel{core.O0, core.O2} {
+		optimised, _, err := core.Optimise(ops, core.Options{Level: level, Cells: cells})
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := []linux.Option{linux.WithCellOverflow(cells.Overflow)}
+		if cells.Signed {
+			opts = append(opts, linux.WithSignedCells())
+		}
+		binary := linux.NewX86_64Generator(optimised, opts...).GenerateELF()
+		got, err := bftest.RunEmulated(binary, cases, 10*time.Second, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, fmt.Sprintf("%d %+d x86_64 -O%s", start, k, level), got[0], want, traps)
+	}
+}
+
+// adds returns + or - repeated to add k to a cell.
+func adds(k int) string {
+	if k < 0 {
+		return strings.Repeat("-", -k)
+	}
+	return strings.Repeat("+", k)
+}
+
+// cellAdd returns what a program writing a cell set to start, then the
+// cell plus k, writes under cells, and whether the add traps.
+func cellAdd(cells core.CellModel, start, k int) (string, bool) {
+	sum := start + k
+	switch {
+	case sum >= cells.Min() && sum <= cells.Max():
+	case cells.Overflow == core.OverflowTrap:
+		return string([]byte{byte(start)}), true
+	case cells.Overflow == core.OverflowSaturate:
+		sum = max(min(sum, cells.Max()), cells.Min())
+	}
+	return string([]byte{byte(start), byte(sum)}), false
+}
+
+// check reports a run that did not write want, or that did not stop with
+// an error if and only if it traps.
+func check(t *testing.T, name string, r bftest.Result, want string, traps bool) {
+	t.Helper()
+	if traps != (r.Err != nil) {
+		t.Errorf("%s: error %v, want one: %v", name, r.Err, traps)
+	}
+	if r.Output != want {
+		t.Errorf("%s: wrote %q, want %q", name, r.Output, want)
+	}
+}
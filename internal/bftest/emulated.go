@@ -0,0 +1,48 @@
+package bftest
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lcox74/bfcc/internal/emu"
+	"github.com/lcox74/bfcc/internal/trace"
+)
+
+// RunEmulated is RunNative in the x86_64 emulator, so it works on any host.
+// A run that exits non-zero, faults or outlives timeout fails with an
+// error.
+func RunEmulated(binary []byte, cases []Case, timeout time.Duration, traceLimit int) ([]Result, error) {
+	results := make([]Result, 0, len(cases))
+	for _, c := range cases {
+		res, err := emu.Run(binary, emu.Config{
+			Input:    []byte(c.Input),
+			Deadline: time.Now().Add(timeout),
+		})
+		if res == nil {
+			return nil, err // not a loadable executable
+		}
+
+		switch {
+		case errors.Is(err, emu.ErrDeadline):
+			err = fmt.Errorf("timed out after %v", timeout)
+		case err == nil && res.Exit != 0:
+			err = fmt.Errorf("exited with exit status %d", res.Exit)
+		}
+
+		r := Result{Case: c, Output: string(res.Stdout), Err: err}
+		if traceLimit > 0 {
+			records := res.Trace
+			if len(records) > 4*traceLimit {
+				records = records[:4*traceLimit]
+			}
+			events, err := trace.Decode(records)
+			if err != nil {
+				return nil, err
+			}
+			r.Trace = events
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
@@ -0,0 +1,118 @@
+//go:build linux && amd64
+
+package bftest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lcox74/bfcc/internal/trace"
+)
+
+// RunNative writes binary to a temporary executable and runs it once per
+// case, with the case's input piped to stdin. A run that exits non-zero or
+// outlives timeout fails with an error.
+//
+// With traceLimit above 0 the binary must have been built with
+// linux.WithTrace: a pipe is passed on trace.FD and up to traceLimit of the
+// events read from it are kept in each Result.
+func RunNative(binary []byte, cases []Case, timeout time.Duration, traceLimit int) ([]Result, error) {
+	dir, err := os.MkdirTemp("", "bfcc-native-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	exe := filepath.Join(dir, "prog")
+	if err := os.WriteFile(exe, binary, 0755); err != nil {
+		return nil, err
+	}
+
+	results := make([]Result, 0, len(cases))
+	for _, c := range cases {
+		r, err := runNative(exe, c, timeout, traceLimit)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+
+	return results, nil
+}
+
+// runNative runs exe for one case.
+func runNative(exe string, c Case, timeout time.Duration, traceLimit int) (Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, exe)
+	cmd.Stdin = strings.NewReader(c.Input)
+	cmd.Stdout = &out
+
+	// Keep the first traceLimit records and drain the rest, so the program
+	// never blocks on a full pipe
+	var records []byte
+	done := make(chan error, 1)
+	if traceLimit > 0 {
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			return Result{}, err
+		}
+		cmd.ExtraFiles = []*os.File{pw} // trace.FD
+		go func() {
+			var buf bytes.Buffer
+			_, err := io.CopyN(&buf, pr, int64(4*traceLimit))
+			if err == nil {
+				_, err = io.Copy(io.Discard, pr)
+			}
+			pr.Close()
+			records = buf.Bytes()
+			if err == io.EOF {
+				err = nil
+			}
+			done <- err
+		}()
+		defer pw.Close()
+	} else {
+		done <- nil
+	}
+
+	err := cmd.Start()
+	if cmd.ExtraFiles != nil {
+		// Only the child holds the write end now, so the reader sees EOF
+		// when it exits
+		cmd.ExtraFiles[0].Close()
+	}
+	if err != nil {
+		return Result{}, err
+	}
+
+	err = cmd.Wait()
+	if ctx.Err() != nil {
+		err = fmt.Errorf("timed out after %v", timeout)
+	} else if exit := (*exec.ExitError)(nil); errors.As(err, &exit) {
+		err = fmt.Errorf("exited with %v", exit.ProcessState)
+	}
+
+	r := Result{Case: c, Output: out.String(), Err: err}
+	if readErr := <-done; readErr != nil {
+		return Result{}, readErr
+	}
+	if traceLimit > 0 {
+		events, err := trace.Decode(records)
+		if err != nil {
+			return Result{}, err
+		}
+		r.Trace = events
+	}
+	return r, nil
+}
@@ -0,0 +1,157 @@
+//go:build linux && amd64
+
+package bftest_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lcox74/bfcc/internal/bftest"
+	"github.com/lcox74/bfcc/internal/codegen/linux"
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// TestNativeCorpus builds each program in testdata at each optimisation
+// level, runs the executable with its cases and checks that it writes what
+// the unoptimised program does in the VM, as bfcc verify does.
+func TestNativeCorpus(t *testing.T) {
+	files, err := filepath.Glob("../../testdata/*.bf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no programs in testdata")
+	}
+
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cases := []bftest.Case{{Name: "no input"}}
+		if f, err := os.Open(bftest.TestsFile(file)); err == nil {
+			cases, err = bftest.ReadCases(f)
+			f.Close()
+			if err != nil {
+				t.Fatalf("%s: %v", bftest.TestsFile(file), err)
+			}
+		}
+
+		for _, level := range []core.OptLevel{core.O0, core.O1, core.O2} {
+			t.Run(filepath.Base(file)+"/O"+level.String(), func(t *testing.T) {
+				ops, err := core.LowerAt(core.Tokenize(src), level)
+				if err != nil {
+					t.Fatal(err)
+				}
+				optimised, err := core.OptimiseWithLevel(ops, level)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				want := bftest.Run(ops, cases, bftest.DefaultMaxSteps, nil)
+				binary := linux.NewX86_64Generator(optimised).GenerateELF()
+				got, err := bftest.RunNative(binary, cases, 10*time.Second, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i, c := range cases {
+					if want[i].Err != nil {
+						t.Fatalf("%s: vm: %v", c.Name, want[i].Err)
+					}
+					if got[i].Err != nil {
+						t.Errorf("%s: native: %v", c.Name, got[i].Err)
+					} else if got[i].Output != want[i].Output {
+						t.Errorf("%s: native wrote %q, vm wrote %q", c.Name, got[i].Output, want[i].Output)
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestNativeTapeGuard checks that a -tape-guard executable stopped off the
+// start of the tape has written what the VM does before its error.
+func TestNativeTapeGuard(t *testing.T) {
+	ops, err := core.Lower(core.Tokenize([]byte("+.<+.")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	optimised, err := core.OptimiseWithLevel(ops, core.O2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []bftest.Case{{Name: "no input"}}
+	want := bftest.Run(ops, cases, bftest.DefaultMaxSteps, nil)
+	if want[0].Err == nil {
+		t.Fatal("vm: no error off the start of the tape")
+	}
+	binary := linux.NewX86_64Generator(optimised, linux.WithTapeGuard()).GenerateELF()
+	got, err := bftest.RunNative(binary, cases, 10*time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0].Err == nil {
+		t.Error("native: no error off the start of the tape")
+	}
+	if got[0].Output != want[0].Output {
+		t.Errorf("native wrote %q, vm wrote %q", got[0].Output, want[0].Output)
+	}
+}
+
+// BenchmarkNativeVector times the SSE2 code for range ops and runs of ADDs
+// against the scalar code WithSize keeps. Each body runs on each of the
+// 255³ passes of three counter loops; the [-] after it keeps the inner
+// loop from becoming a multiply loop.
+func BenchmarkNativeVector(b *testing.B) {
+	far, back := strings.Repeat(">", 64), strings.Repeat("<", 64)
+	var adds strings.Builder
+	for i := range 64 {
+		adds.WriteString(strings.Repeat("+", i%7+1) + ">")
+	}
+	benchmarks := []struct {
+		name string
+		body string
+	}{
+		{"zero range", strings.Repeat("[-]>", 64) + back},
+		{"copy range", strings.Repeat(far+"[-]"+back+"[-"+far+"+"+back+"]>", 64) + back},
+		{"add run", adds.String() + back},
+	}
+	modes := []struct {
+		name string
+		opts []linux.Option
+	}{
+		{"sse2", nil},
+		{"scalar", []linux.Option{linux.WithSize()}},
+	}
+
+	cases := []bftest.Case{{Name: "no input"}}
+	for _, bm := range benchmarks {
+		src := "-[>-[>-[>" + bm.body + far + "[-]" + back + "<-]<-]<-]"
+		ops, err := core.Lower(core.Tokenize([]byte(src)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		optimised, err := core.OptimiseWithLevel(ops, core.O2)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, mode := range modes {
+			b.Run(bm.name+"/"+mode.name, func(b *testing.B) {
+				binary := linux.NewX86_64Generator(optimised, mode.opts...).GenerateELF()
+				for b.Loop() {
+					got, err := bftest.RunNative(binary, cases, time.Minute, 0)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if got[0].Err != nil {
+						b.Fatal(got[0].Err)
+					}
+				}
+			})
+		}
+	}
+}
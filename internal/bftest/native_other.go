@@ -0,0 +1,13 @@
+//go:build !(linux && amd64)
+
+package bftest
+
+import (
+	"errors"
+	"time"
+)
+
+// RunNative runs native executables, which are only built for x86_64 Linux.
+func RunNative(binary []byte, cases []Case, timeout time.Duration, traceLimit int) ([]Result, error) {
+	return nil, errors.New("native executables only run on x86_64 Linux")
+}
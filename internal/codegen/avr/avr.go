@@ -0,0 +1,475 @@
+// Package avr produces programs for AVR microcontrollers from IR
+// operations: machine code for an ATmega, in an Intel HEX file to flash
+// with avrdude, as on an Arduino Uno or Mega.
+//
+// The program runs from reset with nothing else on the chip but the
+// board's bootloader. It does its I/O through USART0, at 9600 baud with
+// 8 data bits, no parity and one stop bit, which is the serial port the
+// board's USB adapter is wired to. Input never ends, and the program
+// stops by spinning in a loop. The tape fills the SRAM but for a little
+// stack, so it is only as large as the chip allows: 2,032 cells on the
+// ATmega328P.
+package avr
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/lcox74/bfcc/internal/codegen/linux"
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/pkg/avr"
+	"github.com/lcox74/bfcc/pkg/ihex"
+)
+
+// MCU describes a supported microcontroller.
+type MCU struct {
+	Name   string
+	Flash  int // bytes of flash for the program, below the board's bootloader
+	RAMEnd int // the last SRAM address
+	Clock  int // clock frequency in Hz, of the usual board
+}
+
+// MCUs are the supported microcontrollers, by their avrdude part name.
+var MCUs = map[string]*MCU{
+	"atmega328p": {Name: "atmega328p", Flash: 32<<10 - 512, RAMEnd: 0x08FF, Clock: 16_000_000},
+	"atmega2560": {Name: "atmega2560", Flash: 256<<10 - 8<<10, RAMEnd: 0x21FF, Clock: 16_000_000},
+}
+
+// Memory layout. Both MCUs put SRAM after the extended I/O registers.
+const (
+	RAMStart  = 0x0100 // the first SRAM address, where the tape starts
+	StackSize = 16     // bytes of SRAM left for the stack, above the tape
+	Baud      = 9600   // the serial port's speed
+)
+
+// TapeSize returns the number of cells on the tape.
+func (m *MCU) TapeSize() int {
+	return m.RAMEnd + 1 - RAMStart - StackSize
+}
+
+// USART0 registers, as data memory addresses, and their bits.
+const (
+	regUCSR0A = 0xC0 // status
+	regUCSR0B = 0xC1 // control: enables the receiver and transmitter
+	regUCSR0C = 0xC2 // control: the frame format
+	regUBRR0L = 0xC4 // baud rate, low byte
+	regUBRR0H = 0xC5 // baud rate, high byte
+	regUDR0   = 0xC6 // data
+
+	bitRXC0  = 7    // UCSR0A: a byte has been received
+	bitUDRE0 = 5    // UCSR0A: the data register is empty
+	rxTxEn   = 0x18 // UCSR0B: RXEN0 and TXEN0
+	frame8N1 = 0x06 // UCSR0C: 8 data bits, no parity, one stop bit
+)
+
+// Registers. R1 is kept 0, X is the data pointer, and the rest are
+// scratch.
+const (
+	regZero = avr.R1
+	regVal  = avr.R24 // the cell being worked on, and a counter's low byte
+	regTmp  = avr.R25 // an immediate to add, and a counter's high byte
+)
+
+// Special fixup targets for the helpers after the code.
+const (
+	fixupRead        = -1 // _bf_read
+	fixupWrite       = -2 // _bf_write
+	fixupTrap        = -3 // _bf_trap, for a cell overflow
+	fixupUnreachable = -4 // _bf_unreachable, for a TRAP
+	fixupExit        = -5 // _bf_exit
+	fixupClear       = -6 // _bf_clear
+)
+
+// Failure messages, NUL terminated.
+const (
+	trapMsg        = "bfcc: cell overflow\n\x00"
+	unreachableMsg = "bfcc: reached unreachable code\n\x00"
+)
+
+// Costs is the size in bytes of the code for each op, for the optimiser,
+// with the wrapping cell model. SHIFTs past 63 cells need a 16-bit
+// subtract instead of an ADIW or SBIW.
+var Costs = core.CostModel{Name: "avr", Shift: 2, FarShift: 4, NearShift: 63, Add: 6, Zero: 2, IO: 4, Jump: 10, Range: 18}
+
+// fixup records a JMP or CALL, to patch once its target is known.
+type fixup struct {
+	at      int // code offset of the instruction
+	target  int // loop label, or a special target
+	loopEnd bool
+	call    bool
+}
+
+// Generator produces AVR machine code from IR operations. It takes the
+// linux package's Options, but only supports the cell model, mid-tape,
+// debug and progress ones.
+//
+// The data pointer is X, and R1 is kept 0. Nothing checks that the data
+// pointer stays on the tape.
+type Generator struct {
+	ops      []core.Op
+	mcu      *MCU
+	code     []byte
+	opts     linux.Settings
+	messages int         // code offset of the failure messages, or 0
+	loopBody map[int]int // loop label -> code offset just past its JZ
+	loopEnd  map[int]int // loop label -> code offset just past its JNZ
+	helpers  map[int]int // special fixup target -> code offset
+	fixups   []fixup
+}
+
+// NewGenerator creates a new AVR generator for mcu.
+func NewGenerator(ops []core.Op, mcu *MCU, opts ...linux.Option) *Generator {
+	return &Generator{
+		ops:      ops,
+		mcu:      mcu,
+		code:     make([]byte, 0, 4096),
+		opts:     linux.ApplyOptions(opts...),
+		loopBody: make(map[int]int),
+		loopEnd:  make(map[int]int),
+		helpers:  make(map[int]int),
+	}
+}
+
+// Generate produces the flash image, to load at address 0. It fails if
+// the code does not fit the MCU's flash.
+func (g *Generator) Generate() ([]byte, error) {
+	g.emitPrologue()
+
+	for i, op := range g.ops {
+		g.emitOp(op)
+		switch op.Kind {
+		case core.OpJz:
+			g.loopBody[op.Arg] = len(g.code)
+		case core.OpJnz:
+			g.loopEnd[op.Arg] = len(g.code)
+		}
+		if progress := g.opts.Progress; progress != nil && (i+1)%linux.ProgressEvery == 0 {
+			progress(i+1, len(g.ops))
+		}
+	}
+	if g.opts.Progress != nil {
+		g.opts.Progress(len(g.ops), len(g.ops))
+	}
+
+	g.emitExit()
+	g.emitHelpers()
+	g.resolveFixups()
+
+	if len(g.code) > g.mcu.Flash {
+		return nil, fmt.Errorf("program too large for the %s: %d bytes of code, with room for %d", g.mcu.Name, len(g.code), g.mcu.Flash)
+	}
+	return g.code, nil
+}
+
+// GenerateHex produces the flash image as an Intel HEX file.
+func (g *Generator) GenerateHex() ([]byte, error) {
+	code, err := g.Generate()
+	if err != nil {
+		return nil, err
+	}
+	return ihex.Encode(code, 0), nil
+}
+
+// emit appends instructions to the code buffer.
+func (g *Generator) emit(insns ...[]byte) {
+	for _, b := range insns {
+		g.code = append(g.code, b...)
+	}
+}
+
+// emitJmp emits a JMP patched by resolveFixups to target.
+func (g *Generator) emitJmp(target int, loopEnd bool) {
+	g.fixups = append(g.fixups, fixup{at: len(g.code), target: target, loopEnd: loopEnd})
+	g.emit(avr.Jmp(0))
+}
+
+// emitCall emits a CALL patched by resolveFixups to the helper target.
+func (g *Generator) emitCall(target int) {
+	g.fixups = append(g.fixups, fixup{at: len(g.code), target: target, call: true})
+	g.emit(avr.Call(0))
+}
+
+// emitBranchBack emits a conditional branch back to the code offset to.
+func (g *Generator) emitBranchBack(c avr.Cond, to int) {
+	g.emit(avr.Branch(c, int8((to-len(g.code))/2-1)))
+}
+
+// emitPrologue jumps over the failure messages, which sit at the start of
+// flash where LPM reaches them on any MCU, then sets up the stack and
+// USART0, clears the tape and points the data pointer at the first cell.
+func (g *Generator) emitPrologue() {
+	if g.fails() {
+		msgs := trapMsg + unreachableMsg
+		if len(msgs)%2 != 0 {
+			msgs += "\x00" // keep the code word aligned
+		}
+		g.emit(avr.Rjmp(int16(len(msgs) / 2)))
+		g.messages = len(g.code)
+		g.emit([]byte(msgs))
+	}
+
+	ubrr := (g.mcu.Clock+8*Baud)/(16*Baud) - 1
+	g.emit(
+		avr.Cli(),
+		avr.Eor(regZero, regZero),
+		avr.Ldi(regVal, byte(g.mcu.RAMEnd)), avr.Out(avr.SPL, regVal),
+		avr.Ldi(regVal, byte(g.mcu.RAMEnd>>8)), avr.Out(avr.SPH, regVal),
+		avr.Ldi(regVal, byte(ubrr>>8)), avr.Sts(regUBRR0H, regVal),
+		avr.Ldi(regVal, byte(ubrr)), avr.Sts(regUBRR0L, regVal),
+		avr.Ldi(regVal, rxTxEn), avr.Sts(regUCSR0B, regVal),
+		avr.Ldi(regVal, frame8N1), avr.Sts(regUCSR0C, regVal),
+	)
+	g.emitCall(fixupClear)
+	g.emitStartPointer()
+}
+
+// fails reports whether the program can fail, so needs _bf_trap and
+// _bf_unreachable.
+func (g *Generator) fails() bool {
+	return g.opts.Cells.Overflow == core.OverflowTrap ||
+		slices.ContainsFunc(g.ops, func(op core.Op) bool { return op.Kind == core.OpTrap })
+}
+
+// emitStartPointer points the data pointer at the first cell: the start,
+// or the middle of the tape with WithMidTape.
+func (g *Generator) emitStartPointer() {
+	start := RAMStart
+	if g.opts.MidTape {
+		start += g.mcu.TapeSize() / 2
+	}
+	g.emitSetPointer(start)
+}
+
+// emitSetPointer points the data pointer at addr.
+func (g *Generator) emitSetPointer(addr int) {
+	g.emit(avr.Ldi(avr.XL, byte(addr)), avr.Ldi(avr.XH, byte(addr>>8)))
+}
+
+// emitExit outputs _bf_exit, which spins forever, as there is nothing to
+// return to.
+func (g *Generator) emitExit() {
+	g.helpers[fixupExit] = len(g.code)
+	g.emit(avr.Rjmp(-1))
+}
+
+// emitHelpers outputs the I/O and tape clearing helpers, and the failure
+// helpers when the program can fail.
+func (g *Generator) emitHelpers() {
+	// _bf_read: wait for a byte and store it in the current cell
+	g.helpers[fixupRead] = len(g.code)
+	g.emit(
+		avr.Lds(regVal, regUCSR0A),
+		avr.Sbrs(regVal, bitRXC0),
+		avr.Rjmp(-4),
+		avr.Lds(regVal, regUDR0),
+		avr.StX(regVal),
+		avr.Ret(),
+	)
+
+	// _bf_write: send the current cell. _bf_putc sends R24, for the
+	// failure helpers
+	g.helpers[fixupWrite] = len(g.code)
+	g.emit(avr.LdX(regVal))
+	putc := len(g.code)
+	g.emit(
+		avr.Lds(regTmp, regUCSR0A),
+		avr.Sbrs(regTmp, bitUDRE0),
+		avr.Rjmp(-4),
+		avr.Sts(regUDR0, regVal),
+		avr.Ret(),
+	)
+
+	// _bf_clear: zero the tape
+	g.helpers[fixupClear] = len(g.code)
+	g.emitSetPointer(RAMStart)
+	g.emitZeroRange(g.mcu.TapeSize())
+	g.emit(avr.Ret())
+
+	if g.messages != 0 {
+		g.emitFailHelpers(putc)
+	}
+}
+
+// emitFailHelpers outputs _bf_trap and _bf_unreachable, which send their
+// message with putc and stop.
+func (g *Generator) emitFailHelpers(putc int) {
+	g.helpers[fixupTrap] = len(g.code)
+	g.emitMessagePointer(g.messages)
+	g.emit(avr.Rjmp(2))
+
+	g.helpers[fixupUnreachable] = len(g.code)
+	g.emitMessagePointer(g.messages + len(trapMsg))
+
+	loop := len(g.code)
+	g.emit(avr.LpmZInc(regVal), avr.Tst(regVal), avr.Branch(avr.BREQ, 3))
+	g.emit(avr.Call(uint32(putc / 2)))
+	g.emit(avr.Rjmp(int16((loop-len(g.code))/2 - 1)))
+	g.emitJmp(fixupExit, false)
+}
+
+// emitMessagePointer points Z at the message at code offset at.
+func (g *Generator) emitMessagePointer(at int) {
+	g.emit(avr.Ldi(avr.ZL, byte(at)), avr.Ldi(avr.ZH, byte(at>>8)))
+}
+
+// emitOp outputs machine code for a single IR operation.
+func (g *Generator) emitOp(op core.Op) {
+	switch op.Kind {
+	case core.OpShift:
+		g.emitShift(op.Arg)
+	case core.OpAdd:
+		g.emitAdd(op.Arg)
+	case core.OpZero:
+		g.emit(avr.StX(regZero))
+	case core.OpIn:
+		g.emitCall(fixupRead)
+	case core.OpOut:
+		g.emitCall(fixupWrite)
+	case core.OpJz:
+		// ld r24, X; tst r24; brne +2; jmp past the loop's JNZ
+		g.emit(avr.LdX(regVal), avr.Tst(regVal), avr.Branch(avr.BRNE, 2))
+		g.emitJmp(op.Arg, true)
+	case core.OpJnz:
+		// ld r24, X; tst r24; breq +2; jmp to the loop body
+		g.emit(avr.LdX(regVal), avr.Tst(regVal), avr.Branch(avr.BREQ, 2))
+		g.emitJmp(op.Arg, false)
+	case core.OpSection:
+		if core.Handoff(op.Arg) == core.HandoffReset {
+			g.emitCall(fixupClear)
+		}
+		g.emitStartPointer()
+	case core.OpTrap:
+		g.emitJmp(fixupUnreachable, false)
+	case core.OpZeroRange:
+		g.emitZeroRange(op.Arg)
+	case core.OpCopyRange:
+		g.emitCopyRange(op.Arg, op.Off)
+	}
+}
+
+// emitShift moves the data pointer by k cells: an ADIW or SBIW when
+// |k| < 64, otherwise a 16-bit subtract.
+func (g *Generator) emitShift(k int) {
+	switch {
+	case k == 0:
+	case k > 0 && k < 64:
+		g.emit(avr.Adiw(avr.XL, byte(k)))
+	case k < 0 && k > -64:
+		g.emit(avr.Sbiw(avr.XL, byte(-k)))
+	default:
+		g.emitSubPointer(-k)
+	}
+}
+
+// emitSubPointer subtracts n from the data pointer.
+func (g *Generator) emitSubPointer(n int) {
+	g.emit(avr.Subi(avr.XL, byte(n)), avr.Sbci(avr.XH, byte(n>>8)))
+}
+
+// emitAdd adds k to the current cell in R24. Under the saturate and trap
+// policies it checks the carry (or overflow, for signed cells) after each
+// add, as for the other backends.
+func (g *Generator) emitAdd(k int) {
+	if k == 0 {
+		return
+	}
+	cells := g.opts.Cells
+
+	if cells.AlwaysOverflows(k) {
+		if cells.Overflow == core.OverflowTrap {
+			g.emitJmp(fixupTrap, false)
+			return
+		}
+		g.emit(avr.Ldi(regVal, byte(g.clamp(k))), avr.StX(regVal))
+		return
+	}
+
+	g.emit(avr.LdX(regVal))
+	switch {
+	case cells.Overflow == core.OverflowWrap:
+		g.emit(avr.Subi(regVal, byte(-k)))
+	case cells.Signed:
+		// V is only meaningful for an addend in [-128, 127]
+		for k != 0 {
+			step := max(-128, min(127, k))
+			g.emit(avr.Ldi(regTmp, byte(step)), avr.Add(regVal, regTmp))
+			g.emitChecked(avr.BRVC, step)
+			k -= step
+		}
+	case k > 0:
+		g.emit(avr.Ldi(regTmp, byte(k)), avr.Add(regVal, regTmp))
+		g.emitChecked(avr.BRCC, k)
+	default:
+		// SUBI sets C on a borrow
+		g.emit(avr.Subi(regVal, byte(-k)))
+		g.emitChecked(avr.BRCC, k)
+	}
+	g.emit(avr.StX(regVal))
+}
+
+// emitChecked outputs the saturate clamp or trap jump after an add of k,
+// skipped by the branch ok when it did not overflow.
+func (g *Generator) emitChecked(ok avr.Cond, k int) {
+	if g.opts.Cells.Overflow == core.OverflowSaturate {
+		g.emit(avr.Branch(ok, 1), avr.Ldi(regVal, byte(g.clamp(k))))
+		return
+	}
+	g.emit(avr.Branch(ok, 2))
+	g.emitJmp(fixupTrap, false)
+}
+
+// clamp returns the value an add of k saturates to.
+func (g *Generator) clamp(k int) int {
+	if k > 0 {
+		return g.opts.Cells.Max()
+	}
+	return g.opts.Cells.Min()
+}
+
+// emitCounter loads the 16-bit loop counter R25:R24 with n.
+func (g *Generator) emitCounter(n int) {
+	g.emit(avr.Ldi(regVal, byte(n)), avr.Ldi(regTmp, byte(n>>8)))
+}
+
+// emitZeroRange clears n cells from the data pointer, counting them down
+// in R25:R24 as X moves on, then moves X back.
+func (g *Generator) emitZeroRange(n int) {
+	g.emitCounter(n)
+	loop := len(g.code)
+	g.emit(avr.StXInc(regZero), avr.Sbiw(regVal, 1))
+	g.emitBranchBack(avr.BRNE, loop)
+	g.emitSubPointer(n)
+}
+
+// emitCopyRange copies n cells from the data pointer to d cells away,
+// through Z, as emitZeroRange clears them. The optimiser only emits
+// non-overlapping ranges.
+func (g *Generator) emitCopyRange(n, d int) {
+	g.emit(avr.Movw(avr.ZL, avr.XL), avr.Subi(avr.ZL, byte(-d)), avr.Sbci(avr.ZH, byte(-d>>8)))
+	g.emitCounter(n)
+	loop := len(g.code)
+	g.emit(avr.LdXInc(avr.R0), avr.StZInc(avr.R0), avr.Sbiw(regVal, 1))
+	g.emitBranchBack(avr.BRNE, loop)
+	g.emitSubPointer(n)
+}
+
+// resolveFixups patches every JMP and CALL with its target's word
+// address.
+func (g *Generator) resolveFixups() {
+	for _, f := range g.fixups {
+		var target int
+		switch {
+		case f.target < 0:
+			target = g.helpers[f.target]
+		case f.loopEnd:
+			target = g.loopEnd[f.target]
+		default:
+			target = g.loopBody[f.target]
+		}
+		insn := avr.Jmp(uint32(target / 2))
+		if f.call {
+			insn = avr.Call(uint32(target / 2))
+		}
+		copy(g.code[f.at:], insn)
+	}
+}
@@ -0,0 +1,537 @@
+// Package avrasm provides GNU assembler source output for AVR
+// microcontrollers, for avr-gcc to build against its startup code and
+// linker scripts. The code is the avr package's, with X the data pointer
+// and R1 kept 0, but the tape is a .bss symbol the linker places, main is
+// an ordinary function, and the tape size and the I/O are options rather
+// than fixed by the chip: USART0, as on an Arduino, or bf_getc and bf_putc
+// functions of your own, for any other wiring.
+package avrasm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lcox74/bfcc/internal/codegen/avr"
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// IO is how a program reads and writes its bytes.
+type IO int
+
+const (
+	UART   IO = iota // polling USART0, set up by main
+	Extern           // calling bf_getc and bf_putc, linked in from elsewhere
+)
+
+// ioNames maps each IO to its -io flag spelling.
+var ioNames = [...]string{UART: "uart", Extern: "extern"}
+
+// String returns the name of io, as for ParseIO.
+func (io IO) String() string {
+	return ioNames[io]
+}
+
+// ParseIO returns the IO named s, uart or extern.
+func ParseIO(s string) (IO, error) {
+	for io, name := range ioNames {
+		if name == s {
+			return IO(io), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown I/O: %s (must be uart or extern)", s)
+}
+
+// USART0 registers, as data memory addresses, and their bits. They are
+// the same on every ATmega the avr package supports.
+const (
+	regUCSR0A = 0xC0 // status
+	regUCSR0B = 0xC1 // control: enables the receiver and transmitter
+	regUCSR0C = 0xC2 // control: the frame format
+	regUBRR0L = 0xC4 // baud rate, low byte
+	regUBRR0H = 0xC5 // baud rate, high byte
+	regUDR0   = 0xC6 // data
+
+	bitRXC0  = 7    // UCSR0A: a byte has been received
+	bitUDRE0 = 5    // UCSR0A: the data register is empty
+	rxTxEn   = 0x18 // UCSR0B: RXEN0 and TXEN0
+	frame8N1 = 0x06 // UCSR0C: 8 data bits, no parity, one stop bit
+)
+
+// Failure messages.
+const (
+	trapMsg        = "bfcc: cell overflow\n"
+	unreachableMsg = "bfcc: reached unreachable code\n"
+)
+
+// Generator produces AVR assembly from IR operations.
+type Generator struct {
+	ops      []core.Op
+	out      strings.Builder
+	mcu      *avr.MCU
+	tapeSize int // cells on the tape, or 0 for the MCU's TapeSize
+	io       IO
+	baud     int
+	cells    core.CellModel
+	midTape  bool // start the data pointer in the middle of the tape
+	progress func(done, total int)
+
+	trap, unreachable bool // the code jumps to _bf_trap or _bf_unreachable
+}
+
+// Option is a functional option for configuring a Generator.
+type Option func(*Generator)
+
+// WithMCU sets the microcontroller the program is for (default the
+// atmega328p), which sets the default tape size and the clock the baud
+// rate is worked out from.
+func WithMCU(mcu *avr.MCU) Option {
+	return func(g *Generator) {
+		g.mcu = mcu
+	}
+}
+
+// WithTapeSize sets the number of cells on the tape (default the MCU's
+// TapeSize, all of its SRAM but a little stack). Leave room for the
+// stack and data of bf_getc and bf_putc with Extern I/O.
+func WithTapeSize(n int) Option {
+	return func(g *Generator) {
+		g.tapeSize = n
+	}
+}
+
+// WithIO sets how the program does its I/O (default UART).
+func WithIO(io IO) Option {
+	return func(g *Generator) {
+		g.io = io
+	}
+}
+
+// WithBaud sets the speed of USART0 with UART I/O (default avr.Baud).
+func WithBaud(baud int) Option {
+	return func(g *Generator) {
+		g.baud = baud
+	}
+}
+
+// WithCellOverflow sets the cell overflow policy (default core.OverflowWrap).
+func WithCellOverflow(overflow core.CellOverflow) Option {
+	return func(g *Generator) {
+		g.cells.Overflow = overflow
+	}
+}
+
+// WithSignedCells treats cells as signed bytes: overflow checks use the
+// overflow flag rather than carry, and with Extern I/O the end of input
+// stores -1.
+func WithSignedCells() Option {
+	return func(g *Generator) {
+		g.cells.Signed = true
+	}
+}
+
+// WithMidTape starts the data pointer in the middle of the tape rather than
+// at cell 0, for programs written for doubly-infinite tapes.
+func WithMidTape() Option {
+	return func(g *Generator) {
+		g.midTape = true
+	}
+}
+
+// WithProgress calls report with the number of ops emitted so far, every
+// ProgressEvery ops and once all of them are done.
+func WithProgress(report func(done, total int)) Option {
+	return func(g *Generator) {
+		g.progress = report
+	}
+}
+
+// ProgressEvery is how many ops are emitted between progress reports.
+const ProgressEvery = 1 << 14
+
+// NewGenerator creates a new AVR assembly generator.
+func NewGenerator(ops []core.Op, opts ...Option) *Generator {
+	g := &Generator{ops: ops, mcu: avr.MCUs["atmega328p"], baud: avr.Baud}
+	for _, opt := range opts {
+		opt(g)
+	}
+	if g.tapeSize == 0 {
+		g.tapeSize = g.mcu.TapeSize()
+	}
+	return g
+}
+
+// UBRR returns the baud rate register value for baud on mcu, rounded to
+// the nearest, and whether it fits the register's 12 bits.
+func UBRR(mcu *avr.MCU, baud int) (int, bool) {
+	if baud <= 0 {
+		return 0, false
+	}
+	ubrr := (mcu.Clock+8*baud)/(16*baud) - 1
+	return ubrr, ubrr >= 0 && ubrr < 1<<12
+}
+
+// Generate produces the complete assembly output: main, its helpers and
+// the tape, in the sections avr-gcc's linker scripts expect.
+func (g *Generator) Generate() string {
+	g.emitHeader()
+	g.emitPrologue()
+
+	for i, op := range g.ops {
+		g.emitOp(op)
+		if g.progress != nil && (i+1)%ProgressEvery == 0 {
+			g.progress(i+1, len(g.ops))
+		}
+	}
+	if g.progress != nil {
+		g.progress(len(g.ops), len(g.ops))
+	}
+	g.emitExit()
+	g.emitHelpers()
+	g.emitTape()
+	return g.out.String()
+}
+
+// emitHeader outputs how to build the program and, with UART I/O, the
+// USART0 registers.
+func (g *Generator) emitHeader() {
+	fmt.Fprintf(&g.out, "; Generated by bfcc: an AVR program for the %s. Build it with\n", g.mcu.Name)
+	fmt.Fprintf(&g.out, "; avr-gcc, whose startup code sets up the stack and calls main, as\n")
+	fmt.Fprintf(&g.out, "; an Intel HEX file to flash with avrdude:\n")
+	fmt.Fprintf(&g.out, ";\n")
+	if g.io == Extern {
+		fmt.Fprintf(&g.out, ";   avr-gcc -mmcu=%s -o program.elf program.s io.c\n", g.mcu.Name)
+	} else {
+		fmt.Fprintf(&g.out, ";   avr-gcc -mmcu=%s -o program.elf program.s\n", g.mcu.Name)
+	}
+	fmt.Fprintf(&g.out, ";   avr-objcopy -O ihex program.elf program.hex\n")
+	if g.io == Extern {
+		fmt.Fprintf(&g.out, ";\n")
+		fmt.Fprintf(&g.out, "; where io.c defines the I/O, with avr-gcc's calling convention:\n")
+		fmt.Fprintf(&g.out, ";\n")
+		fmt.Fprintf(&g.out, ";   int bf_getc(void);  // the next byte, or a negative number at the end of input\n")
+		fmt.Fprintf(&g.out, ";   void bf_putc(char c);\n")
+	}
+
+	if g.io == UART {
+		ubrr, _ := UBRR(g.mcu, g.baud)
+		fmt.Fprintf(&g.out, "\n; USART0, at %d baud from a %d MHz clock, 8N1\n", g.baud, g.mcu.Clock/1_000_000)
+		fmt.Fprintf(&g.out, "UCSR0A = 0x%02X\n", regUCSR0A)
+		fmt.Fprintf(&g.out, "UCSR0B = 0x%02X\n", regUCSR0B)
+		fmt.Fprintf(&g.out, "UCSR0C = 0x%02X\n", regUCSR0C)
+		fmt.Fprintf(&g.out, "UBRR0L = 0x%02X\n", regUBRR0L)
+		fmt.Fprintf(&g.out, "UBRR0H = 0x%02X\n", regUBRR0H)
+		fmt.Fprintf(&g.out, "UDR0 = 0x%02X\n", regUDR0)
+		fmt.Fprintf(&g.out, "RXC0 = %d\n", bitRXC0)
+		fmt.Fprintf(&g.out, "UDRE0 = %d\n", bitUDRE0)
+		fmt.Fprintf(&g.out, "UBRR = %d\n", ubrr)
+	}
+	fmt.Fprintf(&g.out, "\n")
+}
+
+// emitPrologue outputs the start of main, which sets up USART0 with UART
+// I/O, clears the tape and points the data pointer at the first cell.
+// R1 is 0 and the stack is set up by the startup code, but main clears R1
+// anyway.
+func (g *Generator) emitPrologue() {
+	fmt.Fprintf(&g.out, "    .section .text\n")
+	fmt.Fprintf(&g.out, "    .global main\n")
+	fmt.Fprintf(&g.out, "    .type main, @function\n")
+	fmt.Fprintf(&g.out, "main:\n")
+	fmt.Fprintf(&g.out, "    clr r1\n")
+	if g.io == UART {
+		fmt.Fprintf(&g.out, "    ldi r24, hi8(UBRR)\n")
+		fmt.Fprintf(&g.out, "    sts UBRR0H, r24\n")
+		fmt.Fprintf(&g.out, "    ldi r24, lo8(UBRR)\n")
+		fmt.Fprintf(&g.out, "    sts UBRR0L, r24\n")
+		fmt.Fprintf(&g.out, "    ldi r24, 0x%02X ; enable the receiver and transmitter\n", rxTxEn)
+		fmt.Fprintf(&g.out, "    sts UCSR0B, r24\n")
+		fmt.Fprintf(&g.out, "    ldi r24, 0x%02X ; 8N1\n", frame8N1)
+		fmt.Fprintf(&g.out, "    sts UCSR0C, r24\n")
+	}
+	fmt.Fprintf(&g.out, "    call _bf_clear\n")
+	g.emitStartPointer()
+}
+
+// emitStartPointer points the data pointer at the first cell: the start,
+// or the middle of the tape with WithMidTape.
+func (g *Generator) emitStartPointer() {
+	if g.midTape {
+		g.emitSetPointer(fmt.Sprintf("bf_tape+%d", g.tapeSize/2))
+		return
+	}
+	g.emitSetPointer("bf_tape")
+}
+
+// emitSetPointer points the data pointer at addr.
+func (g *Generator) emitSetPointer(addr string) {
+	fmt.Fprintf(&g.out, "    ldi r26, lo8(%s)\n", addr)
+	fmt.Fprintf(&g.out, "    ldi r27, hi8(%s)\n", addr)
+}
+
+// emitExit outputs _bf_exit, which returns 0 from main to avr-libc's exit,
+// which stops with interrupts off.
+func (g *Generator) emitExit() {
+	fmt.Fprintf(&g.out, "\n_bf_exit:\n")
+	fmt.Fprintf(&g.out, "    ldi r24, 0\n")
+	fmt.Fprintf(&g.out, "    ldi r25, 0\n")
+	fmt.Fprintf(&g.out, "    ret\n")
+	fmt.Fprintf(&g.out, "    .size main, .-main\n")
+}
+
+// emitHelpers outputs the I/O and tape clearing helpers, and the failure
+// helpers and their messages when the code uses them.
+func (g *Generator) emitHelpers() {
+	fmt.Fprintf(&g.out, "\n; _bf_read reads a byte into the current cell, and _bf_putc sends R24,\n")
+	fmt.Fprintf(&g.out, "; both keeping X\n")
+	switch g.io {
+	case UART:
+		fmt.Fprintf(&g.out, "_bf_read:\n")
+		fmt.Fprintf(&g.out, "    lds r24, UCSR0A\n")
+		fmt.Fprintf(&g.out, "    sbrs r24, RXC0\n")
+		fmt.Fprintf(&g.out, "    rjmp _bf_read\n")
+		fmt.Fprintf(&g.out, "    lds r24, UDR0\n")
+		fmt.Fprintf(&g.out, "    st X, r24\n")
+		fmt.Fprintf(&g.out, "    ret\n")
+
+		fmt.Fprintf(&g.out, "\n_bf_write:\n")
+		fmt.Fprintf(&g.out, "    ld r24, X\n")
+		fmt.Fprintf(&g.out, "_bf_putc:\n")
+		fmt.Fprintf(&g.out, "    lds r25, UCSR0A\n")
+		fmt.Fprintf(&g.out, "    sbrs r25, UDRE0\n")
+		fmt.Fprintf(&g.out, "    rjmp _bf_putc\n")
+		fmt.Fprintf(&g.out, "    sts UDR0, r24\n")
+		fmt.Fprintf(&g.out, "    ret\n")
+	case Extern:
+		// bf_getc and bf_putc may change X and Z, and return with R1 0
+		fmt.Fprintf(&g.out, "_bf_read:\n")
+		fmt.Fprintf(&g.out, "    push r26\n")
+		fmt.Fprintf(&g.out, "    push r27\n")
+		fmt.Fprintf(&g.out, "    call bf_getc\n")
+		fmt.Fprintf(&g.out, "    pop r27\n")
+		fmt.Fprintf(&g.out, "    pop r26\n")
+		fmt.Fprintf(&g.out, "    sbrc r25, 7 ; skip unless the end of input\n")
+		fmt.Fprintf(&g.out, "    ldi r24, %d\n", g.cells.EOF())
+		fmt.Fprintf(&g.out, "    st X, r24\n")
+		fmt.Fprintf(&g.out, "    ret\n")
+
+		fmt.Fprintf(&g.out, "\n_bf_write:\n")
+		fmt.Fprintf(&g.out, "    ld r24, X\n")
+		fmt.Fprintf(&g.out, "_bf_putc:\n")
+		fmt.Fprintf(&g.out, "    push r26\n")
+		fmt.Fprintf(&g.out, "    push r27\n")
+		fmt.Fprintf(&g.out, "    push r30\n")
+		fmt.Fprintf(&g.out, "    push r31\n")
+		fmt.Fprintf(&g.out, "    call bf_putc\n")
+		fmt.Fprintf(&g.out, "    pop r31\n")
+		fmt.Fprintf(&g.out, "    pop r30\n")
+		fmt.Fprintf(&g.out, "    pop r27\n")
+		fmt.Fprintf(&g.out, "    pop r26\n")
+		fmt.Fprintf(&g.out, "    ret\n")
+	}
+
+	fmt.Fprintf(&g.out, "\n_bf_clear:\n")
+	g.emitSetPointer("bf_tape")
+	g.emitZeroRange(g.tapeSize)
+	fmt.Fprintf(&g.out, "    ret\n")
+
+	if g.trap || g.unreachable {
+		g.emitFailHelpers()
+	}
+}
+
+// emitFailHelpers outputs _bf_trap and _bf_unreachable, which send their
+// message with _bf_putc and exit, and the messages, in flash where avr-gcc
+// puts PROGMEM data, low enough for LPM to reach.
+func (g *Generator) emitFailHelpers() {
+	fmt.Fprintf(&g.out, "\n_bf_trap:\n")
+	fmt.Fprintf(&g.out, "    ldi r30, lo8(_bf_trap_msg)\n")
+	fmt.Fprintf(&g.out, "    ldi r31, hi8(_bf_trap_msg)\n")
+	fmt.Fprintf(&g.out, "    rjmp _bf_fail\n")
+	fmt.Fprintf(&g.out, "_bf_unreachable:\n")
+	fmt.Fprintf(&g.out, "    ldi r30, lo8(_bf_unreachable_msg)\n")
+	fmt.Fprintf(&g.out, "    ldi r31, hi8(_bf_unreachable_msg)\n")
+	fmt.Fprintf(&g.out, "_bf_fail:\n")
+	fmt.Fprintf(&g.out, "    lpm r24, Z+\n")
+	fmt.Fprintf(&g.out, "    tst r24\n")
+	fmt.Fprintf(&g.out, "    breq 1f\n")
+	fmt.Fprintf(&g.out, "    call _bf_putc\n")
+	fmt.Fprintf(&g.out, "    rjmp _bf_fail\n")
+	fmt.Fprintf(&g.out, "1:\n")
+	fmt.Fprintf(&g.out, "    jmp _bf_exit\n")
+
+	fmt.Fprintf(&g.out, "\n    .section .progmem.data, \"a\", @progbits\n")
+	fmt.Fprintf(&g.out, "_bf_trap_msg:\n")
+	fmt.Fprintf(&g.out, "    .asciz %s\n", strconv.Quote(trapMsg))
+	fmt.Fprintf(&g.out, "_bf_unreachable_msg:\n")
+	fmt.Fprintf(&g.out, "    .asciz %s\n", strconv.Quote(unreachableMsg))
+}
+
+// emitTape outputs the tape, a global symbol in .bss for the linker to
+// place.
+func (g *Generator) emitTape() {
+	fmt.Fprintf(&g.out, "\n    .section .bss\n")
+	fmt.Fprintf(&g.out, "    .global bf_tape\n")
+	fmt.Fprintf(&g.out, "    .type bf_tape, @object\n")
+	fmt.Fprintf(&g.out, "    .size bf_tape, %d\n", g.tapeSize)
+	fmt.Fprintf(&g.out, "bf_tape:\n")
+	fmt.Fprintf(&g.out, "    .skip %d\n", g.tapeSize)
+}
+
+// emitOp outputs assembly for a single IR operation.
+func (g *Generator) emitOp(op core.Op) {
+	switch op.Kind {
+	case core.OpShift:
+		g.emitShift(op.Arg)
+	case core.OpAdd:
+		g.emitAdd(op.Arg)
+	case core.OpZero:
+		fmt.Fprintf(&g.out, "    st X, r1\n")
+	case core.OpIn:
+		fmt.Fprintf(&g.out, "    call _bf_read\n")
+	case core.OpOut:
+		fmt.Fprintf(&g.out, "    call _bf_write\n")
+	case core.OpJz:
+		fmt.Fprintf(&g.out, "    ld r24, X\n")
+		fmt.Fprintf(&g.out, "    tst r24\n")
+		fmt.Fprintf(&g.out, "    brne loop%d\n", op.Arg)
+		fmt.Fprintf(&g.out, "    jmp loop%d_end\n", op.Arg)
+		fmt.Fprintf(&g.out, "loop%d:\n", op.Arg)
+	case core.OpJnz:
+		fmt.Fprintf(&g.out, "    ld r24, X\n")
+		fmt.Fprintf(&g.out, "    tst r24\n")
+		fmt.Fprintf(&g.out, "    breq loop%d_end\n", op.Arg)
+		fmt.Fprintf(&g.out, "    jmp loop%d\n", op.Arg)
+		fmt.Fprintf(&g.out, "loop%d_end:\n", op.Arg)
+	case core.OpSection:
+		if core.Handoff(op.Arg) == core.HandoffReset {
+			fmt.Fprintf(&g.out, "    call _bf_clear\n")
+		}
+		g.emitStartPointer()
+	case core.OpTrap:
+		g.unreachable = true
+		fmt.Fprintf(&g.out, "    jmp _bf_unreachable\n")
+	case core.OpZeroRange:
+		g.emitZeroRange(op.Arg)
+	case core.OpCopyRange:
+		g.emitCopyRange(op.Arg, op.Off)
+	}
+}
+
+// emitShift moves the data pointer by k cells: an ADIW or SBIW when
+// |k| < 64, otherwise a 16-bit subtract.
+func (g *Generator) emitShift(k int) {
+	switch {
+	case k == 0:
+	case k > 0 && k < 64:
+		fmt.Fprintf(&g.out, "    adiw r26, %d\n", k)
+	case k < 0 && k > -64:
+		fmt.Fprintf(&g.out, "    sbiw r26, %d\n", -k)
+	default:
+		g.emitSubPointer(-k)
+	}
+}
+
+// emitSubPointer subtracts n from the data pointer.
+func (g *Generator) emitSubPointer(n int) {
+	fmt.Fprintf(&g.out, "    subi r26, 0x%02X\n", byte(n))
+	fmt.Fprintf(&g.out, "    sbci r27, 0x%02X\n", byte(n>>8))
+}
+
+// emitAdd adds k to the current cell in R24. Under the saturate and trap
+// policies it checks the carry (or overflow, for signed cells) after each
+// add, as for the other backends.
+func (g *Generator) emitAdd(k int) {
+	if k == 0 {
+		return
+	}
+
+	if g.cells.AlwaysOverflows(k) {
+		if g.cells.Overflow == core.OverflowTrap {
+			g.trap = true
+			fmt.Fprintf(&g.out, "    jmp _bf_trap\n")
+			return
+		}
+		fmt.Fprintf(&g.out, "    ldi r24, 0x%02X\n", byte(g.clamp(k)))
+		fmt.Fprintf(&g.out, "    st X, r24\n")
+		return
+	}
+
+	fmt.Fprintf(&g.out, "    ld r24, X\n")
+	switch {
+	case g.cells.Overflow == core.OverflowWrap:
+		fmt.Fprintf(&g.out, "    subi r24, 0x%02X\n", byte(-k))
+	case g.cells.Signed:
+		// V is only meaningful for an addend in [-128, 127]
+		for k != 0 {
+			step := max(-128, min(127, k))
+			fmt.Fprintf(&g.out, "    ldi r25, 0x%02X\n", byte(step))
+			fmt.Fprintf(&g.out, "    add r24, r25\n")
+			g.emitChecked("brvc", step)
+			k -= step
+		}
+	case k > 0:
+		fmt.Fprintf(&g.out, "    ldi r25, 0x%02X\n", byte(k))
+		fmt.Fprintf(&g.out, "    add r24, r25\n")
+		g.emitChecked("brcc", k)
+	default:
+		// SUBI sets C on a borrow
+		fmt.Fprintf(&g.out, "    subi r24, 0x%02X\n", byte(-k))
+		g.emitChecked("brcc", k)
+	}
+	fmt.Fprintf(&g.out, "    st X, r24\n")
+}
+
+// emitChecked outputs the saturate clamp or trap jump after an add of k,
+// skipped by the branch ok when it did not overflow.
+func (g *Generator) emitChecked(ok string, k int) {
+	fmt.Fprintf(&g.out, "    %s 1f\n", ok)
+	if g.cells.Overflow == core.OverflowSaturate {
+		fmt.Fprintf(&g.out, "    ldi r24, 0x%02X\n", byte(g.clamp(k)))
+	} else {
+		g.trap = true
+		fmt.Fprintf(&g.out, "    jmp _bf_trap\n")
+	}
+	fmt.Fprintf(&g.out, "1:\n")
+}
+
+// clamp returns the value an add of k saturates to.
+func (g *Generator) clamp(k int) int {
+	if k > 0 {
+		return g.cells.Max()
+	}
+	return g.cells.Min()
+}
+
+// emitCounter loads the 16-bit loop counter R25:R24 with n.
+func (g *Generator) emitCounter(n int) {
+	fmt.Fprintf(&g.out, "    ldi r24, lo8(%d)\n", n)
+	fmt.Fprintf(&g.out, "    ldi r25, hi8(%d)\n", n)
+}
+
+// emitZeroRange clears n cells from the data pointer, counting them down
+// in R25:R24 as X moves on, then moves X back.
+func (g *Generator) emitZeroRange(n int) {
+	g.emitCounter(n)
+	fmt.Fprintf(&g.out, "1:\n")
+	fmt.Fprintf(&g.out, "    st X+, r1\n")
+	fmt.Fprintf(&g.out, "    sbiw r24, 1\n")
+	fmt.Fprintf(&g.out, "    brne 1b\n")
+	g.emitSubPointer(n)
+}
+
+// emitCopyRange copies n cells from the data pointer to d cells away,
+// through Z, as emitZeroRange clears them. The optimiser only emits
+// non-overlapping ranges.
+func (g *Generator) emitCopyRange(n, d int) {
+	fmt.Fprintf(&g.out, "    movw r30, r26\n")
+	fmt.Fprintf(&g.out, "    subi r30, 0x%02X\n", byte(-d))
+	fmt.Fprintf(&g.out, "    sbci r31, 0x%02X\n", byte(-d>>8))
+	g.emitCounter(n)
+	fmt.Fprintf(&g.out, "1:\n")
+	fmt.Fprintf(&g.out, "    ld r0, X+\n")
+	fmt.Fprintf(&g.out, "    st Z+, r0\n")
+	fmt.Fprintf(&g.out, "    sbiw r24, 1\n")
+	fmt.Fprintf(&g.out, "    brne 1b\n")
+	g.emitSubPointer(n)
+}
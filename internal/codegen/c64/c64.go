@@ -0,0 +1,544 @@
+// Package c64 produces Commodore 64 programs from IR operations: 6502
+// machine code in a PRG file, loaded with LOAD "NAME",8 and started with
+// RUN, as a demo of how little the IR asks of a machine.
+//
+// The PRG starts with a one-line BASIC program, 10 SYS 2061, which calls
+// the code straight after it. The code banks out the BASIC ROM for the RAM
+// under it, so the tape fits between the code and the I/O area at $D000,
+// and banks it back in before returning to BASIC. I/O goes through the
+// KERNAL's CHRIN and CHROUT, converting between ASCII and PETSCII with the
+// screen switched to its lower case character set, so text programs look
+// right. Input comes a line at a time from the screen editor, and never
+// ends.
+package c64
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"github.com/lcox74/bfcc/internal/codegen/linux"
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/pkg/mos6502"
+)
+
+// Memory layout.
+const (
+	LoadAddr = 0x0801                 // start of BASIC program text, where the PRG loads
+	CodeBase = 0x080D                 // just past the SYS stub
+	IOBase   = 0xD000                 // the I/O area, kept banked in for the KERNAL
+	TapeBase = IOBase - core.TapeSize // the tape, ending at the I/O area
+	MaxCode  = TapeBase - CodeBase    // the most code there is room for
+)
+
+// KERNAL routines.
+const (
+	kernalCHRIN  = 0xFFCF // read a byte from the screen editor into A
+	kernalCHROUT = 0xFFD2 // print the byte in A, preserving X and Y
+)
+
+// Zero page locations. $FB to $FE are left free for user programs.
+const (
+	zpPort = 0x01 // the 6510's I/O port, selecting the ROMs
+	zpPtr  = 0xFB // the data pointer, low byte first
+	zpDest = 0xFD // the destination pointer of COPY_RANGE
+)
+
+// Values of the I/O port.
+const (
+	portNoBASIC = 0x36 // RAM at $A000, with the KERNAL and I/O
+	portDefault = 0x37 // BASIC, KERNAL and I/O
+)
+
+// petsciiLower switches the screen to the lower and upper case character
+// set when printed.
+const petsciiLower = 0x0E
+
+// Special fixup targets for the helpers after the code.
+const (
+	fixupRead        = -1 // _bf_read
+	fixupWrite       = -2 // _bf_write
+	fixupTrap        = -3 // _bf_trap, for a cell overflow
+	fixupUnreachable = -4 // _bf_unreachable, for a TRAP
+	fixupExit        = -5 // _bf_exit
+	fixupClear       = -6 // _bf_clear
+	fixupMessages    = -7 // the failure messages
+)
+
+// Failure messages, NUL terminated.
+const (
+	trapMsg        = "bfcc: cell overflow\n\x00"
+	unreachableMsg = "bfcc: reached unreachable code\n\x00"
+)
+
+// Costs is the size in bytes of the code for each op, for the optimiser,
+// with the wrapping cell model. SHIFTs past 255 cells carry into the high
+// byte with a second add.
+var Costs = core.CostModel{Name: "6502", Shift: 11, FarShift: 13, NearShift: 255, Add: 7, Zero: 3, IO: 3, Jump: 7, Range: 16}
+
+// fixup records the absolute address operand of a jump, call or load, to
+// patch once its target is known.
+type fixup struct {
+	at      int // code offset of the operand
+	target  int // loop label, or a special target
+	loopEnd bool
+}
+
+// span is a range of letters emitTranslate converts.
+type span struct {
+	from, end byte // the first letter, and the byte after the last
+	conv      []byte
+}
+
+// Generator produces 6502 machine code from IR operations. It takes the
+// linux package's Options, but only supports the cell model, mid-tape,
+// debug and progress ones.
+//
+// The data pointer is the address of the current cell, in zero page at
+// $FB, and cells are accessed as ($FB),Y with Y kept at 0. Nothing checks
+// that the data pointer stays on the tape.
+type Generator struct {
+	ops      []core.Op
+	code     []byte
+	opts     linux.Settings
+	loopBody map[int]int // loop label -> code offset just past its JZ
+	loopEnd  map[int]int // loop label -> code offset just past its JNZ
+	helpers  map[int]int // special fixup target -> code offset
+	fixups   []fixup
+}
+
+// NewGenerator creates a new 6502 generator.
+func NewGenerator(ops []core.Op, opts ...linux.Option) *Generator {
+	return &Generator{
+		ops:      ops,
+		code:     make([]byte, 0, 4096),
+		opts:     linux.ApplyOptions(opts...),
+		loopBody: make(map[int]int),
+		loopEnd:  make(map[int]int),
+		helpers:  make(map[int]int),
+	}
+}
+
+// Generate produces raw 6502 machine code, to load at CodeBase. It fails
+// if the code leaves no room for the tape.
+func (g *Generator) Generate() ([]byte, error) {
+	g.emitPrologue()
+
+	for i, op := range g.ops {
+		g.emitOp(op)
+		switch op.Kind {
+		case core.OpJz:
+			g.loopBody[op.Arg] = len(g.code)
+		case core.OpJnz:
+			g.loopEnd[op.Arg] = len(g.code)
+		}
+		if progress := g.opts.Progress; progress != nil && (i+1)%linux.ProgressEvery == 0 {
+			progress(i+1, len(g.ops))
+		}
+	}
+	if g.opts.Progress != nil {
+		g.opts.Progress(len(g.ops), len(g.ops))
+	}
+
+	g.emitExit()
+	g.emitHelpers()
+	g.resolveFixups()
+
+	if len(g.code) > MaxCode {
+		return nil, fmt.Errorf("program too large for the C64: %d bytes of code, with room for %d", len(g.code), MaxCode)
+	}
+	return g.code, nil
+}
+
+// GeneratePRG produces a PRG file: the load address, the BASIC stub
+// calling the code, and the code.
+func (g *Generator) GeneratePRG() ([]byte, error) {
+	code, err := g.Generate()
+	if err != nil {
+		return nil, err
+	}
+
+	// 10 SYS 2061: the link to the next line, the line number, the SYS
+	// token and its argument, and the NUL ending the line, then a NUL link
+	// ending the program
+	line := append([]byte{0x0A, 0x00, 0x9E}, strconv.Itoa(CodeBase)...)
+	line = append(line, 0x00)
+	prg := binary.LittleEndian.AppendUint16(nil, LoadAddr)
+	prg = binary.LittleEndian.AppendUint16(prg, uint16(LoadAddr+2+len(line)))
+	prg = append(prg, line...)
+	prg = append(prg, 0x00, 0x00)
+	return append(prg, code...), nil
+}
+
+// emit appends instructions to the code buffer.
+func (g *Generator) emit(insns ...[]byte) {
+	for _, b := range insns {
+		g.code = append(g.code, b...)
+	}
+}
+
+// emitAbs emits a jump, call or load whose absolute address is patched by
+// resolveFixups to target.
+func (g *Generator) emitAbs(b []byte, target int, loopEnd bool) {
+	g.emit(b)
+	g.fixups = append(g.fixups, fixup{at: len(g.code) - 2, target: target, loopEnd: loopEnd})
+}
+
+// emitBranch emits a conditional branch to patch with patchBranch,
+// returning its offset.
+func (g *Generator) emitBranch(c mos6502.Cond) int {
+	at := len(g.code)
+	g.emit(mos6502.Branch(c, 0))
+	return at
+}
+
+// patchBranch points the branch at offset at to the end of the code.
+func (g *Generator) patchBranch(at int) {
+	g.code[at+1] = byte(int8(len(g.code) - (at + mos6502.BranchSize)))
+}
+
+// emitBranchBack emits a conditional branch back to the code offset to.
+func (g *Generator) emitBranchBack(c mos6502.Cond, to int) {
+	g.emit(mos6502.Branch(c, int8(to-(len(g.code)+mos6502.BranchSize))))
+}
+
+// emitPrologue banks out BASIC, switches to the lower case character set,
+// clears the tape and points the data pointer at the first cell.
+func (g *Generator) emitPrologue() {
+	g.emit(
+		mos6502.Cld(),
+		mos6502.LdaImm(portNoBASIC),
+		mos6502.StaZP(zpPort),
+		mos6502.LdaImm(petsciiLower),
+		mos6502.Jsr(kernalCHROUT),
+		mos6502.LdyImm(0),
+	)
+	g.emitAbs(mos6502.Jsr(0), fixupClear, false) // jsr _bf_clear
+	g.emitStartPointer()
+}
+
+// emitStartPointer points the data pointer at the first cell: the start,
+// or the middle of the tape with WithMidTape.
+func (g *Generator) emitStartPointer() {
+	start := TapeBase
+	if g.opts.MidTape {
+		start += core.TapeSize / 2
+	}
+	g.emitSetPointer(start)
+}
+
+// emitSetPointer points the data pointer at addr.
+func (g *Generator) emitSetPointer(addr int) {
+	g.emit(
+		mos6502.LdaImm(byte(addr)),
+		mos6502.StaZP(zpPtr),
+		mos6502.LdaImm(byte(addr>>8)),
+		mos6502.StaZP(zpPtr+1),
+	)
+}
+
+// emitExit outputs _bf_exit, which banks BASIC back in and returns to it.
+func (g *Generator) emitExit() {
+	g.helpers[fixupExit] = len(g.code)
+	g.emit(
+		mos6502.LdaImm(portDefault),
+		mos6502.StaZP(zpPort),
+		mos6502.Rts(),
+	)
+}
+
+// emitHelpers outputs the I/O and tape clearing helpers, and the failure
+// helpers and their messages when the code uses them.
+func (g *Generator) emitHelpers() {
+	// _bf_read: read a byte, as ASCII, into the current cell
+	g.helpers[fixupRead] = len(g.code)
+	g.emit(mos6502.Jsr(kernalCHRIN))
+	g.emitTranslate(0x0D, 0x0A,
+		span{0x41, 0x5B, mos6502.OraImm(0x20)}, // a-z
+		span{0xC1, 0xDB, mos6502.AndImm(0x7F)}, // A-Z
+	)
+	g.emit(
+		mos6502.LdyImm(0),
+		mos6502.StaIndY(zpPtr),
+		mos6502.Rts(),
+	)
+
+	// _bf_write: print the current cell, as PETSCII. _bf_putc prints A,
+	// preserving X, for the failure helpers
+	g.helpers[fixupWrite] = len(g.code)
+	g.emit(mos6502.LdaIndY(zpPtr))
+	putc := len(g.code)
+	g.emitTranslate(0x0A, 0x0D,
+		span{0x41, 0x5B, mos6502.OraImm(0x80)}, // A-Z
+		span{0x61, 0x7B, mos6502.AndImm(0xDF)}, // a-z
+	)
+	g.emit(
+		mos6502.Jsr(kernalCHROUT),
+		mos6502.LdyImm(0),
+		mos6502.Rts(),
+	)
+
+	// _bf_clear: zero the tape
+	g.helpers[fixupClear] = len(g.code)
+	g.emitSetPointer(TapeBase)
+	g.emitZeroRange(core.TapeSize)
+	g.emit(mos6502.Rts())
+
+	if g.uses(fixupTrap) || g.uses(fixupUnreachable) {
+		g.emitFailHelpers(putc)
+	}
+}
+
+// emitTranslate converts the byte in A between ASCII and PETSCII, which
+// differ in their newline and letters: newline becomes newlineTo, and the
+// letters from each span's from to just below its end are converted by
+// its conv instruction.
+func (g *Generator) emitTranslate(newline, newlineTo byte, first, second span) {
+	var done []int
+
+	g.emit(mos6502.CmpImm(newline))
+	notNewline := g.emitBranch(mos6502.BNE)
+	g.emit(mos6502.LdaImm(newlineTo))
+	done = append(done, g.emitBranch(mos6502.BNE)) // always taken
+	g.patchBranch(notNewline)
+
+	g.emit(mos6502.CmpImm(first.from))
+	done = append(done, g.emitBranch(mos6502.BCC))
+	g.emit(mos6502.CmpImm(first.end))
+	notFirst := g.emitBranch(mos6502.BCS)
+	g.emit(first.conv)
+	done = append(done, g.emitBranch(mos6502.BNE)) // always taken
+	g.patchBranch(notFirst)
+
+	g.emit(mos6502.CmpImm(second.from))
+	done = append(done, g.emitBranch(mos6502.BCC))
+	g.emit(mos6502.CmpImm(second.end))
+	done = append(done, g.emitBranch(mos6502.BCS))
+	g.emit(second.conv)
+
+	for _, at := range done {
+		g.patchBranch(at)
+	}
+}
+
+// emitFailHelpers outputs _bf_trap and _bf_unreachable, which print their
+// message with putc and exit, followed by the messages.
+func (g *Generator) emitFailHelpers(putc int) {
+	g.helpers[fixupTrap] = len(g.code)
+	g.emit(mos6502.LdxImm(0))
+	toPrint := g.emitBranch(mos6502.BEQ) // always taken
+
+	g.helpers[fixupUnreachable] = len(g.code)
+	g.emit(mos6502.LdxImm(byte(len(trapMsg))))
+	g.patchBranch(toPrint)
+
+	loop := len(g.code)
+	g.emitAbs(mos6502.LdaAbsX(0), fixupMessages, false) // lda messages,x
+	notEnd := g.emitBranch(mos6502.BNE)
+	g.emitAbs(mos6502.Jmp(0), fixupExit, false) // jmp _bf_exit
+	g.patchBranch(notEnd)
+	g.emit(mos6502.Jsr(uint16(CodeBase + putc)))
+	g.emit(mos6502.Inx())
+	g.emitBranchBack(mos6502.BNE, loop) // always taken
+
+	g.helpers[fixupMessages] = len(g.code)
+	g.emit([]byte(trapMsg), []byte(unreachableMsg))
+}
+
+// uses reports whether any fixup targets target.
+func (g *Generator) uses(target int) bool {
+	for _, f := range g.fixups {
+		if f.target == target {
+			return true
+		}
+	}
+	return false
+}
+
+// emitOp outputs machine code for a single IR operation.
+func (g *Generator) emitOp(op core.Op) {
+	switch op.Kind {
+	case core.OpShift:
+		g.emitShift(op.Arg)
+	case core.OpAdd:
+		g.emitAdd(op.Arg)
+	case core.OpZero:
+		g.emit(mos6502.Tya(), mos6502.StaIndY(zpPtr)) // Y is 0
+	case core.OpIn:
+		g.emitAbs(mos6502.Jsr(0), fixupRead, false) // jsr _bf_read
+	case core.OpOut:
+		g.emitAbs(mos6502.Jsr(0), fixupWrite, false) // jsr _bf_write
+	case core.OpJz:
+		// lda (ptr),y; bne +3; jmp past the loop's JNZ
+		g.emit(mos6502.LdaIndY(zpPtr), mos6502.Branch(mos6502.BNE, 3))
+		g.emitAbs(mos6502.Jmp(0), op.Arg, true)
+	case core.OpJnz:
+		// lda (ptr),y; beq +3; jmp to the loop body
+		g.emit(mos6502.LdaIndY(zpPtr), mos6502.Branch(mos6502.BEQ, 3))
+		g.emitAbs(mos6502.Jmp(0), op.Arg, false)
+	case core.OpSection:
+		if core.Handoff(op.Arg) == core.HandoffReset {
+			g.emitAbs(mos6502.Jsr(0), fixupClear, false) // jsr _bf_clear
+		}
+		g.emitStartPointer()
+	case core.OpTrap:
+		g.emitAbs(mos6502.Jmp(0), fixupUnreachable, false) // jmp _bf_unreachable
+	case core.OpZeroRange:
+		g.emitZeroRange(op.Arg)
+	case core.OpCopyRange:
+		g.emitCopyRange(op.Arg, op.Off)
+	}
+}
+
+// emitShift moves the data pointer by k cells: an 8-bit add or subtract
+// carrying into the high byte when |k| < 256, otherwise a 16-bit add.
+func (g *Generator) emitShift(k int) {
+	switch {
+	case k == 0:
+	case k > 0 && k < 256:
+		g.emit(mos6502.Clc(), mos6502.LdaZP(zpPtr), mos6502.AdcImm(byte(k)), mos6502.StaZP(zpPtr))
+		g.emit(mos6502.Branch(mos6502.BCC, 2), mos6502.IncZP(zpPtr+1))
+	case k < 0 && k > -256:
+		g.emit(mos6502.Sec(), mos6502.LdaZP(zpPtr), mos6502.SbcImm(byte(-k)), mos6502.StaZP(zpPtr))
+		g.emit(mos6502.Branch(mos6502.BCS, 2), mos6502.DecZP(zpPtr+1))
+	default:
+		g.emit(
+			mos6502.Clc(),
+			mos6502.LdaZP(zpPtr), mos6502.AdcImm(byte(k)), mos6502.StaZP(zpPtr),
+			mos6502.LdaZP(zpPtr+1), mos6502.AdcImm(byte(k>>8)), mos6502.StaZP(zpPtr+1),
+		)
+	}
+}
+
+// emitAdd adds k to the current cell in A. Under the saturate and trap
+// policies it checks the carry (or overflow, for signed cells) after each
+// add, as for the other backends.
+func (g *Generator) emitAdd(k int) {
+	if k == 0 {
+		return
+	}
+	cells := g.opts.Cells
+
+	if cells.AlwaysOverflows(k) {
+		if cells.Overflow == core.OverflowTrap {
+			g.emitAbs(mos6502.Jmp(0), fixupTrap, false) // jmp _bf_trap
+			return
+		}
+		g.emit(mos6502.LdaImm(byte(g.clamp(k))), mos6502.StaIndY(zpPtr))
+		return
+	}
+
+	g.emit(mos6502.LdaIndY(zpPtr))
+	switch {
+	case cells.Overflow == core.OverflowWrap:
+		g.emit(mos6502.Clc(), mos6502.AdcImm(byte(k)))
+	case cells.Signed:
+		// V is only meaningful for immediates in [-128, 127]
+		for k != 0 {
+			step := max(-128, min(127, k))
+			g.emit(mos6502.Clc(), mos6502.AdcImm(byte(step)))
+			g.emitChecked(mos6502.BVC, step)
+			k -= step
+		}
+	case k > 0:
+		g.emit(mos6502.Clc(), mos6502.AdcImm(byte(k)))
+		g.emitChecked(mos6502.BCC, k)
+	default:
+		g.emit(mos6502.Sec(), mos6502.SbcImm(byte(-k)))
+		g.emitChecked(mos6502.BCS, k)
+	}
+	g.emit(mos6502.StaIndY(zpPtr))
+}
+
+// emitChecked outputs the saturate clamp or trap jump after an add of k,
+// skipped by the branch ok when it did not overflow.
+func (g *Generator) emitChecked(ok mos6502.Cond, k int) {
+	if g.opts.Cells.Overflow == core.OverflowSaturate {
+		g.emit(mos6502.Branch(ok, 2), mos6502.LdaImm(byte(g.clamp(k))))
+		return
+	}
+	g.emit(mos6502.Branch(ok, 3))
+	g.emitAbs(mos6502.Jmp(0), fixupTrap, false) // jmp _bf_trap
+}
+
+// clamp returns the value an add of k saturates to.
+func (g *Generator) clamp(k int) int {
+	if k > 0 {
+		return g.opts.Cells.Max()
+	}
+	return g.opts.Cells.Min()
+}
+
+// emitZeroRange clears n cells from the data pointer: whole pages with X
+// counting them, moving the pointer's high byte, then the rest with Y
+// counting down.
+func (g *Generator) emitZeroRange(n int) {
+	pages, rest := n/256, n%256
+	g.emit(mos6502.Tya()) // Y is 0
+	if pages > 0 {
+		g.emit(mos6502.LdxImm(byte(pages)))
+		loop := len(g.code)
+		g.emit(mos6502.StaIndY(zpPtr), mos6502.Iny())
+		g.emitBranchBack(mos6502.BNE, loop)
+		g.emit(mos6502.IncZP(zpPtr+1), mos6502.Dex())
+		g.emitBranchBack(mos6502.BNE, loop)
+	}
+	if rest > 0 {
+		g.emit(mos6502.LdyImm(byte(rest)))
+		loop := len(g.code)
+		g.emit(mos6502.Dey(), mos6502.StaIndY(zpPtr))
+		g.emitBranchBack(mos6502.BNE, loop)
+	}
+	g.emitRestorePointer(pages)
+}
+
+// emitCopyRange copies n cells from the data pointer to d cells away, as
+// emitZeroRange clears them. The optimiser only emits non-overlapping
+// ranges.
+func (g *Generator) emitCopyRange(n, d int) {
+	g.emit(
+		mos6502.Clc(),
+		mos6502.LdaZP(zpPtr), mos6502.AdcImm(byte(d)), mos6502.StaZP(zpDest),
+		mos6502.LdaZP(zpPtr+1), mos6502.AdcImm(byte(d>>8)), mos6502.StaZP(zpDest+1),
+	)
+	pages, rest := n/256, n%256
+	if pages > 0 {
+		g.emit(mos6502.LdxImm(byte(pages)))
+		loop := len(g.code)
+		g.emit(mos6502.LdaIndY(zpPtr), mos6502.StaIndY(zpDest), mos6502.Iny())
+		g.emitBranchBack(mos6502.BNE, loop)
+		g.emit(mos6502.IncZP(zpPtr+1), mos6502.IncZP(zpDest+1), mos6502.Dex())
+		g.emitBranchBack(mos6502.BNE, loop)
+	}
+	if rest > 0 {
+		g.emit(mos6502.LdyImm(byte(rest)))
+		loop := len(g.code)
+		g.emit(mos6502.Dey(), mos6502.LdaIndY(zpPtr), mos6502.StaIndY(zpDest), mos6502.Tya())
+		g.emitBranchBack(mos6502.BNE, loop)
+	}
+	g.emitRestorePointer(pages)
+}
+
+// emitRestorePointer moves the data pointer back the pages a range op
+// moved it on.
+func (g *Generator) emitRestorePointer(pages int) {
+	if pages > 0 {
+		g.emit(mos6502.Sec(), mos6502.LdaZP(zpPtr+1), mos6502.SbcImm(byte(pages)), mos6502.StaZP(zpPtr+1))
+	}
+}
+
+// resolveFixups patches every absolute address with its target's.
+func (g *Generator) resolveFixups() {
+	for _, f := range g.fixups {
+		var target int
+		switch {
+		case f.target < 0:
+			target = g.helpers[f.target]
+		case f.loopEnd:
+			target = g.loopEnd[f.target]
+		default:
+			target = g.loopBody[f.target]
+		}
+		binary.LittleEndian.PutUint16(g.code[f.at:], uint16(CodeBase+target))
+	}
+}
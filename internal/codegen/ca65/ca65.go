@@ -0,0 +1,581 @@
+// Package ca65 provides ca65 (cc65 assembler) source output for 6502
+// machines: the Commodore 64 and the Apple II. The code is the c64
+// package's, with the data pointer in zero page and cells accessed as
+// (ptr),y with Y kept at 0. Only the I/O shim, a few routines calling the
+// machine's ROM, differs between machines, and its ROM addresses are
+// named at the top of the file for porting to another 6502 machine.
+package ca65
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// Machine is the computer a program is for, which sets its memory layout
+// and the ROM routines its I/O shim calls.
+type Machine int
+
+const (
+	C64    Machine = iota // Commodore 64, a PRG run from BASIC with RUN
+	Apple2                // Apple II, a binary at $0803 run with BRUN
+)
+
+// machineNames maps each Machine to its -machine flag spelling.
+var machineNames = [...]string{C64: "c64", Apple2: "apple2"}
+
+// String returns the name of m, as for ParseMachine.
+func (m Machine) String() string {
+	return machineNames[m]
+}
+
+// ParseMachine returns the Machine named s, c64 or apple2.
+func ParseMachine(s string) (Machine, error) {
+	for m, name := range machineNames {
+		if name == s {
+			return Machine(m), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown machine: %s (must be c64 or apple2)", s)
+}
+
+// layout is where a machine's program goes in memory.
+type layout struct {
+	start   int // the link address, for ld65 --start-addr
+	tapeEnd int // the tape ends just below here, with the code below it
+	ptr     int // two zero page bytes for the data pointer, then two for COPY_RANGE
+}
+
+var layouts = [...]layout{
+	// The PRG's load address comes first, then BASIC's SYS stub. BASIC is
+	// banked out to put the tape in the RAM under it, below the I/O area.
+	C64: {start: 0x07FF, tapeEnd: 0xD000, ptr: 0xFB},
+	// The tape ends at HIMEM under DOS 3.3 and ProDOS, over the hi-res
+	// pages, which text mode does not use.
+	Apple2: {start: 0x0803, tapeEnd: 0x9600, ptr: 0x06},
+}
+
+// C64 memory and KERNAL.
+const (
+	c64CodeBase    = 0x080D // just past the SYS stub
+	c64Port        = 0x01   // the 6510's I/O port, selecting the ROMs
+	c64PortNoBASIC = 0x36   // RAM at $A000, with the KERNAL and I/O
+	c64PortDefault = 0x37   // BASIC, KERNAL and I/O
+	c64Lower       = 0x0E   // switches to the lower case character set when printed
+)
+
+// Failure messages, NUL terminated.
+const (
+	trapMsg        = "bfcc: cell overflow\n\x00"
+	unreachableMsg = "bfcc: reached unreachable code\n\x00"
+)
+
+// Generator produces ca65 assembly from IR operations.
+type Generator struct {
+	ops      []core.Op
+	out      strings.Builder
+	machine  Machine
+	cells    core.CellModel
+	midTape  bool // start the data pointer in the middle of the tape
+	progress func(done, total int)
+
+	trap, unreachable bool // the code jumps to _bf_trap or _bf_unreachable
+}
+
+// Option is a functional option for configuring a Generator.
+type Option func(*Generator)
+
+// WithMachine sets the machine the program is for (default C64).
+func WithMachine(m Machine) Option {
+	return func(g *Generator) {
+		g.machine = m
+	}
+}
+
+// WithCellOverflow sets the cell overflow policy (default core.OverflowWrap).
+func WithCellOverflow(overflow core.CellOverflow) Option {
+	return func(g *Generator) {
+		g.cells.Overflow = overflow
+	}
+}
+
+// WithSignedCells treats cells as signed bytes: overflow checks use the
+// overflow flag rather than carry. Input never ends on these machines, so
+// IN is unchanged.
+func WithSignedCells() Option {
+	return func(g *Generator) {
+		g.cells.Signed = true
+	}
+}
+
+// WithMidTape starts the data pointer in the middle of the tape rather than
+// at cell 0, for programs written for doubly-infinite tapes.
+func WithMidTape() Option {
+	return func(g *Generator) {
+		g.midTape = true
+	}
+}
+
+// WithProgress calls report with the number of ops emitted so far, every
+// ProgressEvery ops and once all of them are done.
+func WithProgress(report func(done, total int)) Option {
+	return func(g *Generator) {
+		g.progress = report
+	}
+}
+
+// ProgressEvery is how many ops are emitted between progress reports.
+const ProgressEvery = 1 << 14
+
+// NewGenerator creates a new ca65 assembly generator.
+func NewGenerator(ops []core.Op, opts ...Option) *Generator {
+	g := &Generator{ops: ops}
+	for _, opt := range opts {
+		opt(g)
+	}
+	return g
+}
+
+// Generate produces the complete assembly output. The program is linked
+// at the machine's start address with ld65's none target, and the linker
+// fails if the code leaves no room for the tape.
+func (g *Generator) Generate() string {
+	g.emitHeader()
+	g.emitPrologue()
+
+	for i, op := range g.ops {
+		g.emitOp(op)
+		if g.progress != nil && (i+1)%ProgressEvery == 0 {
+			g.progress(i+1, len(g.ops))
+		}
+	}
+	if g.progress != nil {
+		g.progress(len(g.ops), len(g.ops))
+	}
+	g.emitExit()
+	g.emitHelpers()
+
+	fmt.Fprintf(&g.out, "\n    .assert * <= tape, error, \"program too large: the code overlaps the tape\"\n")
+	return g.out.String()
+}
+
+// emitHeader outputs how to build the program, the memory layout, the ROM
+// routines of the I/O shim and, for the C64, the load address and the
+// BASIC stub calling the code.
+func (g *Generator) emitHeader() {
+	l := layouts[g.machine]
+	switch g.machine {
+	case C64:
+		fmt.Fprintf(&g.out, "; Generated by bfcc: a Commodore 64 program. Build it as a PRG file,\n")
+		fmt.Fprintf(&g.out, "; to LOAD and RUN, with\n")
+		fmt.Fprintf(&g.out, ";\n")
+		fmt.Fprintf(&g.out, ";   ca65 program.s\n")
+		fmt.Fprintf(&g.out, ";   ld65 -t none --start-addr 0x%04X -o program.prg program.o\n", l.start)
+	case Apple2:
+		fmt.Fprintf(&g.out, "; Generated by bfcc: an Apple II program. Build it as a binary for $%04X\n", l.start)
+		fmt.Fprintf(&g.out, "; with\n")
+		fmt.Fprintf(&g.out, ";\n")
+		fmt.Fprintf(&g.out, ";   ca65 program.s\n")
+		fmt.Fprintf(&g.out, ";   ld65 -t none --start-addr 0x%04X -o program.bin program.o\n", l.start)
+		fmt.Fprintf(&g.out, ";\n")
+		fmt.Fprintf(&g.out, "; then put it on a disk as a binary file loading at $%04X and BRUN it.\n", l.start)
+	}
+
+	fmt.Fprintf(&g.out, "\n    .setcpu \"6502\"\n\n")
+	fmt.Fprintf(&g.out, "tape = $%04X ; %d cells, ending at $%04X\n", l.tapeEnd-core.TapeSize, core.TapeSize, l.tapeEnd)
+	fmt.Fprintf(&g.out, "ptr = $%02X ; the data pointer, low byte first\n", l.ptr)
+	fmt.Fprintf(&g.out, "dest = $%02X ; the destination pointer of COPY_RANGE\n", l.ptr+2)
+
+	fmt.Fprintf(&g.out, "\n; The ROM routines the I/O shim calls\n")
+	switch g.machine {
+	case C64:
+		fmt.Fprintf(&g.out, "CHRIN = $FFCF ; KERNAL: read a byte from the screen editor into A\n")
+		fmt.Fprintf(&g.out, "CHROUT = $FFD2 ; KERNAL: print the byte in A, preserving X and Y\n")
+
+		fmt.Fprintf(&g.out, "\n    .word *+2 ; the load address\n")
+		fmt.Fprintf(&g.out, "    .word basic_end, 10 ; the link to the next line, the line number\n")
+		fmt.Fprintf(&g.out, "    .byte $9E, \"%d\", 0 ; SYS\n", c64CodeBase)
+		fmt.Fprintf(&g.out, "basic_end:\n")
+		fmt.Fprintf(&g.out, "    .word 0 ; the end of the program\n")
+		fmt.Fprintf(&g.out, "    .assert * = $%04X, error, \"link with --start-addr 0x%04X\"\n", c64CodeBase, l.start)
+	case Apple2:
+		fmt.Fprintf(&g.out, "RDKEY = $FD0C ; Monitor: wait for a key, into A with bit 7 set\n")
+		fmt.Fprintf(&g.out, "COUT = $FDED ; Monitor: print the byte in A, with bit 7 set, preserving X and Y\n")
+	}
+	fmt.Fprintf(&g.out, "\n")
+}
+
+// emitPrologue sets the machine up, clears the tape and points the data
+// pointer at the first cell. On the C64 it banks out BASIC and switches to
+// the lower case character set.
+func (g *Generator) emitPrologue() {
+	fmt.Fprintf(&g.out, "start:\n")
+	fmt.Fprintf(&g.out, "    cld\n")
+	if g.machine == C64 {
+		fmt.Fprintf(&g.out, "    lda #$%02X\n", c64PortNoBASIC)
+		fmt.Fprintf(&g.out, "    sta $%02X ; bank out BASIC\n", c64Port)
+		fmt.Fprintf(&g.out, "    lda #$%02X\n", c64Lower)
+		fmt.Fprintf(&g.out, "    jsr CHROUT ; lower case\n")
+	}
+	fmt.Fprintf(&g.out, "    ldy #0\n")
+	fmt.Fprintf(&g.out, "    jsr _bf_clear\n")
+	g.emitStartPointer()
+}
+
+// emitStartPointer points the data pointer at the first cell: the start,
+// or the middle of the tape with WithMidTape.
+func (g *Generator) emitStartPointer() {
+	if g.midTape {
+		g.emitSetPointer(fmt.Sprintf("tape+%d", core.TapeSize/2))
+		return
+	}
+	g.emitSetPointer("tape")
+}
+
+// emitSetPointer points the data pointer at addr.
+func (g *Generator) emitSetPointer(addr string) {
+	fmt.Fprintf(&g.out, "    lda #<(%s)\n", addr)
+	fmt.Fprintf(&g.out, "    sta ptr\n")
+	fmt.Fprintf(&g.out, "    lda #>(%s)\n", addr)
+	fmt.Fprintf(&g.out, "    sta ptr+1\n")
+}
+
+// emitExit outputs _bf_exit, which returns to BASIC, or on the C64 banks
+// it back in first.
+func (g *Generator) emitExit() {
+	fmt.Fprintf(&g.out, "\n_bf_exit:\n")
+	if g.machine == C64 {
+		fmt.Fprintf(&g.out, "    lda #$%02X\n", c64PortDefault)
+		fmt.Fprintf(&g.out, "    sta $%02X ; bank BASIC back in\n", c64Port)
+	}
+	fmt.Fprintf(&g.out, "    rts\n")
+}
+
+// emitHelpers outputs the I/O shim, the tape clearing helper, and the
+// failure helpers and their messages when the code uses them.
+func (g *Generator) emitHelpers() {
+	fmt.Fprintf(&g.out, "\n; The I/O shim: _bf_read reads a byte, as ASCII, into the current cell,\n")
+	fmt.Fprintf(&g.out, "; and _bf_putc prints A, as ASCII, preserving X and leaving Y 0\n")
+	fmt.Fprintf(&g.out, "_bf_read:\n")
+	switch g.machine {
+	case C64:
+		fmt.Fprintf(&g.out, "    jsr CHRIN\n")
+		g.emitTranslate(0x0D, 0x0A,
+			span{0x41, 0x5B, "ora #$20"}, // a-z
+			span{0xC1, 0xDB, "and #$7F"}, // A-Z
+		)
+	case Apple2:
+		fmt.Fprintf(&g.out, "    jsr RDKEY\n")
+		fmt.Fprintf(&g.out, "    jsr COUT ; echo\n")
+		fmt.Fprintf(&g.out, "    and #$7F\n")
+		fmt.Fprintf(&g.out, "    cmp #$0D\n")
+		fmt.Fprintf(&g.out, "    bne @done\n")
+		fmt.Fprintf(&g.out, "    lda #$0A\n")
+		fmt.Fprintf(&g.out, "@done:\n")
+	}
+	fmt.Fprintf(&g.out, "    ldy #0\n")
+	fmt.Fprintf(&g.out, "    sta (ptr),y\n")
+	fmt.Fprintf(&g.out, "    rts\n")
+
+	fmt.Fprintf(&g.out, "\n_bf_write:\n")
+	fmt.Fprintf(&g.out, "    lda (ptr),y\n")
+	fmt.Fprintf(&g.out, "_bf_putc:\n")
+	switch g.machine {
+	case C64:
+		g.emitTranslate(0x0A, 0x0D,
+			span{0x41, 0x5B, "ora #$80"}, // A-Z
+			span{0x61, 0x7B, "and #$DF"}, // a-z
+		)
+		fmt.Fprintf(&g.out, "    jsr CHROUT\n")
+	case Apple2:
+		fmt.Fprintf(&g.out, "    cmp #$0A\n")
+		fmt.Fprintf(&g.out, "    bne @not_newline\n")
+		fmt.Fprintf(&g.out, "    lda #$0D\n")
+		fmt.Fprintf(&g.out, "@not_newline:\n")
+		fmt.Fprintf(&g.out, "    ora #$80\n")
+		fmt.Fprintf(&g.out, "    jsr COUT\n")
+	}
+	fmt.Fprintf(&g.out, "    ldy #0\n")
+	fmt.Fprintf(&g.out, "    rts\n")
+
+	fmt.Fprintf(&g.out, "\n_bf_clear:\n")
+	g.emitSetPointer("tape")
+	g.emitZeroRange(core.TapeSize)
+	fmt.Fprintf(&g.out, "    rts\n")
+
+	if g.trap || g.unreachable {
+		g.emitFailHelpers()
+	}
+}
+
+// span is a range of letters emitTranslate converts.
+type span struct {
+	from, end byte // the first letter, and the byte after the last
+	conv      string
+}
+
+// emitTranslate converts the byte in A between ASCII and PETSCII, which
+// differ in their newline and letters: newline becomes newlineTo, and the
+// letters from each span's from to just below its end are converted by
+// its conv instruction.
+func (g *Generator) emitTranslate(newline, newlineTo byte, first, second span) {
+	fmt.Fprintf(&g.out, "    cmp #$%02X\n", newline)
+	fmt.Fprintf(&g.out, "    bne @not_newline\n")
+	fmt.Fprintf(&g.out, "    lda #$%02X\n", newlineTo)
+	fmt.Fprintf(&g.out, "    bne @done ; always taken\n")
+	fmt.Fprintf(&g.out, "@not_newline:\n")
+	fmt.Fprintf(&g.out, "    cmp #$%02X\n", first.from)
+	fmt.Fprintf(&g.out, "    bcc @done\n")
+	fmt.Fprintf(&g.out, "    cmp #$%02X\n", first.end)
+	fmt.Fprintf(&g.out, "    bcs @not_first\n")
+	fmt.Fprintf(&g.out, "    %s\n", first.conv)
+	fmt.Fprintf(&g.out, "    bne @done ; always taken\n")
+	fmt.Fprintf(&g.out, "@not_first:\n")
+	fmt.Fprintf(&g.out, "    cmp #$%02X\n", second.from)
+	fmt.Fprintf(&g.out, "    bcc @done\n")
+	fmt.Fprintf(&g.out, "    cmp #$%02X\n", second.end)
+	fmt.Fprintf(&g.out, "    bcs @done\n")
+	fmt.Fprintf(&g.out, "    %s\n", second.conv)
+	fmt.Fprintf(&g.out, "@done:\n")
+}
+
+// emitFailHelpers outputs _bf_trap and _bf_unreachable, which print their
+// message with _bf_putc and exit, followed by the messages.
+func (g *Generator) emitFailHelpers() {
+	fmt.Fprintf(&g.out, "\n_bf_trap:\n")
+	fmt.Fprintf(&g.out, "    ldx #0\n")
+	fmt.Fprintf(&g.out, "    beq _bf_fail ; always taken\n")
+	fmt.Fprintf(&g.out, "_bf_unreachable:\n")
+	fmt.Fprintf(&g.out, "    ldx #%d\n", len(trapMsg))
+	fmt.Fprintf(&g.out, "_bf_fail:\n")
+	fmt.Fprintf(&g.out, "    lda _bf_messages,x\n")
+	fmt.Fprintf(&g.out, "    bne :+\n")
+	fmt.Fprintf(&g.out, "    jmp _bf_exit\n")
+	fmt.Fprintf(&g.out, ":\n")
+	fmt.Fprintf(&g.out, "    jsr _bf_putc\n")
+	fmt.Fprintf(&g.out, "    inx\n")
+	fmt.Fprintf(&g.out, "    bne _bf_fail ; always taken\n")
+
+	// .byte rather than strings, which ca65 would convert to PETSCII for
+	// -t c64
+	fmt.Fprintf(&g.out, "\n_bf_messages:\n")
+	for line := range slices.Chunk([]byte(trapMsg+unreachableMsg), 16) {
+		parts := make([]string, len(line))
+		for i, b := range line {
+			parts[i] = fmt.Sprintf("$%02X", b)
+		}
+		fmt.Fprintf(&g.out, "    .byte %s\n", strings.Join(parts, ", "))
+	}
+}
+
+// emitOp outputs assembly for a single IR operation.
+func (g *Generator) emitOp(op core.Op) {
+	switch op.Kind {
+	case core.OpShift:
+		g.emitShift(op.Arg)
+	case core.OpAdd:
+		g.emitAdd(op.Arg)
+	case core.OpZero:
+		fmt.Fprintf(&g.out, "    tya ; Y is 0\n")
+		fmt.Fprintf(&g.out, "    sta (ptr),y\n")
+	case core.OpIn:
+		fmt.Fprintf(&g.out, "    jsr _bf_read\n")
+	case core.OpOut:
+		fmt.Fprintf(&g.out, "    jsr _bf_write\n")
+	case core.OpJz:
+		fmt.Fprintf(&g.out, "    lda (ptr),y\n")
+		fmt.Fprintf(&g.out, "    bne loop%d\n", op.Arg)
+		fmt.Fprintf(&g.out, "    jmp loop%d_end\n", op.Arg)
+		fmt.Fprintf(&g.out, "loop%d:\n", op.Arg)
+	case core.OpJnz:
+		fmt.Fprintf(&g.out, "    lda (ptr),y\n")
+		fmt.Fprintf(&g.out, "    beq loop%d_end\n", op.Arg)
+		fmt.Fprintf(&g.out, "    jmp loop%d\n", op.Arg)
+		fmt.Fprintf(&g.out, "loop%d_end:\n", op.Arg)
+	case core.OpSection:
+		if core.Handoff(op.Arg) == core.HandoffReset {
+			fmt.Fprintf(&g.out, "    jsr _bf_clear\n")
+		}
+		g.emitStartPointer()
+	case core.OpTrap:
+		g.unreachable = true
+		fmt.Fprintf(&g.out, "    jmp _bf_unreachable\n")
+	case core.OpZeroRange:
+		g.emitZeroRange(op.Arg)
+	case core.OpCopyRange:
+		g.emitCopyRange(op.Arg, op.Off)
+	}
+}
+
+// emitShift moves the data pointer by k cells: an 8-bit add or subtract
+// carrying into the high byte when |k| < 256, otherwise a 16-bit add.
+func (g *Generator) emitShift(k int) {
+	switch {
+	case k == 0:
+	case k > 0 && k < 256:
+		fmt.Fprintf(&g.out, "    clc\n")
+		fmt.Fprintf(&g.out, "    lda ptr\n")
+		fmt.Fprintf(&g.out, "    adc #$%02X\n", k)
+		fmt.Fprintf(&g.out, "    sta ptr\n")
+		fmt.Fprintf(&g.out, "    bcc :+\n")
+		fmt.Fprintf(&g.out, "    inc ptr+1\n")
+		fmt.Fprintf(&g.out, ":\n")
+	case k < 0 && k > -256:
+		fmt.Fprintf(&g.out, "    sec\n")
+		fmt.Fprintf(&g.out, "    lda ptr\n")
+		fmt.Fprintf(&g.out, "    sbc #$%02X\n", -k)
+		fmt.Fprintf(&g.out, "    sta ptr\n")
+		fmt.Fprintf(&g.out, "    bcs :+\n")
+		fmt.Fprintf(&g.out, "    dec ptr+1\n")
+		fmt.Fprintf(&g.out, ":\n")
+	default:
+		fmt.Fprintf(&g.out, "    clc\n")
+		fmt.Fprintf(&g.out, "    lda ptr\n")
+		fmt.Fprintf(&g.out, "    adc #$%02X\n", byte(k))
+		fmt.Fprintf(&g.out, "    sta ptr\n")
+		fmt.Fprintf(&g.out, "    lda ptr+1\n")
+		fmt.Fprintf(&g.out, "    adc #$%02X\n", byte(k>>8))
+		fmt.Fprintf(&g.out, "    sta ptr+1\n")
+	}
+}
+
+// emitAdd adds k to the current cell in A. Under the saturate and trap
+// policies it checks the carry (or overflow, for signed cells) after each
+// add, as for the other backends.
+func (g *Generator) emitAdd(k int) {
+	if k == 0 {
+		return
+	}
+
+	if g.cells.AlwaysOverflows(k) {
+		if g.cells.Overflow == core.OverflowTrap {
+			g.trap = true
+			fmt.Fprintf(&g.out, "    jmp _bf_trap\n")
+			return
+		}
+		fmt.Fprintf(&g.out, "    lda #$%02X\n", byte(g.clamp(k)))
+		fmt.Fprintf(&g.out, "    sta (ptr),y\n")
+		return
+	}
+
+	fmt.Fprintf(&g.out, "    lda (ptr),y\n")
+	switch {
+	case g.cells.Overflow == core.OverflowWrap:
+		fmt.Fprintf(&g.out, "    clc\n")
+		fmt.Fprintf(&g.out, "    adc #$%02X\n", byte(k))
+	case g.cells.Signed:
+		// V is only meaningful for immediates in [-128, 127]
+		for k != 0 {
+			step := max(-128, min(127, k))
+			fmt.Fprintf(&g.out, "    clc\n")
+			fmt.Fprintf(&g.out, "    adc #$%02X\n", byte(step))
+			g.emitChecked("bvc", step)
+			k -= step
+		}
+	case k > 0:
+		fmt.Fprintf(&g.out, "    clc\n")
+		fmt.Fprintf(&g.out, "    adc #$%02X\n", byte(k))
+		g.emitChecked("bcc", k)
+	default:
+		fmt.Fprintf(&g.out, "    sec\n")
+		fmt.Fprintf(&g.out, "    sbc #$%02X\n", byte(-k))
+		g.emitChecked("bcs", k)
+	}
+	fmt.Fprintf(&g.out, "    sta (ptr),y\n")
+}
+
+// emitChecked outputs the saturate clamp or trap jump after an add of k,
+// skipped by the branch ok when it did not overflow.
+func (g *Generator) emitChecked(ok string, k int) {
+	fmt.Fprintf(&g.out, "    %s :+\n", ok)
+	if g.cells.Overflow == core.OverflowSaturate {
+		fmt.Fprintf(&g.out, "    lda #$%02X\n", byte(g.clamp(k)))
+	} else {
+		g.trap = true
+		fmt.Fprintf(&g.out, "    jmp _bf_trap\n")
+	}
+	fmt.Fprintf(&g.out, ":\n")
+}
+
+// clamp returns the value an add of k saturates to.
+func (g *Generator) clamp(k int) int {
+	if k > 0 {
+		return g.cells.Max()
+	}
+	return g.cells.Min()
+}
+
+// emitZeroRange clears n cells from the data pointer: whole pages with X
+// counting them, moving the pointer's high byte, then the rest with Y
+// counting down.
+func (g *Generator) emitZeroRange(n int) {
+	pages, rest := n/256, n%256
+	fmt.Fprintf(&g.out, "    tya ; Y is 0\n")
+	if pages > 0 {
+		fmt.Fprintf(&g.out, "    ldx #%d\n", pages)
+		fmt.Fprintf(&g.out, ":\n")
+		fmt.Fprintf(&g.out, "    sta (ptr),y\n")
+		fmt.Fprintf(&g.out, "    iny\n")
+		fmt.Fprintf(&g.out, "    bne :-\n")
+		fmt.Fprintf(&g.out, "    inc ptr+1\n")
+		fmt.Fprintf(&g.out, "    dex\n")
+		fmt.Fprintf(&g.out, "    bne :-\n")
+	}
+	if rest > 0 {
+		fmt.Fprintf(&g.out, "    ldy #%d\n", rest)
+		fmt.Fprintf(&g.out, ":\n")
+		fmt.Fprintf(&g.out, "    dey\n")
+		fmt.Fprintf(&g.out, "    sta (ptr),y\n")
+		fmt.Fprintf(&g.out, "    bne :-\n")
+	}
+	g.emitRestorePointer(pages)
+}
+
+// emitCopyRange copies n cells from the data pointer to d cells away, as
+// emitZeroRange clears them. The optimiser only emits non-overlapping
+// ranges.
+func (g *Generator) emitCopyRange(n, d int) {
+	fmt.Fprintf(&g.out, "    clc\n")
+	fmt.Fprintf(&g.out, "    lda ptr\n")
+	fmt.Fprintf(&g.out, "    adc #$%02X\n", byte(d))
+	fmt.Fprintf(&g.out, "    sta dest\n")
+	fmt.Fprintf(&g.out, "    lda ptr+1\n")
+	fmt.Fprintf(&g.out, "    adc #$%02X\n", byte(d>>8))
+	fmt.Fprintf(&g.out, "    sta dest+1\n")
+	pages, rest := n/256, n%256
+	if pages > 0 {
+		fmt.Fprintf(&g.out, "    ldx #%d\n", pages)
+		fmt.Fprintf(&g.out, ":\n")
+		fmt.Fprintf(&g.out, "    lda (ptr),y\n")
+		fmt.Fprintf(&g.out, "    sta (dest),y\n")
+		fmt.Fprintf(&g.out, "    iny\n")
+		fmt.Fprintf(&g.out, "    bne :-\n")
+		fmt.Fprintf(&g.out, "    inc ptr+1\n")
+		fmt.Fprintf(&g.out, "    inc dest+1\n")
+		fmt.Fprintf(&g.out, "    dex\n")
+		fmt.Fprintf(&g.out, "    bne :-\n")
+	}
+	if rest > 0 {
+		fmt.Fprintf(&g.out, "    ldy #%d\n", rest)
+		fmt.Fprintf(&g.out, ":\n")
+		fmt.Fprintf(&g.out, "    dey\n")
+		fmt.Fprintf(&g.out, "    lda (ptr),y\n")
+		fmt.Fprintf(&g.out, "    sta (dest),y\n")
+		fmt.Fprintf(&g.out, "    tya\n")
+		fmt.Fprintf(&g.out, "    bne :-\n")
+	}
+	g.emitRestorePointer(pages)
+}
+
+// emitRestorePointer moves the data pointer back the pages a range op
+// moved it on.
+func (g *Generator) emitRestorePointer(pages int) {
+	if pages > 0 {
+		fmt.Fprintf(&g.out, "    sec\n")
+		fmt.Fprintf(&g.out, "    lda ptr+1\n")
+		fmt.Fprintf(&g.out, "    sbc #%d\n", pages)
+		fmt.Fprintf(&g.out, "    sta ptr+1\n")
+	}
+}
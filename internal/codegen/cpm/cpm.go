@@ -0,0 +1,430 @@
+// Package cpm produces CP/M programs from IR operations: Z80 machine code
+// in a .COM file, which CP/M loads at $0100 and runs by name.
+//
+// The 30,000 cell tape sits in memory straight after the code. CP/M
+// machines differ in how much memory they leave for programs, so the
+// program checks there is room below the BDOS for the tape before it
+// starts, and moves the stack to the top of that memory. I/O goes through
+// the BDOS console calls: output newlines are written as CR LF, input is
+// echoed by the BDOS with Enter read as a newline, and ^Z reads as the
+// end of input. Programs return to CP/M with a warm boot.
+package cpm
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/lcox74/bfcc/internal/codegen/linux"
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/pkg/z80"
+)
+
+// Memory layout.
+const (
+	CodeBase  = 0x0100 // where CP/M loads a .COM file
+	StackSize = 128    // bytes left for the stack, between the tape and the BDOS
+	// MaxCode is the most code there could be room for with the tape, if
+	// the BDOS were at the top of memory. A 64KB CP/M 2.2 system, with the
+	// BDOS at about $E400, leaves room for about 28KB.
+	MaxCode = 0xFFFF - CodeBase - core.TapeSize - StackSize
+)
+
+// CP/M addresses and BDOS calls.
+const (
+	warmBoot   = 0x0000 // jumped to, to return to CP/M
+	bdosEntry  = 0x0005 // called with the function in C
+	bdosBase   = 0x0006 // holds the BDOS's address, the top of free memory
+	bdosRead   = 1      // read a byte into A, echoing it
+	bdosWrite  = 2      // write the byte in E
+	bdosString = 9      // write the $ terminated string at DE
+)
+
+// Console bytes.
+const (
+	charLF  = 0x0A
+	charCR  = 0x0D
+	charEOF = 0x1A // ^Z, the end of a CP/M text file
+)
+
+// Special fixup targets for the helpers after the code.
+const (
+	fixupRead        = -1 // _bf_read
+	fixupWrite       = -2 // _bf_write
+	fixupTrap        = -3 // _bf_trap, for a cell overflow
+	fixupUnreachable = -4 // _bf_unreachable, for a TRAP
+	fixupClear       = -5 // _bf_clear
+	fixupNoMemory    = -6 // _bf_nomem, when the tape does not fit
+	fixupMessages    = -7 // the failure messages
+	fixupTape        = -8 // the tape, just past the code
+)
+
+// Failure messages, $ terminated for BDOS function 9.
+const (
+	noMemoryMsg    = "bfcc: not enough memory for the tape\r\n$"
+	trapMsg        = "bfcc: cell overflow\r\n$"
+	unreachableMsg = "bfcc: reached unreachable code\r\n$"
+)
+
+// Costs is the size in bytes of the code for each op, for the optimiser,
+// with the wrapping cell model. SHIFTs by one cell are an INC HL or DEC
+// HL, and further ones a 16-bit add.
+var Costs = core.CostModel{Name: "z80", Shift: 1, FarShift: 4, NearShift: 1, Add: 4, Zero: 2, IO: 3, Jump: 5, Range: 12}
+
+// fixup records the absolute address operand of a jump, call or load, to
+// patch once its target is known.
+type fixup struct {
+	at      int // code offset of the operand
+	target  int // loop label, or a special target
+	loopEnd bool
+	add     int // added to a special target's address
+}
+
+// Generator produces Z80 machine code from IR operations. It takes the
+// linux package's Options, but only supports the cell model, mid-tape,
+// debug and progress ones.
+//
+// The data pointer is HL. Nothing checks that it stays on the tape.
+type Generator struct {
+	ops      []core.Op
+	code     []byte
+	opts     linux.Settings
+	loopBody map[int]int // loop label -> code offset just past its JZ
+	loopEnd  map[int]int // loop label -> code offset just past its JNZ
+	helpers  map[int]int // special fixup target -> code offset
+	fixups   []fixup
+}
+
+// NewGenerator creates a new Z80 generator.
+func NewGenerator(ops []core.Op, opts ...linux.Option) *Generator {
+	return &Generator{
+		ops:      ops,
+		code:     make([]byte, 0, 4096),
+		opts:     linux.ApplyOptions(opts...),
+		loopBody: make(map[int]int),
+		loopEnd:  make(map[int]int),
+		helpers:  make(map[int]int),
+	}
+}
+
+// GenerateCOM produces a .COM file, which is the code to load at
+// CodeBase. It fails if the code leaves no room for the tape in 64KB.
+func (g *Generator) GenerateCOM() ([]byte, error) {
+	g.emitPrologue()
+
+	for i, op := range g.ops {
+		g.emitOp(op)
+		switch op.Kind {
+		case core.OpJz:
+			g.loopBody[op.Arg] = len(g.code)
+		case core.OpJnz:
+			g.loopEnd[op.Arg] = len(g.code)
+		}
+		if progress := g.opts.Progress; progress != nil && (i+1)%linux.ProgressEvery == 0 {
+			progress(i+1, len(g.ops))
+		}
+	}
+	if g.opts.Progress != nil {
+		g.opts.Progress(len(g.ops), len(g.ops))
+	}
+
+	g.emit(z80.Jp(warmBoot))
+	g.emitHelpers()
+	g.helpers[fixupTape] = len(g.code)
+	g.resolveFixups()
+
+	if len(g.code) > MaxCode {
+		return nil, fmt.Errorf("program too large for CP/M: %d bytes of code, with room for %d", len(g.code), MaxCode)
+	}
+	return g.code, nil
+}
+
+// emit appends instructions to the code buffer.
+func (g *Generator) emit(insns ...[]byte) {
+	for _, b := range insns {
+		g.code = append(g.code, b...)
+	}
+}
+
+// emitAbs emits a jump, call or load whose 16-bit operand is patched by
+// resolveFixups to target's address plus add.
+func (g *Generator) emitAbs(b []byte, target int, loopEnd bool, add int) {
+	g.emit(b)
+	g.fixups = append(g.fixups, fixup{at: len(g.code) - 2, target: target, loopEnd: loopEnd, add: add})
+}
+
+// emitJr emits a relative jump to patch with patchJr, returning its
+// offset.
+func (g *Generator) emitJr(c z80.Cond) int {
+	at := len(g.code)
+	g.emit(z80.JrCond(c, 0))
+	return at
+}
+
+// patchJr points the relative jump at offset at to the end of the code.
+func (g *Generator) patchJr(at int) {
+	g.code[at+1] = byte(int8(len(g.code) - (at + z80.JrSize)))
+}
+
+// here returns the address of the end of the code, plus off.
+func (g *Generator) here(off int) uint16 {
+	return uint16(CodeBase + len(g.code) + off)
+}
+
+// emitPrologue checks the tape fits below the BDOS, moves the stack up
+// under it, clears the tape and points the data pointer at the first
+// cell.
+func (g *Generator) emitPrologue() {
+	g.emit(z80.LdHLInd(bdosBase))
+	g.emitAbs(z80.LdDE(0), fixupTape, false, core.TapeSize+StackSize)
+	g.emit(z80.OrA(), z80.SbcHLDE()) // carry if the BDOS is below the tape's end
+	g.emitAbs(z80.JpCond(z80.C, 0), fixupNoMemory, false, 0)
+	g.emit(z80.LdSPInd(bdosBase))
+	g.emitAbs(z80.Call(0), fixupClear, false, 0)
+	g.emitStartPointer()
+}
+
+// emitStartPointer points the data pointer at the first cell: the start,
+// or the middle of the tape with WithMidTape.
+func (g *Generator) emitStartPointer() {
+	start := 0
+	if g.opts.MidTape {
+		start = core.TapeSize / 2
+	}
+	g.emitAbs(z80.LdHL(0), fixupTape, false, start)
+}
+
+// emitHelpers outputs the I/O and tape clearing helpers, and the failure
+// helpers, with the messages they print.
+func (g *Generator) emitHelpers() {
+	// _bf_read: read a byte into the current cell, as a newline for CR
+	// and the cell model's EOF for ^Z. The BDOS keeps no registers
+	g.helpers[fixupRead] = len(g.code)
+	g.emit(z80.PushHL(), z80.LdCImm(bdosRead), z80.Call(bdosEntry), z80.PopHL())
+	g.emit(z80.CpImm(charEOF))
+	eof := g.emitJr(z80.Z)
+	g.emit(z80.CpImm(charCR))
+	notCR := g.emitJr(z80.NZ)
+	g.emit(z80.LdAImm(charLF))
+	g.patchJr(notCR)
+	g.emit(z80.LdHLA(), z80.Ret())
+	g.patchJr(eof)
+	g.emit(z80.LdHLImm(g.opts.Cells.EOF()), z80.Ret())
+
+	// _bf_write: write the current cell, with a newline as CR LF
+	g.helpers[fixupWrite] = len(g.code)
+	g.emit(z80.LdAHL(), z80.PushHL(), z80.CpImm(charLF))
+	notLF := g.emitJr(z80.NZ)
+	g.emit(z80.LdEImm(charCR), z80.LdCImm(bdosWrite), z80.Call(bdosEntry), z80.LdAImm(charLF))
+	g.patchJr(notLF)
+	g.emit(z80.LdEA(), z80.LdCImm(bdosWrite), z80.Call(bdosEntry), z80.PopHL(), z80.Ret())
+
+	// _bf_clear: zero the tape, through LDIR copying each cell's zero on
+	// to the next
+	g.helpers[fixupClear] = len(g.code)
+	g.emitAbs(z80.LdHL(0), fixupTape, false, 0)
+	g.emit(z80.LdHLImm(0), z80.LdDH(), z80.LdEL(), z80.IncDE())
+	g.emit(z80.LdBC(core.TapeSize-1), z80.Ldir(), z80.Ret())
+
+	g.emitFailHelpers()
+}
+
+// emitFailHelpers outputs _bf_nomem, and _bf_trap and _bf_unreachable
+// when the code uses them, which print their message and return to CP/M,
+// followed by the messages.
+func (g *Generator) emitFailHelpers() {
+	trap, unreachable := g.uses(fixupTrap), g.uses(fixupUnreachable)
+
+	g.helpers[fixupNoMemory] = len(g.code)
+	g.emitAbs(z80.LdDE(0), fixupMessages, false, 0)
+	fail := len(g.code)
+	g.emit(z80.LdCImm(bdosString), z80.Call(bdosEntry), z80.Jp(warmBoot))
+
+	msgs := noMemoryMsg
+	for _, h := range []struct {
+		used   bool
+		target int
+		msg    string
+	}{{trap, fixupTrap, trapMsg}, {unreachable, fixupUnreachable, unreachableMsg}} {
+		if !h.used {
+			continue
+		}
+		g.helpers[h.target] = len(g.code)
+		g.emitAbs(z80.LdDE(0), fixupMessages, false, len(msgs))
+		g.emit(z80.Jr(int8(fail - (len(g.code) + z80.JrSize))))
+		msgs += h.msg
+	}
+
+	g.helpers[fixupMessages] = len(g.code)
+	g.emit([]byte(msgs))
+}
+
+// uses reports whether any fixup targets target.
+func (g *Generator) uses(target int) bool {
+	for _, f := range g.fixups {
+		if f.target == target {
+			return true
+		}
+	}
+	return false
+}
+
+// emitOp outputs machine code for a single IR operation.
+func (g *Generator) emitOp(op core.Op) {
+	switch op.Kind {
+	case core.OpShift:
+		g.emitShift(op.Arg)
+	case core.OpAdd:
+		g.emitAdd(op.Arg)
+	case core.OpZero:
+		g.emit(z80.LdHLImm(0))
+	case core.OpIn:
+		g.emitAbs(z80.Call(0), fixupRead, false, 0)
+	case core.OpOut:
+		g.emitAbs(z80.Call(0), fixupWrite, false, 0)
+	case core.OpJz:
+		// ld a,(hl); or a; jp z past the loop's JNZ
+		g.emit(z80.LdAHL(), z80.OrA())
+		g.emitAbs(z80.JpCond(z80.Z, 0), op.Arg, true, 0)
+	case core.OpJnz:
+		// ld a,(hl); or a; jp nz to the loop body
+		g.emit(z80.LdAHL(), z80.OrA())
+		g.emitAbs(z80.JpCond(z80.NZ, 0), op.Arg, false, 0)
+	case core.OpSection:
+		if core.Handoff(op.Arg) == core.HandoffReset {
+			g.emitAbs(z80.Call(0), fixupClear, false, 0)
+		}
+		g.emitStartPointer()
+	case core.OpTrap:
+		g.emitAbs(z80.Jp(0), fixupUnreachable, false, 0)
+	case core.OpZeroRange:
+		g.emitZeroRange(op.Arg)
+	case core.OpCopyRange:
+		g.emitCopyRange(op.Arg, op.Off)
+	}
+}
+
+// emitShift moves the data pointer by k cells: INC HL or DEC HL for up to
+// three, otherwise a 16-bit add.
+func (g *Generator) emitShift(k int) {
+	switch {
+	case k >= 0 && k <= 3:
+		for range k {
+			g.emit(z80.IncHL())
+		}
+	case k < 0 && k >= -3:
+		for range -k {
+			g.emit(z80.DecHL())
+		}
+	default:
+		g.emit(z80.LdDE(uint16(k)), z80.AddHLDE())
+	}
+}
+
+// emitAdd adds k to the current cell, in place for up to three either
+// way when wrapping, otherwise in A. Under the saturate and trap policies
+// it checks the carry (or overflow, for signed cells) after each add, as
+// for the other backends.
+func (g *Generator) emitAdd(k int) {
+	if k == 0 {
+		return
+	}
+	cells := g.opts.Cells
+
+	if cells.AlwaysOverflows(k) {
+		if cells.Overflow == core.OverflowTrap {
+			g.emitAbs(z80.Jp(0), fixupTrap, false, 0)
+			return
+		}
+		g.emit(z80.LdHLImm(byte(g.clamp(k))))
+		return
+	}
+
+	if cells.Overflow == core.OverflowWrap {
+		switch b := byte(k); {
+		case b <= 3:
+			for range b {
+				g.emit(z80.IncHLInd())
+			}
+		case b >= 0xFD:
+			for range -int8(b) {
+				g.emit(z80.DecHLInd())
+			}
+		default:
+			g.emit(z80.LdAHL(), z80.AddAImm(b), z80.LdHLA())
+		}
+		return
+	}
+
+	g.emit(z80.LdAHL())
+	switch {
+	case cells.Signed:
+		// P/V is only meaningful for an addend in [-128, 127]
+		for k != 0 {
+			step := max(-128, min(127, k))
+			g.emit(z80.AddAImm(byte(step)))
+			g.emitChecked(z80.PE, step)
+			k -= step
+		}
+	case k > 0:
+		g.emit(z80.AddAImm(byte(k)))
+		g.emitChecked(z80.C, k)
+	default:
+		g.emit(z80.SubImm(byte(-k)))
+		g.emitChecked(z80.C, k)
+	}
+	g.emit(z80.LdHLA())
+}
+
+// emitChecked outputs the saturate clamp or trap jump after an add of k,
+// taken when the condition overflow holds.
+func (g *Generator) emitChecked(overflow z80.Cond, k int) {
+	if g.opts.Cells.Overflow == core.OverflowSaturate {
+		// jp past the clamp, which is two bytes
+		g.emit(z80.JpCond(overflow.Invert(), g.here(3+2)), z80.LdAImm(byte(g.clamp(k))))
+		return
+	}
+	g.emitAbs(z80.JpCond(overflow, 0), fixupTrap, false, 0)
+}
+
+// clamp returns the value an add of k saturates to.
+func (g *Generator) clamp(k int) int {
+	if k > 0 {
+		return g.opts.Cells.Max()
+	}
+	return g.opts.Cells.Min()
+}
+
+// emitZeroRange clears n cells from the data pointer, with LDIR copying
+// the first cell's zero on through the rest.
+func (g *Generator) emitZeroRange(n int) {
+	g.emit(z80.LdHLImm(0))
+	if n < 2 {
+		return
+	}
+	g.emit(z80.PushHL(), z80.LdDH(), z80.LdEL(), z80.IncDE())
+	g.emit(z80.LdBC(uint16(n-1)), z80.Ldir(), z80.PopHL())
+}
+
+// emitCopyRange copies n cells from the data pointer to d cells away,
+// with LDIR. The optimiser only emits non-overlapping ranges.
+func (g *Generator) emitCopyRange(n, d int) {
+	// DE = HL + d, keeping HL
+	g.emit(z80.PushHL(), z80.LdDE(uint16(d)), z80.ExDEHL(), z80.AddHLDE(), z80.ExDEHL())
+	g.emit(z80.LdBC(uint16(n)), z80.Ldir(), z80.PopHL())
+}
+
+// resolveFixups patches every absolute address with its target's.
+func (g *Generator) resolveFixups() {
+	for _, f := range g.fixups {
+		var target int
+		switch {
+		case f.target < 0:
+			target = g.helpers[f.target] + f.add
+		case f.loopEnd:
+			target = g.loopEnd[f.target]
+		default:
+			target = g.loopBody[f.target]
+		}
+		binary.LittleEndian.PutUint16(g.code[f.at:], uint16(CodeBase+target))
+	}
+}
@@ -0,0 +1,455 @@
+package darwin
+
+import (
+	"github.com/lcox74/bfcc/internal/codegen/linux"
+	"github.com/lcox74/bfcc/internal/core"
+	a64 "github.com/lcox74/bfcc/pkg/arm64"
+	"github.com/lcox74/bfcc/pkg/macho"
+)
+
+// macOS arm64 system calls: the BSD call number goes in x16 with no class,
+// and svc #0x80 traps to the kernel. A failed call sets the carry flag and
+// returns errno.
+const (
+	arm64SysExit  = 1
+	arm64SysRead  = 3
+	arm64SysWrite = 4
+	arm64Svc      = 0x80
+)
+
+// ARM64CodeBase is the virtual address of the arm64 code, after the Mach-O
+// headers. The tape follows the code, at the next page, and the whole image
+// slides when loaded.
+const ARM64CodeBase = macho.DefaultARM64CodeBase
+
+// trapMsg is written to stderr by _bf_trap before exiting.
+const trapMsg = "bfcc: cell overflow\n"
+
+// Special fixup targets for runtime helpers and data.
+const (
+	fixupRead    = -1 // _bf_read helper
+	fixupWrite   = -2 // _bf_write helper
+	fixupTrap    = -3 // _bf_trap helper
+	fixupTrapMsg = -4 // trap message bytes
+	fixupTape    = -5 // the tape, after the code
+)
+
+// a64FixupKind is the instruction an arm64 fixup patches.
+type a64FixupKind int
+
+const (
+	a64Jump a64FixupKind = iota // b
+	a64Call                     // bl
+	a64Adr                      // adr into reg
+	a64Adrp                     // adrp of the target's page into reg
+)
+
+// a64Fixup records an instruction to patch once the target's offset is
+// known.
+type a64Fixup struct {
+	offset    int // Offset in code of the instruction
+	targetIdx int // loop label of the jump target, or a special target
+	loopEnd   bool
+	kind      a64FixupKind
+	reg       a64.Reg // destination for a64Adr and a64Adrp
+}
+
+// ARM64Costs is the size in bytes of the code for each op, for the
+// optimiser, with the wrapping cell model. SHIFTs past an add immediate
+// take a mov and an add.
+var ARM64Costs = core.CostModel{Name: "arm64", Shift: 4, FarShift: 8, NearShift: 4095, Add: 12, Zero: 4, IO: 4, Jump: 12, Range: 24}
+
+// ARM64Generator produces arm64 machine code for Apple silicon Macs from
+// IR operations. It takes the linux package's Options, but only supports
+// the cell model, mid-tape, debug and progress ones.
+//
+// X19 holds the tape base and X20 the address of the current cell; X9 to
+// X12 are scratch. The code is position independent, reaching the tape
+// with adrp.
+type ARM64Generator struct {
+	ops       []core.Op
+	code      []byte
+	loopStart map[int]int // loop label -> code offset of its JZ
+	loopEnd   map[int]int // loop label -> code offset just past its JNZ
+	helpers   map[int]int // special fixup target -> code offset
+	fixups    []a64Fixup
+	opts      linux.Settings
+}
+
+// NewARM64Generator creates a new arm64 machine code generator.
+func NewARM64Generator(ops []core.Op, opts ...linux.Option) *ARM64Generator {
+	return &ARM64Generator{
+		ops:       ops,
+		code:      make([]byte, 0, 4096),
+		loopStart: make(map[int]int),
+		loopEnd:   make(map[int]int),
+		helpers:   make(map[int]int),
+		opts:      linux.ApplyOptions(opts...),
+	}
+}
+
+// Generate produces raw arm64 machine code, for loading at ARM64CodeBase.
+func (g *ARM64Generator) Generate() []byte {
+	g.emitPrologue()
+
+	for i, op := range g.ops {
+		if op.Kind == core.OpJz {
+			g.loopStart[op.Arg] = len(g.code)
+		}
+		g.emitOp(op)
+		if op.Kind == core.OpJnz {
+			g.loopEnd[op.Arg] = len(g.code)
+		}
+		if progress := g.opts.Progress; progress != nil && (i+1)%linux.ProgressEvery == 0 {
+			progress(i+1, len(g.ops))
+		}
+	}
+	if g.opts.Progress != nil {
+		g.opts.Progress(len(g.ops), len(g.ops))
+	}
+
+	g.emitEpilogue()
+	g.emitHelpers()
+	g.helpers[fixupTape] = int(g.tapeBase() - ARM64CodeBase)
+	g.resolveFixups()
+
+	return g.code
+}
+
+// GenerateMachO produces a complete, ad-hoc signed Mach-O 64 executable.
+func (g *ARM64Generator) GenerateMachO() []byte {
+	code := g.Generate()
+
+	builder := macho.NewARM64Builder()
+	builder.SetEntry(ARM64CodeBase)
+	builder.SetText(code, ARM64CodeBase)
+	builder.AddZeroFillSegment("__DATA", "__bss", g.tapeBase(), core.TapeSize, macho.VM_PROT_READ|macho.VM_PROT_WRITE)
+
+	return builder.Build()
+}
+
+// tapeBase returns the virtual address of the tape: the first page after
+// the code.
+func (g *ARM64Generator) tapeBase() uint64 {
+	end := ARM64CodeBase + uint64(len(g.code))
+	return (end + macho.ARM64PageSize - 1) &^ (macho.ARM64PageSize - 1)
+}
+
+// emit appends instructions to the code buffer.
+func (g *ARM64Generator) emit(insns ...[]byte) {
+	for _, b := range insns {
+		g.code = append(g.code, b...)
+	}
+}
+
+// emitFixup emits a placeholder instruction for f, patched by
+// resolveFixups.
+func (g *ARM64Generator) emitFixup(f a64Fixup) {
+	f.offset = len(g.code)
+	g.fixups = append(g.fixups, f)
+	g.emit(a64.Nop()) // Placeholder
+}
+
+// emitCall outputs a call to a runtime helper.
+func (g *ARM64Generator) emitCall(helper int) {
+	g.emitFixup(a64Fixup{targetIdx: helper, kind: a64Call})
+}
+
+// emitAddImm outputs rd = rs + imm, through X9 when imm does not fit an add
+// or sub. rd and rs must not be X9 in that case.
+func (g *ARM64Generator) emitAddImm(rd, rs a64.Reg, imm int) {
+	switch {
+	case a64.FitsImm12(int64(imm)):
+		g.emit(a64.AddImm(rd, rs, uint32(imm)))
+	case a64.FitsImm12(int64(-imm)):
+		g.emit(a64.SubImm(rd, rs, uint32(-imm)))
+	default:
+		g.emit(a64.MovImm(a64.X9, int64(imm)), a64.Add(rd, rs, a64.X9))
+	}
+}
+
+// emitSyscall outputs a system call, with its arguments already in x0 to
+// x2.
+func (g *ARM64Generator) emitSyscall(num uint16) {
+	g.emit(a64.Movz(a64.X16, num, 0), a64.Svc(arm64Svc))
+}
+
+// emitPrologue outputs the program start: load X19 with the tape base and
+// X20 with the first cell. dyld calls it as main, but it never returns.
+func (g *ARM64Generator) emitPrologue() {
+	g.emitFixup(a64Fixup{targetIdx: fixupTape, kind: a64Adrp, reg: a64.X19}) // adrp x19, tape
+	g.emitStartPointer()
+}
+
+// emitStartPointer points X20 at the first cell: 0, or the middle of the
+// tape with WithMidTape.
+func (g *ARM64Generator) emitStartPointer() {
+	if g.opts.MidTape {
+		g.emitAddImm(a64.X20, a64.X19, core.TapeSize/2) // x20 = x19 + 15000
+		return
+	}
+	g.emit(a64.Mov(a64.X20, a64.X19)) // mov x20, x19
+}
+
+// emitEpilogue outputs the exit(0) syscall.
+func (g *ARM64Generator) emitEpilogue() {
+	g.emit(a64.Movz(a64.X0, 0, 0)) // mov x0, #0
+	g.emitSyscall(arm64SysExit)
+	if g.opts.Debug {
+		g.emit(a64.Brk(0)) // brk #0
+	}
+}
+
+// alignCode pads the code buffer up to a multiple of align bytes: with brk
+// in debug builds, where padding is never meant to run, otherwise with
+// nop.
+func (g *ARM64Generator) alignCode(align int) {
+	for len(g.code)%align != 0 {
+		if g.opts.Debug {
+			g.emit(a64.Brk(0))
+		} else {
+			g.emit(a64.Nop())
+		}
+	}
+}
+
+// emitHelpers outputs the I/O helper functions, and the trap helper and
+// its message for the trap policy.
+func (g *ARM64Generator) emitHelpers() {
+	g.alignCode(16)
+
+	// _bf_read: read(0, x20, 1), storing EOF when it returns 0
+	g.helpers[fixupRead] = len(g.code)
+	g.emit(
+		a64.Movz(a64.X0, 0, 0),   // mov x0, #0 - stdin
+		a64.Mov(a64.X1, a64.X20), // mov x1, x20
+		a64.Movz(a64.X2, 1, 0),   // mov x2, #1
+	)
+	g.emitSyscall(arm64SysRead)
+	g.emit(
+		a64.Cbnz(a64.X0, 12),                          // cbnz w0, over the store
+		a64.MovzW(a64.X9, uint16(g.opts.Cells.EOF())), // mov w9, #0 (or 255)
+		a64.Strb(a64.X9, a64.X20, 0),                  // strb w9, [x20]
+		a64.Ret(),                                     // ret
+	)
+
+	// _bf_write: write(1, x20, 1)
+	g.helpers[fixupWrite] = len(g.code)
+	g.emit(
+		a64.Movz(a64.X0, 1, 0),   // mov x0, #1 - stdout
+		a64.Mov(a64.X1, a64.X20), // mov x1, x20
+		a64.Movz(a64.X2, 1, 0),   // mov x2, #1
+	)
+	g.emitSyscall(arm64SysWrite)
+	g.emit(a64.Ret()) // ret
+
+	if g.opts.Cells.Overflow == core.OverflowTrap {
+		g.emitTrapHelper()
+	}
+}
+
+// emitTrapHelper outputs _bf_trap, which reports a cell overflow on stderr
+// and exits with status 1, followed by the message it prints.
+func (g *ARM64Generator) emitTrapHelper() {
+	g.helpers[fixupTrap] = len(g.code)
+	g.emitFixup(a64Fixup{targetIdx: fixupTrapMsg, kind: a64Adr, reg: a64.X1}) // adr x1, trap_msg
+	g.emit(
+		a64.Movz(a64.X0, 2, 0),                    // mov x0, #2 - stderr
+		a64.Movz(a64.X2, uint16(len(trapMsg)), 0), // mov x2, #len
+	)
+	g.emitSyscall(arm64SysWrite)
+	g.emit(a64.Movz(a64.X0, 1, 0)) // mov x0, #1
+	g.emitSyscall(arm64SysExit)
+
+	g.helpers[fixupTrapMsg] = len(g.code)
+	g.emit([]byte(trapMsg))
+}
+
+// emitOp outputs machine code for a single IR operation.
+func (g *ARM64Generator) emitOp(op core.Op) {
+	switch op.Kind {
+	case core.OpShift:
+		g.emitShift(op.Arg)
+	case core.OpAdd:
+		g.emitAdd(op.Arg)
+	case core.OpZero:
+		g.emit(a64.Strb(a64.ZR, a64.X20, 0)) // strb wzr, [x20]
+	case core.OpIn:
+		g.emitCall(fixupRead)
+	case core.OpOut:
+		g.emitCall(fixupWrite)
+	case core.OpJz:
+		g.emitLoopJump(op.Arg, true)
+	case core.OpJnz:
+		g.emitLoopJump(op.Arg, false)
+	case core.OpSection:
+		g.emitSection(core.Handoff(op.Arg))
+	case core.OpTrap:
+		g.emit(a64.Brk(0)) // brk #0
+	case core.OpZeroRange:
+		g.emitZeroRange(op.Arg)
+	case core.OpCopyRange:
+		g.emitCopyRange(op.Arg, op.Off)
+	}
+}
+
+// emitShift outputs: add x20, x20, #k (or sub, or through x9)
+func (g *ARM64Generator) emitShift(k int) {
+	if k == 0 {
+		return
+	}
+	g.emitAddImm(a64.X20, a64.X20, k)
+}
+
+// emitAdd outputs a load, add and store of the current cell. Under the
+// saturate and trap policies the sum is range checked before the store,
+// in 32 bits so it cannot itself overflow.
+func (g *ARM64Generator) emitAdd(k int) {
+	if k == 0 {
+		return
+	}
+
+	if g.opts.Cells.Overflow == core.OverflowWrap {
+		g.emit(
+			a64.Ldrb(a64.X9, a64.X20, 0),                  // ldrb w9, [x20]
+			a64.AddImmW(a64.X9, a64.X9, uint32(uint8(k))), // add w9, w9, #k
+			a64.Strb(a64.X9, a64.X20, 0),                  // strb w9, [x20]
+		)
+		return
+	}
+
+	clamp := g.opts.Cells.Max()
+	if k < 0 {
+		clamp = g.opts.Cells.Min()
+	}
+
+	if g.opts.Cells.AlwaysOverflows(k) {
+		if g.opts.Cells.Overflow == core.OverflowTrap {
+			g.emitFixup(a64Fixup{targetIdx: fixupTrap, kind: a64Jump}) // b _bf_trap
+			return
+		}
+		g.emit(
+			a64.MovzW(a64.X9, uint16(uint8(clamp))), // mov w9, #clamp
+			a64.Strb(a64.X9, a64.X20, 0),            // strb w9, [x20]
+		)
+		return
+	}
+
+	addK := a64.AddImmW(a64.X9, a64.X9, uint32(k)) // add w9, w9, #k
+	if k < 0 {
+		addK = a64.SubImmW(a64.X9, a64.X9, uint32(-k)) // sub w9, w9, #-k
+	}
+
+	// The sum is in range when it is 0 to 255, or -128 to 127 for signed
+	// cells, checked as an unsigned compare after a bias of 128
+	if g.opts.Cells.Signed {
+		g.emit(
+			a64.Ldrsb(a64.X9, a64.X20, 0), // ldrsb w9, [x20]
+			addK,
+			a64.AddImmW(a64.X10, a64.X9, 128), // add w10, w9, #128
+			a64.CmpImmW(a64.X10, 255),         // cmp w10, #255
+		)
+	} else {
+		g.emit(
+			a64.Ldrb(a64.X9, a64.X20, 0), // ldrb w9, [x20]
+			addK,
+			a64.CmpImmW(a64.X9, 255), // cmp w9, #255
+		)
+	}
+
+	g.emit(a64.BCond(a64.LS, 8)) // b.ls, over the clamp or jump
+	if g.opts.Cells.Overflow == core.OverflowSaturate {
+		g.emit(a64.MovzW(a64.X9, uint16(uint8(clamp)))) // mov w9, #clamp
+	} else {
+		g.emitFixup(a64Fixup{targetIdx: fixupTrap, kind: a64Jump}) // b _bf_trap
+	}
+	g.emit(a64.Strb(a64.X9, a64.X20, 0)) // strb w9, [x20]
+}
+
+// emitLoopJump outputs the test and jump of a JZ or JNZ: a cbz or cbnz
+// over a b to past the loop's JNZ, or back to its JZ. cbz only reaches
+// ±1 MiB, so the jump is separate to keep every loop the same shape.
+func (g *ARM64Generator) emitLoopJump(label int, jz bool) {
+	g.emit(a64.Ldrb(a64.X9, a64.X20, 0)) // ldrb w9, [x20]
+	if jz {
+		g.emit(a64.Cbnz(a64.X9, 8)) // cbnz w9, into the loop
+	} else {
+		g.emit(a64.Cbz(a64.X9, 8)) // cbz w9, out of the loop
+	}
+	g.emitFixup(a64Fixup{targetIdx: label, loopEnd: jz, kind: a64Jump})
+}
+
+// emitByteLoop outputs a loop clearing n cells from X10 on, or copying
+// them to X12 on. X11 counts down.
+func (g *ARM64Generator) emitByteLoop(n int, copying bool) {
+	g.emit(a64.MovImm(a64.X11, int64(n))) // mov x11, #n
+
+	// loop:
+	start := len(g.code)
+	if copying {
+		g.emit(
+			a64.LdrbPost(a64.X9, a64.X10, 1), // ldrb w9, [x10], #1
+			a64.StrbPost(a64.X9, a64.X12, 1), // strb w9, [x12], #1
+		)
+	} else {
+		g.emit(a64.StrbPost(a64.ZR, a64.X10, 1)) // strb wzr, [x10], #1
+	}
+	g.emit(a64.SubsImm(a64.X11, a64.X11, 1))            // subs x11, x11, #1
+	g.emit(a64.BCond(a64.NE, int32(start-len(g.code)))) // b.ne loop
+}
+
+// emitZeroRange clears n cells from the data pointer.
+func (g *ARM64Generator) emitZeroRange(n int) {
+	g.emit(a64.Mov(a64.X10, a64.X20)) // mov x10, x20
+	g.emitByteLoop(n, false)
+}
+
+// emitCopyRange copies n cells from the data pointer to d cells along. The
+// optimiser only emits non-overlapping ranges, so copying forwards is
+// always safe.
+func (g *ARM64Generator) emitCopyRange(n, d int) {
+	g.emit(a64.Mov(a64.X10, a64.X20)) // mov x10, x20
+	g.emitAddImm(a64.X12, a64.X20, d)
+	g.emitByteLoop(n, true)
+}
+
+// emitSection starts the next chained program, zeroing the tape first for
+// core.HandoffReset.
+func (g *ARM64Generator) emitSection(h core.Handoff) {
+	if h == core.HandoffReset {
+		g.emit(a64.Mov(a64.X10, a64.X19)) // mov x10, x19
+		g.emitByteLoop(core.TapeSize, false)
+	}
+	g.emitStartPointer()
+}
+
+// resolveFixups patches all jump, call and address targets.
+func (g *ARM64Generator) resolveFixups() {
+	for _, f := range g.fixups {
+		var target int
+		switch {
+		case f.targetIdx < 0:
+			target = g.helpers[f.targetIdx]
+		case f.loopEnd:
+			target = g.loopEnd[f.targetIdx]
+		default:
+			target = g.loopStart[f.targetIdx]
+		}
+
+		off := int32(target - f.offset)
+		var insn []byte
+		switch f.kind {
+		case a64Jump:
+			insn = a64.B(off)
+		case a64Call:
+			insn = a64.Bl(off)
+		case a64Adr:
+			insn = a64.Adr(f.reg, off)
+		case a64Adrp:
+			pc := ARM64CodeBase + uint64(f.offset)
+			pages := int64((ARM64CodeBase+uint64(target))>>12) - int64(pc>>12)
+			insn = a64.Adrp(f.reg, int32(pages))
+		}
+		copy(g.code[f.offset:], insn)
+	}
+}
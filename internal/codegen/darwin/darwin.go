@@ -0,0 +1,68 @@
+// Package darwin produces x86_64 and arm64 macOS executables from IR
+// operations. The x86_64 code is the linux package's with BSD system
+// calls, loaded by a static Mach-O executable from pkg/macho; the arm64
+// code has its own generator, for a signed executable started by dyld.
+package darwin
+
+import (
+	"github.com/lcox74/bfcc/internal/codegen/linux"
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/pkg/macho"
+)
+
+// Syscalls is the macOS x86_64 system call interface: BSD calls are class
+// 2 (0x2000000) plus their number, and a failed call sets CF and returns
+// errno. macOS has none of the calls only some features make.
+var Syscalls = linux.Syscalls{
+	Read:           0x2000003,
+	Write:          0x2000004,
+	Mmap:           0x20000c5,
+	Exit:           0x2000001,
+	Writev:         0x2000079,
+	Open:           0x2000005,
+	MapAnonPrivate: 0x1002, // MAP_ANON|MAP_PRIVATE
+	OpenTrunc:      0x601,  // O_WRONLY|O_CREAT|O_TRUNC
+	CarryError:     true,
+}
+
+// Memory layout constants
+const (
+	CodeBase = macho.DefaultCodeBase // Virtual address of the code, after the Mach-O headers
+	DataBase = macho.DefaultDataBase // Virtual address of the tape
+)
+
+// X86_64Generator produces x86_64 macOS executables.
+type X86_64Generator struct {
+	gen *linux.X86_64Generator
+}
+
+// NewX86_64Generator creates a generator taking the linux package's
+// options. Those that add ELF sections, linux.WithSourceMap and
+// linux.WithSymbols, have no effect on the Mach-O output.
+func NewX86_64Generator(ops []core.Op, opts ...linux.Option) *X86_64Generator {
+	opts = append(opts, linux.WithSyscalls(Syscalls), linux.WithLoadAddress(CodeBase, DataBase))
+	return &X86_64Generator{gen: linux.NewX86_64Generator(ops, opts...)}
+}
+
+// Generate produces raw x86_64 machine code.
+func (g *X86_64Generator) Generate() []byte {
+	return g.gen.Generate()
+}
+
+// GenerateMachO produces a complete Mach-O 64 executable.
+func (g *X86_64Generator) GenerateMachO() []byte {
+	code := g.Generate()
+
+	builder := macho.NewBuilder()
+	builder.SetEntry(CodeBase)
+	builder.SetText(code, CodeBase)
+	builder.AddZeroFillSegment("__DATA", "__bss", DataBase, core.TapeSize, macho.VM_PROT_READ|macho.VM_PROT_WRITE)
+
+	return builder.Build()
+}
+
+// Err returns the error from the last Generate, if it needed a system
+// call macOS lacks.
+func (g *X86_64Generator) Err() error {
+	return g.gen.Err()
+}
@@ -0,0 +1,528 @@
+// Package ebpf produces eBPF programs from IR operations, to run bounded
+// Brainfuck programs inside the Linux kernel, and loads and runs them. It
+// is a research and teaching backend: the programs run as socket filters
+// through BPF_PROG_TEST_RUN, with their I/O passed through a map.
+//
+// The verifier rejects any loop it cannot prove to end, so the program's
+// loops are not jumps back. Instead the program is a bpf_loop callback
+// that runs from a resume point to the next JNZ taken, saves where it got
+// to, and returns for bpf_loop to call it again, up to a budget of
+// iterations. The callback only ever jumps forward, so the verifier checks
+// each path through it once. The resume points are the start of the
+// program and the start of each loop body, picked by a chain of compares
+// at the top of the callback.
+//
+// All state lives in the one element of an array map, laid out as:
+//
+//	HeaderSize bytes    pc, dp, budget, loops, status, I/O positions (u32s)
+//	core.TapeSize bytes the tape
+//	InputSize bytes     input, refilled by the loader between runs
+//	OutputSize bytes    output, drained by the loader between runs
+//
+// The callback returns early for the loader to drain and refill the
+// buffers once either is half used, so a program's I/O is only limited
+// by how much one loop iteration does.
+package ebpf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/lcox74/bfcc/internal/codegen/linux"
+	"github.com/lcox74/bfcc/internal/core"
+	bpf "github.com/lcox74/bfcc/pkg/ebpf"
+)
+
+// Offsets of the state header's fields.
+const (
+	pcOff     = 0  // resume point: 0 for the start, or a loop label + 1
+	dpOff     = 4  // the data pointer, saved at a resume point
+	budgetOff = 8  // iterations bpf_loop may run, set by the loader
+	loopsOff  = 12 // iterations bpf_loop ran, for the loader
+	statusOff = 16 // a Status
+	inPosOff  = 20 // input bytes read
+	inLenOff  = 24 // input bytes in the buffer
+	inEndOff  = 28 // 1 if the buffer ends at the end of the input
+	outLenOff = 32 // output bytes written
+)
+
+// Layout of the map value.
+const (
+	HeaderSize = 40
+	InputSize  = 1 << 16
+	OutputSize = 1 << 16
+	TapeOff    = HeaderSize
+	InputOff   = TapeOff + core.TapeSize
+	OutputOff  = InputOff + InputSize
+	ValueSize  = OutputOff + OutputSize
+)
+
+// Status is how far a program got, as the callback leaves it in the state.
+type Status uint32
+
+// Statuses. A program still StatusRunning when bpf_loop returns has used
+// its budget, or stopped for its I/O.
+const (
+	StatusRunning  Status = iota
+	StatusDone            // ran to the end
+	StatusTape            // the data pointer left the tape
+	StatusOverflow        // a cell overflowed under the trap policy
+	StatusTrap            // reached a TRAP op
+	StatusIO              // one loop iteration read or wrote more than a buffer holds
+)
+
+// Errors for the statuses a program fails with.
+var (
+	ErrLoopLimit = errors.New("loop iteration limit reached")
+	ErrTape      = errors.New("data pointer moved off the tape")
+	ErrOverflow  = errors.New("cell overflow")
+	ErrTrap      = errors.New("reached unreachable code")
+	ErrIO        = errors.New("too much I/O in one loop iteration")
+)
+
+// Err returns the error for a failed status, or nil.
+func (s Status) Err() error {
+	switch s {
+	case StatusTape:
+		return ErrTape
+	case StatusOverflow:
+		return ErrOverflow
+	case StatusTrap:
+		return ErrTrap
+	case StatusIO:
+		return ErrIO
+	}
+	return nil
+}
+
+// Special fixup targets: the callback, and the stubs it jumps to.
+const (
+	targetStep     = -1 // the callback, for the main function's LoadFunc
+	targetSuspend  = -2 // return 1, for the loader to drain and refill the buffers
+	targetTape     = -3
+	targetOverflow = -4
+	targetTrap     = -5
+	targetIO       = -6
+)
+
+// stubStatus is the status each failure stub sets.
+var stubStatus = map[int]Status{
+	targetTape:     StatusTape,
+	targetOverflow: StatusOverflow,
+	targetTrap:     StatusTrap,
+	targetIO:       StatusIO,
+}
+
+// Registers of the callback.
+const (
+	regState = bpf.R6 // the map value
+	regDP    = bpf.R7 // the data pointer, checked to be on the tape
+	regPC    = bpf.R8 // the resume point, while dispatching
+	regCell  = bpf.R9 // regState + regDP, the cell is at TapeOff from it
+)
+
+// License is the license the program is loaded under. The helpers it
+// calls are not GPL only.
+const License = "Dual MIT/GPL"
+
+// Costs is the size in bytes of the code for each op, for the optimiser,
+// with the wrapping cell model.
+var Costs = core.CostModel{Name: "ebpf", Shift: 40, Add: 24, Zero: 8, IO: 80, Jump: 48, Range: 24}
+
+// Program is a generated eBPF program: its instructions, and the BTF and
+// func_info describing its two functions, the main function and the
+// bpf_loop callback, which the kernel needs to load it. The map it uses is
+// fd_array[0], an array of one ValueSize element with a 4-byte key.
+type Program struct {
+	Code     []byte
+	BTF      []byte
+	FuncInfo []bpf.FuncInfo
+}
+
+// fixup records a jump, or the callback's address, to patch once the
+// target is known.
+type fixup struct {
+	at      int // instruction index
+	target  int // loop label, or a special target
+	loopEnd bool
+}
+
+// Generator produces an eBPF program from IR operations. It takes the
+// linux package's Options, but only supports the cell model, mid-tape,
+// debug and progress ones.
+type Generator struct {
+	ops      []core.Op
+	code     []byte
+	opts     linux.Settings
+	loopBody map[int]int // loop label -> instruction index of its body
+	loopEnd  map[int]int // loop label -> instruction index just past its JNZ
+	stubs    map[int]int // special target -> instruction index
+	fixups   []fixup
+}
+
+// NewGenerator creates a new eBPF generator.
+func NewGenerator(ops []core.Op, opts ...linux.Option) *Generator {
+	return &Generator{
+		ops:      ops,
+		code:     make([]byte, 0, 4096),
+		opts:     linux.ApplyOptions(opts...),
+		loopBody: make(map[int]int),
+		loopEnd:  make(map[int]int),
+		stubs:    make(map[int]int),
+	}
+}
+
+// Generate produces the program. It fails if the program is too large
+// for a jump to reach from the dispatch to a loop body, or over one.
+func (g *Generator) Generate() (*Program, error) {
+	g.emitMain()
+
+	step := g.pc()
+	g.stubs[targetStep] = step
+	g.emitStepEntry()
+	g.emitStartPointer()
+
+	for i, op := range g.ops {
+		g.emitOp(op)
+		if progress := g.opts.Progress; progress != nil && (i+1)%linux.ProgressEvery == 0 {
+			progress(i+1, len(g.ops))
+		}
+	}
+	if g.opts.Progress != nil {
+		g.opts.Progress(len(g.ops), len(g.ops))
+	}
+
+	g.emitExit(StatusDone)
+	g.emitStubs()
+	if err := g.resolveFixups(); err != nil {
+		return nil, err
+	}
+
+	btf := bpf.NewBTF()
+	long := btf.Int("long", 8, true)
+	ctx := btf.Ptr(0)
+	main := btf.Func("bf_main", btf.FuncProto(long, bpf.Param{Name: "ctx", Type: ctx}), bpf.LinkageGlobal)
+	cb := btf.Func("bf_step", btf.FuncProto(long, bpf.Param{Name: "index", Type: long}, bpf.Param{Name: "ctx", Type: ctx}), bpf.LinkageStatic)
+
+	return &Program{
+		Code:     g.code,
+		BTF:      btf.Build(),
+		FuncInfo: []bpf.FuncInfo{{Insn: 0, Type: main}, {Insn: uint32(step), Type: cb}},
+	}, nil
+}
+
+// pc returns the index of the next instruction.
+func (g *Generator) pc() int {
+	return len(g.code) / bpf.InsnSize
+}
+
+// emit appends instructions to the code buffer.
+func (g *Generator) emit(insns ...[]byte) {
+	for _, b := range insns {
+		g.code = append(g.code, b...)
+	}
+}
+
+// emitJump emits a jump to target, patched by resolveFixups.
+func (g *Generator) emitJump(b []byte, target int, loopEnd bool) {
+	g.fixups = append(g.fixups, fixup{at: g.pc(), target: target, loopEnd: loopEnd})
+	g.emit(b)
+}
+
+// emitLookup looks up the state, leaving a pointer to it or NULL in R0.
+func (g *Generator) emitLookup() {
+	g.emit(
+		bpf.StoreImm(bpf.W, bpf.R10, -4, 0), // key = 0
+		bpf.MovReg(bpf.R2, bpf.R10),
+		bpf.AddImm(bpf.R2, -4),
+		bpf.LoadMapIdx(bpf.R1, 0),
+		bpf.Call(bpf.HelperMapLookupElem),
+	)
+}
+
+// emitMain outputs the main function: run the callback with bpf_loop for
+// the budget the loader set, and record how many iterations it ran.
+func (g *Generator) emitMain() {
+	g.emitLookup()
+	g.emit(bpf.JumpImm(bpf.JNE, bpf.R0, 0, 2), bpf.MovImm(bpf.R0, 0), bpf.Exit())
+	g.emit(
+		bpf.MovReg(regState, bpf.R0),
+		bpf.Load(bpf.W, bpf.R1, regState, budgetOff),
+	)
+	g.emitJump(bpf.LoadFunc(bpf.R2, 0), targetStep, false)
+	g.emit(
+		bpf.MovImm(bpf.R3, 0), // ctx
+		bpf.MovImm(bpf.R4, 0), // flags
+		bpf.Call(bpf.HelperLoop),
+		bpf.Store(bpf.W, regState, loopsOff, bpf.R0),
+		bpf.MovImm(bpf.R0, 0),
+		bpf.Exit(),
+	)
+}
+
+// emitStepEntry outputs the top of the callback: find the state, return
+// for the loader if a buffer needs attention, load the data pointer and
+// jump to the resume point. Resuming at the start falls through.
+func (g *Generator) emitStepEntry() {
+	g.emitLookup()
+	g.emit(bpf.JumpImm(bpf.JNE, bpf.R0, 0, 2), bpf.MovImm(bpf.R0, 1), bpf.Exit())
+	g.emit(bpf.MovReg(regState, bpf.R0))
+
+	g.emit(bpf.Load(bpf.W, bpf.R1, regState, outLenOff))
+	g.emitJump(bpf.JumpImm(bpf.JGE, bpf.R1, OutputSize/2, 0), targetSuspend, false)
+	g.emit(bpf.Load(bpf.W, bpf.R1, regState, inPosOff))
+	g.emitJump(bpf.JumpImm(bpf.JGE, bpf.R1, InputSize/2, 0), targetSuspend, false)
+
+	g.emit(bpf.Load(bpf.W, regDP, regState, dpOff))
+	g.emitPointer()
+
+	g.emit(bpf.Load(bpf.W, regPC, regState, pcOff))
+	for _, op := range g.ops {
+		if op.Kind == core.OpJz {
+			g.emitJump(bpf.JumpImm(bpf.JEQ, regPC, int32(op.Arg+1), 0), op.Arg, false)
+		}
+	}
+}
+
+// emitPointer checks the data pointer is on the tape, and points regCell
+// at it.
+func (g *Generator) emitPointer() {
+	g.emitJump(bpf.JumpImm(bpf.JGE, regDP, core.TapeSize, 0), targetTape, false)
+	g.emit(bpf.MovReg(regCell, regState), bpf.AddReg(regCell, regDP))
+}
+
+// emitStartPointer points the data pointer at the first cell: 0, or the
+// middle of the tape with WithMidTape.
+func (g *Generator) emitStartPointer() {
+	start := int32(0)
+	if g.opts.MidTape {
+		start = core.TapeSize / 2
+	}
+	g.emit(bpf.MovImm(regDP, start), bpf.MovReg(regCell, regState), bpf.AddReg(regCell, regDP))
+}
+
+// emitExit outputs a return ending bpf_loop, with status.
+func (g *Generator) emitExit(status Status) {
+	g.emit(
+		bpf.StoreImm(bpf.W, regState, statusOff, int32(status)),
+		bpf.MovImm(bpf.R0, 1),
+		bpf.Exit(),
+	)
+}
+
+// emitStubs outputs the suspend and failure returns the code jumps to.
+// Only the ones used are output, as the verifier rejects unreachable
+// instructions.
+func (g *Generator) emitStubs() {
+	used := make(map[int]bool)
+	for _, f := range g.fixups {
+		used[f.target] = true
+	}
+	g.stubs[targetSuspend] = g.pc()
+	g.emit(bpf.MovImm(bpf.R0, 1), bpf.Exit())
+	for _, target := range []int{targetTape, targetOverflow, targetTrap, targetIO} {
+		if used[target] {
+			g.stubs[target] = g.pc()
+			g.emitExit(stubStatus[target])
+		}
+	}
+}
+
+// emitOp outputs the instructions for a single IR operation.
+func (g *Generator) emitOp(op core.Op) {
+	switch op.Kind {
+	case core.OpShift:
+		if op.Arg != 0 {
+			g.emit(bpf.AddImm(regDP, int32(op.Arg)))
+			g.emitPointer()
+		}
+	case core.OpAdd:
+		g.emitAdd(op.Arg)
+	case core.OpZero:
+		g.emit(bpf.StoreImm(bpf.B, regCell, TapeOff, 0))
+	case core.OpIn:
+		g.emitIn()
+	case core.OpOut:
+		g.emitOut()
+	case core.OpJz:
+		g.emit(bpf.Load(bpf.B, bpf.R1, regCell, TapeOff))
+		g.emitJump(bpf.JumpImm(bpf.JEQ, bpf.R1, 0, 0), op.Arg, true)
+		g.loopBody[op.Arg] = g.pc()
+	case core.OpJnz:
+		g.emitJnz(op.Arg)
+	case core.OpSection:
+		g.emitSection(core.Handoff(op.Arg))
+	case core.OpTrap:
+		g.emitJump(bpf.Ja(0), targetTrap, false)
+	case core.OpZeroRange:
+		g.emitRangeCheck(bpf.R1, 0, op.Arg)
+		for i := range op.Arg {
+			g.emit(bpf.StoreImm(bpf.B, regCell, int16(TapeOff+i), 0))
+		}
+	case core.OpCopyRange:
+		g.emitRangeCheck(bpf.R1, 0, op.Arg)
+		g.emitRangeCheck(bpf.R2, op.Off, op.Arg)
+		for i := range op.Arg {
+			g.emit(
+				bpf.Load(bpf.B, bpf.R3, regCell, int16(TapeOff+i)),
+				bpf.Store(bpf.B, bpf.R2, int16(TapeOff+i), bpf.R3),
+			)
+		}
+	}
+}
+
+// emitRangeCheck checks the n cells from off cells away are on the tape,
+// leaving a pointer that is to the first of them, as regCell is to the
+// current cell, in r.
+func (g *Generator) emitRangeCheck(r bpf.Reg, off, n int) {
+	g.emit(bpf.MovReg(r, regDP), bpf.AddImm(r, int32(off)))
+	g.emitJump(bpf.JumpImm(bpf.JGT, r, int32(core.TapeSize-n), 0), targetTape, false)
+	g.emit(bpf.AddReg(r, regState))
+}
+
+// emitAdd outputs a load, add and store of the current cell. Under the
+// saturate and trap policies the sum is range checked before the store,
+// in 64 bits so it cannot itself overflow.
+func (g *Generator) emitAdd(k int) {
+	if k == 0 {
+		return
+	}
+
+	if g.opts.Cells.Overflow == core.OverflowWrap {
+		g.emit(
+			bpf.Load(bpf.B, bpf.R1, regCell, TapeOff),
+			bpf.AddImm(bpf.R1, int32(k)),
+			bpf.Store(bpf.B, regCell, TapeOff, bpf.R1),
+		)
+		return
+	}
+
+	clamp := g.opts.Cells.Max()
+	if k < 0 {
+		clamp = g.opts.Cells.Min()
+	}
+
+	if g.opts.Cells.AlwaysOverflows(k) {
+		if g.opts.Cells.Overflow == core.OverflowTrap {
+			g.emitJump(bpf.Ja(0), targetOverflow, false)
+			return
+		}
+		g.emit(bpf.StoreImm(bpf.B, regCell, TapeOff, int32(clamp)))
+		return
+	}
+
+	// The sum is in range when it is 0 to 255, or -128 to 127 for signed
+	// cells, checked as an unsigned compare after subtracting the minimum
+	g.emit(bpf.Load(bpf.B, bpf.R1, regCell, TapeOff))
+	if g.opts.Cells.Signed {
+		g.emit(bpf.XorImm(bpf.R1, 0x80), bpf.SubImm(bpf.R1, 0x80)) // sign-extend
+	}
+	g.emit(
+		bpf.AddImm(bpf.R1, int32(k)),
+		bpf.MovReg(bpf.R2, bpf.R1),
+		bpf.SubImm(bpf.R2, int32(g.opts.Cells.Min())),
+	)
+	if g.opts.Cells.Overflow == core.OverflowSaturate {
+		g.emit(bpf.JumpImm(bpf.JLE, bpf.R2, 255, 1), bpf.MovImm(bpf.R1, int32(clamp)))
+	} else {
+		g.emitJump(bpf.JumpImm(bpf.JGT, bpf.R2, 255, 0), targetOverflow, false)
+	}
+	g.emit(bpf.Store(bpf.B, regCell, TapeOff, bpf.R1))
+}
+
+// emitIn outputs a read of the next input byte into the current cell, or
+// EOF at the end of the input. Reading past the buffer before the end of
+// the input fails with StatusIO.
+func (g *Generator) emitIn() {
+	g.emit(
+		bpf.Load(bpf.W, bpf.R1, regState, inPosOff),
+		bpf.Load(bpf.W, bpf.R2, regState, inLenOff),
+		bpf.JumpReg(bpf.JLT, bpf.R1, bpf.R2, 4), // read
+		bpf.Load(bpf.W, bpf.R2, regState, inEndOff),
+	)
+	g.emitJump(bpf.JumpImm(bpf.JEQ, bpf.R2, 0, 0), targetIO, false)
+	g.emit(
+		bpf.StoreImm(bpf.B, regCell, TapeOff, int32(int8(g.opts.Cells.EOF()))),
+		bpf.Ja(7), // done
+	)
+
+	// read: the compare bounds the position for the verifier
+	g.emitJump(bpf.JumpImm(bpf.JGE, bpf.R1, InputSize, 0), targetIO, false)
+	g.emit(
+		bpf.MovReg(bpf.R2, regState),
+		bpf.AddReg(bpf.R2, bpf.R1),
+		bpf.Load(bpf.B, bpf.R3, bpf.R2, InputOff),
+		bpf.Store(bpf.B, regCell, TapeOff, bpf.R3),
+		bpf.AddImm(bpf.R1, 1),
+		bpf.Store(bpf.W, regState, inPosOff, bpf.R1),
+	)
+	// done:
+}
+
+// emitOut outputs an append of the current cell to the output buffer.
+func (g *Generator) emitOut() {
+	g.emit(bpf.Load(bpf.W, bpf.R1, regState, outLenOff))
+	g.emitJump(bpf.JumpImm(bpf.JGE, bpf.R1, OutputSize, 0), targetIO, false)
+	g.emit(
+		bpf.MovReg(bpf.R2, regState),
+		bpf.AddReg(bpf.R2, bpf.R1),
+		bpf.AddImm(bpf.R2, OutputOff), // past the reach of a 16-bit offset
+		bpf.Load(bpf.B, bpf.R3, regCell, TapeOff),
+		bpf.Store(bpf.B, bpf.R2, 0, bpf.R3),
+		bpf.AddImm(bpf.R1, 1),
+		bpf.Store(bpf.W, regState, outLenOff, bpf.R1),
+	)
+}
+
+// emitJnz outputs the end of a loop: if the cell is not zero, save the
+// loop body as the resume point and return for the next iteration.
+func (g *Generator) emitJnz(label int) {
+	g.emit(
+		bpf.Load(bpf.B, bpf.R1, regCell, TapeOff),
+		bpf.JumpImm(bpf.JEQ, bpf.R1, 0, 4), // past the loop
+		bpf.StoreImm(bpf.W, regState, pcOff, int32(label+1)),
+		bpf.Store(bpf.W, regState, dpOff, regDP),
+		bpf.MovImm(bpf.R0, 0),
+		bpf.Exit(),
+	)
+	g.loopEnd[label] = g.pc()
+}
+
+// emitSection starts the next chained program, zeroing the tape first for
+// core.HandoffReset.
+func (g *Generator) emitSection(h core.Handoff) {
+	if h == core.HandoffReset {
+		for i := 0; i < core.TapeSize; i += 8 {
+			g.emit(bpf.StoreImm(bpf.DW, regState, int16(TapeOff+i), 0))
+		}
+	}
+	g.emitStartPointer()
+}
+
+// resolveFixups patches all jump targets and the callback's address.
+func (g *Generator) resolveFixups() error {
+	for _, f := range g.fixups {
+		var target int
+		switch {
+		case f.target < 0:
+			target = g.stubs[f.target]
+		case f.loopEnd:
+			target = g.loopEnd[f.target]
+		default:
+			target = g.loopBody[f.target]
+		}
+
+		ins := g.code[f.at*bpf.InsnSize:]
+		off := target - (f.at + 1)
+		if f.target == targetStep {
+			binary.LittleEndian.PutUint32(ins[4:], uint32(off))
+			continue
+		}
+		if !bpf.FitsOffset(off) {
+			return fmt.Errorf("program too large for eBPF: a jump spans %d instructions", off)
+		}
+		binary.LittleEndian.PutUint16(ins[2:], uint16(int16(off)))
+	}
+	return nil
+}
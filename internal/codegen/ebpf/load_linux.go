@@ -0,0 +1,285 @@
+//go:build linux && amd64
+
+package ebpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	bpf "github.com/lcox74/bfcc/pkg/ebpf"
+)
+
+// sysBPF is the bpf system call on x86_64.
+const sysBPF = 321
+
+// bpf commands.
+const (
+	cmdMapCreate   = 0
+	cmdMapLookup   = 1
+	cmdMapUpdate   = 2
+	cmdProgLoad    = 5
+	cmdProgTestRun = 10
+	cmdBTFLoad     = 18
+)
+
+// Program and map types.
+const (
+	progTypeSocketFilter = 1
+	mapTypeArray         = 2
+)
+
+// packetSize is the size of the packet the program is test run on, the
+// least a socket filter takes: an Ethernet header.
+const packetSize = 14
+
+// logSize is the size of the buffer for the verifier's log when a load
+// fails.
+const logSize = 1 << 20
+
+// mapCreateAttr is bpf_attr for BPF_MAP_CREATE.
+type mapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	mapFlags   uint32
+	innerMapFD uint32
+	numaNode   uint32
+	mapName    [16]byte
+}
+
+// mapElemAttr is bpf_attr for BPF_MAP_LOOKUP_ELEM and BPF_MAP_UPDATE_ELEM.
+type mapElemAttr struct {
+	mapFD uint32
+	_     uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+// btfLoadAttr is bpf_attr for BPF_BTF_LOAD.
+type btfLoadAttr struct {
+	btf         uint64
+	btfLogBuf   uint64
+	btfSize     uint32
+	btfLogSize  uint32
+	btfLogLevel uint32
+}
+
+// progLoadAttr is bpf_attr for BPF_PROG_LOAD.
+type progLoadAttr struct {
+	progType           uint32
+	insnCnt            uint32
+	insns              uint64
+	license            uint64
+	logLevel           uint32
+	logSize            uint32
+	logBuf             uint64
+	kernVersion        uint32
+	progFlags          uint32
+	progName           [16]byte
+	progIfindex        uint32
+	expectedAttachType uint32
+	progBTFFD          uint32
+	funcInfoRecSize    uint32
+	funcInfo           uint64
+	funcInfoCnt        uint32
+	lineInfoRecSize    uint32
+	lineInfo           uint64
+	lineInfoCnt        uint32
+	attachBTFID        uint32
+	attachProgFD       uint32
+	coreReloCnt        uint32
+	fdArray            uint64
+}
+
+// testRunAttr is bpf_attr for BPF_PROG_TEST_RUN.
+type testRunAttr struct {
+	progFD      uint32
+	retval      uint32
+	dataSizeIn  uint32
+	dataSizeOut uint32
+	dataIn      uint64
+	dataOut     uint64
+	repeat      uint32
+	duration    uint32
+}
+
+// sys makes bpf command cmd with attr, returning the new file descriptor
+// for the commands that make one.
+func sys[T any](cmd uintptr, attr *T) (int, error) {
+	r, _, errno := syscall.Syscall(sysBPF, cmd, uintptr(unsafe.Pointer(attr)), unsafe.Sizeof(*attr))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
+
+// addr returns the address of the first byte of b, for an attr field.
+// The caller keeps b alive until the call is made.
+func addr(b []byte) uint64 {
+	return uint64(uintptr(unsafe.Pointer(unsafe.SliceData(b))))
+}
+
+// Run loads prog into the kernel and runs it until it ends, with input
+// fed to it and its output written to w a buffer at a time between runs.
+// maxLoops bounds the bpf_loop iterations, about one per loop iteration of
+// the program, 0 for no limit. It needs Linux 5.17 or later for bpf_loop,
+// and CAP_BPF.
+//
+// A program that fails returns the Status's error, or ErrLoopLimit, after
+// writing its output.
+func Run(prog *Program, input []byte, w io.Writer, maxLoops uint64) error {
+	btfFD, err := loadBTF(prog.BTF)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(btfFD)
+
+	mapAttr := mapCreateAttr{mapType: mapTypeArray, keySize: 4, valueSize: ValueSize, maxEntries: 1}
+	copy(mapAttr.mapName[:], "bf_state")
+	mapFD, err := sys(cmdMapCreate, &mapAttr)
+	if err != nil {
+		return fmt.Errorf("ebpf: creating the state map: %w", err)
+	}
+	defer syscall.Close(mapFD)
+
+	progFD, err := loadProgram(prog, btfFD, mapFD)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(progFD)
+
+	state := make([]byte, ValueSize)
+	packet := make([]byte, packetSize)
+	var loops uint64
+	for {
+		// Refill the input buffer from where the program got to
+		n := copy(state[InputOff:OutputOff], input)
+		put(state, inPosOff, 0)
+		put(state, inLenOff, uint32(n))
+		put(state, inEndOff, 0)
+		if n == len(input) {
+			put(state, inEndOff, 1)
+		}
+		put(state, outLenOff, 0)
+
+		budget := uint64(bpf.MaxLoops)
+		if maxLoops > 0 {
+			budget = min(budget, maxLoops-loops)
+		}
+		put(state, budgetOff, uint32(budget))
+
+		if err := mapElem(cmdMapUpdate, mapFD, state); err != nil {
+			return fmt.Errorf("ebpf: writing the state: %w", err)
+		}
+		run := testRunAttr{progFD: uint32(progFD), dataSizeIn: packetSize, dataIn: addr(packet)}
+		_, err := sys(cmdProgTestRun, &run)
+		runtime.KeepAlive(packet)
+		if err != nil {
+			return fmt.Errorf("ebpf: running the program: %w", err)
+		}
+		if err := mapElem(cmdMapLookup, mapFD, state); err != nil {
+			return fmt.Errorf("ebpf: reading the state: %w", err)
+		}
+
+		out := state[OutputOff:][:get(state, outLenOff)]
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+		input = input[get(state, inPosOff):]
+		loops += uint64(get(state, loopsOff))
+
+		status := Status(get(state, statusOff))
+		switch {
+		case status == StatusDone:
+			return nil
+		case status != StatusRunning:
+			return status.Err()
+		case maxLoops > 0 && loops >= maxLoops:
+			return ErrLoopLimit
+		}
+	}
+}
+
+// loadBTF loads the BTF blob b, returning its file descriptor.
+func loadBTF(b []byte) (int, error) {
+	attr := btfLoadAttr{btf: addr(b), btfSize: uint32(len(b))}
+	fd, err := sys(cmdBTFLoad, &attr)
+	runtime.KeepAlive(b)
+	if err != nil {
+		return 0, fmt.Errorf("ebpf: loading BTF: %w", err)
+	}
+	return fd, nil
+}
+
+// loadProgram loads prog with its BTF and state map, returning its file
+// descriptor. If the verifier rejects it, it is loaded again for the
+// verifier's log, the end of which is in the error.
+func loadProgram(prog *Program, btfFD, mapFD int) (int, error) {
+	license := []byte(License + "\x00")
+	funcInfo := bpf.EncodeFuncInfo(prog.FuncInfo)
+	fdArray := binary.LittleEndian.AppendUint32(nil, uint32(mapFD))
+	attr := progLoadAttr{
+		progType:        progTypeSocketFilter,
+		insnCnt:         uint32(len(prog.Code) / bpf.InsnSize),
+		insns:           addr(prog.Code),
+		license:         addr(license),
+		progBTFFD:       uint32(btfFD),
+		funcInfoRecSize: bpf.FuncInfoSize,
+		funcInfo:        addr(funcInfo),
+		funcInfoCnt:     uint32(len(prog.FuncInfo)),
+		fdArray:         addr(fdArray),
+	}
+	copy(attr.progName[:], "bf_main")
+
+	fd, err := sys(cmdProgLoad, &attr)
+	if err != nil {
+		log := make([]byte, logSize)
+		attr.logLevel, attr.logSize, attr.logBuf = 1, logSize, addr(log)
+		if _, lerr := sys(cmdProgLoad, &attr); lerr != nil {
+			err = fmt.Errorf("%w\n%s", err, logTail(log))
+		}
+	}
+	runtime.KeepAlive(prog.Code)
+	runtime.KeepAlive(license)
+	runtime.KeepAlive(funcInfo)
+	runtime.KeepAlive(fdArray)
+	if err != nil {
+		return 0, fmt.Errorf("ebpf: loading the program: %w", err)
+	}
+	return fd, nil
+}
+
+// logTail returns the last few lines of a verifier log, which say why the
+// program was rejected.
+func logTail(log []byte) []byte {
+	log, _, _ = bytes.Cut(log, []byte{0})
+	lines := bytes.Split(bytes.TrimSpace(log), []byte("\n"))
+	return bytes.Join(lines[max(0, len(lines)-5):], []byte("\n"))
+}
+
+// mapElem looks up or updates the state map's one element, at key 0.
+func mapElem(cmd uintptr, mapFD int, value []byte) error {
+	key := make([]byte, 4)
+	attr := mapElemAttr{mapFD: uint32(mapFD), key: addr(key), value: addr(value)}
+	_, err := sys(cmd, &attr)
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	return err
+}
+
+// put sets the u32 field of the state header at off.
+func put(state []byte, off int, v uint32) {
+	binary.LittleEndian.PutUint32(state[off:], v)
+}
+
+// get returns the u32 field of the state header at off.
+func get(state []byte, off int) uint32 {
+	return binary.LittleEndian.Uint32(state[off:])
+}
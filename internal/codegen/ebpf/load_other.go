@@ -0,0 +1,13 @@
+//go:build !(linux && amd64)
+
+package ebpf
+
+import (
+	"errors"
+	"io"
+)
+
+// Run loads and runs programs, which is only supported on x86_64 Linux.
+func Run(prog *Program, input []byte, w io.Writer, maxLoops uint64) error {
+	return errors.New("ebpf: programs only run on x86_64 Linux")
+}
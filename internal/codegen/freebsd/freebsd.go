@@ -0,0 +1,78 @@
+// Package freebsd produces x86_64 FreeBSD executables from IR operations:
+// the linux package's code and ELF executable, with FreeBSD system calls
+// and branded for FreeBSD so its kernel runs them natively.
+package freebsd
+
+import (
+	"github.com/lcox74/bfcc/internal/codegen/linux"
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/pkg/elf"
+)
+
+// Syscalls is the FreeBSD amd64 system call interface. A failed call sets
+// CF and returns errno, and the kernel passes the argument block in %rdi,
+// with %rsp 16-byte aligned below it rather than pointing at argc. FreeBSD
+// has no rt_sigaction (its sigaction takes a different struct) or
+// seccomp.
+var Syscalls = linux.Syscalls{
+	Read:           3,
+	Write:          4,
+	Mmap:           477,
+	Exit:           1,
+	Open:           5,
+	Writev:         121,
+	Mprotect:       74,
+	Nanosleep:      240,
+	Getrandom:      563,
+	MapAnonPrivate: 0x1002, // MAP_ANON|MAP_PRIVATE
+	OpenTrunc:      0x601,  // O_WRONLY|O_CREAT|O_TRUNC
+	CarryError:     true,
+	OSABI:          elf.ELFOSABI_FREEBSD,
+	ArgsInRDI:      true,
+}
+
+// X86_64Generator produces x86_64 FreeBSD executables.
+type X86_64Generator struct {
+	gen *linux.X86_64Generator
+}
+
+// NewX86_64Generator creates a generator taking all of the linux
+// package's options.
+func NewX86_64Generator(ops []core.Op, opts ...linux.Option) *X86_64Generator {
+	opts = append(opts, linux.WithSyscalls(Syscalls))
+	return &X86_64Generator{gen: linux.NewX86_64Generator(ops, opts...)}
+}
+
+// Generate produces raw x86_64 machine code.
+func (g *X86_64Generator) Generate() []byte {
+	return g.gen.Generate()
+}
+
+// GenerateRaw produces position-independent machine code with no ELF
+// wrapper, the tape mmapped at startup.
+func (g *X86_64Generator) GenerateRaw() []byte {
+	return g.gen.GenerateRaw()
+}
+
+// GenerateRawFunction produces position-independent machine code with no
+// ELF wrapper, called as a function given the tape in RDI.
+func (g *X86_64Generator) GenerateRawFunction() []byte {
+	return g.gen.GenerateRawFunction()
+}
+
+// GenerateFunctionObject produces a relocatable object file defining name
+// as a function given the tape and its size.
+func (g *X86_64Generator) GenerateFunctionObject(name string) []byte {
+	return g.gen.GenerateFunctionObject(name)
+}
+
+// GenerateELF produces a complete ELF64 executable.
+func (g *X86_64Generator) GenerateELF() []byte {
+	return g.gen.GenerateELF()
+}
+
+// Err returns the error from the last Generate, if it needed a system
+// call FreeBSD lacks.
+func (g *X86_64Generator) Err() error {
+	return g.gen.Err()
+}
@@ -3,6 +3,7 @@ package gas
 
 import (
 	"fmt"
+	"slices"
 	"strings"
 
 	"github.com/lcox74/bfcc/internal/core"
@@ -11,30 +12,102 @@ import (
 // Linux syscall numbers
 const (
 	sysWrite = 1
+	sysMmap  = 9
 	sysExit  = 60
 )
 
 // Generator produces GAS (AT&T syntax) assembly from IR operations.
 type Generator struct {
-	ops     []core.Op
-	out     strings.Builder
-	targets map[int]bool
+	ops       []core.Op
+	out       strings.Builder
+	cells     core.CellModel
+	midTape   bool   // start the data pointer in the middle of the tape
+	argvInput bool   // read input from argv[1] rather than stdin
+	tapeEnv   bool   // size the tape from BF_TAPE at startup, held in R15
+	info      string // printed when run with --bfcc-info, empty for no handler
+	debug     bool   // trap if control runs past the exit syscall
+	progress  func(done, total int)
 }
 
-// NewGenerator creates a new GAS assembly generator.
-func NewGenerator(ops []core.Op) *Generator {
-	g := &Generator{ops: ops, targets: make(map[int]bool)}
-	g.collectTargets()
-	return g
+// Option is a functional option for configuring a Generator.
+type Option func(*Generator)
+
+// WithCellOverflow sets the cell overflow policy (default core.OverflowWrap).
+func WithCellOverflow(overflow core.CellOverflow) Option {
+	return func(g *Generator) {
+		g.cells.Overflow = overflow
+	}
 }
 
-// collectTargets finds all jump target indices.
-func (g *Generator) collectTargets() {
-	for _, op := range g.ops {
-		if op.Kind == core.OpJz || op.Kind == core.OpJnz {
-			g.targets[op.Arg] = true
-		}
+// WithSignedCells treats cells as signed bytes: overflow checks use the
+// overflow flag rather than carry, and IN stores -1 at end of input.
+func WithSignedCells() Option {
+	return func(g *Generator) {
+		g.cells.Signed = true
+	}
+}
+
+// WithMidTape starts the data pointer in the middle of the tape rather than
+// at cell 0, for programs written for doubly-infinite tapes.
+func WithMidTape() Option {
+	return func(g *Generator) {
+		g.midTape = true
+	}
+}
+
+// WithArgvInput makes IN read successive bytes of argv[1] instead of stdin,
+// with end of input at its terminating NUL (or straight away without an
+// argument). R14 holds the read position.
+func WithArgvInput() Option {
+	return func(g *Generator) {
+		g.argvInput = true
+	}
+}
+
+// WithTapeEnv makes the executable read a decimal tape size in bytes from
+// the BF_TAPE environment variable at startup and mmap a tape that size,
+// falling back to the core.TapeSize tape in .bss.
+func WithTapeEnv() Option {
+	return func(g *Generator) {
+		g.tapeEnv = true
+	}
+}
+
+// WithInfo embeds a --bfcc-info handler that prints info to stdout and exits
+// before the program runs.
+func WithInfo(info string) Option {
+	return func(g *Generator) {
+		g.info = info
+	}
+}
+
+// WithDebug pads the code after the exit syscall with int3, so a corrupted
+// jump that runs off the end of the program traps before reaching the
+// helpers. TRAP ops (see core.InsertTraps) always emit int3.
+func WithDebug() Option {
+	return func(g *Generator) {
+		g.debug = true
+	}
+}
+
+// WithProgress calls report with the number of ops emitted so far, every
+// ProgressEvery ops and once all of them are done.
+func WithProgress(report func(done, total int)) Option {
+	return func(g *Generator) {
+		g.progress = report
+	}
+}
+
+// ProgressEvery is how many ops are emitted between progress reports.
+const ProgressEvery = 1 << 14
+
+// NewGenerator creates a new GAS assembly generator.
+func NewGenerator(ops []core.Op, opts ...Option) *Generator {
+	g := &Generator{ops: ops}
+	for _, opt := range opts {
+		opt(g)
 	}
+	return g
 }
 
 // Generate produces the complete assembly output.
@@ -43,14 +116,13 @@ func (g *Generator) Generate() string {
 	g.emitPrologue()
 
 	for i, op := range g.ops {
-		if g.targets[i] {
-			g.emitLabel(i)
-		}
 		g.emitOp(op)
+		if g.progress != nil && (i+1)%ProgressEvery == 0 {
+			g.progress(i+1, len(g.ops))
+		}
 	}
-
-	if g.targets[len(g.ops)] {
-		g.emitLabel(len(g.ops))
+	if g.progress != nil {
+		g.progress(len(g.ops), len(g.ops))
 	}
 	g.emitEpilogue()
 	g.emitHelpers()
@@ -74,6 +146,118 @@ func (g *Generator) emitPrologue() {
 	// Load tape base address into R13
 	fmt.Fprintf(&g.out, "    movq $tape, %%r13\n")
 
+	if g.info != "" {
+		g.emitInfoCheck()
+	}
+
+	if g.argvInput {
+		// R14 = argc >= 2 ? argv[1] : NULL
+		fmt.Fprintf(&g.out, "    xorq %%r14, %%r14\n")
+		fmt.Fprintf(&g.out, "    cmpq $2, (%%rsp)\n")
+		fmt.Fprintf(&g.out, "    jb 1f\n")
+		fmt.Fprintf(&g.out, "    movq 16(%%rsp), %%r14\n")
+		fmt.Fprintf(&g.out, "1:\n")
+	}
+
+	if g.tapeEnv {
+		g.emitTapeEnv()
+	}
+
+	g.emitStartPointer()
+}
+
+// emitInfoCheck outputs the WithInfo prologue: if argv[1] is --bfcc-info,
+// write the info message to stdout and exit 0.
+func (g *Generator) emitInfoCheck() {
+	fmt.Fprintf(&g.out, "    cmpq $2, (%%rsp)\n")
+	fmt.Fprintf(&g.out, "    jb .info_skip\n")
+	fmt.Fprintf(&g.out, "    movq 16(%%rsp), %%rsi\n")
+	fmt.Fprintf(&g.out, "    movabs $0x692d636366622d2d, %%rax\n") // "--bfcc-i"
+	fmt.Fprintf(&g.out, "    cmpq %%rax, (%%rsi)\n")
+	fmt.Fprintf(&g.out, "    jne .info_skip\n")
+	fmt.Fprintf(&g.out, "    cmpl $0x006f666e, 8(%%rsi)\n") // "nfo\0"
+	fmt.Fprintf(&g.out, "    jne .info_skip\n")
+	fmt.Fprintf(&g.out, "    leaq _bf_info_msg(%%rip), %%rsi\n")
+	fmt.Fprintf(&g.out, "    movq $%d, %%rax\n", sysWrite)
+	fmt.Fprintf(&g.out, "    movq $1, %%rdi\n")
+	fmt.Fprintf(&g.out, "    movq $%d, %%rdx\n", len(g.info))
+	fmt.Fprintf(&g.out, "    syscall\n")
+	fmt.Fprintf(&g.out, "    movq $%d, %%rax\n", sysExit)
+	fmt.Fprintf(&g.out, "    xorq %%rdi, %%rdi\n")
+	fmt.Fprintf(&g.out, "    syscall\n")
+	fmt.Fprintf(&g.out, ".info_skip:\n")
+}
+
+// emitInfoMsg outputs the --bfcc-info message as .byte directives, which
+// avoids escaping arbitrary file names for .ascii.
+func (g *Generator) emitInfoMsg() {
+	fmt.Fprintf(&g.out, "\n_bf_info_msg:\n")
+	for line := range slices.Chunk([]byte(g.info), 16) {
+		parts := make([]string, len(line))
+		for i, b := range line {
+			parts[i] = fmt.Sprintf("0x%02x", b)
+		}
+		fmt.Fprintf(&g.out, "    .byte %s\n", strings.Join(parts, ", "))
+	}
+}
+
+// emitTapeEnv outputs the WithTapeEnv prologue: find BF_TAPE= in envp,
+// parse the digits after it into RCX and mmap that many bytes, leaving the
+// tape base in R13 and its size in R15.
+func (g *Generator) emitTapeEnv() {
+	fmt.Fprintf(&g.out, "    movq $%d, %%r15\n", core.TapeSize)
+	fmt.Fprintf(&g.out, "    movq (%%rsp), %%rax\n")
+	fmt.Fprintf(&g.out, "    leaq 16(%%rsp,%%rax,8), %%rbx\n")
+	fmt.Fprintf(&g.out, ".env_next:\n")
+	fmt.Fprintf(&g.out, "    movq (%%rbx), %%rsi\n")
+	fmt.Fprintf(&g.out, "    testq %%rsi, %%rsi\n")
+	fmt.Fprintf(&g.out, "    jz .env_done\n")
+	fmt.Fprintf(&g.out, "    addq $8, %%rbx\n")
+	fmt.Fprintf(&g.out, "    movabs $0x3d455041545f4642, %%rax\n") // "BF_TAPE="
+	fmt.Fprintf(&g.out, "    cmpq %%rax, (%%rsi)\n")
+	fmt.Fprintf(&g.out, "    jne .env_next\n")
+	fmt.Fprintf(&g.out, "    addq $8, %%rsi\n")
+	fmt.Fprintf(&g.out, "    xorq %%rcx, %%rcx\n")
+	fmt.Fprintf(&g.out, ".env_digit:\n")
+	fmt.Fprintf(&g.out, "    movzbq (%%rsi), %%rax\n")
+	fmt.Fprintf(&g.out, "    subq $'0', %%rax\n")
+	fmt.Fprintf(&g.out, "    cmpq $9, %%rax\n")
+	fmt.Fprintf(&g.out, "    ja .env_parsed\n")
+	fmt.Fprintf(&g.out, "    imulq $10, %%rcx, %%rcx\n")
+	fmt.Fprintf(&g.out, "    addq %%rax, %%rcx\n")
+	fmt.Fprintf(&g.out, "    incq %%rsi\n")
+	fmt.Fprintf(&g.out, "    jmp .env_digit\n")
+	fmt.Fprintf(&g.out, ".env_parsed:\n")
+	fmt.Fprintf(&g.out, "    testq %%rcx, %%rcx\n")
+	fmt.Fprintf(&g.out, "    jz .env_done\n")
+	fmt.Fprintf(&g.out, "    movq %%rcx, %%rsi\n")
+	fmt.Fprintf(&g.out, "    xorq %%rdi, %%rdi\n")
+	fmt.Fprintf(&g.out, "    movq $3, %%rdx\n")    // PROT_READ|PROT_WRITE
+	fmt.Fprintf(&g.out, "    movq $0x22, %%r10\n") // MAP_PRIVATE|MAP_ANONYMOUS
+	fmt.Fprintf(&g.out, "    movq $-1, %%r8\n")
+	fmt.Fprintf(&g.out, "    xorq %%r9, %%r9\n")
+	fmt.Fprintf(&g.out, "    movq $%d, %%rax\n", sysMmap)
+	fmt.Fprintf(&g.out, "    syscall\n")
+	fmt.Fprintf(&g.out, "    cmpq $-4096, %%rax\n")
+	fmt.Fprintf(&g.out, "    ja .env_done\n")
+	fmt.Fprintf(&g.out, "    movq %%rax, %%r13\n")
+	fmt.Fprintf(&g.out, "    movq %%rsi, %%r15\n")
+	fmt.Fprintf(&g.out, ".env_done:\n")
+}
+
+// emitStartPointer points R12 at the first cell: 0, or the middle of the
+// tape with WithMidTape.
+func (g *Generator) emitStartPointer() {
+	if g.midTape && g.tapeEnv {
+		fmt.Fprintf(&g.out, "    movq %%r15, %%r12\n")
+		fmt.Fprintf(&g.out, "    shrq $1, %%r12\n")
+		return
+	}
+	if g.midTape {
+		fmt.Fprintf(&g.out, "    movq $%d, %%r12\n", core.TapeSize/2)
+		return
+	}
+
 	// Zero the data pointer (R12)
 	fmt.Fprintf(&g.out, "    xorq %%r12, %%r12\n")
 }
@@ -83,30 +267,94 @@ func (g *Generator) emitEpilogue() {
 	fmt.Fprintf(&g.out, "    movq $%d, %%rax\n", sysExit)
 	fmt.Fprintf(&g.out, "    xorq %%rdi, %%rdi\n")
 	fmt.Fprintf(&g.out, "    syscall\n")
+
+	if g.debug {
+		fmt.Fprintf(&g.out, "    int3\n")
+	}
 }
 
 // emitHelpers outputs the I/O helper functions.
 func (g *Generator) emitHelpers() {
+	// Start the helpers on a fresh 16-byte line, padded with int3 in debug
+	// builds where the padding is never meant to run
+	if g.debug {
+		fmt.Fprintf(&g.out, "    .p2align 4, 0xcc\n")
+	} else {
+		fmt.Fprintf(&g.out, "    .p2align 4\n")
+	}
 	fmt.Fprintf(&g.out, "\n_bf_read:\n")
+	if g.argvInput {
+		g.emitArgvRead()
+	} else {
+		g.emitStdinRead()
+	}
+
+	fmt.Fprintf(&g.out, "\n_bf_write:\n")
 	fmt.Fprintf(&g.out, "    leaq (%%r13,%%r12), %%rsi\n")
-	fmt.Fprintf(&g.out, "    xorq %%rax, %%rax\n")
-	fmt.Fprintf(&g.out, "    xorq %%rdi, %%rdi\n")
+	fmt.Fprintf(&g.out, "    movq $%d, %%rax\n", sysWrite)
+	fmt.Fprintf(&g.out, "    movq $1, %%rdi\n")
 	fmt.Fprintf(&g.out, "    movq $1, %%rdx\n")
 	fmt.Fprintf(&g.out, "    syscall\n")
 	fmt.Fprintf(&g.out, "    ret\n")
 
-	fmt.Fprintf(&g.out, "\n_bf_write:\n")
+	if g.cells.Overflow == core.OverflowTrap {
+		g.emitTrapHelper()
+	}
+
+	if g.info != "" {
+		g.emitInfoMsg()
+	}
+}
+
+// emitStdinRead outputs the body of _bf_read that reads one byte from
+// stdin. At end of input the cell is set to 0, or -1 for signed cells, as
+// in the VM.
+func (g *Generator) emitStdinRead() {
 	fmt.Fprintf(&g.out, "    leaq (%%r13,%%r12), %%rsi\n")
-	fmt.Fprintf(&g.out, "    movq $%d, %%rax\n", sysWrite)
-	fmt.Fprintf(&g.out, "    movq $1, %%rdi\n")
+	fmt.Fprintf(&g.out, "    xorq %%rax, %%rax\n")
+	fmt.Fprintf(&g.out, "    xorq %%rdi, %%rdi\n")
 	fmt.Fprintf(&g.out, "    movq $1, %%rdx\n")
 	fmt.Fprintf(&g.out, "    syscall\n")
+	// Store EOF when read returns 0 (end of input)
+	fmt.Fprintf(&g.out, "    testq %%rax, %%rax\n")
+	fmt.Fprintf(&g.out, "    jnz 1f\n")
+	fmt.Fprintf(&g.out, "    movb $%d, (%%r13,%%r12)\n", g.cells.EOF())
+	fmt.Fprintf(&g.out, "1:\n")
+	fmt.Fprintf(&g.out, "    ret\n")
+}
+
+// emitArgvRead outputs the body of _bf_read that takes the next byte of
+// argv[1] from R14. At end of input the cell is set to 0, or -1 for
+// signed cells, as in the VM.
+func (g *Generator) emitArgvRead() {
+	fmt.Fprintf(&g.out, "    testq %%r14, %%r14\n")
+	fmt.Fprintf(&g.out, "    jz 1f\n")
+	fmt.Fprintf(&g.out, "    movb (%%r14), %%al\n")
+	fmt.Fprintf(&g.out, "    testb %%al, %%al\n")
+	fmt.Fprintf(&g.out, "    jz 1f\n")
+	fmt.Fprintf(&g.out, "    movb %%al, (%%r13,%%r12)\n")
+	fmt.Fprintf(&g.out, "    incq %%r14\n")
+	fmt.Fprintf(&g.out, "    ret\n")
+	fmt.Fprintf(&g.out, "1:\n")
+	fmt.Fprintf(&g.out, "    movb $%d, (%%r13,%%r12)\n", g.cells.EOF())
 	fmt.Fprintf(&g.out, "    ret\n")
 }
 
-// emitLabel outputs a label for the given IR index.
-func (g *Generator) emitLabel(index int) {
-	fmt.Fprintf(&g.out, ".jt_%d:\n", index)
+// emitTrapHelper outputs _bf_trap, which reports a cell overflow on stderr
+// and exits with status 1.
+func (g *Generator) emitTrapHelper() {
+	fmt.Fprintf(&g.out, "\n_bf_trap:\n")
+	fmt.Fprintf(&g.out, "    leaq _bf_trap_msg(%%rip), %%rsi\n")
+	fmt.Fprintf(&g.out, "    movq $%d, %%rax\n", sysWrite)
+	fmt.Fprintf(&g.out, "    movq $2, %%rdi\n")
+	fmt.Fprintf(&g.out, "    movq $_bf_trap_len, %%rdx\n")
+	fmt.Fprintf(&g.out, "    syscall\n")
+	fmt.Fprintf(&g.out, "    movq $%d, %%rax\n", sysExit)
+	fmt.Fprintf(&g.out, "    movq $1, %%rdi\n")
+	fmt.Fprintf(&g.out, "    syscall\n")
+	fmt.Fprintf(&g.out, "_bf_trap_msg:\n")
+	fmt.Fprintf(&g.out, "    .ascii \"bfcc: cell overflow\\n\"\n")
+	fmt.Fprintf(&g.out, "    .set _bf_trap_len, . - _bf_trap_msg\n")
 }
 
 // emitOp outputs assembly for a single IR operation.
@@ -126,7 +374,49 @@ func (g *Generator) emitOp(op core.Op) {
 		g.emitJz(op.Arg)
 	case core.OpJnz:
 		g.emitJnz(op.Arg)
+	case core.OpSection:
+		g.emitSection(core.Handoff(op.Arg))
+	case core.OpTrap:
+		fmt.Fprintf(&g.out, "    int3\n")
+	case core.OpZeroRange:
+		g.emitZeroRange(op.Arg)
+	case core.OpCopyRange:
+		g.emitCopyRange(op.Arg, op.Off)
+	}
+}
+
+// emitZeroRange clears n cells from the data pointer with rep stosb.
+func (g *Generator) emitZeroRange(n int) {
+	fmt.Fprintf(&g.out, "    xorq %%rax, %%rax\n")
+	fmt.Fprintf(&g.out, "    leaq 0(%%r13,%%r12), %%rdi\n")
+	fmt.Fprintf(&g.out, "    movq $%d, %%rcx\n", n)
+	fmt.Fprintf(&g.out, "    rep stosb\n")
+}
+
+// emitCopyRange copies n cells from the data pointer to d cells along with
+// rep movsb. The optimiser only emits non-overlapping ranges, so copying
+// forwards is always safe.
+func (g *Generator) emitCopyRange(n, d int) {
+	fmt.Fprintf(&g.out, "    leaq 0(%%r13,%%r12), %%rsi\n")
+	fmt.Fprintf(&g.out, "    leaq %d(%%r13,%%r12), %%rdi\n", d)
+	fmt.Fprintf(&g.out, "    movq $%d, %%rcx\n", n)
+	fmt.Fprintf(&g.out, "    rep movsb\n")
+}
+
+// emitSection starts the next chained program, zeroing the tape with
+// rep stosb first for core.HandoffReset.
+func (g *Generator) emitSection(h core.Handoff) {
+	if h == core.HandoffReset {
+		fmt.Fprintf(&g.out, "    xorq %%rax, %%rax\n")
+		fmt.Fprintf(&g.out, "    movq %%r13, %%rdi\n")
+		if g.tapeEnv {
+			fmt.Fprintf(&g.out, "    movq %%r15, %%rcx\n")
+		} else {
+			fmt.Fprintf(&g.out, "    movq $%d, %%rcx\n", core.TapeSize)
+		}
+		fmt.Fprintf(&g.out, "    rep stosb\n")
 	}
+	g.emitStartPointer()
 }
 
 // emitShift outputs: addq $k, %r12 (or subq for negative values)
@@ -142,10 +432,37 @@ func (g *Generator) emitShift(k int) {
 }
 
 // emitAdd outputs: addb $k, (%r13,%r12) (or subb for negative values)
+// Under the saturate and trap policies the carry flag (or overflow flag for
+// signed cells) is checked after each add.
 func (g *Generator) emitAdd(k int) {
 	if k == 0 {
 		return
 	}
+
+	if g.cells.Overflow == core.OverflowWrap {
+		g.emitAddSub(k)
+		return
+	}
+
+	if g.cells.AlwaysOverflows(k) {
+		g.emitOverflowed(k)
+		return
+	}
+
+	// The overflow flag is only meaningful for immediates in [-127, 127]
+	for g.cells.Signed && (k > 127 || k < -127) {
+		step := 127
+		if k < 0 {
+			step = -127
+		}
+		g.emitCheckedAdd(step)
+		k -= step
+	}
+	g.emitCheckedAdd(k)
+}
+
+// emitAddSub outputs a plain addb $k or subb $-k on the current cell.
+func (g *Generator) emitAddSub(k int) {
 	if k > 0 {
 		fmt.Fprintf(&g.out, "    addb $%d, (%%r13,%%r12)\n", k)
 	} else {
@@ -153,6 +470,43 @@ func (g *Generator) emitAdd(k int) {
 	}
 }
 
+// emitCheckedAdd outputs an add followed by the saturate clamp or trap jump.
+func (g *Generator) emitCheckedAdd(k int) {
+	g.emitAddSub(k)
+
+	noOverflow, overflow := "jnc", "jc"
+	if g.cells.Signed {
+		noOverflow, overflow = "jno", "jo"
+	}
+
+	if g.cells.Overflow == core.OverflowTrap {
+		fmt.Fprintf(&g.out, "    %s _bf_trap\n", overflow)
+		return
+	}
+
+	clamp := g.cells.Max()
+	if k < 0 {
+		clamp = g.cells.Min()
+	}
+	fmt.Fprintf(&g.out, "    %s 1f\n", noOverflow)
+	fmt.Fprintf(&g.out, "    movb $%d, (%%r13,%%r12)\n", clamp)
+	fmt.Fprintf(&g.out, "1:\n")
+}
+
+// emitOverflowed outputs an ADD k that is known to overflow: the saturated
+// value for the saturate policy or an unconditional jump to _bf_trap.
+func (g *Generator) emitOverflowed(k int) {
+	if g.cells.Overflow == core.OverflowTrap {
+		fmt.Fprintf(&g.out, "    jmp _bf_trap\n")
+		return
+	}
+	if k > 0 {
+		fmt.Fprintf(&g.out, "    movb $%d, (%%r13,%%r12)\n", g.cells.Max())
+	} else {
+		fmt.Fprintf(&g.out, "    movb $%d, (%%r13,%%r12)\n", g.cells.Min())
+	}
+}
+
 // emitZero outputs: movb $0, (%r13,%r12)
 func (g *Generator) emitZero() {
 	fmt.Fprintf(&g.out, "    movb $0, (%%r13,%%r12)\n")
@@ -168,14 +522,16 @@ func (g *Generator) emitOut() {
 	fmt.Fprintf(&g.out, "    call _bf_write\n")
 }
 
-// emitJz outputs: testb $0xff, (%r13,%r12); jz target
-func (g *Generator) emitJz(target int) {
+// emitJz outputs: .loop_L: testb $0xff, (%r13,%r12); jz .loop_L_end
+func (g *Generator) emitJz(label int) {
+	fmt.Fprintf(&g.out, ".loop_%d:\n", label)
 	fmt.Fprintf(&g.out, "    testb $0xff, (%%r13,%%r12)\n")
-	fmt.Fprintf(&g.out, "    jz .jt_%d\n", target)
+	fmt.Fprintf(&g.out, "    jz .loop_%d_end\n", label)
 }
 
-// emitJnz outputs: testb $0xff, (%r13,%r12); jnz target
-func (g *Generator) emitJnz(target int) {
+// emitJnz outputs: testb $0xff, (%r13,%r12); jnz .loop_L; .loop_L_end:
+func (g *Generator) emitJnz(label int) {
 	fmt.Fprintf(&g.out, "    testb $0xff, (%%r13,%%r12)\n")
-	fmt.Fprintf(&g.out, "    jnz .jt_%d\n", target)
+	fmt.Fprintf(&g.out, "    jnz .loop_%d\n", label)
+	fmt.Fprintf(&g.out, ".loop_%d_end:\n", label)
 }
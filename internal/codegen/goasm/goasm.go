@@ -0,0 +1,423 @@
+// Package goasm provides Go assembler (Plan 9 syntax) output for x86_64
+// Linux, with a stub Go file declaring the function it defines, so
+// programs link into Go packages with the go command alone, without cgo.
+// The code is the gas package's, as one function given the tape rather
+// than a process entry point, doing its I/O with system calls.
+package goasm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// Linux syscall numbers
+const (
+	sysRead  = 0
+	sysWrite = 1
+)
+
+// Func is the name of the function the assembly defines and the stub
+// declares, and TapeSizeConst the constant the stub sizes its tape with.
+const (
+	Func          = "bfMain"
+	TapeSizeConst = "bfTapeSize"
+)
+
+// trapMsg is written to stderr by the trap handler before returning.
+const trapMsg = "bfcc: cell overflow\n"
+
+// Generator produces Go assembly from IR operations.
+type Generator struct {
+	ops      []core.Op
+	out      strings.Builder
+	pkg      string
+	cells    core.CellModel
+	midTape  bool // start the data pointer in the middle of the tape
+	debug    bool // trap if control runs past the RET
+	progress func(done, total int)
+}
+
+// Option is a functional option for configuring a Generator.
+type Option func(*Generator)
+
+// WithPackage sets the package the stub is in (default main).
+func WithPackage(name string) Option {
+	return func(g *Generator) {
+		g.pkg = name
+	}
+}
+
+// WithCellOverflow sets the cell overflow policy (default core.OverflowWrap).
+// Under core.OverflowTrap, an overflow writes the trap message to stderr
+// and returns from the function early.
+func WithCellOverflow(overflow core.CellOverflow) Option {
+	return func(g *Generator) {
+		g.cells.Overflow = overflow
+	}
+}
+
+// WithSignedCells treats cells as signed bytes: overflow checks use the
+// overflow flag rather than carry, and IN stores -1 at end of input.
+func WithSignedCells() Option {
+	return func(g *Generator) {
+		g.cells.Signed = true
+	}
+}
+
+// WithMidTape starts the data pointer in the middle of the tape rather than
+// at cell 0, for programs written for doubly-infinite tapes.
+func WithMidTape() Option {
+	return func(g *Generator) {
+		g.midTape = true
+	}
+}
+
+// WithDebug follows the RET with INT $3, so a corrupted jump that runs off
+// the end of the program traps before reaching the trap handler. TRAP ops
+// (see core.InsertTraps) always emit INT $3.
+func WithDebug() Option {
+	return func(g *Generator) {
+		g.debug = true
+	}
+}
+
+// WithProgress calls report with the number of ops emitted so far, every
+// ProgressEvery ops and once all of them are done.
+func WithProgress(report func(done, total int)) Option {
+	return func(g *Generator) {
+		g.progress = report
+	}
+}
+
+// ProgressEvery is how many ops are emitted between progress reports.
+const ProgressEvery = 1 << 14
+
+// NewGenerator creates a new Go assembly generator.
+func NewGenerator(ops []core.Op, opts ...Option) *Generator {
+	g := &Generator{ops: ops, pkg: "main"}
+	for _, opt := range opts {
+		opt(g)
+	}
+	return g
+}
+
+// Generate produces the assembly file, for a name ending _amd64.s.
+func (g *Generator) Generate() string {
+	g.emitHeader()
+	g.emitPrologue()
+
+	for i, op := range g.ops {
+		g.emitOp(op)
+		if g.progress != nil && (i+1)%ProgressEvery == 0 {
+			g.progress(i+1, len(g.ops))
+		}
+	}
+	if g.progress != nil {
+		g.progress(len(g.ops), len(g.ops))
+	}
+	g.emitEpilogue()
+	g.emitHelpers()
+
+	return g.out.String()
+}
+
+// Stub produces the Go file declaring the function, to go beside the
+// assembly in its package.
+func (g *Generator) Stub() string {
+	start := "from cell 0"
+	if g.midTape {
+		start = fmt.Sprintf("from cell %d", core.TapeSize/2)
+	}
+	trap := ""
+	if g.cells.Overflow == core.OverflowTrap {
+		trap = "\n// A cell overflow writes a message to stderr and returns early."
+	}
+
+	return fmt.Sprintf(`// Code generated by bfcc. DO NOT EDIT.
+
+//go:build linux && amd64
+
+package %s
+
+// %s is the number of cells on the tape %s is given.
+const %s = %d
+
+// %s runs the compiled Brainfuck program on tape, which must have
+// %s cells, usually zeroed, starting %s. It reads stdin and
+// writes stdout a byte at a time with system calls the scheduler does not
+// see, and sets the cell to %d at end of input.%s
+// Nothing stops the program leaving the tape.
+//
+//go:noescape
+func %s(tape *byte)
+`, g.pkg, TapeSizeConst, Func, TapeSizeConst, core.TapeSize, Func, TapeSizeConst, start, int8(g.cells.EOF()), trap, Func)
+}
+
+// emitHeader outputs the file header and the function's TEXT directive.
+func (g *Generator) emitHeader() {
+	fmt.Fprintf(&g.out, "// Code generated by bfcc. DO NOT EDIT.\n")
+	fmt.Fprintf(&g.out, "\n")
+	fmt.Fprintf(&g.out, "//go:build linux && amd64\n")
+	fmt.Fprintf(&g.out, "\n")
+	fmt.Fprintf(&g.out, "#include \"textflag.h\"\n")
+	fmt.Fprintf(&g.out, "\n")
+	fmt.Fprintf(&g.out, "// func %s(tape *byte)\n", Func)
+	fmt.Fprintf(&g.out, "TEXT ·%s(SB), NOSPLIT, $0-8\n", Func)
+}
+
+// emitPrologue outputs the function start: load R13 (tape base) from the
+// argument and initialize R12 (data pointer). ABI0 functions may clobber
+// every register but SP and BP.
+func (g *Generator) emitPrologue() {
+	fmt.Fprintf(&g.out, "    MOVQ tape+0(FP), R13\n")
+	g.emitStartPointer()
+}
+
+// emitStartPointer points R12 at the first cell: 0, or the middle of the
+// tape with WithMidTape.
+func (g *Generator) emitStartPointer() {
+	if g.midTape {
+		fmt.Fprintf(&g.out, "    MOVQ $%d, R12\n", core.TapeSize/2)
+		return
+	}
+
+	// Zero the data pointer (R12)
+	fmt.Fprintf(&g.out, "    XORQ R12, R12\n")
+}
+
+// emitEpilogue outputs the return.
+func (g *Generator) emitEpilogue() {
+	fmt.Fprintf(&g.out, "    RET\n")
+
+	if g.debug {
+		fmt.Fprintf(&g.out, "    INT $3\n")
+	}
+}
+
+// emitHelpers outputs the trap handler, inside the function for the
+// conditional jumps to it, and the I/O helper functions, static to the
+// file.
+func (g *Generator) emitHelpers() {
+	if g.cells.Overflow == core.OverflowTrap {
+		g.emitTrapHandler()
+	}
+
+	fmt.Fprintf(&g.out, "\n// func bfread()\n")
+	fmt.Fprintf(&g.out, "TEXT bfread<>(SB), NOSPLIT, $0-0\n")
+	fmt.Fprintf(&g.out, "    LEAQ (R13)(R12*1), SI\n")
+	fmt.Fprintf(&g.out, "    MOVQ $%d, AX\n", sysRead)
+	fmt.Fprintf(&g.out, "    XORQ DI, DI\n")
+	fmt.Fprintf(&g.out, "    MOVQ $1, DX\n")
+	fmt.Fprintf(&g.out, "    SYSCALL\n")
+	// Store EOF when read returns 0 (end of input)
+	fmt.Fprintf(&g.out, "    TESTQ AX, AX\n")
+	fmt.Fprintf(&g.out, "    JNE read_done\n")
+	fmt.Fprintf(&g.out, "    MOVB $%d, (R13)(R12*1)\n", g.cells.EOF())
+	fmt.Fprintf(&g.out, "read_done:\n")
+	fmt.Fprintf(&g.out, "    RET\n")
+
+	fmt.Fprintf(&g.out, "\n// func bfwrite()\n")
+	fmt.Fprintf(&g.out, "TEXT bfwrite<>(SB), NOSPLIT, $0-0\n")
+	fmt.Fprintf(&g.out, "    LEAQ (R13)(R12*1), SI\n")
+	fmt.Fprintf(&g.out, "    MOVQ $%d, AX\n", sysWrite)
+	fmt.Fprintf(&g.out, "    MOVQ $1, DI\n")
+	fmt.Fprintf(&g.out, "    MOVQ $1, DX\n")
+	fmt.Fprintf(&g.out, "    SYSCALL\n")
+	fmt.Fprintf(&g.out, "    RET\n")
+
+	if g.cells.Overflow == core.OverflowTrap {
+		g.emitTrapMsg()
+	}
+}
+
+// emitTrapHandler outputs the trap label the overflow checks jump to,
+// which reports a cell overflow on stderr and returns.
+func (g *Generator) emitTrapHandler() {
+	fmt.Fprintf(&g.out, "trap:\n")
+	fmt.Fprintf(&g.out, "    LEAQ bftrapmsg<>(SB), SI\n")
+	fmt.Fprintf(&g.out, "    MOVQ $%d, AX\n", sysWrite)
+	fmt.Fprintf(&g.out, "    MOVQ $2, DI\n")
+	fmt.Fprintf(&g.out, "    MOVQ $%d, DX\n", len(trapMsg))
+	fmt.Fprintf(&g.out, "    SYSCALL\n")
+	fmt.Fprintf(&g.out, "    RET\n")
+}
+
+// emitTrapMsg outputs the trap message as read-only data, a byte at a
+// time, which avoids escaping it for the assembler's 8-byte strings.
+func (g *Generator) emitTrapMsg() {
+	fmt.Fprintf(&g.out, "\n")
+	for i, b := range []byte(trapMsg) {
+		fmt.Fprintf(&g.out, "DATA bftrapmsg<>+%d(SB)/1, $0x%02x\n", i, b)
+	}
+	fmt.Fprintf(&g.out, "GLOBL bftrapmsg<>(SB), RODATA, $%d\n", len(trapMsg))
+}
+
+// emitOp outputs assembly for a single IR operation.
+func (g *Generator) emitOp(op core.Op) {
+	switch op.Kind {
+	case core.OpShift:
+		g.emitShift(op.Arg)
+	case core.OpAdd:
+		g.emitAdd(op.Arg)
+	case core.OpZero:
+		g.emitZero()
+	case core.OpIn:
+		fmt.Fprintf(&g.out, "    CALL bfread<>(SB)\n")
+	case core.OpOut:
+		fmt.Fprintf(&g.out, "    CALL bfwrite<>(SB)\n")
+	case core.OpJz:
+		g.emitJz(op.Arg)
+	case core.OpJnz:
+		g.emitJnz(op.Arg)
+	case core.OpSection:
+		g.emitSection(core.Handoff(op.Arg))
+	case core.OpTrap:
+		fmt.Fprintf(&g.out, "    INT $3\n")
+	case core.OpZeroRange:
+		g.emitZeroRange(op.Arg)
+	case core.OpCopyRange:
+		g.emitCopyRange(op.Arg, op.Off)
+	}
+}
+
+// emitZeroRange clears n cells from the data pointer with REP; STOSB.
+func (g *Generator) emitZeroRange(n int) {
+	fmt.Fprintf(&g.out, "    XORQ AX, AX\n")
+	fmt.Fprintf(&g.out, "    LEAQ (R13)(R12*1), DI\n")
+	fmt.Fprintf(&g.out, "    MOVQ $%d, CX\n", n)
+	fmt.Fprintf(&g.out, "    REP; STOSB\n")
+}
+
+// emitCopyRange copies n cells from the data pointer to d cells along with
+// REP; MOVSB. The optimiser only emits non-overlapping ranges, so copying
+// forwards is always safe.
+func (g *Generator) emitCopyRange(n, d int) {
+	fmt.Fprintf(&g.out, "    LEAQ (R13)(R12*1), SI\n")
+	fmt.Fprintf(&g.out, "    LEAQ %d(R13)(R12*1), DI\n", d)
+	fmt.Fprintf(&g.out, "    MOVQ $%d, CX\n", n)
+	fmt.Fprintf(&g.out, "    REP; MOVSB\n")
+}
+
+// emitSection starts the next chained program, zeroing the tape with
+// REP; STOSB first for core.HandoffReset.
+func (g *Generator) emitSection(h core.Handoff) {
+	if h == core.HandoffReset {
+		fmt.Fprintf(&g.out, "    XORQ AX, AX\n")
+		fmt.Fprintf(&g.out, "    MOVQ R13, DI\n")
+		fmt.Fprintf(&g.out, "    MOVQ $%d, CX\n", core.TapeSize)
+		fmt.Fprintf(&g.out, "    REP; STOSB\n")
+	}
+	g.emitStartPointer()
+}
+
+// emitShift outputs: ADDQ $k, R12 (or SUBQ for negative values)
+func (g *Generator) emitShift(k int) {
+	if k == 0 {
+		return
+	}
+	if k > 0 {
+		fmt.Fprintf(&g.out, "    ADDQ $%d, R12\n", k)
+	} else {
+		fmt.Fprintf(&g.out, "    SUBQ $%d, R12\n", -k)
+	}
+}
+
+// emitAdd outputs: ADDB $k, (R13)(R12*1) (or SUBB for negative values)
+// Under the saturate and trap policies the carry flag (or overflow flag for
+// signed cells) is checked after each add.
+func (g *Generator) emitAdd(k int) {
+	if k == 0 {
+		return
+	}
+
+	if g.cells.Overflow == core.OverflowWrap {
+		g.emitAddSub(k)
+		return
+	}
+
+	if g.cells.AlwaysOverflows(k) {
+		g.emitOverflowed(k)
+		return
+	}
+
+	// The overflow flag is only meaningful for immediates in [-127, 127]
+	for g.cells.Signed && (k > 127 || k < -127) {
+		step := 127
+		if k < 0 {
+			step = -127
+		}
+		g.emitCheckedAdd(step)
+		k -= step
+	}
+	g.emitCheckedAdd(k)
+}
+
+// emitAddSub outputs a plain ADDB $k or SUBB $-k on the current cell.
+func (g *Generator) emitAddSub(k int) {
+	if k > 0 {
+		fmt.Fprintf(&g.out, "    ADDB $%d, (R13)(R12*1)\n", k)
+	} else {
+		fmt.Fprintf(&g.out, "    SUBB $%d, (R13)(R12*1)\n", -k)
+	}
+}
+
+// emitCheckedAdd outputs an add followed by the saturate clamp or trap
+// jump. Go assembly has no local numeric labels, so each clamp skip is
+// named after its position in the output.
+func (g *Generator) emitCheckedAdd(k int) {
+	g.emitAddSub(k)
+
+	noOverflow, overflow := "JCC", "JCS"
+	if g.cells.Signed {
+		noOverflow, overflow = "JOC", "JOS"
+	}
+
+	if g.cells.Overflow == core.OverflowTrap {
+		fmt.Fprintf(&g.out, "    %s trap\n", overflow)
+		return
+	}
+
+	clamp := g.cells.Max()
+	if k < 0 {
+		clamp = g.cells.Min()
+	}
+	label := fmt.Sprintf("clamp%d", g.out.Len())
+	fmt.Fprintf(&g.out, "    %s %s\n", noOverflow, label)
+	fmt.Fprintf(&g.out, "    MOVB $%d, (R13)(R12*1)\n", clamp)
+	fmt.Fprintf(&g.out, "%s:\n", label)
+}
+
+// emitOverflowed outputs an ADD k that is known to overflow: the saturated
+// value for the saturate policy or an unconditional jump to trap.
+func (g *Generator) emitOverflowed(k int) {
+	if g.cells.Overflow == core.OverflowTrap {
+		fmt.Fprintf(&g.out, "    JMP trap\n")
+		return
+	}
+	if k > 0 {
+		fmt.Fprintf(&g.out, "    MOVB $%d, (R13)(R12*1)\n", g.cells.Max())
+	} else {
+		fmt.Fprintf(&g.out, "    MOVB $%d, (R13)(R12*1)\n", g.cells.Min())
+	}
+}
+
+// emitZero outputs: MOVB $0, (R13)(R12*1)
+func (g *Generator) emitZero() {
+	fmt.Fprintf(&g.out, "    MOVB $0, (R13)(R12*1)\n")
+}
+
+// emitJz outputs: loopL: TESTB $0xff, (R13)(R12*1); JEQ loopL_end
+func (g *Generator) emitJz(label int) {
+	fmt.Fprintf(&g.out, "loop%d:\n", label)
+	fmt.Fprintf(&g.out, "    TESTB $0xff, (R13)(R12*1)\n")
+	fmt.Fprintf(&g.out, "    JEQ loop%d_end\n", label)
+}
+
+// emitJnz outputs: TESTB $0xff, (R13)(R12*1); JNE loopL; loopL_end:
+func (g *Generator) emitJnz(label int) {
+	fmt.Fprintf(&g.out, "    TESTB $0xff, (R13)(R12*1)\n")
+	fmt.Fprintf(&g.out, "    JNE loop%d\n", label)
+	fmt.Fprintf(&g.out, "loop%d_end:\n", label)
+}
@@ -0,0 +1,436 @@
+package linux
+
+import (
+	"encoding/binary"
+
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/pkg/arm"
+	"github.com/lcox74/bfcc/pkg/elf"
+)
+
+// Linux ARM EABI syscall numbers, made with svc #0 and the number in r7.
+const (
+	armSysExit  = 1
+	armSysRead  = 3
+	armSysWrite = 4
+)
+
+// armFixup records an instruction to patch once the target's offset is
+// known: the offset of a b or bl, or of an adr.
+type armFixup struct {
+	offset    int // Offset in code of the instruction
+	targetIdx int // loop label of the jump target, or a special target
+	loopEnd   bool
+	adr       bool
+}
+
+// ARMCosts is the size in bytes of the code for each op, for the optimiser,
+// with the wrapping cell model. SHIFTs past 255 cells may not fit an
+// immediate, so take a movw and an add.
+var ARMCosts = core.CostModel{Name: "arm", Shift: 4, FarShift: 8, NearShift: 255, Add: 12, Zero: 8, IO: 4, Jump: 12, Range: 24}
+
+// ARMGenerator produces 32-bit ARM (ARMv7-A) machine code from IR
+// operations, for older Raspberry Pis and embedded boards running armv7l
+// Linux. It takes the same Options as the X86_64Generator, but only
+// supports the cell model, mid-tape, debug and progress ones.
+//
+// R4 holds the tape base and R5 the address of the current cell; R0 to R3
+// are scratch and R12 holds immediates that do not fit an instruction.
+type ARMGenerator struct {
+	ops       []core.Op
+	code      []byte
+	loopStart map[int]int // loop label -> code offset of its JZ
+	loopEnd   map[int]int // loop label -> code offset just past its JNZ
+	helpers   map[int]int // special fixup target -> code offset
+	fixups    []armFixup
+	codeBase  uint64
+	bssBase   uint64
+	opts      Settings
+}
+
+// NewARMGenerator creates a new ARM machine code generator.
+func NewARMGenerator(ops []core.Op, opts ...Option) *ARMGenerator {
+	g := &ARMGenerator{
+		ops:       ops,
+		code:      make([]byte, 0, 4096),
+		loopStart: make(map[int]int),
+		loopEnd:   make(map[int]int),
+		helpers:   make(map[int]int),
+		codeBase:  CodeBase + elf.PageSize, // Code starts after ELF headers
+		bssBase:   BSSBase,
+		opts:      ApplyOptions(opts...),
+	}
+
+	return g
+}
+
+// Generate produces raw ARM machine code.
+func (g *ARMGenerator) Generate() []byte {
+	g.emitPrologue()
+
+	for i, op := range g.ops {
+		if op.Kind == core.OpJz {
+			g.loopStart[op.Arg] = len(g.code)
+		}
+		g.emitOp(op)
+		if op.Kind == core.OpJnz {
+			g.loopEnd[op.Arg] = len(g.code)
+		}
+		if progress := g.opts.Progress; progress != nil && (i+1)%ProgressEvery == 0 {
+			progress(i+1, len(g.ops))
+		}
+	}
+	if g.opts.Progress != nil {
+		g.opts.Progress(len(g.ops), len(g.ops))
+	}
+
+	g.emitEpilogue()
+	g.emitHelpers()
+	g.resolveFixups()
+
+	return g.code
+}
+
+// GenerateELF produces a complete ELF32 ARM EABI executable.
+func (g *ARMGenerator) GenerateELF() []byte {
+	code := g.Generate()
+
+	builder := elf.NewBuilder()
+	builder.SetMachine(elf.EM_ARM)
+	builder.SetFlags(elf.EF_ARM_EABI_VER5 | elf.EF_ARM_ABI_FLOAT_SOFT)
+	builder.SetEntry(g.codeBase)
+	builder.AddLoadSegment(code, g.codeBase, elf.PF_R|elf.PF_X)
+	builder.AddBSSSegment(g.bssBase, core.TapeSize, elf.PF_R|elf.PF_W)
+
+	return builder.Build32()
+}
+
+// emit appends instructions to the code buffer.
+func (g *ARMGenerator) emit(insns ...[]byte) {
+	for _, b := range insns {
+		g.code = append(g.code, b...)
+	}
+}
+
+// emitFixup emits insn, a branch or adr, for resolveFixups to point at f's
+// target.
+func (g *ARMGenerator) emitFixup(insn []byte, f armFixup) {
+	f.offset = len(g.code)
+	g.fixups = append(g.fixups, f)
+	g.emit(insn)
+}
+
+// emitBranch outputs a b, bl or conditional b to a loop or helper.
+func (g *ARMGenerator) emitBranch(insn []byte, target int, loopEnd bool) {
+	g.emitFixup(insn, armFixup{targetIdx: target, loopEnd: loopEnd})
+}
+
+// emitMovImm loads a 32-bit immediate into rd, with a mov when it fits and
+// otherwise a movw and, for the top half, a movt.
+func (g *ARMGenerator) emitMovImm(rd arm.Reg, imm uint32) {
+	if arm.FitsImm(imm) {
+		g.emit(arm.MovImm(rd, imm))
+		return
+	}
+	g.emit(arm.Movw(rd, uint16(imm)))
+	if imm>>16 != 0 {
+		g.emit(arm.Movt(rd, uint16(imm>>16)))
+	}
+}
+
+// emitAddImm outputs rd = rn + k, with an add or sub of an immediate, or
+// through R12 when k does not fit one.
+func (g *ARMGenerator) emitAddImm(rd, rn arm.Reg, k int) {
+	n := uint32(k)
+	if k < 0 {
+		n = uint32(-k)
+	}
+	switch {
+	case arm.FitsImm(n) && k >= 0:
+		g.emit(arm.AddImm(rd, rn, n))
+	case arm.FitsImm(n):
+		g.emit(arm.SubImm(rd, rn, n))
+	case k >= 0:
+		g.emitMovImm(arm.R12, n)
+		g.emit(arm.Add(rd, rn, arm.R12))
+	default:
+		g.emitMovImm(arm.R12, n)
+		g.emit(arm.Sub(rd, rn, arm.R12))
+	}
+}
+
+// emitPrologue outputs the program start: load R4 with the tape base and
+// R5 with the first cell.
+func (g *ARMGenerator) emitPrologue() {
+	g.emitMovImm(arm.R4, uint32(g.bssBase)) // movw/movt r4, tape
+	g.emitStartPointer()
+}
+
+// emitStartPointer points R5 at the first cell: 0, or the middle of the
+// tape with WithMidTape.
+func (g *ARMGenerator) emitStartPointer() {
+	if g.opts.MidTape {
+		g.emitAddImm(arm.R5, arm.R4, core.TapeSize/2) // r5 = r4 + 15000
+		return
+	}
+	g.emit(arm.Mov(arm.R5, arm.R4)) // mov r5, r4
+}
+
+// emitEpilogue outputs the exit(0) syscall.
+func (g *ARMGenerator) emitEpilogue() {
+	g.emit(
+		arm.MovImm(arm.R7, armSysExit), // mov r7, #1
+		arm.MovImm(arm.R0, 0),          // mov r0, #0
+		arm.Svc(0),                     // svc #0
+	)
+	if g.opts.Debug {
+		g.emit(arm.Udf(16)) // udf #16
+	}
+}
+
+// alignCode pads the code buffer up to a multiple of align bytes: with
+// udf #16 in debug builds, where padding is never meant to run, otherwise
+// with nop.
+func (g *ARMGenerator) alignCode(align int) {
+	for len(g.code)%align != 0 {
+		if g.opts.Debug {
+			g.emit(arm.Udf(16))
+		} else {
+			g.emit(arm.Nop())
+		}
+	}
+}
+
+// emitHelpers outputs the I/O helper functions, and the trap helper and
+// its message for the trap policy.
+func (g *ARMGenerator) emitHelpers() {
+	g.alignCode(16)
+
+	// _bf_read: read(0, r5, 1), storing EOF when it returns 0
+	eof := arm.If(arm.EQ, arm.MovImm(arm.R0, uint32(g.opts.Cells.EOF())))
+	g.helpers[fixupRead] = len(g.code)
+	g.emit(
+		arm.MovImm(arm.R7, armSysRead), // mov r7, #3
+		arm.MovImm(arm.R0, 0),          // mov r0, #0 - stdin
+		arm.Mov(arm.R1, arm.R5),        // mov r1, r5
+		arm.MovImm(arm.R2, 1),          // mov r2, #1
+		arm.Svc(0),                     // svc #0
+		arm.CmpImm(arm.R0, 0),          // cmp r0, #0
+		eof,                            // moveq r0, #0 (or #255)
+		arm.If(arm.EQ, arm.Strb(arm.R0, arm.R5, 0)), // strbeq r0, [r5]
+		arm.Bx(arm.LR), // bx lr
+	)
+
+	// _bf_write: write(1, r5, 1)
+	g.helpers[fixupWrite] = len(g.code)
+	g.emit(
+		arm.MovImm(arm.R7, armSysWrite), // mov r7, #4
+		arm.MovImm(arm.R0, 1),           // mov r0, #1 - stdout
+		arm.Mov(arm.R1, arm.R5),         // mov r1, r5
+		arm.MovImm(arm.R2, 1),           // mov r2, #1
+		arm.Svc(0),                      // svc #0
+		arm.Bx(arm.LR),                  // bx lr
+	)
+
+	if g.opts.Cells.Overflow == core.OverflowTrap {
+		g.emitTrapHelper()
+	}
+}
+
+// emitTrapHelper outputs _bf_trap, which reports a cell overflow on stderr
+// and exits with status 1, followed by the message it prints.
+func (g *ARMGenerator) emitTrapHelper() {
+	g.helpers[fixupTrap] = len(g.code)
+	g.emitFixup(arm.Adr(arm.R1, 8), armFixup{targetIdx: fixupTrapMsg, adr: true}) // adr r1, trap_msg
+	g.emit(
+		arm.MovImm(arm.R7, armSysWrite),          // mov r7, #4
+		arm.MovImm(arm.R0, 2),                    // mov r0, #2 - stderr
+		arm.MovImm(arm.R2, uint32(len(trapMsg))), // mov r2, #len
+		arm.Svc(0),                               // svc #0
+		arm.MovImm(arm.R7, armSysExit),           // mov r7, #1
+		arm.MovImm(arm.R0, 1),                    // mov r0, #1
+		arm.Svc(0),                               // svc #0
+	)
+
+	g.helpers[fixupTrapMsg] = len(g.code)
+	g.emit([]byte(trapMsg))
+}
+
+// emitOp outputs machine code for a single IR operation.
+func (g *ARMGenerator) emitOp(op core.Op) {
+	switch op.Kind {
+	case core.OpShift:
+		g.emitShift(op.Arg)
+	case core.OpAdd:
+		g.emitAdd(op.Arg)
+	case core.OpZero:
+		g.emit(
+			arm.MovImm(arm.R0, 0),       // mov r0, #0
+			arm.Strb(arm.R0, arm.R5, 0), // strb r0, [r5]
+		)
+	case core.OpIn:
+		g.emitBranch(arm.Bl(0), fixupRead, false) // bl _bf_read
+	case core.OpOut:
+		g.emitBranch(arm.Bl(0), fixupWrite, false) // bl _bf_write
+	case core.OpJz:
+		g.emitLoopJump(op.Arg, true)
+	case core.OpJnz:
+		g.emitLoopJump(op.Arg, false)
+	case core.OpSection:
+		g.emitSection(core.Handoff(op.Arg))
+	case core.OpTrap:
+		g.emit(arm.Udf(16)) // udf #16
+	case core.OpZeroRange:
+		g.emitZeroRange(op.Arg)
+	case core.OpCopyRange:
+		g.emitCopyRange(op.Arg, op.Off)
+	}
+}
+
+// emitShift outputs: add r5, r5, #k (or sub, or through r12)
+func (g *ARMGenerator) emitShift(k int) {
+	if k == 0 {
+		return
+	}
+	g.emitAddImm(arm.R5, arm.R5, k)
+}
+
+// emitAdd outputs a load, add and store of the current cell. Under the
+// saturate and trap policies the cell is loaded zero- or sign-extended and
+// the 32-bit sum compared with the cell's range before the store, with a
+// conditional mov of the clamp or branch to _bf_trap.
+func (g *ARMGenerator) emitAdd(k int) {
+	if k == 0 {
+		return
+	}
+
+	if g.opts.Cells.Overflow == core.OverflowWrap {
+		g.emit(
+			arm.Ldrb(arm.R0, arm.R5, 0),                 // ldrb r0, [r5]
+			arm.AddImm(arm.R0, arm.R0, uint32(byte(k))), // add r0, r0, #k
+			arm.Strb(arm.R0, arm.R5, 0),                 // strb r0, [r5]
+		)
+		return
+	}
+
+	bound, cond := g.opts.Cells.Max(), arm.GT
+	if k < 0 {
+		bound, cond = g.opts.Cells.Min(), arm.LT
+	}
+
+	if g.opts.Cells.AlwaysOverflows(k) {
+		if g.opts.Cells.Overflow == core.OverflowTrap {
+			g.emitBranch(arm.B(0), fixupTrap, false) // b _bf_trap
+			return
+		}
+		g.emit(
+			arm.MovImm(arm.R0, uint32(byte(bound))), // mov r0, #clamp
+			arm.Strb(arm.R0, arm.R5, 0),             // strb r0, [r5]
+		)
+		return
+	}
+
+	if g.opts.Cells.Signed {
+		g.emit(arm.Ldrsb(arm.R0, arm.R5, 0)) // ldrsb r0, [r5]
+	} else {
+		g.emit(arm.Ldrb(arm.R0, arm.R5, 0)) // ldrb r0, [r5]
+	}
+	g.emitAddImm(arm.R0, arm.R0, k) // add r0, r0, #k
+	if bound < 0 {
+		g.emit(arm.CmnImm(arm.R0, uint32(-bound))) // cmn r0, #-min
+	} else {
+		g.emit(arm.CmpImm(arm.R0, uint32(bound))) // cmp r0, #max (or #0)
+	}
+
+	if g.opts.Cells.Overflow == core.OverflowSaturate {
+		g.emit(arm.If(cond, arm.MovImm(arm.R0, uint32(byte(bound))))) // movgt/movlt r0, #clamp
+	} else {
+		g.emitBranch(arm.If(cond, arm.B(0)), fixupTrap, false) // bgt/blt _bf_trap
+	}
+	g.emit(arm.Strb(arm.R0, arm.R5, 0)) // strb r0, [r5]
+}
+
+// emitLoopJump outputs the test and jump of a JZ or JNZ: a beq past the
+// loop's JNZ, or a bne back to its JZ.
+func (g *ARMGenerator) emitLoopJump(label int, jz bool) {
+	g.emit(
+		arm.Ldrb(arm.R0, arm.R5, 0), // ldrb r0, [r5]
+		arm.CmpImm(arm.R0, 0),       // cmp r0, #0
+	)
+	if jz {
+		g.emitBranch(arm.If(arm.EQ, arm.B(0)), label, true) // beq past the loop's JNZ
+	} else {
+		g.emitBranch(arm.If(arm.NE, arm.B(0)), label, false) // bne back to the loop's JZ
+	}
+}
+
+// emitByteLoop outputs a loop storing R0 to n cells from R1 on, or copying
+// them to the cells d along with copying. R2 counts down.
+func (g *ARMGenerator) emitByteLoop(n, d int, copying bool) {
+	if copying {
+		g.emitAddImm(arm.R3, arm.R1, d) // r3 = r1 + d
+	}
+	g.emitMovImm(arm.R2, uint32(n))
+
+	// loop:
+	start := len(g.code)
+	if copying {
+		g.emit(arm.LdrbPost(arm.R0, arm.R1, 1)) // ldrb r0, [r1], #1
+		g.emit(arm.StrbPost(arm.R0, arm.R3, 1)) // strb r0, [r3], #1
+	} else {
+		g.emit(arm.StrbPost(arm.R0, arm.R1, 1)) // strb r0, [r1], #1
+	}
+	g.emit(arm.SubsImm(arm.R2, arm.R2, 1))                  // subs r2, r2, #1
+	g.emit(arm.If(arm.NE, arm.B(int32(start-len(g.code))))) // bne loop
+}
+
+// emitZeroRange clears n cells from the data pointer.
+func (g *ARMGenerator) emitZeroRange(n int) {
+	g.emit(arm.Mov(arm.R1, arm.R5), arm.MovImm(arm.R0, 0))
+	g.emitByteLoop(n, 0, false)
+}
+
+// emitCopyRange copies n cells from the data pointer to d cells along. The
+// optimiser only emits non-overlapping ranges, so copying forwards is
+// always safe.
+func (g *ARMGenerator) emitCopyRange(n, d int) {
+	g.emit(arm.Mov(arm.R1, arm.R5))
+	g.emitByteLoop(n, d, true)
+}
+
+// emitSection starts the next chained program, zeroing the tape first for
+// core.HandoffReset.
+func (g *ARMGenerator) emitSection(h core.Handoff) {
+	if h == core.HandoffReset {
+		g.emit(arm.Mov(arm.R1, arm.R4), arm.MovImm(arm.R0, 0))
+		g.emitByteLoop(core.TapeSize, 0, false)
+	}
+	g.emitStartPointer()
+}
+
+// resolveFixups patches all branch targets, and the adr of the trap
+// message. The code ends below the tape, well within a branch's ±32 MiB.
+func (g *ARMGenerator) resolveFixups() {
+	for _, f := range g.fixups {
+		var target int
+		switch {
+		case f.targetIdx < 0:
+			target = g.helpers[f.targetIdx]
+		case f.loopEnd:
+			target = g.loopEnd[f.targetIdx]
+		default:
+			target = g.loopStart[f.targetIdx]
+		}
+
+		// Keep the placeholder's condition and opcode, taking the offset
+		// field from the instruction encoded for the real offset
+		off := int32(target - f.offset)
+		mask, enc := uint32(0xFFFFFF), arm.B(off)
+		if f.adr {
+			mask, enc = 0xFFF, arm.Adr(arm.R1, off)
+		}
+		insn := binary.LittleEndian.Uint32(g.code[f.offset:])
+		w := insn&^mask | binary.LittleEndian.Uint32(enc)&mask
+		binary.LittleEndian.PutUint32(g.code[f.offset:], w)
+	}
+}
@@ -0,0 +1,363 @@
+package linux
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/pkg/elf"
+	"github.com/lcox74/bfcc/pkg/i386"
+)
+
+// Linux i386 syscall numbers, made with int 0x80.
+const (
+	i386SysExit  = 1
+	i386SysRead  = 3
+	i386SysWrite = 4
+)
+
+// I386Costs is the size in bytes of the code for each op, for the
+// optimiser, with the wrapping cell model.
+var I386Costs = core.CostModel{Name: "386", Shift: 6, Add: 4, Zero: 4, IO: 5, Jump: 10, Range: 12}
+
+// I386Generator produces 32-bit x86 machine code from IR operations, for
+// old 32-bit machines and x86_64 kernels with IA-32 emulation. It takes the
+// same Options as the X86_64Generator, but only supports the cell model,
+// mid-tape, debug and progress ones.
+//
+// EBP holds the address of the current cell. The code sticks to the i386
+// instruction set: no multi-byte NOPs or conditional moves.
+type I386Generator struct {
+	ops       []core.Op
+	code      []byte
+	loopStart map[int]int // loop label -> code offset of its JZ
+	loopEnd   map[int]int // loop label -> code offset just past its JNZ
+	helpers   map[int]int // special fixup target -> code offset
+	fixups    []jumpFixup
+	codeBase  uint64
+	bssBase   uint64
+	bare      bool // boot with no OS, for GenerateMultiboot
+	opts      Settings
+}
+
+// NewI386Generator creates a new i386 machine code generator.
+func NewI386Generator(ops []core.Op, opts ...Option) *I386Generator {
+	g := &I386Generator{
+		ops:       ops,
+		code:      make([]byte, 0, 4096),
+		loopStart: make(map[int]int),
+		loopEnd:   make(map[int]int),
+		helpers:   make(map[int]int),
+		codeBase:  CodeBase + elf.PageSize, // Code starts after ELF headers
+		bssBase:   BSSBase,
+		opts:      ApplyOptions(opts...),
+	}
+
+	return g
+}
+
+// Generate produces raw i386 machine code.
+func (g *I386Generator) Generate() []byte {
+	if g.bare {
+		g.emitMultibootEntry()
+	}
+	g.emitStartPointer()
+
+	for i, op := range g.ops {
+		if op.Kind == core.OpJz {
+			g.loopStart[op.Arg] = len(g.code)
+		}
+		g.emitOp(op)
+		if op.Kind == core.OpJnz {
+			g.loopEnd[op.Arg] = len(g.code)
+		}
+		if progress := g.opts.Progress; progress != nil && (i+1)%ProgressEvery == 0 {
+			progress(i+1, len(g.ops))
+		}
+	}
+	if g.opts.Progress != nil {
+		g.opts.Progress(len(g.ops), len(g.ops))
+	}
+
+	g.emitEpilogue()
+	g.emitHelpers()
+	g.resolveFixups()
+
+	return g.code
+}
+
+// GenerateELF produces a complete ELF32 i386 executable.
+func (g *I386Generator) GenerateELF() []byte {
+	code := g.Generate()
+
+	builder := elf.NewBuilder()
+	builder.SetMachine(elf.EM_386)
+	builder.SetEntry(g.codeBase)
+	builder.AddLoadSegment(code, g.codeBase, elf.PF_R|elf.PF_X)
+	builder.AddBSSSegment(g.bssBase, core.TapeSize, elf.PF_R|elf.PF_W)
+
+	return builder.Build32()
+}
+
+// emitBytes appends a byte slice to the code buffer.
+func (g *I386Generator) emitBytes(b []byte) {
+	g.code = append(g.code, b...)
+}
+
+// emitJump emits a jump, call or movl whose last 4 bytes are patched by
+// resolveFixups to reach target.
+func (g *I386Generator) emitJump(b []byte, target int, loopEnd bool) {
+	g.emitBytes(b)
+	g.fixups = append(g.fixups, jumpFixup{offset: len(g.code) - 4, targetIdx: target, loopEnd: loopEnd})
+}
+
+// emitStartPointer points EBP at the first cell: 0, or the middle of the
+// tape with WithMidTape.
+func (g *I386Generator) emitStartPointer() {
+	start := g.bssBase
+	if g.opts.MidTape {
+		start += core.TapeSize / 2
+	}
+	g.emitBytes(i386.MovlImm32(i386.EBP, int32(start))) // movl $tape, %ebp
+}
+
+// emitEpilogue outputs the exit(0) syscall, or the halt of a bare-metal
+// run.
+func (g *I386Generator) emitEpilogue() {
+	if g.bare {
+		g.emitHalt(0)
+		return
+	}
+	g.emitBytes(i386.MovlImm32(i386.EAX, i386SysExit)) // movl $1, %eax
+	g.emitBytes(i386.XorlReg(i386.EBX))                // xorl %ebx, %ebx
+	g.emitBytes(i386.Int80())                          // int $0x80
+
+	if g.opts.Debug {
+		g.emitBytes(i386.Int3()) // int3
+	}
+}
+
+// alignCode pads the code buffer up to a multiple of align bytes: int3 in
+// debug builds, where padding is never meant to run, otherwise nop.
+func (g *I386Generator) alignCode(align int) {
+	pad := i386.Nop()
+	if g.opts.Debug {
+		pad = i386.Int3()
+	}
+	g.emitBytes(bytes.Repeat(pad, (align-len(g.code)%align)%align))
+}
+
+// emitHelpers outputs the I/O helper functions, and the trap helper and
+// its message for the trap policy.
+func (g *I386Generator) emitHelpers() {
+	if g.bare {
+		g.emitBareHelpers()
+		return
+	}
+	g.alignCode(16)
+
+	// _bf_read: read(0, cell, 1), storing EOF when it returns 0
+	eof := i386.MovbImm8Mem(g.opts.Cells.EOF())
+	g.helpers[fixupRead] = len(g.code)
+	g.emitBytes(i386.MovlImm32(i386.EAX, i386SysRead)) // movl $3, %eax
+	g.emitBytes(i386.XorlReg(i386.EBX))                // xorl %ebx, %ebx - stdin
+	g.emitBytes(i386.LealCell(i386.ECX, 0))            // leal 0(%ebp), %ecx
+	g.emitBytes(i386.MovlImm32(i386.EDX, 1))           // movl $1, %edx
+	g.emitBytes(i386.Int80())                          // int $0x80
+	g.emitBytes(i386.TestlReg(i386.EAX))               // testl %eax, %eax
+	g.emitBytes(i386.JnzRel32(int32(len(eof))))        // jnz over the store
+	g.emitBytes(eof)                                   // movb $0 (or $0xff), 0(%ebp)
+	g.emitBytes(i386.Ret())                            // ret
+
+	// _bf_write: write(1, cell, 1)
+	g.helpers[fixupWrite] = len(g.code)
+	g.emitBytes(i386.MovlImm32(i386.EAX, i386SysWrite)) // movl $4, %eax
+	g.emitBytes(i386.MovlImm32(i386.EBX, 1))            // movl $1, %ebx - stdout
+	g.emitBytes(i386.LealCell(i386.ECX, 0))             // leal 0(%ebp), %ecx
+	g.emitBytes(i386.MovlImm32(i386.EDX, 1))            // movl $1, %edx
+	g.emitBytes(i386.Int80())                           // int $0x80
+	g.emitBytes(i386.Ret())                             // ret
+
+	if g.opts.Cells.Overflow == core.OverflowTrap {
+		g.emitTrapHelper()
+	}
+}
+
+// emitTrapHelper outputs _bf_trap, which reports a cell overflow on stderr
+// and exits with status 1, followed by the message it prints.
+func (g *I386Generator) emitTrapHelper() {
+	g.helpers[fixupTrap] = len(g.code)
+	g.emitBytes(i386.MovlImm32(i386.EAX, i386SysWrite))          // movl $4, %eax
+	g.emitBytes(i386.MovlImm32(i386.EBX, 2))                     // movl $2, %ebx - stderr
+	g.emitJump(i386.MovlImm32(i386.ECX, 0), fixupTrapMsg, false) // movl $trap_msg, %ecx
+	g.emitBytes(i386.MovlImm32(i386.EDX, int32(len(trapMsg))))   // movl $len, %edx
+	g.emitBytes(i386.Int80())                                    // int $0x80
+	g.emitBytes(i386.MovlImm32(i386.EAX, i386SysExit))           // movl $1, %eax
+	g.emitBytes(i386.MovlImm32(i386.EBX, 1))                     // movl $1, %ebx
+	g.emitBytes(i386.Int80())                                    // int $0x80
+
+	g.helpers[fixupTrapMsg] = len(g.code)
+	g.emitBytes([]byte(trapMsg))
+}
+
+// emitOp outputs machine code for a single IR operation.
+func (g *I386Generator) emitOp(op core.Op) {
+	switch op.Kind {
+	case core.OpShift:
+		g.emitShift(op.Arg)
+	case core.OpAdd:
+		g.emitAdd(op.Arg)
+	case core.OpZero:
+		g.emitBytes(i386.MovbImm8Mem(0)) // movb $0, 0(%ebp)
+	case core.OpIn:
+		g.emitJump(i386.CallRel32(0), fixupRead, false) // call _bf_read
+	case core.OpOut:
+		g.emitJump(i386.CallRel32(0), fixupWrite, false) // call _bf_write
+	case core.OpJz:
+		g.emitBytes(i386.TestbMem())              // testb $0xff, 0(%ebp)
+		g.emitJump(i386.JzRel32(0), op.Arg, true) // jz past the loop's JNZ
+	case core.OpJnz:
+		g.emitBytes(i386.TestbMem())                // testb $0xff, 0(%ebp)
+		g.emitJump(i386.JnzRel32(0), op.Arg, false) // jnz back to the loop's JZ
+	case core.OpSection:
+		g.emitSection(core.Handoff(op.Arg))
+	case core.OpTrap:
+		g.emitBytes(i386.Int3()) // int3
+	case core.OpZeroRange:
+		g.emitBytes(i386.XorlReg(i386.EAX))                  // xorl %eax, %eax
+		g.emitBytes(i386.LealCell(i386.EDI, 0))              // leal 0(%ebp), %edi
+		g.emitBytes(i386.MovlImm32(i386.ECX, int32(op.Arg))) // movl $n, %ecx
+		g.emitBytes(i386.RepStosb())                         // rep stosb
+	case core.OpCopyRange:
+		// The optimiser only emits non-overlapping ranges
+		g.emitBytes(i386.LealCell(i386.ESI, 0))              // leal 0(%ebp), %esi
+		g.emitBytes(i386.LealCell(i386.EDI, int32(op.Off)))  // leal d(%ebp), %edi
+		g.emitBytes(i386.MovlImm32(i386.ECX, int32(op.Arg))) // movl $n, %ecx
+		g.emitBytes(i386.RepMovsb())                         // rep movsb
+	}
+}
+
+// emitSection starts the next chained program, zeroing the tape with
+// rep stosb first for core.HandoffReset.
+func (g *I386Generator) emitSection(h core.Handoff) {
+	if h == core.HandoffReset {
+		g.emitBytes(i386.XorlReg(i386.EAX))                     // xorl %eax, %eax
+		g.emitBytes(i386.MovlImm32(i386.EDI, int32(g.bssBase))) // movl $tape, %edi
+		g.emitBytes(i386.MovlImm32(i386.ECX, core.TapeSize))    // movl $30000, %ecx
+		g.emitBytes(i386.RepStosb())                            // rep stosb
+	}
+	g.emitStartPointer()
+}
+
+// emitShift outputs: addl/subl $k, %ebp
+func (g *I386Generator) emitShift(k int) {
+	if k > 0 {
+		g.emitBytes(i386.AddlImm32EBP(int32(k))) // addl $k, %ebp
+	} else if k < 0 {
+		g.emitBytes(i386.SublImm32EBP(int32(-k))) // subl $k, %ebp
+	}
+}
+
+// emitAdd outputs: addb/subb $k, 0(%ebp), checking the carry flag (or
+// overflow flag for signed cells) after each add under the saturate and
+// trap policies, as for x86_64.
+func (g *I386Generator) emitAdd(k int) {
+	if k == 0 {
+		return
+	}
+
+	if g.opts.Cells.Overflow == core.OverflowWrap {
+		g.emitAddSub(k)
+		return
+	}
+
+	if g.opts.Cells.AlwaysOverflows(k) {
+		g.emitOverflowed(k)
+		return
+	}
+
+	// The overflow flag is only meaningful for immediates in [-127, 127]
+	for g.opts.Cells.Signed && (k > 127 || k < -127) {
+		step := 127
+		if k < 0 {
+			step = -127
+		}
+		g.emitCheckedAdd(step)
+		k -= step
+	}
+	g.emitCheckedAdd(k)
+}
+
+// emitAddSub outputs a plain addb $k or subb $-k on the current cell.
+func (g *I386Generator) emitAddSub(k int) {
+	if k > 0 {
+		g.emitBytes(i386.AddbImm8Mem(uint8(k))) // addb $k, 0(%ebp)
+	} else {
+		g.emitBytes(i386.SubbImm8Mem(uint8(-k))) // subb $k, 0(%ebp)
+	}
+}
+
+// emitCheckedAdd outputs an add followed by the saturate clamp or trap jump.
+func (g *I386Generator) emitCheckedAdd(k int) {
+	g.emitAddSub(k)
+
+	if g.opts.Cells.Overflow == core.OverflowSaturate {
+		// jnc/jno over the clamp: movb $max/$min, 0(%ebp)
+		clamp := i386.MovbImm8Mem(byte(g.opts.Cells.Max()))
+		if k < 0 {
+			clamp = i386.MovbImm8Mem(byte(g.opts.Cells.Min()))
+		}
+		if g.opts.Cells.Signed {
+			g.emitBytes(i386.JnoRel32(int32(len(clamp))))
+		} else {
+			g.emitBytes(i386.JncRel32(int32(len(clamp))))
+		}
+		g.emitBytes(clamp)
+		return
+	}
+
+	if g.opts.Cells.Signed {
+		g.emitJump(i386.JoRel32(0), fixupTrap, false) // jo _bf_trap
+	} else {
+		g.emitJump(i386.JcRel32(0), fixupTrap, false) // jc _bf_trap
+	}
+}
+
+// emitOverflowed outputs an ADD k that is known to overflow: the saturated
+// value for the saturate policy or an unconditional jump to _bf_trap.
+func (g *I386Generator) emitOverflowed(k int) {
+	if g.opts.Cells.Overflow == core.OverflowSaturate {
+		if k > 0 {
+			g.emitBytes(i386.MovbImm8Mem(byte(g.opts.Cells.Max()))) // movb $max, 0(%ebp)
+		} else {
+			g.emitBytes(i386.MovbImm8Mem(byte(g.opts.Cells.Min()))) // movb $min, 0(%ebp)
+		}
+		return
+	}
+
+	g.emitJump(i386.JmpRel32(0), fixupTrap, false) // jmp _bf_trap
+}
+
+// resolveFixups patches all jump and call targets with their rel32, and
+// the trap message's movl and the keymap lookup with their absolute
+// addresses.
+func (g *I386Generator) resolveFixups() {
+	for _, fixup := range g.fixups {
+		var target int
+		switch {
+		case fixup.targetIdx < 0:
+			target = g.helpers[fixup.targetIdx]
+		case fixup.loopEnd:
+			target = g.loopEnd[fixup.targetIdx]
+		default:
+			target = g.loopStart[fixup.targetIdx]
+		}
+
+		// Relative to the end of the instruction, 4 bytes after the rel32
+		v := uint32(int32(target - (fixup.offset + 4)))
+		if fixup.targetIdx == fixupTrapMsg || fixup.targetIdx == fixupKeymap {
+			v = uint32(g.codeBase) + uint32(target)
+		}
+		binary.LittleEndian.PutUint32(g.code[fixup.offset:], v)
+	}
+}
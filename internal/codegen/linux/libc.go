@@ -0,0 +1,119 @@
+package linux
+
+import (
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/pkg/amd64"
+	"github.com/lcox74/bfcc/pkg/elf"
+)
+
+// mainFrame is the stack the GenerateObject main function reserves for
+// the tape: core.TapeSize cells, rounded up to keep the stack 16-byte
+// aligned for the C library calls.
+const mainFrame = (core.TapeSize+15)&^15 + 8
+
+// GenerateObject produces a relocatable x86_64 object file defining main,
+// for a C compiler to link against the C library:
+//
+//	cc prog.o -o prog
+//
+// Rather than making system calls, , and . call getchar and putchar, so
+// output is buffered by stdio and the object links on any x86_64 OS with
+// an ELF System V toolchain. The tape is zeroed on main's stack. main
+// returns 0 when the program finishes, or 1 once it has reported a cell
+// overflow under core.OverflowTrap. Options that read the process's
+// arguments or environment, write the tape out, trace, or add ELF
+// sections do not apply.
+func (g *X86_64Generator) GenerateObject() []byte {
+	g.libc = true
+	code := g.Generate()
+
+	entry := elf.Symbol{Name: "main", Size: uint64(len(code)), Type: elf.STT_FUNC, Global: true}
+	return elf.BuildObjectRelocs(elf.EM_X86_64, code, []elf.Symbol{entry}, g.relocs)
+}
+
+// emitMainEntry outputs the GenerateObject prologue: save the callee-saved
+// registers the code uses, and zero a tape on the stack into R13.
+func (g *X86_64Generator) emitMainEntry() {
+	g.emitBytes(amd64.PushReg(amd64.R12))                 // pushq %r12
+	g.emitBytes(amd64.PushReg(amd64.R13))                 // pushq %r13
+	g.emitBytes(amd64.SubqImm32RSP(mainFrame))            // subq $frame, %rsp
+	g.emitBytes(amd64.MovqRegReg(amd64.R13, amd64.RSP))   // movq %rsp, %r13 - tape
+	g.emitBytes(amd64.MovqRegReg(amd64.RDI, amd64.RSP))   // movq %rsp, %rdi
+	g.emitBytes(amd64.XorRAXRAX())                        // xorq %rax, %rax
+	g.emitBytes(amd64.MovqImm32RCX(int32(core.TapeSize))) // movq $30000, %rcx
+	g.emitBytes(amd64.RepStosb())                         // rep stosb
+}
+
+// emitMainReturn outputs the GenerateObject epilogue, returning 0. The
+// trap helper returns 1 by jumping to its second instruction, at
+// g.libReturn.
+func (g *X86_64Generator) emitMainReturn() {
+	g.emitBytes(amd64.XorRAXRAX()) // xorq %rax, %rax
+	g.libReturn = len(g.code)
+	g.emitBytes(amd64.AddqImm32RSP(mainFrame)) // addq $frame, %rsp
+	g.emitBytes(amd64.PopReg(amd64.R13))       // popq %r13
+	g.emitBytes(amd64.PopReg(amd64.R12))       // popq %r12
+	g.emitBytes(amd64.Ret())                   // ret
+}
+
+// emitCall outputs a call to the C library function name, recording the
+// relocation the linker fills in.
+func (g *X86_64Generator) emitCall(name string) {
+	g.relocs = append(g.relocs, elf.Reloc{
+		Offset: uint64(len(g.code) + 1), // rel32 starts at offset 1 in call instruction
+		Sym:    name,
+		Type:   elf.R_X86_64_PLT32,
+		Addend: -4,
+	})
+	g.emitBytes(amd64.CallRel32(0)) // call name
+}
+
+// emitLibcRead outputs the body of _bf_read that calls getchar. EOF, or
+// any negative result, sets the cell to 0, or -1 for signed cells, as in
+// the VM. The helper is called with the stack 16-byte aligned, so it
+// moves it down 8 for the call.
+func (g *X86_64Generator) emitLibcRead() {
+	eof := amd64.MovbImm8Mem(g.cells.EOF())
+	store := append(amd64.MovbALMem(), amd64.Ret()...)
+
+	g.emitBytes(amd64.SubqImm8Reg(amd64.RSP, 8))  // subq $8, %rsp
+	g.emitCall("getchar")                         // call getchar
+	g.emitBytes(amd64.AddqImm8Reg(amd64.RSP, 8))  // addq $8, %rsp
+	g.emitBytes(amd64.TestlRegReg(amd64.RAX))     // testl %eax, %eax
+	g.emitBytes(amd64.JsRel32(int32(len(store)))) // js eof
+	g.emitBytes(store)                            // movb %al, (%r13,%r12); ret
+
+	// eof:
+	g.emitBytes(eof)         // movb $0 (or $0xff), (%r13,%r12)
+	g.emitBytes(amd64.Ret()) // ret
+}
+
+// emitLibcWrite outputs the body of _bf_write that calls putchar with the
+// current cell.
+func (g *X86_64Generator) emitLibcWrite() {
+	g.emitBytes(amd64.SubqImm8Reg(amd64.RSP, 8))       // subq $8, %rsp
+	g.emitBytes(amd64.MovzxByteMemToReg(amd64.RDI, 0)) // movzbl (%r13,%r12), %edi
+	g.emitCall("putchar")                              // call putchar
+	g.emitBytes(amd64.AddqImm8Reg(amd64.RSP, 8))       // addq $8, %rsp
+	g.emitBytes(amd64.Ret())                           // ret
+}
+
+// emitLibcTrap outputs the body of _bf_trap that flushes stdout, so the
+// output so far comes before the report, writes the trap message to
+// stderr and returns 1 from main. It is jumped to from the program, not
+// called, so the stack is aligned for the calls and as the epilogue
+// expects.
+func (g *X86_64Generator) emitLibcTrap() {
+	g.emitBytes(amd64.XorRDIRDI()) // xorq %rdi, %rdi - all streams
+	g.emitCall("fflush")           // call fflush
+	g.fixups = append(g.fixups, jumpFixup{
+		offset:    len(g.code) + 3, // rel32 starts at offset 3 in lea instruction
+		targetIdx: fixupTrapMsg,
+	})
+	g.emitBytes(amd64.LeaqRIPRelRSI(0))                                 // leaq trap_msg(%rip), %rsi
+	g.emitBytes(amd64.MovqImm32RDI(2))                                  // movq $2, %rdi - stderr
+	g.emitBytes(amd64.MovqImm32RDX(int32(len(trapMsg))))                // movq $len, %rdx
+	g.emitCall("write")                                                 // call write
+	g.emitBytes(amd64.MovqImm32RAX(1))                                  // movq $1, %rax
+	g.emitBytes(amd64.JmpRel32(int32(g.libReturn - (len(g.code) + 5)))) // jmp to the restores
+}
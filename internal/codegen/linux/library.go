@@ -0,0 +1,159 @@
+package linux
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/pkg/amd64"
+	"github.com/lcox74/bfcc/pkg/ar"
+	"github.com/lcox74/bfcc/pkg/elf"
+)
+
+// The layout of the I/O hooks struct a library's entry function is given,
+// as declared in its header: the read and write function pointers and the
+// context passed to them.
+const (
+	hookRead  = 0
+	hookWrite = 8
+	hookCtx   = 16
+)
+
+// GenerateLibrary produces a static library for C programs to call the
+// program from, as an ar archive holding one object file, and the header
+// declaring it. The entry function is prefix_run, following the System V
+// x86_64 calling convention, so it links into programs for any x86_64 OS
+// but macOS and Windows:
+//
+//	int prefix_run(unsigned char *tape, const struct prefix_io *io);
+//
+// It runs the program on the caller's core.TapeSize cell tape, with ,
+// and . calling the hooks in io rather than making system calls, and
+// returns 0 when the program finishes, or 1 if it stops on a cell overflow
+// under core.OverflowTrap. Options that read the process's arguments or
+// environment, or add ELF sections, do not apply.
+func (g *X86_64Generator) GenerateLibrary(prefix string) (archive []byte, header string) {
+	g.lib = prefix
+	code := g.Generate()
+
+	entry := elf.Symbol{Name: prefix + "_run", Size: uint64(len(code)), Type: elf.STT_FUNC, Global: true}
+	object := elf.BuildObject(elf.EM_X86_64, code, []elf.Symbol{entry})
+	archive = ar.Build([]ar.Member{{Name: prefix + ".o", Data: object, Symbols: []string{entry.Name}}})
+	return archive, g.libraryHeader(prefix)
+}
+
+// emitLibraryEntry outputs the GenerateLibrary prologue: save the
+// callee-saved registers the code uses, which also aligns the stack for
+// the hook calls, and take the tape in R13 and the hooks in RBX.
+func (g *X86_64Generator) emitLibraryEntry() {
+	g.emitBytes(amd64.PushReg(amd64.RBX))               // pushq %rbx
+	g.emitBytes(amd64.PushReg(amd64.R12))               // pushq %r12
+	g.emitBytes(amd64.PushReg(amd64.R13))               // pushq %r13
+	g.emitBytes(amd64.MovqRegReg(amd64.R13, amd64.RDI)) // movq %rdi, %r13 - tape
+	g.emitBytes(amd64.MovqRegReg(amd64.RBX, amd64.RSI)) // movq %rsi, %rbx - hooks
+}
+
+// emitLibraryReturn outputs the GenerateLibrary epilogue, returning 0.
+// The trap helper returns 1 by jumping to its second instruction, at
+// g.libReturn.
+func (g *X86_64Generator) emitLibraryReturn() {
+	g.emitBytes(amd64.XorRAXRAX()) // xorq %rax, %rax
+	g.libReturn = len(g.code)
+	g.emitBytes(amd64.PopReg(amd64.R13)) // popq %r13
+	g.emitBytes(amd64.PopReg(amd64.R12)) // popq %r12
+	g.emitBytes(amd64.PopReg(amd64.RBX)) // popq %rbx
+	g.emitBytes(amd64.Ret())             // ret
+}
+
+// emitHookRead outputs the body of _bf_read that calls the read hook. A
+// negative result is end of input, where the cell is set to 0, or -1 for
+// signed cells, as in the VM. The helper is called with the stack 16-byte
+// aligned, so it moves it down 8 for the hook.
+func (g *X86_64Generator) emitHookRead() {
+	eof := amd64.MovbImm8Mem(g.cells.EOF())
+	store := append(amd64.MovbALMem(), amd64.Ret()...)
+
+	g.emitBytes(amd64.SubqImm8Reg(amd64.RSP, 8))                      // subq $8, %rsp
+	g.emitBytes(amd64.MovqRegDisp8Reg(amd64.RDI, amd64.RBX, hookCtx)) // movq 16(%rbx), %rdi - ctx
+	g.emitBytes(amd64.CallRegDisp8(amd64.RBX, hookRead))              // callq *(%rbx)
+	g.emitBytes(amd64.AddqImm8Reg(amd64.RSP, 8))                      // addq $8, %rsp
+	g.emitBytes(amd64.TestlRegReg(amd64.RAX))                         // testl %eax, %eax
+	g.emitBytes(amd64.JsRel32(int32(len(store))))                     // js eof
+	g.emitBytes(store)                                                // movb %al, (%r13,%r12); ret
+
+	// eof:
+	g.emitBytes(eof)         // movb $0 (or $0xff), (%r13,%r12)
+	g.emitBytes(amd64.Ret()) // ret
+}
+
+// emitHookWrite outputs the body of _bf_write that calls the write hook
+// with the current cell.
+func (g *X86_64Generator) emitHookWrite() {
+	g.emitBytes(amd64.SubqImm8Reg(amd64.RSP, 8))                      // subq $8, %rsp
+	g.emitBytes(amd64.MovzxByteMemToReg(amd64.RDI, 0))                // movzbl (%r13,%r12), %edi
+	g.emitBytes(amd64.MovqRegDisp8Reg(amd64.RSI, amd64.RBX, hookCtx)) // movq 16(%rbx), %rsi - ctx
+	g.emitBytes(amd64.CallRegDisp8(amd64.RBX, hookWrite))             // callq *8(%rbx)
+	g.emitBytes(amd64.AddqImm8Reg(amd64.RSP, 8))                      // addq $8, %rsp
+	g.emitBytes(amd64.Ret())                                          // ret
+}
+
+// emitHookTrap outputs the body of _bf_trap that returns 1 from the entry
+// function. It is jumped to from the program, not called, so the stack is
+// as the epilogue expects.
+func (g *X86_64Generator) emitHookTrap() {
+	g.emitBytes(amd64.MovqImm32RAX(1))                                  // movq $1, %rax
+	g.emitBytes(amd64.JmpRel32(int32(g.libReturn - (len(g.code) + 5)))) // jmp to the restores
+}
+
+// libraryHeader returns the C header declaring a GenerateLibrary entry
+// function and its hooks.
+func (g *X86_64Generator) libraryHeader(prefix string) string {
+	guard := strings.ToUpper(prefix) + "_H"
+	upper := strings.ToUpper(prefix)
+	start := "cell 0"
+	if g.midTape {
+		start = fmt.Sprintf("cell %d, the middle of the tape", core.TapeSize/2)
+	}
+	eof := "0"
+	if g.cells.Signed {
+		eof = "-1"
+	}
+	trap := ""
+	if g.cells.Overflow == core.OverflowTrap {
+		trap = ",\n * or 1 if it stops on a cell overflow"
+	}
+
+	return fmt.Sprintf(`/* Generated by bfcc: the entry function of %s, a Brainfuck program
+ * compiled for x86_64, and the I/O hooks it calls. */
+#ifndef %s
+#define %s
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+/* The number of cells on the tape %s_run is given. */
+#define %s_TAPE_SIZE %d
+
+/* The I/O hooks %s_run calls for , and . with ctx. */
+struct %s_io {
+	/* Returns the next input byte, or a negative value at end of input,
+	 * which sets the cell to %s. */
+	int (*read)(void *ctx);
+	/* Writes one output byte. */
+	void (*write)(unsigned char c, void *ctx);
+	void *ctx;
+};
+
+/* Runs the program on tape, %s_TAPE_SIZE cells that are usually zeroed
+ * first, from %s. Returns 0 when the program finishes%s.
+ * Nothing stops the program leaving the tape. */
+int %s_run(unsigned char *tape, const struct %s_io *io);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif /* %s */
+`, prefix, guard, guard, prefix, upper, core.TapeSize, prefix, prefix, eof, upper, start, trap, prefix, prefix, guard)
+}
@@ -0,0 +1,324 @@
+package linux
+
+import (
+	"encoding/binary"
+
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/pkg/elf"
+	"github.com/lcox74/bfcc/pkg/i386"
+)
+
+// Multiboot images are loaded at 1 MiB, above the BIOS area and VGA
+// memory, and boot in 32-bit protected mode with paging off and no
+// interrupt handlers, so the runtime drives the hardware directly.
+const (
+	MultibootBase  = 0x100000 // Load address of the code
+	multibootMagic = 0x1BADB002
+
+	vgaText     = 0xB8000 // VGA text buffer: 80x25 cells of character and attribute
+	vgaCols     = 80
+	vgaRows     = 25
+	vgaBlank    = 0x07200720 // two spaces, light grey on black
+	vgaAttr     = 0x07
+	vgaCRTC     = 0x3D4 // CRT controller index port, data at +1
+	com1        = 0x3F8 // First serial port; line status at +5
+	kbdData     = 0x60
+	kbdStatus   = 0x64
+	debugExit   = 0xF4 // QEMU's isa-debug-exit device
+	bareStack   = 4096
+	scancodes   = 58  // set 1 scancodes with a character, up to space
+	fixupSerial = -8  // _bf_serial helper
+	fixupVGA    = -9  // _bf_vga helper
+	fixupKeymap = -10 // scancode tables
+)
+
+// keymap maps set 1 scancodes to characters, unshifted then shifted, with
+// 0 for keys that have none.
+var keymap = [2 * scancodes]byte{
+	0, 0x1B, '1', '2', '3', '4', '5', '6', '7', '8', '9', '0', '-', '=', '\b', '\t',
+	'q', 'w', 'e', 'r', 't', 'y', 'u', 'i', 'o', 'p', '[', ']', '\n', 0, 'a', 's',
+	'd', 'f', 'g', 'h', 'j', 'k', 'l', ';', '\'', '`', 0, '\\', 'z', 'x', 'c', 'v',
+	'b', 'n', 'm', ',', '.', '/', 0, '*', 0, ' ',
+
+	0, 0x1B, '!', '@', '#', '$', '%', '^', '&', '*', '(', ')', '_', '+', '\b', '\t',
+	'Q', 'W', 'E', 'R', 'T', 'Y', 'U', 'I', 'O', 'P', '{', '}', '\n', 0, 'A', 'S',
+	'D', 'F', 'G', 'H', 'J', 'K', 'L', ':', '"', '~', 0, '|', 'Z', 'X', 'C', 'V',
+	'B', 'N', 'M', '<', '>', '?', 0, '*', 0, ' ',
+}
+
+// GenerateMultiboot produces an ELF32 image that a Multiboot loader, such
+// as GRUB or `qemu-system-i386 -kernel`, boots straight into. It runs
+// without an OS: OUT writes to the VGA text screen and the first serial
+// port, IN waits for a key on the PS/2 keyboard or a byte on the serial
+// port (input never ends), and at exit, or after a cell overflow trap, it
+// writes 0 (or 1) to port 0xf4, for QEMU's isa-debug-exit device, and
+// halts. EBX holds the screen position.
+func (g *I386Generator) GenerateMultiboot() []byte {
+	g.bare = true
+	g.codeBase = MultibootBase
+	code := g.Generate()
+
+	builder := elf.NewBuilder()
+	builder.SetMachine(elf.EM_386)
+	builder.SetEntry(g.codeBase + 12) // past the Multiboot header
+	builder.AddLoadSegment(code, g.codeBase, elf.PF_R|elf.PF_X)
+	builder.AddBSSSegment(g.bssBase, g.bareBSSSize(), elf.PF_R|elf.PF_W)
+
+	return builder.Build32()
+}
+
+// shiftState is the address of the byte recording whether shift is held,
+// just past the tape.
+func (g *I386Generator) shiftState() uint32 {
+	return uint32(g.bssBase) + core.TapeSize
+}
+
+// bareBSSSize is the size of the tape, the shift state and the stack above
+// them.
+func (g *I386Generator) bareBSSSize() uint64 {
+	return (core.TapeSize+1+15)&^15 + bareStack
+}
+
+// emitMultibootEntry outputs the Multiboot header, which the image starts
+// with, then the code the loader jumps to: set up a stack, zero the tape,
+// clear the screen, hide the cursor and set the serial port to 115200 8N1.
+func (g *I386Generator) emitMultibootEntry() {
+	var header []byte
+	header = binary.LittleEndian.AppendUint32(header, multibootMagic)
+	header = binary.LittleEndian.AppendUint32(header, 0)                    // flags
+	header = binary.LittleEndian.AppendUint32(header, 1<<32-multibootMagic) // checksum, summing to 0
+	g.emitBytes(header)
+
+	g.emitBytes(i386.Cli()) // cli
+	g.emitBytes(i386.Cld()) // cld
+	top := int32(g.bssBase + g.bareBSSSize())
+	g.emitBytes(i386.MovlImm32(i386.ESP, top)) // movl $stack_top, %esp
+
+	// The loader zeroes the BSS, but not every one can be trusted to
+	g.emitBytes(i386.XorlReg(i386.EAX))                     // xorl %eax, %eax
+	g.emitBytes(i386.MovlImm32(i386.EDI, int32(g.bssBase))) // movl $tape, %edi
+	g.emitBytes(i386.MovlImm32(i386.ECX, core.TapeSize+1))  // movl $30001, %ecx - and shift
+	g.emitBytes(i386.RepStosb())                            // rep stosb
+
+	g.emitBytes(i386.MovlImm32(i386.EAX, vgaBlank))          // movl $0x07200720, %eax
+	g.emitBytes(i386.MovlImm32(i386.EDI, vgaText))           // movl $0xb8000, %edi
+	g.emitBytes(i386.MovlImm32(i386.ECX, vgaCols*vgaRows/2)) // movl $1000, %ecx
+	g.emitBytes(i386.RepStosl())                             // rep stosl
+	g.emitOutb(vgaCRTC, 0x0A)                                // cursor start register
+	g.emitOutb(vgaCRTC+1, 0x20)                              // cursor off
+
+	g.emitOutb(com1+1, 0x00) // interrupts off
+	g.emitOutb(com1+3, 0x80) // divisor latch on
+	g.emitOutb(com1+0, 0x01) // divisor 1: 115200 baud
+	g.emitOutb(com1+1, 0x00)
+	g.emitOutb(com1+3, 0x03) // 8 bits, no parity, one stop bit
+	g.emitOutb(com1+2, 0xC7) // FIFOs on and cleared
+	g.emitOutb(com1+4, 0x03) // DTR and RTS
+
+	g.emitBytes(i386.XorlReg(i386.EBX)) // xorl %ebx, %ebx - top left
+}
+
+// emitOutb outputs a write of v to I/O port, clobbering EAX and EDX.
+func (g *I386Generator) emitOutb(port uint16, v uint8) {
+	g.emitBytes(i386.MovlImm32(i386.EDX, int32(port))) // movl $port, %edx
+	g.emitBytes(i386.MovbImm8Reg(i386.EAX, v))         // movb $v, %al
+	g.emitBytes(i386.OutbDX())                         // outb %al, %dx
+}
+
+// emitHalt outputs the end of a bare-metal run: status to isa-debug-exit,
+// which makes QEMU exit with (status << 1) | 1, then halt for good.
+func (g *I386Generator) emitHalt(status uint8) {
+	g.emitBytes(i386.MovbImm8Reg(i386.EAX, status)) // movb $status, %al
+	g.emitBytes(i386.OutbImm8(debugExit))           // outb %al, $0xf4
+	halt := len(g.code)
+	g.emitBytes(i386.Cli()) // cli
+	g.emitBytes(i386.Hlt()) // hlt
+	g.emitBackward(i386.JmpRel32, halt)
+}
+
+// emitForward emits a jump built by jump whose rel32 is patched later by
+// patchForward, returning the offset of the rel32.
+func (g *I386Generator) emitForward(jump func(int32) []byte) int {
+	g.emitBytes(jump(0))
+	return len(g.code) - 4
+}
+
+// patchForward points the jump emitted at rel32 offset at to the current
+// end of the code.
+func (g *I386Generator) patchForward(at int) {
+	binary.LittleEndian.PutUint32(g.code[at:], uint32(int32(len(g.code)-(at+4))))
+}
+
+// emitBackward emits a jump built by jump to the code offset target.
+func (g *I386Generator) emitBackward(jump func(int32) []byte, target int) {
+	size := len(jump(0))
+	g.emitBytes(jump(int32(target - (len(g.code) + size))))
+}
+
+// emitBareHelpers outputs the bare-metal I/O helpers, and the trap helper
+// and its message for the trap policy.
+func (g *I386Generator) emitBareHelpers() {
+	g.alignCode(16)
+
+	g.helpers[fixupRead] = len(g.code)
+	g.emitBareRead()
+
+	// _bf_write: the cell to the serial port, as \r\n for \n, and the screen
+	g.helpers[fixupWrite] = len(g.code)
+	g.emitBytes(i386.MovbCell(i386.EAX))              // movb 0(%ebp), %al
+	g.emitBytes(i386.CmpbImm8AL('\n'))                // cmpb $'\n', %al
+	notNewline := g.emitForward(i386.JnzRel32)        // jnz 1f
+	g.emitBytes(i386.MovbImm8Reg(i386.EAX, '\r'))     // movb $'\r', %al
+	g.emitJump(i386.CallRel32(0), fixupSerial, false) // call _bf_serial
+	g.patchForward(notNewline)                        // 1:
+	g.emitBytes(i386.MovbCell(i386.EAX))              // movb 0(%ebp), %al
+	g.emitJump(i386.CallRel32(0), fixupSerial, false) // call _bf_serial
+	g.emitBytes(i386.MovbCell(i386.EAX))              // movb 0(%ebp), %al
+	g.emitJump(i386.JmpRel32(0), fixupVGA, false)     // jmp _bf_vga
+
+	g.emitSerialOut()
+	g.emitVGAOut()
+
+	g.helpers[fixupKeymap] = len(g.code)
+	g.emitBytes(keymap[:])
+
+	if g.opts.Cells.Overflow == core.OverflowTrap {
+		// _bf_trap: the message, through _bf_write with EBP walking it
+		g.helpers[fixupTrap] = len(g.code)
+		g.emitJump(i386.MovlImm32(i386.EBP, 0), fixupTrapMsg, false) // movl $trap_msg, %ebp
+		next := len(g.code)
+		g.emitBytes(i386.MovbCell(i386.EAX))             // movb 0(%ebp), %al
+		g.emitBytes(i386.TestbImm8(i386.EAX, 0xff))      // testb $0xff, %al
+		done := g.emitForward(i386.JzRel32)              // jz done
+		g.emitJump(i386.CallRel32(0), fixupWrite, false) // call _bf_write
+		g.emitBytes(i386.IncReg(i386.EBP))               // incl %ebp
+		g.emitBackward(i386.JmpRel32, next)              // jmp next
+		g.patchForward(done)
+		g.emitHalt(1)
+
+		g.helpers[fixupTrapMsg] = len(g.code)
+		g.emitBytes([]byte(trapMsg + "\x00"))
+	}
+}
+
+// emitBareRead outputs _bf_read, polling the serial port and then the
+// keyboard until either has a character, and storing it in the cell. A
+// serial \r, as terminals send for Enter, is stored as \n.
+func (g *I386Generator) emitBareRead() {
+	poll := len(g.code)
+	g.emitBytes(i386.MovlImm32(i386.EDX, com1+5)) // movl $0x3fd, %edx
+	g.emitBytes(i386.InbDX())                     // inb %dx, %al
+	g.emitBytes(i386.TestbImm8(i386.EAX, 0x01))   // testb $1, %al - data ready
+	noSerial := g.emitForward(i386.JzRel32)       // jz kbd
+	g.emitBytes(i386.MovlImm32(i386.EDX, com1))   // movl $0x3f8, %edx
+	g.emitBytes(i386.InbDX())                     // inb %dx, %al
+	g.emitBytes(i386.CmpbImm8AL('\r'))            // cmpb $'\r', %al
+	notCR := g.emitForward(i386.JnzRel32)         // jnz store
+	g.emitBytes(i386.MovbImm8Reg(i386.EAX, '\n')) // movb $'\n', %al
+	fromSerial := g.emitForward(i386.JmpRel32)    // jmp store
+
+	// kbd:
+	g.patchForward(noSerial)
+	g.emitBytes(i386.InbImm8(kbdStatus))          // inb $0x64, %al
+	g.emitBytes(i386.TestbImm8(i386.EAX, 0x01))   // testb $1, %al - output full
+	g.emitBackward(i386.JzRel32, poll)            // jz poll
+	g.emitBytes(i386.MovlReg(i386.EAX, i386.ECX)) // movl %eax, %ecx
+	g.emitBytes(i386.InbImm8(kbdData))            // inb $0x60, %al
+	g.emitBytes(i386.TestbImm8(i386.ECX, 0x20))   // testb $0x20, %cl - from the mouse
+	g.emitBackward(i386.JnzRel32, poll)           // jnz poll
+
+	// Track shift, pressed (0x2a, 0x36) and released (0xaa, 0xb6)
+	var shifts []int
+	for _, code := range []uint8{0x2A, 0x36, 0xAA, 0xB6} {
+		g.emitBytes(i386.CmpbImm8AL(code))
+		shifts = append(shifts, g.emitForward(i386.JzRel32))
+	}
+
+	// Releases, and keys past space, have no character
+	g.emitBytes(i386.CmpbImm8AL(scancodes))                                 // cmpb $58, %al
+	g.emitBackward(i386.JncRel32, poll)                                     // jae poll
+	g.emitBytes(i386.Movzbl(i386.EAX, i386.EAX))                            // movzbl %al, %eax
+	g.emitBytes(i386.CmpbImm8Abs(g.shiftState(), 0))                        // cmpb $0, shift
+	unshifted := g.emitForward(i386.JzRel32)                                // jz 1f
+	g.emitBytes(i386.AddlImm32(i386.EAX, scancodes))                        // addl $58, %eax
+	g.patchForward(unshifted)                                               // 1:
+	g.emitJump(i386.MovbIndexed(i386.EAX, i386.EAX, 0), fixupKeymap, false) // movb keymap(%eax), %al
+	g.emitBytes(i386.TestbImm8(i386.EAX, 0xff))                             // testb $0xff, %al
+	g.emitBackward(i386.JzRel32, poll)                                      // jz poll
+
+	// store:
+	g.patchForward(notCR)
+	g.patchForward(fromSerial)
+	g.emitBytes(i386.MovbRegCell(i386.EAX)) // movb %al, 0(%ebp)
+	g.emitBytes(i386.Ret())                 // ret
+
+	for i, at := range shifts {
+		g.patchForward(at)
+		g.emitBytes(i386.MovbImm8Abs(g.shiftState(), uint8(1-i/2))) // movb $1 (or $0), shift
+		g.emitBackward(i386.JmpRel32, poll)                         // jmp poll
+	}
+}
+
+// emitSerialOut outputs _bf_serial, writing AL to the serial port once it
+// can take a byte. It clobbers ECX and EDX.
+func (g *I386Generator) emitSerialOut() {
+	g.helpers[fixupSerial] = len(g.code)
+	g.emitBytes(i386.MovlReg(i386.EAX, i386.ECX)) // movl %eax, %ecx
+	g.emitBytes(i386.MovlImm32(i386.EDX, com1+5)) // movl $0x3fd, %edx
+	wait := len(g.code)
+	g.emitBytes(i386.InbDX())                     // inb %dx, %al
+	g.emitBytes(i386.TestbImm8(i386.EAX, 0x20))   // testb $0x20, %al - transmitter empty
+	g.emitBackward(i386.JzRel32, wait)            // jz wait
+	g.emitBytes(i386.MovlReg(i386.ECX, i386.EAX)) // movl %ecx, %eax
+	g.emitBytes(i386.MovlImm32(i386.EDX, com1))   // movl $0x3f8, %edx
+	g.emitBytes(i386.OutbDX())                    // outb %al, %dx
+	g.emitBytes(i386.Ret())                       // ret
+}
+
+// emitVGAOut outputs _bf_vga, writing AL to the screen at EBX and moving
+// on, with \n starting the next line and \r returning to the start of this
+// one. Past the bottom, the screen scrolls up a line. It clobbers EAX, ECX,
+// EDX, ESI and EDI.
+func (g *I386Generator) emitVGAOut() {
+	g.helpers[fixupVGA] = len(g.code)
+	g.emitBytes(i386.CmpbImm8AL('\r'))             // cmpb $'\r', %al
+	cr := g.emitForward(i386.JzRel32)              // jz cr
+	g.emitBytes(i386.CmpbImm8AL('\n'))             // cmpb $'\n', %al
+	glyph := g.emitForward(i386.JnzRel32)          // jnz glyph
+	g.emitBytes(i386.AddlImm32(i386.EBX, vgaCols)) // addl $80, %ebx
+
+	// cr: EBX -= EBX % 80
+	g.patchForward(cr)
+	g.emitBytes(i386.MovlReg(i386.EBX, i386.EAX))  // movl %ebx, %eax
+	g.emitBytes(i386.XorlReg(i386.EDX))            // xorl %edx, %edx
+	g.emitBytes(i386.MovlImm32(i386.ECX, vgaCols)) // movl $80, %ecx
+	g.emitBytes(i386.Divl(i386.ECX))               // divl %ecx
+	g.emitBytes(i386.SublReg(i386.EDX, i386.EBX))  // subl %edx, %ebx
+	check := g.emitForward(i386.JmpRel32)          // jmp check
+
+	// glyph:
+	g.patchForward(glyph)
+	g.emitBytes(i386.Movzbl(i386.EAX, i386.EAX))              // movzbl %al, %eax
+	g.emitBytes(i386.OrlImm32(i386.EAX, vgaAttr<<8))          // orl $0x700, %eax
+	g.emitBytes(i386.MovwScaled(i386.EAX, i386.EBX, vgaText)) // movw %ax, 0xb8000(,%ebx,2)
+	g.emitBytes(i386.IncReg(i386.EBX))                        // incl %ebx
+
+	// check:
+	g.patchForward(check)
+	g.emitBytes(i386.CmplImm32(i386.EBX, vgaCols*vgaRows)) // cmpl $2000, %ebx
+	onScreen := g.emitForward(i386.JcRel32)                // jb done
+
+	// Scroll up a line and blank the last
+	g.emitBytes(i386.MovlImm32(i386.ESI, vgaText+2*vgaCols))     // movl $0xb80a0, %esi
+	g.emitBytes(i386.MovlImm32(i386.EDI, vgaText))               // movl $0xb8000, %edi
+	g.emitBytes(i386.MovlImm32(i386.ECX, vgaCols*(vgaRows-1)/2)) // movl $960, %ecx
+	g.emitBytes(i386.RepMovsl())                                 // rep movsl
+	g.emitBytes(i386.MovlImm32(i386.EAX, vgaBlank))              // movl $0x07200720, %eax
+	g.emitBytes(i386.MovlImm32(i386.ECX, vgaCols/2))             // movl $40, %ecx
+	g.emitBytes(i386.RepStosl())                                 // rep stosl
+	g.emitBytes(i386.MovlImm32(i386.EBX, vgaCols*(vgaRows-1)))   // movl $1920, %ebx
+
+	// done:
+	g.patchForward(onScreen)
+	g.emitBytes(i386.Ret()) // ret
+}
@@ -0,0 +1,441 @@
+package linux
+
+import (
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/pkg/elf"
+	rv "github.com/lcox74/bfcc/pkg/riscv64"
+)
+
+// RISC-V Linux syscall numbers, from the generic syscall table.
+const (
+	rvSysRead  = 63
+	rvSysWrite = 64
+	rvSysExit  = 93
+)
+
+// rvFixupKind is how a riscv64 fixup reaches its target.
+type rvFixupKind int
+
+const (
+	// rvJump is a jal to reg, with a nop after it, or an auipc and jalr
+	// through T6 when the target is out of jal range.
+	rvJump rvFixupKind = iota
+	// rvAddr is an auipc and addi loading the target's address into reg.
+	rvAddr
+)
+
+// rvFixup records an 8-byte instruction pair to patch once the target's
+// offset is known.
+type rvFixup struct {
+	offset    int // Offset in code of the first instruction
+	targetIdx int // loop label of the jump target, or a special target
+	loopEnd   bool
+	kind      rvFixupKind
+	reg       rv.Reg // link register for rvJump, destination for rvAddr
+}
+
+// RISCV64Costs is the size in bytes of the code for each op, for the
+// optimiser, with the wrapping cell model. SHIFTs past an addi immediate
+// take a li and an add.
+var RISCV64Costs = core.CostModel{Name: "riscv64", Shift: 4, FarShift: 12, NearShift: 2047, Add: 12, Zero: 4, IO: 8, Jump: 16, Range: 34}
+
+// RISCV64Generator produces RV64I machine code from IR operations, for
+// RISC-V Linux boards and qemu-user. It takes the same Options as the
+// X86_64Generator, but only supports the cell model, mid-tape, debug, ident
+// and progress ones.
+//
+// S0 holds the tape base and S1 the address of the current cell; T0 to T2
+// are scratch and T6 is used for far jumps.
+type RISCV64Generator struct {
+	ops       []core.Op
+	code      []byte
+	loopStart map[int]int // loop label -> code offset of its JZ
+	loopEnd   map[int]int // loop label -> code offset just past its JNZ
+	helpers   map[int]int // special fixup target -> code offset
+	fixups    []rvFixup
+	codeBase  uint64
+	bssBase   uint64
+	opts      Settings
+}
+
+// NewRISCV64Generator creates a new riscv64 machine code generator.
+func NewRISCV64Generator(ops []core.Op, opts ...Option) *RISCV64Generator {
+	g := &RISCV64Generator{
+		ops:       ops,
+		code:      make([]byte, 0, 4096),
+		loopStart: make(map[int]int),
+		loopEnd:   make(map[int]int),
+		helpers:   make(map[int]int),
+		codeBase:  CodeBase + elf.PageSize, // Code starts after ELF headers
+		bssBase:   BSSBase,
+		opts:      ApplyOptions(opts...),
+	}
+
+	return g
+}
+
+// Generate produces raw riscv64 machine code.
+func (g *RISCV64Generator) Generate() []byte {
+	g.emitPrologue()
+
+	for i, op := range g.ops {
+		if op.Kind == core.OpJz {
+			g.loopStart[op.Arg] = len(g.code)
+		}
+		g.emitOp(op)
+		if op.Kind == core.OpJnz {
+			g.loopEnd[op.Arg] = len(g.code)
+		}
+		if progress := g.opts.Progress; progress != nil && (i+1)%ProgressEvery == 0 {
+			progress(i+1, len(g.ops))
+		}
+	}
+	if g.opts.Progress != nil {
+		g.opts.Progress(len(g.ops), len(g.ops))
+	}
+
+	g.emitEpilogue()
+	g.emitHelpers()
+	g.resolveFixups()
+
+	return g.code
+}
+
+// GenerateELF produces a complete ELF64 RISC-V executable.
+func (g *RISCV64Generator) GenerateELF() []byte {
+	code := g.Generate()
+
+	builder := elf.NewBuilder()
+	builder.SetMachine(elf.EM_RISCV)
+	builder.SetEntry(g.codeBase)
+	builder.AddLoadSegment(code, g.codeBase, elf.PF_R|elf.PF_X)
+	builder.AddBSSSegment(g.bssBase, core.TapeSize, elf.PF_R|elf.PF_W)
+	addIdent(builder, g.opts.Ident, g.opts.Flags)
+
+	return builder.Build()
+}
+
+// emit appends instructions to the code buffer.
+func (g *RISCV64Generator) emit(insns ...[]byte) {
+	for _, b := range insns {
+		g.code = append(g.code, b...)
+	}
+}
+
+// emitFixup emits a placeholder instruction pair for f, patched by
+// resolveFixups.
+func (g *RISCV64Generator) emitFixup(f rvFixup) {
+	f.offset = len(g.code)
+	g.fixups = append(g.fixups, f)
+	g.emit(rv.Nop(), rv.Nop()) // Placeholder
+}
+
+// emitCall outputs a call to a runtime helper.
+func (g *RISCV64Generator) emitCall(helper int) {
+	g.emitFixup(rvFixup{targetIdx: helper, kind: rvJump, reg: rv.RA})
+}
+
+// emitLi loads a 32-bit immediate into rd.
+func (g *RISCV64Generator) emitLi(rd rv.Reg, imm int) {
+	g.emit(rv.Li(rd, int32(imm)))
+}
+
+// emitAddImm outputs rd = rs + imm, through T0 when imm does not fit an
+// addi. rd and rs must not be T0 in that case.
+func (g *RISCV64Generator) emitAddImm(rd, rs rv.Reg, imm int) {
+	if rv.FitsImm12(int64(imm)) {
+		g.emit(rv.Addi(rd, rs, int32(imm)))
+		return
+	}
+	g.emitLi(rv.T0, imm)
+	g.emit(rv.Add(rd, rs, rv.T0))
+}
+
+// emitPrologue outputs the program start: load S0 with the tape base and
+// S1 with the first cell.
+func (g *RISCV64Generator) emitPrologue() {
+	g.emit(rv.Lui(rv.S0, int32(g.bssBase>>12))) // lui s0, %hi(tape)
+	g.emitStartPointer()
+}
+
+// emitStartPointer points S1 at the first cell: 0, or the middle of the
+// tape with WithMidTape.
+func (g *RISCV64Generator) emitStartPointer() {
+	if g.opts.MidTape {
+		g.emitAddImm(rv.S1, rv.S0, core.TapeSize/2) // s1 = s0 + 15000
+		return
+	}
+	g.emit(rv.Mv(rv.S1, rv.S0)) // mv s1, s0
+}
+
+// emitEpilogue outputs the exit(0) syscall.
+func (g *RISCV64Generator) emitEpilogue() {
+	g.emit(
+		rv.Addi(rv.A7, rv.Zero, rvSysExit), // li a7, 93
+		rv.Mv(rv.A0, rv.Zero),              // li a0, 0
+		rv.Ecall(),                         // ecall
+	)
+	if g.opts.Debug {
+		g.emit(rv.Ebreak()) // ebreak
+	}
+}
+
+// alignCode pads the code buffer up to a multiple of align bytes: with
+// ebreak in debug builds, where padding is never meant to run, otherwise
+// with nop.
+func (g *RISCV64Generator) alignCode(align int) {
+	for len(g.code)%align != 0 {
+		if g.opts.Debug {
+			g.emit(rv.Ebreak())
+		} else {
+			g.emit(rv.Nop())
+		}
+	}
+}
+
+// emitHelpers outputs the I/O helper functions, and the trap helper and
+// its message for the trap policy.
+func (g *RISCV64Generator) emitHelpers() {
+	g.alignCode(16)
+
+	// _bf_read: read(0, s1, 1), storing EOF when it returns 0
+	eof := int32(int8(g.opts.Cells.EOF()))
+	g.helpers[fixupRead] = len(g.code)
+	g.emit(
+		rv.Addi(rv.A7, rv.Zero, rvSysRead), // li a7, 63
+		rv.Mv(rv.A0, rv.Zero),              // li a0, 0 - stdin
+		rv.Mv(rv.A1, rv.S1),                // mv a1, s1
+		rv.Addi(rv.A2, rv.Zero, 1),         // li a2, 1
+		rv.Ecall(),                         // ecall
+		rv.Bnez(rv.A0, 12),                 // bnez a0, over the store
+		rv.Addi(rv.T0, rv.Zero, eof),       // li t0, 0 (or -1)
+		rv.Sb(rv.T0, rv.S1, 0),             // sb t0, 0(s1)
+		rv.Ret(),                           // ret
+	)
+
+	// _bf_write: write(1, s1, 1)
+	g.helpers[fixupWrite] = len(g.code)
+	g.emit(
+		rv.Addi(rv.A7, rv.Zero, rvSysWrite), // li a7, 64
+		rv.Addi(rv.A0, rv.Zero, 1),          // li a0, 1 - stdout
+		rv.Mv(rv.A1, rv.S1),                 // mv a1, s1
+		rv.Addi(rv.A2, rv.Zero, 1),          // li a2, 1
+		rv.Ecall(),                          // ecall
+		rv.Ret(),                            // ret
+	)
+
+	if g.opts.Cells.Overflow == core.OverflowTrap {
+		g.emitTrapHelper()
+	}
+}
+
+// emitTrapHelper outputs _bf_trap, which reports a cell overflow on stderr
+// and exits with status 1, followed by the message it prints.
+func (g *RISCV64Generator) emitTrapHelper() {
+	msgLen := int32(len(trapMsg))
+	g.helpers[fixupTrap] = len(g.code)
+	g.emitFixup(rvFixup{targetIdx: fixupTrapMsg, kind: rvAddr, reg: rv.A1}) // la a1, trap_msg
+	g.emit(
+		rv.Addi(rv.A7, rv.Zero, rvSysWrite), // li a7, 64
+		rv.Addi(rv.A0, rv.Zero, 2),          // li a0, 2 - stderr
+		rv.Addi(rv.A2, rv.Zero, msgLen),     // li a2, len
+		rv.Ecall(),                          // ecall
+		rv.Addi(rv.A7, rv.Zero, rvSysExit),  // li a7, 93
+		rv.Addi(rv.A0, rv.Zero, 1),          // li a0, 1
+		rv.Ecall(),                          // ecall
+	)
+
+	g.helpers[fixupTrapMsg] = len(g.code)
+	g.emit([]byte(trapMsg))
+}
+
+// emitOp outputs machine code for a single IR operation.
+func (g *RISCV64Generator) emitOp(op core.Op) {
+	switch op.Kind {
+	case core.OpShift:
+		g.emitShift(op.Arg)
+	case core.OpAdd:
+		g.emitAdd(op.Arg)
+	case core.OpZero:
+		g.emit(rv.Sb(rv.Zero, rv.S1, 0)) // sb zero, 0(s1)
+	case core.OpIn:
+		g.emitCall(fixupRead)
+	case core.OpOut:
+		g.emitCall(fixupWrite)
+	case core.OpJz:
+		g.emitLoopJump(op.Arg, true)
+	case core.OpJnz:
+		g.emitLoopJump(op.Arg, false)
+	case core.OpSection:
+		g.emitSection(core.Handoff(op.Arg))
+	case core.OpTrap:
+		g.emit(rv.Ebreak()) // ebreak
+	case core.OpZeroRange:
+		g.emitZeroRange(op.Arg)
+	case core.OpCopyRange:
+		g.emitCopyRange(op.Arg, op.Off)
+	}
+}
+
+// emitShift outputs: addi s1, s1, k (or li t0, k; add s1, s1, t0)
+func (g *RISCV64Generator) emitShift(k int) {
+	if k == 0 {
+		return
+	}
+	g.emitAddImm(rv.S1, rv.S1, k)
+}
+
+// emitAdd outputs a load, add and store of the current cell. Under the
+// saturate and trap policies the sum is range checked before the store,
+// as RISC-V has no flags.
+func (g *RISCV64Generator) emitAdd(k int) {
+	if k == 0 {
+		return
+	}
+
+	if g.opts.Cells.Overflow == core.OverflowWrap {
+		g.emit(
+			rv.Lbu(rv.T0, rv.S1, 0),               // lbu t0, 0(s1)
+			rv.Addi(rv.T0, rv.T0, int32(int8(k))), // addi t0, t0, k
+			rv.Sb(rv.T0, rv.S1, 0),                // sb t0, 0(s1)
+		)
+		return
+	}
+
+	clamp := g.opts.Cells.Max()
+	if k < 0 {
+		clamp = g.opts.Cells.Min()
+	}
+
+	if g.opts.Cells.AlwaysOverflows(k) {
+		if g.opts.Cells.Overflow == core.OverflowTrap {
+			g.emitFixup(rvFixup{targetIdx: fixupTrap, kind: rvJump, reg: rv.Zero}) // j _bf_trap
+			return
+		}
+		g.emit(
+			rv.Addi(rv.T0, rv.Zero, int32(clamp)), // li t0, clamp
+			rv.Sb(rv.T0, rv.S1, 0),                // sb t0, 0(s1)
+		)
+		return
+	}
+
+	// T1 is set when the sum is in range: 0 to 255, or -128 to 127 for
+	// signed cells, checked as an unsigned compare after a bias of 128
+	if g.opts.Cells.Signed {
+		g.emit(
+			rv.Lb(rv.T0, rv.S1, 0),          // lb t0, 0(s1)
+			rv.Addi(rv.T0, rv.T0, int32(k)), // addi t0, t0, k
+			rv.Addi(rv.T1, rv.T0, 128),      // addi t1, t0, 128
+			rv.Sltiu(rv.T1, rv.T1, 256),     // sltiu t1, t1, 256
+		)
+	} else {
+		g.emit(
+			rv.Lbu(rv.T0, rv.S1, 0),         // lbu t0, 0(s1)
+			rv.Addi(rv.T0, rv.T0, int32(k)), // addi t0, t0, k
+			rv.Sltiu(rv.T1, rv.T0, 256),     // sltiu t1, t0, 256
+		)
+	}
+
+	if g.opts.Cells.Overflow == core.OverflowSaturate {
+		g.emit(
+			rv.Bnez(rv.T1, 8),                     // bnez t1, over the clamp
+			rv.Addi(rv.T0, rv.Zero, int32(clamp)), // li t0, clamp
+		)
+	} else {
+		g.emit(rv.Bnez(rv.T1, 12))                                             // bnez t1, over the jump
+		g.emitFixup(rvFixup{targetIdx: fixupTrap, kind: rvJump, reg: rv.Zero}) // j _bf_trap
+	}
+	g.emit(rv.Sb(rv.T0, rv.S1, 0)) // sb t0, 0(s1)
+}
+
+// emitLoopJump outputs the test and jump of a JZ or JNZ: a branch over a
+// jump to past the loop's JNZ, or back to its JZ. Branches only reach
+// ±4 KiB, so the jump is separate to keep every loop the same shape.
+func (g *RISCV64Generator) emitLoopJump(label int, jz bool) {
+	g.emit(rv.Lbu(rv.T0, rv.S1, 0)) // lbu t0, 0(s1)
+	if jz {
+		g.emit(rv.Bnez(rv.T0, 12)) // bnez t0, into the loop
+	} else {
+		g.emit(rv.Beqz(rv.T0, 12)) // beqz t0, out of the loop
+	}
+	g.emitFixup(rvFixup{targetIdx: label, loopEnd: jz, kind: rvJump, reg: rv.Zero})
+}
+
+// emitByteLoop outputs a loop storing T2 to n cells from T1 on, or copying
+// them to the cells d along with copying. T0 counts down.
+func (g *RISCV64Generator) emitByteLoop(n, d int, copying bool) {
+	g.emitLi(rv.T0, n)
+	if copying {
+		g.emitLi(rv.T3, d)
+		g.emit(rv.Add(rv.T3, rv.T1, rv.T3)) // add t3, t1, t3
+	}
+
+	// loop:
+	start := len(g.code)
+	if copying {
+		g.emit(
+			rv.Lbu(rv.T2, rv.T1, 0), // lbu t2, 0(t1)
+			rv.Sb(rv.T2, rv.T3, 0),  // sb t2, 0(t3)
+			rv.Addi(rv.T3, rv.T3, 1),
+		)
+	} else {
+		g.emit(rv.Sb(rv.T2, rv.T1, 0)) // sb t2, 0(t1)
+	}
+	g.emit(
+		rv.Addi(rv.T1, rv.T1, 1),  // addi t1, t1, 1
+		rv.Addi(rv.T0, rv.T0, -1), // addi t0, t0, -1
+	)
+	g.emit(rv.Bnez(rv.T0, int32(start-len(g.code)))) // bnez t0, loop
+}
+
+// emitZeroRange clears n cells from the data pointer.
+func (g *RISCV64Generator) emitZeroRange(n int) {
+	g.emit(rv.Mv(rv.T1, rv.S1), rv.Mv(rv.T2, rv.Zero))
+	g.emitByteLoop(n, 0, false)
+}
+
+// emitCopyRange copies n cells from the data pointer to d cells along. The
+// optimiser only emits non-overlapping ranges, so copying forwards is
+// always safe.
+func (g *RISCV64Generator) emitCopyRange(n, d int) {
+	g.emit(rv.Mv(rv.T1, rv.S1))
+	g.emitByteLoop(n, d, true)
+}
+
+// emitSection starts the next chained program, zeroing the tape first for
+// core.HandoffReset.
+func (g *RISCV64Generator) emitSection(h core.Handoff) {
+	if h == core.HandoffReset {
+		g.emit(rv.Mv(rv.T1, rv.S0), rv.Mv(rv.T2, rv.Zero))
+		g.emitByteLoop(core.TapeSize, 0, false)
+	}
+	g.emitStartPointer()
+}
+
+// resolveFixups patches all jump, call and address targets.
+func (g *RISCV64Generator) resolveFixups() {
+	for _, f := range g.fixups {
+		var target int
+		switch {
+		case f.targetIdx < 0:
+			target = g.helpers[f.targetIdx]
+		case f.loopEnd:
+			target = g.loopEnd[f.targetIdx]
+		default:
+			target = g.loopStart[f.targetIdx]
+		}
+
+		off := int32(target - f.offset)
+		hi, lo := rv.HiLo(off)
+		var pair []byte
+		switch {
+		case f.kind == rvAddr:
+			pair = append(rv.Auipc(f.reg, hi), rv.Addi(f.reg, f.reg, lo)...)
+		case rv.FitsJal(int64(off)):
+			pair = append(rv.Jal(f.reg, off), rv.Nop()...)
+		default:
+			pair = append(rv.Auipc(rv.T6, hi), rv.Jalr(f.reg, rv.T6, lo)...)
+		}
+		copy(g.code[f.offset:], pair)
+	}
+}
@@ -0,0 +1,134 @@
+package linux
+
+import (
+	"fmt"
+
+	"github.com/lcox74/bfcc/pkg/amd64"
+)
+
+// sysArgRegs are the registers x86_64 system calls take their arguments
+// in, in order.
+var sysArgRegs = [...]amd64.Reg{amd64.RDI, amd64.RSI, amd64.RDX, amd64.R10, amd64.R8, amd64.R9}
+
+// mmap protections, the same on every supported OS.
+const (
+	protNone  = 0
+	protRead  = 1
+	protWrite = 2
+)
+
+// sysArg is one system call argument: an immediate, or a register that
+// already holds it.
+type sysArg struct {
+	reg   amd64.Reg
+	imm   int32
+	inReg bool
+}
+
+// argImm is an immediate argument.
+func argImm(v int32) sysArg { return sysArg{imm: v} }
+
+// argReg is an argument held in r.
+func argReg(r amd64.Reg) sysArg { return sysArg{reg: r, inReg: true} }
+
+// emitSyscall outputs system call nr with up to six args, leaving its
+// result in RAX and, as the syscall instruction does, clobbering RCX and
+// R11. Arguments are moved into place in order, so a register argument
+// must not be the register of an earlier one, unless it is already there.
+func (g *X86_64Generator) emitSyscall(nr int32, args ...sysArg) {
+	if len(args) > len(sysArgRegs) {
+		panic(fmt.Sprintf("linux: syscall %d with %d arguments", nr, len(args)))
+	}
+	for i, arg := range args {
+		dst := sysArgRegs[i]
+		switch {
+		case arg.inReg && arg.reg == dst:
+		case arg.inReg:
+			for _, earlier := range sysArgRegs[:i] {
+				if earlier == arg.reg {
+					panic(fmt.Sprintf("linux: syscall %d argument %d is in an earlier argument's register", nr, i+1))
+				}
+			}
+			g.emitBytes(amd64.MovqRegReg(dst, arg.reg)) // movq %reg, %dst
+		case arg.imm == 0:
+			g.emitBytes(amd64.XorqRegReg(dst)) // xorq %dst, %dst
+		default:
+			g.emitBytes(amd64.MovqImm32Reg(dst, arg.imm)) // movq $imm, %dst
+		}
+	}
+	if nr == 0 {
+		g.emitBytes(amd64.XorRAXRAX()) // xorq %rax, %rax
+	} else {
+		g.emitBytes(amd64.MovqImm32RAX(nr)) // movq $nr, %rax
+	}
+	g.emitBytes(amd64.Syscall()) // syscall
+}
+
+// emitSyscallFailed outputs a forward jump taken when the system call just
+// made failed, returning its rel32 offset for patchJump.
+func (g *X86_64Generator) emitSyscallFailed() int {
+	if g.sys.CarryError {
+		return g.emitJump(amd64.JcRel32(0)) // jc failed - errno
+	}
+	g.emitBytes(amd64.CmpqImm32RAX(-4096)) // cmpq $-4096, %rax
+	return g.emitJump(amd64.JaRel32(0))    // ja failed - -errno
+}
+
+// sysNumber returns call, or an error if it is 0: a call the OS lacks,
+// for a feature that should have been rejected before code generation.
+func sysNumber(name string, call int32) (int32, error) {
+	if call == 0 {
+		return 0, fmt.Errorf("linux: %s is not supported on this OS", name)
+	}
+	return call, nil
+}
+
+// emitFeatureSyscall outputs system call name, numbered call, with args,
+// for the calls only some features make. If the OS lacks it, nothing is
+// output and the error is kept for Err.
+func (g *X86_64Generator) emitFeatureSyscall(name string, call int32, args ...sysArg) {
+	nr, err := sysNumber(name, call)
+	if err != nil {
+		if g.err == nil {
+			g.err = err
+		}
+		return
+	}
+	g.emitSyscall(nr, args...)
+}
+
+// emitMmap outputs mmap(NULL, length, prot, MAP_PRIVATE|MAP_ANONYMOUS,
+// -1, 0) for a zeroed private mapping, its address left in RAX.
+func (g *X86_64Generator) emitMmap(length sysArg, prot int32) {
+	g.emitSyscall(g.sys.Mmap, argImm(0), length, argImm(prot), argImm(g.sys.MapAnonPrivate), argImm(-1), argImm(0))
+}
+
+// emitMprotect outputs mprotect(addr, length, prot), setting the
+// protection of the pages from addr.
+func (g *X86_64Generator) emitMprotect(addr amd64.Reg, length, prot int32) {
+	g.emitFeatureSyscall("mprotect", g.sys.Mprotect, argReg(addr), argImm(length), argImm(prot))
+}
+
+// emitNanosleep outputs nanosleep(req, NULL), req pointing at a timespec.
+func (g *X86_64Generator) emitNanosleep(req amd64.Reg) {
+	g.emitFeatureSyscall("nanosleep", g.sys.Nanosleep, argReg(req), argImm(0))
+}
+
+// emitGetrandom outputs getrandom(buf, n, 0), filling n bytes at buf and
+// leaving the number filled in RAX.
+func (g *X86_64Generator) emitGetrandom(buf amd64.Reg, n sysArg) {
+	g.emitFeatureSyscall("getrandom", g.sys.Getrandom, argReg(buf), n, argImm(0))
+}
+
+// emitRtSigaction outputs rt_sigaction(sig, act, NULL, 8), installing the
+// kernel sigaction at act for sig. 8 is the size of the kernel's signal
+// mask.
+func (g *X86_64Generator) emitRtSigaction(sig int32, act amd64.Reg) {
+	g.emitFeatureSyscall("rt_sigaction", g.sys.RtSigaction, argImm(sig), argReg(act), argImm(0), argImm(8))
+}
+
+// emitSeccomp outputs seccomp(op, flags, args), eg. installing the filter
+// program at args with SECCOMP_SET_MODE_FILTER.
+func (g *X86_64Generator) emitSeccomp(op, flags int32, args amd64.Reg) {
+	g.emitFeatureSyscall("seccomp", g.sys.Seccomp, argImm(op), argImm(flags), argReg(args))
+}
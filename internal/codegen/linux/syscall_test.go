@@ -0,0 +1,51 @@
+package linux
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/lcox74/bfcc/pkg/amd64"
+)
+
+// TestSyscallHelpers checks that each helper makes its call, and that on
+// an OS lacking it, it outputs nothing and reports the call through Err.
+func TestSyscallHelpers(t *testing.T) {
+	tests := []struct {
+		name string
+		nr   int32
+		emit func(g *X86_64Generator)
+	}{
+		{"mmap", LinuxSyscalls.Mmap, func(g *X86_64Generator) { g.emitMmap(argImm(4096), protRead|protWrite) }},
+		{"mprotect", LinuxSyscalls.Mprotect, func(g *X86_64Generator) { g.emitMprotect(amd64.R13, 4096, protNone) }},
+		{"nanosleep", LinuxSyscalls.Nanosleep, func(g *X86_64Generator) { g.emitNanosleep(amd64.RSP) }},
+		{"getrandom", LinuxSyscalls.Getrandom, func(g *X86_64Generator) { g.emitGetrandom(amd64.RSP, argImm(16)) }},
+		{"rt_sigaction", LinuxSyscalls.RtSigaction, func(g *X86_64Generator) { g.emitRtSigaction(sigSEGV, amd64.RSP) }},
+		{"seccomp", LinuxSyscalls.Seccomp, func(g *X86_64Generator) { g.emitSeccomp(1, 0, amd64.RSP) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewX86_64Generator(nil)
+			tt.emit(g)
+			if err := g.Err(); err != nil {
+				t.Fatal(err)
+			}
+			call := append(amd64.MovqImm32RAX(tt.nr), amd64.Syscall()...)
+			if !bytes.HasSuffix(g.code, call) {
+				t.Errorf("code % x does not end with syscall %d", g.code, tt.nr)
+			}
+
+			if tt.name == "mmap" {
+				return // every OS has it
+			}
+			g = NewX86_64Generator(nil, WithSyscalls(Syscalls{Mmap: LinuxSyscalls.Mmap}))
+			tt.emit(g)
+			if g.Err() == nil {
+				t.Error("no error for a call the OS lacks")
+			}
+			if len(g.code) != 0 {
+				t.Errorf("output % x for a call the OS lacks", g.code)
+			}
+		})
+	}
+}
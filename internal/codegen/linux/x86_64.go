@@ -1,20 +1,43 @@
-// Package linux produces ELF64 x86_64 Linux executables from IR operations.
+// Package linux produces x86_64, riscv64 and i386 Linux executables from IR
+// operations.
 package linux
 
 import (
 	"encoding/binary"
+	"fmt"
+	"slices"
 
 	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/internal/srcmap"
+	"github.com/lcox74/bfcc/internal/trace"
 	"github.com/lcox74/bfcc/pkg/amd64"
 	"github.com/lcox74/bfcc/pkg/elf"
 )
 
-// Linux syscall numbers
-const (
-	// sysRead = 0 // Omitted, it's quicker to use xor to zero out
-	sysWrite = 1
-	sysExit  = 60
-)
+// Syscalls is the system call interface the x86_64 code is written for:
+// the call numbers, the mmap flags for a private anonymous mapping, how a
+// failed call reports its error, and for ELF executables, how the kernel
+// recognises and starts them. The calls only some features make are 0
+// when the OS lacks them.
+type Syscalls struct {
+	Read, Write, Mmap, Exit int32
+	Writev                  int32
+	Open, Mprotect          int32
+	Nanosleep, Getrandom    int32
+	RtSigaction, Seccomp    int32
+	MapAnonPrivate          int32 // MAP_PRIVATE|MAP_ANONYMOUS
+	OpenTrunc               int32 // O_WRONLY|O_CREAT|O_TRUNC
+	CarryError              bool  // errors set CF and return errno, rather than -errno
+	OSABI                   uint8 // the ELF header's OS ABI
+	ArgsInRDI               bool  // argc, argv and envp are at %rdi on entry, and %rsp may be below them
+}
+
+// LinuxSyscalls is the Linux x86_64 syscall interface, the default.
+var LinuxSyscalls = Syscalls{
+	Read: 0, Write: 1, Mmap: 9, Exit: 60, Writev: 20, Open: 2, Mprotect: 10,
+	Nanosleep: 35, Getrandom: 318, RtSigaction: 13, Seccomp: 317,
+	MapAnonPrivate: 0x22, OpenTrunc: 0x241,
+}
 
 // Memory layout constants
 const (
@@ -22,240 +45,2352 @@ const (
 	BSSBase  = 0x600000 // Virtual address for BSS segment (tape)
 )
 
+// Special fixup targets for runtime helpers and data.
+const (
+	fixupRead    = -1  // _bf_read helper
+	fixupWrite   = -2  // _bf_write helper
+	fixupTrap    = -3  // _bf_trap helper
+	fixupTrapMsg = -4  // trap message bytes
+	fixupInfoMsg = -5  // --bfcc-info message bytes
+	fixupTrace   = -6  // _bf_trace helper
+	fixupInit    = -7  // WithTapeInit data
+	fixupCPUMsg  = -8  // WithAVX2 CPU check message bytes
+	fixupSegv    = -9  // _bf_segv handler
+	fixupSegvMsg = -10 // _bf_segv message bytes
+)
+
+// InfoFlag is the argument that makes a WithInfo executable print its info
+// message and exit. The prologue matches it with an 8 and a 4-byte compare,
+// so it must be 11 bytes long.
+const InfoFlag = "--bfcc-info"
+
+// TapeEnvVar names the environment variable read by WithTapeEnv. The
+// prologue matches "BF_TAPE=" with a single 8-byte compare.
+const TapeEnvVar = "BF_TAPE"
+
+// DumpEnvVar names the environment variable holding the file WithDumpTape
+// writes the tape to. Like TapeEnvVar, "BF_DUMP=" is matched with a single
+// 8-byte compare.
+const DumpEnvVar = "BF_DUMP"
+
+// The note WithIdent records the build flags in: the section, the owner
+// name and the note type, as `readelf -n` shows them.
+const (
+	NoteSection = ".note.bfcc"
+	NoteOwner   = "bfcc"
+	NoteFlags   = 1
+)
+
+// trapMsg is written to stderr by _bf_trap before exiting.
+const trapMsg = "bfcc: cell overflow\n"
+
+// segvMsg is written to stderr by _bf_segv, followed by the address of the
+// instruction that faulted, in hex.
+const segvMsg = "bfcc: tape pointer out of bounds at 0x"
+
+// cpuMsg is written to stderr by a WithAVX2 executable before exiting on a
+// CPU without AVX2.
+const cpuMsg = "bfcc: this program needs a CPU with AVX2\n"
+
 // jumpFixup records a location that needs to be patched with a relative offset.
 type jumpFixup struct {
-	offset    int // Offset in code where rel32 starts
-	targetIdx int // IR index of the jump target
+	offset    int  // Offset in code where rel32 starts
+	targetIdx int  // loop label of the jump target, or a special target
+	loopEnd   bool // jump past the loop's JNZ rather than to its JZ
+	short     bool // a rel8 at offset rather than a rel32, see planShortJumps
 }
 
 // X86_64Generator produces x86_64 machine code from IR operations.
 type X86_64Generator struct {
 	ops       []core.Op
 	code      []byte
-	targets   map[int]bool // IR indices that are jump targets
-	labelAddr map[int]int  // IR index -> code offset
-	fixups    []jumpFixup  // Jumps that need patching
-	codeBase  uint64       // Virtual address where code will be loaded
-	bssBase   uint64       // Virtual address for BSS/tape
+	loopStart map[int]int // loop label -> code offset of its JZ
+	loopEnd   map[int]int // loop label -> code offset just past its JNZ
+	fixups    []jumpFixup // Jumps that need patching
+	codeBase  uint64      // Virtual address where code will be loaded
+	bssBase   uint64      // Virtual address for BSS/tape
+	mmapTape  bool        // mmap the tape in the prologue, for GenerateRaw
+	tapeArg   bool        // take the tape in RDI and return, for GenerateRawFunction
+	tapeLen   bool        // with tapeArg, take the tape's size in RSI, held in R15, for GenerateFunctionObject
+	lib       string      // the entry function's prefix, for GenerateLibrary
+	libc      bool        // define main and call the C library for I/O, for GenerateObject
+	libReturn int         // code offset of the GenerateLibrary, GenerateRawFunction or GenerateObject epilogue's register restores
+	relocs    []elf.Reloc // calls into the C library, for GenerateObject
+	sys       Syscalls
+	cells     core.CellModel
+	midTape   bool        // start the data pointer in the middle of the tape
+	argvInput bool        // read input from argv[1] rather than stdin
+	tapeEnv   bool        // size the tape from TapeEnvVar at startup, held in R15
+	tapeInit  []byte      // copied to the tape from the start cell by the prologue
+	tapeGuard bool        // map the tape between guard pages, with a SIGSEGV handler
+	dumpTape  bool        // write the tape to DumpEnvVar's file at exit, the name held in RBP
+	info      string      // printed when run with InfoFlag, empty for no handler
+	ident     string      // .comment text, empty for none
+	flags     string      // NoteFlags note, with ident
+	debug     bool        // trap if control runs past the exit syscall
+	srcmap    *srcmap.Map // filled in by Generate when non-nil
+	symbols   bool        // emit a symbol table
+	trace     bool        // write trace events to trace.FD
+	progress  func(done, total int)
+	symtab    []elf.Symbol
+	err       error            // a system call the OS lacks, see Err
+	batches   map[int]outSlot  // batched OUTs by op index, see planBatches
+	shift     int              // SHIFTs not yet applied to R12, see emitShift
+	multiply  map[int]multiply // multiply loops by the op index of their JZ, see planMultiplies
+	scans     map[int]scan     // scan loops by the op index of their JZ, see planScans
+	adds      map[int]addRun   // runs of ADDs by the op index of their first, see planAdds
+	size      bool             // prefer shorter encodings, see WithSize
+	avx2      bool             // scan and copy 32 cells at a time, see WithAVX2
+	short     map[jumpKey]bool // loop jumps that fit a rel8, see planShortJumps
+	profile   []uint64         // how many times each op ran, see WithProfile
+	aligned   map[int]bool     // hot loops by the op index of their JZ, see planProfile
+	inlined   map[int]bool     // hot OUTs by op index, see planProfile
+}
+
+// Option is a functional option for configuring an X86_64Generator.
+type Option func(*X86_64Generator)
+
+// WithCellOverflow sets the cell overflow policy (default core.OverflowWrap).
+// Saturate and trap are implemented with a flag check after each ADD.
+func WithCellOverflow(overflow core.CellOverflow) Option {
+	return func(g *X86_64Generator) {
+		g.cells.Overflow = overflow
+	}
+}
+
+// WithSignedCells treats cells as signed bytes: overflow checks use the
+// overflow flag rather than carry, and IN stores -1 at end of input.
+func WithSignedCells() Option {
+	return func(g *X86_64Generator) {
+		g.cells.Signed = true
+	}
+}
+
+// WithMidTape starts the data pointer in the middle of the tape rather than
+// at cell 0, for programs written for doubly-infinite tapes.
+func WithMidTape() Option {
+	return func(g *X86_64Generator) {
+		g.midTape = true
+	}
+}
+
+// WithArgvInput makes IN read successive bytes of argv[1] instead of stdin,
+// with end of input at its terminating NUL (or straight away without an
+// argument). R14 holds the read position.
+func WithArgvInput() Option {
+	return func(g *X86_64Generator) {
+		g.argvInput = true
+	}
+}
+
+// WithTapeEnv makes the executable read a decimal tape size in bytes from
+// the TapeEnvVar environment variable at startup and mmap a tape that size.
+// The built-in core.TapeSize tape is used when the variable is unset, not a
+// number, zero, or the mapping fails.
+func WithTapeEnv() Option {
+	return func(g *X86_64Generator) {
+		g.tapeEnv = true
+	}
+}
+
+// WithTapeInit embeds data after the helpers, for the prologue to copy to
+// the tape from the first cell before the program runs. Bytes past the end
+// of the tape are left out, checked at run time with WithTapeEnv.
+func WithTapeInit(data []byte) Option {
+	return func(g *X86_64Generator) {
+		g.tapeInit = data
+	}
+}
+
+// WithTapeGuard maps the tape in the prologue between two pages that
+// cannot be accessed, rather than addressing a BSS segment or mmapping it
+// unguarded, and installs _bf_segv as the SIGSEGV handler. An access to a
+// cell off either end of the tape then faults, and rather than dying with
+// a bare segfault the program writes segvMsg and the address of the
+// instruction, for `bfcc addr2src`, to stderr, and exits with status 1.
+// The tape starts at a page boundary, so a cell before the first is caught
+// at once, but past the last the guard only starts at the next boundary:
+// core.TapeSize cells take up to cell 32767. It applies only to the
+// built-in tape of an executable or GenerateRaw code, not to WithTapeEnv's
+// or a caller's, and needs the rt_sigaction and mprotect system calls.
+func WithTapeGuard() Option {
+	return func(g *X86_64Generator) {
+		g.tapeGuard = true
+	}
+}
+
+// WithDumpTape makes the executable write the tape, from the first cell
+// to the last non-zero one, to the file named by the DumpEnvVar
+// environment variable when the program finishes, as `bfcc run -dump-tape`
+// does, so native and interpreted runs can be compared. Nothing is written
+// when the variable is unset, the file cannot be created, or the program
+// stops early with a trap.
+func WithDumpTape() Option {
+	return func(g *X86_64Generator) {
+		g.dumpTape = true
+	}
+}
+
+// WithInfo embeds an InfoFlag handler that prints info to stdout and exits
+// before the program runs, eg. the compiler version and source hash, so a
+// binary can identify itself when shared on its own.
+func WithInfo(info string) Option {
+	return func(g *X86_64Generator) {
+		g.info = info
+	}
+}
+
+// WithIdent records ident, eg. the compiler name and version, in the
+// .comment section as other compilers do, and flags, the options the
+// executable was built with, in a NoteFlags note in NoteSection. Neither is
+// loaded, and `strip` keeps both. Only ELF executables have them.
+func WithIdent(ident, flags string) Option {
+	return func(g *X86_64Generator) {
+		g.ident, g.flags = ident, flags
+	}
+}
+
+// WithDebug pads the code after the exit syscall with int3, so a corrupted
+// jump that runs off the end of the program traps before reaching the
+// helpers. TRAP ops (see core.InsertTraps) always emit int3.
+func WithDebug() Option {
+	return func(g *X86_64Generator) {
+		g.debug = true
+	}
+}
+
+// WithSourceMap records where the code for each op and runtime routine
+// starts, for SourceMap, and embeds the map in the executable as the
+// srcmap.SectionName section.
+func WithSourceMap() Option {
+	return func(g *X86_64Generator) {
+		g.srcmap = &srcmap.Map{}
+	}
+}
+
+// WithSymbols emits a symbol table naming _start, the runtime helpers and
+// their data, and each loop's .loop_L and .loop_L_end labels as in the
+// assembly from the gas package, for debuggers, profilers and objdump.
+func WithSymbols() Option {
+	return func(g *X86_64Generator) {
+		g.symbols = true
+	}
+}
+
+// WithTrace makes the executable write a trace.Event record to trace.FD
+// for every loop entry, input byte and output byte, through a _bf_trace
+// helper. Loops jump back past their JZ test and trace call, so only the
+// first iteration is recorded. Labels must fit in trace.MaxLabel.
+//
+// The records are for `bfcc verify -trace`, which runs the executable with
+// a pipe on trace.FD. Writes to a closed descriptor fail silently, so the
+// executable also runs without one.
+func WithTrace() Option {
+	return func(g *X86_64Generator) {
+		g.trace = true
+	}
+}
+
+// WithSize optimises the code for size rather than speed: incb and decb
+// for ADDs of ±1 and 8-bit immediates for SHIFTs of -128 to 127. Scan
+// loops are left as loops, rather than the longer SSE2 search, range ops
+// and runs of ADDs keep their scalar code, and the helpers are not aligned.
+func WithSize() Option {
+	return func(g *X86_64Generator) {
+		g.size = true
+	}
+}
+
+// WithAVX2 makes the code for x86-64-v3 CPUs, Haswell and later, rather
+// than for every x86_64 CPU: scan loops search 32 cells at a time, and
+// range ops of 32 cells or more clear or copy 32 at a time, with AVX2
+// rather than SSE2. An executable checks with CPUID at startup that the CPU
+// has AVX2 and the OS saves its registers, and if not writes cpuMsg to
+// stderr and exits with status 1, rather than dying on an illegal
+// instruction later; raw functions, objects and libraries leave that to
+// their caller. WithSize leaves out the code AVX2 would speed up, and so
+// the check.
+func WithAVX2() Option {
+	return func(g *X86_64Generator) {
+		g.avx2 = true
+	}
+}
+
+// WithProfile guides the code by a profile: counts[i] is how many times
+// the i'th op ran, as coverage.Profile.OpCounts gives. Hot loops, those
+// whose JNZ ran at least 1/HotShare as often as the most-run op, start on
+// a 16-byte line, and hot OUTs make the write system call inline rather
+// than calling _bf_write. Loops that are not hot are left unaligned, so
+// the padding only goes where it pays. WithSize ignores the profile, as
+// both make the code bigger.
+func WithProfile(counts []uint64) Option {
+	return func(g *X86_64Generator) {
+		g.profile = counts
+	}
+}
+
+// HotShare is the share of the most-run op's count, as 1/HotShare, that
+// makes an op hot for WithProfile.
+const HotShare = 64
+
+// WithSyscalls emits system calls through sys rather than LinuxSyscalls,
+// for an executable that another package wraps for a different OS.
+func WithSyscalls(sys Syscalls) Option {
+	return func(g *X86_64Generator) {
+		g.sys = sys
+	}
+}
+
+// WithLoadAddress loads the code at codeBase and the tape at bssBase,
+// rather than just past the ELF headers at CodeBase and at BSSBase, for
+// other executable formats. The addresses only reach the code through
+// SourceMap, the symbol table and the tape's movabs.
+func WithLoadAddress(codeBase, bssBase uint64) Option {
+	return func(g *X86_64Generator) {
+		g.codeBase, g.bssBase = codeBase, bssBase
+	}
+}
+
+// WithProgress calls report with the number of ops emitted so far, every
+// ProgressEvery ops and once all of them are done.
+func WithProgress(report func(done, total int)) Option {
+	return func(g *X86_64Generator) {
+		g.progress = report
+	}
+}
+
+// X86_64Costs is the size in bytes of the code for each op, for the
+// optimiser, with the wrapping cell model.
+var X86_64Costs = core.CostModel{Name: "amd64", Shift: 7, Add: 6, Zero: 6, IO: 5, Jump: 12, Range: 18}
+
+// ProgressEvery is how many ops are emitted between progress reports.
+const ProgressEvery = 1 << 14
+
+// Settings are the options every backend supports, for the generators
+// other than the X86_64Generator that take the same Options.
+type Settings struct {
+	Cells    core.CellModel
+	MidTape  bool
+	Debug    bool
+	Progress func(done, total int)
+
+	// WithIdent's, for the ELF backends that record them
+	Ident, Flags string
+}
+
+// ApplyOptions returns the Settings that opts make.
+func ApplyOptions(opts ...Option) Settings {
+	var g X86_64Generator
+	for _, opt := range opts {
+		opt(&g)
+	}
+	return Settings{Cells: g.cells, MidTape: g.midTape, Debug: g.debug, Progress: g.progress, Ident: g.ident, Flags: g.flags}
 }
 
 // NewX86_64Generator creates a new x86_64 machine code generator.
-func NewX86_64Generator(ops []core.Op) *X86_64Generator {
+func NewX86_64Generator(ops []core.Op, opts ...Option) *X86_64Generator {
 	g := &X86_64Generator{
 		ops:       ops,
 		code:      make([]byte, 0, 4096),
-		targets:   make(map[int]bool),
-		labelAddr: make(map[int]int),
+		loopStart: make(map[int]int),
+		loopEnd:   make(map[int]int),
 		codeBase:  CodeBase + elf.PageSize, // Code starts after ELF headers
 		bssBase:   BSSBase,
+		sys:       LinuxSyscalls,
 	}
-	g.collectTargets()
-	return g
-}
 
-// collectTargets finds all jump target indices.
-func (g *X86_64Generator) collectTargets() {
-	for _, op := range g.ops {
-		if op.Kind == core.OpJz || op.Kind == core.OpJnz {
-			g.targets[op.Arg] = true
-		}
+	for _, opt := range opts {
+		opt(g)
 	}
+
+	return g
 }
 
 // Generate produces raw x86_64 machine code.
 func (g *X86_64Generator) Generate() []byte {
+	g.err = nil
+	g.batches = g.planBatches()
+	g.multiply = g.planMultiplies()
+	g.scans = g.planScans()
+	g.adds = g.planAdds()
+	g.aligned, g.inlined = g.planProfile()
+	if g.short == nil {
+		g.short = g.planShortJumps()
+	}
+
+	g.mark("prologue")
+	g.symbol("_start", elf.STT_FUNC)
 	g.emitPrologue()
 
+	skip := -1 // the JNZ of the multiply or scan loop, or the end of the run of ADDs, being passed over
 	for i, op := range g.ops {
-		if g.targets[i] {
-			g.labelAddr[i] = len(g.code)
+		if g.srcmap != nil {
+			g.srcmap.Add(g.codeBase+uint64(len(g.code)), i, op)
+		}
+		if i > skip && !g.addressesCells(i, op) {
+			g.applyShift()
+		}
+		if g.aligned[i] {
+			// Entering the loop runs the padding, so it is NOPs even in
+			// debug builds
+			g.emitBytes(amd64.NopPadding(amd64.PaddingFor(len(g.code), 16)))
+		}
+		if op.Kind == core.OpJz {
+			g.loopStart[op.Arg] = len(g.code)
+		}
+		m, isMultiply := g.multiply[i]
+		s, isScan := g.scans[i]
+		a, isAdds := g.adds[i]
+		slot, isBatched := g.batches[i]
+		switch {
+		case isMultiply:
+			g.emitMultiply(m)
+			skip = m.end
+		case isScan:
+			g.emitScan(s)
+			skip = s.end
+		case i <= skip:
+			// The body of a multiply or scan loop, run by the code at its
+			// JZ, or the rest of a run of ADDs
+		case isAdds:
+			g.emitAdds(a)
+			skip = a.end
+		case isBatched:
+			g.emitBatchedOut(slot)
+		case g.inlined[i]:
+			g.emitWrite()
+		default:
+			g.emitOp(op)
+		}
+		if op.Kind == core.OpJz && g.trace {
+			// Iterations resume in the body, after the entry was traced
+			g.loopStart[op.Arg] = len(g.code)
+		}
+		if op.Kind == core.OpJnz {
+			g.loopEnd[op.Arg] = len(g.code)
+		}
+		if g.progress != nil && (i+1)%ProgressEvery == 0 {
+			g.progress(i+1, len(g.ops))
 		}
-		g.emitOp(op)
 	}
-
-	// Record final label address if it's a target
-	if g.targets[len(g.ops)] {
-		g.labelAddr[len(g.ops)] = len(g.code)
+	if g.progress != nil {
+		g.progress(len(g.ops), len(g.ops))
 	}
 
+	g.mark("epilogue")
 	g.emitEpilogue()
 	g.emitHelpers()
 	g.resolveFixups()
+	if g.srcmap != nil {
+		g.srcmap.End = g.codeBase + uint64(len(g.code))
+	}
 
 	return g.code
 }
 
+// GenerateRaw produces position-independent machine code with no ELF
+// wrapper, for embedding in another binary: the prologue mmaps the tape
+// rather than addressing a BSS segment, exiting with status 1 if that
+// fails, and the code runs from its first byte wherever it is loaded. It
+// ends the process with exit(0) as an executable would, and the argv and
+// environment options still expect the stack as it is at process start.
+func (g *X86_64Generator) GenerateRaw() []byte {
+	g.mmapTape = true
+	return g.Generate()
+}
+
+// GenerateRawFunction produces position-independent machine code like
+// GenerateRaw, but to call as a System V x86_64 function given the tape,
+// core.TapeSize cells of the caller's, in RDI:
+//
+//	int run(unsigned char *tape);
+//
+// It does its I/O with system calls as an executable would, but returns 0
+// when the program finishes, or 1 once it has reported a cell overflow
+// under core.OverflowTrap, rather than exiting. Options that read the
+// process's arguments or environment do not apply.
+func (g *X86_64Generator) GenerateRawFunction() []byte {
+	g.tapeArg = true
+	return g.Generate()
+}
+
+// GenerateFunctionObject produces a relocatable object file defining name
+// as a System V x86_64 function, for C programs, or Go ones through cgo,
+// to link and call given a tape of len cells:
+//
+//	void name(uint8_t *tape, size_t len);
+//
+// The code is GenerateRawFunction's, but sizes the tape from len as
+// WithTapeEnv does from the environment: the middle cell is len/2 and
+// WithTapeInit copies no further than the end. It does its I/O with system
+// calls, so nothing is left buffered when a Go program exits, and returns
+// once the program finishes or, under core.OverflowTrap, has reported a
+// cell overflow, with 0 or 1 in EAX for callers declaring it int.
+func (g *X86_64Generator) GenerateFunctionObject(name string) []byte {
+	g.tapeArg, g.tapeLen = true, true
+	code := g.Generate()
+
+	entry := elf.Symbol{Name: name, Size: uint64(len(code)), Type: elf.STT_FUNC, Global: true}
+	return elf.BuildObject(elf.EM_X86_64, code, []elf.Symbol{entry})
+}
+
 // GenerateELF produces a complete ELF64 executable.
 func (g *X86_64Generator) GenerateELF() []byte {
 	code := g.Generate()
 
 	builder := elf.NewBuilder()
+	builder.SetOSABI(g.sys.OSABI)
 	builder.SetEntry(g.codeBase)
 	builder.AddLoadSegment(code, g.codeBase, elf.PF_R|elf.PF_X)
 	builder.AddBSSSegment(g.bssBase, core.TapeSize, elf.PF_R|elf.PF_W)
+	for _, sym := range g.symbolTable() {
+		builder.AddSymbol(sym)
+	}
+	if g.srcmap != nil {
+		builder.AddSection(srcmap.SectionName, g.srcmap.Encode())
+	}
+	addIdent(builder, g.ident, g.flags)
 
 	return builder.Build()
 }
 
+// addIdent adds the sections WithIdent asks for to builder, if any.
+func addIdent(builder *elf.Builder, ident, flags string) {
+	if ident == "" {
+		return
+	}
+	builder.AddComment(ident)
+	builder.AddNote(NoteSection, NoteOwner, NoteFlags, append([]byte(flags), 0))
+}
+
+// Err returns the error from the last Generate, if it needed a system
+// call the OS's Syscalls lack; the code it produced is then incomplete.
+func (g *X86_64Generator) Err() error {
+	return g.err
+}
+
+// SourceMap returns the map recorded by Generate, or nil without
+// WithSourceMap.
+func (g *X86_64Generator) SourceMap() *srcmap.Map {
+	return g.srcmap
+}
+
+// mark starts a source map entry for runtime code at the current offset.
+func (g *X86_64Generator) mark(name string) {
+	if g.srcmap != nil {
+		g.srcmap.AddRoutine(g.codeBase+uint64(len(g.code)), name)
+	}
+}
+
+// symbol records a function or data symbol at the current offset. Each
+// runs up to the next, or the end of the code.
+func (g *X86_64Generator) symbol(name string, typ uint8) {
+	if g.symbols {
+		g.symtab = append(g.symtab, elf.Symbol{
+			Name:   name,
+			Value:  g.codeBase + uint64(len(g.code)),
+			Type:   typ,
+			Global: name == "_start",
+		})
+	}
+}
+
+// symbolTable returns the symbols recorded by Generate, sized, followed by
+// the loop labels.
+func (g *X86_64Generator) symbolTable() []elf.Symbol {
+	if !g.symbols {
+		return nil
+	}
+
+	syms := slices.Clone(g.symtab)
+	end := g.codeBase + uint64(len(g.code))
+	for i := range syms {
+		next := end
+		if i+1 < len(syms) {
+			next = syms[i+1].Value
+		}
+		syms[i].Size = next - syms[i].Value
+	}
+
+	labels := make([]int, 0, len(g.loopStart))
+	for label := range g.loopStart {
+		labels = append(labels, label)
+	}
+	slices.Sort(labels)
+	for _, label := range labels {
+		syms = append(syms,
+			elf.Symbol{Name: fmt.Sprintf(".loop_%d", label), Value: g.codeBase + uint64(g.loopStart[label])},
+			elf.Symbol{Name: fmt.Sprintf(".loop_%d_end", label), Value: g.codeBase + uint64(g.loopEnd[label])})
+	}
+	return syms
+}
+
 // emitBytes appends a byte slice to the code buffer.
 func (g *X86_64Generator) emitBytes(b []byte) {
 	g.code = append(g.code, b...)
 }
 
+// emitPadding appends n bytes of padding: int3 in debug builds, where
+// padding is never meant to run, otherwise the fewest NOP instructions.
+func (g *X86_64Generator) emitPadding(n int) {
+	if g.debug {
+		g.emitBytes(amd64.TrapPadding(n))
+		return
+	}
+	g.emitBytes(amd64.NopPadding(n))
+}
+
+// alignCode pads the code buffer up to a multiple of align bytes.
+func (g *X86_64Generator) alignCode(align int) {
+	if g.size {
+		return
+	}
+	g.emitPadding(amd64.PaddingFor(len(g.code), align))
+}
+
 // emitPrologue outputs the program start: initialize R13 (tape base) and R12 (data pointer).
 func (g *X86_64Generator) emitPrologue() {
-	// Load tape base address
-	g.emitBytes(amd64.MovabsR13(g.bssBase)) // movabs $tape, %r13
+	if g.lib != "" {
+		g.emitLibraryEntry()
+		g.emitStartPointer()
+		return
+	}
 
-	// Zero data pointer
-	g.emitBytes(amd64.XorR12R12()) // xorq %r12, %r12
-}
+	// Point the stack at argc, where the rest of the prologue expects it
+	if g.sys.ArgsInRDI && !g.tapeArg && !g.libc {
+		g.emitBytes(amd64.MovqRDIRSP()) // movq %rdi, %rsp
+	}
 
-// emitEpilogue outputs the exit(0) syscall.
-func (g *X86_64Generator) emitEpilogue() {
-	// Set Exit syscall
-	g.emitBytes(amd64.MovqImm32RAX(sysExit)) // mov $60, %rax
+	if g.cpuCheck() {
+		g.emitCPUCheck()
+	}
 
-	// Set Exit code 0
-	g.emitBytes(amd64.XorRDIRDI()) // xor %rdi, %rdi
+	// Load tape base address
+	switch {
+	case g.tapeArg:
+		g.emitFunctionEntry()
+	case g.libc:
+		g.emitMainEntry()
+	case g.tapeGuard:
+		g.emitGuardedTape()
+	case g.mmapTape:
+		g.emitTapeMmap()
+	default:
+		g.emitBytes(amd64.MovabsR13(g.bssBase)) // movabs $tape, %r13
+	}
 
-	// Perform Syscall
-	g.emitBytes(amd64.Syscall()) // syscall
-}
+	if g.info != "" {
+		g.emitInfoCheck()
+	}
 
-// helperReadOffset and helperWriteOffset store the code offsets of helper functions.
-var helperReadOffset, helperWriteOffset int
+	if g.argvInput {
+		// R14 = argc >= 2 ? argv[1] : NULL
+		load := amd64.MovqRSPDisp8R14(16)
+		g.emitBytes(amd64.XorR14R14())               // xorq %r14, %r14
+		g.emitBytes(amd64.CmpqImm8RSPMem(2))         // cmpq $2, (%rsp)
+		g.emitBytes(amd64.JcRel32(int32(len(load)))) // jb over the load
+		g.emitBytes(load)                            // movq 16(%rsp), %r14
+	}
 
-// emitHelpers outputs the I/O helper functions.
-func (g *X86_64Generator) emitHelpers() {
-	// _bf_read:
-	helperReadOffset = len(g.code)
-	g.emitBytes(amd64.LeaqR13R12ToRSI()) // leaq (%r13,%r12), %rsi
-	g.emitBytes(amd64.XorRAXRAX())       // xorq %rax, %rax - syscall 0 (read)
-	g.emitBytes(amd64.XorRDIRDI())       // xorq %rdi, %rdi
-	g.emitBytes(amd64.MovqImm32RDX(1))   // movq $1, %rdx
-	g.emitBytes(amd64.Syscall())         // syscall
-	g.emitBytes(amd64.Ret())             // ret
+	if g.tapeEnv {
+		g.emitTapeEnv()
+	}
 
-	// _bf_write:
-	helperWriteOffset = len(g.code)
-	g.emitBytes(amd64.LeaqR13R12ToRSI())      // leaq (%r13,%r12), %rsi
-	g.emitBytes(amd64.MovqImm32RAX(sysWrite)) // movq $1, %rax - syscall 1 (write)
-	g.emitBytes(amd64.MovqImm32RDI(1))        // movq $1, %rdi
-	g.emitBytes(amd64.MovqImm32RDX(1))        // movq $1, %rdx
-	g.emitBytes(amd64.Syscall())              // syscall
-	g.emitBytes(amd64.Ret())                  // ret
-}
+	if g.dumpTape {
+		g.emitDumpEnv()
+	}
 
-// emitOp outputs machine code for a single IR operation.
-func (g *X86_64Generator) emitOp(op core.Op) {
-	switch op.Kind {
-	case core.OpShift:
-		g.emitShift(op.Arg)
-	case core.OpAdd:
-		g.emitAdd(op.Arg)
-	case core.OpZero:
-		g.emitZero()
-	case core.OpIn:
-		g.emitIn()
-	case core.OpOut:
-		g.emitOut()
-	case core.OpJz:
-		g.emitJz(op.Arg)
-	case core.OpJnz:
-		g.emitJnz(op.Arg)
+	// Reserve the output buffer, below everything the prologue reads
+	if len(g.batches) > 0 {
+		g.emitBytes(amd64.SubqImm32RSP(outFrame)) // subq $frame, %rsp
 	}
-}
 
-// emitShift outputs: addq/subq $k, %r12
-// Uses 32-bit immediate since Op.Arg is int.
-func (g *X86_64Generator) emitShift(k int) {
-	if k == 0 {
-		return
+	g.emitStartPointer()
+
+	if len(g.tapeInit) > 0 {
+		g.emitTapeInit()
 	}
-	if k > 0 {
-		g.emitBytes(amd64.AddqImm32R12(int32(k))) // addq $k, %r12
-	} else {
-		g.emitBytes(amd64.SubqImm32R12(int32(-k))) // subq $k, %r12
+}
+
+// emitFunctionEntry outputs the GenerateRawFunction prologue: save the
+// callee-saved registers the code uses and take the tape in R13, and for
+// GenerateFunctionObject its size in R15.
+func (g *X86_64Generator) emitFunctionEntry() {
+	g.emitBytes(amd64.PushReg(amd64.R12))               // pushq %r12
+	g.emitBytes(amd64.PushReg(amd64.R13))               // pushq %r13
+	g.emitBytes(amd64.MovqRegReg(amd64.R13, amd64.RDI)) // movq %rdi, %r13 - tape
+	if g.tapeLen {
+		g.emitBytes(amd64.PushReg(amd64.R15))               // pushq %r15
+		g.emitBytes(amd64.MovqRegReg(amd64.R15, amd64.RSI)) // movq %rsi, %r15 - len
 	}
 }
 
-// emitAdd outputs: addb/subb $k, (%r13,%r12)
-// Tape cells are unsigned bytes [0, 255], so we use separate add/sub with uint8 immediates.
-func (g *X86_64Generator) emitAdd(k int) {
-	if k == 0 {
-		return
+// emitFunctionReturn outputs the GenerateRawFunction epilogue, returning
+// 0. The trap helper returns 1 by jumping to its second instruction, at
+// g.libReturn, which releases the output buffer first.
+func (g *X86_64Generator) emitFunctionReturn() {
+	g.emitBytes(amd64.XorRAXRAX()) // xorq %rax, %rax
+	g.libReturn = len(g.code)
+	if len(g.batches) > 0 {
+		g.emitBytes(amd64.AddqImm32RSP(outFrame)) // addq $frame, %rsp
 	}
-	if k > 0 {
-		g.emitBytes(amd64.AddbImm8Mem(uint8(k))) // addb $k, (%r13,%r12)
-	} else {
-		g.emitBytes(amd64.SubbImm8Mem(uint8(-k))) // subb $k, (%r13,%r12)
+	if g.tapeLen {
+		g.emitBytes(amd64.PopReg(amd64.R15)) // popq %r15
 	}
+	g.emitBytes(amd64.PopReg(amd64.R13)) // popq %r13
+	g.emitBytes(amd64.PopReg(amd64.R12)) // popq %r12
+	g.emitBytes(amd64.Ret())             // ret
 }
 
-// emitZero outputs: movb $0, (%r13,%r12)
-func (g *X86_64Generator) emitZero() {
-	g.emitBytes(amd64.MovbZeroMem()) // movb $0, (%r13,%r12)
+// emitTapeMmap outputs the GenerateRaw prologue, mmapping a core.TapeSize
+// tape into R13 or exiting with status 1.
+func (g *X86_64Generator) emitTapeMmap() {
+	g.emitMmap(argImm(core.TapeSize), protRead|protWrite)
+	failed := g.emitSyscallFailed() // jc/ja failed
+	g.emitBytes(amd64.MovqRAXR13()) // movq %rax, %r13
+	mapped := g.emitJump(amd64.JmpRel32(0))
+
+	// failed:
+	g.patchJump(failed)
+	g.emitSyscall(g.sys.Exit, argImm(1))
+
+	// mapped:
+	g.patchJump(mapped)
 }
 
-// emitIn outputs a call to _bf_read helper.
-func (g *X86_64Generator) emitIn() {
-	// Placeholder call - will be fixed up after helpers are emitted
+// guardSize is the size of a WithTapeGuard guard page, and the tape's
+// mapping is a whole number of them.
+const guardSize = 4096
+
+// The kernel sigaction flags and signal WithTapeGuard installs _bf_segv
+// with: given the ucontext, and a restorer, which x86_64 Linux requires
+// even of a handler that never returns.
+const (
+	saSiginfo  = 0x4
+	saRestorer = 0x4000000
+	sigSEGV    = 11
+)
+
+// emitGuardedTape outputs the WithTapeGuard prologue: mmap the tape, with
+// a guard page either side, as PROT_NONE, make the tape itself readable
+// and writable, point R13 at it, and install _bf_segv for SIGSEGV, exiting
+// with status 1 if the tape cannot be mapped. Should rt_sigaction fail,
+// the guards still stop the program, with a plain segfault.
+func (g *X86_64Generator) emitGuardedTape() {
+	tape := (core.TapeSize + guardSize - 1) / guardSize * guardSize
+	g.emitMmap(argImm(int32(tape+2*guardSize)), protNone)
+	mapFailed := g.emitSyscallFailed()                    // jc/ja failed
+	g.emitBytes(amd64.MovqRAXR13())                       // movq %rax, %r13
+	g.emitBytes(amd64.AddqImm32Reg(amd64.R13, guardSize)) // addq $4096, %r13 - past the low guard
+	g.emitMprotect(amd64.R13, int32(tape), protRead|protWrite)
+	protectFailed := g.emitSyscallFailed() // jc/ja failed
+
+	// The kernel sigaction: handler, flags, restorer and mask
 	g.fixups = append(g.fixups, jumpFixup{
-		offset:    len(g.code) + 1, // rel32 starts at offset 1 in call instruction
-		targetIdx: -1,              // Special marker for read helper
+		offset:    len(g.code) + 3, // rel32 starts at offset 3 in lea instruction
+		targetIdx: fixupSegv,
 	})
-	g.emitBytes(amd64.CallRel32(0)) // Placeholder
+	g.emitBytes(amd64.LeaqRIPRelRSI(0))                     // leaq _bf_segv(%rip), %rsi
+	g.emitBytes(amd64.XorRAXRAX())                          // xorq %rax, %rax
+	g.emitBytes(amd64.PushReg(amd64.RAX))                   // pushq %rax - sa_mask
+	g.emitBytes(amd64.PushReg(amd64.RSI))                   // pushq %rsi - sa_restorer
+	g.emitBytes(amd64.MovqImm32RAX(saSiginfo | saRestorer)) // movq $flags, %rax
+	g.emitBytes(amd64.PushReg(amd64.RAX))                   // pushq %rax - sa_flags
+	g.emitBytes(amd64.PushReg(amd64.RSI))                   // pushq %rsi - sa_handler
+	g.emitBytes(amd64.MovqRSPRSI())                         // movq %rsp, %rsi
+	g.emitRtSigaction(sigSEGV, amd64.RSI)
+	g.emitBytes(amd64.AddqImm32RSP(32)) // addq $32, %rsp
+	mapped := g.emitJump(amd64.JmpRel32(0))
+
+	// failed:
+	g.patchJump(mapFailed)
+	g.patchJump(protectFailed)
+	g.emitSyscall(g.sys.Exit, argImm(1))
+
+	// mapped:
+	g.patchJump(mapped)
 }
 
-// emitOut outputs a call to _bf_write helper.
-func (g *X86_64Generator) emitOut() {
-	// Placeholder call - will be fixed up after helpers are emitted
+// emitTapeInit outputs the WithTapeInit prologue, copying the data to the
+// tape from the first cell with rep movsb.
+func (g *X86_64Generator) emitTapeInit() {
+	n := len(g.tapeInit)
+	if room := core.TapeSize - g.startCell(); !g.sizedTape() && n > room {
+		n = room
+	}
+
 	g.fixups = append(g.fixups, jumpFixup{
-		offset:    len(g.code) + 1, // rel32 starts at offset 1 in call instruction
-		targetIdx: -2,              // Special marker for write helper
+		offset:    len(g.code) + 3, // rel32 starts at offset 3 in lea instruction
+		targetIdx: fixupInit,
 	})
-	g.emitBytes(amd64.CallRel32(0)) // Placeholder
+	g.emitBytes(amd64.LeaqRIPRelRSI(0))            // leaq tape_init(%rip), %rsi
+	g.emitBytes(amd64.LeaqCellToReg(amd64.RDI, 0)) // leaq 0(%r13,%r12), %rdi
+	g.emitBytes(amd64.MovqImm32RCX(int32(n)))      // movq $len, %rcx
+	if g.sizedTape() {
+		// Copy no further than the end of the tape, R15 - R12 cells on
+		g.emitBytes(amd64.MovqRegReg(amd64.RAX, amd64.R15))   // movq %r15, %rax
+		g.emitBytes(amd64.SubqRegReg(amd64.RAX, amd64.R12))   // subq %r12, %rax
+		g.emitBytes(amd64.CmpqRegReg(amd64.RCX, amd64.RAX))   // cmpq %rax, %rcx
+		g.emitBytes(amd64.CmovaqRegReg(amd64.RCX, amd64.RAX)) // cmova %rax, %rcx
+	}
+	g.emitBytes(amd64.RepMovsb()) // rep movsb
 }
 
-// emitJz outputs: testb $0xff, (%r13,%r12); jz target
-func (g *X86_64Generator) emitJz(target int) {
-	g.emitBytes(amd64.TestbMem())
-	// Record fixup for the jz rel32
-	g.fixups = append(g.fixups, jumpFixup{
-		offset:    len(g.code) + 2, // rel32 starts at offset 2 in jz instruction
-		targetIdx: target,
-	})
-	g.emitBytes(amd64.JzRel32(0)) // Placeholder
+// sizedTape reports whether the tape's size is in R15, from TapeEnvVar or
+// the caller, rather than core.TapeSize.
+func (g *X86_64Generator) sizedTape() bool {
+	return g.tapeEnv || g.tapeLen
 }
 
-// emitJnz outputs: testb $0xff, (%r13,%r12); jnz target
-func (g *X86_64Generator) emitJnz(target int) {
-	g.emitBytes(amd64.TestbMem())
-	// Record fixup for the jnz rel32
-	g.fixups = append(g.fixups, jumpFixup{
-		offset:    len(g.code) + 2, // rel32 starts at offset 2 in jnz instruction
-		targetIdx: target,
-	})
-	g.emitBytes(amd64.JnzRel32(0)) // Placeholder
+// startCell returns the cell the data pointer starts at on the built-in
+// tape.
+func (g *X86_64Generator) startCell() int {
+	if g.midTape {
+		return core.TapeSize / 2
+	}
+	return 0
 }
 
-// resolveFixups patches all jump and call targets.
-func (g *X86_64Generator) resolveFixups() {
-	for _, fixup := range g.fixups {
-		var targetAddr int
-		switch fixup.targetIdx {
-		case -1: // read helper
-			targetAddr = helperReadOffset
-		case -2: // write helper
-			targetAddr = helperWriteOffset
-		default:
-			targetAddr = g.labelAddr[fixup.targetIdx]
+// emitTapeEnv outputs the WithTapeEnv prologue: find BF_TAPE= in envp,
+// parse the digits after it into RCX and mmap that many bytes, leaving the
+// tape base in R13 and its size in R15.
+func (g *X86_64Generator) emitTapeEnv() {
+	g.emitBytes(amd64.MovqImm32R15(core.TapeSize)) // movq $30000, %r15
+	noEnv := g.emitFindEnv(tapeEnvKey)
+
+	// Parse decimal digits into RCX
+	g.emitBytes(amd64.AddqImm8RSI(8)) // addq $8, %rsi
+	g.emitBytes(amd64.XorRCXRCX())    // xorq %rcx, %rcx
+
+	// next_digit:
+	nextDigit := len(g.code)
+	g.emitBytes(amd64.MovzbqRSIMemRAX())   // movzbq (%rsi), %rax
+	g.emitBytes(amd64.SubqImm8RAX('0'))    // subq $'0', %rax
+	g.emitBytes(amd64.CmpqImm8RAX(9))      // cmpq $9, %rax
+	parsed := g.emitJump(amd64.JaRel32(0)) // ja parsed - not a digit
+	g.emitBytes(amd64.ImulqImm8RCX(10))    // imulq $10, %rcx, %rcx
+	g.emitBytes(amd64.AddqRAXRCX())        // addq %rax, %rcx
+	g.emitBytes(amd64.IncqRSI())           // incq %rsi
+	// jmp next_digit
+	g.emitBytes(amd64.JmpRel32(int32(nextDigit - (len(g.code) + 5))))
+
+	// parsed:
+	g.patchJump(parsed)
+	g.emitBytes(amd64.TestqRCXRCX())     // testq %rcx, %rcx
+	zero := g.emitJump(amd64.JzRel32(0)) // jz done
+
+	// mmap(NULL, size, PROT_READ|PROT_WRITE, ...), the size staying in RSI
+	g.emitMmap(argReg(amd64.RCX), protRead|protWrite)
+	failed := g.emitSyscallFailed() // jc/ja done
+	g.emitBytes(amd64.MovqRAXR13()) // movq %rax, %r13
+	g.emitBytes(amd64.MovqRSIR15()) // movq %rsi, %r15
+
+	// done:
+	g.patchJump(noEnv)
+	g.patchJump(zero)
+	g.patchJump(failed)
+}
+
+// emitFindEnv outputs a scan of envp for the variable starting with key, a
+// name and its =, leaving a pointer to it in RSI. It returns the rel32 of
+// a jump, for patchJump, taken when there is no such variable. RAX and RBX
+// are clobbered.
+func (g *X86_64Generator) emitFindEnv(key uint64) int {
+	g.emitBytes(amd64.MovqRSPMemRAX()) // movq (%rsp), %rax - argc
+	g.emitBytes(amd64.LeaqEnvpRBX())   // leaq 16(%rsp,%rax,8), %rbx - envp
+
+	// next_env:
+	nextEnv := len(g.code)
+	g.emitBytes(amd64.MovqRBXMemRSI())    // movq (%rbx), %rsi
+	g.emitBytes(amd64.TestqRSIRSI())      // testq %rsi, %rsi - end of envp
+	noEnv := g.emitJump(amd64.JzRel32(0)) // jz missing
+	g.emitBytes(amd64.AddqImm8RBX(8))     // addq $8, %rbx
+	g.emitBytes(amd64.MovabsRAX(key))     // movabs $"NAME=", %rax
+	g.emitBytes(amd64.CmpqRAXRSIMem())    // cmpq %rax, (%rsi)
+	// jne next_env
+	g.emitBytes(amd64.JnzRel32(int32(nextEnv - (len(g.code) + 6))))
+	return noEnv
+}
+
+// emitDumpEnv outputs the WithDumpTape prologue, pointing RBP at the file
+// name after BF_DUMP=, or zeroing it when the variable is unset.
+func (g *X86_64Generator) emitDumpEnv() {
+	g.emitBytes(amd64.XorqRegReg(amd64.RBP)) // xorq %rbp, %rbp
+	noEnv := g.emitFindEnv(dumpEnvKey)
+	g.emitBytes(amd64.AddqImm8RSI(8))                   // addq $8, %rsi
+	g.emitBytes(amd64.MovqRegReg(amd64.RBP, amd64.RSI)) // movq %rsi, %rbp
+
+	// missing:
+	g.patchJump(noEnv)
+}
+
+// emitDumpTape outputs the WithDumpTape epilogue: open the file RBP names,
+// find the last non-zero cell scanning back from the end of the tape with
+// std; repe scasb, and write the tape up to it. The program is over, so
+// R12 holds the write position, RBP the bytes left, and RBX the file.
+func (g *X86_64Generator) emitDumpTape() {
+	g.emitBytes(amd64.TestqRegReg(amd64.RBP)) // testq %rbp, %rbp
+	unset := g.emitJump(amd64.JzRel32(0))     // jz done
+
+	// open(name, O_WRONLY|O_CREAT|O_TRUNC, 0644)
+	g.emitFeatureSyscall("open", g.sys.Open, argReg(amd64.RBP), argImm(g.sys.OpenTrunc), argImm(0o644))
+	failed := g.emitSyscallFailed()                     // jc/ja done
+	g.emitBytes(amd64.MovqRegReg(amd64.RBX, amd64.RAX)) // movq %rax, %rbx
+
+	// RCX = cells up to and including the last non-zero one
+	if g.sizedTape() {
+		g.emitBytes(amd64.MovqR15RCX()) // movq %r15, %rcx
+	} else {
+		g.emitBytes(amd64.MovqImm32RCX(core.TapeSize)) // movq $30000, %rcx
+	}
+	g.emitBytes(amd64.MovqRegReg(amd64.RDI, amd64.R13)) // movq %r13, %rdi
+	g.emitBytes(amd64.AddqRegReg(amd64.RDI, amd64.RCX)) // addq %rcx, %rdi
+	g.emitBytes(amd64.DecqReg(amd64.RDI))               // decq %rdi - last cell
+	g.emitBytes(amd64.XorRAXRAX())                      // xorq %rax, %rax
+	g.emitBytes(amd64.Std())                            // std
+	g.emitBytes(amd64.RepeScasb())                      // repe scasb
+	g.emitBytes(amd64.Cld())                            // cld
+	allZero := g.emitJump(amd64.JzRel32(0))             // jz counted
+	g.emitBytes(amd64.IncqReg(amd64.RCX))               // incq %rcx
+	// counted:
+	g.patchJump(allZero)
+	g.emitBytes(amd64.MovqRegReg(amd64.RBP, amd64.RCX)) // movq %rcx, %rbp
+	g.emitBytes(amd64.MovqRegReg(amd64.R12, amd64.R13)) // movq %r13, %r12
+
+	// next_write:
+	nextWrite := len(g.code)
+	g.emitBytes(amd64.TestqRegReg(amd64.RBP)) // testq %rbp, %rbp
+	written := g.emitJump(amd64.JzRel32(0))   // jz done
+	g.emitSyscall(g.sys.Write, argReg(amd64.RBX), argReg(amd64.R12), argReg(amd64.RBP))
+	writeFailed := g.emitSyscallFailed()                // jc/ja done
+	g.emitBytes(amd64.TestqRAXRAX())                    // testq %rax, %rax
+	stuck := g.emitJump(amd64.JzRel32(0))               // jz done
+	g.emitBytes(amd64.AddqRegReg(amd64.R12, amd64.RAX)) // addq %rax, %r12
+	g.emitBytes(amd64.SubqRegReg(amd64.RBP, amd64.RAX)) // subq %rax, %rbp
+	// jmp next_write
+	g.emitBytes(amd64.JmpRel32(int32(nextWrite - (len(g.code) + 5))))
+
+	// done:
+	for _, at := range []int{unset, failed, written, writeFailed, stuck} {
+		g.patchJump(at)
+	}
+}
+
+// emitInfoCheck outputs the WithInfo prologue: if argv[1] is InfoFlag,
+// write the info message to stdout and exit 0.
+func (g *X86_64Generator) emitInfoCheck() {
+	flag := []byte(InfoFlag + "\x00")
+	head := binary.LittleEndian.Uint64(flag[:8])
+	tail := binary.LittleEndian.Uint32(flag[8:])
+
+	g.emitBytes(amd64.CmpqImm8RSPMem(2))          // cmpq $2, (%rsp) - argc
+	noArg := g.emitJump(amd64.JcRel32(0))         // jb skip
+	g.emitBytes(amd64.MovqRSPDisp8RSI(16))        // movq 16(%rsp), %rsi - argv[1]
+	g.emitBytes(amd64.MovabsRAX(head))            // movabs $"--bfcc-i", %rax
+	g.emitBytes(amd64.CmpqRAXRSIMem())            // cmpq %rax, (%rsi)
+	headDiffers := g.emitJump(amd64.JnzRel32(0))  // jne skip
+	g.emitBytes(amd64.CmplImm32RSIDisp8(8, tail)) // cmpl $"nfo\0", 8(%rsi)
+	tailDiffers := g.emitJump(amd64.JnzRel32(0))  // jne skip
+
+	g.fixups = append(g.fixups, jumpFixup{
+		offset:    len(g.code) + 3, // rel32 starts at offset 3 in lea instruction
+		targetIdx: fixupInfoMsg,
+	})
+	g.emitBytes(amd64.LeaqRIPRelRSI(0))                 // leaq info_msg(%rip), %rsi
+	g.emitBytes(amd64.MovqImm32RAX(g.sys.Write))        // movq $1, %rax
+	g.emitBytes(amd64.MovqImm32RDI(1))                  // movq $1, %rdi - stdout
+	g.emitBytes(amd64.MovqImm32RDX(int32(len(g.info)))) // movq $len, %rdx
+	g.emitBytes(amd64.Syscall())                        // syscall
+	g.emitBytes(amd64.MovqImm32RAX(g.sys.Exit))         // movq $60, %rax
+	g.emitBytes(amd64.XorRDIRDI())                      // xorq %rdi, %rdi
+	g.emitBytes(amd64.Syscall())                        // syscall
+
+	// skip:
+	g.patchJump(noArg)
+	g.patchJump(headDiffers)
+	g.patchJump(tailDiffers)
+}
+
+// usesAVX2 reports whether the code uses AVX2: with WithAVX2, unless
+// WithSize leaves out the scans and range ops it would be used for.
+func (g *X86_64Generator) usesAVX2() bool {
+	return g.avx2 && !g.size
+}
+
+// cpuCheck reports whether the prologue checks for AVX2: in executables
+// using it, not in the code a caller runs.
+func (g *X86_64Generator) cpuCheck() bool {
+	return g.usesAVX2() && g.lib == "" && !g.tapeArg && !g.libc
+}
+
+// emitCPUCheck outputs the WithAVX2 prologue: unless CPUID reports AVX2,
+// and XGETBV that the OS saves the xmm and ymm registers, write cpuMsg to
+// stderr and exit 1. Clobbers RAX, RBX, RCX and RDX.
+func (g *X86_64Generator) emitCPUCheck() {
+	var fails []int
+	need := func(r amd64.Reg, bit uint8) {
+		g.emitBytes(amd64.BtlImm8Reg(r, bit))                // btl $bit, %r
+		fails = append(fails, g.emitJump(amd64.JncRel32(0))) // jnc fail
+	}
+
+	g.emitBytes(amd64.MovlImm32Reg(amd64.RAX, 1)) // movl $1, %eax
+	g.emitBytes(amd64.Cpuid())                    // cpuid
+	need(amd64.RCX, 27)                           // OSXSAVE
+	need(amd64.RCX, 28)                           // AVX
+	g.emitBytes(amd64.MovlImm32Reg(amd64.RCX, 0)) // movl $0, %ecx - XCR0
+	g.emitBytes(amd64.Xgetbv())                   // xgetbv
+	need(amd64.RAX, 1)                            // xmm state
+	need(amd64.RAX, 2)                            // ymm state
+
+	// A CPU with XSAVE has leaf 0xD, so leaf 7 is there to ask
+	g.emitBytes(amd64.MovlImm32Reg(amd64.RAX, 7)) // movl $7, %eax
+	g.emitBytes(amd64.MovlImm32Reg(amd64.RCX, 0)) // movl $0, %ecx
+	g.emitBytes(amd64.Cpuid())                    // cpuid
+	need(amd64.RBX, 5)                            // AVX2
+	ok := g.emitJump(amd64.JmpRel32(0))           // jmp ok
+
+	// fail:
+	for _, at := range fails {
+		g.patchJump(at)
+	}
+	g.fixups = append(g.fixups, jumpFixup{
+		offset:    len(g.code) + 3, // rel32 starts at offset 3 in lea instruction
+		targetIdx: fixupCPUMsg,
+	})
+	g.emitBytes(amd64.LeaqRIPRelRSI(0)) // leaq cpu_msg(%rip), %rsi
+	g.emitSyscall(g.sys.Write, argImm(2), argReg(amd64.RSI), argImm(int32(len(cpuMsg))))
+	g.emitSyscall(g.sys.Exit, argImm(1))
+
+	// ok:
+	g.patchJump(ok)
+}
+
+// tapeEnvKey is "BF_TAPE=" as a little-endian quadword.
+var tapeEnvKey = binary.LittleEndian.Uint64([]byte(TapeEnvVar + "="))
+
+// dumpEnvKey is "BF_DUMP=" as a little-endian quadword.
+var dumpEnvKey = binary.LittleEndian.Uint64([]byte(DumpEnvVar + "="))
+
+// emitJump emits a forward jump whose rel32 is patched later by patchJump,
+// returning the offset of the rel32.
+func (g *X86_64Generator) emitJump(b []byte) int {
+	g.emitBytes(b)
+	return len(g.code) - 4
+}
+
+// patchJump points the jump emitted at rel32 offset at to the current end
+// of the code.
+func (g *X86_64Generator) patchJump(at int) {
+	binary.LittleEndian.PutUint32(g.code[at:], uint32(int32(len(g.code)-(at+4))))
+}
+
+// emitStartPointer points R12 at the first cell: 0, or the middle of the
+// tape with WithMidTape.
+func (g *X86_64Generator) emitStartPointer() {
+	if g.midTape && g.sizedTape() {
+		g.emitBytes(amd64.MovqR15R12()) // movq %r15, %r12
+		g.emitBytes(amd64.ShrqR12())    // shrq $1, %r12
+		return
+	}
+	if g.midTape {
+		g.emitBytes(amd64.MovqImm32R12(core.TapeSize / 2)) // movq $15000, %r12
+		return
+	}
+
+	// Zero data pointer
+	g.emitBytes(amd64.XorR12R12()) // xorq %r12, %r12
+}
+
+// emitEpilogue outputs the exit(0) syscall, or the return of a library or
+// raw function, after the WithDumpTape dump.
+func (g *X86_64Generator) emitEpilogue() {
+	if g.dumpTape {
+		g.emitDumpTape()
+	}
+
+	switch {
+	case g.lib != "":
+		g.emitLibraryReturn()
+	case g.tapeArg:
+		g.emitFunctionReturn()
+	case g.libc:
+		g.emitMainReturn()
+	default:
+		// Set Exit syscall
+		g.emitBytes(amd64.MovqImm32RAX(g.sys.Exit)) // mov $60, %rax
+
+		// Set Exit code 0
+		g.emitBytes(amd64.XorRDIRDI()) // xor %rdi, %rdi
+
+		// Perform Syscall
+		g.emitBytes(amd64.Syscall()) // syscall
+	}
+
+	if g.debug {
+		g.emitBytes(amd64.Int3()) // int3
+	}
+}
+
+// helperReadOffset, helperWriteOffset, helperTrapOffset and
+// helperTraceOffset store the code offsets of helper functions,
+// trapMsgOffset and infoMsgOffset the offsets of the trap and --bfcc-info
+// messages, initOffset the offset of the WithTapeInit data, cpuMsgOffset
+// the offset of the WithAVX2 CPU check message, and segvOffset and
+// segvMsgOffset those of the WithTapeGuard handler and its message.
+var helperReadOffset, helperWriteOffset, helperTrapOffset, helperTraceOffset, trapMsgOffset, infoMsgOffset, initOffset, cpuMsgOffset, segvOffset, segvMsgOffset int
+
+// emitHelpers outputs the I/O helper functions.
+func (g *X86_64Generator) emitHelpers() {
+	// Start the helpers on a fresh 16-byte line
+	g.alignCode(16)
+
+	// _bf_read:
+	g.mark("_bf_read")
+	g.symbol("_bf_read", elf.STT_FUNC)
+	helperReadOffset = len(g.code)
+	switch {
+	case g.lib != "":
+		g.emitHookRead()
+	case g.libc:
+		g.emitLibcRead()
+	case g.argvInput:
+		g.emitArgvRead()
+	default:
+		g.emitStdinRead()
+	}
+
+	// _bf_write:
+	g.mark("_bf_write")
+	g.symbol("_bf_write", elf.STT_FUNC)
+	helperWriteOffset = len(g.code)
+	switch {
+	case g.lib != "":
+		g.emitHookWrite()
+	case g.libc:
+		g.emitLibcWrite()
+	default:
+		g.emitWrite()
+		g.emitBytes(amd64.Ret()) // ret
+	}
+
+	if g.cells.Overflow == core.OverflowTrap {
+		g.emitTrapHelper()
+	}
+
+	if g.trace {
+		g.emitTraceHelper()
+	}
+
+	if g.guardsTape() {
+		g.emitSegvHandler()
+	}
+
+	if g.info != "" {
+		g.mark("info message")
+		g.symbol("_bf_info_msg", elf.STT_OBJECT)
+		infoMsgOffset = len(g.code)
+		g.emitBytes([]byte(g.info))
+	}
+
+	if len(g.tapeInit) > 0 {
+		g.mark("tape init")
+		g.symbol("_bf_tape_init", elf.STT_OBJECT)
+		initOffset = len(g.code)
+		g.emitBytes(g.tapeInit)
+	}
+
+	if g.cpuCheck() {
+		g.mark("cpu message")
+		g.symbol("_bf_cpu_msg", elf.STT_OBJECT)
+		cpuMsgOffset = len(g.code)
+		g.emitBytes([]byte(cpuMsg))
+	}
+}
+
+// emitStdinRead outputs the body of _bf_read that reads one byte from
+// stdin. At end of input the cell is set to 0, or -1 for signed cells, as
+// in the VM.
+func (g *X86_64Generator) emitStdinRead() {
+	g.emitBytes(amd64.LeaqR13R12ToRSI()) // leaq (%r13,%r12), %rsi
+	if g.sys.Read == 0 {
+		g.emitBytes(amd64.XorRAXRAX()) // xorq %rax, %rax - syscall 0 (read)
+	} else {
+		g.emitBytes(amd64.MovqImm32RAX(g.sys.Read)) // movq $read, %rax
+	}
+	g.emitBytes(amd64.XorRDIRDI())     // xorq %rdi, %rdi
+	g.emitBytes(amd64.MovqImm32RDX(1)) // movq $1, %rdx
+	g.emitBytes(amd64.Syscall())       // syscall
+
+	// Store EOF when read returns 0 (end of input)
+	eof := amd64.MovbImm8Mem(g.cells.EOF())
+	g.emitBytes(amd64.TestqRAXRAX())             // testq %rax, %rax
+	g.emitBytes(amd64.JnzRel32(int32(len(eof)))) // jnz over the store
+	g.emitBytes(eof)                             // movb $0 (or $0xff), (%r13,%r12)
+	g.emitBytes(amd64.Ret())                     // ret
+}
+
+// emitArgvRead outputs the body of _bf_read that takes the next byte of
+// argv[1] from R14. At end of input the cell is set to 0, or -1 for
+// signed cells, as in the VM.
+func (g *X86_64Generator) emitArgvRead() {
+	// Store the byte and advance, reached when it is not the NUL
+	store := slices.Concat(
+		amd64.MovbALMem(), // movb %al, (%r13,%r12)
+		amd64.IncqR14(),   // incq %r14
+		amd64.Ret(),       // ret
+	)
+	next := slices.Concat(
+		amd64.MovbR14MemAL(),             // movb (%r14), %al
+		amd64.TestbALAL(),                // testb %al, %al - end of argument
+		amd64.JzRel32(int32(len(store))), // jz eof
+		store,
+	)
+
+	g.emitBytes(amd64.TestqR14R14())             // testq %r14, %r14 - no argument
+	g.emitBytes(amd64.JzRel32(int32(len(next)))) // jz eof
+	g.emitBytes(next)
+
+	// eof:
+	g.emitBytes(amd64.MovbImm8Mem(g.cells.EOF())) // movb $0 (or $0xff), (%r13,%r12)
+	g.emitBytes(amd64.Ret())                      // ret
+}
+
+// emitTrapHelper outputs _bf_trap, which reports a cell overflow on stderr
+// and exits with status 1, or returns 1 from a raw function or main,
+// followed by the message it prints.
+func (g *X86_64Generator) emitTrapHelper() {
+	// _bf_trap:
+	g.mark("_bf_trap")
+	g.symbol("_bf_trap", elf.STT_FUNC)
+	helperTrapOffset = len(g.code)
+	if g.lib != "" {
+		g.emitHookTrap()
+		return
+	}
+	if g.libc {
+		g.emitLibcTrap()
+	} else {
+		g.emitSyscallTrap()
+	}
+
+	g.mark("trap message")
+	g.symbol("_bf_trap_msg", elf.STT_OBJECT)
+	trapMsgOffset = len(g.code)
+	g.emitBytes([]byte(trapMsg))
+}
+
+// emitSyscallTrap outputs the body of _bf_trap that writes the trap
+// message with a system call, then exits, or returns from a raw function.
+func (g *X86_64Generator) emitSyscallTrap() {
+	g.fixups = append(g.fixups, jumpFixup{
+		offset:    len(g.code) + 3, // rel32 starts at offset 3 in lea instruction
+		targetIdx: fixupTrapMsg,
+	})
+	g.emitBytes(amd64.LeaqRIPRelRSI(0))                  // leaq trap_msg(%rip), %rsi
+	g.emitBytes(amd64.MovqImm32RAX(g.sys.Write))         // movq $1, %rax
+	g.emitBytes(amd64.MovqImm32RDI(2))                   // movq $2, %rdi - stderr
+	g.emitBytes(amd64.MovqImm32RDX(int32(len(trapMsg)))) // movq $len, %rdx
+	g.emitBytes(amd64.Syscall())                         // syscall
+	if g.tapeArg {
+		g.emitBytes(amd64.MovqImm32RAX(1))                                  // movq $1, %rax
+		g.emitBytes(amd64.JmpRel32(int32(g.libReturn - (len(g.code) + 5)))) // jmp to the restores
+	} else {
+		g.emitBytes(amd64.MovqImm32RAX(g.sys.Exit)) // movq $60, %rax
+		g.emitBytes(amd64.MovqImm32RDI(1))          // movq $1, %rdi
+		g.emitBytes(amd64.Syscall())                // syscall
+	}
+}
+
+// guardsTape reports whether the prologue maps the tape for WithTapeGuard:
+// unless it is the caller's.
+func (g *X86_64Generator) guardsTape() bool {
+	return g.tapeGuard && g.lib == "" && !g.tapeArg && !g.libc
+}
+
+// emitSegvHandler outputs _bf_segv, the WithTapeGuard SIGSEGV handler,
+// followed by the message it prints. It writes segvMsg and then the
+// faulting instruction's address from the ucontext, formatted in hex
+// below the stack pointer, to stderr, and exits with status 1.
+func (g *X86_64Generator) emitSegvHandler() {
+	// _bf_segv:
+	g.mark("_bf_segv")
+	g.symbol("_bf_segv", elf.STT_FUNC)
+	segvOffset = len(g.code)
+	g.emitBytes(amd64.MovqRegDisp32Reg(amd64.RBX, amd64.RDX, ucontextRIP)) // movq 168(%rdx), %rbx - the faulting RIP
+	g.fixups = append(g.fixups, jumpFixup{
+		offset:    len(g.code) + 3, // rel32 starts at offset 3 in lea instruction
+		targetIdx: fixupSegvMsg,
+	})
+	g.emitBytes(amd64.LeaqRIPRelRSI(0)) // leaq segv_msg(%rip), %rsi
+	g.emitSyscall(g.sys.Write, argImm(2), argReg(amd64.RSI), argImm(int32(len(segvMsg))))
+
+	// Format RBX a digit at a time, from the last, down from RSP
+	g.emitBytes(amd64.MovqRSPRSI())                    // movq %rsp, %rsi
+	g.emitBytes(amd64.DecqReg(amd64.RSI))              // decq %rsi
+	g.emitBytes(amd64.MovbImm8RegMem(amd64.RSI, '\n')) // movb $'\n', (%rsi)
+	digit := len(g.code)
+	g.emitBytes(amd64.MovlRegReg(amd64.RCX, amd64.RBX)) // movl %ebx, %ecx
+	g.emitBytes(amd64.AndlImm8Reg(amd64.RCX, 15))       // andl $15, %ecx
+	letter := amd64.AddlImm8Reg(amd64.RCX, 'a'-'0'-10)
+	g.emitBytes(amd64.CmplImm8Reg(amd64.RCX, 10))               // cmpl $10, %ecx
+	g.emitBytes(amd64.JcRel8(int8(len(letter))))                // jc over the add
+	g.emitBytes(letter)                                         // addl $39, %ecx
+	g.emitBytes(amd64.AddlImm8Reg(amd64.RCX, '0'))              // addl $'0', %ecx
+	g.emitBytes(amd64.DecqReg(amd64.RSI))                       // decq %rsi
+	g.emitBytes(amd64.MovbRegRegMem(amd64.RSI, amd64.RCX))      // movb %cl, (%rsi)
+	g.emitBytes(amd64.ShrqImm8Reg(amd64.RBX, 4))                // shrq $4, %rbx
+	g.emitBytes(amd64.JnzRel8(int8(digit - (len(g.code) + 2)))) // jnz digit
+	g.emitBytes(amd64.MovqRegReg(amd64.RDX, amd64.RSP))         // movq %rsp, %rdx
+	g.emitBytes(amd64.SubqRegReg(amd64.RDX, amd64.RSI))         // subq %rsi, %rdx - the digits and newline
+	g.emitSyscall(g.sys.Write, argImm(2), argReg(amd64.RSI), argReg(amd64.RDX))
+	g.emitSyscall(g.sys.Exit, argImm(1))
+
+	g.mark("segv message")
+	g.symbol("_bf_segv_msg", elf.STT_OBJECT)
+	segvMsgOffset = len(g.code)
+	g.emitBytes([]byte(segvMsg))
+}
+
+// ucontextRIP is the offset of the interrupted RIP in the ucontext a
+// SIGINFO handler is given in RDX: uc_mcontext's gregs[REG_RIP].
+const ucontextRIP = 168
+
+// emitTraceHelper outputs _bf_trace, which writes the 4-byte trace record
+// in EAX to trace.FD. It preserves RAX but, like the I/O helpers, clobbers
+// the syscall registers.
+func (g *X86_64Generator) emitTraceHelper() {
+	// _bf_trace:
+	g.mark("_bf_trace")
+	g.symbol("_bf_trace", elf.STT_FUNC)
+	helperTraceOffset = len(g.code)
+	g.emitBytes(amd64.PushRAX())                 // pushq %rax - the record, little-endian
+	g.emitBytes(amd64.MovqRSPRSI())              // movq %rsp, %rsi
+	g.emitBytes(amd64.MovqImm32RAX(g.sys.Write)) // movq $1, %rax
+	g.emitBytes(amd64.MovqImm32RDI(trace.FD))    // movq $3, %rdi
+	g.emitBytes(amd64.MovqImm32RDX(4))           // movq $4, %rdx
+	g.emitBytes(amd64.Syscall())                 // syscall
+	g.emitBytes(amd64.PopRAX())                  // popq %rax
+	g.emitBytes(amd64.Ret())                     // ret
+}
+
+// emitTrace outputs a call to _bf_trace with the record for e, or for
+// e.Kind and the current cell when cell is set.
+func (g *X86_64Generator) emitTrace(e trace.Event, cell bool) {
+	if cell {
+		g.emitBytes(amd64.MovzxByteMemToReg(amd64.RAX, 0)) // movzbl (%r13,%r12), %eax
+		g.emitBytes(amd64.OrqImm32RAX(int32(e.Record())))  // orq $kind<<24, %rax
+	} else {
+		g.emitBytes(amd64.MovqImm32RAX(int32(e.Record()))) // movq $record, %rax
+	}
+	g.fixups = append(g.fixups, jumpFixup{
+		offset:    len(g.code) + 1, // rel32 starts at offset 1 in call instruction
+		targetIdx: fixupTrace,
+	})
+	g.emitBytes(amd64.CallRel32(0)) // Placeholder
+}
+
+// emitOp outputs machine code for a single IR operation.
+func (g *X86_64Generator) emitOp(op core.Op) {
+	switch op.Kind {
+	case core.OpShift:
+		g.emitShift(op.Arg)
+	case core.OpAdd:
+		g.emitAdd(op.Arg)
+	case core.OpZero:
+		g.emitZero()
+	case core.OpIn:
+		g.emitIn()
+	case core.OpOut:
+		g.emitOut()
+	case core.OpJz:
+		g.emitJz(op.Arg)
+	case core.OpJnz:
+		g.emitJnz(op.Arg)
+	case core.OpSection:
+		g.emitSection(core.Handoff(op.Arg))
+	case core.OpTrap:
+		g.emitBytes(amd64.Int3()) // int3
+	case core.OpZeroRange:
+		g.emitZeroRange(op.Arg)
+	case core.OpCopyRange:
+		g.emitCopyRange(op.Arg, op.Off)
+	}
+}
+
+// emitZeroRange clears n cells from the data pointer: with SSE2 stores
+// of 16 zero cells at a time where vectorRange allows, or AVX2 stores of
+// 32 where wideRange does, else rep stosb.
+func (g *X86_64Generator) emitZeroRange(n int) {
+	if g.wideRange(n) {
+		g.emitBytes(amd64.VpxorYmm(amd64.X0, amd64.X0, amd64.X0)) // vpxor %ymm0, %ymm0, %ymm0
+		for _, at := range rangeBlocks(n, 32) {
+			g.emitBytes(amd64.VmovdquYmmMem(amd64.X0, int32(g.shift+at))) // vmovdqu %ymm0, shift+at(%r13,%r12)
+		}
+		g.emitBytes(amd64.Vzeroupper()) // vzeroupper
+		return
+	}
+	if g.vectorRange(n) {
+		g.emitBytes(amd64.PxorXmm(amd64.X0, amd64.X0)) // pxor %xmm0, %xmm0
+		for _, at := range rangeBlocks(n, 16) {
+			g.emitBytes(amd64.MovdquXmmMem(amd64.X0, int32(g.shift+at))) // movdqu %xmm0, shift+at(%r13,%r12)
+		}
+		return
+	}
+	g.emitBytes(amd64.XorRAXRAX())                              // xorq %rax, %rax
+	g.emitBytes(amd64.LeaqCellToReg(amd64.RDI, int32(g.shift))) // leaq shift(%r13,%r12), %rdi
+	g.emitBytes(amd64.MovqImm32RCX(int32(n)))                   // movq $n, %rcx
+	g.emitBytes(amd64.RepStosb())                               // rep stosb
+}
+
+// emitCopyRange copies n cells from the data pointer to d cells along,
+// 16 at a time through %xmm0 where vectorRange allows, or 32 through %ymm0
+// where wideRange does, else with rep movsb. The optimiser only emits
+// non-overlapping ranges, so copying forwards is always safe.
+func (g *X86_64Generator) emitCopyRange(n, d int) {
+	// Source and destination never overlap, so the blocks can be copied in
+	// any order, the last overlapping the one before
+	if g.wideRange(n) {
+		for _, at := range rangeBlocks(n, 32) {
+			g.emitBytes(amd64.VmovdquMemYmm(amd64.X0, int32(g.shift+at)))   // vmovdqu shift+at(%r13,%r12), %ymm0
+			g.emitBytes(amd64.VmovdquYmmMem(amd64.X0, int32(g.shift+at+d))) // vmovdqu %ymm0, shift+at+d(%r13,%r12)
+		}
+		g.emitBytes(amd64.Vzeroupper()) // vzeroupper
+		return
+	}
+	if g.vectorRange(n) {
+		for _, at := range rangeBlocks(n, 16) {
+			g.emitBytes(amd64.MovdquMemXmm(amd64.X0, int32(g.shift+at)))   // movdqu shift+at(%r13,%r12), %xmm0
+			g.emitBytes(amd64.MovdquXmmMem(amd64.X0, int32(g.shift+at+d))) // movdqu %xmm0, shift+at+d(%r13,%r12)
+		}
+		return
+	}
+	g.emitBytes(amd64.LeaqCellToReg(amd64.RSI, int32(g.shift)))   // leaq shift(%r13,%r12), %rsi
+	g.emitBytes(amd64.LeaqCellToReg(amd64.RDI, int32(g.shift+d))) // leaq shift+d(%r13,%r12), %rdi
+	g.emitBytes(amd64.MovqImm32RCX(int32(n)))                     // movq $n, %rcx
+	g.emitBytes(amd64.RepMovsb())                                 // rep movsb
+}
+
+// vectorRangeMax is the widest range op done 16 cells at a time; rep
+// stosb and rep movsb start slowly, but past this many cells they catch
+// up, in far less code.
+const vectorRangeMax = 128
+
+// vectorRange reports whether a range op over n cells is done with SSE2
+// loads and stores, rather than a rep string instruction: from 16 cells,
+// a whole block, to vectorRangeMax, unless WithSize.
+func (g *X86_64Generator) vectorRange(n int) bool {
+	return !g.size && n >= 16 && n <= vectorRangeMax
+}
+
+// wideRange reports whether a range op over n cells is done with AVX2
+// loads and stores rather than SSE2 ones: with WithAVX2, from 32 cells to
+// vectorRangeMax.
+func (g *X86_64Generator) wideRange(n int) bool {
+	return g.usesAVX2() && n >= 32 && n <= vectorRangeMax
+}
+
+// rangeBlocks returns the offsets of the width-cell blocks that cover n
+// cells, n at least width: every width cells, the last ending on the last
+// cell and so overlapping the one before unless n is a multiple of width.
+func rangeBlocks(n, width int) []int {
+	var blocks []int
+	for at := 0; at+width < n; at += width {
+		blocks = append(blocks, at)
+	}
+	return append(blocks, n-width)
+}
+
+// addRun is a run of ADDs planAdds replaces with SSE2 adds of 16 cells at
+// a time: what each cell from lo gains, lo relative to the pointer at the
+// start of the run, and how far the run moves the pointer.
+type addRun struct {
+	end    int // op index of the run's last op
+	lo     int
+	deltas []byte
+	shift  int
+}
+
+// vectorAddMin is the fewest cells a run of ADDs must change to be done
+// with SSE2 adds.
+const vectorAddMin = 16
+
+// planAdds finds the runs of ADDs over neighbouring cells, as in
+// +>++>+++ setting up the cells a program goes on to write: straight-line
+// ADDs and SHIFTs that change at least vectorAddMin cells, and at least
+// half of the cells from the first they change to the last. Only
+// wrapping cells add as paddb does, and a guarded tape would fault on a
+// block rather than on the cell off the end, so neither the other
+// overflow policies nor WithTapeGuard have any, and nor does WithSize.
+func (g *X86_64Generator) planAdds() map[int]addRun {
+	if g.cells.Overflow != core.OverflowWrap || g.size || g.guardsTape() {
+		return nil
+	}
+
+	adds := make(map[int]addRun)
+	for i := 0; i < len(g.ops); i++ {
+		sums := make(map[int]int) // cell offset -> what it gains
+		pos, end := 0, i-1
+		for j := i; j < len(g.ops); j++ {
+			op := g.ops[j]
+			if op.Kind == core.OpShift {
+				pos += op.Arg
+			} else if op.Kind == core.OpAdd {
+				sums[pos] += op.Arg
+			} else if op.Kind != core.OpNop {
+				break
+			}
+			end = j
+		}
+		if r, ok := matchAdds(sums); ok {
+			r.end, r.shift = end, pos
+			adds[i] = r
+		}
+		i = max(i, end)
+	}
+	return adds
+}
+
+// matchAdds returns the run of ADDs making the gains in sums, by cell
+// offset, if it is one for planAdds.
+func matchAdds(sums map[int]int) (addRun, bool) {
+	lo, hi, changed := 0, 0, 0
+	for off, k := range sums {
+		if byte(k) == 0 {
+			continue
+		}
+		if changed == 0 || off < lo {
+			lo = off
+		}
+		if changed == 0 || off > hi {
+			hi = off
+		}
+		changed++
+	}
+	if changed < vectorAddMin || 2*changed < hi-lo+1 {
+		return addRun{}, false
+	}
+
+	deltas := make([]byte, hi-lo+1)
+	for off, k := range sums {
+		if off >= lo && off <= hi {
+			deltas[off-lo] = byte(k)
+		}
+	}
+	return addRun{lo: lo, deltas: deltas}, true
+}
+
+// emitAdds outputs a run of ADDs as SSE2 adds, 16 cells at a time: the
+// gains are built in %xmm1 from two quadwords, and added with paddb to
+// the cells loaded into %xmm0. The last block may overlap the one before,
+// gaining nothing on the cells they share.
+func (g *X86_64Generator) emitAdds(r addRun) {
+	done := 0 // the cells from lo the blocks so far cover
+	for _, at := range rangeBlocks(len(r.deltas), 16) {
+		var v [16]byte
+		copy(v[done-at:], r.deltas[done:at+16])
+		done = at + 16
+		low, high := binary.LittleEndian.Uint64(v[:8]), binary.LittleEndian.Uint64(v[8:])
+		if low == 0 && high == 0 {
+			continue
+		}
+
+		if low == 0 {
+			g.emitBytes(amd64.PxorXmm(amd64.X1, amd64.X1)) // pxor %xmm1, %xmm1
+		} else {
+			g.emitBytes(amd64.MovabsRAX(low))                  // movabs $low, %rax
+			g.emitBytes(amd64.MovqRegXmm(amd64.X1, amd64.RAX)) // movq %rax, %xmm1
+		}
+		if high != 0 {
+			g.emitBytes(amd64.MovabsRAX(high))                   // movabs $high, %rax
+			g.emitBytes(amd64.MovqRegXmm(amd64.X2, amd64.RAX))   // movq %rax, %xmm2
+			g.emitBytes(amd64.PunpcklqdqXmm(amd64.X1, amd64.X2)) // punpcklqdq %xmm2, %xmm1
+		}
+		disp := int32(g.shift + r.lo + at)
+		g.emitBytes(amd64.MovdquMemXmm(amd64.X0, disp)) // movdqu disp(%r13,%r12), %xmm0
+		g.emitBytes(amd64.PaddbXmm(amd64.X0, amd64.X1)) // paddb %xmm1, %xmm0
+		g.emitBytes(amd64.MovdquXmmMem(amd64.X0, disp)) // movdqu %xmm0, disp(%r13,%r12)
+	}
+	g.shift += r.shift
+}
+
+// emitSection starts the next chained program, zeroing the tape with
+// rep stosb first for core.HandoffReset.
+func (g *X86_64Generator) emitSection(h core.Handoff) {
+	if h == core.HandoffReset {
+		g.emitBytes(amd64.XorRAXRAX())  // xorq %rax, %rax
+		g.emitBytes(amd64.MovqR13RDI()) // movq %r13, %rdi
+		if g.sizedTape() {
+			g.emitBytes(amd64.MovqR15RCX()) // movq %r15, %rcx
+		} else {
+			g.emitBytes(amd64.MovqImm32RCX(core.TapeSize)) // movq $30000, %rcx
+		}
+		g.emitBytes(amd64.RepStosb()) // rep stosb
+	}
+	g.emitStartPointer()
+}
+
+// emitShift defers moving the data pointer by k: the ops after it address
+// their cells g.shift places from R12, so SHIFT ADD SHIFT ADD becomes two
+// addb $k, off(%r13,%r12) with no SHIFT between them, until an op that
+// needs the pointer itself applies the shift. A SHIFT at the end of the
+// program is never applied, as nothing reads the pointer after it.
+func (g *X86_64Generator) emitShift(k int) {
+	g.shift += k
+}
+
+// addressesCells reports whether op, the i'th, reaches its cells through a
+// displacement, so it runs with a shift pending. The others, which test or
+// pass the pointer on, run after applyShift.
+func (g *X86_64Generator) addressesCells(i int, op core.Op) bool {
+	switch op.Kind {
+	case core.OpShift, core.OpAdd, core.OpZero, core.OpZeroRange, core.OpCopyRange, core.OpNop:
+		return true
+	case core.OpOut:
+		_, ok := g.batches[i]
+		return ok
+	case core.OpJz:
+		_, ok := g.multiply[i]
+		return ok
+	}
+	return false
+}
+
+// applyShift outputs the pending shift: addq/subq $k, %r12
+// Uses 32-bit immediate since Op.Arg is int, or with WithSize an 8-bit one
+// where k fits.
+func (g *X86_64Generator) applyShift() {
+	k := g.shift
+	g.shift = 0
+	if k == 0 {
+		return
+	}
+	if g.size && k >= -128 && k <= 127 {
+		if k > 0 {
+			g.emitBytes(amd64.AddqImm8R12(int8(k))) // addq $k, %r12
+		} else {
+			g.emitBytes(amd64.SubqImm8R12(int8(-k))) // subq $k, %r12
+		}
+		return
+	}
+	if k > 0 {
+		g.emitBytes(amd64.AddqImm32R12(int32(k))) // addq $k, %r12
+	} else {
+		g.emitBytes(amd64.SubqImm32R12(int32(-k))) // subq $k, %r12
+	}
+}
+
+// emitAdd outputs: addb/subb $k, shift(%r13,%r12)
+// Tape cells are bytes, so we use separate add/sub with uint8 immediates.
+// Under the saturate and trap policies the carry flag (or overflow flag for
+// signed cells) is checked after each add.
+func (g *X86_64Generator) emitAdd(k int) {
+	if k == 0 {
+		return
+	}
+
+	if g.cells.Overflow == core.OverflowWrap {
+		g.emitAddSub(k)
+		return
+	}
+
+	if g.cells.AlwaysOverflows(k) {
+		g.emitOverflowed(k)
+		return
+	}
+
+	// The overflow flag is only meaningful for immediates in [-127, 127]
+	for g.cells.Signed && (k > 127 || k < -127) {
+		step := 127
+		if k < 0 {
+			step = -127
+		}
+		g.emitCheckedAdd(step)
+		k -= step
+	}
+	g.emitCheckedAdd(k)
+}
+
+// emitAddSub outputs a plain addb $k or subb $-k on the current cell, or
+// with WithSize incb or decb for ±1 where no carry is checked after it.
+func (g *X86_64Generator) emitAddSub(k int) {
+	if g.size && (k == 1 || k == -1) && (g.cells.Overflow == core.OverflowWrap || g.cells.Signed) {
+		if k > 0 {
+			g.emitBytes(amd64.IncbMemDisp(int32(g.shift))) // incb shift(%r13,%r12)
+		} else {
+			g.emitBytes(amd64.DecbMemDisp(int32(g.shift))) // decb shift(%r13,%r12)
+		}
+		return
+	}
+	if k > 0 {
+		g.emitBytes(amd64.AddbImm8MemDisp(uint8(k), int32(g.shift))) // addb $k, shift(%r13,%r12)
+	} else {
+		g.emitBytes(amd64.SubbImm8MemDisp(uint8(-k), int32(g.shift))) // subb $k, shift(%r13,%r12)
+	}
+}
+
+// emitCheckedAdd outputs an add followed by the saturate clamp or trap jump.
+func (g *X86_64Generator) emitCheckedAdd(k int) {
+	g.emitAddSub(k)
+
+	if g.cells.Overflow == core.OverflowSaturate {
+		// jnc/jno over the clamp: movb $max/$min, shift(%r13,%r12)
+		clamp := amd64.MovbImm8MemDisp(byte(g.cells.Max()), int32(g.shift))
+		if k < 0 {
+			clamp = amd64.MovbImm8MemDisp(byte(g.cells.Min()), int32(g.shift))
+		}
+		if g.cells.Signed {
+			g.emitBytes(amd64.JnoRel8(int8(len(clamp))))
+		} else {
+			g.emitBytes(amd64.JncRel8(int8(len(clamp))))
+		}
+		g.emitBytes(clamp)
+		return
+	}
+
+	g.fixups = append(g.fixups, jumpFixup{
+		offset:    len(g.code) + 2, // rel32 starts at offset 2 in jc/jo instruction
+		targetIdx: fixupTrap,
+	})
+	if g.cells.Signed {
+		g.emitBytes(amd64.JoRel32(0)) // Placeholder
+	} else {
+		g.emitBytes(amd64.JcRel32(0)) // Placeholder
+	}
+}
+
+// emitOverflowed outputs an ADD k that is known to overflow: the saturated
+// value for the saturate policy or an unconditional jump to _bf_trap.
+func (g *X86_64Generator) emitOverflowed(k int) {
+	if g.cells.Overflow == core.OverflowSaturate {
+		if k > 0 {
+			g.emitBytes(amd64.MovbImm8MemDisp(byte(g.cells.Max()), int32(g.shift))) // movb $max, shift(%r13,%r12)
+		} else {
+			g.emitBytes(amd64.MovbImm8MemDisp(byte(g.cells.Min()), int32(g.shift))) // movb $min, shift(%r13,%r12)
+		}
+		return
+	}
+
+	g.fixups = append(g.fixups, jumpFixup{
+		offset:    len(g.code) + 1, // rel32 starts at offset 1 in jmp instruction
+		targetIdx: fixupTrap,
+	})
+	g.emitBytes(amd64.JmpRel32(0)) // Placeholder
+}
+
+// emitZero outputs: movb $0, shift(%r13,%r12)
+func (g *X86_64Generator) emitZero() {
+	g.emitBytes(amd64.MovbImm8MemDisp(0, int32(g.shift))) // movb $0, shift(%r13,%r12)
+}
+
+// emitIn outputs a call to _bf_read helper.
+func (g *X86_64Generator) emitIn() {
+	// Placeholder call - will be fixed up after helpers are emitted
+	g.fixups = append(g.fixups, jumpFixup{
+		offset:    len(g.code) + 1, // rel32 starts at offset 1 in call instruction
+		targetIdx: fixupRead,
+	})
+	g.emitBytes(amd64.CallRel32(0)) // Placeholder
+
+	if g.trace {
+		g.emitTrace(trace.Event{Kind: trace.In}, true)
+	}
+}
+
+// emitOut outputs a call to _bf_write helper.
+func (g *X86_64Generator) emitOut() {
+	if g.trace {
+		g.emitTrace(trace.Event{Kind: trace.Out}, true)
+	}
+
+	// Placeholder call - will be fixed up after helpers are emitted
+	g.fixups = append(g.fixups, jumpFixup{
+		offset:    len(g.code) + 1, // rel32 starts at offset 1 in call instruction
+		targetIdx: fixupWrite,
+	})
+	g.emitBytes(amd64.CallRel32(0)) // Placeholder
+}
+
+// emitWrite outputs the write system call of the current cell, the body
+// of _bf_write, or an inlined OUT.
+func (g *X86_64Generator) emitWrite() {
+	g.emitBytes(amd64.LeaqR13R12ToRSI())         // leaq (%r13,%r12), %rsi
+	g.emitBytes(amd64.MovqImm32RAX(g.sys.Write)) // movq $1, %rax - syscall 1 (write)
+	g.emitBytes(amd64.MovqImm32RDI(1))           // movq $1, %rdi
+	g.emitBytes(amd64.MovqImm32RDX(1))           // movq $1, %rdx
+	g.emitBytes(amd64.Syscall())                 // syscall
+}
+
+// planProfile finds, from the profile, the hot loops to align and the hot
+// OUTs to inline (see WithProfile). Multiply and scan loops are straight
+// line code, and batched OUTs already make one call for the batch, so
+// neither is chosen; nor are OUTs where _bf_write is a hook, putchar or
+// traced.
+func (g *X86_64Generator) planProfile() (aligned, inlined map[int]bool) {
+	if g.size || len(g.profile) != len(g.ops) {
+		return nil, nil
+	}
+	var most uint64
+	for _, n := range g.profile {
+		most = max(most, n)
+	}
+	hot := func(n uint64) bool {
+		return n > 0 && n >= most/HotShare
+	}
+
+	iterations := make(map[int]uint64) // loop label -> the count of its JNZ
+	for i, op := range g.ops {
+		if op.Kind == core.OpJnz {
+			iterations[op.Arg] = g.profile[i]
+		}
+	}
+
+	aligned, inlined = make(map[int]bool), make(map[int]bool)
+	plainWrite := !g.trace && g.lib == "" && !g.libc
+	for i, op := range g.ops {
+		_, isMultiply := g.multiply[i]
+		_, isScan := g.scans[i]
+		_, isBatched := g.batches[i]
+		switch {
+		case op.Kind == core.OpJz && !isMultiply && !isScan && hot(iterations[op.Arg]):
+			aligned[i] = true
+		case op.Kind == core.OpOut && !isBatched && plainWrite && hot(g.profile[i]):
+			inlined[i] = true
+		}
+	}
+	return aligned, inlined
+}
+
+// outBufSize is the size of the stack buffer batched OUTs copy their
+// bytes to, and so the most OUTs in one batch.
+const outBufSize = 128
+
+// The iovecs a batch's writev reads, one for each OUT at most, follow the
+// output buffer on the stack.
+const (
+	iovSize  = 16 // struct iovec: base and length
+	outIovs  = outBufSize
+	outFrame = outIovs + outBufSize*iovSize
+)
+
+// noIovec is the iov of an outSlot that extends the iovec before it.
+const noIovec = -1
+
+// outSlot places a batched OUT. Its byte is written by the writev after
+// the last OUT of the batch: straight from the tape if nothing writes its
+// cell before then, and otherwise from the output buffer, at offset.
+// Consecutive bytes from the tape cells in order, or from the buffer,
+// share an iovec, which the first of them fills in.
+type outSlot struct {
+	direct bool // the byte is written from the tape
+	offset int  // the byte's offset in the output buffer, if not direct
+	iov    int  // the iovec the OUT fills in, or noIovec
+	length int  // with iov, the number of bytes the iovec covers
+	flush  int  // the number of iovecs to write after the OUT, or 0 while more of the batch follows
+}
+
+// cellWrite is a write to the cells from lo to hi, relative to the
+// pointer at the start of a run, after the first outs of its OUTs.
+type cellWrite struct {
+	outs, lo, hi int
+}
+
+// planBatches finds the OUTs to batch: runs of two or more with nothing
+// between them but SHIFT, ZERO, range ops and ADDs, none of which read
+// input, branch or exit (except an ADD under the trap policy, which ends
+// a run). With a guarded tape, any of them can lead to a cell off the
+// end, and _bf_segv exiting with the batch unwritten, so only OUTs of the
+// same cell are batched, each copied to the buffer so that reading it
+// faults as an unbatched OUT would. Each OUT of a run fills in its part
+// of the iovecs, and the last writes them all with one writev, rather
+// than each calling _bf_write. Traced executables write each byte as it is traced
+// instead, libraries through the write hook, and objects through
+// putchar, which buffers already.
+func (g *X86_64Generator) planBatches() map[int]outSlot {
+	if g.trace || g.lib != "" || g.libc {
+		return nil
+	}
+
+	batches := make(map[int]outSlot)
+	var (
+		run     []int // op indices of the OUTs in the current run
+		offsets []int // the cell each OUT writes, relative to the run's start
+		writes  []cellWrite
+		offset  int
+	)
+	end := func() {
+		if len(run) >= 2 {
+			for start := 0; start < len(run); start += outBufSize {
+				last := min(start+outBufSize, len(run)) - 1
+				g.planBatch(batches, run[start:last+1], offsets[start:last+1], writes, start)
+			}
+		}
+		run, offsets, writes, offset = run[:0], offsets[:0], writes[:0], 0
+	}
+	write := func(lo, hi int) {
+		if len(run) > 0 {
+			writes = append(writes, cellWrite{outs: len(run), lo: lo, hi: hi})
+		}
+	}
+	for i, op := range g.ops {
+		if g.guardsTape() && op.Kind != core.OpOut && op.Kind != core.OpNop {
+			end()
+			continue
+		}
+		switch op.Kind {
+		case core.OpOut:
+			run = append(run, i)
+			offsets = append(offsets, offset)
+		case core.OpNop:
+		case core.OpShift:
+			offset += op.Arg
+		case core.OpZero:
+			write(offset, offset+1)
+		case core.OpZeroRange:
+			write(offset, offset+op.Arg)
+		case core.OpCopyRange:
+			write(offset+op.Off, offset+op.Off+op.Arg)
+		case core.OpAdd:
+			if g.cells.Overflow == core.OverflowTrap {
+				end()
+			} else {
+				write(offset, offset+1)
+			}
+		default:
+			end()
+		}
+	}
+	end()
+	return batches
+}
+
+// planBatch places the OUTs of one batch, ops, which write the cells at
+// offsets and are the run's OUTs from first on.
+func (g *X86_64Generator) planBatch(batches map[int]outSlot, ops, offsets []int, writes []cellWrite, first int) {
+	// rewritten reports whether a cell is written after the j'th OUT of
+	// the batch, before the writev
+	rewritten := func(j int) bool {
+		for _, w := range writes {
+			if w.outs > first+j && w.outs < first+len(ops) && w.lo <= offsets[j] && offsets[j] < w.hi {
+				return true
+			}
+		}
+		return false
+	}
+
+	slots := make([]outSlot, len(ops))
+	buffered, iovs, open := 0, 0, 0
+	for j := range ops {
+		s := outSlot{direct: !g.guardsTape() && !rewritten(j), iov: noIovec}
+		if !s.direct {
+			s.offset = buffered
+			buffered++
+		}
+		joins := j > 0 && s.direct == slots[j-1].direct && (!s.direct || offsets[j] == offsets[j-1]+1)
+		if !joins {
+			s.iov = iovs
+			iovs++
+			open = j
+		}
+		slots[j] = s
+		slots[open].length++
+	}
+	slots[len(ops)-1].flush = iovs
+	for j, i := range ops {
+		batches[i] = slots[j]
+	}
+}
+
+// multiply is a loop planMultiplies replaces with straight-line code: one
+// whose iterations each add factor to the cell off from the counter, for
+// each target, as many times as the counter's value.
+type multiply struct {
+	end     int // op index of the JNZ
+	targets []cellFactor
+}
+
+// cellFactor is a multiply loop's target: the cell off from the counter,
+// and what it gains for each iteration, as a byte.
+type cellFactor struct {
+	off, factor int
+}
+
+// planMultiplies finds the multiply and copy loops, [->+++>+<<] and the
+// like: bodies of only SHIFTs and ADDs that end on the counter cell,
+// having stepped it by 1 or -1. Their iterations commute only with
+// wrapping cells, and the trace records a loop's entry, so neither other
+// overflow policies nor WithTrace have any.
+func (g *X86_64Generator) planMultiplies() map[int]multiply {
+	if g.cells.Overflow != core.OverflowWrap || g.trace {
+		return nil
+	}
+
+	multiplies := make(map[int]multiply)
+	for i, op := range g.ops {
+		if op.Kind != core.OpJz || op.NoOpt {
+			continue
+		}
+		if m, ok := g.matchMultiply(i); ok {
+			multiplies[i] = m
+		}
+	}
+	return multiplies
+}
+
+// matchMultiply returns the multiply loop starting at the JZ at ops[jz],
+// if it is one.
+func (g *X86_64Generator) matchMultiply(jz int) (multiply, bool) {
+	sums := make(map[int]int)
+	var offs []int // the cells added to, in order
+	pos := 0
+	for j := jz + 1; j < len(g.ops); j++ {
+		switch op := g.ops[j]; op.Kind {
+		case core.OpShift:
+			pos += op.Arg
+		case core.OpAdd:
+			if _, ok := sums[pos]; !ok {
+				offs = append(offs, pos)
+			}
+			sums[pos] += op.Arg
+		case core.OpNop:
+		case core.OpJnz:
+			step := sums[0] & 0xff
+			if pos != 0 || (step != 1 && step != 0xff) {
+				return multiply{}, false
+			}
+			m := multiply{end: j}
+			for _, off := range offs {
+				factor := sums[off] & 0xff
+				if step == 1 {
+					// Counting up runs 256 - counter times, so as many
+					// times the negated factor as counting down
+					factor = -factor & 0xff
+				}
+				if off != 0 && factor != 0 {
+					m.targets = append(m.targets, cellFactor{off: off, factor: factor})
+				}
+			}
+			return m, true
+		default:
+			return multiply{}, false
+		}
+	}
+	return multiply{}, false
+}
+
+// emitMultiply outputs a multiply loop without looping: the counter into
+// EAX, then for each target addb %al (or subb, or the imull product in
+// %cl), and the counter cleared. A zero counter skips it all, as it would
+// the loop, so cells off the tape are not touched unless the loop would.
+func (g *X86_64Generator) emitMultiply(m multiply) {
+	at := int32(g.shift)
+
+	var body []byte
+	for _, t := range m.targets {
+		off := at + int32(t.off)
+		switch t.factor {
+		case 1:
+			body = append(body, amd64.AddRegToMem8(amd64.RAX, off)...) // addb %al, off(%r13,%r12)
+		case 0xff:
+			body = append(body, amd64.SubRegFromMem8(amd64.RAX, off)...) // subb %al, off(%r13,%r12)
+		default:
+			body = append(body, amd64.ImullImm8RegReg(amd64.RCX, amd64.RAX, int8(t.factor))...) // imull $k, %eax, %ecx
+			body = append(body, amd64.AddRegToMem8(amd64.RCX, off)...)                          // addb %cl, off(%r13,%r12)
+		}
+	}
+	body = append(body, amd64.MovbImm8MemDisp(0, at)...) // movb $0, shift(%r13,%r12)
+
+	g.emitBytes(amd64.MovzxByteMemToReg(amd64.RAX, at)) // movzbl shift(%r13,%r12), %eax
+	g.emitBytes(amd64.TestlRegReg(amd64.RAX))           // testl %eax, %eax
+	if len(body) <= 127 {
+		g.emitBytes(amd64.JzRel8(int8(len(body)))) // jz over the body
+	} else {
+		g.emitBytes(amd64.JzRel32(int32(len(body)))) // jz over the body
+	}
+	g.emitBytes(body)
+}
+
+// scan is a loop planScans replaces with a vector search: one that moves
+// the pointer by step, 1 or -1, until it is on a zero cell.
+type scan struct {
+	end  int // op index of the JNZ
+	step int
+}
+
+// planScans finds the scan loops, [>] and [<]. Loops with a longer
+// stride, such as [>>], are left as they are, as are loops with a trace
+// to record their entry.
+func (g *X86_64Generator) planScans() map[int]scan {
+	if g.trace || g.size {
+		return nil
+	}
+
+	scans := make(map[int]scan)
+	for i, op := range g.ops {
+		if op.Kind != core.OpJz || op.NoOpt {
+			continue
+		}
+		if s, ok := g.matchScan(i); ok {
+			scans[i] = s
+		}
+	}
+	return scans
+}
+
+// matchScan returns the scan loop starting at the JZ at ops[jz], if it is
+// one.
+func (g *X86_64Generator) matchScan(jz int) (scan, bool) {
+	step := 0
+	for j := jz + 1; j < len(g.ops); j++ {
+		switch op := g.ops[j]; op.Kind {
+		case core.OpShift:
+			step += op.Arg
+		case core.OpNop:
+		case core.OpJnz:
+			if step != 1 && step != -1 {
+				return scan{}, false
+			}
+			return scan{end: j, step: step}, true
+		default:
+			return scan{}, false
+		}
+	}
+	return scan{}, false
+}
+
+// emitScan outputs a scan loop as an SSE2 search of the tape for a zero
+// cell, 16 cells at a time: pcmpeqb against zero and pmovmskb for a bit
+// per cell, masked in the first block to the current cell and those the
+// scan goes on to, then bsf (or bsr, scanning back) for the nearest. With
+// WithAVX2 the search is the same 32 cells at a time, in the ymm
+// registers. The loads are aligned, so as the loop would, they read
+// nothing past the page the zero cell is in. Clobbers RAX, RCX, RDX, RDI,
+// XMM0 and XMM1.
+func (g *X86_64Generator) emitScan(s scan) {
+	width := int8(16)
+	zero := amd64.PxorXmm(amd64.X0, amd64.X0)                           // pxor %xmm0, %xmm0
+	block := amd64.MovdqaMemXmm(amd64.X1, amd64.RDI)                    // movdqa (%rdi), %xmm1
+	block = append(block, amd64.PcmpeqbXmm(amd64.X1, amd64.X0)...)      // pcmpeqb %xmm0, %xmm1
+	block = append(block, amd64.PmovmskbXmmReg(amd64.RAX, amd64.X1)...) // pmovmskb %xmm1, %eax
+	if g.usesAVX2() {
+		width = 32
+		zero = amd64.VpxorYmm(amd64.X0, amd64.X0, amd64.X0)                       // vpxor %ymm0, %ymm0, %ymm0
+		block = amd64.VmovdqaMemYmm(amd64.X1, amd64.RDI)                          // vmovdqa (%rdi), %ymm1
+		block = append(block, amd64.VpcmpeqbYmm(amd64.X1, amd64.X1, amd64.X0)...) // vpcmpeqb %ymm0, %ymm1, %ymm1
+		block = append(block, amd64.VpmovmskbYmmReg(amd64.RAX, amd64.X1)...)      // vpmovmskb %ymm1, %eax
+	}
+
+	next := amd64.AddqImm8Reg(amd64.RDI, width) // addq $width, %rdi
+	find := amd64.BsflRegReg(amd64.RAX, amd64.RAX)
+	if s.step < 0 {
+		next = amd64.SubqImm8Reg(amd64.RDI, width) // subq $width, %rdi
+		find = amd64.BsrlRegReg(amd64.RAX, amd64.RAX)
+	}
+	loop := append(append(next, block...), amd64.TestlRegReg(amd64.RAX)...)
+
+	g.emitBytes(amd64.LeaqCellToReg(amd64.RDI, 0))      // leaq (%r13,%r12), %rdi
+	g.emitBytes(amd64.MovlRegReg(amd64.RCX, amd64.RDI)) // movl %edi, %ecx
+	g.emitBytes(amd64.AndqImm8Reg(amd64.RDI, -width))   // andq $-width, %rdi - the cell's block
+	g.emitBytes(amd64.AndlImm8Reg(amd64.RCX, width-1))  // andl $width-1, %ecx - the cell's place in it
+	g.emitBytes(zero)
+	g.emitBytes(block)
+	if s.step > 0 {
+		g.emitBytes(amd64.MovlImm32Reg(amd64.RDX, -1)) // movl $-1, %edx
+		g.emitBytes(amd64.ShllCLReg(amd64.RDX))        // shll %cl, %edx - the cell and those after it
+	} else {
+		g.emitBytes(amd64.MovlImm32Reg(amd64.RDX, 2)) // movl $2, %edx
+		g.emitBytes(amd64.ShllCLReg(amd64.RDX))       // shll %cl, %edx
+		g.emitBytes(amd64.DeclReg(amd64.RDX))         // decl %edx - the cell and those before it
+	}
+	g.emitBytes(amd64.AndlRegReg(amd64.RAX, amd64.RDX)) // andl %edx, %eax
+	g.emitBytes(amd64.JnzRel8(int8(len(loop) + 2)))     // jnz found
+	g.emitBytes(loop)                                   // loop: the next block
+	g.emitBytes(amd64.JzRel8(int8(-(len(loop) + 2))))   // jz loop
+	g.emitBytes(find)                                   // found: bsfl (or bsrl) %eax, %eax
+	g.emitBytes(amd64.AddqRegReg(amd64.RDI, amd64.RAX)) // addq %rax, %rdi
+	g.emitBytes(amd64.SubqRegReg(amd64.RDI, amd64.R13)) // subq %r13, %rdi
+	g.emitBytes(amd64.MovqRegReg(amd64.R12, amd64.RDI)) // movq %rdi, %r12
+	if g.usesAVX2() {
+		g.emitBytes(amd64.Vzeroupper()) // vzeroupper
+	}
+}
+
+// emitBatchedOut copies the current cell to the output buffer unless it
+// is written from the tape, fills in the iovec the OUT starts, and for
+// the last OUT of a batch, writes the iovecs to stdout.
+func (g *X86_64Generator) emitBatchedOut(slot outSlot) {
+	if !slot.direct {
+		g.emitBytes(amd64.MovbMemToReg(amd64.RAX, int32(g.shift))) // movb shift(%r13,%r12), %al
+		g.emitBytes(amd64.MovbALRSPDisp8(int8(slot.offset)))       // movb %al, offset(%rsp)
+	}
+	if slot.iov != noIovec {
+		iov := int32(outIovs + slot.iov*iovSize)
+		if slot.direct {
+			g.emitBytes(amd64.LeaqCellToReg(amd64.RAX, int32(g.shift))) // leaq shift(%r13,%r12), %rax
+		} else {
+			g.emitBytes(amd64.LeaqRSPDisp32Reg(amd64.RAX, int32(slot.offset))) // leaq offset(%rsp), %rax
+		}
+		g.emitBytes(amd64.MovqRegRSPDisp32(iov, amd64.RAX))              // movq %rax, iov(%rsp) - iov_base
+		g.emitBytes(amd64.MovqImm32RSPDisp32(iov+8, int32(slot.length))) // movq $length, iov+8(%rsp) - iov_len
+	}
+	if slot.flush == 0 {
+		return
+	}
+	g.emitBytes(amd64.LeaqRSPDisp32Reg(amd64.RSI, outIovs))                              // leaq iovs(%rsp), %rsi
+	g.emitSyscall(g.sys.Writev, argImm(1), argReg(amd64.RSI), argImm(int32(slot.flush))) // writev(1, iovs, n) - stdout
+}
+
+// emitJz outputs: testb $0xff, (%r13,%r12); jz past the loop's JNZ
+func (g *X86_64Generator) emitJz(label int) {
+	g.emitBytes(amd64.TestbMem())
+	if g.short[jumpKey{label, true}] {
+		g.fixups = append(g.fixups, jumpFixup{
+			offset:    len(g.code) + 1, // rel8 starts at offset 1 in jz instruction
+			targetIdx: label,
+			loopEnd:   true,
+			short:     true,
+		})
+		g.emitBytes(amd64.JzRel8(0)) // Placeholder
+	} else {
+		// Record fixup for the jz rel32
+		g.fixups = append(g.fixups, jumpFixup{
+			offset:    len(g.code) + 2, // rel32 starts at offset 2 in jz instruction
+			targetIdx: label,
+			loopEnd:   true,
+		})
+		g.emitBytes(amd64.JzRel32(0)) // Placeholder
+	}
+
+	if g.trace {
+		g.emitTrace(trace.Event{Kind: trace.Loop, Value: label}, false)
+	}
+}
+
+// emitJnz outputs: testb $0xff, (%r13,%r12); jnz back to the loop's JZ
+func (g *X86_64Generator) emitJnz(label int) {
+	g.emitBytes(amd64.TestbMem())
+	if g.short[jumpKey{label, false}] {
+		g.fixups = append(g.fixups, jumpFixup{
+			offset:    len(g.code) + 1, // rel8 starts at offset 1 in jnz instruction
+			targetIdx: label,
+			short:     true,
+		})
+		g.emitBytes(amd64.JnzRel8(0)) // Placeholder
+		return
+	}
+	// Record fixup for the jnz rel32
+	g.fixups = append(g.fixups, jumpFixup{
+		offset:    len(g.code) + 2, // rel32 starts at offset 2 in jnz instruction
+		targetIdx: label,
+	})
+	g.emitBytes(amd64.JnzRel32(0)) // Placeholder
+}
+
+// jumpKey names a loop's JZ (end set, as it jumps to the loop's end) or
+// JNZ.
+type jumpKey struct {
+	label int
+	end   bool
+}
+
+// planShortJumps finds the loop jumps that fit a rel8, by relaxation. It
+// generates the code once with every jump a rel32, and takes those whose
+// rel8 would reach there. Shortening a jump brings others' targets closer,
+// except where the padding that aligns a hot loop grows, so the code is
+// generated again with those jumps short, and any that no longer reach go
+// back to rel32, until all of them reach. With no aligned loops the first
+// guess stands.
+func (g *X86_64Generator) planShortJumps() map[jumpKey]bool {
+	short := make(map[jumpKey]bool)
+	probe := g.probe(short)
+	for _, f := range probe.fixups {
+		// The rel8 form ends 4 bytes before the rel32 form did
+		if f.targetIdx >= 0 && fitsRel8(probe.loopTarget(f)-(f.offset+4)+4) {
+			short[jumpKey{f.targetIdx, f.loopEnd}] = true
+		}
+	}
+	if len(g.aligned) == 0 {
+		return short
+	}
+
+	for {
+		probe = g.probe(short)
+		relaxed := false
+		for _, f := range probe.fixups {
+			if f.short && !fitsRel8(probe.loopTarget(f)-(f.offset+1)) {
+				delete(short, jumpKey{f.targetIdx, f.loopEnd})
+				relaxed = true
+			}
+		}
+		if !relaxed {
+			return short
+		}
+	}
+}
+
+// probe generates the code with the loop jumps in short made rel8, for
+// planShortJumps to measure, leaving g as it was.
+func (g *X86_64Generator) probe(short map[jumpKey]bool) *X86_64Generator {
+	probe := *g
+	probe.code = make([]byte, 0, cap(g.code))
+	probe.loopStart, probe.loopEnd = make(map[int]int), make(map[int]int)
+	probe.fixups, probe.relocs, probe.symtab = nil, nil, nil
+	probe.srcmap, probe.progress = nil, nil
+	probe.short = short
+	probe.Generate()
+	return &probe
+}
+
+// loopTarget returns the code offset a loop jump's fixup jumps to.
+func (g *X86_64Generator) loopTarget(f jumpFixup) int {
+	if f.loopEnd {
+		return g.loopEnd[f.targetIdx]
+	}
+	return g.loopStart[f.targetIdx]
+}
+
+// fitsRel8 reports whether rel fits a jump's 8-bit displacement.
+func fitsRel8(rel int) bool {
+	return rel >= -128 && rel <= 127
+}
+
+// resolveFixups patches all jump and call targets.
+func (g *X86_64Generator) resolveFixups() {
+	for _, fixup := range g.fixups {
+		var targetAddr int
+		switch fixup.targetIdx {
+		case fixupRead:
+			targetAddr = helperReadOffset
+		case fixupWrite:
+			targetAddr = helperWriteOffset
+		case fixupTrap:
+			targetAddr = helperTrapOffset
+		case fixupTrapMsg:
+			targetAddr = trapMsgOffset
+		case fixupInfoMsg:
+			targetAddr = infoMsgOffset
+		case fixupTrace:
+			targetAddr = helperTraceOffset
+		case fixupInit:
+			targetAddr = initOffset
+		case fixupCPUMsg:
+			targetAddr = cpuMsgOffset
+		case fixupSegv:
+			targetAddr = segvOffset
+		case fixupSegvMsg:
+			targetAddr = segvMsgOffset
+		default:
+			targetAddr = g.loopTarget(fixup)
+		}
+
+		if fixup.short {
+			g.code[fixup.offset] = byte(int8(targetAddr - (fixup.offset + 1)))
+			continue
 		}
 
 		// Calculate relative offset from end of instruction
 		// For jz/jnz: instruction ends 4 bytes after rel32 start
 		// For call: instruction ends 4 bytes after rel32 start
+		// For lea: instruction ends 4 bytes after rel32 start
 		instrEnd := fixup.offset + 4
 		rel32 := int32(targetAddr - instrEnd)
 
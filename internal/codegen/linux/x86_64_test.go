@@ -0,0 +1,152 @@
+package linux_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lcox74/bfcc/internal/codegen/linux"
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/internal/emu"
+)
+
+const helloWorld = "++++++++[>++++[>++>+++>+++>+<<<<-]>+>+>->>+[<]<-]>>.>---.+++++++..+++.>>.<-.<.+++.------.--------.>>+.>++."
+
+// TestX86_64Emulated builds small programs at O2 and runs them in the
+// emulator, so that it checks the generated code on any host.
+func TestX86_64Emulated(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   string
+		cells core.CellModel
+		opts  []linux.Option
+		input string
+		args  []string
+		want  string
+		exit  int
+	}{
+		{name: "hello", src: helloWorld, want: "Hello World!\n"},
+		{name: "echo", src: ",[.,]", input: "abc", want: "abc"},
+		{name: "multiply", src: "++++++[>+++++++++++<-]>.", want: "B"},
+		{name: "wrap", src: "-.", want: "\xff"},
+		{name: "saturate", src: "-.", cells: core.CellModel{Overflow: core.OverflowSaturate}, want: "\x00"},
+		{name: "trap", src: "-.", cells: core.CellModel{Overflow: core.OverflowTrap}, exit: 1},
+		{name: "unsigned eof", src: ",.", want: "\x00"},
+		{name: "signed eof", src: ",.", cells: core.CellModel{Signed: true}, want: "\xff"},
+		{name: "mid tape", src: "<++++++++[>++++++++<-]>+.", opts: []linux.Option{linux.WithMidTape()}, want: "A"},
+		{name: "scan right", src: scanRight, want: "A"},
+		{name: "scan left", src: scanLeft, want: "A"},
+		{name: "scan right size", src: scanRight, opts: []linux.Option{linux.WithSize()}, want: "A"},
+		{name: "scan left size", src: scanLeft, opts: []linux.Option{linux.WithSize()}, want: "A"},
+		{name: "scan right avx2", src: scanRight, opts: []linux.Option{linux.WithAVX2()}, want: "A"},
+		{name: "scan left avx2", src: scanLeft, opts: []linux.Option{linux.WithAVX2()}, want: "A"},
+		{name: "zero range", src: zeroRange, want: strings.Repeat("\x00", 40)},
+		{name: "zero range avx2", src: zeroRange, opts: []linux.Option{linux.WithAVX2()}, want: strings.Repeat("\x00", 40)},
+		{name: "copy range", src: copyRange, want: copied},
+		{name: "copy range avx2", src: copyRange, opts: []linux.Option{linux.WithAVX2()}, want: copied},
+		{name: "add run", src: addRun, want: added},
+		{name: "add run size", src: addRun, opts: []linux.Option{linux.WithSize()}, want: added},
+		{name: "batch from the tape", src: numbered + strings.Repeat(".>", 5), want: "\x01\x02\x03\x04\x05"},
+		{name: "batch rewritten", src: "+.+.>+.<.", want: "\x01\x02\x01\x02"},
+		{name: "batch past the buffer", src: "+++[>++++++++<-]>+" + strings.Repeat(".", 300), want: strings.Repeat("\x19", 300)},
+		{name: "tape init", src: "[.>]", opts: []linux.Option{linux.WithTapeInit([]byte("hi"))}, want: "hi"},
+		{name: "argv input", src: ",[.,]", opts: []linux.Option{linux.WithArgvInput()}, args: []string{"xyz"}, want: "xyz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops, err := core.LowerAt(core.Tokenize([]byte(tt.src)), core.O2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ops, _, err = core.Optimise(ops, core.Options{Level: core.O2, Cells: tt.cells})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			opts := []linux.Option{linux.WithCellOverflow(tt.cells.Overflow)}
+			if tt.cells.Signed {
+				opts = append(opts, linux.WithSignedCells())
+			}
+			binary := linux.NewX86_64Generator(ops, append(opts, tt.opts...)...).GenerateELF()
+
+			res, err := emu.Run(binary, emu.Config{Input: []byte(tt.input), Args: tt.args, MaxSteps: 10_000_000})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Exit != tt.exit {
+				t.Errorf("exit status %d, want %d (stderr %q)", res.Exit, tt.exit, res.Stderr)
+			}
+			if got := string(res.Stdout); got != tt.want {
+				t.Errorf("wrote %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Programs for the scan loops and range ops: each scan runs over 40
+// non-zero cells, past a block or two whichever the width, and then writes
+// 'A' on the zero cell it stops on.
+var (
+	scanRight = strings.Repeat("+>", 40) + strings.Repeat("<", 40) + "[>]" + strings.Repeat("+", 65) + "."
+	scanLeft  = ">" + strings.Repeat("+>", 40) + "<[<]" + strings.Repeat("+", 65) + "."
+
+	// 40 cells set to 1 to 40, cleared with [-] each and written
+	zeroRange = numbered + strings.Repeat("[-]>", 40) + strings.Repeat("<", 40) + strings.Repeat(".>", 40)
+
+	// 40 cells set to 1 to 40, each moved 50 cells along and written
+	copyRange = numbered + strings.Repeat(far+"[-]"+back+"[-"+far+"+"+back+"]>", 40) + strings.Repeat("<", 40) +
+		far + strings.Repeat(".>", 40)
+	far, back = strings.Repeat(">", 50), strings.Repeat("<", 50)
+	numbered  = numberCells(40)
+	copied    = string(numberBytes(40))
+
+	// 40 cells set to 1 to 40, then 3 taken from every other one, which
+	// wraps the first and leaves gaps in the second run of ADDs
+	addRun = numbered + strings.Repeat("--->>", 20) + strings.Repeat("<", 40) + strings.Repeat(".>", 40)
+	added  = string(lessEveryOther(numberBytes(40), 3))
+)
+
+// lessEveryOther takes k from every other byte of b, from the first.
+func lessEveryOther(b []byte, k byte) []byte {
+	for i := 0; i < len(b); i += 2 {
+		b[i] -= k
+	}
+	return b
+}
+
+// numberCells returns code setting the n cells from the start to 1 to n,
+// leaving the pointer on the first.
+func numberCells(n int) string {
+	var b strings.Builder
+	for i := 1; i <= n; i++ {
+		b.WriteString(strings.Repeat("+", i) + ">")
+	}
+	return b.String() + strings.Repeat("<", n)
+}
+
+// numberBytes returns the bytes 1 to n.
+func numberBytes(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i + 1)
+	}
+	return b
+}
+
+// TestX86_64MissingSyscall checks that a feature needing a system call the
+// OS lacks is reported by Err, rather than generated.
+func TestX86_64MissingSyscall(t *testing.T) {
+	sys := linux.LinuxSyscalls
+	sys.RtSigaction = 0
+	g := linux.NewX86_64Generator(nil, linux.WithSyscalls(sys), linux.WithTapeGuard())
+	g.Generate()
+	if g.Err() == nil {
+		t.Error("no error for a missing rt_sigaction")
+	}
+
+	g = linux.NewX86_64Generator(nil, linux.WithTapeGuard())
+	g.Generate()
+	if err := g.Err(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,304 @@
+// Package llvm produces LLVM IR assembly (a .ll file) from IR operations,
+// for clang or llc to compile for any target LLVM supports, with LLVM's own
+// optimisations on top of bfcc's.
+//
+// The module defines main, which runs the program on a zeroed global tape
+// and returns 0. I/O goes through the C library's getchar and putchar, and
+// a cell overflow under the trap policy prints the native executables'
+// message with dprintf and calls exit(1), so it links against any POSIX C
+// library. The IR uses opaque pointers, which need LLVM 15 or later.
+package llvm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lcox74/bfcc/internal/codegen/linux"
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// trapMsg is printed on stderr when a cell overflows under the trap policy.
+const trapMsg = "bfcc: cell overflow\n"
+
+// Generator produces LLVM IR from IR operations. It takes the linux
+// package's Options, but only supports the cell model, mid-tape and
+// progress ones; debug builds need nothing more, as nothing follows main's
+// return, and a TRAP calls llvm.trap.
+//
+// The data pointer lives in an alloca, %dp, which LLVM's mem2reg pass
+// promotes to a register. Each loop is three blocks, loop_L testing the
+// cell on entry, loop_L_body, which tests it again at the JNZ and branches
+// back to itself, and loop_L_end after the loop.
+type Generator struct {
+	ops  []core.Op
+	out  strings.Builder
+	opts linux.Settings
+
+	temps  int // %tN values used so far
+	blocks int // cont_N blocks used so far
+}
+
+// NewGenerator creates a new LLVM IR generator.
+func NewGenerator(ops []core.Op, opts ...linux.Option) *Generator {
+	return &Generator{ops: ops, opts: linux.ApplyOptions(opts...)}
+}
+
+// Generate produces the complete module.
+func (g *Generator) Generate() string {
+	g.emitHeader()
+
+	g.line("define i32 @main() {")
+	g.line("entry:")
+	g.line("  %%dp = alloca ptr")
+	g.emitStartPointer()
+
+	for i, op := range g.ops {
+		g.emitOp(op)
+		if progress := g.opts.Progress; progress != nil && (i+1)%linux.ProgressEvery == 0 {
+			progress(i+1, len(g.ops))
+		}
+	}
+	if g.opts.Progress != nil {
+		g.opts.Progress(len(g.ops), len(g.ops))
+	}
+
+	g.line("  ret i32 0")
+	if g.opts.Cells.Overflow == core.OverflowTrap {
+		g.emitOverflowBlock()
+	}
+	g.line("}")
+
+	g.emitDeclarations()
+	return g.out.String()
+}
+
+// line appends a formatted line to the output.
+func (g *Generator) line(format string, args ...any) {
+	fmt.Fprintf(&g.out, format, args...)
+	g.out.WriteByte('\n')
+}
+
+// temp returns a new temporary value name.
+func (g *Generator) temp() string {
+	g.temps++
+	return fmt.Sprintf("%%t%d", g.temps)
+}
+
+// emitCont starts a new block after a terminator, so the code that follows
+// has somewhere to go even if nothing branches to it.
+func (g *Generator) emitCont() {
+	g.blocks++
+	g.line("cont_%d:", g.blocks)
+}
+
+// emitHeader outputs the tape and trap message globals.
+func (g *Generator) emitHeader() {
+	g.line("; Generated by bfcc. Compile with: clang -O2 prog.ll -o prog")
+	g.line("")
+	g.line("@tape = internal global [%d x i8] zeroinitializer", core.TapeSize)
+	if g.opts.Cells.Overflow == core.OverflowTrap {
+		msg := trapMsg + "\x00"
+		g.line("@trap_msg = private unnamed_addr constant [%d x i8] c\"%s\"", len(msg), escape(msg))
+	}
+	g.line("")
+}
+
+// emitDeclarations outputs the C library functions and intrinsics the
+// module calls.
+func (g *Generator) emitDeclarations() {
+	g.line("")
+	g.line("declare i32 @getchar()")
+	g.line("declare i32 @putchar(i32)")
+	g.line("declare i32 @dprintf(i32, ptr, ...)")
+	g.line("declare void @exit(i32) noreturn")
+	g.line("declare void @llvm.trap() noreturn")
+	g.line("declare void @llvm.memset.p0.i64(ptr, i8, i64, i1)")
+	g.line("declare void @llvm.memmove.p0.p0.i64(ptr, ptr, i64, i1)")
+}
+
+// emitStartPointer points %dp at the first cell: the start of the tape, or
+// its middle with WithMidTape.
+func (g *Generator) emitStartPointer() {
+	if g.opts.MidTape {
+		g.line("  store ptr getelementptr (i8, ptr @tape, i64 %d), ptr %%dp", core.TapeSize/2)
+		return
+	}
+	g.line("  store ptr @tape, ptr %%dp")
+}
+
+// emitCell loads %dp and returns the pointer to the current cell, offset by
+// off cells.
+func (g *Generator) emitCell(off int) string {
+	p := g.temp()
+	g.line("  %s = load ptr, ptr %%dp", p)
+	if off == 0 {
+		return p
+	}
+	q := g.temp()
+	g.line("  %s = getelementptr i8, ptr %s, i64 %d", q, p, off)
+	return q
+}
+
+// emitLoad loads the cell p points at.
+func (g *Generator) emitLoad(p string) string {
+	v := g.temp()
+	g.line("  %s = load i8, ptr %s", v, p)
+	return v
+}
+
+// emitOp outputs the instructions for a single IR operation.
+func (g *Generator) emitOp(op core.Op) {
+	switch op.Kind {
+	case core.OpShift:
+		if op.Arg != 0 {
+			q := g.emitCell(op.Arg)
+			g.line("  store ptr %s, ptr %%dp", q)
+		}
+	case core.OpAdd:
+		g.emitAdd(op.Arg)
+	case core.OpZero:
+		g.line("  store i8 0, ptr %s", g.emitCell(0))
+	case core.OpIn:
+		g.emitIn()
+	case core.OpOut:
+		v := g.emitLoad(g.emitCell(0))
+		c := g.temp()
+		g.line("  %s = zext i8 %s to i32", c, v)
+		g.line("  call i32 @putchar(i32 %s)", c)
+	case core.OpJz:
+		g.emitJz(op.Arg)
+	case core.OpJnz:
+		g.emitJnz(op.Arg)
+	case core.OpSection:
+		if core.Handoff(op.Arg) == core.HandoffReset {
+			g.line("  call void @llvm.memset.p0.i64(ptr @tape, i8 0, i64 %d, i1 false)", core.TapeSize)
+		}
+		g.emitStartPointer()
+	case core.OpTrap:
+		g.line("  call void @llvm.trap()")
+		g.line("  unreachable")
+		g.emitCont()
+	case core.OpZeroRange:
+		g.line("  call void @llvm.memset.p0.i64(ptr %s, i8 0, i64 %d, i1 false)", g.emitCell(0), op.Arg)
+	case core.OpCopyRange:
+		p := g.emitCell(0)
+		dst := g.temp()
+		g.line("  %s = getelementptr i8, ptr %s, i64 %d", dst, p, op.Off)
+		g.line("  call void @llvm.memmove.p0.p0.i64(ptr %s, ptr %s, i64 %d, i1 false)", dst, p, op.Arg)
+	}
+}
+
+// emitAdd outputs a load, add and store of the current cell. Under the
+// saturate and trap policies the sum is range checked before the store,
+// in 32 bits so it cannot itself overflow.
+func (g *Generator) emitAdd(k int) {
+	if k == 0 {
+		return
+	}
+	p := g.emitCell(0)
+
+	if g.opts.Cells.Overflow == core.OverflowWrap {
+		v := g.emitLoad(p)
+		s := g.temp()
+		g.line("  %s = add i8 %s, %d", s, v, int8(k))
+		g.line("  store i8 %s, ptr %s", s, p)
+		return
+	}
+
+	clamp := g.opts.Cells.Max()
+	if k < 0 {
+		clamp = g.opts.Cells.Min()
+	}
+
+	if g.opts.Cells.AlwaysOverflows(k) {
+		if g.opts.Cells.Overflow == core.OverflowTrap {
+			g.line("  br label %%overflow")
+			g.emitCont()
+			return
+		}
+		g.line("  store i8 %d, ptr %s", int8(clamp), p)
+		return
+	}
+
+	// The sum is in range when it is 0 to 255, or -128 to 127 for signed
+	// cells, checked as an unsigned compare after subtracting the minimum
+	ext := "zext"
+	if g.opts.Cells.Signed {
+		ext = "sext"
+	}
+	v := g.emitLoad(p)
+	wide, sum, off, bad, b := g.temp(), g.temp(), g.temp(), g.temp(), g.temp()
+	g.line("  %s = %s i8 %s to i32", wide, ext, v)
+	g.line("  %s = add i32 %s, %d", sum, wide, k)
+	g.line("  %s = sub i32 %s, %d", off, sum, g.opts.Cells.Min())
+	g.line("  %s = icmp ugt i32 %s, 255", bad, off)
+	if g.opts.Cells.Overflow == core.OverflowSaturate {
+		r := g.temp()
+		g.line("  %s = trunc i32 %s to i8", b, sum)
+		g.line("  %s = select i1 %s, i8 %d, i8 %s", r, bad, int8(clamp), b)
+		g.line("  store i8 %s, ptr %s", r, p)
+		return
+	}
+	g.line("  br i1 %s, label %%overflow, label %%cont_%d", bad, g.blocks+1)
+	g.emitCont()
+	g.line("  %s = trunc i32 %s to i8", b, sum)
+	g.line("  store i8 %s, ptr %s", b, p)
+}
+
+// emitOverflowBlock outputs the block every overflow under the trap policy
+// branches to, which reports it on stderr and exits with status 1.
+func (g *Generator) emitOverflowBlock() {
+	g.line("overflow:")
+	g.line("  call i32 (i32, ptr, ...) @dprintf(i32 2, ptr @trap_msg)")
+	g.line("  call void @exit(i32 1)")
+	g.line("  unreachable")
+}
+
+// emitIn outputs a getchar into the current cell, storing EOF when it
+// returns a negative value.
+func (g *Generator) emitIn() {
+	p := g.emitCell(0)
+	c, eof, b, r := g.temp(), g.temp(), g.temp(), g.temp()
+	g.line("  %s = call i32 @getchar()", c)
+	g.line("  %s = icmp slt i32 %s, 0", eof, c)
+	g.line("  %s = trunc i32 %s to i8", b, c)
+	g.line("  %s = select i1 %s, i8 %d, i8 %s", r, eof, int8(g.opts.Cells.EOF()), b)
+	g.line("  store i8 %s, ptr %s", r, p)
+}
+
+// emitJz opens a loop: falls into loop_L, which tests the cell and skips
+// to loop_L_end when it is zero.
+func (g *Generator) emitJz(label int) {
+	g.line("  br label %%loop_%d", label)
+	g.line("loop_%d:", label)
+	v := g.emitLoad(g.emitCell(0))
+	z := g.temp()
+	g.line("  %s = icmp eq i8 %s, 0", z, v)
+	g.line("  br i1 %s, label %%loop_%d_end, label %%loop_%d_body", z, label, label)
+	g.line("loop_%d_body:", label)
+}
+
+// emitJnz closes the loop opened by the matching emitJz, branching back to
+// its body while the cell is not zero.
+func (g *Generator) emitJnz(label int) {
+	v := g.emitLoad(g.emitCell(0))
+	nz := g.temp()
+	g.line("  %s = icmp ne i8 %s, 0", nz, v)
+	g.line("  br i1 %s, label %%loop_%d_body, label %%loop_%d_end", nz, label, label)
+	g.line("loop_%d_end:", label)
+}
+
+// escape returns s as the contents of an LLVM c"..." string, with
+// everything but printable ASCII other than " and \ as \XX hex escapes.
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 0x20 && c < 0x7f && c != '"' && c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "\\%02X", c)
+	}
+	return b.String()
+}
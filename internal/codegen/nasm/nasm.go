@@ -0,0 +1,571 @@
+// Package nasm provides NASM (Intel syntax) assembly output for x86_64
+// Linux, for nasm or yasm. The code is the same as the gas package's.
+package nasm
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// Linux syscall numbers
+const (
+	sysWrite = 1
+	sysMmap  = 9
+	sysExit  = 60
+)
+
+// Generator produces NASM assembly from IR operations.
+//
+// NASM has no numeric local labels, so the ones the gas package uses are
+// named, and the clamps after checked adds are numbered. Labels starting
+// with a dot belong to the last label without one: the loops and prologue
+// labels to _start, and the helpers' to the helper.
+type Generator struct {
+	ops       []core.Op
+	out       strings.Builder
+	cells     core.CellModel
+	midTape   bool   // start the data pointer in the middle of the tape
+	argvInput bool   // read input from argv[1] rather than stdin
+	tapeEnv   bool   // size the tape from BF_TAPE at startup, held in R15
+	info      string // printed when run with --bfcc-info, empty for no handler
+	debug     bool   // trap if control runs past the exit syscall
+	progress  func(done, total int)
+	clamps    int // .clamp_N labels used so far
+}
+
+// Option is a functional option for configuring a Generator.
+type Option func(*Generator)
+
+// WithCellOverflow sets the cell overflow policy (default core.OverflowWrap).
+func WithCellOverflow(overflow core.CellOverflow) Option {
+	return func(g *Generator) {
+		g.cells.Overflow = overflow
+	}
+}
+
+// WithSignedCells treats cells as signed bytes: overflow checks use the
+// overflow flag rather than carry, and IN stores -1 at end of input.
+func WithSignedCells() Option {
+	return func(g *Generator) {
+		g.cells.Signed = true
+	}
+}
+
+// WithMidTape starts the data pointer in the middle of the tape rather than
+// at cell 0, for programs written for doubly-infinite tapes.
+func WithMidTape() Option {
+	return func(g *Generator) {
+		g.midTape = true
+	}
+}
+
+// WithArgvInput makes IN read successive bytes of argv[1] instead of stdin,
+// with end of input at its terminating NUL (or straight away without an
+// argument). R14 holds the read position.
+func WithArgvInput() Option {
+	return func(g *Generator) {
+		g.argvInput = true
+	}
+}
+
+// WithTapeEnv makes the executable read a decimal tape size in bytes from
+// the BF_TAPE environment variable at startup and mmap a tape that size,
+// falling back to the core.TapeSize tape in .bss.
+func WithTapeEnv() Option {
+	return func(g *Generator) {
+		g.tapeEnv = true
+	}
+}
+
+// WithInfo embeds a --bfcc-info handler that prints info to stdout and exits
+// before the program runs.
+func WithInfo(info string) Option {
+	return func(g *Generator) {
+		g.info = info
+	}
+}
+
+// WithDebug pads the code after the exit syscall with int3, so a corrupted
+// jump that runs off the end of the program traps before reaching the
+// helpers. TRAP ops (see core.InsertTraps) always emit int3.
+func WithDebug() Option {
+	return func(g *Generator) {
+		g.debug = true
+	}
+}
+
+// WithProgress calls report with the number of ops emitted so far, every
+// ProgressEvery ops and once all of them are done.
+func WithProgress(report func(done, total int)) Option {
+	return func(g *Generator) {
+		g.progress = report
+	}
+}
+
+// ProgressEvery is how many ops are emitted between progress reports.
+const ProgressEvery = 1 << 14
+
+// NewGenerator creates a new NASM assembly generator.
+func NewGenerator(ops []core.Op, opts ...Option) *Generator {
+	g := &Generator{ops: ops}
+	for _, opt := range opts {
+		opt(g)
+	}
+	return g
+}
+
+// Generate produces the complete assembly output.
+func (g *Generator) Generate() string {
+	g.emitHeader()
+	g.emitPrologue()
+
+	for i, op := range g.ops {
+		g.emitOp(op)
+		if g.progress != nil && (i+1)%ProgressEvery == 0 {
+			g.progress(i+1, len(g.ops))
+		}
+	}
+	if g.progress != nil {
+		g.progress(len(g.ops), len(g.ops))
+	}
+	g.emitEpilogue()
+	g.emitHelpers()
+
+	return g.out.String()
+}
+
+// line appends a formatted line to the output.
+func (g *Generator) line(format string, args ...any) {
+	fmt.Fprintf(&g.out, format, args...)
+	g.out.WriteByte('\n')
+}
+
+// cell returns the memory operand for the cell off cells from the data
+// pointer.
+func cell(off int) string {
+	switch {
+	case off > 0:
+		return fmt.Sprintf("[r13+r12+%d]", off)
+	case off < 0:
+		return fmt.Sprintf("[r13+r12-%d]", -off)
+	}
+	return "[r13+r12]"
+}
+
+// emitHeader outputs the assembly file header with BSS and text sections.
+func (g *Generator) emitHeader() {
+	g.line("; Assemble with: nasm -f elf64 prog.asm && ld -o prog prog.o")
+	g.line("bits 64")
+	g.line("default rel")
+	g.line("")
+	g.line("section .bss")
+	g.line("tape: resb %d", core.TapeSize)
+	g.line("")
+	g.line("section .text")
+	g.line("global _start")
+}
+
+// emitPrologue outputs the program start: initialize R13 (tape base) and R12 (data pointer).
+func (g *Generator) emitPrologue() {
+	g.line("_start:")
+
+	// Load tape base address into R13
+	g.line("    mov r13, tape")
+
+	if g.info != "" {
+		g.emitInfoCheck()
+	}
+
+	if g.argvInput {
+		// R14 = argc >= 2 ? argv[1] : NULL
+		g.line("    xor r14, r14")
+		g.line("    cmp qword [rsp], 2")
+		g.line("    jb .argv_done")
+		g.line("    mov r14, [rsp+16]")
+		g.line(".argv_done:")
+	}
+
+	if g.tapeEnv {
+		g.emitTapeEnv()
+	}
+
+	g.emitStartPointer()
+}
+
+// emitInfoCheck outputs the WithInfo prologue: if argv[1] is --bfcc-info,
+// write the info message to stdout and exit 0.
+func (g *Generator) emitInfoCheck() {
+	g.line("    cmp qword [rsp], 2")
+	g.line("    jb .info_skip")
+	g.line("    mov rsi, [rsp+16]")
+	g.line("    mov rax, 0x692d636366622d2d") // "--bfcc-i"
+	g.line("    cmp [rsi], rax")
+	g.line("    jne .info_skip")
+	g.line("    cmp dword [rsi+8], 0x006f666e") // "nfo\0"
+	g.line("    jne .info_skip")
+	g.line("    lea rsi, [_bf_info_msg]")
+	g.line("    mov rax, %d", sysWrite)
+	g.line("    mov rdi, 1")
+	g.line("    mov rdx, %d", len(g.info))
+	g.line("    syscall")
+	g.line("    mov rax, %d", sysExit)
+	g.line("    xor rdi, rdi")
+	g.line("    syscall")
+	g.line(".info_skip:")
+}
+
+// emitInfoMsg outputs the --bfcc-info message as db directives, which
+// avoids escaping arbitrary file names for a string.
+func (g *Generator) emitInfoMsg() {
+	g.line("")
+	g.line("_bf_info_msg:")
+	for line := range slices.Chunk([]byte(g.info), 16) {
+		parts := make([]string, len(line))
+		for i, b := range line {
+			parts[i] = fmt.Sprintf("0x%02x", b)
+		}
+		g.line("    db %s", strings.Join(parts, ", "))
+	}
+}
+
+// emitTapeEnv outputs the WithTapeEnv prologue: find BF_TAPE= in envp,
+// parse the digits after it into RCX and mmap that many bytes, leaving the
+// tape base in R13 and its size in R15.
+func (g *Generator) emitTapeEnv() {
+	g.line("    mov r15, %d", core.TapeSize)
+	g.line("    mov rax, [rsp]")
+	g.line("    lea rbx, [rsp+rax*8+16]")
+	g.line(".env_next:")
+	g.line("    mov rsi, [rbx]")
+	g.line("    test rsi, rsi")
+	g.line("    jz .env_done")
+	g.line("    add rbx, 8")
+	g.line("    mov rax, 0x3d455041545f4642") // "BF_TAPE="
+	g.line("    cmp [rsi], rax")
+	g.line("    jne .env_next")
+	g.line("    add rsi, 8")
+	g.line("    xor rcx, rcx")
+	g.line(".env_digit:")
+	g.line("    movzx rax, byte [rsi]")
+	g.line("    sub rax, '0'")
+	g.line("    cmp rax, 9")
+	g.line("    ja .env_parsed")
+	g.line("    imul rcx, rcx, 10")
+	g.line("    add rcx, rax")
+	g.line("    inc rsi")
+	g.line("    jmp .env_digit")
+	g.line(".env_parsed:")
+	g.line("    test rcx, rcx")
+	g.line("    jz .env_done")
+	g.line("    mov rsi, rcx")
+	g.line("    xor rdi, rdi")
+	g.line("    mov rdx, 3")    // PROT_READ|PROT_WRITE
+	g.line("    mov r10, 0x22") // MAP_PRIVATE|MAP_ANONYMOUS
+	g.line("    mov r8, -1")
+	g.line("    xor r9, r9")
+	g.line("    mov rax, %d", sysMmap)
+	g.line("    syscall")
+	g.line("    cmp rax, -4096")
+	g.line("    ja .env_done")
+	g.line("    mov r13, rax")
+	g.line("    mov r15, rsi")
+	g.line(".env_done:")
+}
+
+// emitStartPointer points R12 at the first cell: 0, or the middle of the
+// tape with WithMidTape.
+func (g *Generator) emitStartPointer() {
+	if g.midTape && g.tapeEnv {
+		g.line("    mov r12, r15")
+		g.line("    shr r12, 1")
+		return
+	}
+	if g.midTape {
+		g.line("    mov r12, %d", core.TapeSize/2)
+		return
+	}
+
+	// Zero the data pointer (R12)
+	g.line("    xor r12, r12")
+}
+
+// emitEpilogue outputs the exit(0) syscall.
+func (g *Generator) emitEpilogue() {
+	g.line("    mov rax, %d", sysExit)
+	g.line("    xor rdi, rdi")
+	g.line("    syscall")
+
+	if g.debug {
+		g.line("    int3")
+	}
+}
+
+// emitHelpers outputs the I/O helper functions.
+func (g *Generator) emitHelpers() {
+	// Start the helpers on a fresh 16-byte line, padded with int3 in debug
+	// builds where the padding is never meant to run
+	if g.debug {
+		g.line("    align 16, db 0xcc")
+	} else {
+		g.line("    align 16")
+	}
+	g.line("")
+	g.line("_bf_read:")
+	if g.argvInput {
+		g.emitArgvRead()
+	} else {
+		g.emitStdinRead()
+	}
+
+	g.line("")
+	g.line("_bf_write:")
+	g.line("    lea rsi, %s", cell(0))
+	g.line("    mov rax, %d", sysWrite)
+	g.line("    mov rdi, 1")
+	g.line("    mov rdx, 1")
+	g.line("    syscall")
+	g.line("    ret")
+
+	if g.cells.Overflow == core.OverflowTrap {
+		g.emitTrapHelper()
+	}
+
+	if g.info != "" {
+		g.emitInfoMsg()
+	}
+}
+
+// emitStdinRead outputs the body of _bf_read that reads one byte from
+// stdin. At end of input the cell is set to 0, or -1 for signed cells, as
+// in the VM.
+func (g *Generator) emitStdinRead() {
+	g.line("    lea rsi, %s", cell(0))
+	g.line("    xor rax, rax")
+	g.line("    xor rdi, rdi")
+	g.line("    mov rdx, 1")
+	g.line("    syscall")
+	// Store EOF when read returns 0 (end of input)
+	g.line("    test rax, rax")
+	g.line("    jnz .done")
+	g.line("    mov byte %s, %d", cell(0), g.cells.EOF())
+	g.line(".done:")
+	g.line("    ret")
+}
+
+// emitArgvRead outputs the body of _bf_read that takes the next byte of
+// argv[1] from R14. At end of input the cell is set to 0, or -1 for
+// signed cells, as in the VM.
+func (g *Generator) emitArgvRead() {
+	g.line("    test r14, r14")
+	g.line("    jz .eof")
+	g.line("    mov al, [r14]")
+	g.line("    test al, al")
+	g.line("    jz .eof")
+	g.line("    mov %s, al", cell(0))
+	g.line("    inc r14")
+	g.line("    ret")
+	g.line(".eof:")
+	g.line("    mov byte %s, %d", cell(0), g.cells.EOF())
+	g.line("    ret")
+}
+
+// emitTrapHelper outputs _bf_trap, which reports a cell overflow on stderr
+// and exits with status 1.
+func (g *Generator) emitTrapHelper() {
+	g.line("")
+	g.line("_bf_trap:")
+	g.line("    lea rsi, [_bf_trap_msg]")
+	g.line("    mov rax, %d", sysWrite)
+	g.line("    mov rdi, 2")
+	g.line("    mov rdx, _bf_trap_len")
+	g.line("    syscall")
+	g.line("    mov rax, %d", sysExit)
+	g.line("    mov rdi, 1")
+	g.line("    syscall")
+	g.line("_bf_trap_msg:")
+	g.line("    db \"bfcc: cell overflow\", 10")
+	g.line("_bf_trap_len equ $ - _bf_trap_msg")
+}
+
+// emitOp outputs assembly for a single IR operation.
+func (g *Generator) emitOp(op core.Op) {
+	switch op.Kind {
+	case core.OpShift:
+		g.emitShift(op.Arg)
+	case core.OpAdd:
+		g.emitAdd(op.Arg)
+	case core.OpZero:
+		g.emitZero()
+	case core.OpIn:
+		g.emitIn()
+	case core.OpOut:
+		g.emitOut()
+	case core.OpJz:
+		g.emitJz(op.Arg)
+	case core.OpJnz:
+		g.emitJnz(op.Arg)
+	case core.OpSection:
+		g.emitSection(core.Handoff(op.Arg))
+	case core.OpTrap:
+		g.line("    int3")
+	case core.OpZeroRange:
+		g.emitZeroRange(op.Arg)
+	case core.OpCopyRange:
+		g.emitCopyRange(op.Arg, op.Off)
+	}
+}
+
+// emitZeroRange clears n cells from the data pointer with rep stosb.
+func (g *Generator) emitZeroRange(n int) {
+	g.line("    xor rax, rax")
+	g.line("    lea rdi, %s", cell(0))
+	g.line("    mov rcx, %d", n)
+	g.line("    rep stosb")
+}
+
+// emitCopyRange copies n cells from the data pointer to d cells along with
+// rep movsb. The optimiser only emits non-overlapping ranges, so copying
+// forwards is always safe.
+func (g *Generator) emitCopyRange(n, d int) {
+	g.line("    lea rsi, %s", cell(0))
+	g.line("    lea rdi, %s", cell(d))
+	g.line("    mov rcx, %d", n)
+	g.line("    rep movsb")
+}
+
+// emitSection starts the next chained program, zeroing the tape with
+// rep stosb first for core.HandoffReset.
+func (g *Generator) emitSection(h core.Handoff) {
+	if h == core.HandoffReset {
+		g.line("    xor rax, rax")
+		g.line("    mov rdi, r13")
+		if g.tapeEnv {
+			g.line("    mov rcx, r15")
+		} else {
+			g.line("    mov rcx, %d", core.TapeSize)
+		}
+		g.line("    rep stosb")
+	}
+	g.emitStartPointer()
+}
+
+// emitShift outputs: add r12, k (or sub for negative values)
+func (g *Generator) emitShift(k int) {
+	if k == 0 {
+		return
+	}
+	if k > 0 {
+		g.line("    add r12, %d", k)
+	} else {
+		g.line("    sub r12, %d", -k)
+	}
+}
+
+// emitAdd outputs: add byte [r13+r12], k (or sub for negative values)
+// Under the saturate and trap policies the carry flag (or overflow flag for
+// signed cells) is checked after each add.
+func (g *Generator) emitAdd(k int) {
+	if k == 0 {
+		return
+	}
+
+	if g.cells.Overflow == core.OverflowWrap {
+		g.emitAddSub(k)
+		return
+	}
+
+	if g.cells.AlwaysOverflows(k) {
+		g.emitOverflowed(k)
+		return
+	}
+
+	// The overflow flag is only meaningful for immediates in [-127, 127]
+	for g.cells.Signed && (k > 127 || k < -127) {
+		step := 127
+		if k < 0 {
+			step = -127
+		}
+		g.emitCheckedAdd(step)
+		k -= step
+	}
+	g.emitCheckedAdd(k)
+}
+
+// emitAddSub outputs a plain add or sub of the byte on the current cell.
+func (g *Generator) emitAddSub(k int) {
+	if k > 0 {
+		g.line("    add byte %s, %d", cell(0), k)
+	} else {
+		g.line("    sub byte %s, %d", cell(0), -k)
+	}
+}
+
+// emitCheckedAdd outputs an add followed by the saturate clamp or trap jump.
+func (g *Generator) emitCheckedAdd(k int) {
+	g.emitAddSub(k)
+
+	noOverflow, overflow := "jnc", "jc"
+	if g.cells.Signed {
+		noOverflow, overflow = "jno", "jo"
+	}
+
+	if g.cells.Overflow == core.OverflowTrap {
+		g.line("    %s _bf_trap", overflow)
+		return
+	}
+
+	clamp := g.cells.Max()
+	if k < 0 {
+		clamp = g.cells.Min()
+	}
+	g.clamps++
+	g.line("    %s .clamp_%d", noOverflow, g.clamps)
+	g.line("    mov byte %s, %d", cell(0), clamp)
+	g.line(".clamp_%d:", g.clamps)
+}
+
+// emitOverflowed outputs an ADD k that is known to overflow: the saturated
+// value for the saturate policy or an unconditional jump to _bf_trap.
+func (g *Generator) emitOverflowed(k int) {
+	if g.cells.Overflow == core.OverflowTrap {
+		g.line("    jmp _bf_trap")
+		return
+	}
+	if k > 0 {
+		g.line("    mov byte %s, %d", cell(0), g.cells.Max())
+	} else {
+		g.line("    mov byte %s, %d", cell(0), g.cells.Min())
+	}
+}
+
+// emitZero outputs: mov byte [r13+r12], 0
+func (g *Generator) emitZero() {
+	g.line("    mov byte %s, 0", cell(0))
+}
+
+// emitIn outputs a call to the read helper.
+func (g *Generator) emitIn() {
+	g.line("    call _bf_read")
+}
+
+// emitOut outputs a call to the write helper.
+func (g *Generator) emitOut() {
+	g.line("    call _bf_write")
+}
+
+// emitJz outputs: .loop_L: test byte [r13+r12], 0xff; jz .loop_L_end
+func (g *Generator) emitJz(label int) {
+	g.line(".loop_%d:", label)
+	g.line("    test byte %s, 0xff", cell(0))
+	g.line("    jz .loop_%d_end", label)
+}
+
+// emitJnz outputs: test byte [r13+r12], 0xff; jnz .loop_L; .loop_L_end:
+func (g *Generator) emitJnz(label int) {
+	g.line("    test byte %s, 0xff", cell(0))
+	g.line("    jnz .loop_%d", label)
+	g.line(".loop_%d_end:", label)
+}
@@ -0,0 +1,142 @@
+package wasm
+
+import (
+	"encoding/binary"
+
+	"github.com/lcox74/bfcc/internal/core"
+	wasmbin "github.com/lcox74/bfcc/pkg/wasm"
+)
+
+// WASI names: the module the system calls are imported from, and the
+// entry point a WASI runtime calls.
+const (
+	WASIModule = "wasi_snapshot_preview1"
+	StartFunc  = "_start"
+)
+
+// trapMsg is written to stderr by the trap function before exiting.
+const trapMsg = "bfcc: cell overflow\n"
+
+// Memory after the tape in a WASI module: two iovecs, one for the I/O
+// byte and one for trapMsg, the count fd_read and fd_write return, then
+// the byte and the message.
+const (
+	wasiScratch = (core.TapeSize + 15) &^ 15
+	wasiByteIov = wasiScratch
+	wasiMsgIov  = wasiScratch + 8
+	wasiCount   = wasiScratch + 16
+	wasiByte    = wasiScratch + 32
+	wasiMsg     = wasiScratch + 40
+)
+
+// GenerateWASI produces a complete binary module for WASI preview 1
+// runtimes such as wasmtime and wasmer. Rather than importing read and
+// write from the host, it defines them over fd_read and fd_write on stdin
+// and stdout, and exports run as _start. A cell overflow under the trap
+// policy prints the native executables' message on stderr and exits with
+// status 1.
+func (g *Generator) GenerateWASI() []byte {
+	i32 := []wasmbin.ValType{wasmbin.I32}
+	fdType := wasmbin.FuncType{Params: []wasmbin.ValType{wasmbin.I32, wasmbin.I32, wasmbin.I32, wasmbin.I32}, Results: i32}
+
+	m := wasmbin.NewModule()
+	fdRead := m.ImportFunc(WASIModule, "fd_read", fdType)
+	fdWrite := m.ImportFunc(WASIModule, "fd_write", fdType)
+	procExit := m.ImportFunc(WASIModule, "proc_exit", wasmbin.FuncType{Params: i32})
+
+	g.fnRead = m.AddFunc(wasmbin.FuncType{Results: i32}, nil, wasiRead(fdRead))
+	g.fnWrite = m.AddFunc(wasmbin.FuncType{Params: i32}, nil, wasiWrite(fdWrite))
+	if g.opts.Cells.Overflow == core.OverflowTrap {
+		g.fnTrap = m.AddFunc(wasmbin.FuncType{}, nil, wasiTrap(fdWrite, procExit))
+		g.hasTrap = true
+	}
+	start := m.AddFunc(wasmbin.FuncType{}, []wasmbin.ValType{wasmbin.I32, wasmbin.I32}, g.Generate())
+
+	end := uint32(wasiMsg + len(trapMsg))
+	pages := (end + wasmbin.PageSize - 1) / wasmbin.PageSize
+	m.SetMemory(pages, pages)
+	m.ExportFunc(StartFunc, start)
+	m.ExportMemory(MemoryExport)
+
+	iovs := binary.LittleEndian.AppendUint32(nil, wasiByte)
+	iovs = binary.LittleEndian.AppendUint32(iovs, 1)
+	iovs = binary.LittleEndian.AppendUint32(iovs, wasiMsg)
+	iovs = binary.LittleEndian.AppendUint32(iovs, uint32(len(trapMsg)))
+	m.AddData(wasiScratch, iovs)
+	m.AddData(wasiMsg, []byte(trapMsg))
+
+	return m.Build()
+}
+
+// wasiCall returns a call to an fd_read or fd_write import on fd, with
+// iov, leaving the errno on the stack.
+func wasiCall(fn uint32, fd, iov int32) []byte {
+	var b []byte
+	for _, insn := range [][]byte{
+		wasmbin.I32Const(fd),
+		wasmbin.I32Const(iov),
+		wasmbin.I32Const(1), // one iovec
+		wasmbin.I32Const(wasiCount),
+		wasmbin.Call(fn),
+	} {
+		b = append(b, insn...)
+	}
+	return b
+}
+
+// wasiRead returns the body of read: fd_read a byte from stdin, returning
+// it, or -1 at end of input or on an error.
+func wasiRead(fdRead uint32) []byte {
+	var b []byte
+	for _, insn := range [][]byte{
+		wasiCall(fdRead, 0, wasiByteIov),
+		wasmbin.If(wasmbin.BlockType(wasmbin.I32)), // errno
+		wasmbin.I32Const(-1),
+		wasmbin.Else(),
+		wasmbin.I32Const(wasiCount),
+		wasmbin.I32Load(0),
+		wasmbin.I32Eqz(),
+		wasmbin.If(wasmbin.BlockType(wasmbin.I32)), // nothing read
+		wasmbin.I32Const(-1),
+		wasmbin.Else(),
+		wasmbin.I32Const(wasiByte),
+		wasmbin.I32Load8U(0),
+		wasmbin.End(),
+		wasmbin.End(),
+	} {
+		b = append(b, insn...)
+	}
+	return b
+}
+
+// wasiWrite returns the body of write: fd_write its argument's low byte
+// to stdout.
+func wasiWrite(fdWrite uint32) []byte {
+	var b []byte
+	for _, insn := range [][]byte{
+		wasmbin.I32Const(wasiByte),
+		wasmbin.LocalGet(0),
+		wasmbin.I32Store8(0),
+		wasiCall(fdWrite, 1, wasiByteIov),
+		wasmbin.Drop(),
+	} {
+		b = append(b, insn...)
+	}
+	return b
+}
+
+// wasiTrap returns the body of the trap function: fd_write trapMsg to
+// stderr and exit with status 1.
+func wasiTrap(fdWrite, procExit uint32) []byte {
+	var b []byte
+	for _, insn := range [][]byte{
+		wasiCall(fdWrite, 2, wasiMsgIov),
+		wasmbin.Drop(),
+		wasmbin.I32Const(1),
+		wasmbin.Call(procExit),
+		wasmbin.Unreachable(),
+	} {
+		b = append(b, insn...)
+	}
+	return b
+}
@@ -0,0 +1,297 @@
+// Package wasm produces WebAssembly modules from IR operations, for
+// running compiled programs in a browser or any other WebAssembly host.
+//
+// The module's linear memory is the tape, exported as "memory", and its
+// exported "run" function runs the program. The host provides the I/O as
+// two imported functions:
+//
+//	bf.read  () -> i32   the next input byte, or -1 at end of input
+//	bf.write (i32)       output the low byte of its argument
+//
+// GenerateWASI instead produces a module for WASI runtimes, in wasi.go.
+package wasm
+
+import (
+	"github.com/lcox74/bfcc/internal/codegen/linux"
+	"github.com/lcox74/bfcc/internal/core"
+	wasmbin "github.com/lcox74/bfcc/pkg/wasm"
+)
+
+// Names the module imports and exports.
+const (
+	ImportModule = "bf"
+	ReadFunc     = "read"
+	WriteFunc    = "write"
+	RunFunc      = "run"
+	MemoryExport = "memory"
+)
+
+// Function indices of the imports in a GenerateModule module.
+const (
+	importRead uint32 = iota
+	importWrite
+)
+
+// Locals of run.
+const (
+	localPtr  uint32 = iota // address of the current cell
+	localTemp               // a cell value being range checked, or an input byte
+)
+
+// Costs is the size in bytes of the code for each op, for the optimiser,
+// with the wrapping cell model. SHIFTs past 63 cells take a longer
+// i32.const.
+var Costs = core.CostModel{Name: "wasm", Shift: 7, FarShift: 8, NearShift: 63, Add: 13, Zero: 7, IO: 12, Jump: 12, Range: 11}
+
+// Generator produces a WebAssembly module from IR operations. It takes the
+// linux package's Options, but only supports the cell model, mid-tape and
+// progress ones; debug builds need nothing more, as running off the end
+// of run returns, and a TRAP is unreachable.
+//
+// The tape starts at address 0 of the memory, which holds no more pages
+// than the tape needs, so a data pointer that leaves the memory traps. A
+// cell overflow under the trap policy traps with unreachable, except in
+// a WASI module.
+type Generator struct {
+	ops  []core.Op
+	code []byte
+	opts linux.Settings
+
+	fnRead, fnWrite uint32 // the read and write functions run calls
+	fnTrap          uint32 // the function reporting a cell overflow
+	hasTrap         bool   // false to trap with unreachable instead
+}
+
+// NewGenerator creates a new WebAssembly generator.
+func NewGenerator(ops []core.Op, opts ...linux.Option) *Generator {
+	return &Generator{
+		ops:     ops,
+		code:    make([]byte, 0, 4096),
+		opts:    linux.ApplyOptions(opts...),
+		fnRead:  importRead,
+		fnWrite: importWrite,
+	}
+}
+
+// Generate produces the body of run.
+func (g *Generator) Generate() []byte {
+	g.emitStartPointer()
+
+	for i, op := range g.ops {
+		g.emitOp(op)
+		if progress := g.opts.Progress; progress != nil && (i+1)%linux.ProgressEvery == 0 {
+			progress(i+1, len(g.ops))
+		}
+	}
+	if g.opts.Progress != nil {
+		g.opts.Progress(len(g.ops), len(g.ops))
+	}
+
+	return g.code
+}
+
+// GenerateModule produces a complete binary module.
+func (g *Generator) GenerateModule() []byte {
+	body := g.Generate()
+
+	pages := uint32((core.TapeSize + wasmbin.PageSize - 1) / wasmbin.PageSize)
+
+	m := wasmbin.NewModule()
+	m.ImportFunc(ImportModule, ReadFunc, wasmbin.FuncType{Results: []wasmbin.ValType{wasmbin.I32}})
+	m.ImportFunc(ImportModule, WriteFunc, wasmbin.FuncType{Params: []wasmbin.ValType{wasmbin.I32}})
+	run := m.AddFunc(wasmbin.FuncType{}, []wasmbin.ValType{wasmbin.I32, wasmbin.I32}, body)
+	m.SetMemory(pages, pages)
+	m.ExportFunc(RunFunc, run)
+	m.ExportMemory(MemoryExport)
+
+	return m.Build()
+}
+
+// emit appends instructions to the code buffer.
+func (g *Generator) emit(insns ...[]byte) {
+	for _, b := range insns {
+		g.code = append(g.code, b...)
+	}
+}
+
+// emitStartPointer points the data pointer at the first cell: 0, or the
+// middle of the tape with WithMidTape.
+func (g *Generator) emitStartPointer() {
+	start := int32(0)
+	if g.opts.MidTape {
+		start = core.TapeSize / 2
+	}
+	g.emit(wasmbin.I32Const(start), wasmbin.LocalSet(localPtr))
+}
+
+// emitLoadCell pushes the current cell, sign-extended for signed cells.
+func (g *Generator) emitLoadCell() {
+	g.emit(wasmbin.LocalGet(localPtr))
+	if g.opts.Cells.Signed {
+		g.emit(wasmbin.I32Load8S(0))
+		return
+	}
+	g.emit(wasmbin.I32Load8U(0))
+}
+
+// emitOp outputs the instructions for a single IR operation.
+func (g *Generator) emitOp(op core.Op) {
+	switch op.Kind {
+	case core.OpShift:
+		g.emitShift(op.Arg)
+	case core.OpAdd:
+		g.emitAdd(op.Arg)
+	case core.OpZero:
+		g.emit(wasmbin.LocalGet(localPtr), wasmbin.I32Const(0), wasmbin.I32Store8(0))
+	case core.OpIn:
+		g.emitIn()
+	case core.OpOut:
+		g.emit(wasmbin.LocalGet(localPtr), wasmbin.I32Load8U(0), wasmbin.Call(g.fnWrite))
+	case core.OpJz:
+		g.emitJz()
+	case core.OpJnz:
+		g.emitJnz()
+	case core.OpSection:
+		g.emitSection(core.Handoff(op.Arg))
+	case core.OpTrap:
+		g.emit(wasmbin.Unreachable())
+	case core.OpZeroRange:
+		g.emit(
+			wasmbin.LocalGet(localPtr),
+			wasmbin.I32Const(0),
+			wasmbin.I32Const(int32(op.Arg)),
+			wasmbin.MemoryFill(),
+		)
+	case core.OpCopyRange:
+		g.emit(
+			wasmbin.LocalGet(localPtr), // destination
+			wasmbin.I32Const(int32(op.Off)),
+			wasmbin.I32Add(),
+			wasmbin.LocalGet(localPtr), // source
+			wasmbin.I32Const(int32(op.Arg)),
+			wasmbin.MemoryCopy(),
+		)
+	}
+}
+
+// emitShift outputs: ptr = ptr + k
+func (g *Generator) emitShift(k int) {
+	if k == 0 {
+		return
+	}
+	g.emit(
+		wasmbin.LocalGet(localPtr),
+		wasmbin.I32Const(int32(k)),
+		wasmbin.I32Add(),
+		wasmbin.LocalSet(localPtr),
+	)
+}
+
+// emitAdd outputs a load, add and store of the current cell. Under the
+// saturate and trap policies the sum is range checked before the store,
+// in 32 bits so it cannot itself overflow.
+func (g *Generator) emitAdd(k int) {
+	if k == 0 {
+		return
+	}
+
+	if g.opts.Cells.Overflow == core.OverflowWrap {
+		g.emit(wasmbin.LocalGet(localPtr), wasmbin.LocalGet(localPtr), wasmbin.I32Load8U(0),
+			wasmbin.I32Const(int32(k)), wasmbin.I32Add(), wasmbin.I32Store8(0))
+		return
+	}
+
+	clamp := g.opts.Cells.Max()
+	if k < 0 {
+		clamp = g.opts.Cells.Min()
+	}
+
+	if g.opts.Cells.AlwaysOverflows(k) {
+		if g.opts.Cells.Overflow == core.OverflowTrap {
+			g.emitOverflow()
+			return
+		}
+		g.emit(wasmbin.LocalGet(localPtr), wasmbin.I32Const(int32(clamp)), wasmbin.I32Store8(0))
+		return
+	}
+
+	// The sum is in range when it is 0 to 255, or -128 to 127 for signed
+	// cells, checked as an unsigned compare after subtracting the minimum
+	g.emitLoadCell()
+	g.emit(
+		wasmbin.I32Const(int32(k)),
+		wasmbin.I32Add(),
+		wasmbin.LocalTee(localTemp),
+		wasmbin.I32Const(int32(g.opts.Cells.Min())),
+		wasmbin.I32Sub(),
+		wasmbin.I32Const(255),
+		wasmbin.I32GtU(),
+		wasmbin.If(wasmbin.Void),
+	)
+	if g.opts.Cells.Overflow == core.OverflowSaturate {
+		g.emit(wasmbin.I32Const(int32(clamp)), wasmbin.LocalSet(localTemp))
+	} else {
+		g.emitOverflow()
+	}
+	g.emit(
+		wasmbin.End(),
+		wasmbin.LocalGet(localPtr),
+		wasmbin.LocalGet(localTemp),
+		wasmbin.I32Store8(0),
+	)
+}
+
+// emitOverflow outputs the trap for a cell overflow under the trap
+// policy.
+func (g *Generator) emitOverflow() {
+	if g.hasTrap {
+		g.emit(wasmbin.Call(g.fnTrap))
+		return
+	}
+	g.emit(wasmbin.Unreachable())
+}
+
+// emitIn outputs a call to read, storing its byte in the current cell, or
+// EOF when it returns -1.
+func (g *Generator) emitIn() {
+	g.emit(
+		wasmbin.LocalGet(localPtr),
+		wasmbin.Call(g.fnRead),
+		wasmbin.LocalTee(localTemp),
+		wasmbin.I32Const(int32(g.opts.Cells.EOF())),
+		wasmbin.LocalGet(localTemp),
+		wasmbin.I32Const(0),
+		wasmbin.I32GeS(),
+		wasmbin.Select(), // the byte read, or EOF
+		wasmbin.I32Store8(0),
+	)
+}
+
+// emitJz opens a loop: a block that the JZ test branches to the end of,
+// around a loop that the JNZ test branches back to the start of. The
+// loop nests like the brackets, so no labels are needed.
+func (g *Generator) emitJz() {
+	g.emit(wasmbin.Block(wasmbin.Void))
+	g.emit(wasmbin.LocalGet(localPtr), wasmbin.I32Load8U(0), wasmbin.I32Eqz(), wasmbin.BrIf(0))
+	g.emit(wasmbin.Loop(wasmbin.Void))
+}
+
+// emitJnz closes the loop opened by the matching emitJz.
+func (g *Generator) emitJnz() {
+	g.emit(wasmbin.LocalGet(localPtr), wasmbin.I32Load8U(0), wasmbin.BrIf(0))
+	g.emit(wasmbin.End(), wasmbin.End())
+}
+
+// emitSection starts the next chained program, zeroing the tape first for
+// core.HandoffReset.
+func (g *Generator) emitSection(h core.Handoff) {
+	if h == core.HandoffReset {
+		g.emit(
+			wasmbin.I32Const(0),
+			wasmbin.I32Const(0),
+			wasmbin.I32Const(core.TapeSize),
+			wasmbin.MemoryFill(),
+		)
+	}
+	g.emitStartPointer()
+}
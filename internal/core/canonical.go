@@ -0,0 +1,164 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+)
+
+// Canonicalise returns ops in a normal form for wrapping unsigned cells. It
+// is CanonicaliseForCells with the zero CellModel.
+func Canonicalise(ops []Op) ([]Op, error) {
+	return CanonicaliseForCells(ops, CellModel{})
+}
+
+// CanonicaliseForCells returns ops in a normal form, which programs that
+// differ only in how they spell the same thing share:
+//
+//   - positions, NoOpt marks and NOPs are dropped, and loops are labelled
+//     from 0 in the order they open
+//   - in each straight-line run of SHIFT, ADD and ZERO, the updates to each
+//     cell are brought together and the cells visited lowest offset first,
+//     as the schedule pass does, before a SHIFT to where the run ends
+//   - each cell's updates are reduced to the fewest that are sound under
+//     cells: with wrapping cells at most a ZERO and then an ADD between
+//     -128 and 127, with other cells merging only ADDs of one sign, and
+//     ADDs before a ZERO only when saturating
+//
+// Two programs with the same normal form do the same thing, except where
+// they fail: updates to different cells commute, but which of them
+// overflows first does not, and a run that stepped off the tape between
+// updates may no longer (<> has the empty program's form). It does not
+// optimise: a loop stays a loop, so [-] and ZERO are not the same form.
+func CanonicaliseForCells(ops []Op, cells CellModel) ([]Op, error) {
+	targets, err := ResolveJumps(ops)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IR: %w", err)
+	}
+
+	out := make([]Op, 0, len(ops))
+	labels := make(map[int]int) // JZ index -> its new label
+	for i := 0; i < len(ops); {
+		if isCellUpdate(ops[i].Kind) {
+			end := i
+			for end < len(ops) && isCellUpdate(ops[end].Kind) {
+				end++
+			}
+			out = append(out, canonicalRun(ops[i:end], cells)...)
+			i = end
+			continue
+		}
+
+		op := Op{Kind: ops[i].Kind, Arg: ops[i].Arg, Off: ops[i].Off}
+		switch op.Kind {
+		case OpJz:
+			op.Arg = len(labels)
+			labels[i] = op.Arg
+		case OpJnz:
+			op.Arg = labels[targets[i]]
+		}
+		out = append(out, op)
+		i++
+	}
+	return out, nil
+}
+
+// canonicalRun returns the normal form of a straight-line run of SHIFT,
+// ADD, ZERO and NOP.
+func canonicalRun(run []Op, cells CellModel) []Op {
+	updates := make(map[int][]Op) // offset -> the updates to that cell, in order
+	offset := 0
+	for _, op := range run {
+		switch op.Kind {
+		case OpShift:
+			offset += op.Arg
+		case OpAdd, OpZero:
+			updates[offset] = append(updates[offset], Op{Kind: op.Kind, Arg: op.Arg})
+		}
+	}
+
+	var offsets []int
+	for at, list := range updates {
+		if list = reduceUpdates(list, cells); len(list) > 0 {
+			updates[at] = list
+			offsets = append(offsets, at)
+		}
+	}
+	slices.Sort(offsets)
+	return visit(offsets, updates, offset)
+}
+
+// reduceUpdates returns the fewest ADDs and ZEROs to one cell that do what
+// list does under cells.
+func reduceUpdates(list []Op, cells CellModel) []Op {
+	if cells.Overflow == OverflowWrap {
+		zero, sum := false, 0
+		for _, op := range list {
+			if op.Kind == OpZero {
+				zero, sum = true, 0
+			} else {
+				sum += op.Arg
+			}
+		}
+
+		var out []Op
+		if zero {
+			out = append(out, Zero())
+		}
+		if k := int(int8(byte(sum))); k != 0 {
+			out = append(out, Add(k))
+		}
+		return out
+	}
+
+	// Saturating, nothing before the last ZERO is seen; trapping, an ADD
+	// before it can still fail
+	if cells.Overflow == OverflowSaturate {
+		for i := len(list) - 1; i > 0; i-- {
+			if list[i].Kind == OpZero {
+				list = list[i:]
+				break
+			}
+		}
+	}
+
+	var out []Op
+	for _, op := range list {
+		last := len(out) - 1
+		switch {
+		case op.Kind == OpAdd && op.Arg == 0:
+		case op.Kind == OpZero && last >= 0 && out[last].Kind == OpZero:
+		case op.Kind == OpAdd && last >= 0 && out[last].Kind == OpAdd && (out[last].Arg > 0) == (op.Arg > 0):
+			out[last].Arg += op.Arg
+		default:
+			out = append(out, op)
+		}
+	}
+	return out
+}
+
+// Fingerprint is a hash of a normal form, the same on every run and
+// machine, for keying programs by what they do.
+type Fingerprint [sha256.Size]byte
+
+// String returns the fingerprint in hex.
+func (f Fingerprint) String() string {
+	return hex.EncodeToString(f[:])
+}
+
+// FingerprintOf returns the fingerprint of the normal form of ops under
+// cells: the SHA-256 of its ops, a line of Op.String each.
+func FingerprintOf(ops []Op, cells CellModel) (Fingerprint, error) {
+	canon, err := CanonicaliseForCells(ops, cells)
+	if err != nil {
+		return Fingerprint{}, err
+	}
+	h := sha256.New()
+	for _, op := range canon {
+		fmt.Fprintf(h, "%s\n", op)
+	}
+	var f Fingerprint
+	h.Sum(f[:0])
+	return f, nil
+}
@@ -0,0 +1,101 @@
+package core
+
+import "fmt"
+
+// CellOverflow selects what happens when an ADD moves a cell past the
+// bounds of an 8-bit cell.
+type CellOverflow int
+
+const (
+	OverflowWrap     CellOverflow = iota // wrap mod 256 (default)
+	OverflowSaturate                     // clamp to the cell bounds
+	OverflowTrap                         // stop execution with an error
+)
+
+// overflowNames maps each CellOverflow to its flag spelling.
+var overflowNames = [...]string{
+	OverflowWrap:     "wrap",
+	OverflowSaturate: "saturate",
+	OverflowTrap:     "trap",
+}
+
+// String returns the flag spelling of the CellOverflow.
+func (o CellOverflow) String() string {
+	return overflowNames[o]
+}
+
+// ParseCellOverflow converts a flag value (wrap, saturate, trap) into a
+// CellOverflow.
+func ParseCellOverflow(s string) (CellOverflow, error) {
+	for o, name := range overflowNames {
+		if name == s {
+			return CellOverflow(o), nil
+		}
+	}
+	return OverflowWrap, fmt.Errorf("invalid cell overflow policy: %q (must be wrap, saturate, or trap)", s)
+}
+
+// CellModel describes the semantics of a tape cell: how ADD behaves at the
+// cell bounds and whether cells hold signed or unsigned bytes. The zero value
+// is the traditional unsigned, wrapping cell.
+//
+// Signedness is observable through the overflow bounds (-128 to 127 rather
+// than 0 to 255) and through IN at end of input, which stores -1 for signed
+// cells and 0 for unsigned cells.
+type CellModel struct {
+	Overflow CellOverflow
+	Signed   bool
+}
+
+// Min returns the smallest value a cell can hold.
+func (c CellModel) Min() int {
+	if c.Signed {
+		return -128
+	}
+	return 0
+}
+
+// Max returns the largest value a cell can hold.
+func (c CellModel) Max() int {
+	if c.Signed {
+		return 127
+	}
+	return 255
+}
+
+// AlwaysOverflows reports whether an ADD of k overflows whatever the cell
+// holds, under a policy other than wrapping. A cell spans 256 values, so
+// one more than 255 either way always takes it past a bound: a backend
+// need not do the add, only trap or store the bound it saturates at.
+func (c CellModel) AlwaysOverflows(k int) bool {
+	return c.Overflow != OverflowWrap && (k > 255 || k < -255)
+}
+
+// Value interprets a raw tape byte according to the cell signedness.
+func (c CellModel) Value(b byte) int {
+	if c.Signed {
+		return int(int8(b))
+	}
+	return int(b)
+}
+
+// EOF returns the raw byte stored by IN when input is exhausted.
+func (c CellModel) EOF() byte {
+	if c.Signed {
+		return 0xFF // -1
+	}
+	return 0
+}
+
+// Normalise reduces a wrapping ADD amount to the range a dump reads most
+// naturally in: [-255, 255] for unsigned cells and [-128, 127] for signed.
+func (c CellModel) Normalise(k int) int {
+	if !c.Signed {
+		return k % 256
+	}
+	k = ((k % 256) + 256) % 256
+	if k > 127 {
+		k -= 256
+	}
+	return k
+}
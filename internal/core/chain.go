@@ -0,0 +1,110 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// ChainSeparator is the line that separates programs in a chain, eg. a
+// generator followed by the consumer of its output:
+//
+//	++++++++[>++++++++<-]>+.
+//	%%
+//	,[.,]
+const ChainSeparator = "%%"
+
+// Handoff selects what the next program in a chain starts with.
+type Handoff int
+
+const (
+	HandoffContinue Handoff = iota // same tape, pointer left where it was
+	HandoffShare                   // same tape, pointer back at the start cell
+	HandoffReset                   // zeroed tape, pointer back at the start cell
+)
+
+// handoffNames maps each Handoff to its flag spelling.
+var handoffNames = [...]string{
+	HandoffContinue: "continue",
+	HandoffShare:    "share",
+	HandoffReset:    "reset",
+}
+
+// String returns the flag spelling of the Handoff.
+func (h Handoff) String() string {
+	return handoffNames[h]
+}
+
+// ParseHandoff converts a flag value (continue, share, reset) into a Handoff.
+func ParseHandoff(s string) (Handoff, error) {
+	for h, name := range handoffNames {
+		if name == s {
+			return Handoff(h), nil
+		}
+	}
+	return HandoffContinue, fmt.Errorf("invalid chain handoff: %q (must be continue, share, or reset)", s)
+}
+
+// LowerChain lowers a source file holding several programs separated by
+// ChainSeparator lines into one IR stream that runs them in order, with a
+// SECTION op between programs unless h is HandoffContinue. Brackets must
+// balance within each program. Positions refer to the whole file.
+func LowerChain(src []byte, h Handoff) ([]Op, error) {
+	return LowerChainAt(src, h, O0)
+}
+
+// LowerChainAt is LowerChain for optimising at level, lowering each
+// program with LowerAt.
+func LowerChainAt(src []byte, h Handoff, level OptLevel) ([]Op, error) {
+	toks := Tokenize(src)
+	var ops []Op
+
+	for _, part := range splitChain(src, toks) {
+		lowered, err := LowerAt(part, level)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(ops) > 0 && h != HandoffContinue {
+			ops = append(ops, Section(h))
+		}
+		// Every part labels its loops from 0, so move them past the
+		// labels already used
+		ops = append(ops, relabel(lowered, NextLabel(ops))...)
+	}
+
+	return ops, nil
+}
+
+// splitChain splits toks at each separator line, ending every part with an
+// EOF token so that it can be lowered on its own.
+func splitChain(src []byte, toks []Token) [][]Token {
+	var parts [][]Token
+	start := 0
+	t := 0
+
+	for offset := 0; offset <= len(src); {
+		end := bytes.IndexByte(src[offset:], '\n')
+		if end < 0 {
+			end = len(src) - offset
+		}
+		line := bytes.TrimSpace(src[offset : offset+end])
+
+		if string(line) == ChainSeparator {
+			for t < len(toks) && toks[t].Kind != TokEOF && toks[t].Pos.Offset < offset {
+				t++
+			}
+			parts = append(parts, eofTerminated(toks[start:t], Position{Offset: offset}))
+			start = t
+		}
+		offset += end + 1
+	}
+
+	return append(parts, toks[start:])
+}
+
+// eofTerminated returns a copy of toks followed by an EOF token at pos.
+func eofTerminated(toks []Token, pos Position) []Token {
+	part := make([]Token, len(toks), len(toks)+1)
+	copy(part, toks)
+	return append(part, Token{Kind: TokEOF, Pos: pos})
+}
@@ -0,0 +1,112 @@
+package core
+
+// CellConst is the statically known value of the current cell.
+type CellConst struct {
+	Value int // as interpreted by the cell model
+	Known bool
+}
+
+// constState tracks known cell values relative to the starting cell.
+type constState struct {
+	cells   CellModel
+	pos     int
+	values  map[int]byte // cells set to a known value, any other cell is 0
+	unknown map[int]bool // cells whose value is not known
+}
+
+func (s *constState) get(p int) (byte, bool) {
+	if s.unknown[p] {
+		return 0, false
+	}
+	return s.values[p], true
+}
+
+func (s *constState) set(p int, v byte, known bool) {
+	if known {
+		s.values[p] = v
+		delete(s.unknown, p)
+	} else {
+		s.unknown[p] = true
+	}
+}
+
+// add applies ADD k to the cell at p under the cell model. An ADD that
+// would trap leaves the cell unknown.
+func (s *constState) add(p, k int) {
+	raw, ok := s.get(p)
+	if !ok {
+		return
+	}
+	sum := s.cells.Value(raw) + k
+	if s.cells.Overflow != OverflowWrap && (sum < s.cells.Min() || sum > s.cells.Max()) {
+		if s.cells.Overflow == OverflowTrap {
+			s.set(p, 0, false)
+			return
+		}
+		sum = max(min(sum, s.cells.Max()), s.cells.Min())
+	}
+	s.set(p, byte(sum), true)
+}
+
+// KnownCells is a constant propagation over straight-line code from the
+// start of the program, where every cell is zero but those loaded from
+// tape, the initial tape from the start cell on. For each op it returns
+// the value of the current cell once the op has run (for JZ and JNZ, the
+// value they test), where that is statically known.
+//
+// IN only loses the cell it reads. A loop entered on a known zero cell is
+// skipped with everything still known, while any other loop ends the
+// analysis: after it neither the pointer nor the cells are known.
+func KnownCells(ops []Op, cells CellModel, tape []byte) []CellConst {
+	result := make([]CellConst, len(ops))
+	s := &constState{cells: cells, values: map[int]byte{}, unknown: map[int]bool{}}
+	for p, v := range tape {
+		s.values[p] = v
+	}
+	ends := loopEnds(ops)
+
+	for i := 0; i < len(ops); i++ {
+		op := ops[i]
+		switch op.Kind {
+		case OpShift:
+			s.pos += op.Arg
+		case OpAdd:
+			s.add(s.pos, op.Arg)
+		case OpZero:
+			s.set(s.pos, 0, true)
+		case OpIn:
+			s.set(s.pos, 0, false)
+		case OpZeroRange:
+			for k := range op.Arg {
+				s.set(s.pos+k, 0, true)
+			}
+		case OpCopyRange:
+			for k := range op.Arg {
+				v, ok := s.get(s.pos + k)
+				s.set(s.pos+op.Off+k, v, ok)
+			}
+		case OpSection:
+			s.pos = 0
+			if Handoff(op.Arg) == HandoffReset {
+				clear(s.values)
+				clear(s.unknown)
+			}
+		case OpJz:
+			v, ok := s.get(s.pos)
+			result[i] = CellConst{Value: cells.Value(v), Known: ok}
+			if !ok || v != 0 || ends[i] < 0 {
+				return result
+			}
+			// Never entered, so nothing changes
+			i = ends[i]
+			continue
+		case OpJnz, OpTrap:
+			return result
+		}
+
+		v, ok := s.get(s.pos)
+		result[i] = CellConst{Value: cells.Value(v), Known: ok}
+	}
+
+	return result
+}
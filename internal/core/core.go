@@ -23,8 +23,17 @@
 //	ZERO       ; set current cell to 0
 //	IN         ; read byte into cell
 //	OUT        ; write byte from cell
-//	JZ target  ; conditional jump if cell == 0
-//	JNZ target ; conditional jump if cell != 0
+//	JZ label   ; jump past the matching JNZ if cell == 0
+//	JNZ label  ; jump back to the matching JZ if cell != 0
+//	SECTION h  ; start of the next chained program (see LowerChain)
+//	TRAP       ; unreachable, stops with an error (see InsertTraps)
+//	ZERO_RANGE n   ; clear the n cells starting at the pointer
+//	COPY_RANGE n d ; copy the n cells starting at the pointer d cells along
+//	NOP        ; removed by an optimiser pass, dropped before codegen
+//
+// A loop's JZ and JNZ share a label instead of pointing at each other by
+// index, so passes can insert, move and remove ops without fixing targets.
+// Backends turn labels into addresses as they emit (see ResolveJumps).
 package core
 
 // TapeSize is the size of the Brainfuck tape in bytes (traditional 30KB).
@@ -32,7 +41,17 @@ const TapeSize = 30000
 
 // Position represents a location in the source file.
 type Position struct {
-	Offset int // byte offset from start of file
-	Line   int // 1-based line number
-	Column int // 1-based column number
+	Offset int    `json:"offset"`         // byte offset from start of file
+	Line   int    `json:"line"`           // 1-based line number
+	Column int    `json:"col"`            // 1-based column number
+	File   string `json:"file,omitempty"` // the file, for a program of several (see Sources)
+}
+
+// InFile returns msg, a diagnostic at pos, naming pos's file first if it
+// has one.
+func InFile(pos *Position, msg string) string {
+	if pos == nil || pos.File == "" {
+		return msg
+	}
+	return Message(MsgInFile, pos.File, msg)
 }
@@ -0,0 +1,52 @@
+package core
+
+// CostModel is what a backend's code for each op costs, for passes that
+// choose between equivalent op sequences. The units are the backend's own:
+// code bytes for the native backends, steps for the VM.
+type CostModel struct {
+	Name      string
+	Shift     int // SHIFT by up to NearShift cells either way
+	FarShift  int // SHIFT further, where the backend's immediates are short
+	NearShift int // 0 if every SHIFT costs Shift
+	Add       int
+	Zero      int
+	IO        int // IN or OUT, a call to a helper making a system call
+	Jump      int // JZ or JNZ, a load, test and branch
+	Range     int // ZERO_RANGE or COPY_RANGE, not counting the cells
+}
+
+// StepCosts is the VM's cost model, where every op is one step. Optimise
+// uses it when Options has no model.
+var StepCosts = CostModel{Name: "vm", Shift: 1, FarShift: 1, Add: 1, Zero: 1, IO: 1, Jump: 1, Range: 1}
+
+// Cost returns what op costs. NOPs, SECTION and TRAP cost nothing.
+func (m *CostModel) Cost(op Op) int {
+	switch op.Kind {
+	case OpShift:
+		if m.NearShift > 0 && (op.Arg > m.NearShift || op.Arg < -m.NearShift) {
+			return m.FarShift
+		}
+		return m.Shift
+	case OpAdd:
+		return m.Add
+	case OpZero:
+		return m.Zero
+	case OpIn, OpOut:
+		return m.IO
+	case OpJz, OpJnz:
+		return m.Jump
+	case OpZeroRange, OpCopyRange:
+		return m.Range
+	default:
+		return 0
+	}
+}
+
+// Total returns what ops cost altogether.
+func (m *CostModel) Total(ops []Op) int {
+	total := 0
+	for _, op := range ops {
+		total += m.Cost(op)
+	}
+	return total
+}
@@ -0,0 +1,60 @@
+package core
+
+// CheckJumps verifies that every JZ and JNZ pairs up with a matching,
+// properly nested bracket, catching IR corrupted by an optimiser bug before
+// it runs.
+func CheckJumps(ops []Op) error {
+	_, err := ResolveJumps(ops)
+	return err
+}
+
+// InsertTraps adds a TRAP after every loop that provably never exits, for
+// debug builds: if a corrupted jump ever lands there, the program stops
+// loudly instead of running on. A loop never exits if it is entered with
+// the current cell known to be non-zero under cells, starting from tape
+// (see KnownCells), and its body cannot change that cell: no nested loops,
+// no net pointer movement, and no ADD, ZERO or IN on the cell itself.
+func InsertTraps(ops []Op, cells CellModel, tape []byte) []Op {
+	result := make([]Op, 0, len(ops))
+	known := KnownCells(ops, cells, tape)
+	ends := loopEnds(ops)
+
+	for i := 0; i < len(ops); i++ {
+		op := ops[i]
+		result = append(result, op)
+
+		if op.Kind == OpJz && known[i].Known && known[i].Value != 0 && ends[i] >= 0 &&
+			neverExits(ops[i+1:ends[i]]) {
+			result = append(result, ops[i+1:ends[i]+1]...)
+			result = append(result, Trap())
+			i = ends[i]
+		}
+	}
+
+	return result
+}
+
+// neverExits reports whether a loop body leaves the cell the loop tests
+// untouched, so that a loop entered on a non-zero cell spins forever.
+func neverExits(body []Op) bool {
+	offset := 0
+	for _, op := range body {
+		switch op.Kind {
+		case OpShift:
+			offset += op.Arg
+		case OpAdd, OpZero, OpIn:
+			if offset == 0 {
+				return false
+			}
+		case OpZeroRange, OpCopyRange:
+			// The cells written start at offset (or offset+Off for a copy)
+			at := offset + op.Off
+			if at <= 0 && 0 < at+op.Arg {
+				return false
+			}
+		case OpJz, OpJnz, OpSection, OpTrap:
+			return false
+		}
+	}
+	return offset == 0
+}
@@ -0,0 +1,60 @@
+package core
+
+import "fmt"
+
+// Dialect selects how source is read, for programs written for other
+// implementations.
+type Dialect int
+
+const (
+	// DialectStandard reads [ as a jump past its ] when the cell is zero,
+	// and ] as a jump back past its [ when it is not.
+	DialectStandard Dialect = iota
+
+	// DialectJumpBack reads ] as an unconditional jump back to its [,
+	// which does all the testing, as in some early interpreters. The
+	// program computes the same either way, so it lowers to the same IR:
+	// a JNZ is the jump back and the [ test folded together. Only the
+	// token interpreter, which counts the [ again on every iteration,
+	// runs it differently.
+	DialectJumpBack
+
+	// DialectStrict reads the source as plain Brainfuck, with none of
+	// bfcc's extensions: NoOptDirective comments are ignored, and programs
+	// cannot be chained.
+	DialectStrict
+)
+
+// dialectNames maps each Dialect to its flag spelling.
+var dialectNames = [...]string{
+	DialectStandard: "standard",
+	DialectJumpBack: "jump-back",
+	DialectStrict:   "strict",
+}
+
+// String returns the flag spelling of the Dialect.
+func (d Dialect) String() string {
+	return dialectNames[d]
+}
+
+// ParseDialect converts a flag value (standard, jump-back, strict) into a
+// Dialect.
+func ParseDialect(s string) (Dialect, error) {
+	for d, name := range dialectNames {
+		if name == s {
+			return Dialect(d), nil
+		}
+	}
+	return DialectStandard, fmt.Errorf("invalid dialect: %q (must be standard, jump-back, or strict)", s)
+}
+
+// TokenizeDialect is Tokenize for source in dialect d.
+func TokenizeDialect(src []byte, d Dialect) []Token {
+	toks := Tokenize(src)
+	if d == DialectStrict {
+		for i := range toks {
+			toks[i].NoOpt = false
+		}
+	}
+	return toks
+}
@@ -0,0 +1,171 @@
+package core
+
+import "errors"
+
+// Limits bounds an Eval run and describes the machine it runs on. The zero
+// value is a TapeSize tape of wrapping unsigned cells with no limits.
+type Limits struct {
+	MaxSteps  uint64 // ops executed before ErrStepLimit, 0 for no limit
+	MaxOutput int    // bytes written before ErrOutputLimit, 0 for no limit
+	Tape      int    // cells on the tape, 0 for TapeSize
+	Cells     CellModel
+
+	// StrictInput makes an IN past the end of the input fail with
+	// ErrInputExhausted, rather than store EOF.
+	StrictInput bool
+}
+
+// Errors wrapped by the EvalError returned by Eval.
+var (
+	ErrStepLimit      = errors.New("step limit exceeded")
+	ErrOutputLimit    = errors.New("output limit exceeded")
+	ErrInputExhausted = errors.New("read past the end of input")
+	ErrOutOfBounds    = errors.New("data pointer out of bounds")
+	ErrCellOverflow   = errors.New("cell overflow")
+	ErrTrapped        = errors.New("trap: reached unreachable code")
+)
+
+// EvalError is a run of Eval that failed at an op.
+type EvalError struct {
+	Err error // one of the errors above
+	Msg string
+	Pos *Position
+	PC  int
+}
+
+func (e *EvalError) Error() string {
+	if e.Pos != nil {
+		return InFile(e.Pos, Message(MsgEvalErrorAt, e.Msg, e.Pos.Line, e.Pos.Column, e.PC))
+	}
+	return Message(MsgEvalError, e.Msg, e.PC)
+}
+
+// Unwrap returns the error EvalError wraps.
+func (e *EvalError) Unwrap() error {
+	return e.Err
+}
+
+// Eval runs ops on input and returns everything they write, as a pure
+// function: no readers, writers or VM. It is the reference interpreter for
+// checking passes and for quick library use, and favours being plainly
+// correct over speed. The output written before an error is returned with
+// it.
+//
+// The pointer starts on the first cell and moving it off either end of the
+// tape is an error.
+func Eval(ops []Op, input []byte, limits Limits) ([]byte, error) {
+	output, _, err := EvalSteps(ops, input, limits)
+	return output, err
+}
+
+// EvalSteps is Eval, also returning the number of ops run, which
+// Limits.MaxSteps bounds. An op that fails counts as run, unless it failed
+// for the step limit.
+func EvalSteps(ops []Op, input []byte, limits Limits) ([]byte, uint64, error) {
+	targets, err := ResolveJumps(ops)
+	if err != nil {
+		return nil, 0, err
+	}
+	size := limits.Tape
+	if size <= 0 {
+		size = TapeSize
+	}
+
+	tape := make([]byte, size)
+	var output []byte
+	var steps uint64
+	dp := 0
+
+	for pc := 0; pc < len(ops); pc++ {
+		op := ops[pc]
+		fail := func(err error, id MessageID, args ...any) ([]byte, uint64, error) {
+			return output, steps, &EvalError{Err: err, Msg: Message(id, args...), Pos: op.Pos, PC: pc}
+		}
+
+		if limits.MaxSteps > 0 && steps == limits.MaxSteps {
+			return fail(ErrStepLimit, MsgStepLimitEval, limits.MaxSteps)
+		}
+		steps++
+
+		// Cells the op touches, relative to the pointer
+		lo, hi := 0, 0
+		switch op.Kind {
+		case OpShift:
+			lo, hi = op.Arg, op.Arg
+		case OpZeroRange:
+			hi = op.Arg - 1
+		case OpCopyRange:
+			lo, hi = min(0, op.Off), max(op.Arg-1, op.Off+op.Arg-1)
+		}
+		if dp+lo < 0 {
+			return fail(ErrOutOfBounds, MsgOutOfBounds, dp+lo, 0, size-1)
+		}
+		if dp+hi >= size {
+			return fail(ErrOutOfBounds, MsgOutOfBounds, dp+hi, 0, size-1)
+		}
+
+		switch op.Kind {
+		case OpShift:
+			dp += op.Arg
+
+		case OpAdd:
+			cell := limits.Cells.Value(tape[dp])
+			sum := cell + op.Arg
+			lo, hi := limits.Cells.Min(), limits.Cells.Max()
+			switch {
+			case sum >= lo && sum <= hi, limits.Cells.Overflow == OverflowWrap:
+			case limits.Cells.Overflow == OverflowTrap:
+				return fail(ErrCellOverflow, MsgCellOverflow, cell, op.Arg, lo, hi)
+			default:
+				sum = max(min(sum, hi), lo)
+			}
+			tape[dp] = byte(sum)
+
+		case OpZero:
+			tape[dp] = 0
+
+		case OpIn:
+			switch {
+			case len(input) > 0:
+				tape[dp], input = input[0], input[1:]
+			case limits.StrictInput:
+				return fail(ErrInputExhausted, MsgInputExhausted)
+			default:
+				tape[dp] = limits.Cells.EOF()
+			}
+
+		case OpOut:
+			if limits.MaxOutput > 0 && len(output) >= limits.MaxOutput {
+				return fail(ErrOutputLimit, MsgOutputLimit, limits.MaxOutput)
+			}
+			output = append(output, tape[dp])
+
+		case OpJz:
+			if tape[dp] == 0 {
+				pc = targets[pc] - 1
+			}
+
+		case OpJnz:
+			if tape[dp] != 0 {
+				pc = targets[pc] - 1
+			}
+
+		case OpZeroRange:
+			clear(tape[dp : dp+op.Arg])
+
+		case OpCopyRange:
+			copy(tape[dp+op.Off:dp+op.Off+op.Arg], tape[dp:dp+op.Arg])
+
+		case OpTrap:
+			return fail(ErrTrapped, MsgTrap)
+
+		case OpSection:
+			dp = 0
+			if Handoff(op.Arg) == HandoffReset {
+				clear(tape)
+			}
+		}
+	}
+
+	return output, steps, nil
+}
@@ -9,24 +9,34 @@ import (
 type OpKind int
 
 const (
-	OpShift OpKind = iota // SHIFT k
-	OpAdd                 // ADD k
-	OpZero                // ZERO
-	OpIn                  // IN
-	OpOut                 // OUT
-	OpJz                  // JZ target
-	OpJnz                 // JNZ target
+	OpShift     OpKind = iota // SHIFT k
+	OpAdd                     // ADD k
+	OpZero                    // ZERO
+	OpIn                      // IN
+	OpOut                     // OUT
+	OpJz                      // JZ label
+	OpJnz                     // JNZ label
+	OpSection                 // SECTION handoff, start of the next chained program
+	OpTrap                    // TRAP, marks code that should be unreachable
+	OpZeroRange               // ZERO_RANGE n, clears n cells from the pointer
+	OpCopyRange               // COPY_RANGE n d, copies n cells from the pointer to d cells away
+	OpNop                     // NOP, a tombstone left by an optimiser pass
 )
 
 // opNames maps each OpKind to its string representation for debugging.
 var opNames = [...]string{
-	OpShift: "SHIFT",
-	OpAdd:   "ADD",
-	OpZero:  "ZERO",
-	OpIn:    "IN",
-	OpOut:   "OUT",
-	OpJz:    "JZ",
-	OpJnz:   "JNZ",
+	OpShift:     "SHIFT",
+	OpAdd:       "ADD",
+	OpZero:      "ZERO",
+	OpIn:        "IN",
+	OpOut:       "OUT",
+	OpJz:        "JZ",
+	OpJnz:       "JNZ",
+	OpSection:   "SECTION",
+	OpTrap:      "TRAP",
+	OpZeroRange: "ZERO_RANGE",
+	OpCopyRange: "COPY_RANGE",
+	OpNop:       "NOP",
 }
 
 // String returns the string representation of the OpKind.
@@ -37,39 +47,151 @@ func (k OpKind) String() string {
 // Op represents one intermediate instruction.
 type Op struct {
 	Kind OpKind
-	Arg  int       // used by SHIFT/ADD/JZ/JNZ
+	Arg  int       // used by SHIFT/ADD/JZ/JNZ/SECTION/ZERO_RANGE/COPY_RANGE, loop label for JZ/JNZ
+	Off  int       // used by COPY_RANGE, destination offset
 	Pos  *Position // optional source metadata for debugging
+
+	// NoOpt marks the JZ of a loop the optimiser leaves as it is, from a
+	// NoOptDirective in the source
+	NoOpt bool
+}
+
+func Shift(k int) Op        { return Op{Kind: OpShift, Arg: k} }
+func Add(k int) Op          { return Op{Kind: OpAdd, Arg: k} }
+func Zero() Op              { return Op{Kind: OpZero} }
+func In() Op                { return Op{Kind: OpIn} }
+func Out() Op               { return Op{Kind: OpOut} }
+func Jz(label int) Op       { return Op{Kind: OpJz, Arg: label} }
+func Jnz(label int) Op      { return Op{Kind: OpJnz, Arg: label} }
+func Section(h Handoff) Op  { return Op{Kind: OpSection, Arg: int(h)} }
+func Trap() Op              { return Op{Kind: OpTrap} }
+func Nop() Op               { return Op{Kind: OpNop} }
+func ZeroRange(n int) Op    { return Op{Kind: OpZeroRange, Arg: n} }
+func CopyRange(n, d int) Op { return Op{Kind: OpCopyRange, Arg: n, Off: d} }
+
+// String returns the op as it appears in a dump, eg. "ADD   +3".
+func (op Op) String() string {
+	switch op.Kind {
+	case OpShift:
+		return fmt.Sprintf("SHIFT %+d", op.Arg)
+	case OpAdd:
+		return fmt.Sprintf("ADD   %+d", op.Arg)
+	case OpJz:
+		return fmt.Sprintf("JZ    L%d", op.Arg)
+	case OpJnz:
+		return fmt.Sprintf("JNZ   L%d", op.Arg)
+	case OpSection:
+		return fmt.Sprintf("SECTION %s", Handoff(op.Arg))
+	case OpZeroRange:
+		return fmt.Sprintf("ZERO_RANGE %d", op.Arg)
+	case OpCopyRange:
+		return fmt.Sprintf("COPY_RANGE %d %+d", op.Arg, op.Off)
+	default:
+		return op.Kind.String()
+	}
 }
 
-func Shift(k int) Op    { return Op{Kind: OpShift, Arg: k} }
-func Add(k int) Op      { return Op{Kind: OpAdd, Arg: k} }
-func Zero() Op          { return Op{Kind: OpZero} }
-func In() Op            { return Op{Kind: OpIn} }
-func Out() Op           { return Op{Kind: OpOut} }
-func Jz(target int) Op  { return Op{Kind: OpJz, Arg: target} }
-func Jnz(target int) Op { return Op{Kind: OpJnz, Arg: target} }
+// Commands returns the number of source commands an unoptimised op was
+// lowered from: |k| for ADD k and SHIFT k, none for the SECTION, TRAP and
+// NOP ops the compiler inserts, and one for every other op. Optimised ops
+// have no such count: a loop replaced by ZERO ran as many commands as its
+// cell's value made it.
+func (op Op) Commands() int {
+	switch op.Kind {
+	case OpAdd, OpShift:
+		return max(op.Arg, -op.Arg)
+	case OpSection, OpTrap, OpNop:
+		return 0
+	default:
+		return 1
+	}
+}
 
-// Dump returns a formatted string representation of the IR stream.
+// Dump returns a formatted string representation of the IR stream. Each
+// JZ and JNZ is followed by a comment giving its bracket's source position
+// and the index of its partner, eg. "; 1:3, JNZ 006".
 func Dump(ops []Op) string {
+	return DumpNotes(ops, nil)
+}
+
+// DumpNotes is Dump with notes[i], when not empty, as a comment after op i.
+func DumpNotes(ops []Op, notes []string) string {
+	return dump(ops, notes, false)
+}
+
+// DumpLoops is DumpNotes with only the JZ and JNZ ops, at their indices in
+// ops, for following the loop structure of a long program.
+func DumpLoops(ops []Op, notes []string) string {
+	return dump(ops, notes, true)
+}
+
+func dump(ops []Op, notes []string, onlyLoops bool) string {
 	var out strings.Builder
 
+	brackets := bracketNotes(ops)
+	for i, op := range ops {
+		if onlyLoops && op.Kind != OpJz && op.Kind != OpJnz {
+			continue
+		}
+		fmt.Fprintf(&out, "%03d: %s", i, op)
+		var comment []string
+		if brackets[i] != "" {
+			comment = append(comment, brackets[i])
+		}
+		if i < len(notes) && notes[i] != "" {
+			comment = append(comment, notes[i])
+		}
+		if len(comment) > 0 {
+			fmt.Fprintf(&out, " ; %s", strings.Join(comment, "; "))
+		}
+		out.WriteByte('\n')
+	}
+	return out.String()
+}
+
+// bracketNotes describes each JZ and JNZ in ops by its bracket's source
+// position, when known, and the index of the op it is matched with. The
+// brackets are matched with a stack, by nesting rather than label, so a
+// dump of IR with broken labels shows which loops they should close; an
+// unmatched bracket has only its position.
+func bracketNotes(ops []Op) []string {
+	notes := make([]string, len(ops))
+	var open []int
 	for i, op := range ops {
 		switch op.Kind {
-		case OpShift:
-			fmt.Fprintf(&out, "%03d: SHIFT %+d\n", i, op.Arg)
-		case OpAdd:
-			fmt.Fprintf(&out, "%03d: ADD   %+d\n", i, op.Arg)
-		case OpZero:
-			fmt.Fprintf(&out, "%03d: ZERO\n", i)
-		case OpIn:
-			fmt.Fprintf(&out, "%03d: IN\n", i)
-		case OpOut:
-			fmt.Fprintf(&out, "%03d: OUT\n", i)
 		case OpJz:
-			fmt.Fprintf(&out, "%03d: JZ    %d\n", i, op.Arg)
+			open = append(open, i)
+			notes[i] = posNote(op.Pos)
 		case OpJnz:
-			fmt.Fprintf(&out, "%03d: JNZ   %d\n", i, op.Arg)
+			notes[i] = posNote(op.Pos)
+			if len(open) == 0 {
+				continue
+			}
+			jz := open[len(open)-1]
+			open = open[:len(open)-1]
+			notes[jz] = joinNote(notes[jz], fmt.Sprintf("JNZ %03d", i))
+			notes[i] = joinNote(notes[i], fmt.Sprintf("JZ %03d", jz))
 		}
 	}
-	return out.String()
+	return notes
+}
+
+// posNote returns pos as line:col, or file:line:col in a program of several
+// files, or "" when it is unknown.
+func posNote(pos *Position) string {
+	if pos == nil {
+		return ""
+	}
+	if pos.File != "" {
+		return fmt.Sprintf("%s:%d:%d", pos.File, pos.Line, pos.Column)
+	}
+	return fmt.Sprintf("%d:%d", pos.Line, pos.Column)
+}
+
+// joinNote appends note to a comma-separated list.
+func joinNote(list, note string) string {
+	if list == "" {
+		return note
+	}
+	return list + ", " + note
 }
@@ -0,0 +1,86 @@
+package core
+
+import "errors"
+
+// ResolveJumps matches every JZ with the JNZ carrying the same label and
+// returns the index each one jumps to: a JZ to just past its JNZ, a JNZ back
+// to its JZ. Other ops get -1. Brackets that do not nest, or a label used
+// by more than one loop, are an error.
+func ResolveJumps(ops []Op) ([]int, error) {
+	targets := make([]int, len(ops))
+	stack := make([]int, 0, 8)
+	seen := make(map[int]bool)
+
+	for i, op := range ops {
+		targets[i] = -1
+		switch op.Kind {
+		case OpJz:
+			if seen[op.Arg] {
+				return nil, errors.New(Message(MsgLabelReused, i, op.Arg))
+			}
+			seen[op.Arg] = true
+			stack = append(stack, i)
+
+		case OpJnz:
+			if len(stack) == 0 {
+				return nil, errors.New(Message(MsgUnmatchedJnz, i, op.Arg))
+			}
+			start := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if ops[start].Arg != op.Arg {
+				return nil, errors.New(Message(MsgMismatchedJnz, i, op.Arg, ops[start].Arg, start))
+			}
+			targets[start] = i + 1
+			targets[i] = start
+		}
+	}
+
+	if len(stack) > 0 {
+		return nil, errors.New(Message(MsgUnmatchedJz, stack[0], ops[stack[0]].Arg))
+	}
+	return targets, nil
+}
+
+// loopEnds returns, for every JZ, the index of the JNZ with its label, and
+// -1 for every other op (and for a JZ that is never closed).
+func loopEnds(ops []Op) []int {
+	ends := make([]int, len(ops))
+	open := make(map[int]int)
+
+	for i, op := range ops {
+		ends[i] = -1
+		switch op.Kind {
+		case OpJz:
+			open[op.Arg] = i
+		case OpJnz:
+			if start, ok := open[op.Arg]; ok {
+				ends[start] = i
+				delete(open, op.Arg)
+			}
+		}
+	}
+	return ends
+}
+
+// NextLabel returns a loop label not used anywhere in ops.
+func NextLabel(ops []Op) int {
+	next := 0
+	for _, op := range ops {
+		if op.Kind == OpJz || op.Kind == OpJnz {
+			next = max(next, op.Arg+1)
+		}
+	}
+	return next
+}
+
+// relabel returns a copy of ops with every loop label moved up by base.
+func relabel(ops []Op, base int) []Op {
+	result := make([]Op, len(ops))
+	for i, op := range ops {
+		if op.Kind == OpJz || op.Kind == OpJnz {
+			op.Arg += base
+		}
+		result[i] = op
+	}
+	return result
+}
@@ -1,7 +1,5 @@
 package core
 
-import "fmt"
-
 // Error is returned when lowering fails (eg. unmatched brackets).
 type Error struct {
 	Msg string
@@ -9,8 +7,7 @@ type Error struct {
 }
 
 func (e *Error) Error() string {
-	return fmt.Sprintf("%s at line %d col %d (offset %d)",
-		e.Msg, e.Pos.Line, e.Pos.Column, e.Pos.Offset)
+	return InFile(&e.Pos, Message(MsgSourceError, e.Msg, e.Pos.Line, e.Pos.Column, e.Pos.Offset))
 }
 
 // lowerRule describes how to lower a token kind to an IR op.
@@ -30,53 +27,69 @@ var tokToRule = [...]lowerRule{
 	TokIn:         {OpIn, 0, false},
 }
 
-// Lower converts a token stream into IR operations.
+// Lower converts a token stream into IR operations. Loops are labelled in
+// the order they open, from 0.
 func Lower(toks []Token) ([]Op, error) {
+	return lower(toks, true)
+}
+
+// LowerAt lowers toks for optimising at level. It is Lower, except that at
+// Og runs of + - < > are not folded: every command is an op of its own at
+// its own position, so anything mapping ops back to source is exact.
+func LowerAt(toks []Token, level OptLevel) ([]Op, error) {
+	return lower(toks, level != Og)
+}
+
+// lower is Lower, folding runs when fold is set.
+func lower(toks []Token, fold bool) ([]Op, error) {
 	ops := make([]Op, 0, len(toks))
 	loopStack := make([]int, 0, 8)
+	openPos := make([]Position, 0, 8) // of each open loop's '[', with loopStack
+	label := 0
 
 	for i := 0; i < len(toks); {
 		tok := toks[i]
-		pos := &Position{tok.Pos.Offset, tok.Pos.Line, tok.Pos.Column}
+		pos := new(Position)
+		*pos = tok.Pos
 
 		switch tok.Kind {
 		case TokEOF:
 			if len(loopStack) > 0 {
-				return nil, &Error{"unmatched '['", toks[loopStack[0]].Pos}
+				return nil, &Error{Message(MsgUnmatchedOpen), openPos[0]}
 			}
 
 			return ops, nil
 
 		case TokLBracket:
-			loopStack = append(loopStack, len(ops))
-			ops = append(ops, Op{Kind: OpJz, Pos: pos})
+			loopStack = append(loopStack, label)
+			openPos = append(openPos, tok.Pos)
+			ops = append(ops, Op{Kind: OpJz, Arg: label, Pos: pos, NoOpt: tok.NoOpt})
+			label++
 			i++
 
 		case TokRBracket:
 			if len(loopStack) == 0 {
-				return nil, &Error{"unmatched ']'", tok.Pos}
+				return nil, &Error{Message(MsgUnmatchedClose), tok.Pos}
 			}
 
-			start := loopStack[len(loopStack)-1]
+			open := loopStack[len(loopStack)-1]
 			loopStack = loopStack[:len(loopStack)-1]
-			ops = append(ops, Op{Kind: OpJnz, Arg: start, Pos: pos})
-			ops[start].Arg = len(ops)
+			openPos = openPos[:len(openPos)-1]
+			ops = append(ops, Op{Kind: OpJnz, Arg: open, Pos: pos})
 			i++
 
 		case TokAdd, TokSub, TokShiftLeft, TokShiftRight, TokIn, TokOut:
 			rule := tokToRule[tok.Kind]
-			if rule.fold {
-				count := FoldToken(toks, i, tok.Kind)
-				ops = append(ops, Op{Kind: rule.op, Arg: rule.sign * count, Pos: pos})
-				i += count
-				continue
+			count := 1
+			if rule.fold && fold {
+				count = FoldToken(toks, i, tok.Kind)
 			}
 
-			ops = append(ops, Op{Kind: rule.op, Pos: pos})
-			i++
+			ops = append(ops, Op{Kind: rule.op, Arg: rule.sign * count, Pos: pos})
+			i += count
 
 		default:
-			return nil, &Error{"unexpected token", tok.Pos}
+			return nil, &Error{Message(MsgUnexpectedToken), tok.Pos}
 		}
 	}
 	return ops, nil
@@ -0,0 +1,165 @@
+package core
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// MessageID names a diagnostic shown to people: a compile or runtime
+// error, or an optimiser warning. Each has an English format, which a
+// Localiser can replace.
+type MessageID int
+
+// Diagnostics, with their English formats.
+const (
+	MsgUnmatchedOpen    MessageID = iota // unmatched '['
+	MsgUnmatchedClose                    // unmatched ']'
+	MsgUnexpectedToken                   // unexpected token
+	MsgSourceError                       // %s at line %d col %d (offset %d)
+	MsgLabelReused                       // op %d: label L%d is used by more than one loop
+	MsgUnmatchedJnz                      // op %d: JNZ L%d without a matching JZ
+	MsgMismatchedJnz                     // op %d: JNZ L%d closes JZ L%d at op %d
+	MsgUnmatchedJz                       // op %d: JZ L%d without a matching JNZ
+	MsgRuntimeError                      // runtime error at PC %d: %s
+	MsgRuntimeErrorAt                    // runtime error at PC %d (line %d, col %d): %s
+	MsgEvalError                         // %s (op %d)
+	MsgEvalErrorAt                       // %s at line %d col %d (op %d)
+	MsgStepLimit                         // step limit exceeded (%d steps)
+	MsgStepLimitEval                     // step limit exceeded: %d steps
+	MsgOutputLimit                       // output limit exceeded: %d bytes
+	MsgInputExhausted                    // read past the end of input
+	MsgInputError                        // input error: %v
+	MsgOutputError                       // output error: %v
+	MsgOutOfBounds                       // data pointer out of bounds: %d (valid range %d to %d)
+	MsgCellOverflow                      // cell overflow: %d %+d is outside %d to %d
+	MsgTrap                              // trap: reached unreachable code
+	MsgWarningAt                         // line %d col %d: %s
+	MsgClearLoopsKept                    // clear loops are kept: signed cells ...
+	MsgEmptyLoopRemoved                  // removed empty loop, which never exits if entered
+	MsgInFile                            // %s: %s
+
+	MsgInvalidIR          // invalid IR: %w
+	MsgOptimiserInvalidIR // optimiser produced invalid IR: %w
+	MsgInputPending       // input requested but not given
+	MsgNotDecimal         // expected a decimal number
+	MsgNotDecimalGot      // %w, got %q
+	MsgInputOverflow      // cell overflow: input %d is outside %d to %d
+	MsgCheckpointProgram  // checkpoint was taken from a different program ...
+	MsgCheckpointDP       // checkpoint data pointer %d is outside its tape
+	MsgCheckpointRead     // reading checkpoint: %w
+	MsgNotCheckpoint      // not a bfcc checkpoint file
+	MsgCheckpointVersion  // unsupported checkpoint version %d
+	MsgCheckpointTooLarge // checkpoint tape too large: %d bytes
+	MsgCheckpointReadTape // reading checkpoint tape: %w
+	MsgCheckpointPC       // checkpoint PC %d is outside its program of %d ops
+	MsgCheckpointOrigin   // checkpoint origin %d is outside its tape
+	numMessages
+)
+
+// messages are the English formats, by MessageID.
+var messages = [numMessages]string{
+	MsgUnmatchedOpen:    "unmatched '['",
+	MsgUnmatchedClose:   "unmatched ']'",
+	MsgUnexpectedToken:  "unexpected token",
+	MsgSourceError:      "%s at line %d col %d (offset %d)",
+	MsgLabelReused:      "op %d: label L%d is used by more than one loop",
+	MsgUnmatchedJnz:     "op %d: JNZ L%d without a matching JZ",
+	MsgMismatchedJnz:    "op %d: JNZ L%d closes JZ L%d at op %d",
+	MsgUnmatchedJz:      "op %d: JZ L%d without a matching JNZ",
+	MsgRuntimeError:     "runtime error at PC %d: %s",
+	MsgRuntimeErrorAt:   "runtime error at PC %d (line %d, col %d): %s",
+	MsgEvalError:        "%s (op %d)",
+	MsgEvalErrorAt:      "%s at line %d col %d (op %d)",
+	MsgStepLimit:        "step limit exceeded (%d steps)",
+	MsgStepLimitEval:    "step limit exceeded: %d steps",
+	MsgOutputLimit:      "output limit exceeded: %d bytes",
+	MsgInputExhausted:   "read past the end of input",
+	MsgInputError:       "input error: %v",
+	MsgOutputError:      "output error: %v",
+	MsgOutOfBounds:      "data pointer out of bounds: %d (valid range %d to %d)",
+	MsgCellOverflow:     "cell overflow: %d %+d is outside %d to %d",
+	MsgTrap:             "trap: reached unreachable code",
+	MsgWarningAt:        "line %d col %d: %s",
+	MsgClearLoopsKept:   "clear loops are kept: signed cells that do not wrap cannot count down to zero from below",
+	MsgEmptyLoopRemoved: "removed empty loop, which never exits if entered",
+	MsgInFile:           "%s: %s",
+
+	MsgInvalidIR:          "invalid IR: %w",
+	MsgOptimiserInvalidIR: "optimiser produced invalid IR: %w",
+	MsgInputPending:       "input requested but not given",
+	MsgNotDecimal:         "expected a decimal number",
+	MsgNotDecimalGot:      "%w, got %q",
+	MsgInputOverflow:      "cell overflow: input %d is outside %d to %d",
+	MsgCheckpointProgram:  "checkpoint was taken from a different program or optimisation level",
+	MsgCheckpointDP:       "checkpoint data pointer %d is outside its tape",
+	MsgCheckpointRead:     "reading checkpoint: %w",
+	MsgNotCheckpoint:      "not a bfcc checkpoint file",
+	MsgCheckpointVersion:  "unsupported checkpoint version %d",
+	MsgCheckpointTooLarge: "checkpoint tape too large: %d bytes",
+	MsgCheckpointReadTape: "reading checkpoint tape: %w",
+	MsgCheckpointPC:       "checkpoint PC %d is outside its program of %d ops",
+	MsgCheckpointOrigin:   "checkpoint origin %d is outside its tape",
+}
+
+// Format returns the English format of id.
+func (id MessageID) Format() string {
+	if id < 0 || id >= numMessages {
+		return fmt.Sprintf("MessageID(%d)", int(id))
+	}
+	return messages[id]
+}
+
+// A Localiser returns the format to use for diagnostic id in place of
+// format, its English one. The replacement takes the same arguments in the
+// same order, though explicit indexes such as %[2]d can use them in
+// another, and should keep any %w, which wraps an error; returning format
+// keeps the English.
+type Localiser func(id MessageID, format string) string
+
+// localiser is the installed Localiser, or nil for English.
+var localiser atomic.Pointer[Localiser]
+
+// SetLocaliser makes l translate every diagnostic from then on, or with
+// nil restores English. It is safe to call while programs compile and run,
+// and affects the whole process.
+func SetLocaliser(l Localiser) {
+	if l == nil {
+		localiser.Store(nil)
+		return
+	}
+	localiser.Store(&l)
+}
+
+// Message formats diagnostic id with args, through the installed
+// Localiser.
+func Message(id MessageID, args ...any) string {
+	format := localised(id)
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// Errorf formats diagnostic id with args as an error, through the
+// installed Localiser, wrapping the argument of a %w as fmt.Errorf does.
+func Errorf(id MessageID, args ...any) error {
+	return fmt.Errorf(localised(id), args...)
+}
+
+// MessageError is a diagnostic without arguments as an error. It is
+// formatted each time it is shown, so a sentinel made from one follows the
+// Localiser installed then.
+type MessageError MessageID
+
+func (e MessageError) Error() string {
+	return Message(MessageID(e))
+}
+
+// localised returns the format of id from the installed Localiser.
+func localised(id MessageID) string {
+	format := id.Format()
+	if l := localiser.Load(); l != nil {
+		format = (*l)(id, format)
+	}
+	return format
+}
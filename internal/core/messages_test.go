@@ -0,0 +1,39 @@
+package core
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestLocaliser checks that errors made from the catalog, sentinels
+// included, are shown in the installed Localiser's language and still
+// wrap what they did.
+func TestLocaliser(t *testing.T) {
+	SetLocaliser(func(id MessageID, format string) string {
+		switch id {
+		case MsgInputPending:
+			return "entrée demandée mais non donnée"
+		case MsgInvalidIR:
+			return "IR invalide : %w"
+		}
+		return format
+	})
+	t.Cleanup(func() { SetLocaliser(nil) })
+
+	pending := MessageError(MsgInputPending)
+	if got, want := pending.Error(), "entrée demandée mais non donnée"; got != want {
+		t.Errorf("sentinel: got %q, want %q", got, want)
+	}
+	err := Errorf(MsgInvalidIR, pending)
+	if got, want := err.Error(), "IR invalide : entrée demandée mais non donnée"; got != want {
+		t.Errorf("wrapped: got %q, want %q", got, want)
+	}
+	if !errors.Is(err, MessageError(MsgInputPending)) {
+		t.Error("wrapped error does not wrap the sentinel")
+	}
+
+	SetLocaliser(nil)
+	if got, want := pending.Error(), "input requested but not given"; got != want {
+		t.Errorf("english: got %q, want %q", got, want)
+	}
+}
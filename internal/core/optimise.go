@@ -1,5 +1,10 @@
 package core
 
+import (
+	"fmt"
+	"slices"
+)
+
 // OptLevel represents the optimization level for the IR.
 type OptLevel int
 
@@ -7,199 +12,314 @@ const (
 	O0 OptLevel = iota // No optimizations
 	O1                 // Basic: mergeAdjacent, removeNoOps
 	O2                 // Full: all passes
+	Og                 // Debugging: one op per source command (see LowerAt), no passes
 )
 
-// OptimiseWithLevel applies optimizations based on the specified level.
-func OptimiseWithLevel(ops []Op, level OptLevel) []Op {
-	if len(ops) == 0 || level == O0 {
-		return ops
-	}
+// levelNames maps each OptLevel to its -O flag spelling.
+var levelNames = [...]string{O0: "0", O1: "1", O2: "2", Og: "g"}
 
-	result := ops
-	for {
-		prev := len(result)
+// String returns the -O flag spelling of the level.
+func (l OptLevel) String() string {
+	return levelNames[l]
+}
 
-		// O2: Full optimizations (clearLoops, removeEmptyLoops)
-		if level >= O2 {
-			result = clearLoops(result)
-			result = removeEmptyLoops(result)
+// ParseOptLevel converts a -O flag value (0, 1, 2, g) into an OptLevel.
+func ParseOptLevel(s string) (OptLevel, error) {
+	for l, name := range levelNames {
+		if name == s {
+			return OptLevel(l), nil
 		}
+	}
+	return O0, fmt.Errorf("invalid optimization level: %q (must be 0, 1, 2, or g)", s)
+}
+
+// Options selects what Optimise does.
+type Options struct {
+	Level OptLevel
+	Cells CellModel  // only rewrites sound for this cell model are made
+	Costs *CostModel // the backend's, for passes choosing between rewrites; nil for StepCosts
+
+	// Superopt, at O2, also runs the experimental superopt pass, replacing
+	// small loops with shorter code found by exhaustive search
+	Superopt bool
 
-		// O1+: Basic optimizations (mergeAdjacent, removeNoOps)
-		result = mergeAdjacent(result)
-		result = removeNoOps(result)
+	// Progress, if set, is called after every pass with the round (from 1),
+	// the pass name and the number of ops, including NOPs not yet compacted.
+	Progress func(round int, pass string, ops int)
 
-		if len(result) == prev {
+	superopts map[string][]Op // loop bodies superopt has searched, and what it found
+}
+
+// pass is one optimiser pass. It rewrites ops in place and returns how many
+// rewrites it made.
+type pass struct {
+	name  string
+	level OptLevel // lowest level the pass runs at
+	run   func(ops []Op, opts *Options, r *Report) int
+
+	// enabled, if set, is whether opts turn the pass on at all
+	enabled func(opts *Options) bool
+}
+
+// runs reports whether p runs under opts.
+func (p pass) runs(opts *Options) bool {
+	return opts.Level >= p.level && (p.enabled == nil || p.enabled(opts))
+}
+
+// passes run in this order every round.
+var passes = []pass{
+	{"clearLoops", O2, func(ops []Op, opts *Options, r *Report) int { return clearLoops(ops, opts.Cells) }, nil},
+	{"removeEmptyLoops", O2, func(ops []Op, opts *Options, r *Report) int { return removeEmptyLoops(ops, r) }, nil},
+	{"rangeOps", O2, func(ops []Op, opts *Options, r *Report) int { return rangeOps(ops, opts.Cells) }, nil},
+	{"mergeAdjacent", O1, func(ops []Op, opts *Options, r *Report) int {
+		return mergeAdjacent(ops, opts.Cells.Overflow == OverflowWrap)
+	}, nil},
+	{"removeNoOps", O1, func(ops []Op, opts *Options, r *Report) int { return removeNoOps(ops, opts.Cells) }, nil},
+	{"superopt", O2, func(ops []Op, opts *Options, r *Report) int {
+		return superopt(ops, opts.Cells, opts.Costs, opts.superopts)
+	}, func(opts *Options) bool { return opts.Superopt }},
+	{"schedule", O2, func(ops []Op, opts *Options, r *Report) int { return schedule(ops, opts.Costs) }, nil},
+}
+
+// Optimise applies the passes for opts.Level, restricted to rewrites that
+// are sound under opts.Cells, and reports what each pass did. Only wrapping
+// cells may have opposite-signed ADDs merged, ADD values normalised mod
+// 256, or [+] rewritten into ZERO.
+//
+// Passes rewrite ops in place, replacing whatever they remove with NOP so
+// that indices stay put while they scan. Each round of passes ends with a
+// single compact, until a round changes nothing. Loops marked NoOpt are cut
+// out of what the passes see, so nothing inside them or across their
+// brackets is rewritten.
+//
+// Both the input and the result must have properly nested loops (see
+// ResolveJumps). Anything else is returned as an error rather than
+// optimised or emitted.
+func Optimise(ops []Op, opts Options) ([]Op, *Report, error) {
+	r := &Report{Level: opts.Level, Before: len(ops), After: len(ops)}
+	if _, err := ResolveJumps(ops); err != nil {
+		return nil, r, Errorf(MsgInvalidIR, err)
+	}
+	if len(ops) == 0 || opts.Level == O0 || opts.Level == Og {
+		return ops, r, nil
+	}
+	if opts.Costs == nil {
+		opts.Costs = &StepCosts
+	}
+	opts.superopts = make(map[string][]Op)
+	r.Costs, r.CostIn = opts.Costs.Name, opts.Costs.Total(ops)
+
+	if opts.Level >= O2 && opts.Cells.Signed && opts.Cells.Overflow != OverflowWrap {
+		r.warn(nil, Message(MsgClearLoopsKept))
+	}
+
+	counts := make([]int, len(passes))
+	result := slices.Clone(ops)
+	for {
+		r.Rounds++
+		changed := false
+		spans := optimisable(result)
+		for i, p := range passes {
+			if !p.runs(&opts) {
+				continue
+			}
+			n := 0
+			for _, s := range spans {
+				n += p.run(result[s[0]:s[1]], &opts, r)
+			}
+			counts[i] += n
+			changed = changed || n > 0
+			if opts.Progress != nil {
+				opts.Progress(r.Rounds, p.name, len(result))
+			}
+		}
+
+		result = compact(result)
+		if !changed {
 			break
 		}
 	}
 
-	return result
+	for i, p := range passes {
+		if p.runs(&opts) {
+			r.Passes = append(r.Passes, PassCount{Name: p.name, Rewrites: counts[i]})
+		}
+	}
+	r.After = len(result)
+	r.CostOut = opts.Costs.Total(result)
+
+	if _, err := ResolveJumps(result); err != nil {
+		return nil, r, Errorf(MsgOptimiserInvalidIR, err)
+	}
+	return result, r, nil
 }
 
-// Optimise applies peephole and structural optimisations to the IR.
-// It returns a new slice with the optimised operations.
-func Optimise(ops []Op) []Op {
-	if len(ops) == 0 {
-		return ops
+// optimisable returns the [start, end) spans of ops outside the loops
+// marked NoOpt, which are all the passes may rewrite.
+func optimisable(ops []Op) [][2]int {
+	if !slices.ContainsFunc(ops, func(op Op) bool { return op.NoOpt }) {
+		return [][2]int{{0, len(ops)}}
 	}
 
-	// Apply optimisation passes until no more changes occur
-	result := ops
-	for {
-		prev := len(result)
-		result = clearLoops(result)
-		result = removeEmptyLoops(result)
-		result = mergeAdjacent(result)
-		result = removeNoOps(result)
-		if len(result) == prev {
-			break
+	var spans [][2]int
+	ends := loopEnds(ops)
+	start := 0
+	for i := 0; i < len(ops); i++ {
+		if ops[i].Kind == OpJz && ops[i].NoOpt && ends[i] >= 0 {
+			spans = append(spans, [2]int{start, i})
+			i = ends[i]
+			start = i + 1
 		}
 	}
+	return append(spans, [2]int{start, len(ops)})
+}
 
-	return result
+// OptimiseWithLevel applies optimizations based on the specified level.
+func OptimiseWithLevel(ops []Op, level OptLevel) ([]Op, error) {
+	return OptimiseForCells(ops, level, CellModel{})
+}
+
+// OptimiseForCells applies optimizations based on the specified level,
+// restricted to rewrites that are sound under the given cell model. It is
+// Optimise without the report.
+func OptimiseForCells(ops []Op, level OptLevel, cells CellModel) ([]Op, error) {
+	result, _, err := Optimise(ops, Options{Level: level, Cells: cells})
+	return result, err
+}
+
+// nextLive returns the index of the first op at or after i that is not a
+// NOP, or len(ops).
+func nextLive(ops []Op, i int) int {
+	for i < len(ops) && ops[i].Kind == OpNop {
+		i++
+	}
+	return i
+}
+
+// tombstone replaces ops[from:to] with NOPs.
+func tombstone(ops []Op, from, to int) {
+	for i := from; i < to; i++ {
+		ops[i] = Nop()
+	}
 }
 
 // removeEmptyLoops eliminates empty [] loops (JZ immediately followed by JNZ).
 // These are often used as comments in Brainfuck: [this is a comment]
-func removeEmptyLoops(ops []Op) []Op {
-	if len(ops) < 2 {
-		return ops
-	}
-
-	result := make([]Op, 0, len(ops))
-	i := 0
-
-	for i < len(ops) {
-		// Check for empty loop: JZ immediately followed by its matching JNZ
-		if i+1 < len(ops) &&
-			ops[i].Kind == OpJz &&
-			ops[i+1].Kind == OpJnz &&
-			ops[i].Arg == i+2 &&
-			ops[i+1].Arg == i {
-			// Skip both instructions
-			i += 2
-			continue
-		}
+// Entered on a non-zero cell, [] spins forever, so removing it is worth a
+// warning.
+func removeEmptyLoops(ops []Op, r *Report) int {
+	removed := 0
+	ends := loopEnds(ops)
 
-		result = append(result, ops[i])
-		i++
+	for i, op := range ops {
+		// Check for empty loop: JZ followed by nothing but its matching JNZ
+		if op.Kind == OpJz && ends[i] >= 0 && nextLive(ops, i+1) == ends[i] {
+			r.warn(op.Pos, Message(MsgEmptyLoopRemoved))
+			tombstone(ops, i, ends[i]+1)
+			removed++
+		}
 	}
 
-	return fixJumpTargets(result)
+	return removed
 }
 
 // clearLoops detects [-] and [+] patterns and replaces them with ZERO.
-// Pattern: JZ target, ADD ±1, JNZ start (where target = start+3, JNZ points to start)
-func clearLoops(ops []Op) []Op {
-	if len(ops) < 3 {
-		return ops
+// Pattern: JZ target, ADD ±1, JNZ start (ignoring NOPs in between)
+// Without wrapping [+] never reaches zero from above, and [-] never reaches it
+// from below, so only [-] on unsigned cells is rewritten.
+func clearLoops(ops []Op, cells CellModel) int {
+	wrap := cells.Overflow == OverflowWrap
+	if !wrap && cells.Signed {
+		return 0
 	}
 
-	result := make([]Op, 0, len(ops))
-	i := 0
+	cleared := 0
+	ends := loopEnds(ops)
+	for i, op := range ops {
+		if op.Kind != OpJz || ends[i] < 0 {
+			continue
+		}
 
-	for i < len(ops) {
 		// Check for clear loop pattern: JZ, ADD ±1, JNZ
-		if i+2 < len(ops) &&
-			ops[i].Kind == OpJz &&
-			ops[i+1].Kind == OpAdd &&
-			(ops[i+1].Arg == 1 || ops[i+1].Arg == -1) &&
-			ops[i+2].Kind == OpJnz &&
-			ops[i].Arg == i+3 &&
-			ops[i+2].Arg == i {
+		end := ends[i]
+		body := nextLive(ops, i+1)
+		if body < end && nextLive(ops, body+1) == end &&
+			ops[body].Kind == OpAdd &&
+			(ops[body].Arg == -1 || (wrap && ops[body].Arg == 1)) {
 			// Replace with ZERO, preserving position from the opening bracket
-			result = append(result, Op{Kind: OpZero, Pos: ops[i].Pos})
-			i += 3
-			continue
+			tombstone(ops, i+1, end+1)
+			ops[i] = Op{Kind: OpZero, Pos: op.Pos}
+			cleared++
 		}
-
-		result = append(result, ops[i])
-		i++
 	}
 
-	// Fix up jump targets after removing instructions
-	return fixJumpTargets(result)
+	return cleared
 }
 
 // mergeAdjacent combines consecutive ADD or SHIFT operations.
-func mergeAdjacent(ops []Op) []Op {
-	if len(ops) < 2 {
-		return ops
-	}
-
-	result := make([]Op, 0, len(ops))
+// When wrap is false, ADDs are only merged if they share a sign, since an
+// intermediate overflow would otherwise be lost.
+func mergeAdjacent(ops []Op, wrap bool) int {
+	merged := 0
+	last := -1 // index of the last live op
 
-	for _, op := range ops {
-		if len(result) == 0 {
-			result = append(result, op)
+	for i, op := range ops {
+		if op.Kind == OpNop {
 			continue
 		}
-
-		last := &result[len(result)-1]
-
-		// Merge consecutive ADD operations
-		if op.Kind == OpAdd && last.Kind == OpAdd {
-			last.Arg += op.Arg
+		if last < 0 {
+			last = i
 			continue
 		}
 
+		prev := &ops[last]
+		switch {
+		// Merge consecutive ADD operations
+		case op.Kind == OpAdd && prev.Kind == OpAdd && (wrap || (op.Arg < 0) == (prev.Arg < 0)):
+			prev.Arg += op.Arg
+
 		// Merge consecutive SHIFT operations
-		if op.Kind == OpShift && last.Kind == OpShift {
-			last.Arg += op.Arg
+		case op.Kind == OpShift && prev.Kind == OpShift:
+			prev.Arg += op.Arg
+
+		default:
+			last = i
 			continue
 		}
 
-		result = append(result, op)
+		ops[i] = Nop()
+		merged++
 	}
 
-	// Fix up jump targets after merging instructions
-	return fixJumpTargets(result)
+	return merged
 }
 
 // removeNoOps eliminates operations that have no effect and normalizes ADD values.
-func removeNoOps(ops []Op) []Op {
-	result := make([]Op, 0, len(ops))
+// ADD values are only normalized for wrapping cells.
+func removeNoOps(ops []Op, cells CellModel) int {
+	removed := 0
+	wrap := cells.Overflow == OverflowWrap
 
-	for _, op := range ops {
-		// Normalize ADD to [-255, 255] range (8-bit cells)
-		if op.Kind == OpAdd {
-			op.Arg = op.Arg % 256
+	for i := range ops {
+		op := &ops[i]
+
+		// Normalize ADD to [-255, 255] ([-128, 127] when signed)
+		if wrap && op.Kind == OpAdd {
+			op.Arg = cells.Normalise(op.Arg)
 		}
 
 		// Skip ADD 0 and SHIFT 0
 		if (op.Kind == OpAdd || op.Kind == OpShift) && op.Arg == 0 {
-			continue
+			ops[i] = Nop()
+			removed++
 		}
-
-		result = append(result, op)
 	}
 
-	// Fix up jump targets after removing instructions
-	return fixJumpTargets(result)
+	return removed
 }
 
-// fixJumpTargets recalculates JZ/JNZ targets after instructions are removed.
-// Uses bracket matching to pair JZ with corresponding JNZ.
-func fixJumpTargets(ops []Op) []Op {
-	// Build a mapping of loop pairs
-	stack := make([]int, 0, 8)
-
-	for i, op := range ops {
-		switch op.Kind {
-		case OpJz:
-			stack = append(stack, i)
-		case OpJnz:
-			if len(stack) > 0 {
-				start := stack[len(stack)-1]
-				stack = stack[:len(stack)-1]
-				// JZ jumps past the JNZ
-				ops[start].Arg = i + 1
-				// JNZ jumps back to the JZ
-				ops[i].Arg = start
-			}
-		}
-	}
-
-	return ops
+// compact drops the NOPs left by a round of passes. Loops are matched by
+// label, so nothing else needs fixing.
+func compact(ops []Op) []Op {
+	return slices.DeleteFunc(ops, func(op Op) bool { return op.Kind == OpNop })
 }
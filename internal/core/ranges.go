@@ -0,0 +1,233 @@
+package core
+
+import "slices"
+
+// rangeOps detects unrolled clears and copies over runs of neighbouring
+// cells and replaces them with ZERO_RANGE and COPY_RANGE:
+//
+//	[-]>[-]>[-]            ZERO_RANGE 3, SHIFT +2
+//	>>>[-]<<<[->>>+<<<]>   COPY_RANGE 2 +3, ZERO_RANGE 2, SHIFT +1
+//	>>>[-]<<<[->>>+<<<]
+//
+// A copy is a move loop ([->d+<d] or [>d+<d-]) into a destination cleared
+// just before it. Runs are only rewritten while source and destination do
+// not overlap, so the cells can be copied in any order. Move loops need
+// every source value to count down to zero, which rules out signed cells
+// that do not wrap.
+func rangeOps(ops []Op, cells CellModel) int {
+	moves := cells.Overflow == OverflowWrap || !cells.Signed
+	ends := loopEnds(ops)
+	rewritten := 0
+
+	for i := 0; i < len(ops); {
+		acts, offset, end := scanStraight(ops, ends, i, moves)
+		if hasRuns(acts) {
+			// The rewrite is never longer than the original, but keep the
+			// original if that ever stops holding
+			if out := emitRuns(acts, offset); len(out) <= end-i {
+				copy(ops[i:], out)
+				tombstone(ops, i+len(out), end)
+				rewritten++
+			}
+		}
+		i = end + 1
+	}
+
+	return rewritten
+}
+
+// cellAction is a clear or a move loop on one cell in straight-line code,
+// at an offset relative to the pointer at the start of the code.
+type cellAction struct {
+	move   bool
+	offset int
+	dest   int  // move destination, relative to offset
+	ops    []Op // the original ops
+}
+
+// scanStraight collects the clears and move loops from ops[i:] up to the
+// first op that is neither. It returns them with the final pointer offset
+// and the index of that op.
+func scanStraight(ops []Op, ends []int, i int, moves bool) ([]cellAction, int, int) {
+	var acts []cellAction
+	offset := 0
+
+	for ; i < len(ops); i++ {
+		switch op := ops[i]; op.Kind {
+		case OpNop:
+			continue
+		case OpShift:
+			offset += op.Arg
+			continue
+		case OpZero:
+			acts = append(acts, cellAction{offset: offset, ops: ops[i : i+1]})
+			continue
+		case OpJz:
+			end := ends[i]
+			if end < 0 {
+				break
+			}
+			if d, ok := moveLoop(ops[i+1 : end]); ok && moves {
+				acts = append(acts, cellAction{move: true, offset: offset, dest: d, ops: ops[i : end+1]})
+				i = end
+				continue
+			}
+		}
+		break
+	}
+
+	return acts, offset, i
+}
+
+// moveLoop matches the body of [->d+<d] or [>d+<d-], returning d.
+func moveLoop(body []Op) (int, bool) {
+	body = slices.DeleteFunc(slices.Clone(body), func(op Op) bool { return op.Kind == OpNop })
+	if len(body) != 4 {
+		return 0, false
+	}
+	switch {
+	case body[0].Kind == OpAdd && body[0].Arg == -1:
+		body = body[1:]
+	case body[3].Kind == OpAdd && body[3].Arg == -1:
+		body = body[:3]
+	default:
+		return 0, false
+	}
+
+	d := body[0].Arg
+	ok := body[0].Kind == OpShift && d != 0 &&
+		body[1].Kind == OpAdd && body[1].Arg == 1 &&
+		body[2].Kind == OpShift && body[2].Arg == -d
+	return d, ok
+}
+
+// runAt returns the number of cells in the run starting at acts[i] and
+// whether it is a copy, which takes two actions per cell.
+func runAt(acts []cellAction, i int) (int, bool) {
+	// clear(o+d) move(o, d)
+	copyAt := func(j int) bool {
+		return j+1 < len(acts) && !acts[j].move && acts[j+1].move &&
+			acts[j].offset == acts[j+1].offset+acts[j+1].dest
+	}
+	// Neighbouring cells, all stepping the same way
+	step := 0
+	next := func(from, to int) bool {
+		s := acts[to].offset - acts[from].offset
+		if step == 0 && (s == 1 || s == -1) {
+			step = s
+		}
+		return s != 0 && s == step
+	}
+
+	if copyAt(i) {
+		d := acts[i+1].dest
+		n := 1
+		for j := i + 2; copyAt(j) && acts[j+1].dest == d && next(j-1, j+1) && n < max(d, -d); j += 2 {
+			n++
+		}
+		return n, true
+	}
+
+	if acts[i].move {
+		return 0, false
+	}
+	n := 1
+	for j := i + 1; j < len(acts) && !acts[j].move && next(j-1, j); j++ {
+		n++
+	}
+	return n, false
+}
+
+// hasRuns reports whether acts holds a copy or a clear of several cells.
+func hasRuns(acts []cellAction) bool {
+	for i := range acts {
+		if n, isCopy := runAt(acts, i); isCopy || n > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// emitRuns returns the straight-line code described by acts, rewriting
+// runs into range ops, and leaves the pointer at offset.
+func emitRuns(acts []cellAction, offset int) []Op {
+	var result []Op
+	at := 0
+	moveTo := func(to int) {
+		if to != at {
+			result = append(result, Shift(to-at))
+			at = to
+		}
+	}
+
+	for i := 0; i < len(acts); {
+		n, isCopy := runAt(acts, i)
+		pos := acts[i].ops[0].Pos
+		switch {
+		case isCopy:
+			// The sources are the moves, every other action from i+1
+			last := i + 2*n - 1
+			moveTo(min(acts[i+1].offset, acts[last].offset))
+			result = append(result,
+				Op{Kind: OpCopyRange, Arg: n, Off: acts[i+1].dest, Pos: pos},
+				Op{Kind: OpZeroRange, Arg: n, Pos: pos})
+			i += 2 * n
+
+		case n > 1:
+			moveTo(min(acts[i].offset, acts[i+n-1].offset))
+			result = append(result, Op{Kind: OpZeroRange, Arg: n, Pos: pos})
+			i += n
+
+		default:
+			moveTo(acts[i].offset)
+			result = append(result, acts[i].ops...)
+			i++
+		}
+	}
+
+	moveTo(offset)
+	return result
+}
+
+// LowerRanges rewrites ZERO_RANGE and COPY_RANGE back into plain clears
+// and move loops, for consumers that re-emit Brainfuck.
+func LowerRanges(ops []Op) []Op {
+	result := make([]Op, 0, len(ops))
+	label := NextLabel(ops)
+
+	for _, op := range ops {
+		switch op.Kind {
+		case OpZeroRange:
+			for k := range op.Arg {
+				if k > 0 {
+					result = append(result, Shift(1))
+				}
+				result = append(result, Op{Kind: OpZero, Pos: op.Pos})
+			}
+			if op.Arg > 1 {
+				result = append(result, Shift(1-op.Arg))
+			}
+
+		case OpCopyRange:
+			d := op.Off
+			for k := range op.Arg {
+				if k > 0 {
+					result = append(result, Shift(1))
+				}
+				// >d[-]<d[->d+<d]
+				result = append(result,
+					Shift(d), Zero(), Shift(-d),
+					Op{Kind: OpJz, Arg: label, Pos: op.Pos}, Add(-1), Shift(d), Add(1), Shift(-d), Jnz(label))
+				label++
+			}
+			if op.Arg > 1 {
+				result = append(result, Shift(1-op.Arg))
+			}
+
+		default:
+			result = append(result, op)
+		}
+	}
+
+	return result
+}
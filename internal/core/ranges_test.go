@@ -0,0 +1,86 @@
+package core
+
+import (
+	"slices"
+	"testing"
+)
+
+// move returns the move loop [->d+<d] with the given label.
+func move(label, d int) []Op {
+	return []Op{Jz(label), Add(-1), Shift(d), Add(1), Shift(-d), Jnz(label)}
+}
+
+// copyTo returns the unrolled copy >d[-]<d[->d+<d] of the cell at the
+// pointer.
+func copyTo(label, d int) []Op {
+	return append([]Op{Shift(d), Zero(), Shift(-d)}, move(label, d)...)
+}
+
+func TestRangeOps(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  []Op
+		want []Op
+	}{
+		{
+			name: "clear up",
+			ops:  []Op{Zero(), Shift(1), Zero(), Shift(1), Zero()},
+			want: []Op{ZeroRange(3), Shift(2)},
+		},
+		{
+			name: "clear down",
+			ops:  []Op{Zero(), Shift(-1), Zero(), Shift(-1), Zero()},
+			want: []Op{Shift(-2), ZeroRange(3)},
+		},
+		{
+			name: "repeated clear",
+			ops:  []Op{Zero(), Zero()},
+			want: []Op{Zero(), Zero()},
+		},
+		{
+			name: "repeated clear after a run",
+			ops:  []Op{Zero(), Shift(1), Zero(), Zero()},
+			want: []Op{ZeroRange(2), Shift(1), Zero()},
+		},
+		{
+			name: "mixed steps",
+			ops:  []Op{Zero(), Shift(1), Zero(), Shift(-1), Zero()},
+			want: []Op{ZeroRange(2), Zero()},
+		},
+		{
+			name: "mixed steps down first",
+			ops:  []Op{Zero(), Shift(-1), Zero(), Shift(2), Zero()},
+			want: []Op{Shift(-1), ZeroRange(2), Shift(2), Zero()},
+		},
+		{
+			name: "copy up",
+			ops:  slices.Concat(copyTo(1, 3), []Op{Shift(1)}, copyTo(2, 3)),
+			want: []Op{CopyRange(2, 3), ZeroRange(2), Shift(1)},
+		},
+		{
+			name: "copy down",
+			ops:  slices.Concat(copyTo(1, 3), []Op{Shift(-1)}, copyTo(2, 3)),
+			want: []Op{Shift(-1), CopyRange(2, 3), ZeroRange(2)},
+		},
+		{
+			name: "repeated copy",
+			ops:  slices.Concat(copyTo(1, 3), copyTo(2, 3)),
+			want: []Op{CopyRange(1, 3), ZeroRange(1), CopyRange(1, 3), ZeroRange(1)},
+		},
+		{
+			name: "overlapping copy",
+			ops:  slices.Concat(copyTo(1, 1), []Op{Shift(1)}, copyTo(2, 1)),
+			want: []Op{CopyRange(1, 1), ZeroRange(1), Shift(1), CopyRange(1, 1), ZeroRange(1)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := compact(slices.Clone(tt.ops))
+			rangeOps(ops, CellModel{})
+			if got, want := Dump(compact(ops)), Dump(tt.want); got != want {
+				t.Errorf("got\n%swant\n%s", got, want)
+			}
+		})
+	}
+}
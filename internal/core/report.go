@@ -0,0 +1,57 @@
+package core
+
+import (
+	"fmt"
+	"io"
+)
+
+// Report describes what Optimise did.
+type Report struct {
+	Level    OptLevel
+	Rounds   int         // rounds of passes until nothing changed
+	Before   int         // ops in
+	After    int         // ops out
+	Costs    string      // name of the cost model
+	CostIn   int         // total cost of the ops in, under the model
+	CostOut  int         // total cost of the ops out
+	Passes   []PassCount // in the order the passes run
+	Warnings []Warning
+}
+
+// PassCount is the number of rewrites one pass made over all rounds.
+type PassCount struct {
+	Name     string
+	Rewrites int
+}
+
+// Warning flags a rewrite (or a missed one) worth knowing about.
+type Warning struct {
+	Pos *Position // nil when not tied to one op
+	Msg string
+}
+
+func (w Warning) String() string {
+	if w.Pos == nil {
+		return w.Msg
+	}
+	return InFile(w.Pos, Message(MsgWarningAt, w.Pos.Line, w.Pos.Column, w.Msg))
+}
+
+// warn records a warning.
+func (r *Report) warn(pos *Position, msg string) {
+	r.Warnings = append(r.Warnings, Warning{Pos: pos, Msg: msg})
+}
+
+// WriteText writes the report as a short human readable summary.
+func (r *Report) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "optimised at -O %v: %d -> %d ops in %d rounds\n", r.Level, r.Before, r.After, r.Rounds)
+	if r.Costs != "" {
+		fmt.Fprintf(w, "  cost for %s: %d -> %d\n", r.Costs, r.CostIn, r.CostOut)
+	}
+	for _, p := range r.Passes {
+		fmt.Fprintf(w, "  %-16s %d\n", p.Name, p.Rewrites)
+	}
+	for _, warning := range r.Warnings {
+		fmt.Fprintf(w, "warning: %s\n", warning)
+	}
+}
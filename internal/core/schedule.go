@@ -0,0 +1,97 @@
+package core
+
+import "slices"
+
+// schedule reorders the cell updates in straight-line runs of SHIFT, ADD
+// and ZERO, where it makes the run cheaper under costs:
+//
+//	SHIFT +1, ADD +1, SHIFT -1, ZERO, SHIFT +2, ADD -1, SHIFT -2
+//	ZERO, SHIFT +1, ADD +1, SHIFT +1, ADD -1, SHIFT -2
+//
+// Updates to different cells commute, so each cell's own updates keep
+// their order but the cells are visited lowest or highest offset first,
+// whichever costs least, before moving to where the run leaves the
+// pointer. That takes the fewest and shortest SHIFTs and brings a cell's
+// updates together for mergeAdjacent. The pointer never strays outside
+// the cells the run already visited, so the tape bounds are never crossed
+// when they were not before.
+func schedule(ops []Op, costs *CostModel) int {
+	rescheduled := 0
+
+	for i := 0; i < len(ops); {
+		end := i
+		for end < len(ops) && isCellUpdate(ops[end].Kind) {
+			end++
+		}
+		if end == i {
+			i++
+			continue
+		}
+
+		run := slices.DeleteFunc(slices.Clone(ops[i:end]), func(op Op) bool { return op.Kind == OpNop })
+		if best := bestSchedule(run, costs); best != nil && len(best) <= end-i {
+			copy(ops[i:], best)
+			tombstone(ops, i+len(best), end)
+			rescheduled++
+		}
+		i = end
+	}
+
+	return rescheduled
+}
+
+// isCellUpdate reports whether kind is allowed in a run schedule reorders.
+func isCellUpdate(kind OpKind) bool {
+	return kind == OpShift || kind == OpAdd || kind == OpZero || kind == OpNop
+}
+
+// bestSchedule returns the cheapest reordering of run under costs, or nil
+// if none is cheaper than run itself.
+func bestSchedule(run []Op, costs *CostModel) []Op {
+	updates := make(map[int][]Op) // offset -> the updates to that cell, in order
+	var offsets []int
+	offset := 0
+	for _, op := range run {
+		if op.Kind == OpShift {
+			offset += op.Arg
+			continue
+		}
+		if _, seen := updates[offset]; !seen {
+			offsets = append(offsets, offset)
+		}
+		updates[offset] = append(updates[offset], op)
+	}
+	if len(offsets) < 2 {
+		return nil
+	}
+
+	slices.Sort(offsets)
+	var best []Op
+	bestCost := costs.Total(run)
+	for range 2 {
+		out := visit(offsets, updates, offset)
+		if cost := costs.Total(out); cost < bestCost {
+			best, bestCost = out, cost
+		}
+		slices.Reverse(offsets)
+	}
+	return best
+}
+
+// visit returns the updates to each cell in offsets order, with the SHIFTs
+// between them, then a SHIFT to final.
+func visit(offsets []int, updates map[int][]Op, final int) []Op {
+	var out []Op
+	at := 0
+	for _, offset := range offsets {
+		if offset != at {
+			out = append(out, Shift(offset-at))
+		}
+		out = append(out, updates[offset]...)
+		at = offset
+	}
+	if final != at {
+		out = append(out, Shift(final-at))
+	}
+	return out
+}
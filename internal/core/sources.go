@@ -0,0 +1,111 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Source is one named file of a program.
+type Source struct {
+	Name string
+	Data []byte
+}
+
+// sourceFile is where one file of a Sources starts in the joined source:
+// its byte offset and line.
+type sourceFile struct {
+	name  string
+	start int
+	line  int
+}
+
+// Sources is a program made of several files, joined in order into Src so
+// that it can be tokenized and lowered as one. Each file starts on a line
+// of its own: a newline is put after any file that does not end with one.
+//
+// Positions in Src are made relative to their file, with its name in
+// File, by Locate and the methods built on it. A single file's positions
+// are left as they are, so its diagnostics read as they always have.
+type Sources struct {
+	Src   []byte
+	files []sourceFile
+}
+
+// JoinSources joins files into one program.
+func JoinSources(files ...Source) *Sources {
+	s := &Sources{}
+	line := 1
+	for _, f := range files {
+		start := len(s.Src)
+		s.files = append(s.files, sourceFile{name: f.Name, start: start, line: line})
+		s.Src = append(s.Src, f.Data...)
+		if len(f.Data) > 0 && f.Data[len(f.Data)-1] != '\n' {
+			s.Src = append(s.Src, '\n')
+		}
+		line += bytes.Count(s.Src[start:], []byte{'\n'})
+	}
+	return s
+}
+
+// Names returns the names of the files, in order.
+func (s *Sources) Names() []string {
+	names := make([]string, len(s.files))
+	for i, f := range s.files {
+		names[i] = f.name
+	}
+	return names
+}
+
+// Locate returns pos, a position in Src, relative to the file it is in.
+func (s *Sources) Locate(pos Position) Position {
+	if len(s.files) < 2 {
+		return pos
+	}
+	f := s.files[0]
+	for _, next := range s.files[1:] {
+		if next.start > pos.Offset {
+			break
+		}
+		f = next
+	}
+	pos.Offset -= f.start
+	if pos.Line > 0 {
+		pos.Line -= f.line - 1
+	}
+	pos.File = f.name
+	return pos
+}
+
+// LocateTokens makes the positions of toks, tokenized from Src, relative
+// to their files.
+func (s *Sources) LocateTokens(toks []Token) {
+	for i := range toks {
+		toks[i].Pos = s.Locate(toks[i].Pos)
+	}
+}
+
+// LocateOps makes the positions of ops, lowered from Src, relative to
+// their files. Positions may be shared between ops, so each op gets a new
+// one rather than having its own changed in place.
+func (s *Sources) LocateOps(ops []Op) {
+	if len(s.files) < 2 {
+		return
+	}
+	for i := range ops {
+		if ops[i].Pos != nil {
+			pos := s.Locate(*ops[i].Pos)
+			ops[i].Pos = &pos
+		}
+	}
+}
+
+// LocateError returns err, from lowering Src, with the position of an
+// *Error in it made relative to its file. Other errors are returned as
+// they are.
+func (s *Sources) LocateError(err error) error {
+	var srcErr *Error
+	if len(s.files) < 2 || !errors.As(err, &srcErr) {
+		return err
+	}
+	return &Error{Msg: srcErr.Msg, Pos: s.Locate(srcErr.Pos)}
+}
@@ -0,0 +1,263 @@
+package core
+
+import (
+	"slices"
+	"strings"
+)
+
+// The loops superopt searches, and the replacements it tries.
+const (
+	superoptMaxLoop = 6       // ops in a loop, brackets included
+	superoptMaxLen  = 3       // ops in a replacement
+	superoptSteps   = 1 << 16 // ops one test of a loop may run
+)
+
+// superoptEntries are the entry cell values a candidate is tried on first,
+// before the other 250: most wrong candidates fail on one of these.
+var superoptEntries = []byte{0, 1, 2, 3, 127, 128, 255}
+
+// superopt replaces small innermost loops with shorter straight-line code
+// that does the same, found by exhaustive search. A loop qualifies when it
+// has at most superoptMaxLoop ops, only SHIFT, ADD and ZERO in its body,
+// and leaves the pointer where it found it. Every sequence of up to
+// superoptMaxLen SHIFTs, ADDs and ZEROs that is shorter and cheaper under
+// costs is tried, shortest first, and the first that does what the loop
+// does, as Eval sees it under cells, replaces it:
+//
+//	JZ, ADD -3, JNZ     ZERO (with wrapping cells)
+//	JZ, ADD -2, JNZ     ZERO (with saturating unsigned cells)
+//
+// "Does the same" is tested, not proved: on all 256 values of the entry
+// cell, with the cells a cell either side of what the body touches all 0,
+// all 1, all 255, and all different. The loop must halt without error on
+// every one. Each loop body is searched once per Optimise, in cache.
+func superopt(ops []Op, cells CellModel, costs *CostModel, cache map[string][]Op) int {
+	replaced := 0
+	ends := loopEnds(ops)
+	for i, op := range ops {
+		if op.Kind != OpJz || ends[i] < 0 {
+			continue
+		}
+		loop := slices.DeleteFunc(slices.Clone(ops[i:ends[i]+1]), func(op Op) bool { return op.Kind == OpNop })
+		if len(loop) > superoptMaxLoop || !superoptable(loop[1:len(loop)-1]) {
+			continue
+		}
+
+		key := superoptKey(loop)
+		better, seen := cache[key]
+		if !seen {
+			better = searchLoop(loop, cells, costs)
+			cache[key] = better
+		}
+		if better == nil {
+			continue
+		}
+
+		tombstone(ops, i, ends[i]+1)
+		for j, b := range better {
+			ops[i+j] = Op{Kind: b.Kind, Arg: b.Arg, Pos: op.Pos}
+		}
+		replaced++
+	}
+	return replaced
+}
+
+// superoptable reports whether a loop body is one superopt searches: only
+// SHIFT, ADD and ZERO, with the pointer back where it started.
+func superoptable(body []Op) bool {
+	offset := 0
+	for _, op := range body {
+		switch op.Kind {
+		case OpShift:
+			offset += op.Arg
+		case OpAdd, OpZero:
+		default:
+			return false
+		}
+	}
+	return offset == 0
+}
+
+// superoptKey names a loop by its body, for the cache.
+func superoptKey(loop []Op) string {
+	var b strings.Builder
+	for _, op := range loop[1 : len(loop)-1] {
+		b.WriteString(op.String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// searchLoop returns the shortest sequence that does what loop does under
+// cells, shorter and cheaper than it, or nil if there is none.
+func searchLoop(loop []Op, cells CellModel, costs *CostModel) []Op {
+	body := loop[1 : len(loop)-1]
+	lo, hi, offset := 0, 0, 0
+	adds := []int{1, -1, 2, -2}
+	for _, op := range body {
+		switch op.Kind {
+		case OpShift:
+			offset += op.Arg
+			lo, hi = min(lo, offset), max(hi, offset)
+		case OpAdd:
+			for _, k := range []int{op.Arg, -op.Arg} {
+				if !slices.Contains(adds, k) {
+					adds = append(adds, k)
+				}
+			}
+		}
+	}
+
+	t := newLoopTest(lo, hi, cells)
+	inner := slices.Clone(loop)
+	inner[0].Arg, inner[len(inner)-1].Arg = 0, 0
+	want := make([][]byte, 256*len(t.patterns))
+	for entry := range 256 {
+		for p := range t.patterns {
+			out, err := t.run(inner, byte(entry), p)
+			if err != nil {
+				return nil // the loop fails or spins on some state
+			}
+			want[entry*len(t.patterns)+p] = out
+		}
+	}
+
+	alphabet := []Op{Zero()}
+	for _, k := range adds {
+		alphabet = append(alphabet, Add(k))
+	}
+	for k := lo - hi; k <= hi-lo; k++ {
+		if k != 0 {
+			alphabet = append(alphabet, Shift(k))
+		}
+	}
+
+	limit := costs.Total(loop)
+	for n := 0; n < len(loop) && n <= superoptMaxLen; n++ {
+		var found []Op
+		candidates(alphabet, n, lo, hi, func(seq []Op) bool {
+			if costs.Total(seq) >= limit || !t.matches(seq, want) {
+				return true
+			}
+			found = slices.Clone(seq)
+			return false
+		})
+		if found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// candidates calls yield with each sequence of n ops from alphabet that
+// keeps the pointer within lo to hi and returns it to 0, with no two
+// SHIFTs or two ADDs in a row, until yield returns false.
+func candidates(alphabet []Op, n, lo, hi int, yield func([]Op) bool) {
+	seq := make([]Op, 0, n)
+	var extend func(offset int) bool
+	extend = func(offset int) bool {
+		if len(seq) == n {
+			return offset != 0 || yield(seq)
+		}
+		for _, op := range alphabet {
+			next := offset
+			if op.Kind == OpShift {
+				next += op.Arg
+			}
+			if next < lo || next > hi {
+				continue
+			}
+			if last := len(seq) - 1; last >= 0 && seq[last].Kind == op.Kind && op.Kind != OpZero {
+				continue
+			}
+			seq = append(seq, op)
+			ok := extend(next)
+			seq = seq[:len(seq)-1]
+			if !ok {
+				return false
+			}
+		}
+		return true
+	}
+	extend(0)
+}
+
+// loopTest runs code on a small tape set up in one of the states searchLoop
+// tries, and returns the cells around the pointer afterwards.
+type loopTest struct {
+	lo, hi   int // the cells a loop's body touches, from its pointer
+	cells    CellModel
+	patterns [][]byte // values for the cells from lo-1 to hi+1, but the entry cell's
+}
+
+func newLoopTest(lo, hi int, cells CellModel) *loopTest {
+	t := &loopTest{lo: lo, hi: hi, cells: cells}
+	n := hi - lo + 3
+	distinct := make([]byte, n)
+	for k := range distinct {
+		distinct[k] = byte(37*k + 11)
+	}
+	t.patterns = [][]byte{
+		make([]byte, n),
+		slices.Repeat([]byte{1}, n),
+		slices.Repeat([]byte{255}, n),
+		distinct,
+	}
+	return t
+}
+
+// run evaluates code with the pointer on entry and the cells around it
+// from the pattern'th pattern, and returns those cells afterwards.
+func (t *loopTest) run(code []Op, entry byte, pattern int) ([]byte, error) {
+	values := slices.Clone(t.patterns[pattern])
+	start := 1 - t.lo // the entry cell's index on the tape
+	values[start] = entry
+
+	ops := make([]Op, 0, 3*len(values)+len(code)+2)
+	at := 0
+	moveTo := func(cell int) {
+		if cell != at {
+			ops = append(ops, Shift(cell-at))
+			at = cell
+		}
+	}
+	for cell, v := range values {
+		if v != 0 {
+			moveTo(cell)
+			ops = append(ops, Add(t.cells.Value(v)))
+		}
+	}
+	moveTo(start)
+	ops = append(ops, code...)
+	for cell := range values {
+		moveTo(cell)
+		ops = append(ops, Out())
+	}
+
+	return Eval(ops, nil, Limits{MaxSteps: superoptSteps, Tape: len(values), Cells: t.cells})
+}
+
+// matches reports whether code leaves every state as want does, trying
+// superoptEntries first.
+func (t *loopTest) matches(code []Op, want [][]byte) bool {
+	try := func(entry byte) bool {
+		for p := range t.patterns {
+			out, err := t.run(code, entry, p)
+			if err != nil || string(out) != string(want[int(entry)*len(t.patterns)+p]) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, entry := range superoptEntries {
+		if !try(entry) {
+			return false
+		}
+	}
+	for entry := range 256 {
+		if !slices.Contains(superoptEntries, byte(entry)) && !try(byte(entry)) {
+			return false
+		}
+	}
+	return true
+}
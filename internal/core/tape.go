@@ -0,0 +1,36 @@
+package core
+
+import "fmt"
+
+// TapeBound selects what happens when the data pointer moves past one end
+// of the tape. Underflow (below cell 0) and overflow (past the last cell)
+// are configured separately.
+type TapeBound int
+
+const (
+	BoundError TapeBound = iota // stop execution with an error (default)
+	BoundWrap                   // wrap around to the other end of the tape
+	BoundGrow                   // extend the tape in that direction
+)
+
+// boundNames maps each TapeBound to its flag spelling.
+var boundNames = [...]string{
+	BoundError: "error",
+	BoundWrap:  "wrap",
+	BoundGrow:  "grow",
+}
+
+// String returns the flag spelling of the TapeBound.
+func (b TapeBound) String() string {
+	return boundNames[b]
+}
+
+// ParseTapeBound converts a flag value (error, wrap, grow) into a TapeBound.
+func ParseTapeBound(s string) (TapeBound, error) {
+	for b, name := range boundNames {
+		if name == s {
+			return TapeBound(b), nil
+		}
+	}
+	return BoundError, fmt.Errorf("invalid tape bound policy: %q (must be error, wrap, or grow)", s)
+}
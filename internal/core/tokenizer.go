@@ -1,5 +1,7 @@
 package core
 
+import "bytes"
+
 // TokenKind represents the type of a Brainfuck instruction token.
 type TokenKind int
 
@@ -38,12 +40,24 @@ func (k TokenKind) String() string {
 
 // Token represents a single lexical token from the source.
 type Token struct {
-	Kind TokenKind // the type of token
-	Pos  Position  // location in source
+	Kind  TokenKind // the type of token
+	Pos   Position  // location in source
+	NoOpt bool      // a [ with NoOptDirective in the comment before it
 }
 
+// NoOptDirective, in the comment text between a [ and the command before
+// it, marks the loop to be left exactly as lowered by the optimiser, eg.
+// to work around an optimiser bug or keep a loop's step count:
+//
+//	wait for input bfcc:noopt
+//	[-,]
+//
+// It holds no command characters, so the program means the same to any
+// other tool.
+const NoOptDirective = "bfcc:noopt"
+
 // charToToken maps Brainfuck command characters to their token kinds.
-var charToToken = [...]TokenKind{
+var charToToken = [256]TokenKind{
 	'>': TokShiftRight,
 	'<': TokShiftLeft,
 	'+': TokAdd,
@@ -65,6 +79,9 @@ func FoldToken(tokens []Token, i int, kind TokenKind) int {
 	return count
 }
 
+// noOptDirective is NoOptDirective as bytes, for Tokenize.
+var noOptDirective = []byte(NoOptDirective)
+
 // Tokenize converts Brainfuck source code into a slice of tokens.
 // Non-command characters are ignored. The returned slice always ends
 // with a TokEOF token.
@@ -73,12 +90,15 @@ func Tokenize(src []byte) []Token {
 	tokens := make([]Token, 0, len(src)/2)
 
 	line, col := 1, 1
+	comment := 0 // start of the comment text before the next command
 	for i, b := range src {
 		if kind := charToToken[b]; kind != 0 {
 			tokens = append(tokens, Token{
-				Kind: kind,
-				Pos:  Position{Offset: i, Line: line, Column: col},
+				Kind:  kind,
+				Pos:   Position{Offset: i, Line: line, Column: col},
+				NoOpt: kind == TokLBracket && bytes.Contains(src[comment:i], noOptDirective),
 			})
+			comment = i + 1
 		} else if b == '\n' {
 			line++
 			col = 0
@@ -0,0 +1,118 @@
+// Package coverage records which Brainfuck source commands a run executed
+// and renders the result as JSON or an HTML report.
+//
+// Counts are gathered per IR op by the VM and mapped back onto source
+// commands. This relies on the unoptimised (-O 0) IR, where every op covers
+// a run of consecutive tokens, as many as core.Op.Commands gives.
+package coverage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// Command is the execution count of a single source command.
+type Command struct {
+	Offset int    `json:"offset"`
+	Line   int    `json:"line"`
+	Column int    `json:"col"`
+	Char   string `json:"cmd"`
+	Count  uint64 `json:"count"`
+}
+
+// Profile is the coverage of one source file.
+type Profile struct {
+	File     string    `json:"file"`
+	Commands []Command `json:"commands"`
+}
+
+// FromCounts builds a profile from per-op execution counts. toks must be
+// the token stream of src and ops its unoptimised IR.
+func FromCounts(file string, src []byte, toks []core.Token, ops []core.Op, counts []uint64) (*Profile, error) {
+	p := &Profile{File: file, Commands: make([]Command, 0, len(toks))}
+
+	t := 0
+	for i, op := range ops {
+		n := op.Commands()
+		if n == 0 {
+			continue // inserted by the compiler, no source command
+		}
+		if t+n > len(toks) || toks[t].Kind == core.TokEOF {
+			return nil, fmt.Errorf("op %d does not map onto the token stream (was the IR optimised?)", i)
+		}
+
+		for _, tok := range toks[t : t+n] {
+			p.Commands = append(p.Commands, Command{
+				Offset: tok.Pos.Offset,
+				Line:   tok.Pos.Line,
+				Column: tok.Pos.Column,
+				Char:   string(src[tok.Pos.Offset]),
+				Count:  counts[i],
+			})
+		}
+		t += n
+	}
+
+	return p, nil
+}
+
+// OpCounts returns how many times each of ops ran in the profile's run: the
+// count of the source command at the op's position, or 0 for an op with
+// none. ops may be optimised, as only their positions are used, but must
+// come from src, and the profile from a run of it; a profile whose
+// commands are not in src is stale and an error.
+func (p *Profile) OpCounts(src []byte, ops []core.Op) ([]uint64, error) {
+	byOffset := make(map[int]uint64, len(p.Commands))
+	for _, c := range p.Commands {
+		if c.Offset < 0 || c.Offset >= len(src) || string(src[c.Offset]) != c.Char {
+			return nil, fmt.Errorf("profile of %s does not match the source at %d:%d", p.File, c.Line, c.Column)
+		}
+		byOffset[c.Offset] = c.Count
+	}
+
+	counts := make([]uint64, len(ops))
+	for i, op := range ops {
+		if op.Pos != nil {
+			counts[i] = byOffset[op.Pos.Offset]
+		}
+	}
+	return counts, nil
+}
+
+// Covered returns the number of commands executed at least once.
+func (p *Profile) Covered() int {
+	n := 0
+	for _, c := range p.Commands {
+		if c.Count > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// Percent returns the share of commands executed at least once.
+func (p *Profile) Percent() float64 {
+	if len(p.Commands) == 0 {
+		return 100
+	}
+	return 100 * float64(p.Covered()) / float64(len(p.Commands))
+}
+
+// WriteJSON encodes the profile as indented JSON.
+func (p *Profile) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
+// ReadJSON decodes a profile written by WriteJSON.
+func ReadJSON(r io.Reader) (*Profile, error) {
+	var p Profile
+	if err := json.NewDecoder(r).Decode(&p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
@@ -0,0 +1,68 @@
+package coverage
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+)
+
+// htmlTemplate renders the source with each command coloured by coverage.
+var htmlTemplate = template.Must(template.New("coverage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.File}} coverage</title>
+<style>
+body { background: #1e1e1e; color: #777; font-family: sans-serif; }
+pre { font-family: monospace; line-height: 1.3; }
+.hit { color: #4ec94e; }
+.miss { color: #f14c4c; background: #3a1e1e; }
+</style>
+</head>
+<body>
+<h1>{{.File}}</h1>
+<p>{{.Covered}} of {{.Total}} commands covered ({{.Percent}}). Hover a command for its execution count.</p>
+<pre>{{.Source}}</pre>
+</body>
+</html>
+`))
+
+// WriteHTML renders an HTML report of the profile over src, the source the
+// profile was recorded from. Comments are shown dimmed, executed commands
+// green and commands that never ran red.
+func (p *Profile) WriteHTML(w io.Writer, src []byte) error {
+	var body strings.Builder
+
+	next := 0
+	for _, c := range p.Commands {
+		if c.Offset < next || c.Offset >= len(src) {
+			return fmt.Errorf("profile does not match source at offset %d", c.Offset)
+		}
+		template.HTMLEscape(&body, src[next:c.Offset])
+
+		class := "miss"
+		if c.Count > 0 {
+			class = "hit"
+		}
+		fmt.Fprintf(&body, `<span class="%s" title="%d:%d executed %d times">`, class, c.Line, c.Column, c.Count)
+		template.HTMLEscape(&body, src[c.Offset:c.Offset+1])
+		body.WriteString("</span>")
+		next = c.Offset + 1
+	}
+	template.HTMLEscape(&body, src[next:])
+
+	return htmlTemplate.Execute(w, struct {
+		File    string
+		Covered int
+		Total   int
+		Percent string
+		Source  template.HTML
+	}{
+		File:    p.File,
+		Covered: p.Covered(),
+		Total:   len(p.Commands),
+		Percent: fmt.Sprintf("%.1f%%", p.Percent()),
+		Source:  template.HTML(body.String()),
+	})
+}
@@ -0,0 +1,851 @@
+package emu
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// General purpose register numbers, as encoded in ModRM and REX.
+const (
+	rax = iota
+	rcx
+	rdx
+	rbx
+	rsp
+	rbp
+	rsi
+	rdi
+	r8
+	r9
+	r10
+	r11
+	r12
+	r13
+	r14
+	r15
+)
+
+// ALU operations, numbered as in the opcode (op>>3) and group 1 /digit.
+const (
+	aluAdd = 0
+	aluOr  = 1
+	aluAnd = 4
+	aluSub = 5
+	aluXor = 6
+	aluCmp = 7
+)
+
+// inst is the instruction being decoded and run.
+type inst struct {
+	m    *machine
+	at   uint64 // address of the instruction
+	rex  byte   // REX prefix, 0 for none
+	size int    // operand size in bytes: 8 with REX.W, 2 with 0x66, else 4
+	rep  byte   // 0xF3 or 0xF2 prefix, 0 for none
+	p66  bool   // a 0x66 prefix, which SSE ops need even where REX.W sets size
+
+	// The VEX prefix, which also sets rex, size and rep as the prefixes
+	// it stands for would
+	vex  bool
+	vvvv int  // the extra source register
+	vexL bool // 256 bits wide
+
+	// The ModRM operands, once decoded by modrm
+	reg   int // ModRM.reg, extended by REX.R
+	isReg bool
+	rm    int // register operand when isReg
+	base  int // -1 for none
+	index int // -1 for none
+	scale uint64
+	disp  int64
+	rip   bool // RIP-relative
+}
+
+// fault returns a Fault at the instruction.
+func (in *inst) fault(err error, format string, args ...any) error {
+	return &Fault{RIP: in.at, Err: err, Msg: fmt.Sprintf(format, args...)}
+}
+
+// unsupported returns the fault for an instruction the emulator does not
+// decode, showing its first bytes.
+func (in *inst) unsupported() error {
+	code := in.m.bytesAt(in.at, 1)
+	for n := 8; n > 1; n-- {
+		if b := in.m.bytesAt(in.at, n); b != nil {
+			code = b
+			break
+		}
+	}
+	return in.fault(ErrUnsupported, "% x", code)
+}
+
+// fetch reads an n byte little-endian immediate at RIP and advances it.
+func (in *inst) fetch(n int) (uint64, error) {
+	v, err := in.m.read(in.m.rip, n)
+	if err != nil {
+		return 0, in.fault(ErrSegv, "fetching code")
+	}
+	in.m.rip += uint64(n)
+	return v, nil
+}
+
+// fetchS reads a sign-extended n byte immediate.
+func (in *inst) fetchS(n int) (uint64, error) {
+	v, err := in.fetch(n)
+	return signExtend(v, n), err
+}
+
+// signExtend extends the low n bytes of v to 64 bits.
+func signExtend(v uint64, n int) uint64 {
+	shift := 64 - 8*n
+	return uint64(int64(v<<shift) >> shift)
+}
+
+// mask returns the bits of an n byte value.
+func mask(n int) uint64 {
+	if n == 8 {
+		return ^uint64(0)
+	}
+	return 1<<(8*n) - 1
+}
+
+// modrm decodes the ModRM byte and any SIB and displacement.
+func (in *inst) modrm() error {
+	b, err := in.fetch(1)
+	if err != nil {
+		return err
+	}
+	mod, rm := b>>6, int(b&7)
+	in.reg = int(b>>3&7) | int(in.rex&4)<<1
+	if mod == 3 {
+		in.isReg, in.rm = true, rm|int(in.rex&1)<<3
+		return nil
+	}
+
+	in.base, in.index, in.scale = -1, -1, 1
+	switch {
+	case rm == 4:
+		sib, err := in.fetch(1)
+		if err != nil {
+			return err
+		}
+		if idx := int(sib>>3&7) | int(in.rex&2)<<2; idx != rsp {
+			in.index, in.scale = idx, 1<<(sib>>6)
+		}
+		if base := int(sib & 7); base == rbp && mod == 0 {
+			mod = 2 // disp32 with no base
+		} else {
+			in.base = base | int(in.rex&1)<<3
+		}
+	case rm == 5 && mod == 0:
+		in.rip = true
+		mod = 2
+	default:
+		in.base = rm | int(in.rex&1)<<3
+	}
+
+	switch mod {
+	case 1:
+		d, err := in.fetchS(1)
+		in.disp = int64(d)
+		return err
+	case 2:
+		d, err := in.fetchS(4)
+		in.disp = int64(d)
+		return err
+	}
+	return nil
+}
+
+// addr returns the memory operand's address. RIP-relative addresses count
+// from the end of the instruction, so all immediates must be fetched first.
+func (in *inst) addr() uint64 {
+	a := uint64(in.disp)
+	if in.rip {
+		a += in.m.rip
+	}
+	if in.base >= 0 {
+		a += in.m.regs[in.base]
+	}
+	if in.index >= 0 {
+		a += in.m.regs[in.index] * in.scale
+	}
+	return a
+}
+
+// getReg reads the low size bytes of register n. Without REX, byte
+// registers 4 to 7 are AH, CH, DH and BH.
+func (in *inst) getReg(n, size int) uint64 {
+	if size == 1 && in.rex == 0 && n >= 4 && n < 8 {
+		return in.m.regs[n-4] >> 8 & 0xff
+	}
+	return in.m.regs[n] & mask(size)
+}
+
+// setReg writes the low size bytes of register n. 32-bit writes clear the
+// upper half, narrower ones leave the rest alone.
+func (in *inst) setReg(n, size int, v uint64) {
+	r := &in.m.regs[n]
+	switch {
+	case size == 1 && in.rex == 0 && n >= 4 && n < 8:
+		r = &in.m.regs[n-4]
+		*r = *r&^0xff00 | (v&0xff)<<8
+	case size == 4:
+		*r = v & mask(4)
+	default:
+		*r = *r&^mask(size) | v&mask(size)
+	}
+}
+
+// getRM reads the ModRM r/m operand.
+func (in *inst) getRM(size int) (uint64, error) {
+	if in.isReg {
+		return in.getReg(in.rm, size), nil
+	}
+	return in.m.read(in.addr(), size)
+}
+
+// setRM writes the ModRM r/m operand.
+func (in *inst) setRM(size int, v uint64) error {
+	if in.isReg {
+		in.setReg(in.rm, size, v)
+		return nil
+	}
+	return in.m.write(in.addr(), size, v)
+}
+
+// result sets ZF and SF from an n byte result.
+func (m *machine) result(v uint64, n int) uint64 {
+	v &= mask(n)
+	m.zf = v == 0
+	m.sf = v>>(8*n-1)&1 == 1
+	return v
+}
+
+// alu computes a op b on n byte operands and sets the flags.
+func (m *machine) alu(op int, a, b uint64, n int) (uint64, bool) {
+	a, b = a&mask(n), b&mask(n)
+	top := uint(8*n - 1)
+	switch op {
+	case aluAdd:
+		r := m.result(a+b, n)
+		m.cf = r < a
+		m.of = ((a^r)&(b^r))>>top&1 == 1
+		return r, true
+	case aluSub, aluCmp:
+		r := m.result(a-b, n)
+		m.cf = a < b
+		m.of = ((a^b)&(a^r))>>top&1 == 1
+		return r, op == aluSub
+	case aluOr:
+		m.cf, m.of = false, false
+		return m.result(a|b, n), true
+	case aluAnd:
+		m.cf, m.of = false, false
+		return m.result(a&b, n), true
+	case aluXor:
+		m.cf, m.of = false, false
+		return m.result(a^b, n), true
+	}
+	return 0, false
+}
+
+// cond reports whether condition code cc (the low nibble of a jcc,
+// setcc or cmovcc opcode) holds. Parity is not kept.
+func (m *machine) cond(cc byte) (bool, bool) {
+	var c bool
+	switch cc >> 1 {
+	case 0:
+		c = m.of
+	case 1:
+		c = m.cf
+	case 2:
+		c = m.zf
+	case 3:
+		c = m.cf || m.zf
+	case 4:
+		c = m.sf
+	case 5:
+		return false, false // parity
+	case 6:
+		c = m.sf != m.of
+	case 7:
+		c = m.zf || m.sf != m.of
+	}
+	return c != (cc&1 == 1), true
+}
+
+// push and pop move a quadword through the stack.
+func (m *machine) push(v uint64) error {
+	m.regs[rsp] -= 8
+	return m.write(m.regs[rsp], 8, v)
+}
+
+func (m *machine) pop() (uint64, error) {
+	v, err := m.read(m.regs[rsp], 8)
+	m.regs[rsp] += 8
+	return v, err
+}
+
+// step decodes and runs one instruction.
+func (m *machine) step() error {
+	m.at = m.rip
+	in := &inst{m: m, at: m.rip, size: 4}
+	op, err := in.prefixes()
+	if err != nil {
+		return err
+	}
+	if in.rex&8 != 0 {
+		in.size = 8
+	}
+
+	// The ALU block: add, or, and, sub, xor and cmp in their six forms
+	if op < 0x40 && op&7 <= 5 {
+		return in.aluForm(int(op>>3), op&7)
+	}
+
+	switch {
+	case op >= 0x50 && op <= 0x57:
+		return m.push(m.regs[int(op-0x50)|int(in.rex&1)<<3])
+	case op >= 0x58 && op <= 0x5f:
+		v, err := m.pop()
+		m.regs[int(op-0x58)|int(in.rex&1)<<3] = v
+		return err
+	case op >= 0x70 && op <= 0x7f:
+		rel, err := in.fetchS(1)
+		if err != nil {
+			return err
+		}
+		return in.jcc(op&0xf, rel)
+	case op >= 0xb0 && op <= 0xb7:
+		v, err := in.fetch(1)
+		in.setReg(int(op-0xb0)|int(in.rex&1)<<3, 1, v)
+		return err
+	case op >= 0xb8 && op <= 0xbf:
+		// imm64 with REX.W (movabs), otherwise zero-extended
+		v, err := in.fetch(in.size)
+		in.setReg(int(op-0xb8)|int(in.rex&1)<<3, in.size, v)
+		return err
+	}
+
+	switch op {
+	case 0x0f:
+		return in.twoByte()
+	case 0x68, 0x6a:
+		n := 4
+		if op == 0x6a {
+			n = 1
+		}
+		v, err := in.fetchS(n)
+		if err != nil {
+			return err
+		}
+		return m.push(v)
+	case 0x69, 0x6b:
+		return in.imul(op)
+	case 0x80, 0x81, 0x83:
+		return in.group1(op)
+	case 0x84, 0x85:
+		n := in.byteOr(op == 0x84)
+		if err := in.modrm(); err != nil {
+			return err
+		}
+		a, err := in.getRM(n)
+		m.alu(aluAnd, a, in.getReg(in.reg, n), n)
+		return err
+	case 0x88, 0x89, 0x8a, 0x8b:
+		n := in.byteOr(op&1 == 0)
+		if err := in.modrm(); err != nil {
+			return err
+		}
+		if op >= 0x8a {
+			v, err := in.getRM(n)
+			in.setReg(in.reg, n, v)
+			return err
+		}
+		return in.setRM(n, in.getReg(in.reg, n))
+	case 0x8d:
+		if err := in.modrm(); err != nil {
+			return err
+		}
+		if in.isReg {
+			return in.fault(ErrIllegal, "lea with a register operand")
+		}
+		in.setReg(in.reg, in.size, in.addr())
+		return nil
+	case 0x90:
+		return nil // nop, or xchg %ax, %ax with 0x66
+	case 0xa4, 0xaa, 0xae:
+		return in.stringOp(op)
+	case 0xa8, 0xa9:
+		n := in.byteOr(op == 0xa8)
+		v, err := in.fetchS(min(n, 4))
+		m.alu(aluAnd, in.getReg(rax, n), v, n)
+		return err
+	case 0xc0, 0xc1, 0xd0, 0xd1, 0xd2, 0xd3:
+		return in.shift(op)
+	case 0xc3:
+		v, err := m.pop()
+		m.rip = v
+		return err
+	case 0xc4, 0xc5:
+		return in.vexOp(op)
+	case 0xc6, 0xc7:
+		n := in.byteOr(op == 0xc6)
+		if err := in.modrm(); err != nil {
+			return err
+		}
+		if in.reg != 0 {
+			return in.unsupported()
+		}
+		v, err := in.fetchS(min(n, 4))
+		if err != nil {
+			return err
+		}
+		return in.setRM(n, v)
+	case 0xcc:
+		return in.fault(ErrTrap, "int3")
+	case 0xe8:
+		rel, err := in.fetchS(4)
+		if err != nil {
+			return err
+		}
+		if err := m.push(m.rip); err != nil {
+			return err
+		}
+		m.rip += rel
+		return nil
+	case 0xe9, 0xeb:
+		n := 4
+		if op == 0xeb {
+			n = 1
+		}
+		rel, err := in.fetchS(n)
+		m.rip += rel
+		return err
+	case 0xf4:
+		return in.fault(ErrIllegal, "hlt in user mode")
+	case 0xf6, 0xf7:
+		return in.group3(op)
+	case 0xfc, 0xfd:
+		m.df = op == 0xfd
+		return nil
+	case 0xfe, 0xff:
+		return in.group5(op)
+	}
+	return in.unsupported()
+}
+
+// prefixes reads the legacy and REX prefixes, returning the opcode byte.
+func (in *inst) prefixes() (byte, error) {
+	for {
+		b, err := in.fetch(1)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case b == 0x66:
+			in.size, in.p66 = 2, true
+		case b == 0xf2 || b == 0xf3:
+			in.rep = byte(b)
+		case b&0xf0 == 0x40:
+			// REX must come last, straight before the opcode
+			in.rex = byte(b)
+			op, err := in.fetch(1)
+			return byte(op), err
+		default:
+			return byte(b), nil
+		}
+	}
+}
+
+// byteOr returns 1 for a byte form of an instruction, otherwise the
+// operand size.
+func (in *inst) byteOr(byteForm bool) int {
+	if byteForm {
+		return 1
+	}
+	return in.size
+}
+
+// aluForm runs an ALU opcode below 0x40: r/m8,r8; r/m,r; r8,r/m8; r,r/m;
+// AL,imm8; or eAX,imm32.
+func (in *inst) aluForm(op int, form byte) error {
+	m := in.m
+	n := in.byteOr(form%2 == 0)
+	if form >= 4 {
+		imm, err := in.fetchS(min(n, 4))
+		if err != nil {
+			return err
+		}
+		if r, store := m.alu(op, in.getReg(rax, n), imm, n); store {
+			in.setReg(rax, n, r)
+		}
+		return nil
+	}
+
+	if err := in.modrm(); err != nil {
+		return err
+	}
+	a, err := in.getRM(n)
+	if err != nil {
+		return err
+	}
+	b := in.getReg(in.reg, n)
+	if form >= 2 {
+		// Register destination
+		if r, store := m.alu(op, b, a, n); store {
+			in.setReg(in.reg, n, r)
+		}
+		return nil
+	}
+	if r, store := m.alu(op, a, b, n); store {
+		return in.setRM(n, r)
+	}
+	return nil
+}
+
+// group1 runs 80 (r/m8, imm8), 81 (r/m, imm32) and 83 (r/m, imm8): the
+// ALU op is ModRM.reg.
+func (in *inst) group1(op byte) error {
+	if err := in.modrm(); err != nil {
+		return err
+	}
+	n, immSize := in.size, 4
+	switch op {
+	case 0x80:
+		n, immSize = 1, 1
+	case 0x83:
+		immSize = 1
+	}
+	immSize = min(immSize, n)
+	imm, err := in.fetchS(immSize)
+	if err != nil {
+		return err
+	}
+	switch in.reg {
+	case 2, 3:
+		return in.unsupported() // adc, sbb
+	}
+
+	a, err := in.getRM(n)
+	if err != nil {
+		return err
+	}
+	if r, store := in.m.alu(in.reg, a, imm, n); store {
+		return in.setRM(n, r)
+	}
+	return nil
+}
+
+// group3 runs F6 and F7: test with an immediate, not and neg.
+func (in *inst) group3(op byte) error {
+	m := in.m
+	n := in.byteOr(op == 0xf6)
+	if err := in.modrm(); err != nil {
+		return err
+	}
+	switch in.reg {
+	case 0:
+		imm, err := in.fetchS(min(n, 4))
+		if err != nil {
+			return err
+		}
+		a, err := in.getRM(n)
+		m.alu(aluAnd, a, imm, n)
+		return err
+	case 2:
+		a, err := in.getRM(n)
+		if err != nil {
+			return err
+		}
+		return in.setRM(n, ^a)
+	case 3:
+		a, err := in.getRM(n)
+		if err != nil {
+			return err
+		}
+		r, _ := m.alu(aluSub, 0, a, n)
+		return in.setRM(n, r)
+	}
+	return in.unsupported()
+}
+
+// group5 runs FE and FF: inc and dec, which leave CF alone.
+func (in *inst) group5(op byte) error {
+	m := in.m
+	n := in.byteOr(op == 0xfe)
+	if err := in.modrm(); err != nil {
+		return err
+	}
+	if in.reg > 1 {
+		return in.unsupported()
+	}
+	a, err := in.getRM(n)
+	if err != nil {
+		return err
+	}
+	cf := m.cf
+	aluOp := aluAdd
+	if in.reg == 1 {
+		aluOp = aluSub
+	}
+	r, _ := m.alu(aluOp, a, 1, n)
+	m.cf = cf
+	return in.setRM(n, r)
+}
+
+// shift runs the C0/C1 (imm8), D0/D1 (by 1) and D2/D3 (by CL) shifts:
+// shl, shr and sar.
+func (in *inst) shift(op byte) error {
+	m := in.m
+	n := in.byteOr(op&1 == 0)
+	if err := in.modrm(); err != nil {
+		return err
+	}
+	count := uint64(1)
+	switch op {
+	case 0xc0, 0xc1:
+		c, err := in.fetch(1)
+		if err != nil {
+			return err
+		}
+		count = c
+	case 0xd2, 0xd3:
+		count = m.regs[rcx]
+	}
+	if n == 8 {
+		count &= 0x3f
+	} else {
+		count &= 0x1f
+	}
+
+	a, err := in.getRM(n)
+	if err != nil || count == 0 {
+		return err
+	}
+	top := uint(8*n - 1)
+	var r uint64
+	switch in.reg {
+	case 4: // shl
+		m.cf = a>>(uint(8*n)-uint(count))&1 == 1
+		r = m.result(a<<count, n)
+		m.of = (r>>top&1 == 1) != m.cf
+	case 5: // shr
+		m.cf = a>>(count-1)&1 == 1
+		m.of = a>>top&1 == 1
+		r = m.result(a>>count, n)
+	case 7: // sar
+		s := int64(signExtend(a, n))
+		m.cf = s>>(count-1)&1 == 1
+		m.of = false
+		r = m.result(uint64(s>>count), n)
+	default:
+		return in.unsupported()
+	}
+	return in.setRM(n, r)
+}
+
+// imul runs 69 (imm32) and 6B (imm8): reg = r/m * imm.
+func (in *inst) imul(op byte) error {
+	if err := in.modrm(); err != nil {
+		return err
+	}
+	immSize := 1
+	if op == 0x69 {
+		immSize = min(in.size, 4)
+	}
+	imm, err := in.fetchS(immSize)
+	if err != nil {
+		return err
+	}
+	a, err := in.getRM(in.size)
+	if err != nil {
+		return err
+	}
+	in.setReg(in.reg, in.size, in.m.mul(a, imm, in.size))
+	return nil
+}
+
+// mul returns the low n bytes of the signed product a*b, setting CF and OF
+// when it was truncated.
+func (m *machine) mul(a, b uint64, n int) uint64 {
+	x, y := int64(signExtend(a, n)), int64(signExtend(b, n))
+	hi, lo := bits.Mul64(uint64(x), uint64(y))
+	// Correct the unsigned high word for the signs
+	if x < 0 {
+		hi -= uint64(y)
+	}
+	if y < 0 {
+		hi -= uint64(x)
+	}
+	r := lo & mask(n)
+	full := signExtend(r, n) == lo && (hi == 0 && int64(lo) >= 0 || hi == ^uint64(0) && int64(lo) < 0)
+	m.cf, m.of = !full, !full
+	return r
+}
+
+// jcc jumps rel bytes if condition cc holds.
+func (in *inst) jcc(cc byte, rel uint64) error {
+	taken, ok := in.m.cond(cc)
+	if !ok {
+		return in.unsupported()
+	}
+	if taken {
+		in.m.rip += rel
+	}
+	return nil
+}
+
+// twoByte runs the 0F xx opcodes.
+func (in *inst) twoByte() error {
+	m := in.m
+	b, err := in.fetch(1)
+	if err != nil {
+		return err
+	}
+	op := byte(b)
+
+	switch {
+	case op >= 0x80 && op <= 0x8f:
+		rel, err := in.fetchS(4)
+		if err != nil {
+			return err
+		}
+		return in.jcc(op&0xf, rel)
+	case op >= 0x40 && op <= 0x4f, op >= 0x90 && op <= 0x9f:
+		if err := in.modrm(); err != nil {
+			return err
+		}
+		c, ok := m.cond(op & 0xf)
+		if !ok {
+			return in.unsupported()
+		}
+		if op >= 0x90 {
+			// setcc
+			v := uint64(0)
+			if c {
+				v = 1
+			}
+			return in.setRM(1, v)
+		}
+		// cmovcc, which zero-extends a 32-bit destination either way
+		v, err := in.getRM(in.size)
+		if !c {
+			v = in.getReg(in.reg, in.size)
+		}
+		in.setReg(in.reg, in.size, v)
+		return err
+	}
+
+	switch op {
+	case 0x05:
+		m.syscall()
+		return nil
+	case 0x01:
+		b, err := in.fetch(1)
+		if err != nil || b != 0xd0 {
+			break
+		}
+		// xgetbv, of XCR0 alone
+		if m.regs[rcx]&mask(4) != 0 {
+			return in.fault(ErrIllegal, "xgetbv of XCR%d", m.regs[rcx]&mask(4))
+		}
+		m.regs[rax], m.regs[rdx] = xcr0AVX, 0
+		return nil
+	case 0x0b:
+		return in.fault(ErrIllegal, "ud2")
+	case 0x1f:
+		return in.modrm() // nop r/m
+	case 0x6f, 0x7f:
+		if in.size == 2 || in.rep == 0xf3 {
+			return in.vecOp(op)
+		}
+	case 0x6c, 0x74, 0xd7, 0xef, 0xfc:
+		if in.size == 2 {
+			return in.vecOp(op)
+		}
+	case 0x6e:
+		if in.p66 {
+			return in.vecOp(op)
+		}
+	case 0xaf:
+		if err := in.modrm(); err != nil {
+			return err
+		}
+		a, err := in.getRM(in.size)
+		in.setReg(in.reg, in.size, m.mul(in.getReg(in.reg, in.size), a, in.size))
+		return err
+	case 0xa2:
+		m.cpuid()
+		return nil
+	case 0xba:
+		return in.bitTest()
+	case 0xbc, 0xbd:
+		return in.bitScan(op)
+	case 0xb6, 0xb7, 0xbe, 0xbf:
+		n := 1
+		if op&1 == 1 {
+			n = 2
+		}
+		if err := in.modrm(); err != nil {
+			return err
+		}
+		v, err := in.getRM(n)
+		if op >= 0xbe {
+			v = signExtend(v, n)
+		}
+		in.setReg(in.reg, in.size, v)
+		return err
+	}
+	return in.unsupported()
+}
+
+// stringOp runs movsb (A4), stosb (AA) and scasb (AE), repeated RCX times
+// with a rep prefix. repe/repne scasb also stop on a mismatch or match.
+func (in *inst) stringOp(op byte) error {
+	m := in.m
+	step := uint64(1)
+	if m.df {
+		step = ^uint64(0)
+	}
+
+	for {
+		if in.rep != 0 {
+			if m.regs[rcx] == 0 {
+				return nil
+			}
+			m.regs[rcx]--
+		}
+
+		switch op {
+		case 0xa4:
+			v, err := m.read(m.regs[rsi], 1)
+			if err != nil {
+				return err
+			}
+			if err := m.write(m.regs[rdi], 1, v); err != nil {
+				return err
+			}
+			m.regs[rsi] += step
+		case 0xaa:
+			if err := m.write(m.regs[rdi], 1, m.regs[rax]); err != nil {
+				return err
+			}
+		case 0xae:
+			v, err := m.read(m.regs[rdi], 1)
+			if err != nil {
+				return err
+			}
+			m.alu(aluCmp, m.regs[rax], v, 1)
+		}
+		m.regs[rdi] += step
+
+		switch {
+		case in.rep == 0:
+			return nil
+		case op == 0xae && in.rep == 0xf3 && !m.zf, op == 0xae && in.rep == 0xf2 && m.zf:
+			return nil
+		}
+	}
+}
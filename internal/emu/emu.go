@@ -0,0 +1,412 @@
+// Package emu is a small x86_64 Linux user-mode emulator, for checking
+// generated code on any host OS or architecture without writing and
+// executing a file. It runs static ELF64 executables such as those from
+// the linux package's X86_64Generator.
+//
+// Only the instruction subset a code generator plausibly emits is decoded:
+// integer moves, arithmetic, logic and shifts, compares and tests, bit
+// scans, jumps, calls, push and pop, rep string ops, syscall, the SSE2
+// and AVX2 loads, stores, compares and masks of scan loops and range ops,
+// with the CPUID and XGETBV that check for AVX2, and the SSE2 adds of runs
+// of ADDs. Anything else stops the
+// run with a Fault wrapping ErrUnsupported. The parity and auxiliary
+// carry flags are not kept, so the conditions that read parity are
+// unsupported.
+//
+// Syscalls are stubbed in process: read from the configured input, write
+// and writev to buffers, anonymous mmap, and exit. File descriptors 1, 2 and
+// trace.FD are writable; other syscalls fail with ENOSYS.
+package emu
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lcox74/bfcc/internal/trace"
+)
+
+// Config is the process an executable runs as.
+type Config struct {
+	Input []byte   // read from stdin
+	Args  []string // argv after argv[0], which is "prog"
+	Env   []string // environment, as KEY=value
+
+	MaxSteps uint64    // instructions run before ErrStepLimit, 0 for no limit
+	Deadline time.Time // time after which the run fails with ErrDeadline, zero for none
+}
+
+// Result is a run that exited.
+type Result struct {
+	Stdout []byte
+	Stderr []byte
+	Trace  []byte // written to trace.FD
+	Exit   int    // exit status
+	Steps  uint64 // instructions run
+}
+
+// Errors wrapped by Fault, or returned as is for the limits.
+var (
+	ErrStepLimit   = errors.New("instruction limit exceeded")
+	ErrDeadline    = errors.New("deadline exceeded")
+	ErrSegv        = errors.New("SIGSEGV: memory access fault")
+	ErrTrap        = errors.New("SIGTRAP: breakpoint")
+	ErrIllegal     = errors.New("SIGILL: illegal instruction")
+	ErrUnsupported = errors.New("instruction not supported by the emulator")
+)
+
+// Fault is a run stopped by the instruction at RIP.
+type Fault struct {
+	RIP uint64
+	Err error
+	Msg string // detail, eg. the address or instruction bytes
+}
+
+func (f *Fault) Error() string {
+	if f.Msg != "" {
+		return fmt.Sprintf("%v at %#x: %s", f.Err, f.RIP, f.Msg)
+	}
+	return fmt.Sprintf("%v at %#x", f.Err, f.RIP)
+}
+
+// Unwrap returns the error Fault wraps.
+func (f *Fault) Unwrap() error {
+	return f.Err
+}
+
+// Process layout. The stack and mmap areas sit well clear of the low
+// addresses static executables load at.
+const (
+	stackTop  = 0x7fff_0000_0000
+	stackSize = 1 << 20
+	mmapBase  = 0x7f00_0000_0000
+	pageSize  = 0x1000
+)
+
+// Linux x86_64 syscall numbers and errno values used by the stubs.
+const (
+	sysRead      = 0
+	sysWrite     = 1
+	sysMmap      = 9
+	sysWritev    = 20
+	sysExit      = 60
+	sysExitGroup = 231
+
+	errBADF   = 9
+	errNOMEM  = 12
+	errFAULT  = 14
+	errINVAL  = 22
+	errNOSYS  = 38
+	protRW    = 3
+	mapAnon   = 0x20
+	mapPriv   = 0x02
+	maxMmap   = 1 << 30
+	iovMax    = 1024      // IOV_MAX, the most iovecs a writev takes
+	checkMask = 1<<16 - 1 // steps between deadline checks
+)
+
+// region is a mapped range of memory.
+type region struct {
+	base uint64
+	data []byte
+}
+
+// machine is the state of a run.
+type machine struct {
+	regs    [16]uint64
+	xmm     [16][32]byte // the ymm registers, xmm in their low halves
+	rip     uint64
+	at      uint64 // address of the instruction running
+	cf, zf  bool
+	sf, of  bool
+	df      bool
+	mem     []region
+	last    *region // most recently used region, usually the code
+	nextMap uint64  // address of the next mmap
+
+	input  []byte
+	stdout bytes.Buffer
+	stderr bytes.Buffer
+	trace  bytes.Buffer
+
+	steps  uint64
+	exited bool
+	status int
+}
+
+// Run loads the ELF64 x86_64 executable and runs it to exit under cfg. A
+// run that faults or hits a limit returns the output so far with the
+// error.
+func Run(binary []byte, cfg Config) (*Result, error) {
+	m, err := load(binary, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	for !m.exited {
+		if cfg.MaxSteps > 0 && m.steps >= cfg.MaxSteps {
+			err = ErrStepLimit
+			break
+		}
+		if m.steps&checkMask == 0 && !cfg.Deadline.IsZero() && time.Now().After(cfg.Deadline) {
+			err = ErrDeadline
+			break
+		}
+		m.steps++
+		if err = m.step(); err != nil {
+			break
+		}
+	}
+
+	r := &Result{
+		Stdout: m.stdout.Bytes(),
+		Stderr: m.stderr.Bytes(),
+		Trace:  m.trace.Bytes(),
+		Exit:   m.status,
+		Steps:  m.steps,
+	}
+	return r, err
+}
+
+// load maps the executable's segments and a stack holding argc, argv and
+// envp, as the kernel does for a static executable.
+func load(binary []byte, cfg Config) (*machine, error) {
+	f, err := elf.NewFile(bytes.NewReader(binary))
+	if err != nil {
+		return nil, err
+	}
+	if f.Class != elf.ELFCLASS64 || f.Machine != elf.EM_X86_64 {
+		return nil, fmt.Errorf("not an x86_64 ELF64 executable (%v %v)", f.Class, f.Machine)
+	}
+
+	m := &machine{rip: f.Entry, input: cfg.Input, nextMap: mmapBase}
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD {
+			continue
+		}
+		// Whole pages, as the kernel maps them, so that running off the
+		// end of a segment faults where it would natively
+		base := p.Vaddr &^ (pageSize - 1)
+		end := (p.Vaddr + p.Memsz + pageSize - 1) &^ (pageSize - 1)
+		data := make([]byte, end-base)
+		if _, err := io.ReadFull(p.Open(), data[p.Vaddr-base:][:p.Filesz]); err != nil {
+			return nil, err
+		}
+		m.mem = append(m.mem, region{base: base, data: data})
+	}
+
+	m.mem = append(m.mem, region{base: stackTop - stackSize, data: make([]byte, stackSize)})
+	m.regs[rsp] = m.setupStack(append([]string{"prog"}, cfg.Args...), cfg.Env)
+	return m, nil
+}
+
+// setupStack writes the strings, then envp, argv and argc below them, and
+// returns the stack pointer, which points at argc.
+func (m *machine) setupStack(args, env []string) uint64 {
+	sp := uint64(stackTop)
+	str := func(s string) uint64 {
+		sp -= uint64(len(s) + 1)
+		m.writeBytes(sp, append([]byte(s), 0))
+		return sp
+	}
+
+	var argv, envp []uint64
+	for _, a := range args {
+		argv = append(argv, str(a))
+	}
+	for _, e := range env {
+		envp = append(envp, str(e))
+	}
+
+	// argc, argv, NULL, envp, NULL and an empty auxv, 16-byte aligned
+	words := []uint64{uint64(len(argv))}
+	words = append(append(words, argv...), 0)
+	words = append(append(words, envp...), 0)
+	words = append(words, 0, 0)
+	sp = (sp - uint64(8*len(words))) &^ 15
+	for i, w := range words {
+		m.write(sp+uint64(8*i), 8, w)
+	}
+	return sp
+}
+
+// find returns the region holding n bytes from addr, or nil.
+func (m *machine) find(addr uint64, n int) *region {
+	if r := m.last; r != nil && addr >= r.base && addr-r.base+uint64(n) <= uint64(len(r.data)) {
+		return r
+	}
+	for i := range m.mem {
+		r := &m.mem[i]
+		if addr >= r.base && addr-r.base+uint64(n) <= uint64(len(r.data)) {
+			m.last = r
+			return r
+		}
+	}
+	return nil
+}
+
+// segv returns the fault for an access to n bytes at addr.
+func (m *machine) segv(addr uint64, n int) error {
+	return &Fault{RIP: m.at, Err: ErrSegv, Msg: fmt.Sprintf("%d bytes at %#x", n, addr)}
+}
+
+// read loads a little-endian value of size bytes.
+func (m *machine) read(addr uint64, size int) (uint64, error) {
+	r := m.find(addr, size)
+	if r == nil {
+		return 0, m.segv(addr, size)
+	}
+	var v uint64
+	b := r.data[addr-r.base:]
+	for i := size - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, nil
+}
+
+// write stores a little-endian value of size bytes.
+func (m *machine) write(addr uint64, size int, v uint64) error {
+	r := m.find(addr, size)
+	if r == nil {
+		return m.segv(addr, size)
+	}
+	b := r.data[addr-r.base:]
+	for i := range size {
+		b[i] = byte(v >> (8 * i))
+	}
+	return nil
+}
+
+// bytesAt returns the n bytes of memory at addr, for syscalls.
+func (m *machine) bytesAt(addr uint64, n int) []byte {
+	r := m.find(addr, n)
+	if r == nil {
+		return nil
+	}
+	return r.data[addr-r.base : addr-r.base+uint64(n)]
+}
+
+// writeBytes copies b to memory at addr, which must be mapped.
+func (m *machine) writeBytes(addr uint64, b []byte) {
+	copy(m.bytesAt(addr, len(b)), b)
+}
+
+// syscall runs the syscall in RAX with the arguments in RDI, RSI, RDX,
+// R10, R8 and R9, leaving the result or -errno in RAX. Like the kernel it
+// clobbers RCX and R11.
+func (m *machine) syscall() {
+	a0, a1, a2 := m.regs[rdi], m.regs[rsi], m.regs[rdx]
+	ret := -int64(errNOSYS)
+
+	switch m.regs[rax] {
+	case sysRead:
+		switch buf := m.bytesAt(a1, int(min(a2, maxMmap))); {
+		case a0 != 0:
+			ret = -errBADF
+		case buf == nil:
+			ret = -errFAULT
+		default:
+			n := copy(buf, m.input)
+			m.input = m.input[n:]
+			ret = int64(n)
+		}
+
+	case sysWrite:
+		ret = m.writeFD(a0, m.bytesAt(a1, int(min(a2, maxMmap))))
+
+	case sysWritev:
+		ret = m.writev(a0, a1, a2)
+
+	case sysMmap:
+		size := (a1 + pageSize - 1) &^ (pageSize - 1)
+		switch {
+		case m.regs[r10] != mapAnon|mapPriv || a2 != protRW || a0 != 0 || size == 0:
+			ret = -errINVAL
+		case size > maxMmap:
+			ret = -errNOMEM
+		default:
+			m.mem = append(m.mem, region{base: m.nextMap, data: make([]byte, size)})
+			m.last = nil // the append may have moved the regions
+			ret = int64(m.nextMap)
+			m.nextMap += size + pageSize
+		}
+
+	case sysExit, sysExitGroup:
+		m.exited = true
+		m.status = int(a0 & 0xff)
+		return
+	}
+
+	m.regs[rcx] = m.rip
+	m.regs[r11] = m.rflags()
+	m.regs[rax] = uint64(ret)
+}
+
+// output returns the buffer written to fd, or nil if it is not writable.
+func (m *machine) output(fd uint64) *bytes.Buffer {
+	switch fd {
+	case 1:
+		return &m.stdout
+	case 2:
+		return &m.stderr
+	case trace.FD:
+		return &m.trace
+	}
+	return nil
+}
+
+// writeFD writes buf, the bytes a write syscall was given or nil if they
+// are not mapped, to fd, returning the count or -errno.
+func (m *machine) writeFD(fd uint64, buf []byte) int64 {
+	out := m.output(fd)
+	switch {
+	case out == nil:
+		return -errBADF
+	case buf == nil:
+		return -errFAULT
+	}
+	out.Write(buf)
+	return int64(len(buf))
+}
+
+// writev writes the n iovecs at iov to fd, returning the count or -errno.
+// As with the kernel, the iovecs are all checked before anything is
+// written.
+func (m *machine) writev(fd, iov, n uint64) int64 {
+	if n > iovMax {
+		return -errINVAL
+	}
+	bufs := make([][]byte, n)
+	for i := range bufs {
+		base, err := m.read(iov+16*uint64(i), 8)
+		size, err2 := m.read(iov+16*uint64(i)+8, 8)
+		if err != nil || err2 != nil {
+			return -errFAULT
+		}
+		if bufs[i] = m.bytesAt(base, int(min(size, maxMmap))); bufs[i] == nil {
+			return -errFAULT
+		}
+	}
+	if m.output(fd) == nil {
+		return -errBADF
+	}
+	var total int64
+	for _, buf := range bufs {
+		total += m.writeFD(fd, buf)
+	}
+	return total
+}
+
+// rflags packs the kept flags into their RFLAGS bits.
+func (m *machine) rflags() uint64 {
+	f := uint64(0x202) // reserved bit 1 and IF
+	for bit, set := range map[uint]bool{0: m.cf, 6: m.zf, 7: m.sf, 10: m.df, 11: m.of} {
+		if set {
+			f |= 1 << bit
+		}
+	}
+	return f
+}
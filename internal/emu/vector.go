@@ -0,0 +1,262 @@
+package emu
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// The SSE2 and AVX2 integer instructions a code generator emits for scan
+// loops: loading 16 or 32 bytes, comparing them with zero and gathering
+// the result into a mask; for range ops, clearing and copying 16 or 32
+// bytes at a time; and for runs of adds, building a vector of 16 bytes
+// from two quadwords and adding it to 16 cells. Also the CPUID, XGETBV and BT of a startup check for
+// AVX2, which the emulator reports it has.
+
+// cpuid and xgetbv results, for the leaves a feature check reads.
+const (
+	cpuidMaxLeaf = 7
+	cpuidSSE2    = 1<<25 | 1<<26      // leaf 1 EDX: SSE and SSE2
+	cpuidAVX     = 1<<27 | 1<<28      // leaf 1 ECX: OSXSAVE and AVX
+	cpuidAVX2    = 1 << 5             // leaf 7 EBX
+	xcr0AVX      = 1<<0 | 1<<1 | 1<<2 // x87, SSE and AVX state
+)
+
+// vecOp runs the vector ops after 0F: movdqa loads and stores (66 6F, 66
+// 7F), movdqu (F3 6F, F3 7F), pcmpeqb (66 74), pmovmskb (66 D7) and pxor
+// (66 EF), as legacy SSE or, after a VEX prefix, their 128 and 256-bit
+// AVX forms; and as SSE only, movd and movq from a general register (66
+// 6E), punpcklqdq (66 6C) and paddb (66 FC).
+func (in *inst) vecOp(op byte) error {
+	m := in.m
+	if err := in.modrm(); err != nil {
+		return err
+	}
+	n := 16
+	if in.vexL {
+		n = 32
+	}
+	src1 := in.reg // the destination, for SSE
+	if in.vex {
+		src1 = in.vvvv
+	}
+	// SSE memory operands must be aligned, but those of movdqu; AVX ones
+	// need only be for vmovdqa
+	aligned := in.rep == 0 && (!in.vex || op == 0x6f || op == 0x7f)
+
+	switch op {
+	case 0x6f:
+		src, err := in.vecRM(n, aligned)
+		if err != nil {
+			return err
+		}
+		in.setVec(in.reg, src)
+		return nil
+	case 0x7f:
+		if in.isReg {
+			in.setVec(in.rm, m.xmm[in.reg][:n])
+			return nil
+		}
+		dst, err := in.vecRM(n, aligned)
+		if err != nil {
+			return err
+		}
+		copy(dst, m.xmm[in.reg][:n])
+		return nil
+	case 0x6c, 0x74, 0xef, 0xfc:
+		src2, err := in.vecRM(n, aligned)
+		if err != nil {
+			return err
+		}
+		var r [32]byte
+		for i, a := range m.xmm[src1][:n] {
+			switch {
+			case op == 0x6c && i < 8:
+				r[i] = a
+			case op == 0x6c:
+				r[i] = src2[i-8]
+			case op == 0xef:
+				r[i] = a ^ src2[i]
+			case op == 0xfc:
+				r[i] = a + src2[i]
+			case a == src2[i]:
+				r[i] = 0xff
+			}
+		}
+		in.setVec(in.reg, r[:n])
+		return nil
+	case 0x6e:
+		width := 4
+		if in.rex&8 != 0 {
+			width = 8
+		}
+		v, err := in.getRM(width)
+		if err != nil {
+			return err
+		}
+		var r [16]byte
+		binary.LittleEndian.PutUint64(r[:], v)
+		in.setVec(in.reg, r[:])
+		return nil
+	case 0xd7:
+		if !in.isReg {
+			return in.fault(ErrIllegal, "pmovmskb with a memory operand")
+		}
+		var v uint64
+		for i, b := range m.xmm[in.rm][:n] {
+			v |= uint64(b>>7) << i
+		}
+		in.setReg(in.reg, 4, v)
+		return nil
+	}
+	return in.unsupported()
+}
+
+// vecRM returns the n bytes of the ModRM r/m operand, an xmm register or
+// memory, to read or write in place. Memory that must be aligned faults
+// otherwise, as the #GP it raises natively is a SIGSEGV.
+func (in *inst) vecRM(n int, aligned bool) ([]byte, error) {
+	if in.isReg {
+		return in.m.xmm[in.rm][:n], nil
+	}
+	a := in.addr()
+	if aligned && a%uint64(n) != 0 {
+		return nil, in.fault(ErrSegv, "unaligned %d bytes at %#x", n, a)
+	}
+	b := in.m.bytesAt(a, n)
+	if b == nil {
+		return nil, in.m.segv(a, n)
+	}
+	return b, nil
+}
+
+// setVec writes v to the low bytes of ymm register r. The VEX forms clear
+// the rest of the register; the SSE ones leave it alone.
+func (in *inst) setVec(r int, v []byte) {
+	x := &in.m.xmm[r]
+	copy(x[:], v)
+	if in.vex {
+		clear(x[len(v):])
+	}
+}
+
+// vexOp decodes the VEX prefix starting with first, C4 or C5, and runs the
+// vector op after it. Only the 0F opcode map is decoded, and VEX.W is
+// ignored, as the ops here do.
+func (in *inst) vexOp(first byte) error {
+	if in.rex != 0 || in.size != 4 || in.rep != 0 {
+		return in.fault(ErrIllegal, "VEX after a legacy or REX prefix")
+	}
+	b, err := in.fetch(1)
+	if err != nil {
+		return err
+	}
+	// R, X and B are stored inverted; C5 has only R, and the 0F map
+	in.rex = 0x40 | byte(^b>>5&4)
+	last := b
+	if first == 0xc4 {
+		if b&0x1f != 1 {
+			return in.unsupported()
+		}
+		in.rex = 0x40 | byte(^b>>5&7)
+		if last, err = in.fetch(1); err != nil {
+			return err
+		}
+	}
+	in.vex = true
+	in.vvvv = int(^last >> 3 & 0xf)
+	in.vexL = last&4 != 0
+	switch last & 3 {
+	case 1:
+		in.size = 2
+	case 2:
+		in.rep = 0xf3
+	case 3:
+		in.rep = 0xf2
+	}
+
+	b, err = in.fetch(1)
+	if err != nil {
+		return err
+	}
+	switch op := byte(b); op {
+	case 0x77:
+		// vzeroupper, or vzeroall with VEX.L
+		for i := range in.m.xmm {
+			if in.vexL {
+				clear(in.m.xmm[i][:])
+			} else {
+				clear(in.m.xmm[i][16:])
+			}
+		}
+		return nil
+	case 0x6f, 0x7f:
+		if in.size == 2 || in.rep == 0xf3 {
+			return in.vecOp(op)
+		}
+	case 0x74, 0xd7, 0xef:
+		if in.size == 2 {
+			return in.vecOp(op)
+		}
+	}
+	return in.unsupported()
+}
+
+// cpuid loads the leaf in EAX into EAX, EBX, ECX and EDX: a CPU with SSE2
+// and AVX2, and nothing else a program would check for.
+func (m *machine) cpuid() {
+	var a, b, c, d uint64
+	switch m.regs[rax] & mask(4) {
+	case 0:
+		a = cpuidMaxLeaf
+	case 1:
+		c, d = cpuidAVX, cpuidSSE2
+	case 7:
+		if m.regs[rcx]&mask(4) == 0 {
+			b = cpuidAVX2
+		}
+	}
+	m.regs[rax], m.regs[rbx], m.regs[rcx], m.regs[rdx] = a, b, c, d
+}
+
+// bitScan runs bsf (0F BC) and bsr (0F BD): the index of the lowest or
+// highest set bit of r/m, with ZF set and the destination left alone when
+// there is none.
+func (in *inst) bitScan(op byte) error {
+	if in.rep != 0 {
+		return in.unsupported() // tzcnt and lzcnt
+	}
+	if err := in.modrm(); err != nil {
+		return err
+	}
+	v, err := in.getRM(in.size)
+	if err != nil {
+		return err
+	}
+	in.m.zf = v == 0
+	if v == 0 {
+		return nil
+	}
+	i := bits.TrailingZeros64(v)
+	if op == 0xbd {
+		i = 63 - bits.LeadingZeros64(v)
+	}
+	in.setReg(in.reg, in.size, uint64(i))
+	return nil
+}
+
+// bitTest runs bt r/m, imm8 (0F BA /4), copying the bit into CF.
+func (in *inst) bitTest() error {
+	if err := in.modrm(); err != nil {
+		return err
+	}
+	bit, err := in.fetch(1)
+	if err != nil {
+		return err
+	}
+	if in.reg != 4 {
+		return in.unsupported() // bts, btr and btc
+	}
+	v, err := in.getRM(in.size)
+	in.m.cf = v>>(bit&uint64(8*in.size-1))&1 == 1
+	return err
+}
@@ -0,0 +1,264 @@
+// Package enumerate searches every Brainfuck program up to a length, in the
+// manner of a busy beaver search: each is run under a step limit, and what
+// it did is reported.
+//
+// Programs are listed shortest first, in alphabet order, skipping any with
+// unmatched brackets. Most short programs do what a shorter one already
+// does (`+-` and `><` do nothing, `+++-` is `++`), so programs are
+// deduplicated by their canonical form, the normal form of the IR the
+// optimiser makes of them at O2, and only the first of each form is run.
+// That is equivalence as the optimiser sees it, which ignores the tape's
+// bounds and the time loops take: `<>` and the empty program are one form,
+// though only the first walks off the tape, and so are `+[+]` and `+[-]`,
+// which run 766 and 4 commands. Config.All runs every program.
+package enumerate
+
+import (
+	"errors"
+	"fmt"
+	"iter"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// DefaultAlphabet is the commands programs are made of when Config.Alphabet
+// is empty: all but I/O, as a busy beaver search compares how long programs
+// run rather than what they print.
+const DefaultAlphabet = "+-<>[]"
+
+// DefaultMaxSteps bounds each run when Config.Limits.MaxSteps is zero, so
+// that programs which never halt fail rather than hang the search.
+const DefaultMaxSteps = 10_000
+
+// batchSize is the number of programs canonicalised and run at a time.
+const batchSize = 4096
+
+// Programs lists every program of up to maxLen commands from alphabet whose
+// brackets match, shortest first and then in the order of alphabet, starting
+// with the empty program.
+func Programs(maxLen int, alphabet string) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		buf := make([]byte, 0, maxLen)
+		for n := 0; n <= maxLen; n++ {
+			if !programs(buf, n, 0, alphabet, yield) {
+				return
+			}
+		}
+	}
+}
+
+// programs yields every completion of prefix to n commands, with depth
+// brackets still open, returning false once yield does.
+func programs(prefix []byte, n, depth int, alphabet string, yield func(string) bool) bool {
+	if len(prefix) == n {
+		return depth > 0 || yield(string(prefix))
+	}
+	for i := range len(alphabet) {
+		d := depth
+		switch alphabet[i] {
+		case '[':
+			d++
+		case ']':
+			d--
+		}
+		// Every open bracket needs a command left to close it
+		if d < 0 || d > n-len(prefix)-1 {
+			continue
+		}
+		if !programs(append(prefix, alphabet[i]), n, d, alphabet, yield) {
+			return false
+		}
+	}
+	return true
+}
+
+// Canonical returns the fingerprint of src's canonical form: the normal
+// form (see core.CanonicaliseForCells) of its IR optimised at O2 for cells.
+// Programs with the same form do the same thing, bar the tape's bounds.
+//
+// O2 removes empty loops, which never end if entered, so a program that
+// had one is optimised at O1 instead, keeping `+[]` apart from `+`.
+func Canonical(src string, cells core.CellModel) (core.Fingerprint, error) {
+	lowered, err := core.Lower(core.Tokenize([]byte(src)))
+	if err != nil {
+		return core.Fingerprint{}, err
+	}
+	ops, r, err := core.Optimise(lowered, core.Options{Level: core.O2, Cells: cells})
+	if err != nil {
+		return core.Fingerprint{}, err
+	}
+	for _, p := range r.Passes {
+		if p.Name == "removeEmptyLoops" && p.Rewrites > 0 {
+			ops, err = core.OptimiseForCells(lowered, core.O1, cells)
+			if err != nil {
+				return core.Fingerprint{}, err
+			}
+		}
+	}
+	return core.FingerprintOf(ops, cells)
+}
+
+// Config controls a search.
+type Config struct {
+	MaxLen   int    // longest program, in commands
+	Alphabet string // commands programs are made of, "" for DefaultAlphabet
+	Input    []byte // what every program reads
+
+	// Limits each run; a MaxSteps of 0 uses DefaultMaxSteps. Limits.Cells
+	// is also the cell model programs are canonicalised for.
+	Limits core.Limits
+
+	Workers int  // 0 uses GOMAXPROCS
+	All     bool // run every program, not just the first of each form
+}
+
+// Result is one program's run.
+type Result struct {
+	Program string
+	Output  []byte
+	Err     error // a *core.EvalError if the run failed, nil if it halted
+
+	// Steps is the number of commands run: a '[' once on entering its loop,
+	// a ']' each time it tests.
+	Steps uint64
+}
+
+// Halted reports whether the program ran to its end.
+func (r Result) Halted() bool {
+	return r.Err == nil
+}
+
+// Stats counts what a search did.
+type Stats struct {
+	Programs int // programs listed
+	Distinct int // programs run
+	Halted   int // runs that halted
+}
+
+// ErrAlphabet is wrapped by the error Search returns for an alphabet with
+// something other than the eight commands in it, or a command twice.
+var ErrAlphabet = errors.New("invalid alphabet")
+
+// Search runs every program cfg lists, or the first of each canonical form,
+// and calls yield with each result in the order Programs lists them, until
+// it returns false. Programs are canonicalised and run in parallel.
+func Search(cfg Config, yield func(Result) bool) (Stats, error) {
+	if cfg.Alphabet == "" {
+		cfg.Alphabet = DefaultAlphabet
+	}
+	for i := range len(cfg.Alphabet) {
+		c := cfg.Alphabet[i]
+		if !strings.ContainsRune("+-<>[].,", rune(c)) || strings.IndexByte(cfg.Alphabet[i+1:], c) >= 0 {
+			return Stats{}, fmt.Errorf("%w: %q", ErrAlphabet, cfg.Alphabet)
+		}
+	}
+	if cfg.MaxLen < 0 {
+		return Stats{}, fmt.Errorf("negative program length %d", cfg.MaxLen)
+	}
+	if cfg.Limits.MaxSteps == 0 {
+		cfg.Limits.MaxSteps = DefaultMaxSteps
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = runtime.GOMAXPROCS(0)
+	}
+
+	s := &search{cfg: cfg, seen: map[core.Fingerprint]bool{}, yield: yield}
+	batch := make([]string, 0, batchSize)
+	for p := range Programs(cfg.MaxLen, cfg.Alphabet) {
+		batch = append(batch, p)
+		if len(batch) == batchSize {
+			if !s.run(batch) {
+				return s.stats, nil
+			}
+			batch = batch[:0]
+		}
+	}
+	s.run(batch)
+	return s.stats, nil
+}
+
+// search is the state of a Search across batches.
+type search struct {
+	cfg   Config
+	seen  map[core.Fingerprint]bool // canonical forms run so far
+	yield func(Result) bool
+	stats Stats
+}
+
+// run runs a batch of programs, returning false once yield does.
+func (s *search) run(batch []string) bool {
+	s.stats.Programs += len(batch)
+
+	// Canonicalise in parallel, then keep each form's first program in
+	// listing order, so which program represents a form never depends on
+	// the workers
+	todo := batch
+	if !s.cfg.All {
+		keys := make([]core.Fingerprint, len(batch))
+		failed := make([]bool, len(batch))
+		parallel(len(batch), s.cfg.Workers, func(i int) {
+			var err error
+			keys[i], err = Canonical(batch[i], s.cfg.Limits.Cells)
+			failed[i] = err != nil
+		})
+		todo = nil
+		for i, key := range keys {
+			// A program with no form is a form of its own
+			if failed[i] || !s.seen[key] {
+				s.seen[key] = true
+				todo = append(todo, batch[i])
+			}
+		}
+	}
+
+	results := make([]Result, len(todo))
+	parallel(len(todo), s.cfg.Workers, func(i int) {
+		results[i] = Run(todo[i], s.cfg.Input, s.cfg.Limits)
+	})
+
+	for _, r := range results {
+		s.stats.Distinct++
+		if r.Halted() {
+			s.stats.Halted++
+		}
+		if !s.yield(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Run runs a program with every command an op of its own, so that Steps
+// counts commands.
+func Run(program string, input []byte, limits core.Limits) Result {
+	ops, err := core.LowerAt(core.Tokenize([]byte(program)), core.Og)
+	if err != nil {
+		return Result{Program: program, Err: err}
+	}
+	out, steps, err := core.EvalSteps(ops, input, limits)
+	return Result{Program: program, Output: out, Steps: steps, Err: err}
+}
+
+// parallel calls f for each of 0 to n-1 on up to workers goroutines.
+func parallel(n, workers int, f func(i int)) {
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for range min(workers, n) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				f(i)
+			}
+		}()
+	}
+
+	for i := range n {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
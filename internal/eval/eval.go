@@ -0,0 +1,47 @@
+// Package eval runs input-free programs at compile time, so their output
+// can be emitted directly instead of computed at run time.
+package eval
+
+import (
+	"errors"
+
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// DefaultMaxSteps bounds evaluation so a program that never halts fails
+// rather than hangs the compiler.
+const DefaultMaxSteps = 1_000_000_000
+
+// ErrReadsInput is wrapped by the error returned when the program executes
+// an IN, as its output then depends on run-time input.
+var ErrReadsInput = errors.New("program reads input")
+
+// Evaluate runs ops to completion on the default tape and returns
+// everything they write. It fails if the program reads input or runs for
+// more than maxSteps ops.
+func Evaluate(ops []core.Op, maxSteps uint64) ([]byte, error) {
+	out, err := core.Eval(ops, nil, core.Limits{MaxSteps: maxSteps, StrictInput: true})
+	var e *core.EvalError
+	if errors.As(err, &e) && errors.Is(e, core.ErrInputExhausted) {
+		e.Err, e.Msg = ErrReadsInput, ErrReadsInput.Error()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Program returns IR that writes out using a single cell, stepping it by
+// the shortest wrapping difference between consecutive bytes.
+func Program(out []byte) []core.Op {
+	ops := make([]core.Op, 0, 2*len(out))
+	var cell byte
+	for _, b := range out {
+		if d := int(int8(b - cell)); d != 0 {
+			ops = append(ops, core.Add(d))
+		}
+		ops = append(ops, core.Out())
+		cell = b
+	}
+	return ops
+}
@@ -0,0 +1,107 @@
+// Package expand does the inverse of the optimiser: it writes IR back out as
+// long-hand Brainfuck, optionally padded with no-op pairs and comment noise,
+// for generating test corpora and stress inputs.
+//
+// Output is deterministic for a given seed. Expanded programs behave the
+// same as the original under the default wrapping cells; no-op pairs such
+// as +- are not no-ops under saturating or trapping cells.
+package expand
+
+import (
+	"math/rand/v2"
+	"strings"
+
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// Config controls how much padding is added.
+type Config struct {
+	Seed     uint64
+	NoOps    float64 // chance of a no-op pair after each command
+	Comments float64 // chance of a run of comment noise after each command
+	Width    int     // wrap lines at this many bytes, 0 for no wrapping
+}
+
+// noOps are pairs that leave wrapping cells unchanged. Pointer pairs are
+// left out: <> would briefly move off the start of a bounded tape, and ><
+// off its end.
+var noOps = []string{"+-", "-+"}
+
+// noise is the alphabet for comment padding, which must not contain any
+// of the eight command characters.
+const noise = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789 !?#*/"
+
+// expander accumulates output, wrapping lines as it goes.
+type expander struct {
+	cfg  Config
+	rng  *rand.Rand
+	out  strings.Builder
+	line int // bytes on the current line
+}
+
+// Expand writes ops as Brainfuck: ADD k as |k| pluses or minuses, SHIFT k
+// as |k| arrows and ZERO as [-], padded according to cfg.
+func Expand(ops []core.Op, cfg Config) string {
+	e := &expander{cfg: cfg, rng: rand.New(rand.NewPCG(cfg.Seed, cfg.Seed^0x9e3779b97f4a7c15))}
+
+	for _, op := range core.LowerRanges(ops) {
+		switch op.Kind {
+		case core.OpShift:
+			e.repeat('>', '<', op.Arg)
+		case core.OpAdd:
+			e.repeat('+', '-', op.Arg)
+		case core.OpZero:
+			e.command("[-]")
+		case core.OpIn:
+			e.command(",")
+		case core.OpOut:
+			e.command(".")
+		case core.OpJz:
+			e.command("[")
+		case core.OpJnz:
+			e.command("]")
+		}
+	}
+
+	if e.line > 0 {
+		e.out.WriteByte('\n')
+	}
+	return e.out.String()
+}
+
+// repeat writes |n| single commands, up for n > 0 and down for n < 0.
+func (e *expander) repeat(up, down byte, n int) {
+	c := up
+	if n < 0 {
+		c, n = down, -n
+	}
+	for range n {
+		e.command(string(c))
+	}
+}
+
+// command writes s followed by any padding.
+func (e *expander) command(s string) {
+	e.write(s)
+	if e.rng.Float64() < e.cfg.NoOps {
+		e.write(noOps[e.rng.IntN(len(noOps))])
+	}
+	if e.rng.Float64() < e.cfg.Comments {
+		n := 1 + e.rng.IntN(8)
+		var b strings.Builder
+		for range n {
+			b.WriteByte(noise[e.rng.IntN(len(noise))])
+		}
+		e.write(b.String())
+	}
+}
+
+// write appends s, breaking the line first if it would exceed the width.
+func (e *expander) write(s string) {
+	if e.cfg.Width > 0 && e.line > 0 && e.line+len(s) > e.cfg.Width {
+		e.out.WriteByte('\n')
+		e.line = 0
+	}
+	e.out.WriteString(s)
+	e.line += len(s)
+}
@@ -0,0 +1,199 @@
+// Package golf turns optimised IR back into short, equivalent Brainfuck.
+//
+// Besides dropping comments and re-emitting folded ops, it tracks which
+// cells are statically known to be zero and uses that to:
+//
+//   - skip ZERO on a cell that is already zero
+//   - build large constants with a multiplication loop through a known-zero
+//     neighbour when that is shorter than a run of + or -
+//
+// For example ADD +72 next to an empty cell becomes >++++++++[<+++++++++>-]<
+// rather than 72 pluses. The search for factors is bounded (see maxFactor).
+// Shortening assumes the default wrapping, unsigned 8-bit cells.
+package golf
+
+import (
+	"strings"
+
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// maxFactor bounds the multiplication loop search.
+const maxFactor = 40
+
+// construction is the cheapest known way to add a constant to a cell.
+type construction struct {
+	cost  int
+	outer int // pluses in the temp cell (loop count), 0 for a plain run
+	inner int // signed amount added per iteration
+	rest  int // signed amount added directly afterwards
+}
+
+// table holds the best construction for each constant mod 256.
+var table = buildTable()
+
+// buildTable searches a*b + c for every constant, keeping the shortest.
+func buildTable() [256]construction {
+	var t [256]construction
+	for k := range 256 {
+		t[k] = construction{cost: direct(k), rest: signedRun(k)}
+
+		for a := 2; a <= maxFactor; a++ {
+			for b := 1; b <= maxFactor; b++ {
+				for _, inner := range []int{b, -b} {
+					rest := signedRun(k - a*inner)
+					// >a[<b>-]< plus the remainder
+					cost := 1 + a + 2 + b + 3 + 1 + max(rest, -rest)
+					if cost < t[k].cost {
+						t[k] = construction{cost: cost, outer: a, inner: inner, rest: rest}
+					}
+				}
+			}
+		}
+	}
+	return t
+}
+
+// signedRun returns the shortest signed run adding k mod 256.
+func signedRun(k int) int {
+	k = ((k % 256) + 256) % 256
+	if k > 128 {
+		return k - 256
+	}
+	return k
+}
+
+// direct returns the length of the shortest plain run adding k mod 256.
+func direct(k int) int {
+	r := signedRun(k)
+	return max(r, -r)
+}
+
+// shortener walks the IR tracking known-zero cells relative to the pointer.
+type shortener struct {
+	out      strings.Builder
+	pos      int          // pointer offset since knowledge was last reset
+	zero     map[int]bool // offsets known to hold zero
+	allZero  bool         // every cell not in zero is also zero (program start)
+	absolute bool         // pos is the absolute cell index
+	nonZero  map[int]bool // offsets known to be modified since the start
+}
+
+// Shorten emits Brainfuck equivalent to ops, using the smallest constant
+// constructions it can find.
+func Shorten(ops []core.Op) string {
+	s := &shortener{
+		zero:     make(map[int]bool),
+		nonZero:  make(map[int]bool),
+		allZero:  true,
+		absolute: true,
+	}
+
+	for _, op := range core.LowerRanges(ops) {
+		s.emit(op)
+	}
+	return s.out.String()
+}
+
+// isZero reports whether the cell at offset is known to hold zero.
+func (s *shortener) isZero(offset int) bool {
+	if s.zero[offset] {
+		return true
+	}
+	return s.allZero && !s.nonZero[offset]
+}
+
+// setKnown records the zero-ness of the cell at offset.
+func (s *shortener) setKnown(offset int, zero bool) {
+	s.zero[offset] = zero
+	if !zero {
+		s.nonZero[offset] = true
+	}
+}
+
+// forget drops everything known, eg. on entering a loop body.
+func (s *shortener) forget() {
+	clear(s.zero)
+	clear(s.nonZero)
+	s.allZero = false
+	s.absolute = false
+}
+
+func (s *shortener) emit(op core.Op) {
+	switch op.Kind {
+	case core.OpShift:
+		s.run('>', '<', op.Arg)
+		s.pos += op.Arg
+
+	case core.OpAdd:
+		s.add(op.Arg)
+
+	case core.OpZero:
+		if !s.isZero(s.pos) {
+			s.out.WriteString("[-]")
+		}
+		s.setKnown(s.pos, true)
+
+	case core.OpIn:
+		s.out.WriteByte(',')
+		s.setKnown(s.pos, false)
+
+	case core.OpOut:
+		s.out.WriteByte('.')
+
+	case core.OpJz:
+		s.out.WriteByte('[')
+		s.forget()
+
+	case core.OpJnz:
+		s.out.WriteByte(']')
+		s.forget()
+		s.setKnown(s.pos, true)
+	}
+}
+
+// add emits ADD k on the current cell, through a zero neighbour if cheaper.
+func (s *shortener) add(k int) {
+	c := table[((k%256)+256)%256]
+	if c.outer == 0 || c.cost >= direct(k) {
+		s.run('+', '-', signedRun(k))
+		s.setKnown(s.pos, false)
+		return
+	}
+
+	// Prefer the right neighbour; the left one only when it surely exists
+	dir := 0
+	switch {
+	case s.isZero(s.pos + 1):
+		dir = 1
+	case s.absolute && s.pos > 0 && s.isZero(s.pos-1):
+		dir = -1
+	default:
+		s.run('+', '-', signedRun(k))
+		s.setKnown(s.pos, false)
+		return
+	}
+
+	// >aaa[<bbb>-]< (mirrored for the left neighbour)
+	s.run('>', '<', dir)
+	s.run('+', '-', c.outer)
+	s.out.WriteByte('[')
+	s.run('>', '<', -dir)
+	s.run('+', '-', c.inner)
+	s.run('>', '<', dir)
+	s.out.WriteString("-]")
+	s.run('>', '<', -dir)
+	s.run('+', '-', c.rest)
+	s.setKnown(s.pos, false)
+}
+
+// run writes |n| copies of up (n > 0) or down (n < 0).
+func (s *shortener) run(up, down byte, n int) {
+	c := up
+	if n < 0 {
+		c, n = down, -n
+	}
+	for range n {
+		s.out.WriteByte(c)
+	}
+}
@@ -0,0 +1,192 @@
+// Package irdiff compares two Brainfuck programs by their IR rather than
+// their text, so changes to comments and layout do not show up.
+//
+// Ops are compared by kind and argument. Jump targets are ignored, since
+// they shift whenever anything earlier changes; the bracket structure is
+// still compared through the JZ and JNZ ops themselves.
+package irdiff
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// EditKind says how an op appears in the two programs.
+type EditKind int
+
+const (
+	Equal  EditKind = iota // in both
+	Delete                 // only in the first
+	Insert                 // only in the second
+)
+
+// Edit is one step of the diff. A and B index the ops of the first and
+// second program; the one that does not apply is -1.
+type Edit struct {
+	Kind EditKind
+	A, B int
+}
+
+// same reports whether two ops are equivalent for diffing.
+func same(a, b core.Op) bool {
+	if a.Kind != b.Kind {
+		return false
+	}
+	return a.Kind == core.OpJz || a.Kind == core.OpJnz || (a.Arg == b.Arg && a.Off == b.Off)
+}
+
+// Diff returns the shortest edit script turning a into b, using Myers'
+// O((N+M)D) algorithm.
+func Diff(a, b []core.Op) []Edit {
+	n, m := len(a), len(b)
+	off := n + m
+	v := make([]int, 2*off+2)
+	var trace [][]int
+
+	for d := 0; d <= off; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1] // down: insert from b
+			} else {
+				x = v[off+k-1] + 1 // right: delete from a
+			}
+			y := x - k
+			for x < n && y < m && same(a[x], b[y]) {
+				x, y = x+1, y+1
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				return backtrack(trace, off, n, m, d)
+			}
+		}
+	}
+	return nil
+}
+
+// backtrack walks the saved V arrays from (n, m) back to the origin.
+func backtrack(trace [][]int, off, x, y, d int) []Edit {
+	var edits []Edit
+	for ; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[off+prevK]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x, y = x-1, y-1
+			edits = append(edits, Edit{Equal, x, y})
+		}
+		if x == prevX {
+			y--
+			edits = append(edits, Edit{Insert, -1, y})
+		} else {
+			x--
+			edits = append(edits, Edit{Delete, x, -1})
+		}
+	}
+	for x > 0 && y > 0 {
+		x, y = x-1, y-1
+		edits = append(edits, Edit{Equal, x, y})
+	}
+
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+// Changed reports whether the edit script has any insertions or deletions.
+func Changed(edits []Edit) bool {
+	for _, e := range edits {
+		if e.Kind != Equal {
+			return true
+		}
+	}
+	return false
+}
+
+// FormatOp renders an op without its index or jump target, eg. "ADD +6".
+func FormatOp(op core.Op) string {
+	switch op.Kind {
+	case core.OpShift, core.OpAdd:
+		return fmt.Sprintf("%-5s %+d", op.Kind, op.Arg)
+	case core.OpZeroRange:
+		return fmt.Sprintf("%s %d", op.Kind, op.Arg)
+	case core.OpCopyRange:
+		return fmt.Sprintf("%s %d %+d", op.Kind, op.Arg, op.Off)
+	default:
+		return op.Kind.String()
+	}
+}
+
+// WriteUnified writes the edits as unified-style hunks with the given lines
+// of context. Each changed op is annotated with its source position.
+func WriteUnified(w io.Writer, nameA, nameB string, a, b []core.Op, edits []Edit, context int) {
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", nameA, nameB)
+
+	for start := 0; start < len(edits); {
+		// Find the next change, then extend the hunk while changes stay
+		// within 2*context ops of each other
+		for start < len(edits) && edits[start].Kind == Equal {
+			start++
+		}
+		if start == len(edits) {
+			return
+		}
+		end := start
+		for i := start; i < len(edits) && i <= end+2*context; i++ {
+			if edits[i].Kind != Equal {
+				end = i
+			}
+		}
+
+		from := max(start-context, 0)
+		to := min(end+context+1, len(edits))
+		fmt.Fprintf(w, "@@ %s %s @@\n", hunkPos(nameA, a, edits[from:to], true), hunkPos(nameB, b, edits[from:to], false))
+
+		for _, e := range edits[from:to] {
+			switch e.Kind {
+			case Equal:
+				fmt.Fprintf(w, "  %s\n", FormatOp(a[e.A]))
+			case Delete:
+				fmt.Fprintf(w, "- %-12s %s\n", FormatOp(a[e.A]), posString(a[e.A].Pos))
+			case Insert:
+				fmt.Fprintf(w, "+ %-12s %s\n", FormatOp(b[e.B]), posString(b[e.B].Pos))
+			}
+		}
+		start = to
+	}
+}
+
+// hunkPos returns the source position of the first op a hunk covers on one
+// side, eg. "a.bf:3:5".
+func hunkPos(name string, ops []core.Op, edits []Edit, first bool) string {
+	for _, e := range edits {
+		i := e.B
+		if first {
+			i = e.A
+		}
+		if i >= 0 && ops[i].Pos != nil {
+			return fmt.Sprintf("%s:%d:%d", name, ops[i].Pos.Line, ops[i].Pos.Column)
+		}
+	}
+	return name
+}
+
+// posString formats an op's source position as "; line:col".
+func posString(pos *core.Position) string {
+	if pos == nil {
+		return ""
+	}
+	return fmt.Sprintf("; %d:%d", pos.Line, pos.Column)
+}
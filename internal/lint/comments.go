@@ -0,0 +1,103 @@
+// Package lint finds likely mistakes in Brainfuck source that are still
+// valid programs, as core.Warnings for `bfcc check`.
+package lint
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// DefaultCommentChars are the commands Comments looks for unless told
+// otherwise: the ones prose uses as punctuation.
+const DefaultCommentChars = ".,+-"
+
+// CommandChars are the Brainfuck commands, the only characters Comments
+// can look for.
+const CommandChars = "+-<>.,[]"
+
+// A line is prose when it starts with a word, has at least proseWords
+// words of two or more letters, and commands make up less than
+// 1/proseRatio of its non-blank bytes.
+const (
+	proseWords = 3
+	proseRatio = 4
+)
+
+// effects describes what each command does, for the warning.
+var effects = map[byte]string{
+	'+': "increments the current cell",
+	'-': "decrements the current cell",
+	'>': "moves the data pointer right",
+	'<': "moves the data pointer left",
+	'.': "outputs the current cell",
+	',': "reads input into the current cell",
+	'[': "starts a loop",
+	']': "ends a loop",
+}
+
+// Comments warns about each of chars, which must all be commands, on a
+// line that reads as a prose comment, such as
+//
+//	Print the total, then a newline.
+//
+// where the comma reads a byte and the full stop prints one. Such lines
+// are almost always meant as comments only, so the commands in them are
+// usually mistakes.
+func Comments(src []byte, chars string) []core.Warning {
+	var warnings []core.Warning
+	offset := 0
+	for i, line := range bytes.Split(src, []byte("\n")) {
+		if isProse(line) {
+			for col, b := range line {
+				if strings.IndexByte(chars, b) < 0 {
+					continue
+				}
+				pos := &core.Position{Offset: offset + col, Line: i + 1, Column: col + 1}
+				warnings = append(warnings, core.Warning{
+					Pos: pos,
+					Msg: fmt.Sprintf("%q in a prose comment %s", b, effects[b]),
+				})
+			}
+		}
+		offset += len(line) + 1
+	}
+	return warnings
+}
+
+// isProse reports whether line reads as a sentence rather than code.
+func isProse(line []byte) bool {
+	text := bytes.TrimLeft(line, " \t\r")
+	if len(text) == 0 || !isLetter(text[0]) {
+		return false
+	}
+
+	words, letters, commands, nonBlank := 0, 0, 0, 0
+	for _, b := range text {
+		if isLetter(b) {
+			letters++
+		} else {
+			if letters >= 2 {
+				words++
+			}
+			letters = 0
+		}
+		if strings.IndexByte(CommandChars, b) >= 0 {
+			commands++
+		}
+		if b != ' ' && b != '\t' && b != '\r' {
+			nonBlank++
+		}
+	}
+	if letters >= 2 {
+		words++
+	}
+	return words >= proseWords && commands*proseRatio < nonBlank
+}
+
+// isLetter reports whether b is an ASCII letter.
+func isLetter(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
@@ -0,0 +1,223 @@
+// Package mutate implements mutation testing for Brainfuck programs.
+//
+// Each mutant changes a single source command: `+` and `-` are swapped,
+// `<` and `>` are swapped, and any non-bracket command can be dropped.
+// A mutant is killed when at least one test case fails against it; a
+// surviving mutant points at behaviour the tests do not pin down.
+package mutate
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/lcox74/bfcc/internal/bftest"
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/internal/coverage"
+	"github.com/lcox74/bfcc/internal/vm"
+)
+
+// Mutant is a single-command change to a program.
+type Mutant struct {
+	Pos  core.Position
+	From byte // original command
+	To   byte // replacement command, 0 if the command is dropped
+}
+
+// String describes the mutant, eg. "3:5 '+' -> '-'" or "3:5 drop '.'".
+func (m Mutant) String() string {
+	if m.To == 0 {
+		return fmt.Sprintf("%d:%d drop '%c'", m.Pos.Line, m.Pos.Column, m.From)
+	}
+	return fmt.Sprintf("%d:%d '%c' -> '%c'", m.Pos.Line, m.Pos.Column, m.From, m.To)
+}
+
+// Apply returns a copy of src with the mutation applied.
+func (m Mutant) Apply(src []byte) []byte {
+	out := make([]byte, 0, len(src))
+	out = append(out, src[:m.Pos.Offset]...)
+	if m.To != 0 {
+		out = append(out, m.To)
+	}
+	return append(out, src[m.Pos.Offset+1:]...)
+}
+
+// swaps maps each command to its swapped counterpart.
+var swaps = map[byte]byte{'+': '-', '-': '+', '<': '>', '>': '<'}
+
+// Generate lists every mutant of src, in source order.
+func Generate(src []byte, toks []core.Token) []Mutant {
+	var mutants []Mutant
+	for _, tok := range toks {
+		if tok.Kind == core.TokEOF || tok.Kind == core.TokLBracket || tok.Kind == core.TokRBracket {
+			continue
+		}
+
+		c := src[tok.Pos.Offset]
+		if to, ok := swaps[c]; ok {
+			mutants = append(mutants, Mutant{Pos: tok.Pos, From: c, To: to})
+		}
+		mutants = append(mutants, Mutant{Pos: tok.Pos, From: c})
+	}
+	return mutants
+}
+
+// Status is the outcome of testing one mutant.
+type Status int
+
+const (
+	Killed    Status = iota // at least one test failed
+	Survived                // every test still passed
+	Uncovered               // the command never runs under the tests
+	Invalid                 // the mutant does not compile
+)
+
+// statusNames maps each Status to its report spelling.
+var statusNames = [...]string{
+	Killed:    "killed",
+	Survived:  "survived",
+	Uncovered: "uncovered",
+	Invalid:   "invalid",
+}
+
+// String returns the report spelling of the Status.
+func (s Status) String() string {
+	return statusNames[s]
+}
+
+// Outcome pairs a mutant with its status. For killed mutants Reason names
+// the first failing test case.
+type Outcome struct {
+	Mutant Mutant
+	Status Status
+	Reason string
+}
+
+// Report is the result of a mutation testing run.
+type Report struct {
+	Outcomes []Outcome
+}
+
+// Count returns the number of outcomes with the given status.
+func (r *Report) Count(s Status) int {
+	n := 0
+	for _, o := range r.Outcomes {
+		if o.Status == s {
+			n++
+		}
+	}
+	return n
+}
+
+// Score returns the percentage of tested (covered, valid) mutants killed.
+func (r *Report) Score() float64 {
+	killed, survived := r.Count(Killed), r.Count(Survived)
+	if killed+survived == 0 {
+		return 100
+	}
+	return 100 * float64(killed) / float64(killed+survived)
+}
+
+// Config controls how mutants are compiled and tested.
+type Config struct {
+	Level    core.OptLevel
+	Cells    core.CellModel
+	MaxSteps uint64 // per test case, 0 uses bftest.DefaultMaxSteps
+	Workers  int    // 0 uses GOMAXPROCS
+}
+
+// ErrOriginalFails is returned when the unmutated program fails its tests,
+// since every mutant would then trivially count as killed.
+var ErrOriginalFails = errors.New("program fails its own tests")
+
+// Run tests every mutant of src against cases. Commands the tests never
+// execute are reported as Uncovered without being run.
+func Run(file string, src []byte, cases []bftest.Case, cfg Config) (*Report, error) {
+	if cfg.MaxSteps == 0 {
+		cfg.MaxSteps = bftest.DefaultMaxSteps
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = runtime.GOMAXPROCS(0)
+	}
+
+	covered, err := coveredOffsets(file, src, cases, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	toks := core.Tokenize(src)
+	mutants := Generate(src, toks)
+	report := &Report{Outcomes: make([]Outcome, len(mutants))}
+
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for range cfg.Workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				report.Outcomes[i] = test(mutants[i], src, cases, cfg)
+			}
+		}()
+	}
+
+	for i, m := range mutants {
+		if !covered[m.Pos.Offset] {
+			report.Outcomes[i] = Outcome{Mutant: m, Status: Uncovered}
+			continue
+		}
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	return report, nil
+}
+
+// coveredOffsets runs the original program over every case, failing if it
+// does not pass, and returns the source offsets of commands that executed.
+func coveredOffsets(file string, src []byte, cases []bftest.Case, cfg Config) (map[int]bool, error) {
+	toks := core.Tokenize(src)
+	ops, err := core.Lower(toks)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make([]uint64, len(ops))
+	for _, r := range bftest.Run(ops, cases, cfg.MaxSteps, counts, vm.WithCells(cfg.Cells)) {
+		if !r.Passed() {
+			return nil, fmt.Errorf("%w: %s", ErrOriginalFails, r.Case.Name)
+		}
+	}
+
+	profile, err := coverage.FromCounts(file, src, toks, ops, counts)
+	if err != nil {
+		return nil, err
+	}
+
+	covered := make(map[int]bool, len(profile.Commands))
+	for _, c := range profile.Commands {
+		covered[c.Offset] = c.Count > 0
+	}
+	return covered, nil
+}
+
+// test compiles a mutant and runs it against every case.
+func test(m Mutant, src []byte, cases []bftest.Case, cfg Config) Outcome {
+	ops, err := core.LowerAt(core.Tokenize(m.Apply(src)), cfg.Level)
+	if err != nil {
+		return Outcome{Mutant: m, Status: Invalid, Reason: err.Error()}
+	}
+	ops, err = core.OptimiseForCells(ops, cfg.Level, cfg.Cells)
+	if err != nil {
+		return Outcome{Mutant: m, Status: Invalid, Reason: err.Error()}
+	}
+
+	for _, r := range bftest.Run(ops, cases, cfg.MaxSteps, nil, vm.WithCells(cfg.Cells)) {
+		if !r.Passed() {
+			return Outcome{Mutant: m, Status: Killed, Reason: r.Case.Name}
+		}
+	}
+	return Outcome{Mutant: m, Status: Survived}
+}
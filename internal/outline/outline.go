@@ -0,0 +1,150 @@
+// Package outline describes the loop structure of a Brainfuck program, with
+// source ranges and a summary of each loop body, for editor folding and
+// navigation.
+package outline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// Summary counts the ops directly inside a loop body, not in nested loops.
+type Summary struct {
+	Adds   int `json:"adds"`
+	Shifts int `json:"shifts"`
+	Inputs int `json:"inputs"`
+	Output int `json:"outputs"`
+	Loops  int `json:"loops"` // directly nested loops
+
+	// Net pointer movement over one iteration, only meaningful when every
+	// nested loop is balanced too.
+	Shift    int  `json:"shift"`
+	Balanced bool `json:"balanced"`
+}
+
+// Loop is one [ ... ] pair.
+type Loop struct {
+	Start    core.Position `json:"start"` // the '['
+	End      core.Position `json:"end"`   // the ']'
+	Depth    int           `json:"depth"` // 1 for top-level loops
+	Summary  Summary       `json:"summary"`
+	Children []*Loop       `json:"children,omitempty"`
+}
+
+// Outline is the loop tree of a program.
+type Outline struct {
+	File  string  `json:"file"`
+	Loops []*Loop `json:"loops"`
+}
+
+// Build walks the unoptimised IR of src and returns its loop tree. It fails
+// if the brackets do not match.
+func Build(file string, src []byte) (*Outline, error) {
+	ops, err := core.Lower(core.Tokenize(src))
+	if err != nil {
+		return nil, err
+	}
+
+	o := &Outline{File: file, Loops: []*Loop{}}
+	var stack []*Loop
+
+	for _, op := range ops {
+		var cur *Loop
+		if len(stack) > 0 {
+			cur = stack[len(stack)-1]
+		}
+
+		switch op.Kind {
+		case core.OpJz:
+			loop := &Loop{Start: *op.Pos, Depth: len(stack) + 1, Summary: Summary{Balanced: true}}
+			if cur == nil {
+				o.Loops = append(o.Loops, loop)
+			} else {
+				cur.Children = append(cur.Children, loop)
+				cur.Summary.Loops++
+			}
+			stack = append(stack, loop)
+			continue
+
+		case core.OpJnz:
+			cur.End = *op.Pos
+			if cur.Summary.Shift != 0 {
+				cur.Summary.Balanced = false
+			}
+			stack = stack[:len(stack)-1]
+			if len(stack) > 0 && !cur.Summary.Balanced {
+				stack[len(stack)-1].Summary.Balanced = false
+			}
+			continue
+		}
+
+		if cur == nil {
+			continue
+		}
+		switch op.Kind {
+		case core.OpAdd:
+			cur.Summary.Adds++
+		case core.OpShift:
+			cur.Summary.Shifts++
+			cur.Summary.Shift += op.Arg
+		case core.OpIn:
+			cur.Summary.Inputs++
+		case core.OpOut:
+			cur.Summary.Output++
+		}
+	}
+
+	return o, nil
+}
+
+// WriteJSON encodes the outline as indented JSON.
+func (o *Outline) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(o)
+}
+
+// WriteText writes the outline as an indented tree, one loop per line, eg.
+//
+//	1:9-1:20 adds 2, shifts 2, balanced
+func (o *Outline) WriteText(w io.Writer) {
+	var walk func(loops []*Loop)
+	walk = func(loops []*Loop) {
+		for _, l := range loops {
+			fmt.Fprintf(w, "%s%d:%d-%d:%d %s\n", strings.Repeat("  ", l.Depth-1),
+				l.Start.Line, l.Start.Column, l.End.Line, l.End.Column, l.Summary)
+			walk(l.Children)
+		}
+	}
+	walk(o.Loops)
+}
+
+// String lists the non-zero counts and the pointer movement.
+func (s Summary) String() string {
+	var parts []string
+	for _, c := range []struct {
+		name string
+		n    int
+	}{
+		{"adds", s.Adds}, {"shifts", s.Shifts}, {"inputs", s.Inputs},
+		{"outputs", s.Output}, {"loops", s.Loops},
+	} {
+		if c.n > 0 {
+			parts = append(parts, fmt.Sprintf("%s %d", c.name, c.n))
+		}
+	}
+
+	switch {
+	case !s.Balanced && s.Shift != 0:
+		parts = append(parts, fmt.Sprintf("moves %+d", s.Shift))
+	case !s.Balanced:
+		parts = append(parts, "unbalanced")
+	default:
+		parts = append(parts, "balanced")
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,157 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// PassesEnv names the environment variable listing the external optimiser
+// passes, as a PATH-style list of executables, run in order after the
+// built-in passes.
+const PassesEnv = "BFCC_PASSES"
+
+// PassRequest is what bfcc sends a pass: the IR as the built-in passes
+// left it, and what it must stay sound for.
+type PassRequest struct {
+	Protocol     int    `json:"protocol"`
+	Level        string `json:"level"`         // the -O level, 1 or 2
+	Ops          []Op   `json:"ops"`           // optimised IR
+	TapeSize     int    `json:"tape_size"`     // cells on the tape
+	CellOverflow string `json:"cell_overflow"` // wrap, saturate or trap
+	SignedCells  bool   `json:"signed_cells"`  // cells hold -128 to 127, and EOF stores -1
+}
+
+// PassResult is what a pass writes back: the transformed IR.
+type PassResult struct {
+	Ops []Op `json:"ops"`
+}
+
+// IR returns the ops of req, failing on an op kind it does not know.
+func (req *PassRequest) IR() ([]core.Op, error) {
+	return coreOps(req.Ops)
+}
+
+// CellModel returns the cell model of req.
+func (req *PassRequest) CellModel() (core.CellModel, error) {
+	overflow, err := core.ParseCellOverflow(req.CellOverflow)
+	return core.CellModel{Overflow: overflow, Signed: req.SignedCells}, err
+}
+
+// Pass is an external optimiser pass: an executable that reads a
+// PassRequest as JSON from stdin and writes a PassResult to stdout. As
+// with a backend plugin, its stderr is shown to the user and a non-zero
+// exit status fails the compile. The IR it returns is only accepted if
+// every op is known and its loops pair up (see core.CheckJumps).
+type Pass struct {
+	Path string
+}
+
+// Passes returns the passes listed in BFCC_PASSES, in order, each looked
+// up on the PATH unless it is a path.
+func Passes() ([]Pass, error) {
+	var passes []Pass
+	for _, name := range filepath.SplitList(os.Getenv(PassesEnv)) {
+		if name == "" {
+			continue
+		}
+		path, err := exec.LookPath(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", PassesEnv, err)
+		}
+		passes = append(passes, Pass{Path: path})
+	}
+	return passes, nil
+}
+
+// Run sends ops to the pass and returns the IR it writes back, once
+// verified.
+func (p Pass) Run(ops []core.Op, level core.OptLevel, cells core.CellModel) ([]core.Op, error) {
+	in, err := json.Marshal(&PassRequest{
+		Protocol:     Protocol,
+		Level:        level.String(),
+		Ops:          jsonOps(ops),
+		TapeSize:     core.TapeSize,
+		CellOverflow: cells.Overflow.String(),
+		SignedCells:  cells.Signed,
+	})
+	if err != nil {
+		return nil, err
+	}
+	out, err := run(context.Background(), p.Path, in)
+	if err != nil {
+		return nil, err
+	}
+	var res PassResult
+	if err := json.Unmarshal(out, &res); err != nil {
+		return nil, fmt.Errorf("%s: invalid result: %w", p.Path, err)
+	}
+	result, err := coreOps(res.Ops)
+	if err == nil {
+		err = core.CheckJumps(result)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: returned invalid IR: %w", p.Path, err)
+	}
+	return result, nil
+}
+
+// RunPasses runs ops through the passes in BFCC_PASSES, in order. Passes
+// only run at -O1 and -O2, as the built-in passes do, so that -O0 and -Og
+// keep one op per source command.
+func RunPasses(ops []core.Op, level core.OptLevel, cells core.CellModel) ([]core.Op, error) {
+	if level != core.O1 && level != core.O2 {
+		return ops, nil
+	}
+	passes, err := Passes()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range passes {
+		if ops, err = p.Run(ops, level, cells); err != nil {
+			return nil, err
+		}
+	}
+	return ops, nil
+}
+
+// ReadPassRequest reads a PassRequest from r, for a pass written in Go,
+// failing if it is in a newer protocol than this package knows.
+func ReadPassRequest(r io.Reader) (*PassRequest, error) {
+	var req PassRequest
+	if err := json.NewDecoder(r).Decode(&req); err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+	if req.Protocol > Protocol {
+		return nil, fmt.Errorf("request is in protocol %d, newer than %d", req.Protocol, Protocol)
+	}
+	return &req, nil
+}
+
+// PassMain is the main function of a pass written in Go: it reads the
+// request on stdin, transforms its IR with pass and writes the result to
+// stdout. It exits 1, with the error on stderr, if anything fails.
+func PassMain(pass func(*PassRequest) ([]core.Op, error)) {
+	if err := servePass(pass, os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", filepath.Base(os.Args[0]), err)
+		os.Exit(1)
+	}
+}
+
+func servePass(pass func(*PassRequest) ([]core.Op, error), stdin io.Reader, stdout io.Writer) error {
+	req, err := ReadPassRequest(stdin)
+	if err != nil {
+		return err
+	}
+	ops, err := pass(req)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(stdout).Encode(PassResult{Ops: jsonOps(ops)})
+}
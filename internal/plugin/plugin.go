@@ -0,0 +1,266 @@
+// Package plugin runs third-party backends: executables named
+// bfcc-backend-<arch> on the PATH, which build adds to its -arch values
+// without bfcc knowing anything about their target.
+//
+// bfcc talks to a plugin over its stdin and stdout. Run with -describe, a
+// plugin writes an Info as JSON and exits. Run with no arguments, it reads
+// a Request as JSON from stdin and writes the finished output file to
+// stdout. Anything it writes to stderr is shown to the user, and a
+// non-zero exit status fails the build.
+//
+// External optimiser passes, listed in BFCC_PASSES, speak a similar
+// protocol: see Pass.
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// Protocol is the version of the Request format, sent in every request.
+// It changes only if a Request can no longer be read as before; new fields
+// may be added without changing it.
+const Protocol = 1
+
+// Prefix starts the name of every plugin executable.
+const Prefix = "bfcc-backend-"
+
+// describeTimeout bounds how long a plugin may take to describe itself, so
+// that a broken one cannot hang `bfcc backends`.
+const describeTimeout = 5 * time.Second
+
+// Info is what a plugin says about itself when run with -describe.
+type Info struct {
+	Protocol    int    `json:"protocol"`             // the newest Protocol the plugin reads
+	Description string `json:"description"`          // one line, eg. "Game Boy ROM"
+	Suffix      string `json:"suffix,omitempty"`     // added to the default output file name, eg. ".gb"
+	Executable  bool   `json:"executable,omitempty"` // output is run directly, so is made mode 0755 rather than 0644
+}
+
+// Op is one IR op in a Request. Kind is its name in an IR dump, eg. "ADD",
+// "JZ" or "COPY_RANGE", with Arg and Off as in core.Op; the Arg of a
+// SECTION is the handoff, 0 for continue, 1 for share or 2 for reset.
+type Op struct {
+	Kind string         `json:"op"`
+	Arg  int            `json:"arg,omitempty"`
+	Off  int            `json:"off,omitempty"`
+	Pos  *core.Position `json:"pos,omitempty"`
+}
+
+// Request is what bfcc asks a plugin to build.
+type Request struct {
+	Protocol     int    `json:"protocol"`
+	Arch         string `json:"arch"`          // the plugin's name, for a plugin installed under several
+	Ops          []Op   `json:"ops"`           // optimised IR
+	TapeSize     int    `json:"tape_size"`     // cells on the tape
+	MidTape      bool   `json:"mid_tape"`      // start the data pointer at TapeSize/2
+	CellOverflow string `json:"cell_overflow"` // wrap, saturate or trap
+	SignedCells  bool   `json:"signed_cells"`  // cells hold -128 to 127, and EOF stores -1
+}
+
+// NewRequest returns the Request to build ops for arch with cells.
+func NewRequest(arch string, ops []core.Op, cells core.CellModel, midTape bool) *Request {
+	return &Request{
+		Protocol:     Protocol,
+		Arch:         arch,
+		Ops:          jsonOps(ops),
+		TapeSize:     core.TapeSize,
+		MidTape:      midTape,
+		CellOverflow: cells.Overflow.String(),
+		SignedCells:  cells.Signed,
+	}
+}
+
+// IR returns the ops of req, failing on an op kind it does not know.
+func (req *Request) IR() ([]core.Op, error) {
+	return coreOps(req.Ops)
+}
+
+// jsonOps returns ops as they are sent to a plugin.
+func jsonOps(ops []core.Op) []Op {
+	out := make([]Op, len(ops))
+	for i, op := range ops {
+		out[i] = Op{Kind: op.Kind.String(), Arg: op.Arg, Off: op.Off, Pos: op.Pos}
+	}
+	return out
+}
+
+// coreOps returns the ops sent or returned by a plugin, failing on an op
+// kind it does not know.
+func coreOps(in []Op) ([]core.Op, error) {
+	ops := make([]core.Op, len(in))
+	for i, op := range in {
+		kind, ok := parseOpKind(op.Kind)
+		if !ok {
+			return nil, fmt.Errorf("op %d: unknown op %q", i, op.Kind)
+		}
+		ops[i] = core.Op{Kind: kind, Arg: op.Arg, Off: op.Off, Pos: op.Pos}
+	}
+	return ops, nil
+}
+
+// CellModel returns the cell model of req.
+func (req *Request) CellModel() (core.CellModel, error) {
+	overflow, err := core.ParseCellOverflow(req.CellOverflow)
+	return core.CellModel{Overflow: overflow, Signed: req.SignedCells}, err
+}
+
+// parseOpKind returns the OpKind named name in an IR dump.
+func parseOpKind(name string) (core.OpKind, bool) {
+	for k := core.OpShift; k <= core.OpNop; k++ {
+		if k.String() == name {
+			return k, true
+		}
+	}
+	return 0, false
+}
+
+// Plugin is a plugin executable found on the PATH.
+type Plugin struct {
+	Arch string // the -arch it adds, its name without Prefix
+	Path string
+}
+
+// Discover returns the plugins on the PATH, sorted by arch. As with
+// commands, where two directories hold a plugin of the same name the one
+// earlier in the PATH is used.
+func Discover() []Plugin {
+	var plugins []Plugin
+	seen := map[string]bool{}
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if dir == "" {
+			dir = "."
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			arch, ok := strings.CutPrefix(entry.Name(), Prefix)
+			if !ok || arch == "" || seen[arch] {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			if _, err := exec.LookPath(path); err != nil {
+				continue // not executable
+			}
+			seen[arch] = true
+			plugins = append(plugins, Plugin{Arch: arch, Path: path})
+		}
+	}
+	slices.SortFunc(plugins, func(a, b Plugin) int { return strings.Compare(a.Arch, b.Arch) })
+	return plugins
+}
+
+// Find returns the plugin adding arch, if there is one on the PATH.
+func Find(arch string) (Plugin, bool) {
+	if arch == "" || strings.ContainsAny(arch, `/\`) {
+		return Plugin{}, false // a path, not a name to look up
+	}
+	path, err := exec.LookPath(Prefix + arch)
+	if err != nil {
+		return Plugin{}, false
+	}
+	return Plugin{Arch: arch, Path: path}, true
+}
+
+// Describe runs the plugin with -describe and returns what it says.
+func (p Plugin) Describe() (Info, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), describeTimeout)
+	defer cancel()
+
+	out, err := run(ctx, p.Path, nil, "-describe")
+	if err != nil {
+		return Info{}, err
+	}
+	var info Info
+	if err := json.Unmarshal(out, &info); err != nil {
+		return Info{}, fmt.Errorf("%s: invalid description: %w", p.Path, err)
+	}
+	if info.Protocol < Protocol {
+		return Info{}, fmt.Errorf("%s: reads protocol %d, but bfcc sends %d", p.Path, info.Protocol, Protocol)
+	}
+	return info, nil
+}
+
+// Build sends req to the plugin and returns the output file it writes.
+func (p Plugin) Build(req *Request) ([]byte, error) {
+	in, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	return run(context.Background(), p.Path, in)
+}
+
+// run runs the plugin or pass at path with args and stdin, passing its
+// stderr through, and returns its stdout.
+func run(ctx context.Context, path string, stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stderr = os.Stderr
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%s: timed out", path)
+		}
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return out.Bytes(), nil
+}
+
+// ReadRequest reads a Request from r, for a plugin written in Go, failing
+// if it is in a newer protocol than this package knows.
+func ReadRequest(r io.Reader) (*Request, error) {
+	var req Request
+	if err := json.NewDecoder(r).Decode(&req); err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+	if req.Protocol > Protocol {
+		return nil, fmt.Errorf("request is in protocol %d, newer than %d", req.Protocol, Protocol)
+	}
+	return &req, nil
+}
+
+// Main is the main function of a plugin written in Go: it describes the
+// plugin as info when run with -describe, and otherwise builds the request
+// on stdin with build and writes the result to stdout. It exits 1, with
+// the error on stderr, if anything fails.
+func Main(info Info, build func(*Request) ([]byte, error)) {
+	if err := serve(info, build, os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", filepath.Base(os.Args[0]), err)
+		os.Exit(1)
+	}
+}
+
+func serve(info Info, build func(*Request) ([]byte, error), args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 1 && args[0] == "-describe" {
+		info.Protocol = Protocol
+		return json.NewEncoder(stdout).Encode(info)
+	}
+	if len(args) != 0 {
+		return fmt.Errorf("run by bfcc build, not directly (unexpected arguments %q)", args)
+	}
+	req, err := ReadRequest(stdin)
+	if err != nil {
+		return err
+	}
+	out, err := build(req)
+	if err != nil {
+		return err
+	}
+	_, err = stdout.Write(out)
+	return err
+}
@@ -0,0 +1,197 @@
+// Package srcmap maps code addresses in a native executable back to the IR
+// ops, and through them the Brainfuck source, they were generated from.
+//
+// A map is embedded in the executable as the SectionName section, in a
+// line-based text format:
+//
+//	bfcc srcmap 1
+//	end 4010a3
+//	401000 - - prologue
+//	40102b 0 1:1 ADD   +6
+//	401032 1 1:7 JZ    L0
+//	401090 - - epilogue
+//
+// Each entry covers the code from its address up to the next entry's, and
+// the last up to end. Entries for runtime code such as the I/O helpers have
+// no op index or position.
+//
+// A map for a program of several files is version 2. It names the files
+// after end, and a position gives its file's index after the column:
+//
+//	bfcc srcmap 2
+//	end 4010a3
+//	file main.bf
+//	file lib.bf
+//	40102b 0 1:1:0 ADD   +6
+//	401032 1 3:2:1 JZ    L0
+package srcmap
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// SectionName is the ELF section holding the map.
+const SectionName = ".bfcc.srcmap"
+
+const (
+	header  = "bfcc srcmap 1"
+	header2 = "bfcc srcmap 2" // with files, see the package doc
+)
+
+// Entry is the start of the code generated for one op or runtime routine.
+type Entry struct {
+	Addr uint64
+	Op   int            // index of the op in the emitted IR, or -1 for runtime code
+	Pos  *core.Position // source position of the op, if known (Offset is not kept)
+	Name string         // the op as it appears in an IR dump, or the routine's name
+}
+
+// Map is a list of entries in address order.
+type Map struct {
+	Entries []Entry
+	End     uint64 // address just past the last entry's code
+}
+
+// Add appends an entry for the op at index i, starting at addr.
+func (m *Map) Add(addr uint64, i int, op core.Op) {
+	m.Entries = append(m.Entries, Entry{Addr: addr, Op: i, Pos: op.Pos, Name: op.String()})
+}
+
+// AddRoutine appends an entry for runtime code starting at addr.
+func (m *Map) AddRoutine(addr uint64, name string) {
+	m.Entries = append(m.Entries, Entry{Addr: addr, Op: -1, Name: name})
+}
+
+// Lookup returns the entry whose code contains addr. Where code is empty
+// several entries share an address, and the last of them is returned.
+func (m *Map) Lookup(addr uint64) (Entry, bool) {
+	if addr >= m.End {
+		return Entry{}, false
+	}
+	i, _ := slices.BinarySearchFunc(m.Entries, addr+1, func(e Entry, a uint64) int {
+		return cmp.Compare(e.Addr, a)
+	})
+	if i == 0 {
+		return Entry{}, false
+	}
+	return m.Entries[i-1], true
+}
+
+// Encode returns the map in its section format, version 2 only if a
+// position names its file.
+func (m *Map) Encode() []byte {
+	var files []string
+	for _, e := range m.Entries {
+		if e.Pos != nil && e.Pos.File != "" && !slices.Contains(files, e.Pos.File) {
+			files = append(files, e.Pos.File)
+		}
+	}
+
+	var out bytes.Buffer
+	if files == nil {
+		fmt.Fprintln(&out, header)
+	} else {
+		fmt.Fprintln(&out, header2)
+	}
+	fmt.Fprintf(&out, "end %x\n", m.End)
+	for _, file := range files {
+		fmt.Fprintf(&out, "file %s\n", file)
+	}
+	for _, e := range m.Entries {
+		op, pos := "-", "-"
+		if e.Op >= 0 {
+			op = strconv.Itoa(e.Op)
+		}
+		if e.Pos != nil {
+			pos = fmt.Sprintf("%d:%d", e.Pos.Line, e.Pos.Column)
+			if files != nil {
+				pos += fmt.Sprintf(":%d", slices.Index(files, e.Pos.File))
+			}
+		}
+		fmt.Fprintf(&out, "%x %s %s %s\n", e.Addr, op, pos, e.Name)
+	}
+	return out.Bytes()
+}
+
+// Decode parses a map in its section format, either version.
+func Decode(data []byte) (*Map, error) {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	if !sc.Scan() || (sc.Text() != header && sc.Text() != header2) {
+		return nil, errors.New("not a bfcc source map")
+	}
+	withFiles := sc.Text() == header2
+
+	m := &Map{}
+	if !sc.Scan() {
+		return nil, errors.New("source map has no end address")
+	}
+	end, ok := strings.CutPrefix(sc.Text(), "end ")
+	if !ok {
+		return nil, fmt.Errorf("source map line 2: want end address, got %q", sc.Text())
+	}
+	var err error
+	if m.End, err = strconv.ParseUint(end, 16, 64); err != nil {
+		return nil, fmt.Errorf("source map line 2: %w", err)
+	}
+
+	var files []string
+	for line := 3; sc.Scan(); line++ {
+		if withFiles {
+			if file, ok := strings.CutPrefix(sc.Text(), "file "); ok && len(m.Entries) == 0 {
+				files = append(files, file)
+				continue
+			}
+		}
+		e, err := decodeEntry(sc.Text(), files)
+		if err != nil {
+			return nil, fmt.Errorf("source map line %d: %w", line, err)
+		}
+		m.Entries = append(m.Entries, e)
+	}
+	return m, sc.Err()
+}
+
+// decodeEntry parses "addr op pos name", with pos naming one of files if
+// there are any.
+func decodeEntry(line string, files []string) (Entry, error) {
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) != 4 {
+		return Entry{}, fmt.Errorf("malformed entry %q", line)
+	}
+
+	e := Entry{Op: -1, Name: fields[3]}
+	var err error
+	if e.Addr, err = strconv.ParseUint(fields[0], 16, 64); err != nil {
+		return Entry{}, err
+	}
+	if fields[1] != "-" {
+		if e.Op, err = strconv.Atoi(fields[1]); err != nil {
+			return Entry{}, err
+		}
+	}
+	if fields[2] != "-" {
+		var pos core.Position
+		if files == nil {
+			if _, err := fmt.Sscanf(fields[2], "%d:%d", &pos.Line, &pos.Column); err != nil {
+				return Entry{}, fmt.Errorf("malformed position %q", fields[2])
+			}
+		} else {
+			var file int
+			if _, err := fmt.Sscanf(fields[2], "%d:%d:%d", &pos.Line, &pos.Column, &file); err != nil || file < 0 || file >= len(files) {
+				return Entry{}, fmt.Errorf("malformed position %q", fields[2])
+			}
+			pos.File = files[file]
+		}
+		e.Pos = &pos
+	}
+	return e, nil
+}
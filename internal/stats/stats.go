@@ -0,0 +1,186 @@
+// Package stats computes static metrics over a Brainfuck program, for
+// golfing and for curating program corpora.
+package stats
+
+import (
+	"io"
+	"strings"
+
+	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/internal/vm"
+)
+
+// Run is a sequence of consecutive identical commands.
+type Run struct {
+	Kind   core.TokenKind
+	Length int
+	Pos    core.Position
+}
+
+// Stats holds the static metrics of one program.
+type Stats struct {
+	Bytes        int
+	Lines        int
+	Commands     int
+	CommentBytes int
+	Counts       map[core.TokenKind]int // commands by token kind
+
+	Loops      int
+	MaxDepth   int
+	Depths     []int // Depths[d] is the number of loops opened at nesting depth d+1
+	LongestRun Run
+
+	// Tape range touched, relative to the starting cell, from a walk that
+	// assumes every loop body returns to the cell it started at. It is only
+	// meaningful when Balanced is true; otherwise Unbalanced is the first
+	// loop that moves the pointer overall.
+	Balanced   bool
+	Unbalanced core.Position
+	MinOffset  int
+	MaxOffset  int
+
+	IRSize [3]int // op count at -O 0, -O 1 and -O 2
+
+	// The highest cell the data pointer reached in a run, from Measure,
+	// which sizes the tape for the input run on rather than estimating it.
+	Measured  bool
+	HighWater int
+}
+
+// TapeCells returns the estimated minimum tape size, the number of cells
+// between the lowest and highest offsets reached.
+func (s *Stats) TapeCells() int {
+	return s.MaxOffset - s.MinOffset + 1
+}
+
+// CommentRatio returns the share of source bytes that are not commands.
+func (s *Stats) CommentRatio() float64 {
+	if s.Bytes == 0 {
+		return 0
+	}
+	return float64(s.CommentBytes) / float64(s.Bytes)
+}
+
+// Analyse computes the metrics for src. It fails if the brackets do not
+// match, as the loop and IR metrics need a valid program.
+func Analyse(src []byte) (*Stats, error) {
+	toks := core.Tokenize(src)
+	ops, err := core.Lower(toks)
+	if err != nil {
+		return nil, err
+	}
+
+	s := count(src, toks)
+	s.countLoops(toks)
+	s.walkTape(ops)
+
+	s.IRSize[core.O0] = len(ops)
+	for _, level := range []core.OptLevel{core.O1, core.O2} {
+		optimised, err := core.OptimiseWithLevel(ops, level)
+		if err != nil {
+			return nil, err
+		}
+		s.IRSize[level] = len(optimised)
+	}
+
+	return s, nil
+}
+
+// Measure runs src in the VM with input, for up to maxSteps steps (0 for
+// no limit), and records how far the data pointer got in HighWater. A run
+// that fails, eg. at the step limit, still records it, and returns the
+// error.
+func (s *Stats) Measure(src []byte, input string, maxSteps uint64) error {
+	ops, err := core.Lower(core.Tokenize(src))
+	if err != nil {
+		return err
+	}
+	interpreter := vm.NewVM(
+		vm.WithInput(strings.NewReader(input)),
+		vm.WithOutput(io.Discard),
+		vm.WithMaxSteps(maxSteps),
+	)
+	err = interpreter.Run(ops)
+	s.Measured, s.HighWater = true, interpreter.HighWater()
+	return err
+}
+
+// Count computes the metrics that need no valid program: Bytes, Lines,
+// Commands, CommentBytes and Counts.
+func Count(src []byte) *Stats {
+	return count(src, core.Tokenize(src))
+}
+
+// count is Count for src already tokenized as toks.
+func count(src []byte, toks []core.Token) *Stats {
+	s := &Stats{
+		Bytes:  len(src),
+		Lines:  toks[len(toks)-1].Pos.Line,
+		Counts: make(map[core.TokenKind]int),
+	}
+
+	// A trailing newline ends the last line rather than starting another
+	if len(src) > 0 && src[len(src)-1] == '\n' {
+		s.Lines--
+	}
+
+	s.Commands = len(toks) - 1 // all but TokEOF
+	for _, tok := range toks[:s.Commands] {
+		s.Counts[tok.Kind]++
+	}
+	s.CommentBytes = s.Bytes - s.Commands
+	return s
+}
+
+// countLoops fills in the loop nesting and run metrics.
+func (s *Stats) countLoops(toks []core.Token) {
+	depth := 0
+	for i := 0; i < len(toks) && toks[i].Kind != core.TokEOF; i++ {
+		tok := toks[i]
+		switch tok.Kind {
+		case core.TokLBracket:
+			depth++
+			s.Loops++
+			s.MaxDepth = max(s.MaxDepth, depth)
+			for len(s.Depths) < depth {
+				s.Depths = append(s.Depths, 0)
+			}
+			s.Depths[depth-1]++
+		case core.TokRBracket:
+			depth--
+		}
+
+		if n := core.FoldToken(toks, i, tok.Kind); n > s.LongestRun.Length {
+			s.LongestRun = Run{Kind: tok.Kind, Length: n, Pos: tok.Pos}
+		}
+	}
+}
+
+// walkTape tracks the pointer offset through the unoptimised IR, treating
+// each loop body as running once.
+func (s *Stats) walkTape(ops []core.Op) {
+	s.Balanced = true
+	offset := 0
+	starts := make([]int, 0, 8)
+
+	for _, op := range ops {
+		switch op.Kind {
+		case core.OpShift:
+			offset += op.Arg
+			s.MinOffset = min(s.MinOffset, offset)
+			s.MaxOffset = max(s.MaxOffset, offset)
+		case core.OpJz:
+			starts = append(starts, offset)
+		case core.OpJnz:
+			start := starts[len(starts)-1]
+			starts = starts[:len(starts)-1]
+			if offset != start {
+				s.Balanced = false
+				if op.Pos != nil {
+					s.Unbalanced = *op.Pos
+				}
+				return
+			}
+		}
+	}
+}
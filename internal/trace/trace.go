@@ -0,0 +1,94 @@
+// Package trace records what a running program does, as a sequence of
+// events that the VM and a native build (linux.WithTrace) both produce, so
+// that their runs can be compared step by step rather than only by final
+// output.
+//
+// An event is a loop being entered (its JZ finding a non-zero cell, not each
+// iteration), a byte read by IN (after end of input handling) or a byte
+// written by OUT. Native builds write each event to file descriptor FD as a
+// 4-byte little-endian record: the value in the low 24 bits and the kind in
+// the top byte.
+package trace
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// FD is the file descriptor a traced native build writes its events to.
+const FD = 3
+
+// Kind is the kind of an event, also its tag byte in a native record.
+type Kind byte
+
+const (
+	Loop Kind = 'L' // a loop was entered, Value is its label
+	In   Kind = 'I' // IN stored Value
+	Out  Kind = 'O' // OUT wrote Value
+)
+
+// MaxLabel is the largest loop label a native record can hold.
+const MaxLabel = 1<<24 - 1
+
+// Event is one step of a trace.
+type Event struct {
+	Kind  Kind
+	Value int
+}
+
+// Record returns the native record of e, as the 32-bit value written.
+func (e Event) Record() uint32 {
+	return uint32(e.Kind)<<24 | uint32(e.Value)&MaxLabel
+}
+
+// String returns the canonical text of the event, eg. "loop L3" or
+// "out 72 'H'".
+func (e Event) String() string {
+	switch e.Kind {
+	case Loop:
+		return fmt.Sprintf("loop L%d", e.Value)
+	case In, Out:
+		name := "in"
+		if e.Kind == Out {
+			name = "out"
+		}
+		if e.Value >= ' ' && e.Value <= '~' {
+			return fmt.Sprintf("%s %d %s", name, e.Value, strconv.QuoteRune(rune(e.Value)))
+		}
+		return fmt.Sprintf("%s %d", name, e.Value)
+	}
+	return fmt.Sprintf("unknown event %q %d", byte(e.Kind), e.Value)
+}
+
+// Decode parses the records written by a native build. A trailing partial
+// record, from a run cut short, is ignored.
+func Decode(data []byte) ([]Event, error) {
+	events := make([]Event, 0, len(data)/4)
+	for ; len(data) >= 4; data = data[4:] {
+		r := binary.LittleEndian.Uint32(data)
+		e := Event{Kind: Kind(r >> 24), Value: int(r & MaxLabel)}
+		switch e.Kind {
+		case Loop, In, Out:
+		default:
+			return events, fmt.Errorf("bad trace record %#08x after %d events", r, len(events))
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// FirstDiff returns the index of the first event where a and b differ, or
+// -1 if they are the same. If one is a prefix of the other, it is the
+// length of the shorter one.
+func FirstDiff(a, b []Event) int {
+	for i := range min(len(a), len(b)) {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	if len(a) != len(b) {
+		return min(len(a), len(b))
+	}
+	return -1
+}
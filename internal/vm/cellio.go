@@ -0,0 +1,215 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// CellIO is how IN and OUT move cells to and from the input and output
+// streams, see WithIO. The default is ByteIO.
+type CellIO interface {
+	// Read returns the next input cell, or ok false at the end of input.
+	Read(r io.Reader, cells core.CellModel) (cell byte, ok bool, err error)
+	// Write writes cell to w.
+	Write(w io.Writer, cell byte, cells core.CellModel) error
+}
+
+// WithIO sets how cells are read and written (default ByteIO).
+func WithIO(cio CellIO) VMOption {
+	return func(v *VM) {
+		v.cellIO = cio
+	}
+}
+
+// ParseIO returns a new CellIO by name: bytes, decimal, hex or escaped.
+func ParseIO(s string) (CellIO, error) {
+	switch s {
+	case "bytes":
+		return &ByteIO{}, nil
+	case "decimal":
+		return &DecimalIO{}, nil
+	case "hex":
+		return &EscapedIO{All: true}, nil
+	case "escaped":
+		return &EscapedIO{}, nil
+	}
+	return nil, fmt.Errorf("invalid I/O mode: %q (must be bytes, decimal, hex, or escaped)", s)
+}
+
+// ByteIO reads and writes each cell as one raw byte.
+type ByteIO struct {
+	buf [1]byte
+}
+
+func (b *ByteIO) Read(r io.Reader, _ core.CellModel) (byte, bool, error) {
+	n, err := r.Read(b.buf[:])
+	if err != nil && err != io.EOF {
+		return 0, false, err
+	}
+	// A read of nothing without an error shouldn't happen, but if it does
+	// then treat it as the end of input too
+	return b.buf[0], n > 0, nil
+}
+
+func (b *ByteIO) Write(w io.Writer, cell byte, _ core.CellModel) error {
+	b.buf[0] = cell
+	_, err := w.Write(b.buf[:])
+	return err
+}
+
+// DecimalIO reads and writes cells as decimal numbers, a convention of
+// teaching interpreters: OUT prints the cell's value and a newline, and IN
+// parses the next number from the input, skipping whitespace before it and
+// consuming the character after it. Numbers outside the cell range are
+// handled by the cell overflow policy.
+type DecimalIO struct {
+	buf []byte
+}
+
+// ErrNotDecimal is returned by DecimalIO when the input holds something
+// other than a number.
+var ErrNotDecimal error = core.MessageError(core.MsgNotDecimal)
+
+func (d *DecimalIO) Read(r io.Reader, cells core.CellModel) (byte, bool, error) {
+	d.buf = d.buf[:0]
+	var one [1]byte
+	for {
+		n, err := r.Read(one[:])
+		if err != nil && err != io.EOF {
+			return 0, false, err
+		}
+		if n == 0 {
+			break
+		}
+
+		c := one[0]
+		digit := c >= '0' && c <= '9'
+		sign := (c == '-' || c == '+') && len(d.buf) == 0
+		space := c == ' ' || c == '\t' || c == '\n' || c == '\r'
+		if digit || sign {
+			d.buf = append(d.buf, c)
+			continue
+		}
+		if space && len(d.buf) == 0 {
+			continue
+		}
+		if !space {
+			d.buf = append(d.buf, c)
+			return 0, false, core.Errorf(core.MsgNotDecimalGot, ErrNotDecimal, d.buf)
+		}
+		break
+	}
+
+	if len(d.buf) == 0 {
+		return 0, false, nil
+	}
+	k, err := strconv.Atoi(string(d.buf))
+	if err != nil {
+		return 0, false, core.Errorf(core.MsgNotDecimalGot, ErrNotDecimal, d.buf)
+	}
+
+	lo, hi := cells.Min(), cells.Max()
+	switch {
+	case k >= lo && k <= hi:
+	case cells.Overflow == core.OverflowTrap:
+		return 0, false, errors.New(core.Message(core.MsgInputOverflow, k, lo, hi))
+	case cells.Overflow == core.OverflowSaturate:
+		k = max(min(k, hi), lo)
+	}
+	return byte(k), true, nil
+}
+
+func (d *DecimalIO) Write(w io.Writer, cell byte, cells core.CellModel) error {
+	d.buf = strconv.AppendInt(d.buf[:0], int64(cells.Value(cell)), 10)
+	d.buf = append(d.buf, '\n')
+	_, err := w.Write(d.buf)
+	return err
+}
+
+// EscapedIO reads raw bytes like ByteIO, but writes output bytes that are
+// not printable ASCII as \xNN escapes, so the output of programs that write
+// binary can be looked at safely in a terminal. A backslash is written as
+// \\ to keep the output unambiguous, and newlines are written as they are,
+// to keep lines. With All set every byte is escaped, and a newline is
+// followed by a line break.
+type EscapedIO struct {
+	ByteIO
+	All bool
+	buf []byte
+}
+
+func (e *EscapedIO) Write(w io.Writer, cell byte, _ core.CellModel) error {
+	const hex = "0123456789abcdef"
+	switch {
+	case cell == '\n' && !e.All:
+		e.buf = append(e.buf[:0], cell)
+	case cell == '\\' && !e.All:
+		e.buf = append(e.buf[:0], '\\', '\\')
+	case cell >= 0x20 && cell < 0x7f && !e.All:
+		e.buf = append(e.buf[:0], cell)
+	default:
+		e.buf = append(e.buf[:0], '\\', 'x', hex[cell>>4], hex[cell&0xf])
+		if cell == '\n' {
+			e.buf = append(e.buf, '\n')
+		}
+	}
+	_, err := w.Write(e.buf)
+	return err
+}
+
+// WithTranscript logs every cell read and written to w, one line each with
+// the step it happened at:
+//
+//	12 in  0x48 H
+//	15 out 0x0a
+//	20 in  eof
+//
+// Cells are logged as the program sees them, so with DecimalIO a line holds
+// a number's value rather than its digits. The log is not checked for write
+// errors; give a writer that keeps them, such as a bufio.Writer.
+func WithTranscript(w io.Writer) VMOption {
+	return func(v *VM) {
+		v.transcript = w
+	}
+}
+
+// transcriptIO logs the cells passed through another CellIO.
+type transcriptIO struct {
+	CellIO
+	vm  *VM
+	w   io.Writer
+	buf []byte
+}
+
+func (t *transcriptIO) Read(r io.Reader, cells core.CellModel) (byte, bool, error) {
+	cell, ok, err := t.CellIO.Read(r, cells)
+	if err == nil {
+		t.log("in ", cell, ok)
+	}
+	return cell, ok, err
+}
+
+func (t *transcriptIO) Write(w io.Writer, cell byte, cells core.CellModel) error {
+	t.log("out", cell, true)
+	return t.CellIO.Write(w, cell, cells)
+}
+
+func (t *transcriptIO) log(dir string, cell byte, ok bool) {
+	t.buf = strconv.AppendUint(t.buf[:0], t.vm.steps, 10)
+	t.buf = append(t.buf, ' ')
+	t.buf = append(t.buf, dir...)
+	switch {
+	case !ok:
+		t.buf = append(t.buf, " eof"...)
+	case cell >= 0x20 && cell < 0x7f:
+		t.buf = fmt.Appendf(t.buf, " 0x%02x %c", cell, cell)
+	default:
+		t.buf = fmt.Appendf(t.buf, " 0x%02x", cell)
+	}
+	t.buf = append(t.buf, '\n')
+	t.w.Write(t.buf)
+}
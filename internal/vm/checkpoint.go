@@ -0,0 +1,196 @@
+package vm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// checkpointMagic identifies a checkpoint file, followed by the format version.
+const (
+	checkpointMagic   = "BFCK"
+	checkpointVersion = 1
+)
+
+// Snapshot is a copy of the VM state between two ops, taken so a long run
+// can be resumed later. Input already consumed and output already written
+// are not part of the snapshot.
+type Snapshot struct {
+	Program [sha256.Size]byte // hash of the ops the snapshot belongs to
+	PC      int
+	DP      int
+	Origin  int
+	Memory  []byte
+}
+
+// WithCheckpoint calls save with a snapshot of the VM state roughly every
+// interval. Snapshots are only taken on taken loop back-edges, so the
+// interval is a lower bound. If save returns an error the run stops with it.
+func WithCheckpoint(every time.Duration, save func(*Snapshot) error) VMOption {
+	return func(v *VM) {
+		v.checkpointEvery = every
+		v.checkpoint = save
+	}
+}
+
+// WithProgress calls report with the number of ops executed so far
+// roughly every interval. Like checkpoints, reports are only made on taken
+// loop back-edges, so a program without loops makes none.
+func WithProgress(every time.Duration, report func(steps uint64)) VMOption {
+	return func(v *VM) {
+		v.progressEvery = every
+		v.progress = report
+	}
+}
+
+// WithResume starts the next Run from a snapshot instead of a fresh tape.
+// Run fails if the snapshot was taken from a different program.
+func WithResume(s *Snapshot) VMOption {
+	return func(v *VM) {
+		v.resume = s
+	}
+}
+
+// programHash identifies an op stream, so snapshots are only restored into
+// the program (and optimisation level) they were taken from.
+func programHash(ops []core.Op) [sha256.Size]byte {
+	h := sha256.New()
+	var buf [16]byte
+	for _, op := range ops {
+		binary.LittleEndian.PutUint64(buf[0:], uint64(op.Kind))
+		binary.LittleEndian.PutUint64(buf[8:], uint64(op.Arg))
+		h.Write(buf[:])
+		if op.Off != 0 {
+			binary.LittleEndian.PutUint64(buf[0:], uint64(op.Off))
+			h.Write(buf[:8])
+		}
+	}
+
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// snapshot copies the current VM state.
+func (v *VM) snapshot() *Snapshot {
+	return &Snapshot{
+		Program: v.program,
+		PC:      v.pc,
+		DP:      v.dp,
+		Origin:  v.origin,
+		Memory:  bytes.Clone(v.memory),
+	}
+}
+
+// restore loads a snapshot taken from the same program, of numOps ops.
+// A file that matches the program's hash may still have been edited, so
+// the PC and the indices into the tape are checked before they are used.
+func (v *VM) restore(s *Snapshot, numOps int) error {
+	if s.Program != v.program {
+		return errors.New(core.Message(core.MsgCheckpointProgram))
+	}
+	if s.PC < 0 || s.PC > numOps {
+		return errors.New(core.Message(core.MsgCheckpointPC, s.PC, numOps))
+	}
+	if s.DP < 0 || s.DP >= len(s.Memory) {
+		return errors.New(core.Message(core.MsgCheckpointDP, s.DP))
+	}
+	if s.Origin < 0 || s.Origin >= len(s.Memory) {
+		return errors.New(core.Message(core.MsgCheckpointOrigin, s.Origin))
+	}
+
+	v.memory = bytes.Clone(s.Memory)
+	v.pc = s.PC
+	v.dp = s.DP
+	v.maxDP = s.DP
+	v.origin = s.Origin
+	return nil
+}
+
+// periodic reports whether the VM has work to do on back-edges.
+func (v *VM) periodic() bool {
+	return v.checkpoint != nil || v.progress != nil || v.ctx != nil
+}
+
+// onBackEdge runs the periodic work of a taken loop back-edge at pos:
+// stopping a cancelled run, and progress reports and checkpoints whose
+// interval has elapsed. The context and clock are only checked every 4096
+// back-edges to keep tight loops cheap.
+func (v *VM) onBackEdge(pos *core.Position) error {
+	v.backEdges++
+	if v.backEdges&0xFFF != 0 {
+		return nil
+	}
+	if err := v.cancelled(pos); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if v.progress != nil && now.Sub(v.lastProgress) >= v.progressEvery {
+		v.lastProgress = now
+		v.progress(v.steps)
+	}
+	if v.checkpoint != nil && now.Sub(v.lastCheckpoint) >= v.checkpointEvery {
+		v.lastCheckpoint = now
+		return v.checkpoint(v.snapshot())
+	}
+	return nil
+}
+
+// WriteTo encodes the snapshot in the checkpoint file format.
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	buf := make([]byte, 0, 4+4+sha256.Size+4*8+len(s.Memory))
+	buf = append(buf, checkpointMagic...)
+	buf = binary.LittleEndian.AppendUint32(buf, checkpointVersion)
+	buf = append(buf, s.Program[:]...)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(s.PC))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(s.DP))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(s.Origin))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(s.Memory)))
+	buf = append(buf, s.Memory...)
+
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// ReadSnapshot decodes a snapshot written by Snapshot.WriteTo.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	var hdr struct {
+		Magic   [4]byte
+		Version uint32
+		Program [sha256.Size]byte
+		PC      uint64
+		DP      uint64
+		Origin  uint64
+		MemLen  uint64
+	}
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return nil, core.Errorf(core.MsgCheckpointRead, err)
+	}
+	if string(hdr.Magic[:]) != checkpointMagic {
+		return nil, errors.New(core.Message(core.MsgNotCheckpoint))
+	}
+	if hdr.Version != checkpointVersion {
+		return nil, errors.New(core.Message(core.MsgCheckpointVersion, hdr.Version))
+	}
+	if hdr.MemLen > maxGrowSize {
+		return nil, errors.New(core.Message(core.MsgCheckpointTooLarge, hdr.MemLen))
+	}
+
+	s := &Snapshot{
+		Program: hdr.Program,
+		PC:      int(hdr.PC),
+		DP:      int(hdr.DP),
+		Origin:  int(hdr.Origin),
+		Memory:  make([]byte, hdr.MemLen),
+	}
+	if _, err := io.ReadFull(r, s.Memory); err != nil {
+		return nil, core.Errorf(core.MsgCheckpointReadTape, err)
+	}
+	return s, nil
+}
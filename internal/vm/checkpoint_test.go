@@ -0,0 +1,61 @@
+package vm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// TestRestore checks that a snapshot whose PC, data pointer or origin is
+// out of range, as an edited checkpoint file may be, fails the run with an
+// error rather than a panic.
+func TestRestore(t *testing.T) {
+	ops, err := core.Lower(core.Tokenize([]byte("+.")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		pc      int
+		dp      int
+		origin  int
+		want    string
+		wantErr bool
+	}{
+		{name: "start", want: "\x02"},
+		{name: "halted", pc: len(ops)},
+		{name: "negative pc", pc: -1, wantErr: true},
+		{name: "pc past the end", pc: len(ops) + 1, wantErr: true},
+		{name: "data pointer off the tape", dp: 16, wantErr: true},
+		{name: "origin off the tape", origin: -1, wantErr: true},
+		{name: "origin past the tape", origin: 16, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Snapshot{
+				Program: programHash(ops),
+				PC:      tt.pc,
+				DP:      tt.dp,
+				Origin:  tt.origin,
+				Memory:  []byte{1, 15: 0},
+			}
+			var out bytes.Buffer
+			err := NewVM(WithResume(s), WithOutput(&out)).Run(ops)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := out.String(); got != tt.want {
+				t.Errorf("wrote %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
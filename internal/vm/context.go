@@ -0,0 +1,85 @@
+package vm
+
+import (
+	"context"
+	"io"
+
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// WithContext stops a run once ctx is done, with a RuntimeError wrapping
+// context.Cause(ctx). The context is checked on taken loop back-edges, like
+// checkpoints, and interrupts a read waiting for input. Input is then read
+// ahead in blocks, and whatever arrives after a read was given up on is
+// lost.
+func WithContext(ctx context.Context) VMOption {
+	return func(v *VM) {
+		v.ctx = ctx
+	}
+}
+
+// cancelled returns the error for a run stopped by its context at pos, or
+// nil if the context is not done.
+func (v *VM) cancelled(pos *core.Position) error {
+	if v.ctx == nil || v.ctx.Err() == nil {
+		return nil
+	}
+	err := context.Cause(v.ctx)
+	return &RuntimeError{Msg: err.Error(), Pos: pos, PC: v.pc, Err: err}
+}
+
+// contextReader is an io.Reader that stops waiting when its context is
+// done. The read it gave up on carries on in the background. Reads are
+// made in blocks and buffered, so that waiting on the context is not paid
+// for on every byte.
+type contextReader struct {
+	ctx     context.Context
+	r       io.Reader
+	pending []byte // read but not yet returned
+	err     error  // returned once pending is drained
+}
+
+type readResult struct {
+	buf []byte
+	err error
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 && c.err == nil {
+		if err := c.fill(); err != nil {
+			return 0, err
+		}
+	}
+	if len(c.pending) == 0 {
+		err := c.err
+		c.err = nil
+		return 0, err
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// fill reads the next block, unless the context is done first.
+func (c *contextReader) fill() error {
+	if c.ctx.Err() != nil {
+		return context.Cause(c.ctx)
+	}
+
+	// Each read gets a buffer of its own, as one given up on may still
+	// complete into it
+	done := make(chan readResult, 1)
+	go func() {
+		buf := make([]byte, 4096)
+		n, err := c.r.Read(buf)
+		done <- readResult{buf[:n], err}
+	}()
+
+	select {
+	case res := <-done:
+		c.pending, c.err = res.buf, res.err
+		return nil
+	case <-c.ctx.Done():
+		return context.Cause(c.ctx)
+	}
+}
@@ -1,26 +1,35 @@
 package vm
 
 import (
-	"fmt"
+	"errors"
 
 	"github.com/lcox74/bfcc/internal/core"
 )
 
+// ErrStepLimit is wrapped by the RuntimeError returned when a run exceeds
+// the step limit set by WithMaxSteps.
+var ErrStepLimit = errors.New("step limit exceeded")
+
+// ErrTrap is wrapped by the RuntimeError returned when a TRAP op runs,
+// meaning control reached code that should be unreachable.
+var ErrTrap = errors.New("trap: reached unreachable code")
+
 // RuntimeError represents an error during VM execution.
 type RuntimeError struct {
 	Msg string
 	Pos *core.Position
 	PC  int
+	Err error // optional underlying error, eg. ErrStepLimit
 }
 
 func (e *RuntimeError) Error() string {
 	if e.Pos != nil {
-		return fmt.Sprintf("runtime error at PC %d (line %d, col %d): %s",
-			e.PC,
-			e.Pos.Line,
-			e.Pos.Column,
-			e.Msg,
-		)
+		return core.InFile(e.Pos, core.Message(core.MsgRuntimeErrorAt, e.PC, e.Pos.Line, e.Pos.Column, e.Msg))
 	}
-	return fmt.Sprintf("runtime error at PC %d: %s", e.PC, e.Msg)
+	return core.Message(core.MsgRuntimeError, e.PC, e.Msg)
+}
+
+// Unwrap returns the underlying error, if any.
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
 }
@@ -0,0 +1,138 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+)
+
+// Newline is the line ending a program reads and writes. NewlineReader
+// and NewlineWriter translate between it and the \n of the streams around
+// the program, for programs written for interpreters on other systems.
+type Newline int
+
+const (
+	NewlineLF   Newline = iota // \n, as on Unix: nothing is translated
+	NewlineCR                  // \r (13), as some historical interpreters read Enter
+	NewlineCRLF                // \r\n, as on DOS and Windows
+)
+
+// ParseNewline returns a Newline by name: lf, cr or crlf.
+func ParseNewline(s string) (Newline, error) {
+	switch s {
+	case "lf":
+		return NewlineLF, nil
+	case "cr":
+		return NewlineCR, nil
+	case "crlf":
+		return NewlineCRLF, nil
+	}
+	return 0, fmt.Errorf("invalid newline: %q (must be lf, cr, or crlf)", s)
+}
+
+// NewlineReader returns a reader giving the program r's lines ending in
+// nl. Lines of r may end in \n or \r\n.
+func NewlineReader(r io.Reader, nl Newline) io.Reader {
+	if nl == NewlineLF {
+		return r
+	}
+	return &newlineReader{r: r, nl: nl, in: make([]byte, 4096)}
+}
+
+// newlineReader translates the line endings of r, a block at a time.
+type newlineReader struct {
+	r       io.Reader
+	nl      Newline
+	in      []byte // the block read from r
+	out     []byte // translated but not yet returned
+	pending []byte // the unread part of out
+	cr      bool   // the last byte read from r was \r
+	err     error  // returned once pending is drained
+}
+
+func (n *newlineReader) Read(p []byte) (int, error) {
+	for len(n.pending) == 0 {
+		if n.err != nil {
+			return 0, n.err
+		}
+		k, err := n.r.Read(n.in)
+		n.out = n.translate(n.out[:0], n.in[:k])
+		n.pending, n.err = n.out, err
+	}
+	k := copy(p, n.pending)
+	n.pending = n.pending[k:]
+	return k, nil
+}
+
+// translate appends b to dst with each \n, or \r\n, as n.nl.
+func (n *newlineReader) translate(dst, b []byte) []byte {
+	for _, c := range b {
+		switch {
+		case c != '\n':
+			dst = append(dst, c)
+		case n.nl == NewlineCRLF && !n.cr:
+			dst = append(dst, '\r', '\n')
+		case n.nl == NewlineCRLF:
+			dst = append(dst, '\n') // \r\n is already CRLF
+		case !n.cr:
+			dst = append(dst, '\r') // the \r of a \r\n stands for the line
+		}
+		n.cr = c == '\r'
+	}
+	return dst
+}
+
+// NewlineWriter is a writer taking the program's lines ending in nl and
+// writing them to the underlying writer ending in \n. Other \r bytes are
+// written as they are. With NewlineCRLF a \r at the end of a Write is held
+// until the next shows whether a \n follows it, so Flush writes it once
+// the program is done.
+type NewlineWriter struct {
+	w   io.Writer
+	nl  Newline
+	cr  bool // a \r is held back
+	buf []byte
+}
+
+// NewNewlineWriter returns a NewlineWriter writing to w.
+func NewNewlineWriter(w io.Writer, nl Newline) *NewlineWriter {
+	return &NewlineWriter{w: w, nl: nl}
+}
+
+func (n *NewlineWriter) Write(p []byte) (int, error) {
+	if n.nl == NewlineLF {
+		return n.w.Write(p)
+	}
+	n.buf = n.buf[:0]
+	for _, c := range p {
+		if n.nl == NewlineCR {
+			if c == '\r' {
+				c = '\n'
+			}
+			n.buf = append(n.buf, c)
+			continue
+		}
+		if n.cr && c != '\n' {
+			n.buf = append(n.buf, '\r')
+		}
+		n.cr = c == '\r'
+		if !n.cr {
+			n.buf = append(n.buf, c)
+		}
+	}
+	if len(n.buf) > 0 {
+		if _, err := n.w.Write(n.buf); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes a \r held back at the end of the last Write.
+func (n *NewlineWriter) Flush() error {
+	if !n.cr {
+		return nil
+	}
+	n.cr = false
+	_, err := n.w.Write([]byte{'\r'})
+	return err
+}
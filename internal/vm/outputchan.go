@@ -0,0 +1,46 @@
+package vm
+
+import "context"
+
+// WithOutputChan sends the output to ch instead of a writer, as byte
+// slices the receiver owns: a straight-line run of OUTs in one slice, as
+// Run writes them. A run waits for the receiver while ch is full, so a
+// slow consumer holds the program back rather than output piling up, and
+// with WithContext it stops waiting once the context is done, failing
+// with an output error wrapping context.Cause(ctx).
+//
+// Run never closes ch, so a VM can run again on it. Close it once Run
+// returns to end a range over it.
+func WithOutputChan(ch chan<- []byte) VMOption {
+	return func(v *VM) {
+		v.outputCh = ch
+	}
+}
+
+// chanWriter is an io.Writer sending a copy of each write on ch, until
+// its context, if any, is done.
+type chanWriter struct {
+	ctx context.Context
+	ch  chan<- []byte
+}
+
+func (c *chanWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	// The VM reuses p, so the receiver gets a copy
+	buf := append([]byte(nil), p...)
+	if c.ctx == nil {
+		c.ch <- buf
+		return len(p), nil
+	}
+	if c.ctx.Err() != nil {
+		return 0, context.Cause(c.ctx)
+	}
+	select {
+	case c.ch <- buf:
+		return len(p), nil
+	case <-c.ctx.Done():
+		return 0, context.Cause(c.ctx)
+	}
+}
@@ -0,0 +1,229 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// EventKind is the kind of an Event from a Stepper.
+type EventKind int
+
+const (
+	EventOutput       EventKind = iota // an OUT op wrote Value
+	EventInputRequest                  // an IN op waits for Input or InputEOF
+	EventLoopEnter                     // a loop was entered (not iterated)
+	EventHalt                          // the program ran to its end
+)
+
+var eventKindNames = [...]string{"output", "input request", "loop enter", "halt"}
+
+func (k EventKind) String() string {
+	if int(k) < len(eventKindNames) {
+		return eventKindNames[k]
+	}
+	return fmt.Sprintf("EventKind(%d)", int(k))
+}
+
+// Event is something a program did that can be seen from outside it.
+type Event struct {
+	Kind  EventKind
+	Value byte           // the cell written, for EventOutput
+	Label int            // the loop label, for EventLoopEnter
+	PC    int            // index of the op, len(ops) for EventHalt
+	Pos   *core.Position // source position of the op, nil for EventHalt
+	Steps uint64         // ops executed so far
+}
+
+// ErrInputPending is returned by Next when it is called after an
+// EventInputRequest without Input or InputEOF.
+var ErrInputPending error = core.MessageError(core.MsgInputPending)
+
+// Stepper runs a program one event at a time, for callers such as GUIs and
+// notebooks that drive execution themselves. Nothing is read from or
+// written to the VM's input and output: input is handed over with Input or
+// InputEOF after an EventInputRequest, and output comes back as
+// EventOutput.
+//
+// The cell model, tape, step limit and context options apply as they do
+// to Run. Op counts, traces, I/O modes, progress reports and checkpoints
+// do not.
+type Stepper struct {
+	v        *VM
+	ops      []core.Op
+	targets  []int
+	backEdge bool  // the JZ about to run was jumped back to by its JNZ
+	waiting  bool  // stopped at an IN op for input
+	given    bool  // input was given for the IN op
+	input    byte  // the cell given
+	err      error // the error that stopped the program
+}
+
+// Stepper returns a Stepper over ops, starting from a fresh tape. The VM
+// must not be used for anything else until the Stepper is done with.
+func (v *VM) Stepper(ops []core.Op) (*Stepper, error) {
+	targets, err := core.ResolveJumps(ops)
+	if err != nil {
+		return nil, err
+	}
+	v.reset()
+	return &Stepper{v: v, ops: ops, targets: targets}, nil
+}
+
+// Input gives the cell for the IN op that raised the last
+// EventInputRequest.
+func (s *Stepper) Input(cell byte) {
+	s.input, s.given = cell, true
+}
+
+// InputEOF reports the end of input to the IN op that raised the last
+// EventInputRequest, which stores 0 (or -1 for signed cells).
+func (s *Stepper) InputEOF() {
+	s.input, s.given = s.v.cells.EOF(), true
+}
+
+// Next runs the program up to and including its next event. Once the
+// program halts Next keeps returning EventHalt, and once it fails, the
+// error it failed with.
+func (s *Stepper) Next() (Event, error) {
+	if s.err != nil {
+		return Event{}, s.err
+	}
+	ev, err := s.next()
+	if err != nil {
+		s.err = err
+	}
+	return ev, err
+}
+
+func (s *Stepper) next() (Event, error) {
+	v := s.v
+	if s.waiting {
+		if !s.given {
+			return Event{}, ErrInputPending
+		}
+		v.memory[v.dp] = s.input
+		s.waiting, s.given = false, false
+		v.pc++
+	}
+
+	for v.pc < len(s.ops) {
+		op := s.ops[v.pc]
+
+		v.steps++
+		if v.maxSteps > 0 && v.steps > v.maxSteps {
+			return Event{}, &RuntimeError{
+				Msg: core.Message(core.MsgStepLimit, v.maxSteps),
+				Pos: op.Pos,
+				PC:  v.pc,
+				Err: ErrStepLimit,
+			}
+		}
+
+		switch op.Kind {
+		case core.OpShift:
+			v.dp += op.Arg
+			if v.dp < 0 || v.dp >= len(v.memory) {
+				if err := v.outOfBounds(op); err != nil {
+					return Event{}, err
+				}
+			}
+			v.maxDP = max(v.maxDP, v.dp)
+
+		case core.OpAdd:
+			if v.cells.Overflow == core.OverflowWrap {
+				v.memory[v.dp] += byte(op.Arg)
+				break
+			}
+			if err := v.addChecked(op); err != nil {
+				return Event{}, err
+			}
+
+		case core.OpZero:
+			v.memory[v.dp] = 0
+
+		case core.OpIn:
+			// The pc stays on the IN op until the input is given
+			s.waiting = true
+			return s.event(EventInputRequest, op), nil
+
+		case core.OpOut:
+			ev := s.event(EventOutput, op)
+			ev.Value = v.memory[v.dp]
+			v.pc++
+			return ev, nil
+
+		case core.OpJz:
+			if v.memory[v.dp] == 0 {
+				v.pc = s.targets[v.pc]
+				continue
+			}
+			if !s.backEdge {
+				ev := s.event(EventLoopEnter, op)
+				ev.Label = op.Arg
+				v.pc++
+				return ev, nil
+			}
+			s.backEdge = false
+
+		case core.OpJnz:
+			if v.memory[v.dp] != 0 {
+				v.pc = s.targets[v.pc]
+				s.backEdge = true
+				v.backEdges++
+				if v.backEdges&0xFFF == 0 {
+					if err := v.cancelled(op.Pos); err != nil {
+						return Event{}, err
+					}
+				}
+				continue
+			}
+
+		case core.OpZeroRange, core.OpCopyRange:
+			if err := v.rangeOp(op); err != nil {
+				return Event{}, err
+			}
+
+		case core.OpTrap:
+			return Event{}, &RuntimeError{Msg: core.Message(core.MsgTrap), Pos: op.Pos, PC: v.pc, Err: ErrTrap}
+
+		case core.OpSection:
+			v.dp = v.origin
+			if core.Handoff(op.Arg) == core.HandoffReset {
+				clear(v.memory)
+			}
+		}
+
+		v.pc++
+	}
+
+	return Event{Kind: EventHalt, PC: v.pc, Steps: v.steps}, nil
+}
+
+// event returns an event of the given kind at op, the one at the pc.
+func (s *Stepper) event(kind EventKind, op core.Op) Event {
+	return Event{Kind: kind, PC: s.v.pc, Pos: op.Pos, Steps: s.v.steps}
+}
+
+// PC returns the index of the next op to run.
+func (s *Stepper) PC() int {
+	return s.v.pc
+}
+
+// Pointer returns the cell the data pointer is on, counting from the start
+// cell of the tape.
+func (s *Stepper) Pointer() int {
+	return s.v.dp - s.v.origin
+}
+
+// Tape returns the tape and the index in it of the start cell, which Pointer
+// counts from. The slice is the VM's own, and is only valid until the next
+// call to Next.
+func (s *Stepper) Tape() ([]byte, int) {
+	return s.v.memory, s.v.origin
+}
+
+// Steps returns the number of ops executed so far.
+func (s *Stepper) Steps() uint64 {
+	return s.v.steps
+}
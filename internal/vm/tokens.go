@@ -0,0 +1,145 @@
+package vm
+
+import (
+	"time"
+
+	"github.com/lcox74/bfcc/internal/core"
+)
+
+// RunTokens interprets the source tokens directly, one command at a time,
+// without lowering them to IR. It shares nothing with core.Lower or the
+// optimiser, so it serves as an oracle for them, and as a baseline for how
+// much folding runs of commands and optimising buys.
+//
+// The cell model, tape bounds, mid-tape start, dialect, I/O, step limit,
+// progress, context and command count options apply as they do to Run,
+// with one step per command.
+// Op counts, traces and checkpoints are not supported. Runtime errors carry
+// the token index as their PC.
+func (v *VM) RunTokens(toks []core.Token) error {
+	match, err := matchBrackets(toks)
+	if err != nil {
+		return err
+	}
+
+	v.reset()
+
+	v.lastProgress = time.Now()
+
+	wrap := v.cells.Overflow == core.OverflowWrap
+	periodic := v.progress != nil || v.ctx != nil // checkpoints are not supported
+	for v.pc = 0; v.pc < len(toks); v.pc++ {
+		tok := &toks[v.pc]
+		if tok.Kind == core.TokEOF {
+			break
+		}
+
+		v.steps++
+		if v.countCmds {
+			v.commands++
+		}
+		if v.maxSteps > 0 && v.steps > v.maxSteps {
+			return &RuntimeError{
+				Msg: core.Message(core.MsgStepLimit, v.maxSteps),
+				Pos: &tok.Pos,
+				PC:  v.pc,
+				Err: ErrStepLimit,
+			}
+		}
+
+		// The bounds and overflow checks are shared with Run, and report the
+		// position of the op they are given
+		switch tok.Kind {
+		case core.TokShiftRight, core.TokShiftLeft:
+			if tok.Kind == core.TokShiftRight {
+				v.dp++
+			} else {
+				v.dp--
+			}
+			if v.dp < 0 || v.dp >= len(v.memory) {
+				if err := v.outOfBounds(core.Op{Kind: core.OpShift, Pos: &tok.Pos}); err != nil {
+					return err
+				}
+			}
+			v.maxDP = max(v.maxDP, v.dp)
+
+		case core.TokAdd, core.TokSub:
+			k := 1
+			if tok.Kind == core.TokSub {
+				k = -1
+			}
+			if wrap {
+				v.memory[v.dp] += byte(k)
+				break
+			}
+			if err := v.addChecked(core.Op{Kind: core.OpAdd, Arg: k, Pos: &tok.Pos}); err != nil {
+				return err
+			}
+
+		case core.TokIn:
+			cell, ok, err := v.cellIO.Read(v.input, v.cells)
+			if err != nil {
+				return &RuntimeError{Msg: core.Message(core.MsgInputError, err), Pos: &tok.Pos, PC: v.pc, Err: err}
+			} else if !ok {
+				v.memory[v.dp] = v.cells.EOF()
+			} else {
+				v.memory[v.dp] = cell
+			}
+
+		case core.TokOut:
+			if err := v.cellIO.Write(v.output, v.memory[v.dp], v.cells); err != nil {
+				return &RuntimeError{Msg: core.Message(core.MsgOutputError, err), Pos: &tok.Pos, PC: v.pc, Err: err}
+			}
+
+		case core.TokLBracket:
+			if v.memory[v.dp] == 0 {
+				v.pc = match[v.pc]
+			}
+
+		case core.TokRBracket:
+			if v.jumpBack {
+				v.pc = match[v.pc] - 1 // the loop increment lands on the [
+				if periodic {
+					if err := v.onBackEdge(&tok.Pos); err != nil {
+						return err
+					}
+				}
+			} else if v.memory[v.dp] != 0 {
+				v.pc = match[v.pc]
+				if periodic {
+					if err := v.onBackEdge(&tok.Pos); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// matchBrackets returns the index of the matching bracket for each bracket
+// token, with the same errors as core.Lower for unmatched ones.
+func matchBrackets(toks []core.Token) ([]int, error) {
+	match := make([]int, len(toks))
+	var open []int
+
+	for i, tok := range toks {
+		switch tok.Kind {
+		case core.TokLBracket:
+			open = append(open, i)
+		case core.TokRBracket:
+			if len(open) == 0 {
+				return nil, &core.Error{Msg: core.Message(core.MsgUnmatchedClose), Pos: tok.Pos}
+			}
+			j := open[len(open)-1]
+			open = open[:len(open)-1]
+			match[i], match[j] = j, i
+		}
+	}
+
+	if len(open) > 0 {
+		return nil, &core.Error{Msg: core.Message(core.MsgUnmatchedOpen), Pos: toks[open[0]].Pos}
+	}
+	return match, nil
+}
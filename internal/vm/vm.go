@@ -2,22 +2,63 @@
 package vm
 
 import (
-	"fmt"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"io"
 	"os"
+	"time"
 
 	"github.com/lcox74/bfcc/internal/core"
+	"github.com/lcox74/bfcc/internal/trace"
 )
 
+// maxGrowSize caps how far a growing tape may extend (256 MiB).
+const maxGrowSize = 1 << 28
+
 // VM executes Brainfuck IR operations.
 type VM struct {
-	memSize int
-	input   io.Reader
-	output  io.Writer
-	memory  []byte
-	dp      int     // data pointer
-	pc      int     // program counter
-	ioBuf   [1]byte // reusable I/O buffer to avoid allocations
+	memSize   int
+	cells     core.CellModel
+	underflow core.TapeBound // policy when dp moves below 0
+	overflow  core.TapeBound // policy when dp moves past the last cell
+	midTape   bool           // start dp in the middle of the tape
+	origin    int            // memory index of cell 0, moves as the tape grows left
+	input     io.Reader
+	output    io.Writer
+	cellIO    CellIO // how IN and OUT convert cells, see WithIO
+	pending   []byte // OUT bytes not yet written, see flush
+	pendingAt int    // pc of the OUT that wrote pending[0]
+	memory    []byte
+	dp        int // data pointer
+	maxDP     int // highest dp reached, see HighWater
+	pc        int // program counter
+
+	// Checkpointing, see checkpoint.go
+	program         [sha256.Size]byte
+	checkpoint      func(*Snapshot) error
+	checkpointEvery time.Duration
+	lastCheckpoint  time.Time
+	backEdges       uint64
+	resume          *Snapshot
+
+	// Progress reports, see WithProgress
+	progress      func(steps uint64)
+	progressEvery time.Duration
+	lastProgress  time.Time
+
+	ctx      context.Context // see WithContext
+	outputCh chan<- []byte   // see WithOutputChan
+
+	counts     []uint64          // per-op execution counts, see WithOpCounts
+	trace      func(trace.Event) // see WithTrace
+	transcript io.Writer         // see WithTranscript
+	steps      uint64            // ops executed by the last Run
+	commands   uint64            // source commands executed, see WithCommandCount
+	countCmds  bool              // see WithCommandCount
+	maxSteps   uint64            // 0 means unlimited
+	jumpBack   bool              // see WithDialect
+	tapeInit   []byte            // see WithTapeInit
 }
 
 // VMOption is a functional option for configuring a VM.
@@ -30,6 +71,109 @@ func WithMemorySize(size int) VMOption {
 	}
 }
 
+// WithCellOverflow sets the cell overflow policy (default core.OverflowWrap).
+func WithCellOverflow(overflow core.CellOverflow) VMOption {
+	return func(v *VM) {
+		v.cells.Overflow = overflow
+	}
+}
+
+// WithSignedCells treats cells as signed bytes (-128 to 127), which moves the
+// overflow bounds and makes IN store -1 at end of input.
+func WithSignedCells() VMOption {
+	return func(v *VM) {
+		v.cells.Signed = true
+	}
+}
+
+// WithCells sets the whole cell model at once, see WithCellOverflow and
+// WithSignedCells.
+func WithCells(cells core.CellModel) VMOption {
+	return func(v *VM) {
+		v.cells = cells
+	}
+}
+
+// WithTapeUnderflow sets the policy for moving below cell 0 (default
+// core.BoundError). With core.BoundGrow the tape is extended leftwards on
+// demand, giving negative cell indices.
+func WithTapeUnderflow(b core.TapeBound) VMOption {
+	return func(v *VM) {
+		v.underflow = b
+	}
+}
+
+// WithTapeOverflow sets the policy for moving past the last cell (default
+// core.BoundError). With core.BoundGrow the tape is extended on demand.
+func WithTapeOverflow(b core.TapeBound) VMOption {
+	return func(v *VM) {
+		v.overflow = b
+	}
+}
+
+// WithMidTape starts the data pointer in the middle of the tape rather than
+// at cell 0, for programs that expect to move left from where they start.
+func WithMidTape() VMOption {
+	return func(v *VM) {
+		v.midTape = true
+	}
+}
+
+// WithTapeInit copies data to the tape from the first cell at the start
+// of every run, leaving out any bytes past the end of the tape. A
+// core.HandoffReset section clears them with the rest of the tape.
+func WithTapeInit(data []byte) VMOption {
+	return func(v *VM) {
+		v.tapeInit = data
+	}
+}
+
+// WithOpCounts records how many times each op executes: counts[i] is
+// incremented every time ops[i] runs. counts must be at least len(ops) long.
+func WithOpCounts(counts []uint64) VMOption {
+	return func(v *VM) {
+		v.counts = counts
+	}
+}
+
+// WithCommandCount counts the source commands each Run executes, for
+// Commands, rather than leaving it at 0. The ops must be unoptimised, as
+// the count comes from core.Op.Commands. A loop's [ counts once on entry
+// and ] on every iteration, as RunTokens steps through them, or with
+// core.DialectJumpBack (see WithDialect) [ counts on every iteration too.
+func WithCommandCount() VMOption {
+	return func(v *VM) {
+		v.countCmds = true
+	}
+}
+
+// WithTrace calls record with each loop entry (not each iteration), input
+// byte and output byte of a Run, in order, as a traced native build
+// reports them.
+func WithTrace(record func(trace.Event)) VMOption {
+	return func(v *VM) {
+		v.trace = record
+	}
+}
+
+// WithDialect runs source tokens in dialect d. With core.DialectJumpBack
+// RunTokens takes every ] back to its [, counting a step for the [ test on
+// each iteration. The other dialects run alike, and IR is unaffected but
+// for WithCommandCount, which counts the [ tests as RunTokens does.
+func WithDialect(d core.Dialect) VMOption {
+	return func(v *VM) {
+		v.jumpBack = d == core.DialectJumpBack
+	}
+}
+
+// WithMaxSteps stops a run with ErrStepLimit after n ops (0 means no limit),
+// so untrusted or mutated programs cannot loop forever.
+func WithMaxSteps(n uint64) VMOption {
+	return func(v *VM) {
+		v.maxSteps = n
+	}
+}
+
 // WithInput sets the input reader (default os.Stdin).
 func WithInput(r io.Reader) VMOption {
 	return func(v *VM) {
@@ -50,84 +194,221 @@ func NewVM(opts ...VMOption) *VM {
 		memSize: 30000,
 		input:   os.Stdin,
 		output:  os.Stdout,
+		cellIO:  &ByteIO{},
 	}
 
 	for _, opt := range opts {
 		opt(vm)
 	}
+	if vm.transcript != nil {
+		vm.cellIO = &transcriptIO{CellIO: vm.cellIO, vm: vm, w: vm.transcript}
+	}
+	if vm.ctx != nil && vm.ctx.Done() != nil {
+		vm.input = &contextReader{ctx: vm.ctx, r: vm.input}
+	}
+	if vm.outputCh != nil {
+		vm.output = &chanWriter{ctx: vm.ctx, ch: vm.outputCh}
+	}
 
 	return vm
 }
 
 // Run executes the given IR operations.
+//
+// With the default ByteIO, each straight-line run of OUTs, between the
+// loops and INs around it, is collected and written in one Write rather
+// than a Write per byte. Anything written before Run returns, even with an
+// error, has been passed to the output.
 func (v *VM) Run(ops []core.Op) error {
-	v.memory = make([]byte, v.memSize)
-	v.dp = 0
-	v.pc = 0
+	err := v.run(ops)
+	if ferr := v.flush(ops); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// run is Run, leaving the last of the output pending.
+func (v *VM) run(ops []core.Op) error {
+	v.reset()
+
+	if v.checkpoint != nil || v.resume != nil {
+		v.program = programHash(ops)
+		v.lastCheckpoint = time.Now()
+	}
+	v.lastProgress = time.Now()
+	if v.resume != nil {
+		if err := v.restore(v.resume, len(ops)); err != nil {
+			return err
+		}
+	}
+
+	// Resolve loop labels to op indices once, up front
+	targets, err := core.ResolveJumps(ops)
+	if err != nil {
+		return err
+	}
 
 	// Cache frequently accessed values for the hot loop
 	memory := v.memory
-	memSize := v.memSize
+	memSize := len(memory)
+	periodic := v.periodic()
+	wrap := v.cells.Overflow == core.OverflowWrap
+	counts := v.counts
+	record := v.trace
+	backEdge := false // the JZ about to run was jumped back to by its JNZ
+	countCmds := v.countCmds
+	retest := false // likewise, for the command count
+	_, batch := v.cellIO.(*ByteIO)
+	maxSteps := v.maxSteps
 	numOps := len(ops)
 
 	for v.pc < numOps {
 		op := ops[v.pc]
+		if counts != nil {
+			counts[v.pc]++
+		}
+		if countCmds {
+			v.countCommands(op, retest)
+			retest = false
+		}
+
+		v.steps++
+		if maxSteps > 0 && v.steps > maxSteps {
+			return &RuntimeError{
+				Msg: core.Message(core.MsgStepLimit, maxSteps),
+				Pos: op.Pos,
+				PC:  v.pc,
+				Err: ErrStepLimit,
+			}
+		}
 
 		switch op.Kind {
 		case core.OpShift:
 			v.dp += op.Arg
 			if v.dp < 0 || v.dp >= memSize {
-				return &RuntimeError{
-					Msg: fmt.Sprintf("data pointer out of bounds: %d (valid range 0-%d)", v.dp, memSize-1),
-					Pos: op.Pos,
-					PC:  v.pc,
+				if err := v.outOfBounds(op); err != nil {
+					return err
 				}
+				// The tape may have grown
+				memory = v.memory
+				memSize = len(memory)
+			}
+			if v.dp > v.maxDP {
+				v.maxDP = v.dp
 			}
 
 		case core.OpAdd:
-			memory[v.dp] += byte(op.Arg)
+			if wrap {
+				memory[v.dp] += byte(op.Arg)
+				break
+			}
+			if err := v.addChecked(op); err != nil {
+				return err
+			}
 
 		case core.OpZero:
 			memory[v.dp] = 0
 
 		case core.OpIn:
-			n, err := v.input.Read(v.ioBuf[:])
-			if err == io.EOF || n == 0 {
-				// This shouldn't happen, but if it does then lets just treat
-				// it as a 0.
-				memory[v.dp] = 0
-			} else if err != nil {
+			if err := v.flush(ops); err != nil {
+				return err
+			}
+			cell, ok, err := v.cellIO.Read(v.input, v.cells)
+			if err != nil {
 				return &RuntimeError{
-					Msg: fmt.Sprintf("input error: %v", err),
+					Msg: core.Message(core.MsgInputError, err),
 					Pos: op.Pos,
 					PC:  v.pc,
+					Err: err,
 				}
+			} else if !ok {
+				// End of input stores 0 (or -1 for signed cells)
+				memory[v.dp] = v.cells.EOF()
 			} else {
-				memory[v.dp] = v.ioBuf[0]
+				memory[v.dp] = cell
+			}
+			if record != nil {
+				record(trace.Event{Kind: trace.In, Value: int(memory[v.dp])})
 			}
 
 		case core.OpOut:
-			v.ioBuf[0] = memory[v.dp]
-			_, err := v.output.Write(v.ioBuf[:])
-			if err != nil {
+			if record != nil {
+				record(trace.Event{Kind: trace.Out, Value: int(memory[v.dp])})
+			}
+			if batch {
+				if len(v.pending) == 0 {
+					v.pendingAt = v.pc
+				}
+				v.pending = append(v.pending, memory[v.dp])
+				break
+			}
+			if err := v.cellIO.Write(v.output, memory[v.dp], v.cells); err != nil {
 				return &RuntimeError{
-					Msg: fmt.Sprintf("output error: %v", err),
+					Msg: core.Message(core.MsgOutputError, err),
 					Pos: op.Pos,
 					PC:  v.pc,
+					Err: err,
 				}
 			}
 
 		case core.OpJz:
+			if len(v.pending) > 0 {
+				if err := v.flush(ops); err != nil {
+					return err
+				}
+			}
 			if memory[v.dp] == 0 {
-				v.pc = op.Arg
+				v.pc = targets[v.pc]
 				continue
 			}
+			if record != nil {
+				if !backEdge {
+					record(trace.Event{Kind: trace.Loop, Value: op.Arg})
+				}
+				backEdge = false
+			}
 
 		case core.OpJnz:
+			if len(v.pending) > 0 {
+				if err := v.flush(ops); err != nil {
+					return err
+				}
+			}
 			if memory[v.dp] != 0 {
-				v.pc = op.Arg
+				v.pc = targets[v.pc]
+				backEdge = record != nil
+				retest = true
+				if periodic {
+					if err := v.onBackEdge(op.Pos); err != nil {
+						return err
+					}
+				}
 				continue
 			}
+			if countCmds && v.jumpBack {
+				v.commands++ // the [ test that leaves the loop
+			}
+
+		case core.OpZeroRange, core.OpCopyRange:
+			if err := v.rangeOp(op); err != nil {
+				return err
+			}
+			// The tape may have grown
+			memory = v.memory
+			memSize = len(memory)
+
+		case core.OpTrap:
+			return &RuntimeError{Msg: core.Message(core.MsgTrap), Pos: op.Pos, PC: v.pc, Err: ErrTrap}
+
+		case core.OpSection:
+			if err := v.flush(ops); err != nil {
+				return err
+			}
+			// Start the next chained program back at the first cell
+			v.dp = v.origin
+			if core.Handoff(op.Arg) == core.HandoffReset {
+				clear(memory)
+			}
 		}
 
 		v.pc++
@@ -135,3 +416,196 @@ func (v *VM) Run(ops []core.Op) error {
 
 	return nil
 }
+
+// countCommands adds the source commands op ran to the count. A JZ that its
+// JNZ jumped back to, retest, ran no [ of its own, but for
+// core.DialectJumpBack, where the ] went back to the [ test.
+func (v *VM) countCommands(op core.Op, retest bool) {
+	if retest && !v.jumpBack {
+		return
+	}
+	v.commands += uint64(op.Commands())
+}
+
+// reset gives the VM a fresh tape, with the data pointer on the start cell
+// and nothing run yet.
+func (v *VM) reset() {
+	v.memory = make([]byte, v.memSize)
+	v.dp = 0
+	v.pc = 0
+	v.steps = 0
+	v.commands = 0
+	v.origin = 0
+	if v.midTape {
+		v.dp = v.memSize / 2
+		v.origin = v.dp
+	}
+	v.maxDP = v.dp
+	copy(v.memory[v.dp:], v.tapeInit)
+}
+
+// flush writes the pending OUT bytes in one Write.
+func (v *VM) flush(ops []core.Op) error {
+	if len(v.pending) == 0 {
+		return nil
+	}
+	_, err := v.output.Write(v.pending)
+	v.pending = v.pending[:0]
+	if err != nil {
+		return &RuntimeError{
+			Msg: core.Message(core.MsgOutputError, err),
+			Pos: ops[v.pendingAt].Pos,
+			PC:  v.pendingAt,
+			Err: err,
+		}
+	}
+	return nil
+}
+
+// Steps returns the number of ops executed by the last (or current) Run.
+func (v *VM) Steps() uint64 {
+	return v.steps
+}
+
+// Commands returns the number of source commands executed by the last (or
+// current) Run or RunTokens, with WithCommandCount, and 0 without it. A
+// run resumed from a checkpoint only counts from where it resumed.
+func (v *VM) Commands() uint64 {
+	return v.commands
+}
+
+// Tape returns the tape after the last Run, from its first cell (the
+// leftmost, if it grew left) to its last non-zero one, as a native
+// executable built with linux.WithDumpTape writes it.
+func (v *VM) Tape() []byte {
+	return bytes.TrimRight(v.memory, "\x00")
+}
+
+// HighWater returns the highest cell the data pointer reached in the last
+// (or current) Run, counting from the start cell, with the cells a range
+// op touches counted as reached: the tape a native executable needs to
+// the right of its start cell, less one. A run resumed from a checkpoint
+// only counts from where it resumed.
+func (v *VM) HighWater() int {
+	return v.maxDP - v.origin
+}
+
+// addChecked applies an ADD under the saturate or trap overflow policies.
+func (v *VM) addChecked(op core.Op) error {
+	lo, hi := v.cells.Min(), v.cells.Max()
+	cell := v.cells.Value(v.memory[v.dp])
+	sum := cell + op.Arg
+	if sum >= lo && sum <= hi {
+		v.memory[v.dp] = byte(sum)
+		return nil
+	}
+
+	if v.cells.Overflow == core.OverflowTrap {
+		return &RuntimeError{
+			Msg: core.Message(core.MsgCellOverflow, cell, op.Arg, lo, hi),
+			Pos: op.Pos,
+			PC:  v.pc,
+		}
+	}
+
+	v.memory[v.dp] = byte(max(min(sum, hi), lo))
+	return nil
+}
+
+// rangeOp runs ZERO_RANGE or COPY_RANGE. Every cell it touches must be
+// reachable under the tape bound policies, as if the pointer had stepped
+// there; the whole range is then cleared or copied in one go unless it
+// wraps around the end of the tape.
+func (v *VM) rangeOp(op core.Op) error {
+	n := op.Arg
+	reach := []int{n - 1}
+	if op.Kind == core.OpCopyRange {
+		reach = append(reach, op.Off, op.Off+n-1)
+	}
+	for _, off := range reach {
+		if err := v.reach(op, off); err != nil {
+			return err
+		}
+	}
+
+	memory := v.memory
+	size := len(memory)
+	src, dst := v.dp, v.dp+op.Off
+	if src+n <= size && dst >= 0 && dst+n <= size {
+		if op.Kind == core.OpZeroRange {
+			clear(memory[src : src+n])
+			v.maxDP = max(v.maxDP, src+n-1)
+		} else {
+			copy(memory[dst:dst+n], memory[src:src+n])
+			v.maxDP = max(v.maxDP, src+n-1, dst+n-1)
+		}
+		return nil
+	}
+
+	// Only a wrapping tape gets here, and it reaches the last cell
+	v.maxDP = size - 1
+	for i := range n {
+		s := (src + i) % size
+		if op.Kind == core.OpZeroRange {
+			memory[s] = 0
+		} else {
+			memory[((dst+i)%size+size)%size] = memory[s]
+		}
+	}
+	return nil
+}
+
+// reach applies the tape bound policies to the cell off places from dp, as
+// if dp had moved there and back, growing the tape if needed.
+func (v *VM) reach(op core.Op, off int) error {
+	idx := v.dp + off
+	if idx >= 0 && idx < len(v.memory) {
+		return nil
+	}
+
+	dp, origin := v.dp, v.origin
+	v.dp = idx
+	err := v.outOfBounds(op)
+	v.dp = dp + v.origin - origin
+	return err
+}
+
+// outOfBounds applies the underflow or overflow policy after a SHIFT moved
+// dp off the tape, growing v.memory if needed. Growing leftwards prepends
+// cells and moves the origin so that cell indices stay stable.
+func (v *VM) outOfBounds(op core.Op) error {
+	size := len(v.memory)
+	bound := v.overflow
+	if v.dp < 0 {
+		bound = v.underflow
+	}
+
+	switch {
+	case bound == core.BoundWrap:
+		v.dp = ((v.dp % size) + size) % size
+		return nil
+
+	case bound == core.BoundGrow && v.dp >= size && v.dp < maxGrowSize:
+		grown := make([]byte, min(max(2*size, v.dp+1), maxGrowSize))
+		copy(grown, v.memory)
+		v.memory = grown
+		return nil
+
+	case bound == core.BoundGrow && v.dp < 0 && size-v.dp <= maxGrowSize:
+		extra := min(max(size, -v.dp), maxGrowSize-size)
+		grown := make([]byte, size+extra)
+		copy(grown[extra:], v.memory)
+		v.memory = grown
+		v.dp += extra
+		v.maxDP += extra
+		v.origin += extra
+		return nil
+	}
+
+	return &RuntimeError{
+		Msg: core.Message(core.MsgOutOfBounds,
+			v.dp-v.origin, -v.origin, size-1-v.origin),
+		Pos: op.Pos,
+		PC:  v.pc,
+	}
+}
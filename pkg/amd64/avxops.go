@@ -0,0 +1,102 @@
+package amd64
+
+// AVX2 encoders, for scan loops and range ops 32 cells at a time, and the
+// CPUID, XGETBV and BT a program needs to check at startup that it may use
+// them.
+//
+// The ymm registers share their numbers, and their low halves, with the
+// XMM ones. Only %ymm0 to %ymm7 are encoded.
+
+// vex encodes a VEX.256 instruction in the 0F map, op /r, with reg in
+// ModRM.reg, src1 in VEX.vvvv and operand the rest of the ModRM byte on:
+// C5 when x and b, the REX.X and REX.B the operand needs, are clear, else
+// C4. pp selects the implied prefix: 1 for 66, 2 for F3.
+func vex(pp byte, op byte, reg, src1 XMM, x, b bool, operand []byte) []byte {
+	vvvv := ^byte(src1) & 0x0F
+	last := vvvv<<3 | 0x04 | pp // W=0, L=1 for 256 bits
+	var buf []byte
+	if x || b {
+		rxb := byte(0xE0) // R, X and B are stored inverted
+		if x {
+			rxb &^= 0x40
+		}
+		if b {
+			rxb &^= 0x20
+		}
+		buf = []byte{0xC4, rxb | 0x01, last} // map 0F
+	} else {
+		buf = []byte{0xC5, 0x80 | last} // R inverted
+	}
+	buf = append(buf, op)
+	operand[0] |= byte(reg&7) << 3
+	return append(buf, operand...)
+}
+
+// VpxorYmm encodes: vpxor %src2, %src1, %dst (VEX.256.66.0F EF /r)
+// With the sources the same, zeroes dst.
+func VpxorYmm(dst, src1, src2 XMM) []byte {
+	return vex(1, 0xEF, dst, src1, false, false, []byte{0xC0 | byte(src2&7)})
+}
+
+// VmovdqaMemYmm encodes: vmovdqa (%base), %dst (VEX.256.66.0F 6F /r)
+// Loads 32 bytes from a 32-byte aligned address, which never crosses a
+// page boundary. base cannot be RSP, RBP, R12 or R13, which would need a
+// SIB byte or a displacement.
+func VmovdqaMemYmm(dst XMM, base Reg) []byte {
+	// ModRM: 00 (no disp) dst base
+	return vex(1, 0x6F, dst, 0, false, base >= 8, []byte{byte(base & 7)})
+}
+
+// VpcmpeqbYmm encodes: vpcmpeqb %src2, %src1, %dst (VEX.256.66.0F 74 /r)
+// Sets each byte of dst to 0xFF where the bytes of the sources are equal,
+// or 0.
+func VpcmpeqbYmm(dst, src1, src2 XMM) []byte {
+	return vex(1, 0x74, dst, src1, false, false, []byte{0xC0 | byte(src2&7)})
+}
+
+// VpmovmskbYmmReg encodes: vpmovmskb %src, %dst32 (VEX.256.66.0F D7 /r)
+// Gathers the top bit of each byte of src into dst: bit i for byte i.
+func VpmovmskbYmmReg(dst Reg, src XMM) []byte {
+	return vex(1, 0xD7, XMM(dst&7), 0, false, false, []byte{0xC0 | byte(src&7)})
+}
+
+// VmovdquMemYmm encodes: vmovdqu disp(%r13,%r12), %dst (VEX.256.F3.0F 6F /r)
+// Loads the 32 cells from disp places away, at any alignment.
+func VmovdquMemYmm(dst XMM, disp int32) []byte {
+	return vex(2, 0x6F, dst, 0, true, true, cellOperand(0, disp))
+}
+
+// VmovdquYmmMem encodes: vmovdqu %src, disp(%r13,%r12) (VEX.256.F3.0F 7F /r)
+// Stores 32 cells from disp places away, at any alignment.
+func VmovdquYmmMem(src XMM, disp int32) []byte {
+	return vex(2, 0x7F, src, 0, true, true, cellOperand(0, disp))
+}
+
+// Vzeroupper encodes: vzeroupper (VEX.128.0F 77)
+// Clears the upper halves of the ymm registers, so that the SSE code after
+// AVX code pays no penalty for them.
+func Vzeroupper() []byte {
+	return []byte{0xC5, 0xF8, 0x77}
+}
+
+// Cpuid encodes: cpuid (0F A2)
+// Loads the CPU's features for leaf EAX, subleaf ECX into EAX, EBX, ECX
+// and EDX.
+func Cpuid() []byte {
+	return []byte{0x0F, 0xA2}
+}
+
+// Xgetbv encodes: xgetbv (0F 01 D0)
+// Loads the extended control register ECX into EDX:EAX; register 0 says
+// which register state the OS saves. Only valid once CPUID reports
+// OSXSAVE.
+func Xgetbv() []byte {
+	return []byte{0x0F, 0x01, 0xD0}
+}
+
+// BtlImm8Reg encodes: btl $bit, %r32 ([REX] 0F BA /4 ib)
+// Copies the bit of r into CF.
+func BtlImm8Reg(r Reg, bit uint8) []byte {
+	// ModRM: 11 (reg) 100 (/4) r
+	return append(reg32([]byte{0x0F, 0xBA}, 4, r), bit)
+}
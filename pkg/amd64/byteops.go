@@ -0,0 +1,175 @@
+package amd64
+
+// Register-parameterised byte encoders for cell arithmetic.
+//
+// Unlike the fixed encoders in instructions.go, these take a general purpose
+// register and a cell displacement, addressing disp(%r13,%r12), the cell
+// disp places away from the data pointer. They cover caching the current
+// cell in a register and moving values between cells (multiply loops,
+// if-conversion).
+
+// Reg is a general purpose register number, as encoded in ModRM/REX.
+type Reg uint8
+
+// General purpose registers. Used as byte operands they name the low byte
+// (%al, %cl, ..., %spl, %bpl, %sil, %dil, %r8b, ..., %r15b).
+const (
+	RAX Reg = iota
+	RCX
+	RDX
+	RBX
+	RSP
+	RBP
+	RSI
+	RDI
+	R8
+	R9
+	R10
+	R11
+	R12
+	R13
+	R14
+	R15
+)
+
+// rex builds a REX prefix from the W/R/X/B bits.
+func rex(w, r, x, b bool) byte {
+	p := byte(0x40)
+	if w {
+		p |= 0x08
+	}
+	if r {
+		p |= 0x04
+	}
+	if x {
+		p |= 0x02
+	}
+	if b {
+		p |= 0x01
+	}
+	return p
+}
+
+// cellOperand encodes the ModRM, SIB and displacement for disp(%r13,%r12)
+// with reg in the ModRM.reg field. r13 as a base always needs a
+// displacement, so disp8 is used when it fits and disp32 otherwise.
+func cellOperand(reg byte, disp int32) []byte {
+	// SIB: 00 (scale=1) 100 (r12 index) 101 (r13 base) = 25
+	if disp >= -128 && disp <= 127 {
+		// ModRM: 01 (disp8) reg 100 (SIB)
+		return []byte{0x44 | (reg&7)<<3, 0x25, byte(int8(disp))}
+	}
+	// ModRM: 10 (disp32) reg 100 (SIB)
+	buf := []byte{0x84 | (reg&7)<<3, 0x25, 0, 0, 0, 0}
+	writeLE32(buf[2:], uint32(disp))
+	return buf
+}
+
+// cellOp encodes a byte instruction against disp(%r13,%r12). REX.X and
+// REX.B are always set for r12/r13, which also makes %spl..%dil reachable.
+func cellOp(w bool, opcode []byte, reg byte, disp int32) []byte {
+	buf := []byte{rex(w, reg >= 8, true, true)}
+	buf = append(buf, opcode...)
+	return append(buf, cellOperand(reg, disp)...)
+}
+
+// MovzxByteMemToReg encodes: movzbl disp(%r13,%r12), %dst32 (0F B6 /r)
+// Loads a cell zero-extended into dst (writing the 32-bit half clears the
+// upper bits too).
+func MovzxByteMemToReg(dst Reg, disp int32) []byte {
+	return cellOp(false, []byte{0x0F, 0xB6}, byte(dst), disp)
+}
+
+// MovsxByteMemToReg encodes: movsbq disp(%r13,%r12), %dst (REX.W 0F BE /r)
+// Loads a cell sign-extended into dst, for signed cells.
+func MovsxByteMemToReg(dst Reg, disp int32) []byte {
+	return cellOp(true, []byte{0x0F, 0xBE}, byte(dst), disp)
+}
+
+// MovbMemToReg encodes: movb disp(%r13,%r12), %dst8 (8A /r)
+func MovbMemToReg(dst Reg, disp int32) []byte {
+	return cellOp(false, []byte{0x8A}, byte(dst), disp)
+}
+
+// MovbRegToMem encodes: movb %src8, disp(%r13,%r12) (88 /r)
+func MovbRegToMem(src Reg, disp int32) []byte {
+	return cellOp(false, []byte{0x88}, byte(src), disp)
+}
+
+// AddRegToMem8 encodes: addb %src8, disp(%r13,%r12) (00 /r)
+func AddRegToMem8(src Reg, disp int32) []byte {
+	return cellOp(false, []byte{0x00}, byte(src), disp)
+}
+
+// SubRegFromMem8 encodes: subb %src8, disp(%r13,%r12) (28 /r)
+func SubRegFromMem8(src Reg, disp int32) []byte {
+	return cellOp(false, []byte{0x28}, byte(src), disp)
+}
+
+// CmpbImm8Mem encodes: cmpb $imm8, disp(%r13,%r12) (80 /7 ib)
+func CmpbImm8Mem(imm8 uint8, disp int32) []byte {
+	return append(cellOp(false, []byte{0x80}, 7, disp), imm8)
+}
+
+// AddbImm8MemDisp encodes: addb $imm8, disp(%r13,%r12) (80 /0 ib)
+// Adds to the cell disp places away without moving the data pointer.
+func AddbImm8MemDisp(imm8 uint8, disp int32) []byte {
+	return append(cellOp(false, []byte{0x80}, 0, disp), imm8)
+}
+
+// SubbImm8MemDisp encodes: subb $imm8, disp(%r13,%r12) (80 /5 ib)
+func SubbImm8MemDisp(imm8 uint8, disp int32) []byte {
+	return append(cellOp(false, []byte{0x80}, 5, disp), imm8)
+}
+
+// IncbMemDisp encodes: incb disp(%r13,%r12) (FE /0)
+// One byte shorter than addb $1. Sets OF but, unlike add, not CF.
+func IncbMemDisp(disp int32) []byte {
+	return cellOp(false, []byte{0xFE}, 0, disp)
+}
+
+// DecbMemDisp encodes: decb disp(%r13,%r12) (FE /1)
+// One byte shorter than subb $1. Sets OF but, unlike sub, not CF.
+func DecbMemDisp(disp int32) []byte {
+	return cellOp(false, []byte{0xFE}, 1, disp)
+}
+
+// MovbImm8MemDisp encodes: movb $imm8, disp(%r13,%r12) (C6 /0 ib)
+// Sets the cell disp places away, eg. to 0 for a clear or to a saturated
+// bound.
+func MovbImm8MemDisp(imm8 uint8, disp int32) []byte {
+	return append(cellOp(false, []byte{0xC6}, 0, disp), imm8)
+}
+
+// regReg encodes a byte register-to-register instruction with reg in
+// ModRM.reg and rm in ModRM.rm. A REX prefix is emitted when either
+// operand needs one: r8b..r15b, or %spl..%dil which would otherwise
+// decode as %ah..%bh.
+func regReg(opcode byte, reg, rm Reg) []byte {
+	modrm := 0xC0 | byte(reg&7)<<3 | byte(rm&7)
+	if reg < 4 && rm < 4 {
+		return []byte{opcode, modrm}
+	}
+	return []byte{rex(false, reg >= 8, false, rm >= 8), opcode, modrm}
+}
+
+// MovbRegToReg encodes: movb %src8, %dst8 (88 /r)
+func MovbRegToReg(dst, src Reg) []byte {
+	return regReg(0x88, src, dst)
+}
+
+// AddbRegToReg encodes: addb %src8, %dst8 (00 /r)
+func AddbRegToReg(dst, src Reg) []byte {
+	return regReg(0x00, src, dst)
+}
+
+// SubbRegFromReg encodes: subb %src8, %dst8 (28 /r)
+func SubbRegFromReg(dst, src Reg) []byte {
+	return regReg(0x28, src, dst)
+}
+
+// TestbRegReg encodes: testb %reg8, %reg8 (84 /r)
+// Sets ZF when a cached cell is zero.
+func TestbRegReg(r Reg) []byte {
+	return regReg(0x84, r, r)
+}
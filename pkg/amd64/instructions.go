@@ -30,6 +30,20 @@ func XorR12R12() []byte {
 	return []byte{0x4D, 0x31, 0xE4}
 }
 
+// MovqImm32R12 encodes: movq $imm32, %r12 (49 C7 C4 <imm32>)
+// Load 32-bit sign-extended immediate into R12.
+func MovqImm32R12(imm32 int32) []byte {
+	// REX.WB (49) = REX.W + REX.B (R12)
+	// C7 /0 id = mov r/m64, imm32
+	// ModRM: 11 (reg) 000 (/0) 100 (r12) = C4
+	buf := make([]byte, 7)
+	buf[0] = 0x49
+	buf[1] = 0xC7
+	buf[2] = 0xC4
+	writeLE32(buf[3:], uint32(imm32))
+	return buf
+}
+
 // AddqImm32R12 encodes: addq $imm32, %r12 (49 81 C4 <imm32>)
 // Adds a signed 32-bit immediate to R12.
 func AddqImm32R12(imm32 int32) []byte {
@@ -58,6 +72,18 @@ func SubqImm32R12(imm32 int32) []byte {
 	return buf
 }
 
+// AddqImm8R12 encodes: addq $imm8, %r12 (49 83 C4 <imm8>)
+// The short form of AddqImm32R12, for -128 to 127.
+func AddqImm8R12(imm8 int8) []byte {
+	return []byte{0x49, 0x83, 0xC4, byte(imm8)}
+}
+
+// SubqImm8R12 encodes: subq $imm8, %r12 (49 83 EC <imm8>)
+// The short form of SubqImm32R12, for -128 to 127.
+func SubqImm8R12(imm8 int8) []byte {
+	return []byte{0x49, 0x83, 0xEC, byte(imm8)}
+}
+
 // AddbImm8Mem encodes: addb $imm8, (%r13,%r12) (43 80 44 25 00 <imm8>)
 // Adds an unsigned 8-bit immediate to the byte at (%r13,%r12).
 func AddbImm8Mem(imm8 uint8) []byte {
@@ -91,6 +117,17 @@ func MovbZeroMem() []byte {
 	return []byte{0x43, 0xC6, 0x44, 0x25, 0x00, 0x00}
 }
 
+// MovbImm8Mem encodes: movb $imm8, (%r13,%r12) (43 C6 44 25 00 <imm8>)
+// Sets the byte at (%r13,%r12) to an 8-bit immediate.
+func MovbImm8Mem(imm8 uint8) []byte {
+	// 43 = REX.XB
+	// C6 /0 ib = mov r/m8, imm8
+	// ModRM: 01 (disp8) 000 (/0) 100 (SIB) = 44
+	// SIB: 00 (scale=1) 100 (r12 index) 101 (r13 base) = 25
+	// disp8 = 00
+	return []byte{0x43, 0xC6, 0x44, 0x25, 0x00, imm8}
+}
+
 // TestbMem encodes: testb $0xff, (%r13,%r12) (43 F6 44 25 00 FF)
 // Tests the byte at (%r13,%r12) against 0xFF, setting flags.
 func TestbMem() []byte {
@@ -122,6 +159,82 @@ func JnzRel32(rel32 int32) []byte {
 	return buf
 }
 
+// JoRel32 encodes: jo rel32 (0F 80 <rel32>)
+// Jump if overflow flag is set. rel32 is relative to end of instruction.
+func JoRel32(rel32 int32) []byte {
+	buf := make([]byte, 6)
+	buf[0] = 0x0F
+	buf[1] = 0x80
+	writeLE32(buf[2:], uint32(rel32))
+	return buf
+}
+
+// JnoRel32 encodes: jno rel32 (0F 81 <rel32>)
+// Jump if overflow flag is not set. rel32 is relative to end of instruction.
+func JnoRel32(rel32 int32) []byte {
+	buf := make([]byte, 6)
+	buf[0] = 0x0F
+	buf[1] = 0x81
+	writeLE32(buf[2:], uint32(rel32))
+	return buf
+}
+
+// JcRel32 encodes: jc rel32 (0F 82 <rel32>)
+// Jump if carry flag is set. rel32 is relative to end of instruction.
+func JcRel32(rel32 int32) []byte {
+	buf := make([]byte, 6)
+	buf[0] = 0x0F
+	buf[1] = 0x82
+	writeLE32(buf[2:], uint32(rel32))
+	return buf
+}
+
+// JncRel32 encodes: jnc rel32 (0F 83 <rel32>)
+// Jump if carry flag is not set. rel32 is relative to end of instruction.
+func JncRel32(rel32 int32) []byte {
+	buf := make([]byte, 6)
+	buf[0] = 0x0F
+	buf[1] = 0x83
+	writeLE32(buf[2:], uint32(rel32))
+	return buf
+}
+
+// JzRel8 encodes: jz rel8 (74 <rel8>)
+// The short form of JzRel32, for targets -128 to 127 bytes from the end of
+// the instruction.
+func JzRel8(rel8 int8) []byte {
+	return []byte{0x74, byte(rel8)}
+}
+
+// JnzRel8 encodes: jnz rel8 (75 <rel8>)
+func JnzRel8(rel8 int8) []byte {
+	return []byte{0x75, byte(rel8)}
+}
+
+// JnoRel8 encodes: jno rel8 (71 <rel8>)
+func JnoRel8(rel8 int8) []byte {
+	return []byte{0x71, byte(rel8)}
+}
+
+// JncRel8 encodes: jnc rel8 (73 <rel8>)
+func JncRel8(rel8 int8) []byte {
+	return []byte{0x73, byte(rel8)}
+}
+
+// JcRel8 encodes: jc rel8 (72 <rel8>)
+func JcRel8(rel8 int8) []byte {
+	return []byte{0x72, byte(rel8)}
+}
+
+// JmpRel32 encodes: jmp rel32 (E9 <rel32>)
+// Unconditional jump. rel32 is relative to end of instruction.
+func JmpRel32(rel32 int32) []byte {
+	buf := make([]byte, 5)
+	buf[0] = 0xE9
+	writeLE32(buf[1:], uint32(rel32))
+	return buf
+}
+
 // CallRel32 encodes: call rel32 (E8 <rel32>)
 // Call a function. rel32 is relative to end of instruction.
 func CallRel32(rel32 int32) []byte {
@@ -152,12 +265,32 @@ func LeaqR13R12ToRSI() []byte {
 	return []byte{0x4B, 0x8D, 0x74, 0x25, 0x00}
 }
 
+// LeaqRIPRelRSI encodes: leaq rel32(%rip), %rsi (48 8D 35 <rel32>)
+// Load the RIP-relative address into RSI. rel32 is relative to end of instruction.
+func LeaqRIPRelRSI(rel32 int32) []byte {
+	// 48 = REX.W
+	// 8D /r = lea r64, m
+	// ModRM: 00 (no disp) 110 (rsi) 101 (RIP+disp32) = 35
+	buf := make([]byte, 7)
+	buf[0] = 0x48
+	buf[1] = 0x8D
+	buf[2] = 0x35
+	writeLE32(buf[3:], uint32(rel32))
+	return buf
+}
+
 // XorRAXRAX encodes: xorq %rax, %rax (48 31 C0)
 // Zeros RAX.
 func XorRAXRAX() []byte {
 	return []byte{0x48, 0x31, 0xC0}
 }
 
+// TestqRAXRAX encodes: testq %rax, %rax (48 85 C0)
+// Sets flags from RAX, eg. to check a syscall return value.
+func TestqRAXRAX() []byte {
+	return []byte{0x48, 0x85, 0xC0}
+}
+
 // XorRDIRDI encodes: xorq %rdi, %rdi (48 31 FF)
 // Zeros RDI.
 func XorRDIRDI() []byte {
@@ -196,3 +329,361 @@ func MovqImm32RDX(imm32 int32) []byte {
 	writeLE32(buf[3:], uint32(imm32))
 	return buf
 }
+
+// MovqImm32RCX encodes: movq $imm32, %rcx (48 C7 C1 <imm32>)
+// Load 32-bit sign-extended immediate into RCX.
+func MovqImm32RCX(imm32 int32) []byte {
+	buf := make([]byte, 7)
+	buf[0] = 0x48 // REX.W
+	buf[1] = 0xC7 // mov r/m64, imm32
+	buf[2] = 0xC1 // ModRM: 11 000 001 (rcx)
+	writeLE32(buf[3:], uint32(imm32))
+	return buf
+}
+
+// MovqR13RDI encodes: movq %r13, %rdi (4C 89 EF)
+// Copy the tape base into RDI.
+func MovqR13RDI() []byte {
+	return []byte{0x4C, 0x89, 0xEF}
+}
+
+// XorR14R14 encodes: xorq %r14, %r14 (4D 31 F6)
+// Zeros R14.
+func XorR14R14() []byte {
+	return []byte{0x4D, 0x31, 0xF6}
+}
+
+// TestqR14R14 encodes: testq %r14, %r14 (4D 85 F6)
+// Sets flags from R14.
+func TestqR14R14() []byte {
+	return []byte{0x4D, 0x85, 0xF6}
+}
+
+// IncqR14 encodes: incq %r14 (49 FF C6)
+func IncqR14() []byte {
+	return []byte{0x49, 0xFF, 0xC6}
+}
+
+// CmpqImm8RSPMem encodes: cmpq $imm8, (%rsp) (48 83 3C 24 <imm8>)
+// Compares the quadword at the top of the stack, eg. argc in _start.
+func CmpqImm8RSPMem(imm8 int8) []byte {
+	// 48 = REX.W
+	// 83 /7 ib = cmp r/m64, imm8
+	// ModRM: 00 (no disp) 111 (/7) 100 (SIB) = 3C
+	// SIB: 00 (scale=1) 100 (no index) 100 (rsp base) = 24
+	return []byte{0x48, 0x83, 0x3C, 0x24, byte(imm8)}
+}
+
+// MovqRSPDisp8R14 encodes: movq disp8(%rsp), %r14 (4C 8B 74 24 <disp8>)
+// Loads a stack slot into R14, eg. argv[1] in _start.
+func MovqRSPDisp8R14(disp8 int8) []byte {
+	// 4C = REX.WR (R for r14 in ModRM.reg)
+	// 8B /r = mov r64, r/m64
+	// ModRM: 01 (disp8) 110 (r14) 100 (SIB) = 74
+	// SIB: 00 (scale=1) 100 (no index) 100 (rsp base) = 24
+	return []byte{0x4C, 0x8B, 0x74, 0x24, byte(disp8)}
+}
+
+// MovbR14MemAL encodes: movb (%r14), %al (41 8A 06)
+// Loads the byte at (%r14) into AL.
+func MovbR14MemAL() []byte {
+	// 41 = REX.B (B for r14 in ModRM.rm)
+	// 8A /r = mov r8, r/m8
+	// ModRM: 00 (no disp) 000 (al) 110 (r14) = 06
+	return []byte{0x41, 0x8A, 0x06}
+}
+
+// MovbALMem encodes: movb %al, (%r13,%r12) (43 88 44 25 00)
+// Stores AL into the byte at (%r13,%r12).
+func MovbALMem() []byte {
+	// 43 = REX.XB
+	// 88 /r = mov r/m8, r8
+	// ModRM: 01 (disp8) 000 (al) 100 (SIB) = 44
+	// SIB: 00 (scale=1) 100 (r12 index) 101 (r13 base) = 25
+	// disp8 = 00
+	return []byte{0x43, 0x88, 0x44, 0x25, 0x00}
+}
+
+// TestbALAL encodes: testb %al, %al (84 C0)
+func TestbALAL() []byte {
+	return []byte{0x84, 0xC0}
+}
+
+// The encoders below are used by the BF_TAPE prologue, which walks envp and
+// parses a decimal tape size before mapping the tape.
+
+// MovqImm32R15 encodes: movq $imm32, %r15 (49 C7 C7 <imm32>)
+// Load 32-bit sign-extended immediate into R15.
+func MovqImm32R15(imm32 int32) []byte {
+	buf := make([]byte, 7)
+	buf[0] = 0x49 // REX.WB
+	buf[1] = 0xC7 // mov r/m64, imm32
+	buf[2] = 0xC7 // ModRM: 11 000 111 (r15)
+	writeLE32(buf[3:], uint32(imm32))
+	return buf
+}
+
+// MovqImm32R10 encodes: movq $imm32, %r10 (49 C7 C2 <imm32>)
+// Load 32-bit sign-extended immediate into R10 (the 4th syscall argument).
+func MovqImm32R10(imm32 int32) []byte {
+	buf := make([]byte, 7)
+	buf[0] = 0x49 // REX.WB
+	buf[1] = 0xC7 // mov r/m64, imm32
+	buf[2] = 0xC2 // ModRM: 11 000 010 (r10)
+	writeLE32(buf[3:], uint32(imm32))
+	return buf
+}
+
+// MovqImm32R8 encodes: movq $imm32, %r8 (49 C7 C0 <imm32>)
+// Load 32-bit sign-extended immediate into R8 (the 5th syscall argument).
+func MovqImm32R8(imm32 int32) []byte {
+	buf := make([]byte, 7)
+	buf[0] = 0x49 // REX.WB
+	buf[1] = 0xC7 // mov r/m64, imm32
+	buf[2] = 0xC0 // ModRM: 11 000 000 (r8)
+	writeLE32(buf[3:], uint32(imm32))
+	return buf
+}
+
+// XorR9R9 encodes: xorq %r9, %r9 (4D 31 C9)
+// Zeros R9 (the 6th syscall argument).
+func XorR9R9() []byte {
+	return []byte{0x4D, 0x31, 0xC9}
+}
+
+// MovabsRAX encodes: movabs $imm64, %rax (48 B8 <imm64>)
+func MovabsRAX(imm64 uint64) []byte {
+	buf := make([]byte, 10)
+	buf[0] = 0x48 // REX.W
+	buf[1] = 0xB8 // mov r64, imm64 (rax)
+	writeLE64(buf[2:], imm64)
+	return buf
+}
+
+// MovqRSPMemRAX encodes: movq (%rsp), %rax (48 8B 04 24)
+// Loads argc in _start.
+func MovqRSPMemRAX() []byte {
+	return []byte{0x48, 0x8B, 0x04, 0x24}
+}
+
+// LeaqEnvpRBX encodes: leaq 16(%rsp,%rax,8), %rbx (48 8D 5C C4 10)
+// Points RBX at envp in _start, given argc in RAX.
+func LeaqEnvpRBX() []byte {
+	// ModRM: 01 (disp8) 011 (rbx) 100 (SIB) = 5C
+	// SIB: 11 (scale=8) 000 (rax index) 100 (rsp base) = C4
+	return []byte{0x48, 0x8D, 0x5C, 0xC4, 0x10}
+}
+
+// MovqRBXMemRSI encodes: movq (%rbx), %rsi (48 8B 33)
+func MovqRBXMemRSI() []byte {
+	return []byte{0x48, 0x8B, 0x33}
+}
+
+// AddqImm8RBX encodes: addq $imm8, %rbx (48 83 C3 <imm8>)
+func AddqImm8RBX(imm8 int8) []byte {
+	return []byte{0x48, 0x83, 0xC3, byte(imm8)}
+}
+
+// AddqImm8RSI encodes: addq $imm8, %rsi (48 83 C6 <imm8>)
+func AddqImm8RSI(imm8 int8) []byte {
+	return []byte{0x48, 0x83, 0xC6, byte(imm8)}
+}
+
+// CmpqRAXRSIMem encodes: cmpq %rax, (%rsi) (48 39 06)
+func CmpqRAXRSIMem() []byte {
+	return []byte{0x48, 0x39, 0x06}
+}
+
+// CmpqImm8RAX encodes: cmpq $imm8, %rax (48 83 F8 <imm8>)
+func CmpqImm8RAX(imm8 int8) []byte {
+	return []byte{0x48, 0x83, 0xF8, byte(imm8)}
+}
+
+// CmpqImm32RAX encodes: cmpq $imm32, %rax (48 3D <imm32>)
+// Used to check syscall results against -4095 to -1 (errno).
+func CmpqImm32RAX(imm32 int32) []byte {
+	buf := make([]byte, 6)
+	buf[0] = 0x48 // REX.W
+	buf[1] = 0x3D // cmp rax, imm32
+	writeLE32(buf[2:], uint32(imm32))
+	return buf
+}
+
+// OrqImm32RAX encodes: orq $imm32, %rax (48 0D <imm32>)
+// Sets the tag byte of a trace record.
+func OrqImm32RAX(imm32 int32) []byte {
+	buf := make([]byte, 6)
+	buf[0] = 0x48 // REX.W
+	buf[1] = 0x0D // or rax, imm32
+	writeLE32(buf[2:], uint32(imm32))
+	return buf
+}
+
+// PushRAX encodes: pushq %rax (50)
+func PushRAX() []byte {
+	return []byte{0x50}
+}
+
+// PopRAX encodes: popq %rax (58)
+func PopRAX() []byte {
+	return []byte{0x58}
+}
+
+// MovqRSPRSI encodes: movq %rsp, %rsi (48 89 E6)
+// Points a write syscall at data pushed on the stack.
+func MovqRSPRSI() []byte {
+	return []byte{0x48, 0x89, 0xE6}
+}
+
+// MovqRDIRSP encodes: movq %rdi, %rsp (48 89 FC)
+// Points the stack at the argument block a FreeBSD kernel passes in %rdi.
+func MovqRDIRSP() []byte {
+	return []byte{0x48, 0x89, 0xFC}
+}
+
+// SubqImm8RAX encodes: subq $imm8, %rax (48 83 E8 <imm8>)
+func SubqImm8RAX(imm8 int8) []byte {
+	return []byte{0x48, 0x83, 0xE8, byte(imm8)}
+}
+
+// MovzbqRSIMemRAX encodes: movzbq (%rsi), %rax (48 0F B6 06)
+// Loads the byte at (%rsi) zero-extended into RAX.
+func MovzbqRSIMemRAX() []byte {
+	return []byte{0x48, 0x0F, 0xB6, 0x06}
+}
+
+// ImulqImm8RCX encodes: imulq $imm8, %rcx, %rcx (48 6B C9 <imm8>)
+func ImulqImm8RCX(imm8 int8) []byte {
+	return []byte{0x48, 0x6B, 0xC9, byte(imm8)}
+}
+
+// AddqRAXRCX encodes: addq %rax, %rcx (48 01 C1)
+func AddqRAXRCX() []byte {
+	return []byte{0x48, 0x01, 0xC1}
+}
+
+// IncqRSI encodes: incq %rsi (48 FF C6)
+func IncqRSI() []byte {
+	return []byte{0x48, 0xFF, 0xC6}
+}
+
+// XorRCXRCX encodes: xorq %rcx, %rcx (48 31 C9)
+func XorRCXRCX() []byte {
+	return []byte{0x48, 0x31, 0xC9}
+}
+
+// TestqRSIRSI encodes: testq %rsi, %rsi (48 85 F6)
+func TestqRSIRSI() []byte {
+	return []byte{0x48, 0x85, 0xF6}
+}
+
+// TestqRCXRCX encodes: testq %rcx, %rcx (48 85 C9)
+func TestqRCXRCX() []byte {
+	return []byte{0x48, 0x85, 0xC9}
+}
+
+// MovqRCXRSI encodes: movq %rcx, %rsi (48 89 CE)
+func MovqRCXRSI() []byte {
+	return []byte{0x48, 0x89, 0xCE}
+}
+
+// MovqRAXR13 encodes: movq %rax, %r13 (49 89 C5)
+// Sets the tape base, eg. to the result of mmap.
+func MovqRAXR13() []byte {
+	return []byte{0x49, 0x89, 0xC5}
+}
+
+// MovqRSIR15 encodes: movq %rsi, %r15 (49 89 F7)
+func MovqRSIR15() []byte {
+	return []byte{0x49, 0x89, 0xF7}
+}
+
+// MovqR15R12 encodes: movq %r15, %r12 (4D 89 FC)
+func MovqR15R12() []byte {
+	return []byte{0x4D, 0x89, 0xFC}
+}
+
+// MovqR15RCX encodes: movq %r15, %rcx (4C 89 F9)
+func MovqR15RCX() []byte {
+	return []byte{0x4C, 0x89, 0xF9}
+}
+
+// ShrqR12 encodes: shrq $1, %r12 (49 D1 EC)
+func ShrqR12() []byte {
+	return []byte{0x49, 0xD1, 0xEC}
+}
+
+// JsRel32 encodes: js rel32 (0F 88 <rel32>)
+// Jump if sign (SF=1). rel32 is relative to end of instruction.
+func JsRel32(rel32 int32) []byte {
+	buf := make([]byte, 6)
+	buf[0] = 0x0F
+	buf[1] = 0x88
+	writeLE32(buf[2:], uint32(rel32))
+	return buf
+}
+
+// JaRel32 encodes: ja rel32 (0F 87 <rel32>)
+// Jump if above (unsigned, CF=0 and ZF=0). rel32 is relative to end of instruction.
+func JaRel32(rel32 int32) []byte {
+	buf := make([]byte, 6)
+	buf[0] = 0x0F
+	buf[1] = 0x87
+	writeLE32(buf[2:], uint32(rel32))
+	return buf
+}
+
+// MovqRSPDisp8RSI encodes: movq disp8(%rsp), %rsi (48 8B 74 24 <disp8>)
+// Loads a stack slot into RSI, eg. argv[1] in _start.
+func MovqRSPDisp8RSI(disp8 int8) []byte {
+	// ModRM: 01 (disp8) 110 (rsi) 100 (SIB) = 74
+	// SIB: 00 (scale=1) 100 (no index) 100 (rsp base) = 24
+	return []byte{0x48, 0x8B, 0x74, 0x24, byte(disp8)}
+}
+
+// CmplImm32RSIDisp8 encodes: cmpl $imm32, disp8(%rsi) (81 7E <disp8> <imm32>)
+func CmplImm32RSIDisp8(disp8 int8, imm32 uint32) []byte {
+	buf := make([]byte, 7)
+	buf[0] = 0x81 // cmp r/m32, imm32 (/7)
+	buf[1] = 0x7E // ModRM: 01 (disp8) 111 (/7) 110 (rsi)
+	buf[2] = byte(disp8)
+	writeLE32(buf[3:], imm32)
+	return buf
+}
+
+// SubqImm32RSP encodes: subq $imm32, %rsp (48 81 EC <imm32>)
+// Reserves stack space below the argument block.
+func SubqImm32RSP(imm32 int32) []byte {
+	// 48 = REX.W
+	// 81 /5 id = sub r/m64, imm32
+	// ModRM: 11 (reg) 101 (/5) 100 (rsp) = EC
+	buf := make([]byte, 7)
+	buf[0] = 0x48
+	buf[1] = 0x81
+	buf[2] = 0xEC
+	writeLE32(buf[3:], uint32(imm32))
+	return buf
+}
+
+// AddqImm32RSP encodes: addq $imm32, %rsp (48 81 C4 <imm32>)
+// Releases stack space SubqImm32RSP reserved.
+func AddqImm32RSP(imm32 int32) []byte {
+	// 48 = REX.W
+	// 81 /0 id = add r/m64, imm32
+	// ModRM: 11 (reg) 000 (/0) 100 (rsp) = C4
+	buf := make([]byte, 7)
+	buf[0] = 0x48
+	buf[1] = 0x81
+	buf[2] = 0xC4
+	writeLE32(buf[3:], uint32(imm32))
+	return buf
+}
+
+// MovbALRSPDisp8 encodes: movb %al, disp8(%rsp) (88 44 24 <disp8>)
+// Stores AL into a byte of the stack.
+func MovbALRSPDisp8(disp8 int8) []byte {
+	// 88 /r = mov r/m8, r8
+	// ModRM: 01 (disp8) 000 (al) 100 (SIB) = 44
+	// SIB: 00 (scale=1) 100 (no index) 100 (rsp base) = 24
+	return []byte{0x88, 0x44, 0x24, byte(disp8)}
+}
@@ -0,0 +1,62 @@
+package amd64
+
+import "bytes"
+
+// Trap and padding encoders.
+
+// Int3 encodes: int3 (CC)
+// Breakpoint trap, raises SIGTRAP.
+func Int3() []byte {
+	return []byte{0xCC}
+}
+
+// Ud2 encodes: ud2 (0F 0B)
+// Guaranteed invalid opcode, raises SIGILL.
+func Ud2() []byte {
+	return []byte{0x0F, 0x0B}
+}
+
+// MaxNop is the longest single NOP instruction returned by Nop.
+const MaxNop = 9
+
+// nops holds the recommended multi-byte NOP forms from the Intel optimisation
+// manual, indexed by length.
+var nops = [MaxNop + 1][]byte{
+	1: {0x90},                                                 // nop
+	2: {0x66, 0x90},                                           // xchg %ax, %ax
+	3: {0x0F, 0x1F, 0x00},                                     // nopl (%rax)
+	4: {0x0F, 0x1F, 0x40, 0x00},                               // nopl 0(%rax)
+	5: {0x0F, 0x1F, 0x44, 0x00, 0x00},                         // nopl 0(%rax,%rax,1)
+	6: {0x66, 0x0F, 0x1F, 0x44, 0x00, 0x00},                   // nopw 0(%rax,%rax,1)
+	7: {0x0F, 0x1F, 0x80, 0x00, 0x00, 0x00, 0x00},             // nopl 0L(%rax)
+	8: {0x0F, 0x1F, 0x84, 0x00, 0x00, 0x00, 0x00, 0x00},       // nopl 0L(%rax,%rax,1)
+	9: {0x66, 0x0F, 0x1F, 0x84, 0x00, 0x00, 0x00, 0x00, 0x00}, // nopw 0L(%rax,%rax,1)
+}
+
+// Nop encodes a single NOP instruction n bytes long, 1 <= n <= MaxNop.
+func Nop(n int) []byte {
+	return append([]byte(nil), nops[n]...)
+}
+
+// NopPadding returns n bytes of NOPs using as few instructions as possible,
+// so padding that is executed costs the fewest decode slots.
+func NopPadding(n int) []byte {
+	buf := make([]byte, 0, n)
+	for n > 0 {
+		k := min(n, MaxNop)
+		buf = append(buf, nops[k]...)
+		n -= k
+	}
+	return buf
+}
+
+// TrapPadding returns n bytes of int3, for padding that should never run.
+func TrapPadding(n int) []byte {
+	return bytes.Repeat(Int3(), n)
+}
+
+// PaddingFor returns how many bytes are needed to bring offset up to a
+// multiple of align (a power of two).
+func PaddingFor(offset, align int) int {
+	return (align - offset%align) % align
+}
@@ -0,0 +1,188 @@
+package amd64
+
+// Register-parameterised quadword encoders, for setting up system call
+// arguments in any of the six argument registers.
+
+// MovqImm32Reg encodes: movq $imm32, %dst (REX.W C7 /0 <imm32>)
+// Loads a sign-extended 32-bit immediate into dst.
+func MovqImm32Reg(dst Reg, imm32 int32) []byte {
+	// ModRM: 11 (reg) 000 (/0) dst
+	buf := []byte{rex(true, false, false, dst >= 8), 0xC7, 0xC0 | byte(dst&7), 0, 0, 0, 0}
+	writeLE32(buf[3:], uint32(imm32))
+	return buf
+}
+
+// MovqRegReg encodes: movq %src, %dst (REX.W 89 /r)
+func MovqRegReg(dst, src Reg) []byte {
+	// ModRM: 11 (reg) src dst
+	return []byte{rex(true, src >= 8, false, dst >= 8), 0x89, 0xC0 | byte(src&7)<<3 | byte(dst&7)}
+}
+
+// XorqRegReg encodes: xorq %r, %r (REX.W 31 /r)
+// Zeroes r, in fewer bytes than a movq $0.
+func XorqRegReg(r Reg) []byte {
+	// ModRM: 11 (reg) r r
+	return []byte{rex(true, r >= 8, false, r >= 8), 0x31, 0xC0 | byte(r&7)<<3 | byte(r&7)}
+}
+
+// SubqRegReg encodes: subq %src, %dst (REX.W 29 /r)
+func SubqRegReg(dst, src Reg) []byte {
+	// ModRM: 11 (reg) src dst
+	return []byte{rex(true, src >= 8, false, dst >= 8), 0x29, 0xC0 | byte(src&7)<<3 | byte(dst&7)}
+}
+
+// CmpqRegReg encodes: cmpq %src, %dst (REX.W 39 /r)
+// Sets the flags for dst - src.
+func CmpqRegReg(dst, src Reg) []byte {
+	// ModRM: 11 (reg) src dst
+	return []byte{rex(true, src >= 8, false, dst >= 8), 0x39, 0xC0 | byte(src&7)<<3 | byte(dst&7)}
+}
+
+// CmovaqRegReg encodes: cmovaq %src, %dst (REX.W 0F 47 /r)
+// Moves src into dst when the last compare was unsigned above.
+func CmovaqRegReg(dst, src Reg) []byte {
+	// ModRM: 11 (reg) dst src
+	return []byte{rex(true, dst >= 8, false, src >= 8), 0x0F, 0x47, 0xC0 | byte(dst&7)<<3 | byte(src&7)}
+}
+
+// AddqRegReg encodes: addq %src, %dst (REX.W 01 /r)
+func AddqRegReg(dst, src Reg) []byte {
+	// ModRM: 11 (reg) src dst
+	return []byte{rex(true, src >= 8, false, dst >= 8), 0x01, 0xC0 | byte(src&7)<<3 | byte(dst&7)}
+}
+
+// TestqRegReg encodes: testq %r, %r (REX.W 85 /r)
+// Sets ZF if r is zero.
+func TestqRegReg(r Reg) []byte {
+	// ModRM: 11 (reg) r r
+	return []byte{rex(true, r >= 8, false, r >= 8), 0x85, 0xC0 | byte(r&7)<<3 | byte(r&7)}
+}
+
+// IncqReg encodes: incq %r (REX.W FF /0)
+func IncqReg(r Reg) []byte {
+	// ModRM: 11 (reg) 000 (/0) r
+	return []byte{rex(true, false, false, r >= 8), 0xFF, 0xC0 | byte(r&7)}
+}
+
+// DecqReg encodes: decq %r (REX.W FF /1)
+func DecqReg(r Reg) []byte {
+	// ModRM: 11 (reg) 001 (/1) r
+	return []byte{rex(true, false, false, r >= 8), 0xFF, 0xC8 | byte(r&7)}
+}
+
+// TestlRegReg encodes: testl %r32, %r32 (85 /r)
+// Sets ZF and SF from the low 32 bits of r, eg. an int returned in %eax.
+func TestlRegReg(r Reg) []byte {
+	// ModRM: 11 (reg) r r
+	op := []byte{0x85, 0xC0 | byte(r&7)<<3 | byte(r&7)}
+	if r >= 8 {
+		return append([]byte{rex(false, true, false, true)}, op...)
+	}
+	return op
+}
+
+// ImullImm8RegReg encodes: imull $imm8, %src32, %dst32 ([REX] 6B /r ib)
+// Multiplies src by a sign-extended 8-bit immediate into dst. The low byte
+// of the product is the same for either reading of a byte factor.
+func ImullImm8RegReg(dst, src Reg, imm8 int8) []byte {
+	// ModRM: 11 (reg) dst src
+	op := []byte{0x6B, 0xC0 | byte(dst&7)<<3 | byte(src&7), byte(imm8)}
+	if dst >= 8 || src >= 8 {
+		return append([]byte{rex(false, dst >= 8, false, src >= 8)}, op...)
+	}
+	return op
+}
+
+// AddqImm8Reg encodes: addq $imm8, %r (REX.W 83 /0 <imm8>)
+func AddqImm8Reg(r Reg, imm8 int8) []byte {
+	// ModRM: 11 (reg) 000 (/0) r
+	return []byte{rex(true, false, false, r >= 8), 0x83, 0xC0 | byte(r&7), byte(imm8)}
+}
+
+// AddqImm32Reg encodes: addq $imm32, %r (REX.W 81 /0 <imm32>)
+func AddqImm32Reg(r Reg, imm32 int32) []byte {
+	// ModRM: 11 (reg) 000 (/0) r
+	buf := []byte{rex(true, false, false, r >= 8), 0x81, 0xC0 | byte(r&7), 0, 0, 0, 0}
+	writeLE32(buf[3:], uint32(imm32))
+	return buf
+}
+
+// ShrqImm8Reg encodes: shrq $imm8, %r (REX.W C1 /5 <imm8>)
+// Sets ZF if the result is zero.
+func ShrqImm8Reg(r Reg, imm8 uint8) []byte {
+	// ModRM: 11 (reg) 101 (/5) r
+	return []byte{rex(true, false, false, r >= 8), 0xC1, 0xE8 | byte(r&7), imm8}
+}
+
+// SubqImm8Reg encodes: subq $imm8, %r (REX.W 83 /5 <imm8>)
+func SubqImm8Reg(r Reg, imm8 int8) []byte {
+	// ModRM: 11 (reg) 101 (/5) r
+	return []byte{rex(true, false, false, r >= 8), 0x83, 0xE8 | byte(r&7), byte(imm8)}
+}
+
+// PushReg encodes: pushq %r ([41] 50+r)
+func PushReg(r Reg) []byte {
+	if r >= 8 {
+		return []byte{rex(false, false, false, true), 0x50 | byte(r&7)}
+	}
+	return []byte{0x50 | byte(r)}
+}
+
+// PopReg encodes: popq %r ([41] 58+r)
+func PopReg(r Reg) []byte {
+	if r >= 8 {
+		return []byte{rex(false, false, false, true), 0x58 | byte(r&7)}
+	}
+	return []byte{0x58 | byte(r)}
+}
+
+// MovqRegDisp8Reg encodes: movq disp8(%base), %dst (REX.W 8B /r <disp8>)
+// base cannot be RSP or R12, which would need a SIB byte.
+func MovqRegDisp8Reg(dst, base Reg, disp8 int8) []byte {
+	// ModRM: 01 (disp8) dst base
+	return []byte{rex(true, dst >= 8, false, base >= 8), 0x8B, 0x40 | byte(dst&7)<<3 | byte(base&7), byte(disp8)}
+}
+
+// MovqRegDisp32Reg encodes: movq disp32(%base), %dst (REX.W 8B /r <disp32>)
+// Like MovqRegDisp8Reg, for a field further into a structure.
+func MovqRegDisp32Reg(dst, base Reg, disp32 int32) []byte {
+	// ModRM: 10 (disp32) dst base
+	buf := []byte{rex(true, dst >= 8, false, base >= 8), 0x8B, 0x80 | byte(dst&7)<<3 | byte(base&7), 0, 0, 0, 0}
+	writeLE32(buf[3:], uint32(disp32))
+	return buf
+}
+
+// MovbRegRegMem encodes: movb %src8, (%base) ([REX] 88 /r)
+// Stores the low byte of src. src from RSP up takes a REX prefix, for
+// %spl to %r15b rather than %ah to %bh; base cannot be RSP, RBP, R12 or
+// R13, which would need a SIB byte or a displacement.
+func MovbRegRegMem(base, src Reg) []byte {
+	// ModRM: 00 (no disp) src base
+	op := []byte{0x88, byte(src&7)<<3 | byte(base&7)}
+	if src >= 4 || base >= 8 {
+		return append([]byte{rex(false, src >= 8, false, base >= 8)}, op...)
+	}
+	return op
+}
+
+// MovbImm8RegMem encodes: movb $imm8, (%base) ([41] C6 /0 <imm8>)
+// base cannot be RSP, RBP, R12 or R13.
+func MovbImm8RegMem(base Reg, imm8 uint8) []byte {
+	// ModRM: 00 (no disp) 000 (/0) base
+	op := []byte{0xC6, byte(base & 7), imm8}
+	if base >= 8 {
+		return append([]byte{rex(false, false, false, true)}, op...)
+	}
+	return op
+}
+
+// CallRegDisp8 encodes: callq *disp8(%base) ([41] FF /2 <disp8>)
+// Calls through a function pointer in memory. base cannot be RSP or R12.
+func CallRegDisp8(base Reg, disp8 int8) []byte {
+	// ModRM: 01 (disp8) 010 (/2) base
+	op := []byte{0xFF, 0x50 | byte(base&7), byte(disp8)}
+	if base >= 8 {
+		return append([]byte{rex(false, false, false, true)}, op...)
+	}
+	return op
+}
@@ -0,0 +1,183 @@
+package amd64
+
+// SSE2 and bit scan encoders, for scan loops: comparing 16 cells with zero
+// at a time and finding the first (or last) that matched; for range ops,
+// clearing or copying 16 cells at a time; and for runs of adds, adding a
+// vector of 16 bytes, built from two quadwords, to 16 cells at a time.
+//
+// The 32-bit register operations among them write the low half of the
+// register and zero the upper half, as any 32-bit operation does.
+
+// XMM is an SSE register number. Only %xmm0 to %xmm7 are encoded, which
+// need no REX prefix.
+type XMM uint8
+
+// SSE registers.
+const (
+	X0 XMM = iota
+	X1
+	X2
+	X3
+	X4
+	X5
+	X6
+	X7
+)
+
+// sse encodes a 66-prefixed SSE2 instruction, 66 [REX] 0F op /r, with reg
+// in ModRM.reg and rm in ModRM.rm, both registers.
+func sse(op byte, reg, rm byte) []byte {
+	modrm := 0xC0 | (reg&7)<<3 | rm&7
+	if reg >= 8 || rm >= 8 {
+		return []byte{0x66, rex(false, reg >= 8, false, rm >= 8), 0x0F, op, modrm}
+	}
+	return []byte{0x66, 0x0F, op, modrm}
+}
+
+// reg32 encodes a 32-bit register-to-register instruction, [REX] op /r,
+// with reg in ModRM.reg and rm in ModRM.rm.
+func reg32(op []byte, reg, rm Reg) []byte {
+	modrm := 0xC0 | byte(reg&7)<<3 | byte(rm&7)
+	b := append(append([]byte{}, op...), modrm)
+	if reg >= 8 || rm >= 8 {
+		return append([]byte{rex(false, reg >= 8, false, rm >= 8)}, b...)
+	}
+	return b
+}
+
+// PxorXmm encodes: pxor %src, %dst (66 0F EF /r)
+// With src and dst the same, zeroes the register.
+func PxorXmm(dst, src XMM) []byte {
+	return sse(0xEF, byte(dst), byte(src))
+}
+
+// MovdqaMemXmm encodes: movdqa (%base), %dst (66 [REX] 0F 6F /r)
+// Loads 16 bytes from a 16-byte aligned address, which never crosses a
+// page boundary, so reads nothing past a page the first byte is in. base
+// cannot be RSP, RBP, R12 or R13, which would need a SIB byte or a
+// displacement.
+func MovdqaMemXmm(dst XMM, base Reg) []byte {
+	// ModRM: 00 (no disp) dst base
+	modrm := byte(dst&7)<<3 | byte(base&7)
+	if base >= 8 {
+		return []byte{0x66, rex(false, false, false, true), 0x0F, 0x6F, modrm}
+	}
+	return []byte{0x66, 0x0F, 0x6F, modrm}
+}
+
+// MovdquMemXmm encodes: movdqu disp(%r13,%r12), %dst (F3 REX 0F 6F /r)
+// Loads the 16 cells from disp places away, at any alignment.
+func MovdquMemXmm(dst XMM, disp int32) []byte {
+	return append([]byte{0xF3}, cellOp(false, []byte{0x0F, 0x6F}, byte(dst), disp)...)
+}
+
+// MovdquXmmMem encodes: movdqu %src, disp(%r13,%r12) (F3 REX 0F 7F /r)
+// Stores 16 cells from disp places away, at any alignment.
+func MovdquXmmMem(src XMM, disp int32) []byte {
+	return append([]byte{0xF3}, cellOp(false, []byte{0x0F, 0x7F}, byte(src), disp)...)
+}
+
+// MovqRegXmm encodes: movq %src, %dst (66 REX.W 0F 6E /r)
+// Loads src into the low 8 bytes of dst and clears the others.
+func MovqRegXmm(dst XMM, src Reg) []byte {
+	modrm := 0xC0 | byte(dst&7)<<3 | byte(src&7)
+	return []byte{0x66, rex(true, false, false, src >= 8), 0x0F, 0x6E, modrm}
+}
+
+// PunpcklqdqXmm encodes: punpcklqdq %src, %dst (66 0F 6C /r)
+// Moves the low 8 bytes of src into the high 8 bytes of dst, joining two
+// movq loads into one vector.
+func PunpcklqdqXmm(dst, src XMM) []byte {
+	return sse(0x6C, byte(dst), byte(src))
+}
+
+// PaddbXmm encodes: paddb %src, %dst (66 0F FC /r)
+// Adds each byte of src to the byte of dst, wrapping.
+func PaddbXmm(dst, src XMM) []byte {
+	return sse(0xFC, byte(dst), byte(src))
+}
+
+// PcmpeqbXmm encodes: pcmpeqb %src, %dst (66 0F 74 /r)
+// Sets each byte of dst to 0xFF where it equals the byte of src, or 0.
+func PcmpeqbXmm(dst, src XMM) []byte {
+	return sse(0x74, byte(dst), byte(src))
+}
+
+// PmovmskbXmmReg encodes: pmovmskb %src, %dst32 (66 [REX] 0F D7 /r)
+// Gathers the top bit of each byte of src into the low 16 bits of dst: bit
+// i for byte i.
+func PmovmskbXmmReg(dst Reg, src XMM) []byte {
+	return sse(0xD7, byte(dst), byte(src))
+}
+
+// BsflRegReg encodes: bsfl %src32, %dst32 ([REX] 0F BC /r)
+// Loads the index of the lowest set bit of src. src must not be zero.
+func BsflRegReg(dst, src Reg) []byte {
+	return reg32([]byte{0x0F, 0xBC}, dst, src)
+}
+
+// BsrlRegReg encodes: bsrl %src32, %dst32 ([REX] 0F BD /r)
+// Loads the index of the highest set bit of src. src must not be zero.
+func BsrlRegReg(dst, src Reg) []byte {
+	return reg32([]byte{0x0F, 0xBD}, dst, src)
+}
+
+// MovlRegReg encodes: movl %src32, %dst32 ([REX] 89 /r)
+func MovlRegReg(dst, src Reg) []byte {
+	return reg32([]byte{0x89}, src, dst)
+}
+
+// AndlRegReg encodes: andl %src32, %dst32 ([REX] 21 /r)
+// Sets ZF if the result is zero.
+func AndlRegReg(dst, src Reg) []byte {
+	return reg32([]byte{0x21}, src, dst)
+}
+
+// ShllCLReg encodes: shll %cl, %r32 ([REX] D3 /4)
+func ShllCLReg(r Reg) []byte {
+	// ModRM: 11 (reg) 100 (/4) r
+	return reg32([]byte{0xD3}, 4, r)
+}
+
+// DeclReg encodes: decl %r32 ([REX] FF /1)
+func DeclReg(r Reg) []byte {
+	// ModRM: 11 (reg) 001 (/1) r
+	return reg32([]byte{0xFF}, 1, r)
+}
+
+// AndlImm8Reg encodes: andl $imm8, %r32 ([REX] 83 /4 <imm8>)
+// The immediate is sign-extended.
+func AndlImm8Reg(r Reg, imm8 int8) []byte {
+	// ModRM: 11 (reg) 100 (/4) r
+	return append(reg32([]byte{0x83}, 4, r), byte(imm8))
+}
+
+// AddlImm8Reg encodes: addl $imm8, %r32 ([REX] 83 /0 <imm8>)
+func AddlImm8Reg(r Reg, imm8 int8) []byte {
+	// ModRM: 11 (reg) 000 (/0) r
+	return append(reg32([]byte{0x83}, 0, r), byte(imm8))
+}
+
+// CmplImm8Reg encodes: cmpl $imm8, %r32 ([REX] 83 /7 <imm8>)
+// Sets the flags for r - imm8, CF if r is below it unsigned.
+func CmplImm8Reg(r Reg, imm8 int8) []byte {
+	// ModRM: 11 (reg) 111 (/7) r
+	return append(reg32([]byte{0x83}, 7, r), byte(imm8))
+}
+
+// AndqImm8Reg encodes: andq $imm8, %r (REX.W 83 /4 <imm8>)
+// The immediate is sign-extended, so $-16 rounds r down to a multiple of 16.
+func AndqImm8Reg(r Reg, imm8 int8) []byte {
+	// ModRM: 11 (reg) 100 (/4) r
+	return []byte{rex(true, false, false, r >= 8), 0x83, 0xE0 | byte(r&7), byte(imm8)}
+}
+
+// MovlImm32Reg encodes: movl $imm32, %r32 ([41] B8+r <imm32>)
+func MovlImm32Reg(r Reg, imm32 int32) []byte {
+	buf := []byte{0xB8 | byte(r&7), 0, 0, 0, 0}
+	writeLE32(buf[1:], uint32(imm32))
+	if r >= 8 {
+		return append([]byte{rex(false, false, false, true)}, buf...)
+	}
+	return buf
+}
@@ -0,0 +1,35 @@
+package amd64
+
+// Stack slot encoders, for structures built below the stack pointer such
+// as the iovecs of a writev. The slots may be further than a disp8 from
+// RSP, so each takes a disp32, after the SIB byte an RSP base needs.
+
+// LeaqRSPDisp32Reg encodes: leaq disp32(%rsp), %dst (REX.W 8D /r <disp32>)
+// Loads the address of a stack slot.
+func LeaqRSPDisp32Reg(dst Reg, disp32 int32) []byte {
+	// ModRM: 10 (disp32) dst 100 (SIB)
+	// SIB: 00 (scale=1) 100 (no index) 100 (rsp base) = 24
+	buf := []byte{rex(true, dst >= 8, false, false), 0x8D, 0x84 | byte(dst&7)<<3, 0x24, 0, 0, 0, 0}
+	writeLE32(buf[4:], uint32(disp32))
+	return buf
+}
+
+// MovqRegRSPDisp32 encodes: movq %src, disp32(%rsp) (REX.W 89 /r <disp32>)
+// Stores src in a stack slot.
+func MovqRegRSPDisp32(disp32 int32, src Reg) []byte {
+	// ModRM: 10 (disp32) src 100 (SIB), SIB as for LeaqRSPDisp32Reg
+	buf := []byte{rex(true, src >= 8, false, false), 0x89, 0x84 | byte(src&7)<<3, 0x24, 0, 0, 0, 0}
+	writeLE32(buf[4:], uint32(disp32))
+	return buf
+}
+
+// MovqImm32RSPDisp32 encodes: movq $imm32, disp32(%rsp)
+// (REX.W C7 /0 <disp32> <imm32>)
+// Stores a sign-extended 32-bit immediate in a stack slot.
+func MovqImm32RSPDisp32(disp32, imm32 int32) []byte {
+	// ModRM: 10 (disp32) 000 (/0) 100 (SIB), SIB as for LeaqRSPDisp32Reg
+	buf := []byte{rex(true, false, false, false), 0xC7, 0x84, 0x24, 0, 0, 0, 0, 0, 0, 0, 0}
+	writeLE32(buf[4:], uint32(disp32))
+	writeLE32(buf[8:], uint32(imm32))
+	return buf
+}
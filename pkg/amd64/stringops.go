@@ -0,0 +1,52 @@
+package amd64
+
+// String instruction encoders, for bulk operations over runs of cells.
+//
+// All of them count RCX down to zero and step RDI (and RSI) by one byte per
+// iteration, forwards while the direction flag is clear (the ABI default at
+// process start) or backwards after Std.
+
+// RepStosb encodes: rep stosb (F3 AA)
+// Store AL into RCX bytes starting at (%rdi).
+func RepStosb() []byte {
+	return []byte{0xF3, 0xAA}
+}
+
+// RepMovsb encodes: rep movsb (F3 A4)
+// Copy RCX bytes from (%rsi) to (%rdi).
+func RepMovsb() []byte {
+	return []byte{0xF3, 0xA4}
+}
+
+// RepneScasb encodes: repne scasb (F2 AE)
+// Scan up to RCX bytes from (%rdi) for AL. ZF is set if it was found, with
+// RDI one past the match.
+func RepneScasb() []byte {
+	return []byte{0xF2, 0xAE}
+}
+
+// RepeScasb encodes: repe scasb (F3 AE)
+// Scan up to RCX bytes from (%rdi) while they equal AL. ZF is clear if a
+// different byte was found, with RDI one past it.
+func RepeScasb() []byte {
+	return []byte{0xF3, 0xAE}
+}
+
+// Cld encodes: cld (FC)
+// Clear the direction flag, string ops step forwards.
+func Cld() []byte {
+	return []byte{0xFC}
+}
+
+// Std encodes: std (FD)
+// Set the direction flag, string ops step backwards. Must be undone with Cld
+// before returning to code that assumes the default.
+func Std() []byte {
+	return []byte{0xFD}
+}
+
+// LeaqCellToReg encodes: leaq disp(%r13,%r12), %dst (REX.W 8D /r)
+// Loads the address of a cell, eg. into RDI/RSI ahead of a string op.
+func LeaqCellToReg(dst Reg, disp int32) []byte {
+	return cellOp(true, []byte{0x8D}, byte(dst), disp)
+}
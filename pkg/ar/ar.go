@@ -0,0 +1,114 @@
+// Package ar writes static libraries: Unix ar archives in the System V
+// (GNU) format, with the symbol index linkers look symbols up in. This
+// package has no dependencies on the compiler internals.
+//
+// Archives are deterministic, as with `ar D`: every member has a zero
+// timestamp, owner and group, and mode 0644.
+package ar
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Magic starts every archive.
+const Magic = "!<arch>\n"
+
+// headerSize is the size of a member header.
+const headerSize = 60
+
+// maxShortName is the longest name that fits in a member header with its
+// terminating /. Longer names go in the // member.
+const maxShortName = 15
+
+// Member is a file in an archive, usually an object file, with the global
+// symbols it defines for the index.
+type Member struct {
+	Name    string
+	Data    []byte
+	Symbols []string
+}
+
+// Build returns an archive of members, in order, led by a symbol index if
+// any of them define symbols.
+func Build(members []Member) []byte {
+	// The // member holds the names too long for a header, each ending
+	// with /\n, and the header names them as /offset
+	var longNames []byte
+	names := make([]string, len(members))
+	for i, m := range members {
+		if len(m.Name) > maxShortName {
+			names[i] = fmt.Sprintf("/%d", len(longNames))
+			longNames = append(longNames, m.Name+"/\n"...)
+		} else {
+			names[i] = m.Name + "/"
+		}
+	}
+
+	var nsyms int
+	var symNames []byte
+	for _, m := range members {
+		nsyms += len(m.Symbols)
+		for _, sym := range m.Symbols {
+			symNames = append(append(symNames, sym...), 0)
+		}
+	}
+
+	// Lay the members out to find the offsets the index points at
+	offset := len(Magic)
+	indexSize := 0
+	if nsyms > 0 {
+		indexSize = 4 + 4*nsyms + len(symNames)
+		offset += headerSize + padded(indexSize)
+	}
+	if len(longNames) > 0 {
+		offset += headerSize + padded(len(longNames))
+	}
+	offsets := make([]int, len(members))
+	for i, m := range members {
+		offsets[i] = offset
+		offset += headerSize + padded(len(m.Data))
+	}
+
+	out := []byte(Magic)
+	if nsyms > 0 {
+		index := binary.BigEndian.AppendUint32(nil, uint32(nsyms))
+		for i, m := range members {
+			for range m.Symbols {
+				index = binary.BigEndian.AppendUint32(index, uint32(offsets[i]))
+			}
+		}
+		out = appendMember(out, "/", append(index, symNames...))
+	}
+	if len(longNames) > 0 {
+		out = appendMember(out, "//", longNames)
+	}
+	for i, m := range members {
+		out = appendMember(out, names[i], m.Data)
+	}
+	return out
+}
+
+// appendMember writes a member header and its data, padded to an even
+// length with a newline. The index and long names members have the header
+// fields GNU ar gives them.
+func appendMember(out []byte, name string, data []byte) []byte {
+	date, id, mode := "0", "0", "644"
+	switch name {
+	case "/":
+		mode = "0"
+	case "//":
+		date, id, mode = "", "", ""
+	}
+	header := fmt.Sprintf("%-16s%-12s%-6s%-6s%-8s%-10d`\n", name, date, id, id, mode, len(data))
+	out = append(append(out, header...), data...)
+	if len(data)%2 != 0 {
+		out = append(out, '\n')
+	}
+	return out
+}
+
+// padded returns n rounded up to an even number of bytes.
+func padded(n int) int {
+	return n + n%2
+}
@@ -0,0 +1,121 @@
+// Package arm provides 32-bit ARM (ARMv7-A, A32) machine code encoding
+// utilities. This package has no dependencies on compiler internals and can
+// be used standalone for generating ARM machine code.
+//
+// Every instruction is 4 bytes and, as encoded, always executes. If makes
+// one conditional, as any A32 instruction can be. Thumb is not used.
+package arm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// Reg is a general purpose register, r0 to r15.
+type Reg uint32
+
+// Registers by number. SP, LR and PC are r13, r14 and r15.
+const (
+	R0 Reg = iota
+	R1
+	R2
+	R3
+	R4
+	R5
+	R6
+	R7
+	R8
+	R9
+	R10
+	R11
+	R12
+	SP
+	LR
+	PC
+)
+
+// Cond is the condition an instruction executes under, in its top 4 bits.
+type Cond uint32
+
+// Condition codes. HS and LO are the unsigned >= and <, HI and LS the
+// unsigned > and <=, and AL always.
+const (
+	EQ Cond = iota
+	NE
+	HS
+	LO
+	MI
+	PL
+	VS
+	VC
+	HI
+	LS
+	GE
+	LT
+	GT
+	LE
+	AL
+)
+
+// word returns an instruction as its 4 little-endian bytes.
+func word(w uint32) []byte {
+	return binary.LittleEndian.AppendUint32(make([]byte, 0, 4), w)
+}
+
+// always is the AL condition in place, for the encoders to OR in.
+const always = uint32(AL) << 28
+
+// If returns insn, an instruction from this package, made to execute only
+// when cond holds.
+func If(cond Cond, insn []byte) []byte {
+	w := binary.LittleEndian.Uint32(insn)
+	return word(w&^(0xF<<28) | uint32(cond)<<28)
+}
+
+// EncodeImm returns v as a data processing immediate: an 8-bit value
+// rotated right by an even amount, as the 12 bits rot:imm8. ok is false
+// if v has no such form.
+func EncodeImm(v uint32) (imm12 uint32, ok bool) {
+	for rot := uint32(0); rot < 16; rot++ {
+		if imm8 := bits.RotateLeft32(v, int(2*rot)); imm8 <= 0xFF {
+			return rot<<8 | imm8, true
+		}
+	}
+	return 0, false
+}
+
+// FitsImm reports whether v can be a data processing immediate.
+func FitsImm(v uint32) bool {
+	_, ok := EncodeImm(v)
+	return ok
+}
+
+// dataImm encodes a data processing instruction with an immediate, opcode
+// being bits 24 to 20 (the opcode and S bit). It panics if imm has no
+// immediate form; check with FitsImm.
+func dataImm(opcode uint32, rd, rn Reg, imm uint32) []byte {
+	imm12, ok := EncodeImm(imm)
+	if !ok {
+		panic(fmt.Sprintf("arm: %#x is not an immediate", imm))
+	}
+	return word(always | 1<<25 | opcode<<20 | uint32(rn)<<16 | uint32(rd)<<12 | imm12)
+}
+
+// dataReg encodes a data processing instruction with an unshifted register
+// as its last operand.
+func dataReg(opcode uint32, rd, rn, rm Reg) []byte {
+	return word(always | opcode<<20 | uint32(rn)<<16 | uint32(rd)<<12 | uint32(rm))
+}
+
+// branch encodes a b or bl of off bytes from the instruction. The offset
+// is from the instruction after next, where PC reads, in words.
+func branch(op uint32, off int32) []byte {
+	return word(always | op<<24 | uint32((off-8)>>2)&0xFFFFFF)
+}
+
+// FitsBranch reports whether off, in bytes from a branch, is in its
+// ±32 MiB range.
+func FitsBranch(off int64) bool {
+	return off%4 == 0 && off-8 >= -(1<<25) && off-8 < 1<<25
+}
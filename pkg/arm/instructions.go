@@ -0,0 +1,144 @@
+package arm
+
+// This file contains A32 instruction encoders. Each function returns the 4
+// bytes of one instruction, named after its assembler mnemonic, that always
+// executes; If makes it conditional. Immediates of the data processing
+// instructions must pass FitsImm.
+//
+// For the encodings see the ARM Architecture Reference Manual ARMv7-A and
+// ARMv7-R edition, chapter A5 "ARM Instruction Set Encoding".
+
+// Data processing opcodes, with the S bit (set flags) as bit 0.
+const (
+	opSub  = 0x04
+	opSubs = 0x05
+	opAdd  = 0x08
+	opCmp  = 0x15
+	opCmn  = 0x17
+	opMov  = 0x1a
+)
+
+// MovImm encodes: mov rd, #imm
+func MovImm(rd Reg, imm uint32) []byte {
+	return dataImm(opMov, rd, 0, imm)
+}
+
+// Mov encodes: mov rd, rm
+func Mov(rd, rm Reg) []byte {
+	return dataReg(opMov, rd, 0, rm)
+}
+
+// Movw encodes: movw rd, #imm16 - rd = imm16, clearing the top half.
+func Movw(rd Reg, imm16 uint16) []byte {
+	return word(always | 0x03000000 | uint32(imm16)>>12<<16 | uint32(rd)<<12 | uint32(imm16)&0xFFF)
+}
+
+// Movt encodes: movt rd, #imm16 - replace the top half of rd, keeping the
+// bottom.
+func Movt(rd Reg, imm16 uint16) []byte {
+	return word(always | 0x03400000 | uint32(imm16)>>12<<16 | uint32(rd)<<12 | uint32(imm16)&0xFFF)
+}
+
+// AddImm encodes: add rd, rn, #imm
+func AddImm(rd, rn Reg, imm uint32) []byte {
+	return dataImm(opAdd, rd, rn, imm)
+}
+
+// SubImm encodes: sub rd, rn, #imm
+func SubImm(rd, rn Reg, imm uint32) []byte {
+	return dataImm(opSub, rd, rn, imm)
+}
+
+// SubsImm encodes: subs rd, rn, #imm, setting the flags.
+func SubsImm(rd, rn Reg, imm uint32) []byte {
+	return dataImm(opSubs, rd, rn, imm)
+}
+
+// Add encodes: add rd, rn, rm
+func Add(rd, rn, rm Reg) []byte {
+	return dataReg(opAdd, rd, rn, rm)
+}
+
+// Sub encodes: sub rd, rn, rm
+func Sub(rd, rn, rm Reg) []byte {
+	return dataReg(opSub, rd, rn, rm)
+}
+
+// CmpImm encodes: cmp rn, #imm
+func CmpImm(rn Reg, imm uint32) []byte {
+	return dataImm(opCmp, 0, rn, imm)
+}
+
+// CmnImm encodes: cmn rn, #imm - compare rn with -imm.
+func CmnImm(rn Reg, imm uint32) []byte {
+	return dataImm(opCmn, 0, rn, imm)
+}
+
+// Adr encodes: adr rd, off - rd = the address off bytes from here (add rd,
+// pc, #off-8, as PC reads 8 bytes ahead). off-8 must pass FitsImm.
+func Adr(rd Reg, off int32) []byte {
+	return AddImm(rd, PC, uint32(off-8))
+}
+
+// Ldrb encodes: ldrb rt, [rn, #off] - load a zero-extended byte, off 0 to
+// 4095.
+func Ldrb(rt, rn Reg, off uint32) []byte {
+	return word(always | 0x05D00000 | uint32(rn)<<16 | uint32(rt)<<12 | off&0xFFF)
+}
+
+// Ldrsb encodes: ldrsb rt, [rn, #off] - load a byte sign-extended to 32
+// bits, off 0 to 255.
+func Ldrsb(rt, rn Reg, off uint32) []byte {
+	return word(always | 0x01D000D0 | uint32(rn)<<16 | uint32(rt)<<12 | off&0xF0<<4 | off&0xF)
+}
+
+// Strb encodes: strb rt, [rn, #off] - store the low byte of rt, off 0 to
+// 4095.
+func Strb(rt, rn Reg, off uint32) []byte {
+	return word(always | 0x05C00000 | uint32(rn)<<16 | uint32(rt)<<12 | off&0xFFF)
+}
+
+// LdrbPost encodes: ldrb rt, [rn], #inc - load a byte then add inc (0 to
+// 4095) to rn.
+func LdrbPost(rt, rn Reg, inc uint32) []byte {
+	return word(always | 0x04D00000 | uint32(rn)<<16 | uint32(rt)<<12 | inc&0xFFF)
+}
+
+// StrbPost encodes: strb rt, [rn], #inc - store a byte then add inc (0 to
+// 4095) to rn.
+func StrbPost(rt, rn Reg, inc uint32) []byte {
+	return word(always | 0x04C00000 | uint32(rn)<<16 | uint32(rt)<<12 | inc&0xFFF)
+}
+
+// B encodes: b off - jump off bytes from here (±32 MiB).
+func B(off int32) []byte {
+	return branch(0x0A, off)
+}
+
+// Bl encodes: bl off - call off bytes from here (±32 MiB), saving the
+// return address in lr.
+func Bl(off int32) []byte {
+	return branch(0x0B, off)
+}
+
+// Bx encodes: bx rm - jump to the address in rm; bx lr returns.
+func Bx(rm Reg) []byte {
+	return word(always | 0x012FFF10 | uint32(rm))
+}
+
+// Svc encodes: svc #imm24 - supervisor call. Linux EABI system calls take
+// the number in r7 and arguments in r0 to r6, and return in r0.
+func Svc(imm24 uint32) []byte {
+	return word(always | 0x0F000000 | imm24&0xFFFFFF)
+}
+
+// Udf encodes: udf #imm16 - permanently undefined. Linux takes udf #16 as
+// a breakpoint and raises SIGTRAP.
+func Udf(imm16 uint16) []byte {
+	return word(always | 0x07F000F0 | uint32(imm16)>>4<<8 | uint32(imm16)&0xF)
+}
+
+// Nop encodes: nop
+func Nop() []byte {
+	return word(always | 0x0320F000)
+}
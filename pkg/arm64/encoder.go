@@ -0,0 +1,117 @@
+// Package arm64 provides AArch64 (ARMv8-A) machine code encoding utilities.
+// This package has no dependencies on compiler internals and can be used
+// standalone for generating arm64 machine code.
+//
+// Every instruction is 4 bytes. Register 31 is the zero register or the
+// stack pointer depending on the instruction; the encoders here only take
+// it as the zero register, except where noted.
+package arm64
+
+import "encoding/binary"
+
+// Reg is a general purpose register, x0 to x30, or 31 for xzr. The 32-bit
+// forms of the instructions use the same numbers for w0 to w30 and wzr.
+type Reg uint32
+
+// Registers by number. X29 is the frame pointer and X30 the link register.
+const (
+	X0 Reg = iota
+	X1
+	X2
+	X3
+	X4
+	X5
+	X6
+	X7
+	X8
+	X9
+	X10
+	X11
+	X12
+	X13
+	X14
+	X15
+	X16
+	X17
+	X18
+	X19
+	X20
+	X21
+	X22
+	X23
+	X24
+	X25
+	X26
+	X27
+	X28
+	X29
+	X30
+	ZR // xzr or wzr
+)
+
+// Cond is a condition code for BCond.
+type Cond uint32
+
+// Condition codes. HS and LO are the unsigned >= and <, HI and LS the
+// unsigned > and <=.
+const (
+	EQ Cond = iota
+	NE
+	HS
+	LO
+	MI
+	PL
+	VS
+	VC
+	HI
+	LS
+	GE
+	LT
+	GT
+	LE
+)
+
+// word returns an instruction as its 4 little-endian bytes.
+func word(w uint32) []byte {
+	return binary.LittleEndian.AppendUint32(make([]byte, 0, 4), w)
+}
+
+// addSubImm encodes an add or subtract of a 12-bit unsigned immediate,
+// shifted left by 12 when lsl12 is set. base selects the operation and
+// width.
+func addSubImm(base uint32, rd, rn Reg, imm uint32, lsl12 bool) []byte {
+	var sh uint32
+	if lsl12 {
+		sh = 1
+	}
+	return word(base | sh<<22 | imm&0xfff<<10 | uint32(rn)<<5 | uint32(rd))
+}
+
+// loadStore encodes a byte load or store at an unsigned 12-bit offset.
+func loadStore(base uint32, rt, rn Reg, off uint32) []byte {
+	return word(base | off&0xfff<<10 | uint32(rn)<<5 | uint32(rt))
+}
+
+// moveWide encodes a movz, movk or movn of a 16-bit immediate shifted left
+// by shift, which must be 0, 16, 32 or 48.
+func moveWide(base uint32, rd Reg, imm16 uint16, shift uint) []byte {
+	return word(base | uint32(shift/16)<<21 | uint32(imm16)<<5 | uint32(rd))
+}
+
+// FitsImm12 reports whether v fits the unsigned 12-bit immediate of an add
+// or subtract.
+func FitsImm12(v int64) bool {
+	return v >= 0 && v < 4096
+}
+
+// FitsBranch reports whether a b or bl can reach off bytes away (±128
+// MiB).
+func FitsBranch(off int64) bool {
+	return off >= -1<<27 && off < 1<<27
+}
+
+// FitsAdrp reports whether an adrp can reach a page off bytes away (±4
+// GiB).
+func FitsAdrp(off int64) bool {
+	return off >= -1<<32 && off < 1<<32
+}
@@ -0,0 +1,189 @@
+package arm64
+
+// This file contains A64 instruction encoders. Each function returns the 4
+// bytes of one instruction, named after its assembler mnemonic, with a W
+// suffix for the 32-bit forms.
+//
+// For the encodings see the Arm Architecture Reference Manual for A-profile,
+// chapter C4 "A64 Instruction Set Encoding".
+
+// Movz encodes: movz xd, #imm16, lsl #shift
+func Movz(rd Reg, imm16 uint16, shift uint) []byte {
+	return moveWide(0xd2800000, rd, imm16, shift)
+}
+
+// Movk encodes: movk xd, #imm16, lsl #shift - replace 16 bits, keeping the
+// rest of xd.
+func Movk(rd Reg, imm16 uint16, shift uint) []byte {
+	return moveWide(0xf2800000, rd, imm16, shift)
+}
+
+// Movn encodes: movn xd, #imm16, lsl #shift - xd = ^(imm16 << shift)
+func Movn(rd Reg, imm16 uint16, shift uint) []byte {
+	return moveWide(0x92800000, rd, imm16, shift)
+}
+
+// MovzW encodes: movz wd, #imm16
+func MovzW(rd Reg, imm16 uint16) []byte {
+	return moveWide(0x52800000, rd, imm16, 0)
+}
+
+// Mov encodes: mov xd, xm (orr xd, xzr, xm)
+func Mov(rd, rm Reg) []byte {
+	return word(0xaa0003e0 | uint32(rm)<<16 | uint32(rd))
+}
+
+// MovImm encodes: mov xd, #v, as a movz (or a movn for negative v)
+// followed by a movk for each further 16 bits that differ.
+func MovImm(rd Reg, v int64) []byte {
+	fill := uint16(0)
+	first := Movz
+	if v < 0 {
+		fill, first = 0xffff, Movn
+	}
+
+	u := uint64(v)
+	var out []byte
+	for shift := uint(0); shift < 64; shift += 16 {
+		part := uint16(u >> shift)
+		switch {
+		case part == fill:
+		case out == nil:
+			out = first(rd, part^fill, shift)
+		default:
+			out = append(out, Movk(rd, part, shift)...)
+		}
+	}
+	if out == nil {
+		return first(rd, 0, 0) // 0 or -1
+	}
+	return out
+}
+
+// AddImm encodes: add xd, xn, #imm (imm 0 to 4095). Register 31 is sp
+// here, not xzr.
+func AddImm(rd, rn Reg, imm uint32) []byte {
+	return addSubImm(0x91000000, rd, rn, imm, false)
+}
+
+// SubImm encodes: sub xd, xn, #imm (imm 0 to 4095)
+func SubImm(rd, rn Reg, imm uint32) []byte {
+	return addSubImm(0xd1000000, rd, rn, imm, false)
+}
+
+// SubsImm encodes: subs xd, xn, #imm (imm 0 to 4095), setting the flags.
+func SubsImm(rd, rn Reg, imm uint32) []byte {
+	return addSubImm(0xf1000000, rd, rn, imm, false)
+}
+
+// AddImmW encodes: add wd, wn, #imm (imm 0 to 4095)
+func AddImmW(rd, rn Reg, imm uint32) []byte {
+	return addSubImm(0x11000000, rd, rn, imm, false)
+}
+
+// SubImmW encodes: sub wd, wn, #imm (imm 0 to 4095)
+func SubImmW(rd, rn Reg, imm uint32) []byte {
+	return addSubImm(0x51000000, rd, rn, imm, false)
+}
+
+// CmpImmW encodes: cmp wn, #imm (subs wzr, wn, #imm)
+func CmpImmW(rn Reg, imm uint32) []byte {
+	return addSubImm(0x71000000, ZR, rn, imm, false)
+}
+
+// Add encodes: add xd, xn, xm
+func Add(rd, rn, rm Reg) []byte {
+	return word(0x8b000000 | uint32(rm)<<16 | uint32(rn)<<5 | uint32(rd))
+}
+
+// Ldrb encodes: ldrb wt, [xn, #off] - load a zero-extended byte, off 0 to
+// 4095.
+func Ldrb(rt, rn Reg, off uint32) []byte {
+	return loadStore(0x39400000, rt, rn, off)
+}
+
+// Ldrsb encodes: ldrsb wt, [xn, #off] - load a byte sign-extended to 32
+// bits, off 0 to 4095.
+func Ldrsb(rt, rn Reg, off uint32) []byte {
+	return loadStore(0x39c00000, rt, rn, off)
+}
+
+// Strb encodes: strb wt, [xn, #off] - store the low byte of wt, off 0 to
+// 4095.
+func Strb(rt, rn Reg, off uint32) []byte {
+	return loadStore(0x39000000, rt, rn, off)
+}
+
+// LdrbPost encodes: ldrb wt, [xn], #inc - load a byte then add inc (-256
+// to 255) to xn.
+func LdrbPost(rt, rn Reg, inc int32) []byte {
+	return word(0x38400400 | uint32(inc)&0x1ff<<12 | uint32(rn)<<5 | uint32(rt))
+}
+
+// StrbPost encodes: strb wt, [xn], #inc - store a byte then add inc (-256
+// to 255) to xn.
+func StrbPost(rt, rn Reg, inc int32) []byte {
+	return word(0x38000400 | uint32(inc)&0x1ff<<12 | uint32(rn)<<5 | uint32(rt))
+}
+
+// B encodes: b off - jump off bytes from here (±128 MiB).
+func B(off int32) []byte {
+	return word(0x14000000 | uint32(off>>2)&0x3ffffff)
+}
+
+// Bl encodes: bl off - call off bytes from here (±128 MiB), saving the
+// return address in x30.
+func Bl(off int32) []byte {
+	return word(0x94000000 | uint32(off>>2)&0x3ffffff)
+}
+
+// BCond encodes: b.cond off - jump off bytes from here (±1 MiB) if cond
+// holds.
+func BCond(cond Cond, off int32) []byte {
+	return word(0x54000000 | uint32(off>>2)&0x7ffff<<5 | uint32(cond))
+}
+
+// Cbz encodes: cbz wt, off - jump off bytes from here (±1 MiB) if wt is
+// zero.
+func Cbz(rt Reg, off int32) []byte {
+	return word(0x34000000 | uint32(off>>2)&0x7ffff<<5 | uint32(rt))
+}
+
+// Cbnz encodes: cbnz wt, off - jump off bytes from here (±1 MiB) if wt is
+// not zero.
+func Cbnz(rt Reg, off int32) []byte {
+	return word(0x35000000 | uint32(off>>2)&0x7ffff<<5 | uint32(rt))
+}
+
+// Ret encodes: ret (to x30)
+func Ret() []byte {
+	return word(0xd65f03c0)
+}
+
+// Adr encodes: adr xd, off - xd = pc + off (±1 MiB).
+func Adr(rd Reg, off int32) []byte {
+	u := uint32(off)
+	return word(0x10000000 | u&3<<29 | u>>2&0x7ffff<<5 | uint32(rd))
+}
+
+// Adrp encodes: adrp xd, pages - xd = the 4 KiB page of pc, plus pages
+// pages (±1M, so ±4 GiB).
+func Adrp(rd Reg, pages int32) []byte {
+	u := uint32(pages)
+	return word(0x90000000 | u&3<<29 | u>>2&0x7ffff<<5 | uint32(rd))
+}
+
+// Svc encodes: svc #imm16 - a supervisor call.
+func Svc(imm16 uint16) []byte {
+	return word(0xd4000001 | uint32(imm16)<<5)
+}
+
+// Brk encodes: brk #imm16 - a breakpoint, raising SIGTRAP.
+func Brk(imm16 uint16) []byte {
+	return word(0xd4200000 | uint32(imm16)<<5)
+}
+
+// Nop encodes: nop
+func Nop() []byte {
+	return word(0xd503201f)
+}
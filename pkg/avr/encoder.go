@@ -0,0 +1,93 @@
+// Package avr provides AVR machine code encoding utilities, for the
+// ATmega microcontrollers. This package has no dependencies on compiler
+// internals and can be used standalone for generating AVR machine code.
+//
+// Instructions are one or two 16-bit words, stored little-endian. Jumps,
+// calls and branches count in words, as the program counter does, and
+// relative ones count from the word after the instruction.
+package avr
+
+// Reg is one of the 32 general purpose registers, R0 to R31.
+type Reg uint8
+
+// Registers. Immediate instructions only take R16 to R31, and word
+// instructions the pairs from R24.
+const (
+	R0  Reg = 0
+	R1  Reg = 1
+	R24 Reg = 24
+	R25 Reg = 25
+	R26 Reg = 26
+	R27 Reg = 27
+	R30 Reg = 30
+	R31 Reg = 31
+)
+
+// Pointer register halves.
+const (
+	XL = R26
+	XH = R27
+	ZL = R30
+	ZH = R31
+)
+
+// Cond is the encoding of a conditional branch, taken when its status
+// register bit is set or clear.
+type Cond uint16
+
+// Conditional branches.
+const (
+	BRCS Cond = 0xF000 // branch if C set
+	BREQ Cond = 0xF001 // branch if Z set
+	BRMI Cond = 0xF002 // branch if N set
+	BRVS Cond = 0xF003 // branch if V set
+	BRCC Cond = 0xF400 // branch if C clear
+	BRNE Cond = 0xF401 // branch if Z clear
+	BRPL Cond = 0xF402 // branch if N clear
+	BRVC Cond = 0xF403 // branch if V clear
+)
+
+// Invert returns the branch taken exactly when c is not.
+func (c Cond) Invert() Cond {
+	return c ^ 0x0400
+}
+
+// FitsBranch reports whether off, in words counted from the word after a
+// branch, is in a branch's reach.
+func FitsBranch(off int) bool {
+	return off >= -64 && off <= 63
+}
+
+// I/O registers, by I/O address for IN and OUT.
+const (
+	SPL = 0x3D // stack pointer, low byte
+	SPH = 0x3E // stack pointer, high byte
+)
+
+// word encodes a one word instruction.
+func word(w uint16) []byte {
+	return []byte{byte(w), byte(w >> 8)}
+}
+
+// rd encodes an instruction with a 5-bit register at bits 4 to 8.
+func rd(op uint16, d Reg) []byte {
+	return word(op | uint16(d&0x1F)<<4)
+}
+
+// rdrr encodes an instruction with two 5-bit registers, d at bits 4 to 8
+// and r at bits 0 to 3 and 9.
+func rdrr(op uint16, d, r Reg) []byte {
+	return word(op | uint16(d&0x1F)<<4 | uint16(r&0x0F) | uint16(r&0x10)<<5)
+}
+
+// rdk encodes an instruction with a register from R16 and an 8-bit
+// immediate, split around it.
+func rdk(op uint16, d Reg, k byte) []byte {
+	return word(op | uint16(d&0x0F)<<4 | uint16(k&0x0F) | uint16(k&0xF0)<<4)
+}
+
+// long encodes a two word jump or call to the word address addr.
+func long(op uint16, addr uint32) []byte {
+	first := op | uint16(addr>>17&0x1F)<<4 | uint16(addr>>16&1)
+	return append(word(first), word(uint16(addr))...)
+}
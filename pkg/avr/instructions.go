@@ -0,0 +1,148 @@
+package avr
+
+// This file contains AVR instruction encoders, named after the mnemonic
+// and addressing mode. Each function returns the machine code bytes for a
+// specific instruction. See the AVR Instruction Set Manual:
+// https://ww1.microchip.com/downloads/en/devicedoc/atmel-0856-avr-instruction-set-manual.pdf
+
+// Ldi encodes: LDI Rd, k (1110 kkkk dddd kkkk), for R16 to R31
+func Ldi(d Reg, k byte) []byte {
+	return rdk(0xE000, d, k)
+}
+
+// Mov encodes: MOV Rd, Rr (0010 11rd dddd rrrr)
+func Mov(d, r Reg) []byte {
+	return rdrr(0x2C00, d, r)
+}
+
+// Movw encodes: MOVW Rd+1:Rd, Rr+1:Rr (0000 0001 dddd rrrr), for even d
+// and r
+func Movw(d, r Reg) []byte {
+	return word(0x0100 | uint16(d>>1)<<4 | uint16(r>>1))
+}
+
+// LdX encodes: LD Rd, X (1001 000d dddd 1100)
+func LdX(d Reg) []byte {
+	return rd(0x900C, d)
+}
+
+// LdXInc encodes: LD Rd, X+ (1001 000d dddd 1101)
+// Loads the byte at X, then increments X.
+func LdXInc(d Reg) []byte {
+	return rd(0x900D, d)
+}
+
+// StX encodes: ST X, Rr (1001 001r rrrr 1100)
+func StX(r Reg) []byte {
+	return rd(0x920C, r)
+}
+
+// StXInc encodes: ST X+, Rr (1001 001r rrrr 1101)
+func StXInc(r Reg) []byte {
+	return rd(0x920D, r)
+}
+
+// StZInc encodes: ST Z+, Rr (1001 001r rrrr 0001)
+func StZInc(r Reg) []byte {
+	return rd(0x9201, r)
+}
+
+// LpmZInc encodes: LPM Rd, Z+ (1001 000d dddd 0101)
+// Loads the byte of program memory at the byte address Z, then
+// increments Z.
+func LpmZInc(d Reg) []byte {
+	return rd(0x9005, d)
+}
+
+// Lds encodes: LDS Rd, addr (1001 000d dddd 0000, addr)
+func Lds(d Reg, addr uint16) []byte {
+	return append(rd(0x9000, d), word(addr)...)
+}
+
+// Sts encodes: STS addr, Rr (1001 001r rrrr 0000, addr)
+func Sts(addr uint16, r Reg) []byte {
+	return append(rd(0x9200, r), word(addr)...)
+}
+
+// Out encodes: OUT a, Rr (1011 1aar rrrr aaaa), for I/O addresses 0 to 63
+func Out(a byte, r Reg) []byte {
+	return word(0xB800 | uint16(r&0x1F)<<4 | uint16(a&0x0F) | uint16(a&0x30)<<5)
+}
+
+// Add encodes: ADD Rd, Rr (0000 11rd dddd rrrr)
+func Add(d, r Reg) []byte {
+	return rdrr(0x0C00, d, r)
+}
+
+// Subi encodes: SUBI Rd, k (0101 kkkk dddd kkkk), for R16 to R31
+func Subi(d Reg, k byte) []byte {
+	return rdk(0x5000, d, k)
+}
+
+// Sbci encodes: SBCI Rd, k (0100 kkkk dddd kkkk), for R16 to R31
+// Subtracts k and the carry.
+func Sbci(d Reg, k byte) []byte {
+	return rdk(0x4000, d, k)
+}
+
+// Adiw encodes: ADIW Rd+1:Rd, k (1001 0110 kkdd kkkk), for R24, R26, R28
+// or R30 and k from 0 to 63
+func Adiw(d Reg, k byte) []byte {
+	return word(0x9600 | uint16(k&0x30)<<2 | uint16((d-24)>>1)<<4 | uint16(k&0x0F))
+}
+
+// Sbiw encodes: SBIW Rd+1:Rd, k (1001 0111 kkdd kkkk), as for Adiw
+func Sbiw(d Reg, k byte) []byte {
+	return word(0x9700 | uint16(k&0x30)<<2 | uint16((d-24)>>1)<<4 | uint16(k&0x0F))
+}
+
+// Eor encodes: EOR Rd, Rr (0010 01rd dddd rrrr)
+// EOR Rd, Rd clears Rd.
+func Eor(d, r Reg) []byte {
+	return rdrr(0x2400, d, r)
+}
+
+// Tst encodes: TST Rd, that is AND Rd, Rd (0010 00dd dddd dddd)
+func Tst(d Reg) []byte {
+	return rdrr(0x2000, d, d)
+}
+
+// Sbrs encodes: SBRS Rr, b (1111 111r rrrr 0bbb)
+// Skips the next instruction if bit b of Rr is set.
+func Sbrs(r Reg, b byte) []byte {
+	return word(0xFE00 | uint16(r&0x1F)<<4 | uint16(b&7))
+}
+
+// Branch encodes a conditional branch by off words (1111 0skk kkkk ksss),
+// from -64 to 63.
+func Branch(c Cond, off int8) []byte {
+	return word(uint16(c) | uint16(off&0x7F)<<3)
+}
+
+// Rjmp encodes: RJMP off (1100 kkkk kkkk kkkk), by off words from -2048
+// to 2047
+func Rjmp(off int16) []byte {
+	return word(0xC000 | uint16(off)&0x0FFF)
+}
+
+// Jmp encodes: JMP addr (1001 010k kkkk 110k, kkkk kkkk kkkk kkkk), to
+// the word address addr
+func Jmp(addr uint32) []byte {
+	return long(0x940C, addr)
+}
+
+// Call encodes: CALL addr (1001 010k kkkk 111k, kkkk kkkk kkkk kkkk),
+// pushing the return address
+func Call(addr uint32) []byte {
+	return long(0x940E, addr)
+}
+
+// Ret encodes: RET (1001 0101 0000 1000)
+func Ret() []byte {
+	return word(0x9508)
+}
+
+// Cli encodes: CLI (1001 0100 1111 1000), disabling interrupts
+func Cli() []byte {
+	return word(0x94F8)
+}
@@ -0,0 +1,131 @@
+package ebpf
+
+import "encoding/binary"
+
+// TypeID identifies a type in a BTF blob. 0 is void.
+type TypeID uint32
+
+// BTF kinds.
+const (
+	kindInt       = 1
+	kindPtr       = 2
+	kindFunc      = 12
+	kindFuncProto = 13
+)
+
+// Linkage is the visibility of a BTF function. A bpf_loop callback must be
+// static.
+type Linkage uint16
+
+// Function linkages.
+const (
+	LinkageStatic Linkage = 0
+	LinkageGlobal Linkage = 1
+)
+
+// btfMagic starts every BTF blob.
+const btfMagic = 0xeb9f
+
+// BTF builds a blob of BPF Type Format type information, for BPF_BTF_LOAD.
+// Only the types describing functions are supported: integers, pointers,
+// function prototypes and functions.
+type BTF struct {
+	types   []byte
+	strings []byte
+	next    TypeID
+}
+
+// Param is a parameter of a function prototype.
+type Param struct {
+	Name string
+	Type TypeID
+}
+
+// NewBTF creates an empty BTF blob.
+func NewBTF() *BTF {
+	return &BTF{strings: []byte{0}, next: 1}
+}
+
+// Int adds an integer type size bytes wide.
+func (b *BTF) Int(name string, size uint32, signed bool) TypeID {
+	var encoding uint32
+	if signed {
+		encoding = 1
+	}
+	id := b.add(name, kindInt, 0, size)
+	b.types = binary.LittleEndian.AppendUint32(b.types, encoding<<24|size*8)
+	return id
+}
+
+// Ptr adds a pointer to to, or void * for 0.
+func (b *BTF) Ptr(to TypeID) TypeID {
+	return b.add("", kindPtr, 0, uint32(to))
+}
+
+// FuncProto adds a function prototype returning ret.
+func (b *BTF) FuncProto(ret TypeID, params ...Param) TypeID {
+	id := b.add("", kindFuncProto, uint16(len(params)), uint32(ret))
+	for _, p := range params {
+		b.types = binary.LittleEndian.AppendUint32(b.types, b.str(p.Name))
+		b.types = binary.LittleEndian.AppendUint32(b.types, uint32(p.Type))
+	}
+	return id
+}
+
+// Func adds a function named name of prototype proto.
+func (b *BTF) Func(name string, proto TypeID, linkage Linkage) TypeID {
+	return b.add(name, kindFunc, uint16(linkage), uint32(proto))
+}
+
+// add appends a type's common header: its name, kind, vlen (or linkage)
+// and size (or referenced type).
+func (b *BTF) add(name string, kind uint32, vlen uint16, sizeOrType uint32) TypeID {
+	b.types = binary.LittleEndian.AppendUint32(b.types, b.str(name))
+	b.types = binary.LittleEndian.AppendUint32(b.types, kind<<24|uint32(vlen))
+	b.types = binary.LittleEndian.AppendUint32(b.types, sizeOrType)
+	id := b.next
+	b.next++
+	return id
+}
+
+// str adds s to the string section, returning its offset. The empty
+// string is at 0.
+func (b *BTF) str(s string) uint32 {
+	if s == "" {
+		return 0
+	}
+	off := uint32(len(b.strings))
+	b.strings = append(append(b.strings, s...), 0)
+	return off
+}
+
+// Build returns the blob: a header, then the types and the strings.
+func (b *BTF) Build() []byte {
+	const hdrLen = 24
+	buf := binary.LittleEndian.AppendUint16(nil, btfMagic)
+	buf = append(buf, 1, 0) // version, flags
+	for _, v := range []uint32{hdrLen, 0, uint32(len(b.types)), uint32(len(b.types)), uint32(len(b.strings))} {
+		buf = binary.LittleEndian.AppendUint32(buf, v)
+	}
+	return append(append(buf, b.types...), b.strings...)
+}
+
+// FuncInfo says where a function starts, in instructions, and its BTF
+// type, for the func_info of BPF_PROG_LOAD.
+type FuncInfo struct {
+	Insn uint32
+	Type TypeID
+}
+
+// FuncInfoSize is the size of an encoded FuncInfo record.
+const FuncInfoSize = 8
+
+// EncodeFuncInfo returns the func_info records for infos.
+func EncodeFuncInfo(infos []FuncInfo) []byte {
+	var buf []byte
+	for _, fi := range infos {
+		buf = binary.LittleEndian.AppendUint32(buf, fi.Insn)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(fi.Type))
+	}
+	return buf
+}
@@ -0,0 +1,99 @@
+package ebpf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// aluSymbols are the C operators of the ALU operations.
+var aluSymbols = map[uint8]string{aluAdd: "+=", aluSub: "-=", aluAnd: "&=", aluXor: "^=", aluMov: "="}
+
+// condSymbols are the operators of the jump conditions, with s< and the
+// like for the signed orderings, as the kernel's verifier log prints them.
+var condSymbols = map[Cond]string{
+	JEQ: "==", JGT: ">", JGE: ">=", JNE: "!=", JSGT: "s>", JSGE: "s>=",
+	JLT: "<", JLE: "<=", JSLT: "s<", JSLE: "s<=",
+}
+
+// sizeNames are the C types of the access sizes.
+var sizeNames = map[Size]string{W: "u32", H: "u16", B: "u8", DW: "u64"}
+
+// helperNames are the names of the helper functions in Helper*.
+var helperNames = map[int32]string{HelperMapLookupElem: "bpf_map_lookup_elem", HelperLoop: "bpf_loop"}
+
+// Disassemble returns code as text, one numbered instruction per line, in
+// the notation of the kernel's verifier log. It only knows the
+// instructions this package encodes.
+func Disassemble(code []byte) string {
+	var sb strings.Builder
+	for pc := 0; pc+InsnSize <= len(code); pc += InsnSize {
+		text, wide := disassembleInsn(code[pc:])
+		fmt.Fprintf(&sb, "%5d: %s\n", pc/InsnSize, text)
+		if wide {
+			pc += InsnSize
+		}
+	}
+	return sb.String()
+}
+
+// disassembleInsn returns the instruction at the start of code as text,
+// and whether it is a two-instruction 64-bit immediate load.
+func disassembleInsn(code []byte) (string, bool) {
+	op := code[0]
+	dst, src := Reg(code[1]&0xf), Reg(code[1]>>4)
+	off := int16(binary.LittleEndian.Uint16(code[2:]))
+	imm := int32(binary.LittleEndian.Uint32(code[4:]))
+	size := Size(op & 0x18)
+
+	switch op & 0x07 {
+	case classAlu64:
+		sym, ok := aluSymbols[op&0xf0]
+		if !ok {
+			break
+		}
+		if op&srcReg != 0 {
+			return fmt.Sprintf("r%d %s r%d", dst, sym, src), false
+		}
+		return fmt.Sprintf("r%d %s %d", dst, sym, imm), false
+	case classLdx:
+		return fmt.Sprintf("r%d = *(%s *)(r%d %+d)", dst, sizeNames[size], src, off), false
+	case classStx:
+		return fmt.Sprintf("*(%s *)(r%d %+d) = r%d", sizeNames[size], dst, off, src), false
+	case classSt:
+		return fmt.Sprintf("*(%s *)(r%d %+d) = %d", sizeNames[size], dst, off, imm), false
+	case classLd:
+		if op != classLd|modeImm|uint8(DW) || len(code) < 2*InsnSize {
+			break
+		}
+		switch src {
+		case pseudoMapIdx:
+			return fmt.Sprintf("r%d = map[idx:%d]", dst, imm), true
+		case pseudoFunc:
+			return fmt.Sprintf("r%d = func pc%+d", dst, imm), true
+		}
+		hi := binary.LittleEndian.Uint32(code[InsnSize+4:])
+		return fmt.Sprintf("r%d = %#x ll", dst, uint64(hi)<<32|uint64(uint32(imm))), true
+	case classJmp:
+		switch op & 0xf0 {
+		case jmpJa:
+			return fmt.Sprintf("goto pc%+d", off), false
+		case jmpCall:
+			if name, ok := helperNames[imm]; ok {
+				return fmt.Sprintf("call %s#%d", name, imm), false
+			}
+			return fmt.Sprintf("call #%d", imm), false
+		case jmpExit:
+			return "exit", false
+		}
+		sym, ok := condSymbols[Cond(op&0xf0)]
+		if !ok {
+			break
+		}
+		if op&srcReg != 0 {
+			return fmt.Sprintf("if r%d %s r%d goto pc%+d", dst, sym, src, off), false
+		}
+		return fmt.Sprintf("if r%d %s %d goto pc%+d", dst, sym, imm, off), false
+	}
+	return fmt.Sprintf("(%02x) unknown", op), false
+}
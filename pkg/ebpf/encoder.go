@@ -0,0 +1,128 @@
+// Package ebpf provides eBPF bytecode encoding utilities: the instructions,
+// a disassembler for them, and the BTF type information the kernel needs
+// to load a program made of more than one function. This package has no
+// dependencies on compiler internals and can be used standalone for
+// generating eBPF.
+//
+// Only the original 64-bit instruction set is used, plus the pseudo
+// loads of a map (by its index in the fd_array given at load time) and of
+// a function's address, for a bpf_loop callback.
+package ebpf
+
+import "encoding/binary"
+
+// InsnSize is the size of an instruction. A 64-bit immediate load takes
+// two, and jump offsets count instructions, not bytes.
+const InsnSize = 8
+
+// Reg is a register, R0 to R10.
+type Reg uint8
+
+// Registers. R0 holds return values, R1 to R5 are helper arguments and
+// scratch, R6 to R9 survive helper calls, and R10 is the read-only frame
+// pointer.
+const (
+	R0 Reg = iota
+	R1
+	R2
+	R3
+	R4
+	R5
+	R6
+	R7
+	R8
+	R9
+	R10
+)
+
+// Instruction classes.
+const (
+	classLd    = 0x00
+	classLdx   = 0x01
+	classSt    = 0x02
+	classStx   = 0x03
+	classJmp   = 0x05
+	classAlu64 = 0x07
+)
+
+// Size is the width of a memory access.
+type Size uint8
+
+// Access sizes.
+const (
+	W  Size = 0x00 // 32 bits
+	H  Size = 0x08 // 16 bits
+	B  Size = 0x10 // 8 bits
+	DW Size = 0x18 // 64 bits
+)
+
+// Addressing modes and operand sources.
+const (
+	modeImm = 0x00
+	modeMem = 0x60
+	srcImm  = 0x00
+	srcReg  = 0x08
+)
+
+// ALU operations.
+const (
+	aluAdd = 0x00
+	aluSub = 0x10
+	aluAnd = 0x50
+	aluXor = 0xa0
+	aluMov = 0xb0
+)
+
+// Cond is the condition of a conditional jump.
+type Cond uint8
+
+// Jump conditions. The orderings are unsigned, JSGT to JSLE signed.
+const (
+	JEQ  Cond = 0x10
+	JGT  Cond = 0x20
+	JGE  Cond = 0x30
+	JNE  Cond = 0x50
+	JSGT Cond = 0x60
+	JSGE Cond = 0x70
+	JLT  Cond = 0xa0
+	JLE  Cond = 0xb0
+	JSLT Cond = 0xc0
+	JSLE Cond = 0xd0
+)
+
+// Other jump class operations.
+const (
+	jmpJa   = 0x00
+	jmpCall = 0x80
+	jmpExit = 0x90
+)
+
+// Pseudo sources of a 64-bit immediate load.
+const (
+	pseudoFunc   = 4 // the address of the function imm instructions on
+	pseudoMapIdx = 5 // the map at fd_array[imm]
+)
+
+// Helpers are the kernel helper functions a call can make.
+const (
+	HelperMapLookupElem = 1   // void *bpf_map_lookup_elem(map, key)
+	HelperLoop          = 181 // long bpf_loop(nr_loops, callback, ctx, flags)
+)
+
+// MaxLoops is the most iterations bpf_loop will run.
+const MaxLoops = 1 << 23
+
+// insn encodes one instruction.
+func insn(op uint8, dst, src Reg, off int16, imm int32) []byte {
+	buf := make([]byte, InsnSize)
+	buf[0] = op
+	buf[1] = byte(src)<<4 | byte(dst)
+	binary.LittleEndian.PutUint16(buf[2:], uint16(off))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(imm))
+	return buf
+}
+
+// FitsOffset reports whether a jump can reach off instructions away.
+func FitsOffset(off int) bool {
+	return off >= -1<<15 && off < 1<<15
+}
@@ -0,0 +1,91 @@
+package ebpf
+
+// MovImm encodes: dst = imm (sign-extended to 64 bits)
+func MovImm(dst Reg, imm int32) []byte {
+	return insn(classAlu64|aluMov|srcImm, dst, 0, 0, imm)
+}
+
+// MovReg encodes: dst = src
+func MovReg(dst, src Reg) []byte {
+	return insn(classAlu64|aluMov|srcReg, dst, src, 0, 0)
+}
+
+// AddImm encodes: dst += imm
+func AddImm(dst Reg, imm int32) []byte {
+	return insn(classAlu64|aluAdd|srcImm, dst, 0, 0, imm)
+}
+
+// AddReg encodes: dst += src
+func AddReg(dst, src Reg) []byte {
+	return insn(classAlu64|aluAdd|srcReg, dst, src, 0, 0)
+}
+
+// SubImm encodes: dst -= imm
+func SubImm(dst Reg, imm int32) []byte {
+	return insn(classAlu64|aluSub|srcImm, dst, 0, 0, imm)
+}
+
+// AndImm encodes: dst &= imm
+func AndImm(dst Reg, imm int32) []byte {
+	return insn(classAlu64|aluAnd|srcImm, dst, 0, 0, imm)
+}
+
+// XorImm encodes: dst ^= imm
+func XorImm(dst Reg, imm int32) []byte {
+	return insn(classAlu64|aluXor|srcImm, dst, 0, 0, imm)
+}
+
+// Load encodes: dst = *(size *)(src + off), zero-extended
+func Load(size Size, dst, src Reg, off int16) []byte {
+	return insn(classLdx|modeMem|uint8(size), dst, src, off, 0)
+}
+
+// Store encodes: *(size *)(dst + off) = src
+func Store(size Size, dst Reg, off int16, src Reg) []byte {
+	return insn(classStx|modeMem|uint8(size), dst, src, off, 0)
+}
+
+// StoreImm encodes: *(size *)(dst + off) = imm
+func StoreImm(size Size, dst Reg, off int16, imm int32) []byte {
+	return insn(classSt|modeMem|uint8(size), dst, 0, off, imm)
+}
+
+// JumpImm encodes: if dst <cond> imm goto pc+off
+// off counts instructions from the one after the jump.
+func JumpImm(cond Cond, dst Reg, imm int32, off int16) []byte {
+	return insn(classJmp|uint8(cond)|srcImm, dst, 0, off, imm)
+}
+
+// JumpReg encodes: if dst <cond> src goto pc+off
+func JumpReg(cond Cond, dst, src Reg, off int16) []byte {
+	return insn(classJmp|uint8(cond)|srcReg, dst, src, off, 0)
+}
+
+// Ja encodes: goto pc+off
+func Ja(off int16) []byte {
+	return insn(classJmp|jmpJa, 0, 0, off, 0)
+}
+
+// Call encodes a call to kernel helper function helper, with its
+// arguments in R1 to R5 and its result in R0. R1 to R5 are clobbered.
+func Call(helper int32) []byte {
+	return insn(classJmp|jmpCall, 0, 0, 0, helper)
+}
+
+// Exit encodes: exit, returning R0
+func Exit() []byte {
+	return insn(classJmp|jmpExit, 0, 0, 0, 0)
+}
+
+// LoadMapIdx encodes: dst = map[idx], a pointer to the map at index idx
+// of the fd_array the program is loaded with. It takes two instructions.
+func LoadMapIdx(dst Reg, idx int32) []byte {
+	return append(insn(classLd|modeImm|uint8(DW), dst, pseudoMapIdx, 0, idx), make([]byte, InsnSize)...)
+}
+
+// LoadFunc encodes: dst = the address of the function starting off
+// instructions after the load's first instruction, plus one, as for a
+// jump, for a bpf_loop callback. It takes two instructions.
+func LoadFunc(dst Reg, off int32) []byte {
+	return append(insn(classLd|modeImm|uint8(DW), dst, pseudoFunc, 0, off), make([]byte, InsnSize)...)
+}
@@ -1,4 +1,4 @@
-// Package elf provides ELF64 binary format building utilities.
+// Package elf provides ELF64 (and ELF32) binary format building utilities.
 // This package has no dependencies on the compiler internals and can be used
 // standalone for generating ELF executables.
 package elf
@@ -10,25 +10,50 @@ import (
 // ELF64 constants
 const (
 	// ELF identification
-	ELFMAG0       = 0x7f
-	ELFMAG1       = 'E'
-	ELFMAG2       = 'L'
-	ELFMAG3       = 'F'
-	ELFCLASS64    = 2
-	ELFDATA2LSB   = 1 // Little endian
-	EV_CURRENT    = 1
-	ELFOSABI_NONE = 0
+	ELFMAG0          = 0x7f
+	ELFMAG1          = 'E'
+	ELFMAG2          = 'L'
+	ELFMAG3          = 'F'
+	ELFCLASS64       = 2
+	ELFDATA2LSB      = 1 // Little endian
+	EV_CURRENT       = 1
+	ELFOSABI_NONE    = 0
+	ELFOSABI_FREEBSD = 9
 
 	// ELF types
 	ET_EXEC = 2 // Executable file
 
 	// Machine types
 	EM_X86_64 = 62
+	EM_RISCV  = 243
 
 	// Program header types
 	PT_NULL = 0
 	PT_LOAD = 1
 
+	// Section header types
+	SHT_NULL     = 0
+	SHT_PROGBITS = 1
+	SHT_SYMTAB   = 2
+	SHT_STRTAB   = 3
+	SHT_NOTE     = 7
+	SHT_NOBITS   = 8
+
+	// Section header flags
+	SHF_WRITE     = 0x1
+	SHF_ALLOC     = 0x2
+	SHF_EXECINSTR = 0x4
+	SHF_MERGE     = 0x10
+	SHF_STRINGS   = 0x20
+
+	// Symbol bindings and types
+	STB_LOCAL  = 0
+	STB_GLOBAL = 1
+	STT_NOTYPE = 0
+	STT_OBJECT = 1
+	STT_FUNC   = 2
+	SHN_ABS    = 0xfff1
+
 	// Program header flags
 	PF_X = 0x1 // Execute
 	PF_W = 0x2 // Write
@@ -37,6 +62,8 @@ const (
 	// Sizes
 	ELF64HeaderSize = 64
 	ELF64PhdrSize   = 56
+	ELF64ShdrSize   = 64
+	ELF64SymSize    = 24
 	PageSize        = 0x1000
 	DefaultCodeBase = 0x400000
 	DefaultBSSBase  = 0x600000
@@ -72,6 +99,41 @@ type Phdr64 struct {
 	Align  uint64 // Alignment
 }
 
+// Shdr64 represents an ELF64 section header.
+type Shdr64 struct {
+	Name      uint32 // Offset of the name in the section name string table
+	Type      uint32 // Section type
+	Flags     uint64 // Section flags
+	Addr      uint64 // Virtual address, 0 when not loaded
+	Off       uint64 // File offset
+	Size      uint64 // Size in file
+	Link      uint32 // Type-dependent section index
+	Info      uint32 // Type-dependent extra information
+	AddrAlign uint64 // Alignment
+	EntSize   uint64 // Entry size for tables of fixed-size entries
+}
+
+// Section is a named, non-loaded section to be added to the ELF, eg. debug
+// data for tools rather than the program.
+type Section struct {
+	Name    string
+	Data    []byte
+	Type    uint32 // SHT_PROGBITS when 0
+	Flags   uint64
+	Align   uint64 // 1 when 0
+	EntSize uint64
+}
+
+// Symbol is an entry for the symbol table, naming an address in one of the
+// loaded segments.
+type Symbol struct {
+	Name   string
+	Value  uint64 // virtual address
+	Size   uint64
+	Type   uint8 // STT_NOTYPE, STT_OBJECT or STT_FUNC
+	Global bool
+}
+
 // Segment represents a loadable segment to be added to the ELF.
 type Segment struct {
 	VAddr uint64 // Virtual address
@@ -85,11 +147,33 @@ type Segment struct {
 type Builder struct {
 	entry    uint64
 	segments []Segment
+	sections []Section
+	symbols  []Symbol
+	machine  uint16
+	osabi    uint8
+	flags    uint32
 }
 
 // NewBuilder creates a new ELF64 builder.
 func NewBuilder() *Builder {
-	return &Builder{}
+	return &Builder{machine: EM_X86_64}
+}
+
+// SetMachine sets the machine type (default EM_X86_64).
+func (b *Builder) SetMachine(machine uint16) {
+	b.machine = machine
+}
+
+// SetOSABI sets the OS ABI the kernel recognises the executable by
+// (default ELFOSABI_NONE, which Linux runs).
+func (b *Builder) SetOSABI(osabi uint8) {
+	b.osabi = osabi
+}
+
+// SetFlags sets the machine specific e_flags (default 0), eg. the EABI
+// version for EM_ARM.
+func (b *Builder) SetFlags(flags uint32) {
+	b.flags = flags
 }
 
 // SetEntry sets the entry point virtual address.
@@ -117,6 +201,66 @@ func (b *Builder) AddBSSSegment(vaddr uint64, size uint64, flags uint32) {
 	})
 }
 
+// AddSection adds a non-loaded section. With any sections or symbols the
+// binary gets a section header table and a .shstrtab naming them; without,
+// it has none.
+func (b *Builder) AddSection(name string, data []byte) {
+	b.sections = append(b.sections, Section{Name: name, Data: data})
+}
+
+// AddComment adds text to the .comment section, as the version strings
+// compilers leave there for `readelf -p .comment`. Each call adds one
+// NUL-terminated string.
+func (b *Builder) AddComment(text string) {
+	for i := range b.sections {
+		if b.sections[i].Name == ".comment" {
+			b.sections[i].Data = append(append(b.sections[i].Data, text...), 0)
+			return
+		}
+	}
+	b.sections = append(b.sections, Section{
+		Name:    ".comment",
+		Data:    append([]byte(text), 0),
+		Flags:   SHF_MERGE | SHF_STRINGS,
+		EntSize: 1,
+	})
+}
+
+// AddNote adds a note of type typ, from owner, to the named SHT_NOTE
+// section, eg. ".note.tool", as read by `readelf -n`. Notes added to the
+// same section follow each other in it.
+func (b *Builder) AddNote(section, owner string, typ uint32, desc []byte) {
+	note := appendNote(nil, owner, typ, desc)
+	for i := range b.sections {
+		if b.sections[i].Name == section && b.sections[i].Type == SHT_NOTE {
+			b.sections[i].Data = append(b.sections[i].Data, note...)
+			return
+		}
+	}
+	b.sections = append(b.sections, Section{Name: section, Data: note, Type: SHT_NOTE, Align: 4})
+}
+
+// appendNote writes a note entry: the sizes of the owner name, with its
+// NUL, and of desc, the type, then the name and desc each padded to 4
+// bytes.
+func appendNote(out []byte, owner string, typ uint32, desc []byte) []byte {
+	out = appendLE32(out, uint32(len(owner)+1))
+	out = appendLE32(out, uint32(len(desc)))
+	out = appendLE32(out, typ)
+	out = append(append(out, owner...), 0)
+	out = append(out, make([]byte, -len(out)&3)...)
+	out = append(out, desc...)
+	return append(out, make([]byte, -len(out)&3)...)
+}
+
+// AddSymbol adds a symbol. With any symbols the binary gets .symtab and
+// .strtab sections, and sections describing the loaded segments for the
+// symbols to refer to: .text for executable segments, .bss for BSS and
+// .data for the rest.
+func (b *Builder) AddSymbol(sym Symbol) {
+	b.symbols = append(b.symbols, sym)
+}
+
 // Build produces the final ELF binary.
 func (b *Builder) Build() []byte {
 	// Calculate sizes
@@ -129,7 +273,7 @@ func (b *Builder) Build() []byte {
 	// Build the binary
 	out := make([]byte, 0, codeOffset)
 
-	// Write ELF header
+	// Write ELF header, leaving the section header fields for writeSections
 	out = b.writeHeader(out, numPhdrs)
 
 	// Write program headers
@@ -169,6 +313,163 @@ func (b *Builder) Build() []byte {
 		}
 	}
 
+	if len(b.sections) > 0 || len(b.symbols) > 0 {
+		out = b.writeSections(out, codeOffset)
+	}
+
+	return out
+}
+
+// writeSections appends the sections, the section name string table and
+// the section header table after the segment data, and points the ELF
+// header at them. Section 0 is the null section, then come the segments
+// (with symbols), the added sections, the symbol tables and last the
+// section name string table.
+func (b *Builder) writeSections(out []byte, codeOffset uint64) []byte {
+	shstrtab := []byte{0}
+	nameOff := func(name string) uint32 {
+		off := uint32(len(shstrtab))
+		shstrtab = append(append(shstrtab, name...), 0)
+		return off
+	}
+
+	shdrs := []Shdr64{{Type: SHT_NULL}}
+	if len(b.symbols) > 0 {
+		fileOffset := codeOffset
+		for _, seg := range b.segments {
+			shdr := Shdr64{Type: SHT_PROGBITS, Flags: SHF_ALLOC, Addr: seg.VAddr, Size: seg.MemSz, AddrAlign: 16}
+			switch {
+			case seg.IsBSS:
+				shdr.Name = nameOff(".bss")
+				shdr.Type = SHT_NOBITS
+				shdr.Flags |= SHF_WRITE
+			case seg.Flags&PF_X != 0:
+				shdr.Name = nameOff(".text")
+				shdr.Flags |= SHF_EXECINSTR
+			default:
+				shdr.Name = nameOff(".data")
+				shdr.Flags |= SHF_WRITE
+			}
+			if !seg.IsBSS {
+				shdr.Off = fileOffset
+				fileOffset += uint64(len(seg.Data))
+			}
+			shdrs = append(shdrs, shdr)
+		}
+	}
+
+	for _, sec := range b.sections {
+		shdr := Shdr64{
+			Name:      nameOff(sec.Name),
+			Type:      sec.Type,
+			Flags:     sec.Flags,
+			AddrAlign: sec.Align,
+			EntSize:   sec.EntSize,
+		}
+		if shdr.Type == 0 {
+			shdr.Type = SHT_PROGBITS
+		}
+		if shdr.AddrAlign == 0 {
+			shdr.AddrAlign = 1
+		}
+		for uint64(len(out))%shdr.AddrAlign != 0 {
+			out = append(out, 0)
+		}
+		shdr.Off = uint64(len(out))
+		shdr.Size = uint64(len(sec.Data))
+		shdrs = append(shdrs, shdr)
+		out = append(out, sec.Data...)
+	}
+
+	if len(b.symbols) > 0 {
+		out, shdrs = b.writeSymbols(out, shdrs, nameOff)
+	}
+
+	shstr := Shdr64{Name: nameOff(".shstrtab"), Type: SHT_STRTAB, AddrAlign: 1}
+	shstr.Off = uint64(len(out))
+	shstr.Size = uint64(len(shstrtab))
+	shdrs = append(shdrs, shstr)
+	out = append(out, shstrtab...)
+
+	// Section headers are 8-byte aligned
+	for len(out)%8 != 0 {
+		out = append(out, 0)
+	}
+	shOff := uint64(len(out))
+	for i := range shdrs {
+		out = writeShdr(out, &shdrs[i])
+	}
+
+	// e_shoff at 0x28, e_shentsize, e_shnum and e_shstrndx from 0x3a
+	binary.LittleEndian.PutUint64(out[0x28:], shOff)
+	binary.LittleEndian.PutUint16(out[0x3a:], ELF64ShdrSize)
+	binary.LittleEndian.PutUint16(out[0x3c:], uint16(len(shdrs)))
+	binary.LittleEndian.PutUint16(out[0x3e:], uint16(len(shdrs)-1))
+	return out
+}
+
+// writeSymbols appends .symtab and .strtab, local symbols first as ELF
+// requires, and their section headers to shdrs. Symbols refer to the
+// segment sections, which follow the null section in segment order.
+func (b *Builder) writeSymbols(out []byte, shdrs []Shdr64, nameOff func(string) uint32) ([]byte, []Shdr64) {
+	strtab := []byte{0}
+	syms := appendSym(nil, 0, 0, 0, 0, 0) // the null symbol
+	locals := 1
+
+	for _, global := range []bool{false, true} {
+		for _, sym := range b.symbols {
+			if sym.Global != global {
+				continue
+			}
+
+			shndx := uint16(SHN_ABS)
+			for i, seg := range b.segments {
+				if sym.Value >= seg.VAddr && sym.Value < seg.VAddr+seg.MemSz {
+					shndx = uint16(1 + i)
+					break
+				}
+			}
+			info := sym.Type
+			if global {
+				info |= STB_GLOBAL << 4
+			} else {
+				locals++
+			}
+
+			syms = appendSym(syms, uint32(len(strtab)), info, shndx, sym.Value, sym.Size)
+			strtab = append(append(strtab, sym.Name...), 0)
+		}
+	}
+
+	// Symbol tables are 8-byte aligned
+	for len(out)%8 != 0 {
+		out = append(out, 0)
+	}
+	symtab := Shdr64{
+		Name:      nameOff(".symtab"),
+		Type:      SHT_SYMTAB,
+		Off:       uint64(len(out)),
+		Size:      uint64(len(syms)),
+		Link:      uint32(len(shdrs) + 1), // .strtab follows
+		Info:      uint32(locals),
+		AddrAlign: 8,
+		EntSize:   ELF64SymSize,
+	}
+	out = append(out, syms...)
+
+	str := Shdr64{Name: nameOff(".strtab"), Type: SHT_STRTAB, Off: uint64(len(out)), Size: uint64(len(strtab)), AddrAlign: 1}
+	out = append(out, strtab...)
+
+	return out, append(shdrs, symtab, str)
+}
+
+// appendSym writes a symbol table entry.
+func appendSym(out []byte, name uint32, info uint8, shndx uint16, value, size uint64) []byte {
+	out = appendLE32(out, name)
+	out = append(out, info, 0) // st_info, st_other
+	out = appendLE16(out, shndx)
+	out = appendLE64(out, value)
+	out = appendLE64(out, size)
 	return out
 }
 
@@ -187,15 +488,17 @@ func (b *Builder) Build() []byte {
 //	0x600000   BSS/tape (30KB, zero-initialized by kernel)
 //
 //	No section headers needed - just program headers for a minimal executable.
+//	Sections added with AddSection and symbol tables follow the segment data,
+//	with the section header table at the end of the file.
 func (b *Builder) writeHeader(out []byte, numPhdrs int) []byte {
 	hdr := Header64{
 		Type:      ET_EXEC,
-		Machine:   EM_X86_64,
+		Machine:   b.machine,
 		Version:   EV_CURRENT,
 		Entry:     b.entry,
 		PhOff:     ELF64HeaderSize,
 		ShOff:     0, // No section headers
-		Flags:     0,
+		Flags:     b.flags,
 		EhSize:    ELF64HeaderSize,
 		PhEntSize: ELF64PhdrSize,
 		PhNum:     uint16(numPhdrs),
@@ -212,7 +515,7 @@ func (b *Builder) writeHeader(out []byte, numPhdrs int) []byte {
 	hdr.Ident[4] = ELFCLASS64
 	hdr.Ident[5] = ELFDATA2LSB
 	hdr.Ident[6] = EV_CURRENT
-	hdr.Ident[7] = ELFOSABI_NONE
+	hdr.Ident[7] = b.osabi
 	// Ident[8..15] are padding (already zero)
 
 	// Write header bytes
@@ -247,6 +550,21 @@ func writePhdr(out []byte, phdr *Phdr64) []byte {
 	return out
 }
 
+// writeShdr writes a section header.
+func writeShdr(out []byte, shdr *Shdr64) []byte {
+	out = appendLE32(out, shdr.Name)
+	out = appendLE32(out, shdr.Type)
+	out = appendLE64(out, shdr.Flags)
+	out = appendLE64(out, shdr.Addr)
+	out = appendLE64(out, shdr.Off)
+	out = appendLE64(out, shdr.Size)
+	out = appendLE32(out, shdr.Link)
+	out = appendLE32(out, shdr.Info)
+	out = appendLE64(out, shdr.AddrAlign)
+	out = appendLE64(out, shdr.EntSize)
+	return out
+}
+
 // Little-endian append helpers
 func appendLE16(out []byte, v uint16) []byte {
 	var buf [2]byte
@@ -0,0 +1,79 @@
+package elf
+
+// ELF32 constants
+const (
+	ELFCLASS32 = 1
+	EM_386     = 3
+	EM_ARM     = 40
+
+	// ARM e_flags: the EABI version 5 Linux expects, with software floating
+	// point, so no VFP registers are needed
+	EF_ARM_EABI_VER5      = 0x05000000
+	EF_ARM_ABI_FLOAT_SOFT = 0x200
+
+	ELF32HeaderSize = 52
+	ELF32PhdrSize   = 32
+)
+
+// Build32 produces an ELF32 executable from the entry point and segments,
+// for 32-bit machines such as EM_386 and EM_ARM. Addresses and sizes must fit in 32
+// bits. It has the same layout as Build, but added sections and symbols are
+// not written: the binary has no section header table.
+func (b *Builder) Build32() []byte {
+	numPhdrs := len(b.segments)
+	headerSize := ELF32HeaderSize + numPhdrs*ELF32PhdrSize
+
+	// Align code start to page boundary
+	codeOffset := alignUp(uint64(headerSize), PageSize)
+	out := make([]byte, 0, codeOffset)
+
+	// ELF identification
+	out = append(out, ELFMAG0, ELFMAG1, ELFMAG2, ELFMAG3, ELFCLASS32, ELFDATA2LSB, EV_CURRENT, ELFOSABI_NONE)
+	out = append(out, make([]byte, 8)...)
+
+	out = appendLE16(out, ET_EXEC)
+	out = appendLE16(out, b.machine)
+	out = appendLE32(out, EV_CURRENT)
+	out = appendLE32(out, uint32(b.entry))
+	out = appendLE32(out, ELF32HeaderSize) // e_phoff
+	out = appendLE32(out, 0)               // e_shoff, no section headers
+	out = appendLE32(out, b.flags)         // e_flags
+	out = appendLE16(out, ELF32HeaderSize)
+	out = appendLE16(out, ELF32PhdrSize)
+	out = appendLE16(out, uint16(numPhdrs))
+	out = appendLE16(out, 0) // e_shentsize
+	out = appendLE16(out, 0) // e_shnum
+	out = appendLE16(out, 0) // e_shstrndx
+
+	// Program headers, whose fields are in a different order to ELF64's
+	fileOffset := codeOffset
+	for _, seg := range b.segments {
+		var off, fileSz uint64
+		if !seg.IsBSS {
+			off, fileSz = fileOffset, uint64(len(seg.Data))
+			fileOffset += fileSz
+		}
+		out = appendLE32(out, PT_LOAD)
+		out = appendLE32(out, uint32(off))
+		out = appendLE32(out, uint32(seg.VAddr)) // p_vaddr
+		out = appendLE32(out, uint32(seg.VAddr)) // p_paddr
+		out = appendLE32(out, uint32(fileSz))
+		out = appendLE32(out, uint32(seg.MemSz))
+		out = appendLE32(out, seg.Flags)
+		out = appendLE32(out, PageSize) // p_align
+	}
+
+	// Pad to code offset
+	for len(out) < int(codeOffset) {
+		out = append(out, 0)
+	}
+
+	// Write segment data
+	for _, seg := range b.segments {
+		if !seg.IsBSS {
+			out = append(out, seg.Data...)
+		}
+	}
+
+	return out
+}
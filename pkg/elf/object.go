@@ -0,0 +1,190 @@
+package elf
+
+import "encoding/binary"
+
+// ET_REL is the type of a relocatable object file, for a linker rather
+// than the loader.
+const ET_REL = 1
+
+// STT_SECTION is the type of a symbol standing for a section.
+const STT_SECTION = 3
+
+// Relocation section type and flag, and the x86_64 relocation types
+// objects use.
+const (
+	SHT_RELA       = 4
+	SHF_INFO_LINK  = 0x40
+	R_X86_64_PC32  = 2 // S + A - P
+	R_X86_64_PLT32 = 4 // L + A - P, through the PLT if the symbol needs one
+
+	ELF64RelaSize = 24
+)
+
+// Reloc is a relocation in .text: the field at Offset is set from the
+// address of the symbol named Sym, by Type, with Addend.
+type Reloc struct {
+	Offset uint64
+	Sym    string
+	Type   uint32
+	Addend int64
+}
+
+// BuildObject returns a relocatable ELF64 object file for machine, with
+// text as its .text section and syms naming offsets into it. The code must
+// need no relocations: it may only refer to itself, PC-relative. The
+// object has an empty .note.GNU-stack, so linking it keeps the stack
+// non-executable.
+//
+//	Section  Content
+//	0        null
+//	1        .text
+//	2        .note.GNU-stack
+//	3        .symtab, the .text section symbol then syms, locals first
+//	4        .strtab
+//	5        .shstrtab
+func BuildObject(machine uint16, text []byte, syms []Symbol) []byte {
+	return BuildObjectRelocs(machine, text, syms, nil)
+}
+
+// BuildObjectRelocs is BuildObject for code that refers to other objects'
+// symbols, through relocs. A symbol they name that is not in syms is
+// added to the symbol table as an undefined global, for the linker to
+// find elsewhere, and the relocations go in a .rela.text section after
+// .text, moving the later sections along one.
+func BuildObjectRelocs(machine uint16, text []byte, syms []Symbol, relocs []Reloc) []byte {
+	shstrtab := []byte{0}
+	nameOff := func(name string) uint32 {
+		off := uint32(len(shstrtab))
+		shstrtab = append(append(shstrtab, name...), 0)
+		return off
+	}
+
+	out := make([]byte, ELF64HeaderSize, ELF64HeaderSize+len(text))
+	shdrs := []Shdr64{{Type: SHT_NULL}}
+
+	// .text, 16-byte aligned, straight after the header
+	shdrs = append(shdrs, Shdr64{
+		Name:      nameOff(".text"),
+		Type:      SHT_PROGBITS,
+		Flags:     SHF_ALLOC | SHF_EXECINSTR,
+		Off:       uint64(len(out)),
+		Size:      uint64(len(text)),
+		AddrAlign: 16,
+	})
+	out = append(out, text...)
+
+	// .rela.text, written once the symbol table has numbered the symbols
+	rela := -1
+	if len(relocs) > 0 {
+		rela = len(shdrs)
+		shdrs = append(shdrs, Shdr64{
+			Name:      nameOff(".rela.text"),
+			Type:      SHT_RELA,
+			Flags:     SHF_INFO_LINK,
+			Info:      1, // .text
+			AddrAlign: 8,
+			EntSize:   ELF64RelaSize,
+		})
+	}
+
+	shdrs = append(shdrs, Shdr64{
+		Name:      nameOff(".note.GNU-stack"),
+		Type:      SHT_PROGBITS,
+		Off:       uint64(len(out)),
+		AddrAlign: 1,
+	})
+
+	// The symbols relocs name that syms does not define
+	defined := make(map[string]bool)
+	for _, sym := range syms {
+		defined[sym.Name] = true
+	}
+	var undefined []string
+	for _, r := range relocs {
+		if !defined[r.Sym] {
+			defined[r.Sym] = true
+			undefined = append(undefined, r.Sym)
+		}
+	}
+
+	strtab := []byte{0}
+	symtab := appendSym(nil, 0, 0, 0, 0, 0)             // the null symbol
+	symtab = appendSym(symtab, 0, STT_SECTION, 1, 0, 0) // .text
+	index := make(map[string]uint32)
+	locals := 2
+	for _, global := range []bool{false, true} {
+		for _, sym := range syms {
+			if sym.Global != global {
+				continue
+			}
+			info := sym.Type
+			if global {
+				info |= STB_GLOBAL << 4
+			} else {
+				locals++
+			}
+			index[sym.Name] = uint32(len(symtab) / ELF64SymSize)
+			symtab = appendSym(symtab, uint32(len(strtab)), info, 1, sym.Value, sym.Size)
+			strtab = append(append(strtab, sym.Name...), 0)
+		}
+	}
+	for _, name := range undefined {
+		index[name] = uint32(len(symtab) / ELF64SymSize)
+		symtab = appendSym(symtab, uint32(len(strtab)), STB_GLOBAL<<4, 0, 0, 0)
+		strtab = append(append(strtab, name...), 0)
+	}
+	symtabIndex := len(shdrs)
+	for len(out)%8 != 0 {
+		out = append(out, 0)
+	}
+	if rela >= 0 {
+		shdrs[rela].Off = uint64(len(out))
+		shdrs[rela].Size = uint64(len(relocs) * ELF64RelaSize)
+		shdrs[rela].Link = uint32(symtabIndex)
+		for _, r := range relocs {
+			out = appendLE64(out, r.Offset)
+			out = appendLE64(out, uint64(index[r.Sym])<<32|uint64(r.Type))
+			out = appendLE64(out, uint64(r.Addend))
+		}
+	}
+	shdrs = append(shdrs, Shdr64{
+		Name:      nameOff(".symtab"),
+		Type:      SHT_SYMTAB,
+		Off:       uint64(len(out)),
+		Size:      uint64(len(symtab)),
+		Link:      uint32(symtabIndex + 1), // .strtab
+		Info:      uint32(locals),
+		AddrAlign: 8,
+		EntSize:   ELF64SymSize,
+	})
+	out = append(out, symtab...)
+
+	shdrs = append(shdrs, Shdr64{Name: nameOff(".strtab"), Type: SHT_STRTAB, Off: uint64(len(out)), Size: uint64(len(strtab)), AddrAlign: 1})
+	out = append(out, strtab...)
+
+	shstr := Shdr64{Name: nameOff(".shstrtab"), Type: SHT_STRTAB, AddrAlign: 1}
+	shstr.Off = uint64(len(out))
+	shstr.Size = uint64(len(shstrtab))
+	shdrs = append(shdrs, shstr)
+	out = append(out, shstrtab...)
+
+	for len(out)%8 != 0 {
+		out = append(out, 0)
+	}
+	shOff := uint64(len(out))
+	for i := range shdrs {
+		out = writeShdr(out, &shdrs[i])
+	}
+
+	// The executable header, less its program headers, then e_type and
+	// the section header fields from 0x28 as writeSections sets them
+	copy(out, (&Builder{machine: machine}).writeHeader(nil, 0))
+	binary.LittleEndian.PutUint16(out[0x10:], ET_REL)
+	binary.LittleEndian.PutUint64(out[0x20:], 0) // e_phoff
+	binary.LittleEndian.PutUint64(out[0x28:], shOff)
+	binary.LittleEndian.PutUint16(out[0x36:], 0) // e_phentsize
+	binary.LittleEndian.PutUint16(out[0x3a:], ELF64ShdrSize)
+	binary.LittleEndian.PutUint16(out[0x3c:], uint16(len(shdrs)))
+	binary.LittleEndian.PutUint16(out[0x3e:], uint16(len(shdrs)-1))
+	return out
+}
@@ -0,0 +1,44 @@
+// Package i386 provides 32-bit x86 (IA-32) machine code encoding utilities.
+// This package has no dependencies on compiler internals and can be used
+// standalone for generating i386 machine code.
+//
+// The encoders cover what a Brainfuck program needs with the data pointer
+// held in EBP, addressing cells as disp(%ebp). EBP is left alone by int
+// 0x80 syscalls and the string instructions, which use EBX, ECX, EDX, ESI
+// and EDI.
+package i386
+
+import "encoding/binary"
+
+// Reg is a general purpose register number, as encoded in ModRM. Used as
+// byte operands the first four name the low byte (%al, %cl, %dl, %bl).
+type Reg uint8
+
+// General purpose registers.
+const (
+	EAX Reg = iota
+	ECX
+	EDX
+	EBX
+	ESP
+	EBP
+	ESI
+	EDI
+)
+
+// withImm32 returns op followed by a little-endian 32-bit immediate.
+func withImm32(op []byte, imm32 uint32) []byte {
+	return binary.LittleEndian.AppendUint32(op, imm32)
+}
+
+// cellOperand encodes the ModRM and displacement for disp(%ebp) with reg in
+// the ModRM.reg field. EBP as a base always needs a displacement, so disp8
+// is used when it fits and disp32 otherwise.
+func cellOperand(reg byte, disp int32) []byte {
+	if disp >= -128 && disp <= 127 {
+		// ModRM: 01 (disp8) reg 101 (ebp)
+		return []byte{0x45 | (reg&7)<<3, byte(int8(disp))}
+	}
+	// ModRM: 10 (disp32) reg 101 (ebp)
+	return withImm32([]byte{0x85 | (reg&7)<<3}, uint32(disp))
+}
@@ -0,0 +1,276 @@
+package i386
+
+// This file contains i386 instruction encoders, named after the AT&T
+// mnemonic and operands. Each function returns the machine code bytes for
+// a specific instruction.
+//
+// The encodings are the x86_64 ones without REX prefixes, see:
+// https://wiki.osdev.org/X86-64_Instruction_Encoding
+
+// MovlImm32 encodes: movl $imm32, %dst (B8+r <imm32>)
+func MovlImm32(dst Reg, imm32 int32) []byte {
+	return withImm32([]byte{0xB8 + byte(dst)}, uint32(imm32))
+}
+
+// MovlReg encodes: movl %src, %dst (89 /r)
+func MovlReg(src, dst Reg) []byte {
+	// ModRM: 11 (reg-reg) src dst
+	return []byte{0x89, 0xC0 | byte(src)<<3 | byte(dst)}
+}
+
+// XorlReg encodes: xorl %r, %r (31 /r)
+// Zeros a register.
+func XorlReg(r Reg) []byte {
+	return []byte{0x31, 0xC0 | byte(r)<<3 | byte(r)}
+}
+
+// TestlReg encodes: testl %r, %r (85 /r)
+func TestlReg(r Reg) []byte {
+	return []byte{0x85, 0xC0 | byte(r)<<3 | byte(r)}
+}
+
+// AddlImm32EBP encodes: addl $imm32, %ebp (81 C5 <imm32>)
+// Moves the data pointer right.
+func AddlImm32EBP(imm32 int32) []byte {
+	// 81 /0 id, ModRM: 11 000 101 = C5
+	return withImm32([]byte{0x81, 0xC5}, uint32(imm32))
+}
+
+// SublImm32EBP encodes: subl $imm32, %ebp (81 ED <imm32>)
+// Moves the data pointer left.
+func SublImm32EBP(imm32 int32) []byte {
+	// 81 /5 id, ModRM: 11 101 101 = ED
+	return withImm32([]byte{0x81, 0xED}, uint32(imm32))
+}
+
+// LealCell encodes: leal disp(%ebp), %dst (8D /r)
+// Loads the address of a cell, eg. into ECX for a syscall or EDI/ESI ahead
+// of a string op.
+func LealCell(dst Reg, disp int32) []byte {
+	return append([]byte{0x8D}, cellOperand(byte(dst), disp)...)
+}
+
+// AddbImm8Mem encodes: addb $imm8, 0(%ebp) (80 /0 ib)
+func AddbImm8Mem(imm8 uint8) []byte {
+	return append(append([]byte{0x80}, cellOperand(0, 0)...), imm8)
+}
+
+// SubbImm8Mem encodes: subb $imm8, 0(%ebp) (80 /5 ib)
+func SubbImm8Mem(imm8 uint8) []byte {
+	return append(append([]byte{0x80}, cellOperand(5, 0)...), imm8)
+}
+
+// MovbImm8Mem encodes: movb $imm8, 0(%ebp) (C6 /0 ib)
+func MovbImm8Mem(imm8 uint8) []byte {
+	return append(append([]byte{0xC6}, cellOperand(0, 0)...), imm8)
+}
+
+// TestbMem encodes: testb $0xff, 0(%ebp) (F6 /0 ib)
+// Sets ZF when the current cell is zero.
+func TestbMem() []byte {
+	return append(append([]byte{0xF6}, cellOperand(0, 0)...), 0xFF)
+}
+
+// JmpRel32 encodes: jmp rel32 (E9 <rel32>)
+func JmpRel32(rel32 int32) []byte {
+	return withImm32([]byte{0xE9}, uint32(rel32))
+}
+
+// CallRel32 encodes: call rel32 (E8 <rel32>)
+func CallRel32(rel32 int32) []byte {
+	return withImm32([]byte{0xE8}, uint32(rel32))
+}
+
+// jcc encodes a conditional jump with a 32-bit displacement (0F 80+cc).
+func jcc(cc byte, rel32 int32) []byte {
+	return withImm32([]byte{0x0F, 0x80 + cc}, uint32(rel32))
+}
+
+// JoRel32 encodes: jo rel32 (0F 80 <rel32>)
+func JoRel32(rel32 int32) []byte { return jcc(0x0, rel32) }
+
+// JnoRel32 encodes: jno rel32 (0F 81 <rel32>)
+func JnoRel32(rel32 int32) []byte { return jcc(0x1, rel32) }
+
+// JcRel32 encodes: jc rel32 (0F 82 <rel32>)
+func JcRel32(rel32 int32) []byte { return jcc(0x2, rel32) }
+
+// JncRel32 encodes: jnc rel32 (0F 83 <rel32>)
+func JncRel32(rel32 int32) []byte { return jcc(0x3, rel32) }
+
+// JzRel32 encodes: jz rel32 (0F 84 <rel32>)
+func JzRel32(rel32 int32) []byte { return jcc(0x4, rel32) }
+
+// JnzRel32 encodes: jnz rel32 (0F 85 <rel32>)
+func JnzRel32(rel32 int32) []byte { return jcc(0x5, rel32) }
+
+// Ret encodes: ret (C3)
+func Ret() []byte {
+	return []byte{0xC3}
+}
+
+// Int80 encodes: int $0x80 (CD 80)
+// The Linux i386 syscall: number in EAX, arguments in EBX, ECX, EDX, the
+// result in EAX. Every other register is preserved.
+func Int80() []byte {
+	return []byte{0xCD, 0x80}
+}
+
+// Int3 encodes: int3 (CC)
+// Breakpoint trap, raises SIGTRAP.
+func Int3() []byte {
+	return []byte{0xCC}
+}
+
+// Nop encodes: nop (90)
+func Nop() []byte {
+	return []byte{0x90}
+}
+
+// RepStosb encodes: rep stosb (F3 AA)
+// Store AL into ECX bytes starting at (%edi).
+func RepStosb() []byte {
+	return []byte{0xF3, 0xAA}
+}
+
+// RepMovsb encodes: rep movsb (F3 A4)
+// Copy ECX bytes from (%esi) to (%edi).
+func RepMovsb() []byte {
+	return []byte{0xF3, 0xA4}
+}
+
+// RepStosl encodes: rep stosl (F3 AB)
+// Store EAX into ECX doublewords starting at (%edi).
+func RepStosl() []byte {
+	return []byte{0xF3, 0xAB}
+}
+
+// RepMovsl encodes: rep movsl (F3 A5)
+// Copy ECX doublewords from (%esi) to (%edi).
+func RepMovsl() []byte {
+	return []byte{0xF3, 0xA5}
+}
+
+// The rest are for bare-metal code, running in ring 0 with no OS: port
+// I/O, interrupts and absolute addresses.
+
+// AddlImm32 encodes: addl $imm32, %dst (81 /0 <imm32>)
+func AddlImm32(dst Reg, imm32 int32) []byte {
+	return withImm32([]byte{0x81, 0xC0 | byte(dst)}, uint32(imm32))
+}
+
+// SublReg encodes: subl %src, %dst (29 /r)
+func SublReg(src, dst Reg) []byte {
+	return []byte{0x29, 0xC0 | byte(src)<<3 | byte(dst)}
+}
+
+// OrlImm32 encodes: orl $imm32, %dst (81 /1 <imm32>)
+func OrlImm32(dst Reg, imm32 int32) []byte {
+	return withImm32([]byte{0x81, 0xC8 | byte(dst)}, uint32(imm32))
+}
+
+// CmplImm32 encodes: cmpl $imm32, %r (81 /7 <imm32>)
+func CmplImm32(r Reg, imm32 int32) []byte {
+	return withImm32([]byte{0x81, 0xF8 | byte(r)}, uint32(imm32))
+}
+
+// IncReg encodes: incl %r (40+r)
+func IncReg(r Reg) []byte {
+	return []byte{0x40 | byte(r)}
+}
+
+// Divl encodes: divl %r (F7 /6)
+// Divides EDX:EAX by r, leaving the quotient in EAX and remainder in EDX.
+func Divl(r Reg) []byte {
+	return []byte{0xF7, 0xF0 | byte(r)}
+}
+
+// Movzbl encodes: movzbl %src, %dst (0F B6 /r), src a byte register.
+func Movzbl(src, dst Reg) []byte {
+	return []byte{0x0F, 0xB6, 0xC0 | byte(dst)<<3 | byte(src)}
+}
+
+// MovbImm8Reg encodes: movb $imm8, %dst (B0+r ib), dst a byte register.
+func MovbImm8Reg(dst Reg, imm8 uint8) []byte {
+	return []byte{0xB0 | byte(dst), imm8}
+}
+
+// MovbCell encodes: movb 0(%ebp), %dst (8A /r), dst a byte register.
+func MovbCell(dst Reg) []byte {
+	return append([]byte{0x8A}, cellOperand(byte(dst), 0)...)
+}
+
+// MovbRegCell encodes: movb %src, 0(%ebp) (88 /r), src a byte register.
+func MovbRegCell(src Reg) []byte {
+	return append([]byte{0x88}, cellOperand(byte(src), 0)...)
+}
+
+// MovbIndexed encodes: movb disp32(%index), %dst (8A /r <disp32>), dst a
+// byte register. Used to look a byte up in a table at an absolute address.
+func MovbIndexed(dst, index Reg, disp32 uint32) []byte {
+	return withImm32([]byte{0x8A, 0x80 | byte(dst)<<3 | byte(index)}, disp32)
+}
+
+// MovwScaled encodes: movw %src, disp32(,%index,2) (66 89 /r <SIB> <disp32>)
+// Stores a word to an array of words at an absolute address, such as
+// the VGA text buffer.
+func MovwScaled(src, index Reg, disp32 uint32) []byte {
+	// ModRM: 00 src 100 (SIB), SIB: 01 (x2) index 101 (disp32, no base)
+	return withImm32([]byte{0x66, 0x89, 0x04 | byte(src)<<3, 0x45 | byte(index)<<3}, disp32)
+}
+
+// MovbImm8Abs encodes: movb $imm8, addr32 (C6 05 <addr32> ib)
+func MovbImm8Abs(addr uint32, imm8 uint8) []byte {
+	return append(withImm32([]byte{0xC6, 0x05}, addr), imm8)
+}
+
+// CmpbImm8Abs encodes: cmpb $imm8, addr32 (80 3D <addr32> ib)
+func CmpbImm8Abs(addr uint32, imm8 uint8) []byte {
+	return append(withImm32([]byte{0x80, 0x3D}, addr), imm8)
+}
+
+// CmpbImm8AL encodes: cmpb $imm8, %al (3C ib)
+func CmpbImm8AL(imm8 uint8) []byte {
+	return []byte{0x3C, imm8}
+}
+
+// TestbImm8 encodes: testb $imm8, %r (F6 /0 ib), r a byte register.
+func TestbImm8(r Reg, imm8 uint8) []byte {
+	return []byte{0xF6, 0xC0 | byte(r), imm8}
+}
+
+// InbDX encodes: inb %dx, %al (EC)
+func InbDX() []byte {
+	return []byte{0xEC}
+}
+
+// OutbDX encodes: outb %al, %dx (EE)
+func OutbDX() []byte {
+	return []byte{0xEE}
+}
+
+// InbImm8 encodes: inb $port, %al (E4 ib)
+func InbImm8(port uint8) []byte {
+	return []byte{0xE4, port}
+}
+
+// OutbImm8 encodes: outb %al, $port (E6 ib)
+func OutbImm8(port uint8) []byte {
+	return []byte{0xE6, port}
+}
+
+// Cli encodes: cli (FA)
+func Cli() []byte {
+	return []byte{0xFA}
+}
+
+// Cld encodes: cld (FC)
+func Cld() []byte {
+	return []byte{0xFC}
+}
+
+// Hlt encodes: hlt (F4)
+// Halts the CPU until the next interrupt, or for good after cli.
+func Hlt() []byte {
+	return []byte{0xF4}
+}
@@ -0,0 +1,56 @@
+// Package ihex provides Intel HEX encoding, the text format device
+// programmers such as avrdude flash microcontrollers from. This package
+// has no dependencies on the compiler internals and can be used
+// standalone for writing Intel HEX files.
+//
+// A file is a series of records, one per line, each a colon followed by
+// hex digits: the data length, a 16-bit address, the record type, the
+// data, and a checksum making the bytes of the record sum to zero.
+// Addresses past 64KB are reached through extended linear address
+// records, setting the upper 16 bits.
+package ihex
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Record types.
+const (
+	recData        = 0x00
+	recEOF         = 0x01
+	recLinearAddr  = 0x04 // the upper 16 bits of the following addresses
+	bytesPerRecord = 16
+)
+
+// Encode returns data as an Intel HEX file to load at address base, with
+// 16 bytes of data to a record.
+func Encode(data []byte, base uint32) []byte {
+	var b strings.Builder
+	upper := uint32(0)
+	for off := 0; off < len(data); off += bytesPerRecord {
+		addr := base + uint32(off)
+		if addr>>16 != upper {
+			upper = addr >> 16
+			record(&b, recLinearAddr, 0, binary.BigEndian.AppendUint16(nil, uint16(upper)))
+		}
+		// A record must not cross a 64KB boundary
+		n := min(bytesPerRecord, len(data)-off, int(0x10000-addr&0xFFFF))
+		record(&b, recData, uint16(addr), data[off:off+n])
+		off -= bytesPerRecord - n
+	}
+	record(&b, recEOF, 0, nil)
+	return []byte(b.String())
+}
+
+// record writes one record and its line ending.
+func record(b *strings.Builder, typ byte, addr uint16, data []byte) {
+	sum := byte(len(data)) + byte(addr>>8) + byte(addr) + typ
+	fmt.Fprintf(b, ":%02X%04X%02X", len(data), addr, typ)
+	for _, d := range data {
+		fmt.Fprintf(b, "%02X", d)
+		sum += d
+	}
+	fmt.Fprintf(b, "%02X\n", -sum)
+}
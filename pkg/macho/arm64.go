@@ -0,0 +1,224 @@
+package macho
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// Mach-O constants for dyld-loaded executables
+const (
+	CPU_TYPE_ARM64        = 0x0100000c
+	CPU_SUBTYPE_ARM64_ALL = 0
+	MH_DYLDLINK           = 0x4
+	MH_TWOLEVEL           = 0x80
+	MH_PIE                = 0x200000
+
+	LC_SYMTAB              = 0x2
+	LC_DYSYMTAB            = 0xb
+	LC_LOAD_DYLIB          = 0xc
+	LC_LOAD_DYLINKER       = 0xe
+	LC_UUID                = 0x1b
+	LC_CODE_SIGNATURE      = 0x1d
+	LC_BUILD_VERSION       = 0x32
+	LC_MAIN                = 0x80000028
+	LC_DYLD_CHAINED_FIXUPS = 0x80000034
+
+	PLATFORM_MACOS          = 1
+	DYLD_CHAINED_IMPORT     = 1
+	MinMacOSVersion         = 0x000b0000 // 11.0, the first for Apple silicon
+	SymtabCommandSize       = 24
+	DysymtabCommandSize     = 80
+	LinkeditDataCommandSize = 16
+	BuildVersionCommandSize = 24
+	EntryPointCommandSize   = 24
+	UUIDCommandSize         = 24
+)
+
+// Dyld is the dynamic linker arm64 executables are started by, and
+// LibSystem the library they must link, though they call nothing in it.
+const (
+	Dyld      = "/usr/lib/dyld"
+	LibSystem = "/usr/lib/libSystem.B.dylib"
+)
+
+// NewARM64Builder creates a Mach-O builder for an arm64 executable, which
+// Apple silicon only runs when it is position independent, started by dyld
+// and code signed. The executable links libSystem, as dyld requires, and
+// starts at a main function named by LC_MAIN; the code still makes system
+// calls directly. The tape and anything else it addresses must be reached
+// pc-relative, as the whole image slides. Segments are aligned to
+// ARM64PageSize.
+//
+// Build signs the executable ad-hoc, as the linker does: the signature
+// only hashes the file, so the kernel can check each page as it is mapped.
+// Changing the file afterwards, eg. with strip, invalidates it; codesign
+// -s - re-signs it.
+func NewARM64Builder() *Builder {
+	return &Builder{arm64: true, pageSize: ARM64PageSize}
+}
+
+// buildARM64 produces an arm64 executable: the header and load commands in
+// the first page, the code, then __LINKEDIT with the empty fixup and
+// symbol tables dyld expects and the code signature.
+func (b *Builder) buildARM64() []byte {
+	segments := []Segment{*b.text}
+	segments = append(segments, b.segments...)
+
+	textFileSize := alignUp(b.pageSize+uint64(len(b.text.Data)), b.pageSize)
+	var linkeditVAddr uint64
+	for _, seg := range segments {
+		linkeditVAddr = max(linkeditVAddr, seg.VAddr+seg.VMSize)
+	}
+
+	// __LINKEDIT: chained fixups with none in any segment, a string table
+	// with no symbols, then the signature covering everything before it
+	nsegs := 1 + len(segments) + 1 // __PAGEZERO, the segments, __LINKEDIT
+	fixups := chainedFixups(nsegs)
+	fixupsOff := textFileSize
+	strOff := fixupsOff + uint64(len(fixups))
+	strtab := []byte{' ', 0, 0, 0, 0, 0, 0, 0}
+	sigOff := alignUp(strOff+uint64(len(strtab)), 16)
+	sigSize := signatureSize(int(sigOff), signingIdentifier)
+	linkeditSize := sigOff + uint64(sigSize) - textFileSize
+
+	var cmds []byte
+	ncmds := 0
+	cmd := func(c []byte) {
+		cmds = append(cmds, c...)
+		ncmds++
+	}
+
+	// __PAGEZERO: no access below __TEXT, so null pointers fault
+	cmd(writeSegment(nil, "__PAGEZERO", 0, b.text.VAddr, 0, 0, VM_PROT_NONE, 0))
+
+	for _, seg := range segments {
+		var fileSize uint64
+		if !seg.ZeroFill {
+			fileSize = textFileSize
+		}
+		c := writeSegment(nil, seg.Name, seg.VAddr, seg.VMSize, 0, fileSize, seg.Prot, 1)
+
+		sect := Section64{Addr: seg.VAddr, Size: seg.VMSize, Align: 2}
+		copy(sect.SectName[:], seg.Section)
+		copy(sect.SegName[:], seg.Name)
+		if seg.ZeroFill {
+			sect.Flags = S_ZEROFILL
+		} else {
+			sect.Addr += b.pageSize
+			sect.Size = uint64(len(seg.Data))
+			sect.Offset = uint32(b.pageSize)
+			sect.Flags = S_ATTR_PURE_INSTRUCTIONS | S_ATTR_SOME_INSTRUCTIONS
+		}
+		cmd(writeSection(c, &sect))
+	}
+
+	cmd(writeSegment(nil, "__LINKEDIT", linkeditVAddr, alignUp(linkeditSize, b.pageSize),
+		textFileSize, linkeditSize, VM_PROT_READ, 0))
+
+	cmd(linkeditData(LC_DYLD_CHAINED_FIXUPS, fixupsOff, len(fixups)))
+
+	// LC_SYMTAB and LC_DYSYMTAB: no symbols
+	c := le32(nil, LC_SYMTAB)
+	c = le32(c, SymtabCommandSize)
+	c = le32(c, uint32(strOff)) // symoff
+	c = le32(c, 0)              // nsyms
+	c = le32(c, uint32(strOff))
+	cmd(le32(c, uint32(len(strtab))))
+	c = le32(nil, LC_DYSYMTAB)
+	c = le32(c, DysymtabCommandSize)
+	cmd(append(c, make([]byte, DysymtabCommandSize-8)...))
+
+	cmd(pathCommand(LC_LOAD_DYLINKER, 12, Dyld))
+
+	// LC_UUID: a hash of the code, so identical builds match
+	sum := sha256.Sum256(b.text.Data)
+	sum[6] = sum[6]&0x0f | 0x50 // version 5, name based (SHA)
+	sum[8] = sum[8]&0x3f | 0x80
+	c = le32(nil, LC_UUID)
+	c = le32(c, UUIDCommandSize)
+	cmd(append(c, sum[:16]...))
+
+	c = le32(nil, LC_BUILD_VERSION)
+	c = le32(c, BuildVersionCommandSize)
+	c = le32(c, PLATFORM_MACOS)
+	c = le32(c, MinMacOSVersion) // minos
+	c = le32(c, MinMacOSVersion) // sdk
+	cmd(le32(c, 0))              // ntools
+
+	// LC_MAIN: the entry point as a file offset, with the default stack
+	c = le32(nil, LC_MAIN)
+	c = le32(c, EntryPointCommandSize)
+	c = binary.LittleEndian.AppendUint64(c, b.entry-b.text.VAddr)
+	cmd(binary.LittleEndian.AppendUint64(c, 0))
+
+	// LC_LOAD_DYLIB: timestamp, then current and compatibility version 1.0
+	dylib := pathCommand(LC_LOAD_DYLIB, 24, LibSystem)
+	binary.LittleEndian.PutUint32(dylib[12:], 2)
+	binary.LittleEndian.PutUint32(dylib[16:], 0x10000)
+	binary.LittleEndian.PutUint32(dylib[20:], 0x10000)
+	cmd(dylib)
+
+	cmd(linkeditData(LC_CODE_SIGNATURE, sigOff, sigSize))
+
+	out := make([]byte, 0, sigOff+uint64(sigSize))
+	out = le32(out, MH_MAGIC_64)
+	out = le32(out, CPU_TYPE_ARM64)
+	out = le32(out, CPU_SUBTYPE_ARM64_ALL)
+	out = le32(out, MH_EXECUTE)
+	out = le32(out, uint32(ncmds))
+	out = le32(out, uint32(len(cmds)))
+	out = le32(out, MH_NOUNDEFS|MH_DYLDLINK|MH_TWOLEVEL|MH_PIE)
+	out = le32(out, 0) // reserved
+	out = append(out, cmds...)
+
+	// Pad to the code, then to __LINKEDIT
+	out = append(out, make([]byte, int(b.pageSize)-len(out))...)
+	out = append(out, b.text.Data...)
+	out = append(out, make([]byte, int(textFileSize)-len(out))...)
+	out = append(out, fixups...)
+	out = append(out, strtab...)
+	out = append(out, make([]byte, int(sigOff)-len(out))...)
+
+	return append(out, adhocSignature(out, signingIdentifier, textFileSize)...)
+}
+
+// chainedFixups returns an LC_DYLD_CHAINED_FIXUPS payload with no fixups
+// or imports: the header, then a dyld_chained_starts_in_image with no
+// starts for each of nsegs segments.
+func chainedFixups(nsegs int) []byte {
+	const startsOff = 0x20
+	importsOff := uint32(startsOff + 4 + 4*nsegs)
+
+	out := le32(nil, 0) // fixups_version
+	out = le32(out, startsOff)
+	out = le32(out, importsOff)
+	out = le32(out, importsOff) // symbols_offset
+	out = le32(out, 0)          // imports_count
+	out = le32(out, DYLD_CHAINED_IMPORT)
+	out = le32(out, 0) // symbols_format, uncompressed
+	out = append(out, make([]byte, startsOff-len(out))...)
+	out = le32(out, uint32(nsegs))
+	out = append(out, make([]byte, 4*nsegs)...)
+	return append(out, make([]byte, int(alignUp(uint64(len(out)), 8))-len(out))...)
+}
+
+// linkeditData returns a linkedit_data_command locating size bytes at off.
+func linkeditData(cmd uint32, off uint64, size int) []byte {
+	out := le32(nil, cmd)
+	out = le32(out, LinkeditDataCommandSize)
+	out = le32(out, uint32(off))
+	return le32(out, uint32(size))
+}
+
+// pathCommand returns a load command of fixed size pathOff followed by
+// path, which the word after cmdsize points to, padded to 8 bytes. The
+// fields between are left zero.
+func pathCommand(cmd uint32, pathOff int, path string) []byte {
+	size := alignUp(uint64(pathOff+len(path)+1), 8)
+	out := le32(nil, cmd)
+	out = le32(out, uint32(size))
+	out = le32(out, uint32(pathOff))
+	out = append(out, make([]byte, pathOff-12)...)
+	out = append(out, path...)
+	return append(out, make([]byte, int(size)-len(out))...)
+}
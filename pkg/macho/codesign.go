@@ -0,0 +1,80 @@
+package macho
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// Code signature constants, from the kernel's cs_blobs.h. Unlike the rest
+// of the file the signature is big-endian.
+const (
+	CSMAGIC_EMBEDDED_SIGNATURE = 0xfade0cc0
+	CSMAGIC_CODEDIRECTORY      = 0xfade0c02
+	CSSLOT_CODEDIRECTORY       = 0
+	CS_ADHOC                   = 0x2
+	CS_LINKER_SIGNED           = 0x20000
+	CS_HASHTYPE_SHA256         = 2
+	CS_EXECSEG_MAIN_BINARY     = 0x1
+	CodeDirectoryVersion       = 0x20400 // with the executable segment fields
+	CodeDirectorySize          = 88
+	SigningPageShift           = 12 // pages are hashed 4 KiB at a time
+	superBlobSize              = 12 + 8
+)
+
+// signingIdentifier names the code in its signature. The linker uses the
+// output file name; the kernel does not check it for ad-hoc signatures.
+const signingIdentifier = "a.out"
+
+// signatureSize returns the size of the ad-hoc signature of the first
+// codeLimit bytes of a file.
+func signatureSize(codeLimit int, ident string) int {
+	nslots := (codeLimit + 1<<SigningPageShift - 1) >> SigningPageShift
+	return superBlobSize + CodeDirectorySize + len(ident) + 1 + nslots*sha256.Size
+}
+
+// adhocSignature returns the ad-hoc signature of file: a SuperBlob holding
+// just a CodeDirectory, with the SHA-256 of each page of file. The first
+// textSize bytes are the executable __TEXT segment.
+func adhocSignature(file []byte, ident string, textSize uint64) []byte {
+	size := signatureSize(len(file), ident)
+	nslots := (len(file) + 1<<SigningPageShift - 1) >> SigningPageShift
+	be32 := binary.BigEndian.AppendUint32
+	be64 := binary.BigEndian.AppendUint64
+
+	// SuperBlob, indexing the one blob
+	out := make([]byte, 0, size)
+	out = be32(out, CSMAGIC_EMBEDDED_SIGNATURE)
+	out = be32(out, uint32(size))
+	out = be32(out, 1) // count
+	out = be32(out, CSSLOT_CODEDIRECTORY)
+	out = be32(out, superBlobSize)
+
+	// CodeDirectory
+	out = be32(out, CSMAGIC_CODEDIRECTORY)
+	out = be32(out, uint32(size-superBlobSize))
+	out = be32(out, CodeDirectoryVersion)
+	out = be32(out, CS_ADHOC|CS_LINKER_SIGNED)
+	out = be32(out, uint32(CodeDirectorySize+len(ident)+1)) // hashOffset
+	out = be32(out, CodeDirectorySize)                      // identOffset
+	out = be32(out, 0)                                      // nSpecialSlots
+	out = be32(out, uint32(nslots))
+	out = be32(out, uint32(len(file))) // codeLimit
+	out = append(out, sha256.Size, CS_HASHTYPE_SHA256, 0, SigningPageShift)
+	out = be32(out, 0) // spare2
+	out = be32(out, 0) // scatterOffset
+	out = be32(out, 0) // teamOffset
+	out = be32(out, 0) // spare3
+	out = be64(out, 0) // codeLimit64
+	out = be64(out, 0) // execSegBase
+	out = be64(out, textSize)
+	out = be64(out, CS_EXECSEG_MAIN_BINARY)
+	out = append(out, ident...)
+	out = append(out, 0)
+
+	for off := 0; off < len(file); off += 1 << SigningPageShift {
+		page := file[off:min(off+1<<SigningPageShift, len(file))]
+		sum := sha256.Sum256(page)
+		out = append(out, sum[:]...)
+	}
+	return out
+}
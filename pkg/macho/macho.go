@@ -0,0 +1,236 @@
+// Package macho provides Mach-O 64 binary building utilities, for x86_64
+// and arm64 macOS executables. Like package elf it has no dependencies on
+// the compiler internals and can be used standalone.
+//
+// x86_64 executables are static: they start through LC_UNIXTHREAD rather
+// than dyld and LC_MAIN, so they make system calls directly and link
+// nothing. Apple silicon runs no static executables and no unsigned code,
+// so arm64 ones are dyld-loaded position independent executables with an
+// ad-hoc code signature; see NewARM64Builder.
+package macho
+
+import (
+	"encoding/binary"
+)
+
+// Mach-O constants
+const (
+	// Header
+	MH_MAGIC_64         = 0xfeedfacf
+	CPU_TYPE_X86_64     = 0x01000007
+	CPU_SUBTYPE_X86_ALL = 3
+	MH_EXECUTE          = 2
+	MH_NOUNDEFS         = 0x1
+
+	// Load commands
+	LC_UNIXTHREAD = 0x5
+	LC_SEGMENT_64 = 0x19
+
+	// Segment protections
+	VM_PROT_NONE    = 0x0
+	VM_PROT_READ    = 0x1
+	VM_PROT_WRITE   = 0x2
+	VM_PROT_EXECUTE = 0x4
+
+	// Section types and attributes
+	S_ZEROFILL               = 0x1
+	S_ATTR_PURE_INSTRUCTIONS = 0x80000000
+	S_ATTR_SOME_INSTRUCTIONS = 0x00000400
+	x86_THREAD_STATE64       = 4
+	x86_THREAD_STATE64_COUNT = 42 // 32-bit words of register state
+	threadStateRIP           = 16 // index of RIP in the register state
+	MachHeader64Size         = 32
+	SegmentCommand64Size     = 72
+	Section64Size            = 80
+	UnixThreadCommandSize    = 16 + 4*x86_THREAD_STATE64_COUNT
+	PageSize                 = 0x1000
+	DefaultTextBase          = 0x100000000 // __PAGEZERO covers the low 4 GiB
+	DefaultCodeBase          = DefaultTextBase + PageSize
+	DefaultDataBase          = 0x200000000
+	ARM64PageSize            = 0x4000 // Apple silicon has 16 KiB pages
+	DefaultARM64CodeBase     = DefaultTextBase + ARM64PageSize
+)
+
+// Segment is a segment to be mapped: __TEXT with the code, or a zero-fill
+// segment with no file data.
+type Segment struct {
+	Name     string // eg. __TEXT
+	Section  string // the one section describing it, eg. __text
+	VAddr    uint64
+	Data     []byte // nil for zero-fill
+	VMSize   uint64
+	Prot     uint32 // VM_PROT_READ, VM_PROT_WRITE, VM_PROT_EXECUTE
+	ZeroFill bool
+}
+
+// Builder constructs a Mach-O 64 executable.
+type Builder struct {
+	entry    uint64
+	text     *Segment
+	segments []Segment // zero-fill segments
+	arm64    bool      // a signed, dyld-loaded arm64 executable
+	pageSize uint64
+}
+
+// NewBuilder creates a new Mach-O builder, for a static x86_64 executable.
+func NewBuilder() *Builder {
+	return &Builder{pageSize: PageSize}
+}
+
+// SetEntry sets the entry point virtual address, the RIP LC_UNIXTHREAD
+// starts at, or for arm64 the main function LC_MAIN names.
+func (b *Builder) SetEntry(vaddr uint64) {
+	b.entry = vaddr
+}
+
+// SetText sets the code, loaded read-only and executable at vaddr as the
+// __text section. As usual the __TEXT segment also maps the headers, in
+// the page before vaddr, so vaddr must be page aligned and above the low
+// 4 GiB that __PAGEZERO reserves, eg. DefaultCodeBase or
+// DefaultARM64CodeBase.
+func (b *Builder) SetText(code []byte, vaddr uint64) {
+	b.text = &Segment{
+		Name:    "__TEXT",
+		Section: "__text",
+		VAddr:   vaddr - b.pageSize,
+		Data:    code,
+		VMSize:  alignUp(b.pageSize+uint64(len(code)), b.pageSize),
+		Prot:    VM_PROT_READ | VM_PROT_EXECUTE,
+	}
+}
+
+// AddZeroFillSegment adds a zero-initialized segment with no file data,
+// eg. __DATA holding __bss.
+func (b *Builder) AddZeroFillSegment(name, section string, vaddr, size uint64, prot uint32) {
+	b.segments = append(b.segments, Segment{
+		Name:     name,
+		Section:  section,
+		VAddr:    vaddr,
+		VMSize:   alignUp(size, b.pageSize),
+		Prot:     prot,
+		ZeroFill: true,
+	})
+}
+
+// Build produces the final Mach-O binary: the header and load commands in
+// the first page, then the code.
+func (b *Builder) Build() []byte {
+	if b.arm64 {
+		return b.buildARM64()
+	}
+
+	segments := []Segment{*b.text}
+	segments = append(segments, b.segments...)
+
+	ncmds := 1 + len(segments) + 1 // __PAGEZERO, the segments, the thread
+	sizeofcmds := SegmentCommand64Size + len(segments)*(SegmentCommand64Size+Section64Size) + UnixThreadCommandSize
+
+	out := make([]byte, 0, PageSize+len(b.text.Data))
+	out = le32(out, MH_MAGIC_64)
+	out = le32(out, CPU_TYPE_X86_64)
+	out = le32(out, CPU_SUBTYPE_X86_ALL)
+	out = le32(out, MH_EXECUTE)
+	out = le32(out, uint32(ncmds))
+	out = le32(out, uint32(sizeofcmds))
+	out = le32(out, MH_NOUNDEFS)
+	out = le32(out, 0) // reserved
+
+	// __PAGEZERO: no access below __TEXT, so null pointers fault
+	out = writeSegment(out, "__PAGEZERO", 0, b.text.VAddr, 0, 0, VM_PROT_NONE, 0)
+
+	for _, seg := range segments {
+		var fileSize uint64
+		if !seg.ZeroFill {
+			fileSize = PageSize + uint64(len(seg.Data))
+		}
+		out = writeSegment(out, seg.Name, seg.VAddr, seg.VMSize, 0, fileSize, seg.Prot, 1)
+
+		sect := Section64{Addr: seg.VAddr, Size: seg.VMSize, Align: 4}
+		copy(sect.SectName[:], seg.Section)
+		copy(sect.SegName[:], seg.Name)
+		if seg.ZeroFill {
+			sect.Flags = S_ZEROFILL
+		} else {
+			sect.Addr += PageSize
+			sect.Size = uint64(len(seg.Data))
+			sect.Offset = PageSize
+			sect.Flags = S_ATTR_PURE_INSTRUCTIONS | S_ATTR_SOME_INSTRUCTIONS
+		}
+		out = writeSection(out, &sect)
+	}
+
+	// LC_UNIXTHREAD: every register zero but RIP
+	out = le32(out, LC_UNIXTHREAD)
+	out = le32(out, UnixThreadCommandSize)
+	out = le32(out, x86_THREAD_STATE64)
+	out = le32(out, x86_THREAD_STATE64_COUNT)
+	for i := range x86_THREAD_STATE64_COUNT / 2 {
+		var reg uint64
+		if i == threadStateRIP {
+			reg = b.entry
+		}
+		out = binary.LittleEndian.AppendUint64(out, reg)
+	}
+
+	// Pad to the code
+	for len(out) < PageSize {
+		out = append(out, 0)
+	}
+	return append(out, b.text.Data...)
+}
+
+// Section64 represents a Mach-O section_64.
+type Section64 struct {
+	SectName [16]byte
+	SegName  [16]byte
+	Addr     uint64
+	Size     uint64
+	Offset   uint32 // file offset, 0 for zero-fill
+	Align    uint32 // as a power of two
+	RelOff   uint32
+	NReloc   uint32
+	Flags    uint32
+}
+
+// writeSegment appends an LC_SEGMENT_64 command followed by nsects
+// sections.
+func writeSegment(out []byte, name string, vaddr, vmsize, fileoff, filesize uint64, prot uint32, nsects int) []byte {
+	var segname [16]byte
+	copy(segname[:], name)
+
+	out = le32(out, LC_SEGMENT_64)
+	out = le32(out, uint32(SegmentCommand64Size+nsects*Section64Size))
+	out = append(out, segname[:]...)
+	out = binary.LittleEndian.AppendUint64(out, vaddr)
+	out = binary.LittleEndian.AppendUint64(out, vmsize)
+	out = binary.LittleEndian.AppendUint64(out, fileoff)
+	out = binary.LittleEndian.AppendUint64(out, filesize)
+	out = le32(out, prot) // maxprot
+	out = le32(out, prot) // initprot
+	out = le32(out, uint32(nsects))
+	return le32(out, 0) // flags
+}
+
+// writeSection appends a section_64.
+func writeSection(out []byte, s *Section64) []byte {
+	out = append(out, s.SectName[:]...)
+	out = append(out, s.SegName[:]...)
+	out = binary.LittleEndian.AppendUint64(out, s.Addr)
+	out = binary.LittleEndian.AppendUint64(out, s.Size)
+	out = le32(out, s.Offset)
+	out = le32(out, s.Align)
+	out = le32(out, s.RelOff)
+	out = le32(out, s.NReloc)
+	out = le32(out, s.Flags)
+	return append(out, make([]byte, 12)...) // reserved1-3
+}
+
+// le32 appends a little-endian uint32.
+func le32(out []byte, v uint32) []byte {
+	return binary.LittleEndian.AppendUint32(out, v)
+}
+
+// alignUp rounds n up to a multiple of align.
+func alignUp(n, align uint64) uint64 {
+	return (n + align - 1) &^ (align - 1)
+}
@@ -0,0 +1,49 @@
+// Package mos6502 provides MOS 6502 machine code encoding utilities, for
+// the Commodore 64 and other 8-bit machines built around the 6502 or 6510.
+// This package has no dependencies on compiler internals and can be used
+// standalone for generating 6502 machine code.
+//
+// Instructions are one to three bytes, with 16-bit operands little-endian.
+// Only the documented NMOS opcodes are used, so the code runs on any
+// 6502 and its variants.
+package mos6502
+
+// Cond is the opcode of a conditional branch, which jumps by a signed
+// 8-bit offset counted from the end of the branch.
+type Cond uint8
+
+// Conditional branches.
+const (
+	BPL Cond = 0x10 // branch if N clear
+	BMI Cond = 0x30 // branch if N set
+	BVC Cond = 0x50 // branch if V clear
+	BVS Cond = 0x70 // branch if V set
+	BCC Cond = 0x90 // branch if C clear
+	BCS Cond = 0xB0 // branch if C set
+	BNE Cond = 0xD0 // branch if Z clear
+	BEQ Cond = 0xF0 // branch if Z set
+)
+
+// Invert returns the branch taken exactly when c is not.
+func (c Cond) Invert() Cond {
+	return c ^ 0x20
+}
+
+// BranchSize is the size in bytes of a conditional branch.
+const BranchSize = 2
+
+// FitsBranch reports whether off, counted from the end of a branch, is in
+// a branch's reach.
+func FitsBranch(off int) bool {
+	return off >= -128 && off <= 127
+}
+
+// imm encodes an instruction with an 8-bit immediate or zero page operand.
+func imm(op, v byte) []byte {
+	return []byte{op, v}
+}
+
+// abs encodes an instruction with a 16-bit absolute operand.
+func abs(op byte, addr uint16) []byte {
+	return []byte{op, byte(addr), byte(addr >> 8)}
+}
@@ -0,0 +1,169 @@
+package mos6502
+
+// This file contains 6502 instruction encoders, named after the mnemonic
+// and addressing mode. Each function returns the machine code bytes for a
+// specific instruction. See:
+// https://www.masswerk.at/6502/6502_instruction_set.html
+
+// LdaImm encodes: LDA #v (A9 v)
+func LdaImm(v byte) []byte {
+	return imm(0xA9, v)
+}
+
+// LdaZP encodes: LDA zp (A5 zp)
+func LdaZP(zp byte) []byte {
+	return imm(0xA5, zp)
+}
+
+// LdaIndY encodes: LDA (zp),Y (B1 zp)
+// Loads the byte Y past the address held in zp and zp+1.
+func LdaIndY(zp byte) []byte {
+	return imm(0xB1, zp)
+}
+
+// LdaAbsX encodes: LDA addr,X (BD addr)
+func LdaAbsX(addr uint16) []byte {
+	return abs(0xBD, addr)
+}
+
+// StaZP encodes: STA zp (85 zp)
+func StaZP(zp byte) []byte {
+	return imm(0x85, zp)
+}
+
+// StaIndY encodes: STA (zp),Y (91 zp)
+func StaIndY(zp byte) []byte {
+	return imm(0x91, zp)
+}
+
+// LdxImm encodes: LDX #v (A2 v)
+func LdxImm(v byte) []byte {
+	return imm(0xA2, v)
+}
+
+// LdxZP encodes: LDX zp (A6 zp)
+func LdxZP(zp byte) []byte {
+	return imm(0xA6, zp)
+}
+
+// StxZP encodes: STX zp (86 zp)
+func StxZP(zp byte) []byte {
+	return imm(0x86, zp)
+}
+
+// LdyImm encodes: LDY #v (A0 v)
+func LdyImm(v byte) []byte {
+	return imm(0xA0, v)
+}
+
+// AdcImm encodes: ADC #v (69 v)
+func AdcImm(v byte) []byte {
+	return imm(0x69, v)
+}
+
+// SbcImm encodes: SBC #v (E9 v)
+func SbcImm(v byte) []byte {
+	return imm(0xE9, v)
+}
+
+// AndImm encodes: AND #v (29 v)
+func AndImm(v byte) []byte {
+	return imm(0x29, v)
+}
+
+// OraImm encodes: ORA #v (09 v)
+func OraImm(v byte) []byte {
+	return imm(0x09, v)
+}
+
+// CmpImm encodes: CMP #v (C9 v)
+func CmpImm(v byte) []byte {
+	return imm(0xC9, v)
+}
+
+// IncZP encodes: INC zp (E6 zp)
+func IncZP(zp byte) []byte {
+	return imm(0xE6, zp)
+}
+
+// DecZP encodes: DEC zp (C6 zp)
+func DecZP(zp byte) []byte {
+	return imm(0xC6, zp)
+}
+
+// Inx encodes: INX (E8)
+func Inx() []byte {
+	return []byte{0xE8}
+}
+
+// Dex encodes: DEX (CA)
+func Dex() []byte {
+	return []byte{0xCA}
+}
+
+// Iny encodes: INY (C8)
+func Iny() []byte {
+	return []byte{0xC8}
+}
+
+// Dey encodes: DEY (88)
+func Dey() []byte {
+	return []byte{0x88}
+}
+
+// Tya encodes: TYA (98)
+func Tya() []byte {
+	return []byte{0x98}
+}
+
+// Tsx encodes: TSX (BA)
+func Tsx() []byte {
+	return []byte{0xBA}
+}
+
+// Txs encodes: TXS (9A)
+func Txs() []byte {
+	return []byte{0x9A}
+}
+
+// Clc encodes: CLC (18)
+func Clc() []byte {
+	return []byte{0x18}
+}
+
+// Sec encodes: SEC (38)
+func Sec() []byte {
+	return []byte{0x38}
+}
+
+// Cld encodes: CLD (D8)
+// Leaves decimal mode, for binary ADC and SBC.
+func Cld() []byte {
+	return []byte{0xD8}
+}
+
+// Branch encodes a conditional branch by off bytes from its end, which
+// must fit in a signed byte.
+func Branch(c Cond, off int8) []byte {
+	return imm(byte(c), byte(off))
+}
+
+// Jmp encodes: JMP addr (4C addr)
+func Jmp(addr uint16) []byte {
+	return abs(0x4C, addr)
+}
+
+// Jsr encodes: JSR addr (20 addr)
+func Jsr(addr uint16) []byte {
+	return abs(0x20, addr)
+}
+
+// Rts encodes: RTS (60)
+func Rts() []byte {
+	return []byte{0x60}
+}
+
+// Brk encodes: BRK (00)
+func Brk() []byte {
+	return []byte{0x00}
+}
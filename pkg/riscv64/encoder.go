@@ -0,0 +1,116 @@
+// Package riscv64 provides RISC-V (RV64I) machine code encoding utilities.
+// This package has no dependencies on compiler internals and can be used
+// standalone for generating RISC-V machine code.
+//
+// Every instruction is 4 bytes; the compressed extension is not used, so
+// the code runs on any RV64I core.
+package riscv64
+
+import "encoding/binary"
+
+// Reg is an integer register, x0 to x31.
+type Reg uint32
+
+// Registers by their ABI names.
+const (
+	Zero Reg = iota // hard-wired zero
+	RA              // return address
+	SP              // stack pointer
+	GP              // global pointer
+	TP              // thread pointer
+	T0
+	T1
+	T2
+	S0
+	S1
+	A0
+	A1
+	A2
+	A3
+	A4
+	A5
+	A6
+	A7
+	S2
+	S3
+	S4
+	S5
+	S6
+	S7
+	S8
+	S9
+	S10
+	S11
+	T3
+	T4
+	T5
+	T6
+)
+
+// Major opcodes.
+const (
+	opLoad   = 0x03
+	opImm    = 0x13
+	opAuipc  = 0x17
+	opImm32  = 0x1b
+	opStore  = 0x23
+	opReg    = 0x33
+	opLui    = 0x37
+	opBranch = 0x63
+	opJalr   = 0x67
+	opJal    = 0x6f
+	opSystem = 0x73
+)
+
+// word returns an instruction as its 4 little-endian bytes.
+func word(w uint32) []byte {
+	return binary.LittleEndian.AppendUint32(make([]byte, 0, 4), w)
+}
+
+// rType encodes a register-register instruction.
+func rType(opcode, funct3, funct7 uint32, rd, rs1, rs2 Reg) []byte {
+	return word(funct7<<25 | uint32(rs2)<<20 | uint32(rs1)<<15 | funct3<<12 | uint32(rd)<<7 | opcode)
+}
+
+// iType encodes an instruction with a 12-bit signed immediate.
+func iType(opcode, funct3 uint32, rd, rs1 Reg, imm int32) []byte {
+	return word(uint32(imm)&0xfff<<20 | uint32(rs1)<<15 | funct3<<12 | uint32(rd)<<7 | opcode)
+}
+
+// sType encodes a store, with its 12-bit offset split around rs2.
+func sType(funct3 uint32, rs1, rs2 Reg, imm int32) []byte {
+	u := uint32(imm)
+	return word(u>>5&0x7f<<25 | uint32(rs2)<<20 | uint32(rs1)<<15 | funct3<<12 | u&0x1f<<7 | opStore)
+}
+
+// bType encodes a conditional branch to off bytes from the branch, which
+// must be even and within ±4 KiB.
+func bType(funct3 uint32, rs1, rs2 Reg, off int32) []byte {
+	u := uint32(off)
+	return word(u>>12&1<<31 | u>>5&0x3f<<25 | uint32(rs2)<<20 | uint32(rs1)<<15 |
+		funct3<<12 | u>>1&0xf<<8 | u>>11&1<<7 | opBranch)
+}
+
+// uType encodes an instruction with a 20-bit upper immediate.
+func uType(opcode uint32, rd Reg, imm20 int32) []byte {
+	return word(uint32(imm20)&0xfffff<<12 | uint32(rd)<<7 | opcode)
+}
+
+// FitsImm12 reports whether v fits a 12-bit signed immediate.
+func FitsImm12(v int64) bool {
+	return v >= -2048 && v < 2048
+}
+
+// FitsJal reports whether a jal can reach off bytes away (±1 MiB).
+func FitsJal(off int64) bool {
+	return off >= -1<<20 && off < 1<<20
+}
+
+// HiLo splits a 32-bit offset into the immediates of an auipc (or lui)
+// and the addi, load or jalr that follows it, allowing for the low part
+// being sign-extended.
+func HiLo(off int32) (hi, lo int32) {
+	hi = (off + 0x800) >> 12
+	lo = off - hi<<12
+	return hi, lo
+}
@@ -0,0 +1,164 @@
+package riscv64
+
+// This file contains RV64I instruction encoders. Each function returns the
+// 4 bytes of one instruction, named after its assembler mnemonic.
+//
+// For the encodings see the RISC-V unprivileged ISA specification, chapter
+// "RV32I Base Integer Instruction Set" and the RV64I additions.
+
+// Lui encodes: lui rd, imm20 - rd = imm20 << 12, sign-extended.
+func Lui(rd Reg, imm20 int32) []byte {
+	return uType(opLui, rd, imm20)
+}
+
+// Auipc encodes: auipc rd, imm20 - rd = pc + imm20 << 12.
+func Auipc(rd Reg, imm20 int32) []byte {
+	return uType(opAuipc, rd, imm20)
+}
+
+// Jal encodes: jal rd, off - jump off bytes from here (±1 MiB), saving the
+// return address in rd.
+func Jal(rd Reg, off int32) []byte {
+	u := uint32(off)
+	return word(u>>20&1<<31 | u>>1&0x3ff<<21 | u>>11&1<<20 | u>>12&0xff<<12 | uint32(rd)<<7 | opJal)
+}
+
+// Jalr encodes: jalr rd, off(rs1) - jump to rs1 + off, saving the return
+// address in rd.
+func Jalr(rd, rs1 Reg, off int32) []byte {
+	return iType(opJalr, 0, rd, rs1, off)
+}
+
+// Ret encodes: ret (jalr zero, 0(ra)).
+func Ret() []byte {
+	return Jalr(Zero, RA, 0)
+}
+
+// Beq encodes: beq rs1, rs2, off
+func Beq(rs1, rs2 Reg, off int32) []byte {
+	return bType(0, rs1, rs2, off)
+}
+
+// Bne encodes: bne rs1, rs2, off
+func Bne(rs1, rs2 Reg, off int32) []byte {
+	return bType(1, rs1, rs2, off)
+}
+
+// Blt encodes: blt rs1, rs2, off (signed)
+func Blt(rs1, rs2 Reg, off int32) []byte {
+	return bType(4, rs1, rs2, off)
+}
+
+// Bge encodes: bge rs1, rs2, off (signed)
+func Bge(rs1, rs2 Reg, off int32) []byte {
+	return bType(5, rs1, rs2, off)
+}
+
+// Bltu encodes: bltu rs1, rs2, off (unsigned)
+func Bltu(rs1, rs2 Reg, off int32) []byte {
+	return bType(6, rs1, rs2, off)
+}
+
+// Bgeu encodes: bgeu rs1, rs2, off (unsigned)
+func Bgeu(rs1, rs2 Reg, off int32) []byte {
+	return bType(7, rs1, rs2, off)
+}
+
+// Beqz encodes: beqz rs, off (beq rs, zero, off)
+func Beqz(rs Reg, off int32) []byte {
+	return Beq(rs, Zero, off)
+}
+
+// Bnez encodes: bnez rs, off (bne rs, zero, off)
+func Bnez(rs Reg, off int32) []byte {
+	return Bne(rs, Zero, off)
+}
+
+// Lb encodes: lb rd, off(rs1) - load a sign-extended byte.
+func Lb(rd, rs1 Reg, off int32) []byte {
+	return iType(opLoad, 0, rd, rs1, off)
+}
+
+// Lbu encodes: lbu rd, off(rs1) - load a zero-extended byte.
+func Lbu(rd, rs1 Reg, off int32) []byte {
+	return iType(opLoad, 4, rd, rs1, off)
+}
+
+// Ld encodes: ld rd, off(rs1) - load a doubleword.
+func Ld(rd, rs1 Reg, off int32) []byte {
+	return iType(opLoad, 3, rd, rs1, off)
+}
+
+// Sb encodes: sb rs2, off(rs1) - store the low byte of rs2.
+func Sb(rs2, rs1 Reg, off int32) []byte {
+	return sType(0, rs1, rs2, off)
+}
+
+// Addi encodes: addi rd, rs1, imm
+func Addi(rd, rs1 Reg, imm int32) []byte {
+	return iType(opImm, 0, rd, rs1, imm)
+}
+
+// Addiw encodes: addiw rd, rs1, imm - add and sign-extend the low 32 bits.
+func Addiw(rd, rs1 Reg, imm int32) []byte {
+	return iType(opImm32, 0, rd, rs1, imm)
+}
+
+// Sltiu encodes: sltiu rd, rs1, imm - rd = rs1 < imm, unsigned.
+func Sltiu(rd, rs1 Reg, imm int32) []byte {
+	return iType(opImm, 3, rd, rs1, imm)
+}
+
+// Andi encodes: andi rd, rs1, imm
+func Andi(rd, rs1 Reg, imm int32) []byte {
+	return iType(opImm, 7, rd, rs1, imm)
+}
+
+// Srli encodes: srli rd, rs1, shamt - logical shift right by 0 to 63.
+func Srli(rd, rs1 Reg, shamt int32) []byte {
+	return iType(opImm, 5, rd, rs1, shamt&0x3f)
+}
+
+// Mv encodes: mv rd, rs (addi rd, rs, 0)
+func Mv(rd, rs Reg) []byte {
+	return Addi(rd, rs, 0)
+}
+
+// Nop encodes: nop (addi zero, zero, 0)
+func Nop() []byte {
+	return Addi(Zero, Zero, 0)
+}
+
+// Add encodes: add rd, rs1, rs2
+func Add(rd, rs1, rs2 Reg) []byte {
+	return rType(opReg, 0, 0, rd, rs1, rs2)
+}
+
+// Sub encodes: sub rd, rs1, rs2
+func Sub(rd, rs1, rs2 Reg) []byte {
+	return rType(opReg, 0, 0x20, rd, rs1, rs2)
+}
+
+// Ecall encodes: ecall
+func Ecall() []byte {
+	return word(opSystem)
+}
+
+// Ebreak encodes: ebreak, which raises SIGTRAP under Linux.
+func Ebreak() []byte {
+	return word(1<<20 | opSystem)
+}
+
+// Li encodes: li rd, imm for a 32-bit immediate, as one addi or a lui and
+// addiw.
+func Li(rd Reg, imm int32) []byte {
+	if FitsImm12(int64(imm)) {
+		return Addi(rd, Zero, imm)
+	}
+	hi, lo := HiLo(imm)
+	out := Lui(rd, hi)
+	if lo != 0 {
+		out = append(out, Addiw(rd, rd, lo)...)
+	}
+	return out
+}
@@ -0,0 +1,64 @@
+// Package wasm provides WebAssembly binary encoding utilities: the
+// instructions of function bodies and a builder for whole modules. This
+// package has no dependencies on compiler internals and can be used
+// standalone for generating WebAssembly.
+//
+// Modules are in the 1.0 binary format, plus the bulk memory operations
+// (memory.fill and memory.copy), which every current browser and runtime
+// supports.
+package wasm
+
+// ValType is the type of a value on the operand stack, a local, a
+// parameter or a result.
+type ValType byte
+
+// Value types.
+const (
+	I32 ValType = 0x7f
+	I64 ValType = 0x7e
+)
+
+// BlockType is the result type of a block, loop or if: Void, or a single
+// ValType.
+type BlockType byte
+
+// Void is the block type with no result.
+const Void BlockType = 0x40
+
+// AppendULEB128 appends v in unsigned LEB128, as every index, count and
+// size in a module is encoded.
+func AppendULEB128(b []byte, v uint64) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+// AppendSLEB128 appends v in signed LEB128, as constants are encoded.
+func AppendSLEB128(b []byte, v int64) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 && c&0x40 == 0 || v == -1 && c&0x40 != 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+// appendName appends a name: its length, then its UTF-8 bytes.
+func appendName(b []byte, name string) []byte {
+	b = AppendULEB128(b, uint64(len(name)))
+	return append(b, name...)
+}
+
+// appendVec appends a vector: the number of items, then their encodings
+// one after another.
+func appendVec(b []byte, n int, items []byte) []byte {
+	b = AppendULEB128(b, uint64(n))
+	return append(b, items...)
+}
@@ -0,0 +1,205 @@
+package wasm
+
+// This file contains instruction encoders. Each function returns the bytes
+// of one instruction, named after its text format mnemonic.
+//
+// For the encodings see the WebAssembly core specification, section
+// "Binary Format: Instructions".
+
+// Opcodes of the instructions encoded here.
+const (
+	opUnreachable = 0x00
+	opBlock       = 0x02
+	opLoop        = 0x03
+	opIf          = 0x04
+	opElse        = 0x05
+	opEnd         = 0x0b
+	opBr          = 0x0c
+	opBrIf        = 0x0d
+	opReturn      = 0x0f
+	opCall        = 0x10
+	opDrop        = 0x1a
+	opSelect      = 0x1b
+	opLocalGet    = 0x20
+	opLocalSet    = 0x21
+	opLocalTee    = 0x22
+	opI32Load     = 0x28
+	opI32Load8S   = 0x2c
+	opI32Load8U   = 0x2d
+	opI32Store    = 0x36
+	opI32Store8   = 0x3a
+	opI32Const    = 0x41
+	opI32Eqz      = 0x45
+	opI32LtS      = 0x48
+	opI32GtU      = 0x4b
+	opI32GeS      = 0x4e
+	opI32Add      = 0x6a
+	opI32Sub      = 0x6b
+	opPrefixFC    = 0xfc // bulk memory, with a LEB128 sub-opcode
+	opMemoryCopy  = 10
+	opMemoryFill  = 11
+)
+
+// Unreachable encodes: unreachable - trap.
+func Unreachable() []byte {
+	return []byte{opUnreachable}
+}
+
+// Block encodes: block bt - a label that br 0 inside jumps to the end of.
+func Block(bt BlockType) []byte {
+	return []byte{opBlock, byte(bt)}
+}
+
+// Loop encodes: loop bt - a label that br 0 inside jumps back to the start
+// of.
+func Loop(bt BlockType) []byte {
+	return []byte{opLoop, byte(bt)}
+}
+
+// If encodes: if bt - pop an i32 and run the block if it is not zero.
+func If(bt BlockType) []byte {
+	return []byte{opIf, byte(bt)}
+}
+
+// Else encodes: else - the block run when an if's condition is zero.
+func Else() []byte {
+	return []byte{opElse}
+}
+
+// End encodes: end - close a block, loop, if or function body.
+func End() []byte {
+	return []byte{opEnd}
+}
+
+// Br encodes: br depth - branch to the label depth blocks out, 0 being
+// the innermost.
+func Br(depth uint32) []byte {
+	return AppendULEB128([]byte{opBr}, uint64(depth))
+}
+
+// BrIf encodes: br_if depth - pop an i32 and branch if it is not zero.
+func BrIf(depth uint32) []byte {
+	return AppendULEB128([]byte{opBrIf}, uint64(depth))
+}
+
+// Return encodes: return
+func Return() []byte {
+	return []byte{opReturn}
+}
+
+// Call encodes: call fn - fn is an index into the imported functions, then
+// the module's own.
+func Call(fn uint32) []byte {
+	return AppendULEB128([]byte{opCall}, uint64(fn))
+}
+
+// Drop encodes: drop - pop and discard a value.
+func Drop() []byte {
+	return []byte{opDrop}
+}
+
+// Select encodes: select - pop a condition, then b and a, and push a if
+// the condition is not zero, else b.
+func Select() []byte {
+	return []byte{opSelect}
+}
+
+// LocalGet encodes: local.get idx
+func LocalGet(idx uint32) []byte {
+	return AppendULEB128([]byte{opLocalGet}, uint64(idx))
+}
+
+// LocalSet encodes: local.set idx
+func LocalSet(idx uint32) []byte {
+	return AppendULEB128([]byte{opLocalSet}, uint64(idx))
+}
+
+// LocalTee encodes: local.tee idx - local.set that leaves the value on the
+// stack.
+func LocalTee(idx uint32) []byte {
+	return AppendULEB128([]byte{opLocalTee}, uint64(idx))
+}
+
+// memarg appends a load or store's alignment, as a power of two, and
+// offset.
+func memarg(b []byte, align, offset uint32) []byte {
+	b = AppendULEB128(b, uint64(align))
+	return AppendULEB128(b, uint64(offset))
+}
+
+// I32Load encodes: i32.load offset - pop an address and push the 4-byte
+// word at address + offset, which should be 4-byte aligned.
+func I32Load(offset uint32) []byte {
+	return memarg([]byte{opI32Load}, 2, offset)
+}
+
+// I32Store encodes: i32.store offset - pop a value and an address, and
+// store the value as a 4-byte word at address + offset.
+func I32Store(offset uint32) []byte {
+	return memarg([]byte{opI32Store}, 2, offset)
+}
+
+// I32Load8U encodes: i32.load8_u offset - pop an address and push the
+// byte at address + offset, zero-extended.
+func I32Load8U(offset uint32) []byte {
+	return memarg([]byte{opI32Load8U}, 0, offset)
+}
+
+// I32Load8S encodes: i32.load8_s offset - i32.load8_u, sign-extended.
+func I32Load8S(offset uint32) []byte {
+	return memarg([]byte{opI32Load8S}, 0, offset)
+}
+
+// I32Store8 encodes: i32.store8 offset - pop a value and an address, and
+// store the value's low byte at address + offset.
+func I32Store8(offset uint32) []byte {
+	return memarg([]byte{opI32Store8}, 0, offset)
+}
+
+// I32Const encodes: i32.const v
+func I32Const(v int32) []byte {
+	return AppendSLEB128([]byte{opI32Const}, int64(v))
+}
+
+// I32Eqz encodes: i32.eqz - push 1 if the popped value is zero, else 0.
+func I32Eqz() []byte {
+	return []byte{opI32Eqz}
+}
+
+// I32LtS encodes: i32.lt_s
+func I32LtS() []byte {
+	return []byte{opI32LtS}
+}
+
+// I32GtU encodes: i32.gt_u
+func I32GtU() []byte {
+	return []byte{opI32GtU}
+}
+
+// I32GeS encodes: i32.ge_s
+func I32GeS() []byte {
+	return []byte{opI32GeS}
+}
+
+// I32Add encodes: i32.add
+func I32Add() []byte {
+	return []byte{opI32Add}
+}
+
+// I32Sub encodes: i32.sub
+func I32Sub() []byte {
+	return []byte{opI32Sub}
+}
+
+// MemoryFill encodes: memory.fill - pop a size, a byte value and a
+// destination, and set the size bytes from the destination to the value.
+func MemoryFill() []byte {
+	return []byte{opPrefixFC, opMemoryFill, 0}
+}
+
+// MemoryCopy encodes: memory.copy - pop a size, a source and a
+// destination, and copy the size bytes, as if through a temporary buffer
+// when they overlap.
+func MemoryCopy() []byte {
+	return []byte{opPrefixFC, opMemoryCopy, 0, 0}
+}
@@ -0,0 +1,235 @@
+package wasm
+
+import "slices"
+
+// Module format constants
+const (
+	Magic   = "\x00asm"
+	Version = 1
+
+	PageSize = 0x10000 // linear memory is sized in 64 KiB pages
+)
+
+// Section IDs, in the order sections must appear.
+const (
+	secType     = 1
+	secImport   = 2
+	secFunction = 3
+	secMemory   = 5
+	secExport   = 7
+	secCode     = 10
+	secData     = 11
+)
+
+// Import and export kinds.
+const (
+	kindFunc   = 0x00
+	kindMemory = 0x02
+)
+
+// FuncType is a function signature.
+type FuncType struct {
+	Params  []ValType
+	Results []ValType
+}
+
+// function is one of the module's own functions.
+type function struct {
+	typ    uint32
+	locals []ValType
+	body   []byte
+}
+
+// importedFunc is a function the host provides.
+type importedFunc struct {
+	module, name string
+	typ          uint32
+}
+
+// export is a function or memory the host can reach by name.
+type export struct {
+	name  string
+	kind  byte
+	index uint32
+}
+
+// data is bytes the memory holds at an offset when the module starts.
+type data struct {
+	offset uint32
+	bytes  []byte
+}
+
+// Module constructs a WebAssembly module with at most one linear memory.
+type Module struct {
+	types   []FuncType
+	imports []importedFunc
+	funcs   []function
+	exports []export
+	data    []data
+
+	hasMemory bool
+	memMin    uint32 // pages
+	memMax    uint32 // pages
+}
+
+// NewModule creates an empty module.
+func NewModule() *Module {
+	return &Module{}
+}
+
+// typeIndex returns the index of typ in the type section, adding it if it
+// is new.
+func (m *Module) typeIndex(typ FuncType) uint32 {
+	for i, t := range m.types {
+		if slices.Equal(t.Params, typ.Params) && slices.Equal(t.Results, typ.Results) {
+			return uint32(i)
+		}
+	}
+	m.types = append(m.types, typ)
+	return uint32(len(m.types) - 1)
+}
+
+// ImportFunc adds a function the host provides as module.name, and
+// returns its function index. Imported functions are numbered before the
+// module's own, so they must all be added before any AddFunc.
+func (m *Module) ImportFunc(module, name string, typ FuncType) uint32 {
+	if len(m.funcs) > 0 {
+		panic("wasm: ImportFunc after AddFunc")
+	}
+	m.imports = append(m.imports, importedFunc{module: module, name: name, typ: m.typeIndex(typ)})
+	return uint32(len(m.imports) - 1)
+}
+
+// AddFunc adds a function with the given locals after its parameters, and
+// returns its function index. body is its instructions, without the final
+// end, which Build adds.
+func (m *Module) AddFunc(typ FuncType, locals []ValType, body []byte) uint32 {
+	m.funcs = append(m.funcs, function{typ: m.typeIndex(typ), locals: locals, body: body})
+	return uint32(len(m.imports) + len(m.funcs) - 1)
+}
+
+// SetMemory gives the module a zeroed linear memory of min pages, which
+// memory.grow can take up to max.
+func (m *Module) SetMemory(min, max uint32) {
+	m.hasMemory, m.memMin, m.memMax = true, min, max
+}
+
+// AddData initialises the memory at offset with b when the module is
+// instantiated.
+func (m *Module) AddData(offset uint32, b []byte) {
+	m.data = append(m.data, data{offset: offset, bytes: b})
+}
+
+// ExportFunc makes function fn callable by the host as name.
+func (m *Module) ExportFunc(name string, fn uint32) {
+	m.exports = append(m.exports, export{name: name, kind: kindFunc, index: fn})
+}
+
+// ExportMemory makes the linear memory readable and writable by the host
+// as name.
+func (m *Module) ExportMemory(name string) {
+	m.exports = append(m.exports, export{name: name, kind: kindMemory, index: 0})
+}
+
+// Build produces the binary module.
+func (m *Module) Build() []byte {
+	out := append([]byte(Magic), Version, 0, 0, 0)
+
+	var sec []byte
+	for _, t := range m.types {
+		sec = append(sec, 0x60) // func
+		sec = appendVec(sec, len(t.Params), valTypes(t.Params))
+		sec = appendVec(sec, len(t.Results), valTypes(t.Results))
+	}
+	out = appendSection(out, secType, len(m.types), sec)
+
+	sec = nil
+	for _, imp := range m.imports {
+		sec = appendName(sec, imp.module)
+		sec = appendName(sec, imp.name)
+		sec = append(sec, kindFunc)
+		sec = AppendULEB128(sec, uint64(imp.typ))
+	}
+	out = appendSection(out, secImport, len(m.imports), sec)
+
+	sec = nil
+	for _, f := range m.funcs {
+		sec = AppendULEB128(sec, uint64(f.typ))
+	}
+	out = appendSection(out, secFunction, len(m.funcs), sec)
+
+	if m.hasMemory {
+		sec = []byte{0x01} // limits with a maximum
+		sec = AppendULEB128(sec, uint64(m.memMin))
+		sec = AppendULEB128(sec, uint64(m.memMax))
+		out = appendSection(out, secMemory, 1, sec)
+	}
+
+	sec = nil
+	for _, e := range m.exports {
+		sec = appendName(sec, e.name)
+		sec = append(sec, e.kind)
+		sec = AppendULEB128(sec, uint64(e.index))
+	}
+	out = appendSection(out, secExport, len(m.exports), sec)
+
+	sec = nil
+	for _, f := range m.funcs {
+		code := appendLocals(nil, f.locals)
+		code = append(code, f.body...)
+		code = append(code, opEnd)
+		sec = AppendULEB128(sec, uint64(len(code)))
+		sec = append(sec, code...)
+	}
+	out = appendSection(out, secCode, len(m.funcs), sec)
+
+	sec = nil
+	for _, d := range m.data {
+		sec = append(sec, 0x00) // active, in memory 0, at a constant offset
+		sec = append(sec, I32Const(int32(d.offset))...)
+		sec = append(sec, opEnd)
+		sec = appendVec(sec, len(d.bytes), d.bytes)
+	}
+	out = appendSection(out, secData, len(m.data), sec)
+
+	return out
+}
+
+// appendSection appends a section holding a vector of n items, unless it
+// is empty.
+func appendSection(b []byte, id byte, n int, items []byte) []byte {
+	if n == 0 {
+		return b
+	}
+	contents := appendVec(nil, n, items)
+	b = append(b, id)
+	b = AppendULEB128(b, uint64(len(contents)))
+	return append(b, contents...)
+}
+
+// appendLocals appends a function's local declarations, with runs of the
+// same type declared together.
+func appendLocals(b []byte, locals []ValType) []byte {
+	var runs []byte
+	n := 0
+	for i := 0; i < len(locals); {
+		j := i
+		for j < len(locals) && locals[j] == locals[i] {
+			j++
+		}
+		runs = AppendULEB128(runs, uint64(j-i))
+		runs = append(runs, byte(locals[i]))
+		n++
+		i = j
+	}
+	return appendVec(b, n, runs)
+}
+
+// valTypes returns types as bytes.
+func valTypes(types []ValType) []byte {
+	out := make([]byte, len(types))
+	for i, t := range types {
+		out[i] = byte(t)
+	}
+	return out
+}
@@ -0,0 +1,54 @@
+// Package z80 provides Zilog Z80 machine code encoding utilities, for CP/M
+// and other 8-bit machines built around the Z80. This package has no
+// dependencies on compiler internals and can be used standalone for
+// generating Z80 machine code.
+//
+// Instructions are one to four bytes, with 16-bit operands little-endian.
+// The Z80-only instructions have a prefix byte, 0xED, so the others also
+// run on an 8080.
+package z80
+
+// Cond is a condition code, tested by conditional jumps, calls and
+// returns. JR only takes NZ, Z, NC and C.
+type Cond uint8
+
+// Condition codes.
+const (
+	NZ Cond = 0 // Z clear
+	Z  Cond = 1 // Z set
+	NC Cond = 2 // C clear
+	C  Cond = 3 // C set
+	PO Cond = 4 // P/V clear: no overflow, after an add or subtract
+	PE Cond = 5 // P/V set: overflow
+	P  Cond = 6 // S clear
+	M  Cond = 7 // S set
+)
+
+// Invert returns the condition true exactly when c is not.
+func (c Cond) Invert() Cond {
+	return c ^ 1
+}
+
+// JrSize is the size in bytes of a relative jump.
+const JrSize = 2
+
+// FitsJr reports whether off, counted from the end of a relative jump, is
+// in its reach.
+func FitsJr(off int) bool {
+	return off >= -128 && off <= 127
+}
+
+// imm encodes an instruction with an 8-bit immediate operand.
+func imm(op, v byte) []byte {
+	return []byte{op, v}
+}
+
+// abs encodes an instruction with a 16-bit operand.
+func abs(op byte, nn uint16) []byte {
+	return []byte{op, byte(nn), byte(nn >> 8)}
+}
+
+// ed encodes an instruction with the 0xED prefix.
+func ed(op byte) []byte {
+	return []byte{0xED, op}
+}
@@ -0,0 +1,187 @@
+package z80
+
+// This file contains Z80 instruction encoders, named after the mnemonic
+// and operands. Each function returns the machine code bytes for a
+// specific instruction. See:
+// https://clrhome.org/table/
+
+// LdAImm encodes: LD A,n (3E n)
+func LdAImm(n byte) []byte {
+	return imm(0x3E, n)
+}
+
+// LdCImm encodes: LD C,n (0E n)
+func LdCImm(n byte) []byte {
+	return imm(0x0E, n)
+}
+
+// LdEImm encodes: LD E,n (1E n)
+func LdEImm(n byte) []byte {
+	return imm(0x1E, n)
+}
+
+// LdEA encodes: LD E,A (5F)
+func LdEA() []byte {
+	return []byte{0x5F}
+}
+
+// LdAHL encodes: LD A,(HL) (7E)
+func LdAHL() []byte {
+	return []byte{0x7E}
+}
+
+// LdHLA encodes: LD (HL),A (77)
+func LdHLA() []byte {
+	return []byte{0x77}
+}
+
+// LdHLImm encodes: LD (HL),n (36 n)
+func LdHLImm(n byte) []byte {
+	return imm(0x36, n)
+}
+
+// LdHL encodes: LD HL,nn (21 nn)
+func LdHL(nn uint16) []byte {
+	return abs(0x21, nn)
+}
+
+// LdDE encodes: LD DE,nn (11 nn)
+func LdDE(nn uint16) []byte {
+	return abs(0x11, nn)
+}
+
+// LdBC encodes: LD BC,nn (01 nn)
+func LdBC(nn uint16) []byte {
+	return abs(0x01, nn)
+}
+
+// LdHLInd encodes: LD HL,(nn) (2A nn)
+// Loads the word at address nn.
+func LdHLInd(nn uint16) []byte {
+	return abs(0x2A, nn)
+}
+
+// LdSPInd encodes: LD SP,(nn) (ED 7B nn)
+func LdSPInd(nn uint16) []byte {
+	return append(ed(0x7B), byte(nn), byte(nn>>8))
+}
+
+// LdDH encodes: LD D,H (54)
+func LdDH() []byte {
+	return []byte{0x54}
+}
+
+// LdEL encodes: LD E,L (5D)
+func LdEL() []byte {
+	return []byte{0x5D}
+}
+
+// AddAImm encodes: ADD A,n (C6 n)
+// Sets C on an unsigned carry and P/V on a signed overflow.
+func AddAImm(n byte) []byte {
+	return imm(0xC6, n)
+}
+
+// SubImm encodes: SUB n (D6 n)
+// Sets C on an unsigned borrow and P/V on a signed overflow.
+func SubImm(n byte) []byte {
+	return imm(0xD6, n)
+}
+
+// CpImm encodes: CP n (FE n)
+func CpImm(n byte) []byte {
+	return imm(0xFE, n)
+}
+
+// OrA encodes: OR A (B7)
+// Sets Z if A is zero, and clears C.
+func OrA() []byte {
+	return []byte{0xB7}
+}
+
+// IncHLInd encodes: INC (HL) (34)
+func IncHLInd() []byte {
+	return []byte{0x34}
+}
+
+// DecHLInd encodes: DEC (HL) (35)
+func DecHLInd() []byte {
+	return []byte{0x35}
+}
+
+// IncHL encodes: INC HL (23)
+func IncHL() []byte {
+	return []byte{0x23}
+}
+
+// DecHL encodes: DEC HL (2B)
+func DecHL() []byte {
+	return []byte{0x2B}
+}
+
+// IncDE encodes: INC DE (13)
+func IncDE() []byte {
+	return []byte{0x13}
+}
+
+// AddHLDE encodes: ADD HL,DE (19)
+func AddHLDE() []byte {
+	return []byte{0x19}
+}
+
+// SbcHLDE encodes: SBC HL,DE (ED 52)
+// Subtracts DE and the carry, setting C on a borrow.
+func SbcHLDE() []byte {
+	return ed(0x52)
+}
+
+// ExDEHL encodes: EX DE,HL (EB)
+func ExDEHL() []byte {
+	return []byte{0xEB}
+}
+
+// PushHL encodes: PUSH HL (E5)
+func PushHL() []byte {
+	return []byte{0xE5}
+}
+
+// PopHL encodes: POP HL (E1)
+func PopHL() []byte {
+	return []byte{0xE1}
+}
+
+// Ldir encodes: LDIR (ED B0)
+// Copies BC bytes from (HL) to (DE), counting up. BC must not be 0.
+func Ldir() []byte {
+	return ed(0xB0)
+}
+
+// Jp encodes: JP nn (C3 nn)
+func Jp(nn uint16) []byte {
+	return abs(0xC3, nn)
+}
+
+// JpCond encodes: JP cc,nn (C2+cc*8 nn)
+func JpCond(c Cond, nn uint16) []byte {
+	return abs(0xC2|byte(c)<<3, nn)
+}
+
+// Jr encodes: JR e (18 e), by e bytes from its end
+func Jr(e int8) []byte {
+	return imm(0x18, byte(e))
+}
+
+// JrCond encodes: JR cc,e (20+cc*8 e), for NZ, Z, NC or C
+func JrCond(c Cond, e int8) []byte {
+	return imm(0x20|byte(c)<<3, byte(e))
+}
+
+// Call encodes: CALL nn (CD nn)
+func Call(nn uint16) []byte {
+	return abs(0xCD, nn)
+}
+
+// Ret encodes: RET (C9)
+func Ret() []byte {
+	return []byte{0xC9}
+}
@@ -0,0 +1,2 @@
+echo input until a zero byte
+,[.,]
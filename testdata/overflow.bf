@@ -0,0 +1,3 @@
+Decrement an empty cell then print it
+wrap prints 0xff and saturate prints 0x00 while trap stops
+-.